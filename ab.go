@@ -0,0 +1,269 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- A/B Toggle ---
+
+// abHistoryLimit bounds the phases kept in the history of a test.
+const abHistoryLimit = 1000
+
+// ABProfile is one side of an A/B test: a named rule held for Duration.
+// Without options the interface runs unimpaired during the phase.
+type ABProfile struct {
+	Name     string            `json:"name"`
+	Duration string            `json:"duration"` // Go duration, e.g. "5m"
+	Options  *V4NetworkOptions `json:"options,omitempty"`
+	duration time.Duration
+}
+
+// ABPhase is a finished (or the running) phase of a test with the
+// interface counters over it, so measurements can be aligned with it.
+type ABPhase struct {
+	Cycle    int            `json:"cycle"`
+	Profile  string         `json:"profile"`
+	Start    TcTime         `json:"start"`
+	End      *TcTime        `json:"end,omitempty"` // nil while running
+	Counters *IfaceCounters `json:"counters,omitempty"`
+}
+
+// ABTest alternates an interface between profiles A and B, for Cycles A+B
+// rounds (0 = until stopped).
+type ABTest struct {
+	Iface     string     `json:"iface"`
+	Direction string     `json:"direction"`
+	A         *ABProfile `json:"a"`
+	B         *ABProfile `json:"b"`
+	Cycles    int        `json:"cycles,omitempty"`
+
+	Active       *ABPhase   `json:"active,omitempty"`
+	History      []*ABPhase `json:"history"`
+	HistoryTotal int        `json:"historyTotal"` // 'history' may be a page of it (offset, limit)
+}
+
+// abTests holds the A/B test of each interface (guarded by sched).
+var abTests = map[string]*ABTest{}
+
+// validate checks the test and parses the phase durations.
+func (t *ABTest) validate() error {
+	if t.Iface == "" || t.Direction == "" {
+		return fmt.Errorf("ab: 'iface' and 'direction' are required")
+	}
+	if t.Cycles < 0 {
+		return fmt.Errorf("ab: 'cycles' must be >= 0")
+	}
+	for _, p := range []struct {
+		side    string
+		profile *ABProfile
+	}{{"a", t.A}, {"b", t.B}} {
+		if p.profile == nil || p.profile.Name == "" {
+			return fmt.Errorf("ab: '%s.name' is required", p.side)
+		}
+		d, err := time.ParseDuration(p.profile.Duration)
+		if err != nil || d < time.Second {
+			return fmt.Errorf("ab: invalid '%s.duration' %q (at least 1s)", p.side, p.profile.Duration)
+		}
+		p.profile.duration = d
+		if opts := p.profile.Options; opts != nil {
+			opts.Iface, opts.Direction = t.Iface, t.Direction
+			if err := opts.validateNetem(); err != nil {
+				return err
+			}
+		}
+	}
+	if t.A.Name == t.B.Name {
+		return fmt.Errorf("ab: the profiles need different names")
+	}
+	t.History = []*ABPhase{}
+	return nil
+}
+
+// applyProfile applies p (or resets the test's direction of the interface)
+// and returns the rule now in place.
+func (t *ABTest) applyProfile(ctx context.Context, p *ABProfile, prev *V4NetworkOptions) (*V4NetworkOptions, error) {
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if ctx.Err() != nil { // Stopped (e.g. reset) while waiting for the lock
+		return prev, ctx.Err()
+	}
+	by := Actor{Source: "ab", User: p.Name}
+	if p.Options == nil {
+		if err := cleanupDirection(ctx, t.Iface, t.Direction); err != nil {
+			return prev, err
+		}
+		if rule := store.Get(t.Iface, t.Direction); rule != nil {
+			store.DeleteByID(rule.ID, by)
+		}
+		return nil, nil
+	}
+	opts := *p.Options
+	if err := opts.Adjust(ctx, prev); err != nil {
+		return prev, err
+	}
+	store.Set(&opts, by)
+	return &opts, nil
+}
+
+// run alternates the profiles, recording the counters of every phase.
+func (t *ABTest) run(ctx context.Context) {
+	var prev *V4NetworkOptions
+	counterOpts := &V4NetworkOptions{Iface: t.Iface, Direction: t.Direction}
+	for cycle := 1; t.Cycles == 0 || cycle <= t.Cycles; cycle++ {
+		for _, p := range []*ABProfile{t.A, t.B} {
+			log.Printf("[INFO] AB: %s: cycle %d, profile %q for %v", t.Iface, cycle, p.Name, p.duration)
+			var err error
+			if prev, err = t.applyProfile(ctx, p, prev); err != nil {
+				if ctx.Err() != nil {
+					return
+				}
+				log.Printf("[ERROR] AB: %s: failed to apply profile %q: %v", t.Iface, p.Name, err)
+			}
+
+			start := readIfaceCounters(ctx, counterOpts)
+			phase := &ABPhase{Cycle: cycle, Profile: p.Name, Start: start.At}
+			sched.mu.Lock()
+			t.Active = phase
+			sched.mu.Unlock()
+
+			timer := time.NewTimer(p.duration)
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+			case <-timer.C:
+			}
+			end := readIfaceCounters(context.Background(), counterOpts)
+			sched.mu.Lock()
+			phase.End, phase.Counters = &end.At, end.since(start)
+			t.Active = nil
+			t.History = append(t.History, phase)
+			if len(t.History) > abHistoryLimit {
+				t.History = t.History[len(t.History)-abHistoryLimit:]
+			}
+			sched.mu.Unlock()
+			if ctx.Err() != nil {
+				return
+			}
+		}
+	}
+	log.Printf("[INFO] AB: %s: finished %d cycle(s)", t.Iface, t.Cycles)
+}
+
+// activeABProfile returns the profile active on iface, or "".
+func activeABProfile(iface string) string {
+	sched.mu.Lock()
+	defer sched.mu.Unlock()
+	if t, ok := abTests[iface]; ok && t.Active != nil {
+		if _, running := sched.jobs["ab:"+iface]; running {
+			return t.Active.Profile
+		}
+	}
+	return ""
+}
+
+// --- Handlers: /ab ---
+
+// handleABStart starts (or replaces) the A/B test of an interface.
+func handleABStart(w http.ResponseWriter, r *http.Request) {
+	t := &ABTest{}
+	if err := json.NewDecoder(r.Body).Decode(t); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid A/B test JSON: %v", err), 400)
+		return
+	}
+	if err := t.validate(); err != nil {
+		respondWithLocalizedError(w, r, 400, err)
+		return
+	}
+	sched.StopIface(t.Iface)
+	sched.mu.Lock()
+	abTests[t.Iface] = t
+	snapshot := abSnapshot(t)
+	sched.mu.Unlock()
+	sched.Start("ab:"+t.Iface, "ab", t.Iface, t.run)
+	respondWithJSON(w, http.StatusOK, snapshot)
+}
+
+// abSnapshot returns a copy of a test that is safe to encode.
+func abSnapshot(t *ABTest) *ABTest {
+	c := *t
+	if t.Active != nil {
+		active := *t.Active
+		c.Active = &active
+	}
+	c.History = append([]*ABPhase{}, t.History...)
+	c.HistoryTotal = len(t.History)
+	return &c
+}
+
+// page keeps the page of the history selected by the request.
+func (t *ABTest) page(r *http.Request) error {
+	start, end, err := pageBounds(r, len(t.History))
+	if err != nil {
+		return fmt.Errorf("ab: %w", err)
+	}
+	t.History = t.History[start:end]
+	return nil
+}
+
+// handleABList returns the A/B tests (running or finished) by interface,
+// with the same page of each history.
+func handleABList(w http.ResponseWriter, r *http.Request) {
+	type abStatus struct {
+		*ABTest
+		Running bool `json:"running"`
+	}
+	list := map[string]abStatus{}
+	sched.mu.Lock()
+	for iface, t := range abTests {
+		_, running := sched.jobs["ab:"+iface]
+		list[iface] = abStatus{ABTest: abSnapshot(t), Running: running}
+	}
+	sched.mu.Unlock()
+	for _, status := range list {
+		if err := status.page(r); err != nil {
+			respondWithError(w, err.Error(), 400)
+			return
+		}
+	}
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleABGet returns the A/B test of an interface with its phase history
+// (or the page of it selected by 'offset' and 'limit').
+func handleABGet(w http.ResponseWriter, r *http.Request) {
+	iface := chi.URLParam(r, "iface")
+	sched.mu.Lock()
+	t, ok := abTests[iface]
+	var snapshot *ABTest
+	if ok {
+		snapshot = abSnapshot(t)
+	}
+	sched.mu.Unlock()
+	if !ok {
+		respondWithError(w, fmt.Sprintf("no A/B test on '%s'", iface), 404)
+		return
+	}
+	if err := snapshot.page(r); err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, snapshot)
+}
+
+// handleABStop stops the A/B test of an interface, keeping its current rule
+// and the history.
+func handleABStop(w http.ResponseWriter, r *http.Request) {
+	iface := chi.URLParam(r, "iface")
+	if !sched.Stop("ab:" + iface) {
+		respondWithError(w, fmt.Sprintf("no A/B test running on '%s'", iface), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Shaping Accuracy Report ---
+
+// The self-measurement lab: a veth pair whose far end lives in its own
+// network namespace, so probes really cross the shaped device.
+const (
+	accuracyNetns    = "netsim-accuracy"
+	accuracyDev      = "nsacc0"
+	accuracyPeerDev  = "nsacc1"
+	accuracyLocalIP  = "169.254.250.1"
+	accuracyRemoteIP = "169.254.250.2"
+)
+
+// AccuracyReport compares the requested rule with what a copy of it
+// actually delivers between two namespaces.
+type AccuracyReport struct {
+	RequestedDelayMs  float64  `json:"requestedDelayMs,omitempty"`
+	MeasuredDelayMs   float64  `json:"measuredDelayMs,omitempty"` // RTT increase over the bare veth
+	DelayErrorMs      float64  `json:"delayErrorMs,omitempty"`
+	MeasuredJitterMs  float64  `json:"measuredJitterMs,omitempty"`
+	RequestedRateBps  float64  `json:"requestedRateBps,omitempty"`
+	MeasuredRateBps   float64  `json:"measuredRateBps,omitempty"`
+	RateErrorPercent  float64  `json:"rateErrorPercent,omitempty"`
+	TimerResolutionNs int64    `json:"timerResolutionNs"`
+	Reliable          bool     `json:"reliable"`
+	Notes             []string `json:"notes,omitempty"`
+}
+
+// timerResolution returns the packet scheduler clock resolution, from the
+// last field of /proc/net/psched (hrtimer ticks per second, or HZ without
+// high-resolution timers).
+func timerResolution() (time.Duration, error) {
+	b, err := os.ReadFile("/proc/net/psched")
+	if err != nil {
+		return 0, err
+	}
+	fields := strings.Fields(string(b))
+	if len(fields) < 4 {
+		return 0, fmt.Errorf("unexpected /proc/net/psched: %q", string(b))
+	}
+	perSec, err := strconv.ParseUint(fields[3], 16, 64)
+	if err != nil || perSec == 0 {
+		return 0, fmt.Errorf("unexpected /proc/net/psched: %q", string(b))
+	}
+	return time.Second / time.Duration(perSec), nil
+}
+
+// setupAccuracyLab creates the veth pair and the namespace. The namespace
+// needs CAP_SYS_ADMIN, which is dropped unless 'accuracy' is in
+// PRIVILEGED_FEATURES.
+func setupAccuracyLab(ctx context.Context) error {
+	if err := privilegedFeatureAvailable("accuracy"); err != nil {
+		return err
+	}
+	teardownAccuracyLab(ctx)
+	steps := [][]string{
+		{"netns", "add", accuracyNetns},
+		{"link", "add", accuracyDev, "type", "veth", "peer", "name", accuracyPeerDev},
+		{"link", "set", accuracyPeerDev, "netns", accuracyNetns},
+		{"addr", "add", accuracyLocalIP + "/30", "dev", accuracyDev},
+		{"link", "set", accuracyDev, "up"},
+		{"-n", accuracyNetns, "addr", "add", accuracyRemoteIP + "/30", "dev", accuracyPeerDev},
+		{"-n", accuracyNetns, "link", "set", accuracyPeerDev, "up"},
+		{"-n", accuracyNetns, "link", "set", "lo", "up"},
+	}
+	for _, args := range steps {
+		if err := runIP(ctx, args...); err != nil {
+			teardownAccuracyLab(ctx)
+			return err
+		}
+	}
+	return nil
+}
+
+// teardownAccuracyLab removes the namespace, which also deletes the veth
+// pair and its rules.
+func teardownAccuracyLab(ctx context.Context) {
+	runIP(ctx, "link", "del", accuracyDev)
+	runIP(ctx, "netns", "del", accuracyNetns)
+}
+
+// txBytes reads the transmitted bytes counter of a device.
+func txBytes(dev string) (uint64, error) {
+	b, err := os.ReadFile("/sys/class/net/" + dev + "/statistics/tx_bytes")
+	if err != nil {
+		return 0, err
+	}
+	return strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+}
+
+// measureRate floods the lab with UDP for d and returns the rate that left
+// the shaped device.
+func measureRate(ctx context.Context, d time.Duration) (float64, error) {
+	conn, err := net.DialUDP("udp4", &net.UDPAddr{IP: net.ParseIP(accuracyLocalIP)}, &net.UDPAddr{IP: net.ParseIP(accuracyRemoteIP), Port: 9})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	payload := make([]byte, 1400)
+	warmup := time.Now().Add(200 * time.Millisecond)
+	end := warmup.Add(d)
+	var start uint64
+	started := false
+	for time.Now().Before(end) && ctx.Err() == nil {
+		conn.Write(payload) // drops (ENOBUFS) are expected
+		if !started && time.Now().After(warmup) {
+			if start, err = txBytes(accuracyDev); err != nil {
+				return 0, err
+			}
+			started, warmup = true, time.Now()
+		}
+	}
+	stop, err := txBytes(accuracyDev)
+	if err != nil {
+		return 0, err
+	}
+	return float64(stop-start) * 8 / time.Since(warmup).Seconds(), nil
+}
+
+// measureAccuracy applies a copy of opts to the lab and measures it. Must
+// be called with applyMu held.
+func measureAccuracy(ctx context.Context, opts *V4NetworkOptions) *AccuracyReport {
+	report := &AccuracyReport{Reliable: true}
+	fail := func(format string, args ...interface{}) *AccuracyReport {
+		report.Reliable = false
+		report.Notes = append(report.Notes, fmt.Sprintf(format, args...))
+		return report
+	}
+	if res, err := timerResolution(); err == nil {
+		report.TimerResolutionNs = res.Nanoseconds()
+	}
+
+	if err := setupAccuracyLab(ctx); err != nil {
+		return fail("self-measurement unavailable: %v", err)
+	}
+	defer teardownAccuracyLab(context.Background())
+
+	bare, err := pingRTTs(ctx, accuracyDev, accuracyRemoteIP, 10, 20*time.Millisecond)
+	if err != nil || len(bare) == 0 {
+		return fail("self-measurement failed: no reply on the bare link (%v)", err)
+	}
+
+	// Outgoing copy of the rule (probes are ICMP, so flow sampling and the
+	// latency compensation of the real interface do not apply)
+	lab := *opts
+	lab.Iface, lab.Direction, lab.FlowSamplePercent, lab.Compensate = accuracyDev, "outgoing", "", ""
+	if err := lab.Execute(ctx); err != nil {
+		return fail("self-measurement failed: %v", err)
+	}
+	if opts.FlowSamplePercent != "" {
+		report.Notes = append(report.Notes, "measured with all flows impaired (flowSamplePercent is ignored)")
+	}
+
+	if opts.Delay != "" {
+		report.RequestedDelayMs = parseFloatOrZero(opts.Delay)
+		rtts, err := pingRTTs(ctx, accuracyDev, accuracyRemoteIP, 20, 50*time.Millisecond)
+		if err != nil || len(rtts) == 0 {
+			return fail("self-measurement failed: no reply through the rule (%v)", err)
+		}
+		report.MeasuredDelayMs = roundTo(mean(rtts)-mean(bare), 3)
+		report.DelayErrorMs = roundTo(report.MeasuredDelayMs-report.RequestedDelayMs, 3)
+		report.MeasuredJitterMs = roundTo(stddev(rtts), 3)
+
+		// netem only releases packets on timer ticks
+		tolerance := math.Max(0.1, report.RequestedDelayMs*0.05) + parseFloatOrZero(opts.Jitter)/math.Sqrt(float64(len(rtts)))*3
+		if res := float64(report.TimerResolutionNs) / 1e6; res > 0 && res > report.RequestedDelayMs/10 {
+			report.Reliable = false
+			report.Notes = append(report.Notes, fmt.Sprintf("the packet scheduler clock ticks every %vms: delays below %vms are unreliable on this host (no high-resolution timers)", res, res*10))
+		}
+		if math.Abs(report.DelayErrorMs) > tolerance {
+			report.Reliable = false
+			report.Notes = append(report.Notes, fmt.Sprintf("the measured delay is off by %vms (tolerance %.3fms)", report.DelayErrorMs, tolerance))
+		}
+	}
+
+	if opts.Rate != "" {
+		rate, err := parseTCRate(opts.Rate)
+		if err != nil {
+			return fail("%v", err)
+		}
+		report.RequestedRateBps = rate
+		if rate > 1e9 {
+			report.Notes = append(report.Notes, "rates above 1gbit are not measured")
+			return report
+		}
+		measured, err := measureRate(ctx, time.Second)
+		if err != nil {
+			return fail("rate measurement failed: %v", err)
+		}
+		report.MeasuredRateBps = math.Round(measured)
+		report.RateErrorPercent = roundTo((measured-rate)/rate*100, 2)
+		if math.Abs(report.RateErrorPercent) > 10 {
+			report.Reliable = false
+			report.Notes = append(report.Notes, fmt.Sprintf("the measured rate is off by %v%%", report.RateErrorPercent))
+		}
+	}
+	log.Printf("[INFO] ACCURACY: delay %v/%vms, rate %v/%v bit/s (requested/measured), reliable=%v",
+		report.RequestedDelayMs, report.MeasuredDelayMs, report.RequestedRateBps, report.MeasuredRateBps, report.Reliable)
+	return report
+}
+
+func mean(values []float64) float64 {
+	var sum float64
+	for _, v := range values {
+		sum += v
+	}
+	return sum / float64(len(values))
+}
+
+func stddev(values []float64) float64 {
+	m, sq := mean(values), 0.0
+	for _, v := range values {
+		sq += (v - m) * (v - m)
+	}
+	return math.Sqrt(sq / float64(len(values)))
+}
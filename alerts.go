@@ -0,0 +1,372 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Alerts ---
+
+// An alert watches a metric of an interface and fires when it stays above a
+// threshold, so an experiment whose conditions drift (a queue that never
+// drains, a path slower than the rule says) does not go unnoticed. Firing
+// and resolving are sent to the alert's webhook and to /alerts/events.
+
+// alertMetrics are the metrics alerts can watch.
+var alertMetrics = map[string]string{
+	"drops":        "packets dropped per second by the qdiscs of the shaped device",
+	"backlog":      "packets queued in the qdiscs of the shaped direction (the largest queue)",
+	"rttDeviation": "ms between the probed RTT and the one the rule configures (its delay, plus the latency baseline)",
+}
+
+// AlertRule fires when Metric of Iface is above Above for For (default: at
+// the first check), checked every Interval (default 10s). rttDeviation
+// probes Target (default: the interface's gateway) with ICMP.
+type AlertRule struct {
+	Name     string  `json:"name"`
+	Iface    string  `json:"iface"`
+	Metric   string  `json:"metric"`
+	Above    float64 `json:"above"`
+	For      string  `json:"for,omitempty"`      // Go duration
+	Interval string  `json:"interval,omitempty"` // Go duration, at least 1s
+	Target   string  `json:"target,omitempty"`
+	Webhook  string  `json:"webhook,omitempty"` // URL the events are POSTed to
+
+	Firing  bool    `json:"firing"`
+	Value   float64 `json:"value"`
+	Since   *TcTime `json:"since,omitempty"` // firing since
+	Checked *TcTime `json:"checked,omitempty"`
+	Fired   int     `json:"fired"`
+	Error   string  `json:"error,omitempty"` // of the last check
+
+	interval, hold time.Duration
+	next, above    time.Time
+	drops          *dropCounter
+}
+
+// dropCounter is the drop counter of the previous check of a drops alert
+// (only the checking loop uses it).
+type dropCounter struct {
+	dropped uint64
+	at      time.Time
+}
+
+// AlertEvent is sent when an alert fires or resolves.
+type AlertEvent struct {
+	Alert  string  `json:"alert"`
+	Iface  string  `json:"iface"`
+	Metric string  `json:"metric"`
+	State  string  `json:"state"` // "firing" or "resolved"
+	Value  float64 `json:"value"`
+	Above  float64 `json:"above"`
+	At     TcTime  `json:"at"`
+}
+
+// alerts holds the alert rules by name and the event subscribers.
+var alerts = struct {
+	sync.Mutex
+	rules       map[string]*AlertRule
+	subscribers map[chan AlertEvent]bool
+}{rules: map[string]*AlertRule{}, subscribers: map[chan AlertEvent]bool{}}
+
+// alertWebhookClient posts the events.
+var alertWebhookClient = &http.Client{Timeout: 5 * time.Second}
+
+// validate checks the alert and parses its durations.
+func (a *AlertRule) validate() error {
+	if !groupNamePattern.MatchString(a.Name) {
+		return fmt.Errorf("alert: invalid 'name' %q (letters, digits, '_', '.' and '-')", a.Name)
+	}
+	if a.Iface == "" {
+		return fmt.Errorf("alert: 'iface' is required")
+	}
+	if _, ok := alertMetrics[a.Metric]; !ok {
+		return fmt.Errorf("alert: invalid 'metric' %q (drops, backlog or rttDeviation)", a.Metric)
+	}
+	if a.Above < 0 || math.IsNaN(a.Above) {
+		return fmt.Errorf("alert: invalid 'above' %v", a.Above)
+	}
+	var err error
+	if a.Interval == "" {
+		a.Interval = "10s"
+	}
+	if a.interval, err = time.ParseDuration(a.Interval); err != nil || a.interval < time.Second {
+		return fmt.Errorf("alert: invalid 'interval' %q (at least 1s)", a.Interval)
+	}
+	if a.For != "" {
+		if a.hold, err = time.ParseDuration(a.For); err != nil || a.hold < 0 {
+			return fmt.Errorf("alert: invalid 'for' %q", a.For)
+		}
+	}
+	a.drops = &dropCounter{}
+	if a.Webhook != "" {
+		if u, err := url.Parse(a.Webhook); err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return fmt.Errorf("alert: invalid 'webhook' %q (an http or https URL)", a.Webhook)
+		}
+	}
+	return nil
+}
+
+// shapedRule returns the rule of iface, or an outgoing rule for counters
+// when there is none.
+func shapedRule(iface string) *V4NetworkOptions {
+	if rule := store.Get(iface, ""); rule != nil {
+		return rule.Options
+	}
+	return &V4NetworkOptions{Iface: iface, Direction: "outgoing"}
+}
+
+// measure reads the metric of the alert. drops needs two checks: the first
+// one only reads the counter (ok is false).
+func (a *AlertRule) measure(ctx context.Context, now time.Time) (value float64, ok bool, err error) {
+	opts := shapedRule(a.Iface)
+	switch a.Metric {
+	case "drops":
+		dropped := readIfaceCounters(ctx, opts).QdiscDropped
+		last := *a.drops
+		*a.drops = dropCounter{dropped: dropped, at: now}
+		if last.at.IsZero() || dropped < last.dropped {
+			return 0, false, nil
+		}
+		return roundTo(float64(dropped-last.dropped)/now.Sub(last.at).Seconds(), 2), true, nil
+	case "backlog":
+		for _, d := range readDirectionStats(ctx, a.Iface, opts) {
+			if d.Direction != opts.Direction {
+				continue
+			}
+			for _, q := range d.Qdiscs {
+				value = math.Max(value, float64(q.BacklogPackets))
+			}
+		}
+		return value, true, nil
+	default: // rttDeviation
+		target := a.Target
+		if target == "" {
+			if target = defaultGateway(ctx, a.Iface); target == "" {
+				return 0, false, fmt.Errorf("no 'target' and no gateway on '%s'", a.Iface)
+			}
+		}
+		rtts, err := pingRTTs(ctx, a.Iface, target, 5, 200*time.Millisecond)
+		if err != nil {
+			return 0, false, err
+		}
+		if len(rtts) == 0 {
+			return 0, false, fmt.Errorf("no reply from %s", target)
+		}
+		expected := 0.0
+		if delay, ok := parseTCNumber(opts.Delay); ok {
+			expected = delay
+		}
+		if b := latencyBaseline(a.Iface); b != nil {
+			expected += b.RttAvgMs
+		}
+		return roundTo(math.Abs(mean(rtts)-expected), 3), true, nil
+	}
+}
+
+// check records a value of the metric and returns the event of a state
+// change, or nil. Must be called with alerts held.
+func (a *AlertRule) check(value float64, now time.Time) *AlertEvent {
+	a.Value = value
+	if value <= a.Above {
+		a.above = time.Time{}
+		if !a.Firing {
+			return nil
+		}
+		a.Firing, a.Since = false, nil
+		return &AlertEvent{Alert: a.Name, Iface: a.Iface, Metric: a.Metric, State: "resolved", Value: value, Above: a.Above, At: TcTime(now)}
+	}
+	if a.above.IsZero() {
+		a.above = now
+	}
+	if a.Firing || now.Sub(a.above) < a.hold {
+		return nil
+	}
+	since := TcTime(now)
+	a.Firing, a.Since = true, &since
+	a.Fired++
+	return &AlertEvent{Alert: a.Name, Iface: a.Iface, Metric: a.Metric, State: "firing", Value: value, Above: a.Above, At: since}
+}
+
+// publishAlert sends ev to the subscribers of /alerts/events and to webhook.
+// Must be called with alerts held.
+func publishAlert(ev *AlertEvent, webhook string) {
+	if ev.State == "firing" {
+		log.Printf("[WARN] ALERTS: %q fired on %s: %s is %v (above %v)", ev.Alert, ev.Iface, ev.Metric, ev.Value, ev.Above)
+	} else {
+		log.Printf("[INFO] ALERTS: %q resolved on %s: %s is %v", ev.Alert, ev.Iface, ev.Metric, ev.Value)
+	}
+	for sub := range alerts.subscribers {
+		select {
+		case sub <- *ev:
+		default:
+			log.Printf("[WARN] ALERTS: Dropped an event for a slow subscriber")
+		}
+	}
+	if webhook == "" {
+		return
+	}
+	body, _ := json.Marshal(ev)
+	go func() {
+		resp, err := alertWebhookClient.Post(webhook, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Printf("[ERROR] ALERTS: Webhook of %q failed: %v", ev.Alert, err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			log.Printf("[ERROR] ALERTS: Webhook of %q answered %s", ev.Alert, resp.Status)
+		}
+	}()
+}
+
+// checkAlerts checks the alerts that are due.
+func checkAlerts(ctx context.Context, now time.Time) {
+	alerts.Lock()
+	var due []*AlertRule
+	for _, a := range alerts.rules {
+		if !now.Before(a.next) {
+			a.next = now.Add(a.interval)
+			due = append(due, a)
+		}
+	}
+	alerts.Unlock()
+
+	for _, a := range due {
+		// (outside the lock: probing takes a while)
+		value, ok, err := a.measure(ctx, now)
+		alerts.Lock()
+		checked := TcTime(now)
+		a.Checked, a.Error = &checked, ""
+		if err != nil {
+			a.Error = err.Error()
+		} else if ok {
+			if ev := a.check(value, now); ev != nil && alerts.rules[a.Name] == a {
+				publishAlert(ev, a.Webhook)
+			}
+		}
+		alerts.Unlock()
+	}
+}
+
+// startAlerts checks the alerts every second until ctx is done.
+func startAlerts(ctx context.Context) {
+	go func() {
+		ticker := time.NewTicker(time.Second)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				checkAlerts(ctx, now)
+			}
+		}
+	}()
+}
+
+// snapshot copies the alert. Must be called with alerts held.
+func (a *AlertRule) snapshot() *AlertRule {
+	c := *a
+	return &c
+}
+
+// --- Handlers: /alerts ---
+
+// handleAlertList returns the alert rules with their state, and the
+// metrics they can watch.
+func handleAlertList(w http.ResponseWriter, r *http.Request) {
+	list := []*AlertRule{}
+	alerts.Lock()
+	for _, a := range alerts.rules {
+		list = append(list, a.snapshot())
+	}
+	alerts.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"alerts": list, "metrics": alertMetrics})
+}
+
+// handleAlertDefine defines (or replaces) an alert rule. Its state starts
+// over.
+func handleAlertDefine(w http.ResponseWriter, r *http.Request) {
+	a := &AlertRule{}
+	if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid alert JSON: %v", err), 400)
+		return
+	}
+	a.Firing, a.Value, a.Since, a.Checked, a.Fired, a.Error = false, 0, nil, nil, 0, ""
+	if err := a.validate(); err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	alerts.Lock()
+	alerts.rules[a.Name] = a
+	snapshot := a.snapshot()
+	alerts.Unlock()
+	log.Printf("[INFO] ALERTS: %q watches %s of %s (above %v)", a.Name, a.Metric, a.Iface, a.Above)
+	respondWithJSON(w, http.StatusOK, snapshot)
+}
+
+// handleAlertDelete removes an alert rule.
+func handleAlertDelete(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	alerts.Lock()
+	_, ok := alerts.rules[name]
+	delete(alerts.rules, name)
+	alerts.Unlock()
+	if !ok {
+		respondWithError(w, fmt.Sprintf("no alert '%s'", name), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// handleAlertEvents streams the alert events as Server-Sent Events
+// ("firing" and "resolved").
+func handleAlertEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, "streaming not supported", 500)
+		return
+	}
+	events := make(chan AlertEvent, 16)
+	alerts.Lock()
+	alerts.subscribers[events] = true
+	alerts.Unlock()
+	defer func() {
+		alerts.Lock()
+		delete(alerts.subscribers, events)
+		alerts.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, "retry: 2000\n\n")
+	flusher.Flush()
+
+	keepalive := time.NewTicker(20 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-events:
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", ev.State, data)
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,11 @@
+#!/bin/sh
+# Generates the Python client from api/openapi.yaml into clients/python
+# using openapi-generator (Docker). Usage: ./api/generate-python-client.sh
+set -e
+cd "$(dirname "$0")/.."
+docker run --rm -u "$(id -u):$(id -g)" -v "$PWD:/local" openapitools/openapi-generator-cli:v7.8.0 generate \
+  -i /local/api/openapi.yaml \
+  -g python \
+  -o /local/clients/python \
+  --package-name netsim_client \
+  --additional-properties=packageVersion=2.0.0
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"crypto/tls"
+	"fmt"
+	"os"
+)
+
+// --- API TLS (HTTP/2) ---
+
+// apiTLS is the TLS configuration of the API server, set when API_TLS_CERT
+// and API_TLS_KEY are. Go's server negotiates HTTP/2 over it (ALPN), which
+// multiplexes the UI's polling and large stats responses on one connection.
+var apiTLS *tls.Config
+
+// configureAPITLS loads the certificate and key of the API server.
+func configureAPITLS() error {
+	cert, key := os.Getenv("API_TLS_CERT"), os.Getenv("API_TLS_KEY")
+	if cert == "" && key == "" {
+		return nil
+	}
+	if cert == "" || key == "" {
+		return fmt.Errorf("API_TLS_CERT and API_TLS_KEY must be set together")
+	}
+	pair, err := tls.LoadX509KeyPair(cert, key)
+	if err != nil {
+		return fmt.Errorf("failed to load the API certificate: %w", err)
+	}
+	apiTLS = &tls.Config{Certificates: []tls.Certificate{pair}, MinVersion: tls.VersionTLS12}
+	return nil
+}
+
+// apiScheme is the URL scheme of the API server.
+func apiScheme() string {
+	if apiTLS != nil {
+		return "https"
+	}
+	return "http"
+}
@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"strings"
+)
+
+// --- Applied Configuration (setup response) ---
+
+// AppliedConfig is the canonical form of a rule as it was applied: the
+// device and tree that carry it, their handles and the normalized values,
+// so clients can store and later reference exactly what is active.
+type AppliedConfig struct {
+	RuleID    string `json:"ruleId"` // the rule's ID, for /rules/{id} and 'id' parameters
+	Iface     string `json:"iface"`
+	Direction string `json:"direction"`
+	Device    string `json:"device"` // the tree's device: iface, or ifb0 for 'incoming'
+	Tree      string `json:"tree"`   // "htb", "prio", "netem", "police" or "mq"
+	Revision  uint64 `json:"revision"`
+	// Handles maps the role of each qdisc/class (root, shapedClass,
+	// unlimitedClass, impairedBand, unimpairedBand, netem, flowCap, ingress)
+	// to its tc handle or classid, and in coexistence mode "parent" to the
+	// host's class the tree hangs below.
+	Handles  map[string]string `json:"handles"`
+	Rate     string            `json:"rate,omitempty"`     // as passed to tc (the default when unlimited; per flow with rateScope=flow)
+	RateBits float64           `json:"rateBits,omitempty"` // rate in bit/s
+	Ceil     string            `json:"ceil,omitempty"`
+	Quantum  string            `json:"quantum,omitempty"` // HTB quantum in bytes (see htbQuantum)
+	Netem    string            `json:"netem,omitempty"`   // netem parameters as passed to tc (delay compensated)
+	// NetemSeed is the seed of netem's PRNG as the kernel reports it: the
+	// rule's, or the one netem picked (pass it as 'seed' to repeat a run)
+	NetemSeed string            `json:"netemSeed,omitempty"`
+	Options   *V4NetworkOptions `json:"options"`
+}
+
+// appliedConfig describes opts, applied at revision rev. Call it right
+// after Execute and store.Set: the mq root handle is read from the
+// interface, the rule ID from the store.
+func appliedConfig(ctx context.Context, opts *V4NetworkOptions, rev uint64) *AppliedConfig {
+	c := &AppliedConfig{
+		Iface:     opts.Iface,
+		Direction: opts.Direction,
+		Device:    opts.effectiveIface(),
+		Revision:  rev,
+		Handles:   map[string]string{},
+		Options:   opts,
+	}
+	if rule := store.Get(opts.Iface, opts.Direction); rule != nil {
+		c.RuleID = rule.ID
+	}
+	netemArgs, hasNetem := opts.netemParams()
+	if hasNetem {
+		c.Netem = strings.Join(netemArgs, " ")
+	}
+
+	switch kind, handle := rootQdisc(ctx, opts.Iface); {
+	case opts.Direction == "incoming" && opts.ingressMode() == "police":
+		c.Device, c.Tree = opts.Iface, "police"
+		c.Handles["ingress"] = "ffff:"
+		c.Rate = opts.Rate
+	case opts.Direction == "outgoing" && opts.PreserveMQ == "true" && isMultiQueueRoot(kind):
+		c.Tree = "mq"
+		c.Handles["root"] = handle
+		if queues := txQueues(opts.Iface); queues > 0 {
+			c.Handles["netem"] = mqChildHandle(1) + "-" + mqChildHandle(queues)
+		}
+		c.Rate = opts.Rate
+	default:
+		c.Tree, _ = opts.treeShape()
+		switch c.Tree {
+		case "htb":
+			c.Handles["root"], c.Handles["unlimitedClass"], c.Handles["shapedClass"] = rootHandle, unlimitedClass, shapedClass
+			if params, err := opts.htbClassParams(); err == nil {
+				for i := 0; i+1 < len(params); i += 2 {
+					switch params[i] {
+					case "rate":
+						c.Rate = params[i+1]
+					case "ceil":
+						c.Ceil = params[i+1]
+					case "quantum":
+						c.Quantum = params[i+1]
+					}
+				}
+			}
+		case "prio":
+			c.Handles["root"], c.Handles["unimpairedBand"], c.Handles["impairedBand"] = rootHandle, unimpairedBand, impairedBand
+		}
+		if hasNetem {
+			c.Handles["netem"] = netemHandle
+			c.NetemSeed = appliedNetemSeed(ctx, c.Device)
+		}
+		if opts.RateScope == "flow" && c.Tree == "htb" {
+			c.Handles["flowCap"] = flowCapHandle
+			c.Rate = opts.Rate // of each flow
+		}
+		if attach := opts.treeAttach(); attach[0] == "parent" {
+			c.Handles["parent"] = attach[1] // coexistence: the host's class
+		}
+	}
+	if c.Rate != "" {
+		c.RateBits, _ = parseTCRate(c.Rate)
+	}
+	return c
+}
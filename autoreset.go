@@ -0,0 +1,195 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+)
+
+// --- Scheduled Auto-Reset ---
+
+// autoResetPolicy resets all impairments (like reset-all) every day at a
+// set time, and/or after a period without changes, so a shared lab box
+// does not keep yesterday's forgotten rules.
+type autoResetPolicy struct {
+	mu           sync.Mutex
+	at           string        // daily reset time, "HH:MM" local time (optional)
+	idle         time.Duration // reset after this long without changes (optional)
+	next         time.Time     // next daily reset
+	skipNext     bool          // the next daily reset is skipped (e.g. an overnight test)
+	lastActivity time.Time
+	lastReset    time.Time
+	lastReason   string
+}
+
+// autoResetInterval is how often the policy is checked.
+const autoResetInterval = 30 * time.Second
+
+// autoReset is the process-wide policy. It is disabled unless configured.
+var autoReset = &autoResetPolicy{}
+
+// configureAutoReset reads AUTO_RESET_AT and AUTO_RESET_IDLE and returns
+// false when the policy is not enabled. An invalid time is an error.
+func configureAutoReset() (bool, error) {
+	autoReset.mu.Lock()
+	defer autoReset.mu.Unlock()
+	if at := os.Getenv("AUTO_RESET_AT"); at != "" {
+		if _, err := time.Parse("15:04", at); err != nil {
+			return false, fmt.Errorf("invalid AUTO_RESET_AT %q (a time of day such as '03:00')", at)
+		}
+		autoReset.at = at
+	}
+	autoReset.idle = envDuration("AUTO_RESET_IDLE", 0)
+	autoReset.lastActivity = time.Now()
+	if autoReset.at != "" {
+		autoReset.next = autoReset.nextDaily(time.Now())
+	}
+	return autoReset.enabled(), nil
+}
+
+// enabled reports whether a daily time or an idle period is set.
+func (p *autoResetPolicy) enabled() bool {
+	return p.at != "" || p.idle > 0
+}
+
+// nextDaily returns the first daily reset time after now.
+func (p *autoResetPolicy) nextDaily(now time.Time) time.Time {
+	at, _ := time.Parse("15:04", p.at)
+	next := time.Date(now.Year(), now.Month(), now.Day(), at.Hour(), at.Minute(), 0, 0, time.Local)
+	if !next.After(now) {
+		next = next.AddDate(0, 0, 1)
+	}
+	return next
+}
+
+// startAutoReset runs the policy until ctx is cancelled.
+func startAutoReset(ctx context.Context) {
+	log.Printf("[INFO] AUTORESET: Enabled (at=%q, idle=%v)", autoReset.at, autoReset.idle)
+	go func() {
+		ticker := time.NewTicker(autoResetInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case now := <-ticker.C:
+				if reason := autoReset.due(now); reason != "" {
+					autoReset.reset(ctx, reason)
+				}
+			}
+		}
+	}()
+}
+
+// due returns a non-empty reason when the rules should be reset now. The
+// idle reset happens once per idle period: a change re-arms it.
+func (p *autoResetPolicy) due(now time.Time) string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.at != "" && !now.Before(p.next) {
+		p.next = p.nextDaily(now)
+		if p.skipNext {
+			p.skipNext = false
+			log.Printf("[INFO] AUTORESET: Skipped the daily reset at %s (as requested)", p.at)
+		} else {
+			return fmt.Sprintf("daily reset at %s", p.at)
+		}
+	}
+	if p.idle > 0 && p.lastActivity.After(p.lastReset) && now.Sub(p.lastActivity) >= p.idle {
+		return fmt.Sprintf("no changes for %v", now.Sub(p.lastActivity).Round(time.Second))
+	}
+	return ""
+}
+
+// reset resets every impairment.
+func (p *autoResetPolicy) reset(ctx context.Context, reason string) {
+	p.mu.Lock()
+	p.lastReset = time.Now()
+	p.lastReason = reason
+	p.mu.Unlock()
+
+	log.Printf("[INFO] AUTORESET: Resetting all impairments (%s)...", reason)
+	if isDarwin {
+		return
+	}
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if _, failures := resetAllInterfaces(ctx); len(failures) > 0 {
+		log.Printf("[ERROR] AUTORESET: Reset finished with errors: %v", failures)
+	}
+}
+
+// changesState reports whether an API call changes something, which counts
+// as activity: every method but GET and HEAD, and the GET setup and reset
+// endpoints (and init, raw and the watchdog keepalive).
+func changesState(r *http.Request) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return true
+	}
+	switch path.Base(r.URL.Path) {
+	case "setup", "reset", "reset-all", "init", "raw", "keepalive":
+		return true
+	}
+	return false
+}
+
+// AutoResetMiddleware records the time of the last API call that changes
+// something, for the idle reset.
+func AutoResetMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if changesState(r) && !isReadOnlyView(r) {
+			autoReset.mu.Lock()
+			autoReset.lastActivity = time.Now()
+			autoReset.mu.Unlock()
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// --- Handlers: /autoreset ---
+
+// handleAutoResetStatus reports the policy and when it resets next.
+func handleAutoResetStatus(w http.ResponseWriter, r *http.Request) {
+	autoReset.mu.Lock()
+	defer autoReset.mu.Unlock()
+	status := map[string]interface{}{
+		"enabled":      autoReset.enabled(),
+		"lastActivity": TcTime(autoReset.lastActivity),
+	}
+	if autoReset.at != "" {
+		status["at"] = autoReset.at
+		status["next"] = TcTime(autoReset.next)
+		status["skipNext"] = autoReset.skipNext
+	}
+	if autoReset.idle > 0 {
+		status["idle"] = autoReset.idle.String()
+		if autoReset.lastActivity.After(autoReset.lastReset) {
+			status["idleReset"] = TcTime(autoReset.lastActivity.Add(autoReset.idle))
+		}
+	}
+	if !autoReset.lastReset.IsZero() {
+		status["lastReset"] = TcTime(autoReset.lastReset)
+		status["lastReason"] = autoReset.lastReason
+	}
+	respondWithJSON(w, http.StatusOK, status)
+}
+
+// handleAutoResetSkip skips the next daily reset ('skip=false' undoes it),
+// e.g. to keep an overnight test running.
+func handleAutoResetSkip(w http.ResponseWriter, r *http.Request) {
+	autoReset.mu.Lock()
+	if autoReset.at == "" {
+		autoReset.mu.Unlock()
+		respondWithError(w, "autoreset: no daily reset is set (AUTO_RESET_AT)", 409)
+		return
+	}
+	autoReset.skipNext = r.URL.Query().Get("skip") != "false"
+	log.Printf("[INFO] AUTORESET: Skip the reset of %s: %v", autoReset.next.Format("2006-01-02 15:04"), autoReset.skipNext)
+	autoReset.mu.Unlock()
+	handleAutoResetStatus(w, r)
+}
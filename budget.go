@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+)
+
+// --- Path Budgets ---
+
+// PathTarget is the end-to-end behavior of a path: the round-trip delay and
+// jitter (ms), the loss of a round trip (percent) and the bottleneck rate.
+type PathTarget struct {
+	RTT    string `json:"rtt,omitempty"`
+	Jitter string `json:"jitter,omitempty"`
+	Loss   string `json:"loss,omitempty"`
+	Rate   string `json:"rate,omitempty"`
+}
+
+// PathHop is a rule on the path (one interface and direction) with its
+// share of the budget (Weight, default 1). Options holds other parameters
+// of the hop's rule (e.g. 'corrupt'); the budget sets the delay, jitter,
+// loss and rate.
+type PathHop struct {
+	Iface     string            `json:"iface"`
+	Direction string            `json:"direction"`
+	Weight    float64           `json:"weight,omitempty"`
+	Options   *V4NetworkOptions `json:"options,omitempty"`
+}
+
+// PathBudget distributes Target over Hops. BaseRTT (ms) is the round trip
+// the path has unimpaired, taken from the delay budget. With Group, the
+// hops' rules are defined as an impairment group (not enabled).
+type PathBudget struct {
+	Target  PathTarget `json:"target"`
+	BaseRTT string     `json:"baseRtt,omitempty"`
+	Hops    []*PathHop `json:"hops"`
+	Group   string     `json:"group,omitempty"`
+
+	rtt, jitter, loss float64
+}
+
+// validate checks the budget and parses the target.
+func (b *PathBudget) validate() error {
+	if len(b.Hops) == 0 {
+		return fmt.Errorf("budget: at least one hop is required")
+	}
+	for _, hop := range b.Hops {
+		if hop.Weight < 0 || math.IsNaN(hop.Weight) {
+			return fmt.Errorf("budget: invalid 'weight' %v of the hop on '%s'", hop.Weight, hop.Iface)
+		}
+		if hop.Weight == 0 {
+			hop.Weight = 1
+		}
+	}
+	for _, f := range []struct {
+		name  string
+		value string
+		into  *float64
+	}{{"target.rtt", b.Target.RTT, &b.rtt}, {"target.jitter", b.Target.Jitter, &b.jitter}, {"target.loss", b.Target.Loss, &b.loss}} {
+		if f.value == "" {
+			continue
+		}
+		v, ok := parseTCNumber(f.value)
+		if !ok {
+			return fmt.Errorf("budget: invalid '%s' %q", f.name, f.value)
+		}
+		*f.into = v
+	}
+	if b.loss >= 100 {
+		return fmt.Errorf("budget: 'target.loss' must be below 100")
+	}
+	if b.BaseRTT != "" {
+		base, ok := parseTCNumber(b.BaseRTT)
+		if !ok {
+			return fmt.Errorf("budget: invalid 'baseRtt' %q", b.BaseRTT)
+		}
+		if base > b.rtt {
+			return fmt.Errorf("budget: the path's 'baseRtt' (%vms) is already above 'target.rtt' (%vms)", base, b.rtt)
+		}
+		b.rtt -= base
+	}
+	if b.Target.Rate != "" {
+		if _, err := parseTCRate(b.Target.Rate); err != nil {
+			return fmt.Errorf("budget: invalid 'target.rate' %q", b.Target.Rate)
+		}
+	}
+	return nil
+}
+
+// split returns the rule of each hop. Every packet of a round trip crosses
+// each hop once, so the hops' delays add up to the RTT, their jitter
+// variances to the jitter's, and their survival probabilities multiply to
+// that of the round trip: hop i with weight share s gets s of the delay,
+// sqrt(s) of the jitter and 1-(1-loss)^s of the loss. The rate is the
+// bottleneck, so every hop gets it.
+func (b *PathBudget) split() []*V4NetworkOptions {
+	total := 0.0
+	for _, hop := range b.Hops {
+		total += hop.Weight
+	}
+	rules := make([]*V4NetworkOptions, len(b.Hops))
+	delayLeft := roundTo(b.rtt, 2)
+	for i, hop := range b.Hops {
+		share := hop.Weight / total
+		opts := &V4NetworkOptions{}
+		if hop.Options != nil {
+			*opts = *hop.Options
+		}
+		opts.Iface, opts.Direction = hop.Iface, hop.Direction
+		if b.rtt > 0 {
+			// (the last hop takes what rounding left, so the delays add up)
+			delay := roundTo(b.rtt*share, 2)
+			if i == len(b.Hops)-1 {
+				delay = delayLeft
+			}
+			delayLeft = roundTo(delayLeft-delay, 2)
+			opts.Delay = strconv.FormatFloat(delay, 'f', -1, 64)
+		}
+		if b.jitter > 0 {
+			opts.Jitter = strconv.FormatFloat(roundTo(b.jitter*math.Sqrt(share), 2), 'f', -1, 64)
+		}
+		if b.loss > 0 {
+			loss := 100 * (1 - math.Pow(1-b.loss/100, share))
+			opts.Loss = strconv.FormatFloat(roundTo(loss, 4), 'f', -1, 64)
+			if opts.LossModel == "" {
+				opts.LossModel = "random"
+			}
+		}
+		if b.Target.Rate != "" {
+			opts.Rate = b.Target.Rate
+		}
+		rules[i] = opts
+	}
+	return rules
+}
+
+// --- Handlers: /budget ---
+
+// handleBudgetSplit distributes an end-to-end target over the hops of a
+// path and returns their rules, defined as an impairment group with
+// 'group'.
+func handleBudgetSplit(w http.ResponseWriter, r *http.Request) {
+	b := &PathBudget{}
+	if err := json.NewDecoder(r.Body).Decode(b); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid budget JSON: %v", err), 400)
+		return
+	}
+	if err := b.validate(); err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	rules := b.split()
+	for _, opts := range rules {
+		if err := opts.validateNetem(); err != nil {
+			respondWithLocalizedError(w, r, 400, err)
+			return
+		}
+	}
+	response := map[string]interface{}{"rules": rules}
+	if b.Group != "" {
+		g := &ImpairmentGroup{Name: b.Group, Rules: rules}
+		if err := g.validate(); err != nil {
+			respondWithLocalizedError(w, r, 400, err)
+			return
+		}
+		if err := g.define(); err != nil {
+			respondWithError(w, err.Error(), 409)
+			return
+		}
+		response["group"] = g.snapshot()
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,356 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+)
+
+// --- Calibration (clone a network's behavior from a capture) ---
+
+// maxCaptureDuration keeps a live capture within the request timeout.
+const maxCaptureDuration = 45 * time.Second
+
+// maxOutstandingSegments bounds the per-direction RTT bookkeeping.
+const maxOutstandingSegments = 4096
+
+// Calibration is what was observed in a capture and the matching rule.
+type Calibration struct {
+	Packets           int               `json:"packets"`
+	TCPFlows          int               `json:"tcpFlows"`
+	DurationSec       float64           `json:"durationSec"`
+	RttSamples        int               `json:"rttSamples"`
+	RttMinMs          float64           `json:"rttMinMs"`
+	RttMedianMs       float64           `json:"rttMedianMs"`
+	RttP90Ms          float64           `json:"rttP90Ms"`
+	RttStddevMs       float64           `json:"rttStddevMs"`
+	DataSegments      int               `json:"dataSegments"`
+	Retransmissions   int               `json:"retransmissions"`
+	RetransmitPercent float64           `json:"retransmitPercent"`
+	AvgThroughputBps  float64           `json:"avgThroughputBps"`
+	PeakThroughputBps float64           `json:"peakThroughputBps"` // busiest second
+	Profile           *V4NetworkOptions `json:"profile"`
+	SetupQuery        string            `json:"setupQuery"`
+	Notes             []string          `json:"notes,omitempty"`
+}
+
+// tcpFlowKey identifies one direction of a TCP connection.
+type tcpFlowKey struct {
+	src, dst     [16]byte
+	sport, dport uint16
+}
+
+func (k tcpFlowKey) reverse() tcpFlowKey {
+	return tcpFlowKey{src: k.dst, dst: k.src, sport: k.dport, dport: k.sport}
+}
+
+// tcpDirection tracks the unacknowledged segments of one direction.
+type tcpDirection struct {
+	sent        map[uint32]time.Time // end sequence number -> first sent
+	highestEnd  uint32
+	initialized bool
+}
+
+// calibrator accumulates the statistics of a capture.
+type calibrator struct {
+	packets, dataSegments, retransmissions int
+	flows                                  map[tcpFlowKey]*tcpDirection
+	rtts                                   []float64 // ms
+	first, last                            time.Time
+	bytes                                  float64
+	perSecond                              map[int64]float64
+}
+
+func newCalibrator() *calibrator {
+	return &calibrator{flows: map[tcpFlowKey]*tcpDirection{}, perSecond: map[int64]float64{}}
+}
+
+// seqAfter reports whether a comes after b, with wraparound.
+func seqAfter(a, b uint32) bool { return int32(a-b) > 0 }
+
+// read consumes a pcap stream until EOF.
+func (c *calibrator) read(r io.Reader) error {
+	pcap, err := newPcapReader(r)
+	if err != nil {
+		return err
+	}
+	for {
+		pkt, err := pcap.Next()
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		c.packets++
+		if c.first.IsZero() {
+			c.first = pkt.Time
+		}
+		c.last = pkt.Time
+		c.bytes += float64(pkt.OrigLen)
+		c.perSecond[pkt.Time.Unix()] += float64(pkt.OrigLen)
+		if ip, version := pcap.networkLayer(pkt.Data); version != 0 {
+			c.tcp(pkt.Time, ip, version)
+		}
+	}
+}
+
+// tcp records a TCP segment: data segments (and SYN/FIN) are remembered
+// until acknowledged, which yields an RTT sample. Retransmitted segments are
+// counted and, per Karn's algorithm, not used for RTT.
+func (c *calibrator) tcp(ts time.Time, ip []byte, version int) {
+	var key tcpFlowKey
+	var payload int
+	switch version {
+	case 4:
+		if len(ip) < 20 || ip[9] != 6 || binary.BigEndian.Uint16(ip[6:8])&0x1fff != 0 {
+			return // not TCP, or a non-first fragment
+		}
+		ihl := int(ip[0]&0x0f) * 4
+		payload = int(binary.BigEndian.Uint16(ip[2:4])) - ihl
+		copy(key.src[:], ip[12:16])
+		copy(key.dst[:], ip[16:20])
+		ip = ip[min(ihl, len(ip)):]
+	case 6:
+		if len(ip) < 40 || ip[6] != 6 {
+			return // not TCP (extension headers are not followed)
+		}
+		payload = int(binary.BigEndian.Uint16(ip[4:6]))
+		copy(key.src[:], ip[8:24])
+		copy(key.dst[:], ip[24:40])
+		ip = ip[40:]
+	}
+	if len(ip) < 20 {
+		return
+	}
+	key.sport, key.dport = binary.BigEndian.Uint16(ip[0:2]), binary.BigEndian.Uint16(ip[2:4])
+	seq, ack := binary.BigEndian.Uint32(ip[4:8]), binary.BigEndian.Uint32(ip[8:12])
+	flags := ip[13]
+	payload -= int(ip[12]>>4) * 4
+	length := uint32(max(payload, 0))
+	if flags&0x03 != 0 { // SYN or FIN consume a sequence number
+		length++
+	}
+
+	dir := c.flows[key]
+	if dir == nil {
+		dir = &tcpDirection{sent: map[uint32]time.Time{}}
+		c.flows[key] = dir
+	}
+
+	// ACK: match it against the other direction
+	if flags&0x10 != 0 {
+		if rev := c.flows[key.reverse()]; rev != nil {
+			if sent, ok := rev.sent[ack]; ok {
+				c.rtts = append(c.rtts, float64(ts.Sub(sent))/float64(time.Millisecond))
+			}
+			for end := range rev.sent {
+				if !seqAfter(end, ack) {
+					delete(rev.sent, end)
+				}
+			}
+		}
+	}
+
+	if length == 0 {
+		return
+	}
+	end := seq + length
+	if payload > 0 {
+		c.dataSegments++
+	}
+	if dir.initialized && !seqAfter(end, dir.highestEnd) {
+		if payload > 0 {
+			c.retransmissions++
+		}
+		delete(dir.sent, end) // Karn: ambiguous
+		return
+	}
+	dir.initialized, dir.highestEnd = true, end
+	if len(dir.sent) < maxOutstandingSegments {
+		dir.sent[end] = ts
+	}
+}
+
+// result summarizes the capture and derives a rule. baseRttMs is the RTT of
+// the lab path without any rule, which the delay does not need to add.
+func (c *calibrator) result(baseRttMs float64) *Calibration {
+	res := &Calibration{
+		Packets:         c.packets,
+		RttSamples:      len(c.rtts),
+		DataSegments:    c.dataSegments,
+		Retransmissions: c.retransmissions,
+		Profile:         &V4NetworkOptions{},
+	}
+	for key := range c.flows {
+		if _, ok := c.flows[key.reverse()]; !ok || bytesLess(key.src, key.dst) {
+			res.TCPFlows++
+		}
+	}
+	res.DurationSec = c.last.Sub(c.first).Seconds()
+	if res.DurationSec > 0 {
+		res.AvgThroughputBps = c.bytes * 8 / res.DurationSec
+	}
+	for _, b := range c.perSecond {
+		res.PeakThroughputBps = math.Max(res.PeakThroughputBps, b*8)
+	}
+	if c.dataSegments > 0 {
+		res.RetransmitPercent = roundTo(float64(c.retransmissions)/float64(c.dataSegments)*100, 2)
+	}
+
+	p := res.Profile
+	if len(c.rtts) > 0 {
+		sort.Float64s(c.rtts)
+		res.RttMinMs = roundTo(c.rtts[0], 3)
+		res.RttMedianMs = roundTo(percentile(c.rtts, 50), 3)
+		res.RttP90Ms = roundTo(percentile(c.rtts, 90), 3)
+		res.RttStddevMs = roundTo(stddev(c.rtts), 3)
+
+		// netem delays one direction, which adds the full delay to the RTT
+		if delay := roundTo(res.RttMedianMs-baseRttMs, 1); delay > 0 {
+			p.Delay = strconv.FormatFloat(delay, 'f', -1, 64)
+		}
+		if jitter := roundTo(res.RttStddevMs, 1); jitter > 0 && p.Delay != "" {
+			p.Jitter = strconv.FormatFloat(jitter, 'f', -1, 64)
+			p.Distribution = "normal"
+		}
+		if len(c.rtts) < 20 {
+			res.Notes = append(res.Notes, fmt.Sprintf("only %d RTT samples: capture longer or busier traffic for a reliable delay", len(c.rtts)))
+		}
+	} else {
+		res.Notes = append(res.Notes, "no RTT samples: the capture has no acknowledged TCP segments")
+	}
+	if res.RetransmitPercent > 0 {
+		p.LossModel = "random"
+		p.Loss = strconv.FormatFloat(res.RetransmitPercent, 'f', -1, 64)
+		res.Notes = append(res.Notes, "loss is estimated from TCP retransmissions, which also include spurious ones")
+	}
+	if kbit := math.Floor(res.PeakThroughputBps / 1000); kbit > 0 && res.DurationSec >= 1 {
+		p.Rate = fmt.Sprintf("%.0fkbit", kbit)
+		res.Notes = append(res.Notes, "rate is the busiest second of the capture: remove it if the traffic did not saturate the link")
+	}
+	if baseRttMs == 0 {
+		res.Notes = append(res.Notes, "set 'baseRtt' to the RTT of the lab path so it is not added twice")
+	}
+
+	q := url.Values{}
+	for name, v := range map[string]string{
+		"rate": p.Rate, "delay": p.Delay, "jitter": p.Jitter, "distribution": p.Distribution,
+		"lossModel": p.LossModel, "loss": p.Loss,
+	} {
+		if v != "" {
+			q.Set(name, v)
+		}
+	}
+	res.SetupQuery = q.Encode()
+	return res
+}
+
+func bytesLess(a, b [16]byte) bool {
+	for i := range a {
+		if a[i] != b[i] {
+			return a[i] < b[i]
+		}
+	}
+	return false
+}
+
+// percentile returns the p-th percentile of sorted values.
+func percentile(sorted []float64, p float64) float64 {
+	i := int(math.Ceil(p/100*float64(len(sorted)))) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+func roundTo(v float64, decimals int) float64 {
+	f := math.Pow(10, float64(decimals))
+	return math.Round(v*f) / f
+}
+
+// --- Handlers: /calibrate ---
+
+// calibrateBaseRtt reads the optional 'baseRtt' (ms, default 0).
+func calibrateBaseRtt(r *http.Request) (float64, error) {
+	v := r.URL.Query().Get("baseRtt")
+	if v == "" {
+		return 0, nil
+	}
+	baseRttMs, err := strconv.ParseFloat(v, 64)
+	if err != nil || baseRttMs < 0 {
+		return 0, fmt.Errorf("invalid 'baseRtt' %q (ms)", v)
+	}
+	return baseRttMs, nil
+}
+
+// handleCalibrateUpload analyzes an uploaded pcap file (request body).
+func handleCalibrateUpload(w http.ResponseWriter, r *http.Request) {
+	baseRttMs, err := calibrateBaseRtt(r)
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	c := newCalibrator()
+	if err := c.read(bufio.NewReader(http.MaxBytesReader(w, r.Body, 512<<20))); err != nil {
+		respondWithError(w, fmt.Sprintf("calibrate: %v", err), 400)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, c.result(baseRttMs))
+}
+
+// handleCalibrateCapture captures 'iface' for 'duration' (default 10s),
+// optionally restricted by the tcpdump 'filter' (e.g. "host 10.0.0.5"), and
+// analyzes it. Only headers are captured.
+func handleCalibrateCapture(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	baseRttMs, err := calibrateBaseRtt(r)
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	iface := q.Get("iface")
+	if iface == "" {
+		respondWithError(w, "calibrate: 'iface' is required", 400)
+		return
+	}
+	duration := 10 * time.Second
+	if v := q.Get("duration"); v != "" {
+		if duration, err = time.ParseDuration(v); err != nil || duration <= 0 || duration > maxCaptureDuration {
+			respondWithError(w, fmt.Sprintf("calibrate: invalid 'duration' %q (max %v)", v, maxCaptureDuration), 400)
+			return
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), duration)
+	defer cancel()
+	args := []string{"-i", iface, "-U", "-n", "-s", "128", "-w", "-"}
+	if filter := q.Get("filter"); filter != "" {
+		args = append(args, filter)
+	}
+	cmd := command(ctx, "tcpdump", args...)
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("calibrate: %v", err), 500)
+		return
+	}
+	log.Printf("[INFO] CALIBRATE: Executing: %s (for %v)", cmd.String(), duration)
+	if err := cmd.Start(); err != nil {
+		respondWithError(w, fmt.Sprintf("calibrate: failed to start tcpdump: %v", err), 500)
+		return
+	}
+	c := newCalibrator()
+	readErr := c.read(bufio.NewReader(stdout))
+	cmd.Wait()
+	if readErr != nil && !(c.packets == 0 && errors.Is(readErr, io.EOF)) { // nothing captured
+		respondWithError(w, fmt.Sprintf("calibrate: capture on %s failed: %v", iface, readErr), 500)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, c.result(baseRttMs))
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+)
+
+// --- Canary Impairment (Flow Sampling) ---
+
+// A sampled rule impairs the flows whose hash falls in the buckets of
+// flowSamplePercent, combined with the selectors: "5% of the flows to
+// service X". The buckets of a percentage contain those of every lower one,
+// so raising it (with PATCH /rules/{id}) keeps the flows already impaired
+// and adds others, like a progressive rollout. Only the sampling filters
+// are replaced; the classes and qdiscs stay.
+
+// flowHashBuckets is the number of buckets the flows are hashed into.
+const flowHashBuckets = 256
+
+// flowHashMatch is the ematch of the packets whose flow falls in the first
+// n buckets. It reads the kernel's flow hash of the packet (the skb hash),
+// a hash of its 5-tuple (addresses, protocol and ports) set by the NIC or
+// the flow dissector; the connections of local sockets carry a
+// per-connection hash of their own. Either way every packet of a flow falls
+// in the same bucket, whichever side picked its ports.
+func flowHashMatch(n int) string {
+	return fmt.Sprintf("meta(rxhash mask 0x%x lt %d)", flowHashBuckets-1, n)
+}
+
+// addSampleFilters sends the sampled flows (Prio 2) to the impaired class
+// of a rule without selectors; everything else is caught by the (Prio 3)
+// filter and sent to the unimpaired one.
+func (v *V4NetworkOptions) addSampleFilters(ctx context.Context, dev string, n int, impaired, unimpaired string) error {
+	log.Printf("[INFO] V4: Impairing %v%% of flows (%d of %d buckets)", v.FlowSamplePercent, n, flowHashBuckets)
+	if err := runTC(ctx, v.sampleFilter("add", dev, n)...); err != nil {
+		return fmt.Errorf("V4: failed to add flow sampling filter: %w", err)
+	}
+	if err := runTC(ctx, "filter", "add", "dev", dev, "protocol", "all", "parent", rootHandle, "prio", "3",
+		"u32", "match", "u32", "0", "0",
+		"flowid", unimpaired); err != nil {
+		return fmt.Errorf("V4: failed to add unsampled 'fast' filter: %w", err)
+	}
+	return nil
+}
+
+// sampleFilter is the tc command (op "add" or "replace") of the flow
+// sampling filter of an HTB tree: without selectors it sends the flows of
+// the first n buckets (Prio 2) to the shaped class, with selectors the
+// others (Prio 4) to the unlimited class, ahead of the targets. Its handle
+// is fixed, so that resample replaces it in place.
+func (v *V4NetworkOptions) sampleFilter(op, dev string, n int) []string {
+	prio, match, flowid := "2", flowHashMatch(n), shapedClass
+	if v.hasSelectors() {
+		prio, match, flowid = "4", "not "+flowHashMatch(n), unlimitedClass
+	}
+	return []string{"filter", op, "dev", dev, "protocol", "all", "parent", rootHandle, "prio", prio, "handle", "1",
+		"basic", "match", match, "flowid", flowid}
+}
+
+// resample replaces the sampling filter of a live rule with that of
+// v.FlowSamplePercent, atomically: no flow changes class on the way.
+func (v *V4NetworkOptions) resample(ctx context.Context, dev string) error {
+	n, err := v.flowSampleBuckets()
+	if err != nil {
+		return err
+	}
+	log.Printf("[INFO] V4: Resampling the flows of %s to %v%%", v.Iface, v.FlowSamplePercent)
+	if err := runTC(ctx, v.sampleFilter("replace", dev, n)...); err != nil {
+		return fmt.Errorf("V4: failed to replace the flow sampling filter: %w", err)
+	}
+	return nil
+}
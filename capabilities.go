@@ -0,0 +1,74 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strconv"
+)
+
+// --- Host Capabilities ---
+
+// capabilities lists the optional features available on this host (also
+// reported to the fleet controller).
+func capabilities() map[string]bool {
+	return map[string]bool{
+		"ifb":             hasIFB,
+		"ipv6":            hasIPv6,
+		"ingressPolicing": true,
+		"l7Proxy":         l7ProxyEnabled(),
+		"tlsIntercept":    len(tlsInterceptor.hosts) > 0,
+		"objectStorage":   backupStore != nil,
+		"persistentState": os.Getenv("STATE_FILE") != "",
+		"watchdog":        safeMode.controlHost != "" || safeMode.keepalive > 0,
+		"autoReset":       autoReset.enabled(),
+		"clockSynced":     clockSynced(),
+		"packetMangling":  packetMangling(),
+		"resetInjection":  resetInjection(),
+		"ttlRewrite":      ttlRewrite(),
+		"snmp":            snmpEnabled(),
+		"netemSeed":       netemSeedSupported,
+		"http3Speedtest":  curlHTTP3(),
+	}
+}
+
+// clockSynced reports whether the clock is known to be synchronized.
+func clockSynced() bool {
+	synced, known, _ := clockSync()
+	return synced && known
+}
+
+// handleCapabilities returns the host's features, how 'incoming' rules
+// are applied by default ("ifb" or "police"), the disabled endpoint
+// groups, the chaos seed and whether this is the read-only view.
+func handleCapabilities(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"features":          capabilities(),
+		"ingressMode":       defaultIngressMode(),
+		"disabledEndpoints": disabledGroupNames(),
+		"protectedPorts":    protectedPortList(),
+		"chaosSeed":         strconv.FormatInt(chaosSeed, 10), // (a string: JSON numbers lose 64-bit precision)
+		"readOnly":          isReadOnlyView(r),
+	})
+}
+
+// handlePreflight returns the results of the startup checks, with their
+// messages and remediation hints in the client's language.
+func handlePreflight(w http.ResponseWriter, r *http.Request) {
+	lang := requestLanguage(r)
+	ok := true
+	checks := make([]PreflightCheck, 0, len(preflightChecks))
+	for _, check := range preflightChecks {
+		c := *check
+		if c.message != nil {
+			c.Message = c.message.Render(lang)
+		}
+		if c.hint != nil {
+			c.Hint = c.hint.Render(lang)
+		}
+		if c.Required && !c.Status {
+			ok = false
+		}
+		checks = append(checks, c)
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"ok": ok, "checks": checks})
+}
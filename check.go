@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+)
+
+// --- Configuration Check (-check) ---
+
+// 'netsim -check [state.json]' validates a configuration on the box it is
+// meant for, without starting the API or changing anything: the host (the
+// preflight checks), the environment (what the startup would refuse), the
+// library (LIBRARY_FILE) and every rule of the desired state (STATE_FILE,
+// or the file given). The plan of each rule on this host's interfaces and
+// features is printed, and the kernel judges the valid ones in a scratch
+// namespace (see Shadow Apply). It exits with 1 on any error, so a CI job
+// can gate the changes of a lab box's configuration.
+
+// runCheck checks the configuration, prints the report to out and returns
+// the number of failures.
+func runCheck(ctx context.Context, out io.Writer) int {
+	log.SetOutput(io.Discard) // the report says it all
+	defer log.SetOutput(os.Stderr)
+	if os.Getenv("API_LISTEN") == "" {
+		os.Setenv("API_LISTEN", "2023")
+	}
+	failures := 0
+	report := func(err error, format string, args ...interface{}) {
+		if err != nil {
+			failures++
+			fmt.Fprintf(out, "  ERROR %s: %v\n", fmt.Sprintf(format, args...), err)
+		}
+	}
+
+	fmt.Fprintf(out, "netsim %s configuration check\n\nHost:\n", version)
+	checks, _ := runPreflightChecks(ctx)
+	for _, check := range checks {
+		status := "OK   "
+		if !check.Status && check.Required {
+			status = "ERROR"
+			failures++
+		} else if !check.Status {
+			status = "WARN "
+		}
+		fmt.Fprintf(out, "  %s %s: %s\n", status, check.Name, check.Message)
+	}
+
+	fmt.Fprintln(out, "\nEnvironment:")
+	before := failures
+	report(loadSettings(), "settings")
+	report(loadSecrets(), "tokens")
+	report(configureRandomness(ctx), "CHAOS_SEED")
+	report(configureEndpointGroups(), "DISABLE_ENDPOINTS")
+	report(configureIfaceFilter(), "IFACE_INCLUDE/IFACE_EXCLUDE")
+	report(configureTrustedProxies(), "TRUSTED_PROXIES")
+	report(configureAPITLS(), "API_TLS_CERT/API_TLS_KEY")
+	report(configureProtectedPorts(), "protected ports")
+	report(configurePrivilegedFeatures(), "PRIVILEGED_FEATURES")
+	report(configureCleanup(), "CLEANUP_WORKERS")
+	_, err := leftoverPolicy()
+	report(err, "STARTUP_LEFTOVERS")
+	_, err = configureAutoReset()
+	report(err, "AUTO_RESET_AT/AUTO_RESET_IDLE")
+	ok, err := loadLibraryFile()
+	report(err, "LIBRARY_FILE")
+	if failures == before {
+		fmt.Fprintln(out, "  OK")
+	}
+	if ok && err == nil {
+		fmt.Fprintf(out, "  library: %s\n", os.Getenv("LIBRARY_FILE"))
+	}
+
+	// The rules are checked against the host as it is, not against each
+	// other: they stay out of the store
+	desired := &ruleStore{rules: map[ruleKey]*AppliedRule{}, revisions: map[string]uint64{}, settings: map[string]*Setting{}}
+	path := os.Getenv("STATE_FILE")
+	if path == "" {
+		fmt.Fprintln(out, "\nState: no STATE_FILE, no rules to check")
+	} else if _, err := os.Stat(path); err != nil {
+		fmt.Fprintf(out, "\nState: %s\n", path)
+		report(err, "STATE_FILE")
+	} else if err := desired.Open(path); err != nil {
+		fmt.Fprintf(out, "\nState: %s\n", path)
+		report(err, "STATE_FILE")
+	} else {
+		rules := desired.List()
+		fmt.Fprintf(out, "\nState: %s, %d rule(s)\n", path, len(rules))
+		var valid []*V4NetworkOptions
+		for _, rule := range rules {
+			if n := checkRule(ctx, out, rule.Options); n > 0 {
+				failures += n
+			} else {
+				valid = append(valid, rule.Options)
+			}
+		}
+		failures += checkShadow(ctx, out, valid)
+	}
+
+	if failures > 0 {
+		fmt.Fprintf(out, "\nFAILED: %d error(s)\n", failures)
+	} else {
+		fmt.Fprintln(out, "\nOK")
+	}
+	return failures
+}
+
+// checkRule prints the plan of a rule on this host and returns its number
+// of failures.
+func checkRule(ctx context.Context, out io.Writer, opts *V4NetworkOptions) int {
+	fmt.Fprintf(out, "\n%s (%s): %s\n", opts.Iface, opts.Direction, optionSummary(opts))
+	if _, err := net.InterfaceByName(opts.Iface); err != nil && !isDarwin {
+		fmt.Fprintf(out, "  ERROR no interface %s on this host\n", opts.Iface)
+		return 1
+	}
+	plan := planIn(ctx, "en", opts)
+	for i, step := range plan.Steps {
+		fmt.Fprintf(out, "  %d. %s\n     %s\n", i+1, step.Description, step.Command)
+	}
+	for _, warning := range plan.Warnings {
+		fmt.Fprintf(out, "  WARN  %s\n", warning)
+	}
+	for _, c := range plan.Conflicts {
+		fmt.Fprintf(out, "  WARN  %s\n", c.Message)
+	}
+	if plan.Error != "" {
+		fmt.Fprintf(out, "  ERROR %s\n", plan.Error)
+		return 1
+	}
+	return 0
+}
+
+// checkShadow shadow-applies rules, prints what the kernel said and returns
+// the number of rules it refused.
+func checkShadow(ctx context.Context, out io.Writer, rules []*V4NetworkOptions) int {
+	if len(rules) == 0 || isDarwin {
+		return 0
+	}
+	fmt.Fprintln(out, "\nKernel (shadow apply in a scratch namespace):")
+	results, _, err := shadowApply(ctx, "en", rules)
+	if err != nil {
+		fmt.Fprintf(out, "  WARN  not checked: %v\n", err)
+		return 0
+	}
+	refused := 0
+	for _, result := range results {
+		if result.OK {
+			fmt.Fprintf(out, "  OK    %s\n", result.Iface)
+			continue
+		}
+		refused++
+		fmt.Fprintf(out, "  ERROR %s: %s\n", result.Iface, result.Error)
+		if result.Command != "" {
+			fmt.Fprintf(out, "        refused: %s\n", result.Command)
+		}
+	}
+	return refused
+}
@@ -0,0 +1,374 @@
+// Package client is a typed Go client for the netsim-in-a-box REST API, so
+// automation does not have to build query strings by hand.
+//
+//	c := client.New("http://10.0.0.2:2023")
+//	etag, err := c.Setup(ctx, client.Options{Iface: "eth0", Direction: "outgoing", Delay: "100"}, "")
+//
+// The OpenAPI description of the same endpoints is in api/openapi.yaml.
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// APIVersion is the path segment of the config API.
+const APIVersion = "v2"
+
+// Options are the parameters of a V4 rule (see /config/setup). Values are
+// strings exactly as accepted by the API (e.g. Rate "10mbit", Delay "100").
+type Options struct {
+	Iface      string `json:"iface,omitempty"`
+	IfaceRegex string `json:"ifaceRegex,omitempty"`
+	Direction  string `json:"direction,omitempty"` // "outgoing" or "incoming"
+
+	Rate   string `json:"rate,omitempty"`
+	Ceil   string `json:"ceil,omitempty"`   // burst speed, >= Rate
+	Burst  string `json:"burst,omitempty"`  // e.g. "1mb"
+	Cburst string `json:"cburst,omitempty"` // e.g. "15k"
+
+	RateScope string `json:"rateScope,omitempty"` // "aggregate" or "flow": Rate caps each flow
+
+	Delay            string `json:"delay,omitempty"`  // ms
+	Jitter           string `json:"jitter,omitempty"` // ms
+	DelayCorrelation string `json:"delayCorrelation,omitempty"`
+	Distribution     string `json:"distribution,omitempty"`
+
+	LossModel       string `json:"lossModel,omitempty"` // "random", "state" or "gemodel"
+	Loss            string `json:"loss,omitempty"`
+	LossCorrelation string `json:"lossCorrelation,omitempty"`
+	LossStateP13    string `json:"lossStateP13,omitempty"`
+	LossStateP31    string `json:"lossStateP31,omitempty"`
+	LossStateP32    string `json:"lossStateP32,omitempty"`
+	LossStateP23    string `json:"lossStateP23,omitempty"`
+	LossStateP14    string `json:"lossStateP14,omitempty"`
+	LossGemodelP    string `json:"lossGemodelP,omitempty"`
+	LossGemodelR    string `json:"lossGemodelR,omitempty"`
+	LossGemodel1h   string `json:"lossGemodel1h,omitempty"`
+	LossGemodel1k   string `json:"lossGemodel1k,omitempty"`
+
+	Corrupt              string `json:"corrupt,omitempty"`
+	CorruptCorrelation   string `json:"corruptCorrelation,omitempty"`
+	Duplicate            string `json:"duplicate,omitempty"`
+	DuplicateCorrelation string `json:"duplicateCorrelation,omitempty"`
+	Reorder              string `json:"reorder,omitempty"`
+	ReorderCorrelation   string `json:"reorderCorrelation,omitempty"`
+	ReorderGap           string `json:"reorderGap,omitempty"`
+	Seed                 string `json:"seed,omitempty"`
+
+	FlowSamplePercent string `json:"flowSamplePercent,omitempty"`
+	SrcNetwork        string `json:"srcNetwork,omitempty"`
+	DstNetwork        string `json:"dstNetwork,omitempty"`
+	SrcPort           string `json:"srcPort,omitempty"`
+	DstPort           string `json:"dstPort,omitempty"`
+	ExcludeSrcNetwork string `json:"excludeSrcNetwork,omitempty"` // comma-separated
+	ExcludeDstNetwork string `json:"excludeDstNetwork,omitempty"` // comma-separated
+	ExcludeSrcPort    string `json:"excludeSrcPort,omitempty"`    // comma-separated
+	ExcludeDstPort    string `json:"excludeDstPort,omitempty"`    // comma-separated
+	ExcludeClient     string `json:"excludeClient,omitempty"`     // "true": also exclude the caller's IP (setup only)
+	IcmpDrop          string `json:"icmpDrop,omitempty"`          // comma-separated ICMP kinds
+	IcmpLimit         string `json:"icmpLimit,omitempty"`         // comma-separated ICMP kinds
+	IcmpRate          string `json:"icmpRate,omitempty"`
+	Compensate        string `json:"compensate,omitempty"`
+	IngressMode       string `json:"ingressMode,omitempty"` // "ifb" or "police"
+	Tree              string `json:"tree,omitempty"`        // "htb", "prio" or "netem"
+	PreserveMQ        string `json:"preserveMq,omitempty"`  // "true": keep an mq/mqprio root
+	ParentClass       string `json:"parentClass,omitempty"` // coexistence: host class to attach below
+	FilterOffload     string `json:"filterOffload,omitempty"`
+	ConfirmLoopback   string `json:"confirmLoopback,omitempty"` // "true": allow a rule on 'lo'
+}
+
+// Values encodes the options as the query string of /config/setup.
+func (o Options) Values() url.Values {
+	raw, _ := json.Marshal(o)
+	fields := map[string]string{}
+	json.Unmarshal(raw, &fields)
+	q := url.Values{}
+	for k, v := range fields {
+		q.Set(k, v)
+	}
+	return q
+}
+
+// Interface is a host interface returned by /config/init.
+type Interface struct {
+	Name string `json:"name"`
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+}
+
+// Rule is the desired rule recorded for one direction of an interface.
+type Rule struct {
+	ID        string    `json:"id"`
+	Options   Options   `json:"options"`
+	AppliedAt time.Time `json:"appliedAt"`
+	Revision  uint64    `json:"revision"`
+}
+
+// AppliedConfig is a rule as it was applied by /config/setup.
+type AppliedConfig struct {
+	RuleID    string            `json:"ruleId"`
+	Iface     string            `json:"iface"`
+	Direction string            `json:"direction"`
+	Device    string            `json:"device"` // iface, or ifb0 for 'incoming'
+	Tree      string            `json:"tree"`   // "htb", "prio", "netem", "police" or "mq"
+	Revision  uint64            `json:"revision"`
+	Handles   map[string]string `json:"handles"`
+	Rate      string            `json:"rate,omitempty"`
+	RateBits  float64           `json:"rateBits,omitempty"`
+	Ceil      string            `json:"ceil,omitempty"`
+	Netem     string            `json:"netem,omitempty"`
+	NetemSeed string            `json:"netemSeed,omitempty"`
+	Options   Options           `json:"options"`
+}
+
+// Counters are interface and qdisc counters (see /config/stats).
+type Counters struct {
+	RxBytes      uint64    `json:"rxBytes"`
+	TxBytes      uint64    `json:"txBytes"`
+	RxPackets    uint64    `json:"rxPackets"`
+	TxPackets    uint64    `json:"txPackets"`
+	RxDropped    uint64    `json:"rxDropped"`
+	TxDropped    uint64    `json:"txDropped"`
+	QdiscBytes   uint64    `json:"qdiscBytes"`
+	QdiscPackets uint64    `json:"qdiscPackets"`
+	QdiscDropped uint64    `json:"qdiscDropped"`
+	At           time.Time `json:"at"`
+}
+
+// RuleStats are the counters of a rule's interface since it was applied.
+type RuleStats struct {
+	RuleID     string            `json:"ruleId"`
+	Iface      string            `json:"iface"`
+	Direction  string            `json:"direction"`
+	Seconds    float64           `json:"seconds"`
+	SinceApply *Counters         `json:"sinceApply"`
+	Current    *Counters         `json:"current"`
+	Directions []*DirectionStats `json:"directions"`
+}
+
+// DirectionStats are the qdisc and class counters of one direction of an
+// interface ("outgoing" on it, "incoming" on its ifb device).
+type DirectionStats struct {
+	Direction string        `json:"direction"`
+	Device    string        `json:"device"`
+	Mode      string        `json:"mode"`
+	Shaped    bool          `json:"shaped"`
+	Qdiscs    []*TcCounters `json:"qdiscs"`
+	Classes   []*TcCounters `json:"classes"`
+}
+
+// TcCounters are the counters of a qdisc or class.
+type TcCounters struct {
+	Kind           string `json:"kind"`
+	Handle         string `json:"handle"`
+	Parent         string `json:"parent"`
+	Rate           string `json:"rate"`
+	Bytes          uint64 `json:"bytes"`
+	Packets        uint64 `json:"packets"`
+	Dropped        uint64 `json:"dropped"`
+	Overlimits     uint64 `json:"overlimits"`
+	Requeues       uint64 `json:"requeues"`
+	BacklogPackets uint64 `json:"backlogPackets"`
+}
+
+// Version is returned by /tc/api/version.
+type Version struct {
+	Software  string   `json:"software_version"`
+	API       string   `json:"api_version"`
+	Supported []string `json:"supported_api_versions"`
+}
+
+// System describes the server's environment (/system).
+type System struct {
+	Software  string `json:"softwareVersion"`
+	API       string `json:"apiVersion"`
+	Hostname  string `json:"hostname"`
+	OS        string `json:"os"`
+	Kernel    string `json:"kernel"`
+	Arch      string `json:"arch"`
+	GoVersion string `json:"goVersion"`
+	Iproute2  string `json:"iproute2"`
+	Tcconfig  string `json:"tcconfig"`
+	Container string `json:"container"` // "" on a host
+	Gateway   struct {
+		Enabled   bool   `json:"enabled"`
+		WanIface  string `json:"wanIface"`
+		IPForward bool   `json:"ipForward"`
+	} `json:"gatewayMode"`
+	Listen        string          `json:"listen"`
+	StartedAt     time.Time       `json:"startedAt"`
+	UptimeSeconds float64         `json:"uptimeSeconds"`
+	Features      map[string]bool `json:"features"`
+	IngressMode   string          `json:"ingressMode"`
+}
+
+// Error is a non-2xx API response.
+type Error struct {
+	StatusCode  int    `json:"code"`
+	Message     string `json:"message"`
+	MessageCode string `json:"messageCode"` // catalog code, e.g. "rule.invalidRate" (may be empty)
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("netsim: %d: %s", e.StatusCode, e.Message)
+}
+
+// Client calls one netsim-in-a-box instance.
+type Client struct {
+	BaseURL    string // e.g. "http://10.0.0.2:2023"
+	HTTPClient *http.Client
+}
+
+// New returns a client for baseURL with a 60s timeout.
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:    strings.TrimRight(baseURL, "/"),
+		HTTPClient: &http.Client{Timeout: 60 * time.Second},
+	}
+}
+
+// do sends a request and decodes a JSON response into out (if not nil).
+// It returns the ETag header of the response.
+func (c *Client) do(ctx context.Context, method, path string, q url.Values, ifMatch string, out interface{}) (string, error) {
+	u := c.BaseURL + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Netsim-API-Version", APIVersion)
+	if ifMatch != "" {
+		req.Header.Set("If-Match", ifMatch)
+	}
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	if resp.StatusCode/100 != 2 {
+		apiErr := &Error{StatusCode: resp.StatusCode}
+		if json.Unmarshal(body, apiErr) != nil || apiErr.Message == "" {
+			apiErr.Message = strings.TrimSpace(string(body))
+		}
+		apiErr.StatusCode = resp.StatusCode
+		return "", apiErr
+	}
+	if out != nil && len(body) > 0 && string(body) != "null\n" {
+		if err := json.Unmarshal(body, out); err != nil {
+			return "", fmt.Errorf("netsim: invalid response from %s: %w", path, err)
+		}
+	}
+	return resp.Header.Get("ETag"), nil
+}
+
+func configPath(endpoint string) string {
+	return fmt.Sprintf("/tc/api/%s/config/%s", APIVersion, endpoint)
+}
+
+// Version returns the server software and API versions.
+func (c *Client) Version(ctx context.Context) (*Version, error) {
+	v := &Version{}
+	_, err := c.do(ctx, http.MethodGet, "/tc/api/version", nil, "", v)
+	return v, err
+}
+
+// System returns the server's environment summary.
+func (c *Client) System(ctx context.Context) (*System, error) {
+	s := &System{}
+	_, err := c.do(ctx, http.MethodGet, fmt.Sprintf("/tc/api/%s/system", APIVersion), nil, "", s)
+	return s, err
+}
+
+// Interfaces lists the host interfaces with IPs (/config/init).
+func (c *Client) Interfaces(ctx context.Context) ([]Interface, error) {
+	var resp struct {
+		Ifaces []Interface `json:"ifaces"`
+	}
+	_, err := c.do(ctx, http.MethodGet, configPath("init"), nil, "", &resp)
+	return resp.Ifaces, err
+}
+
+// Setup applies a rule and returns the new ETag. ifMatch ("" to skip) is a
+// previous ETag: the call fails with 412 if the interface changed since.
+func (c *Client) Setup(ctx context.Context, opts Options, ifMatch string) (string, error) {
+	_, etag, err := c.Apply(ctx, opts, ifMatch)
+	return etag, err
+}
+
+// Apply is Setup that also returns the applied configuration of each
+// target interface.
+func (c *Client) Apply(ctx context.Context, opts Options, ifMatch string) ([]*AppliedConfig, string, error) {
+	var resp struct {
+		Applied []*AppliedConfig `json:"applied"`
+	}
+	etag, err := c.do(ctx, http.MethodGet, configPath("setup"), opts.Values(), ifMatch, &resp)
+	return resp.Applied, etag, err
+}
+
+// Reset removes the rules of iface (a name or glob) and returns the ETag.
+func (c *Client) Reset(ctx context.Context, iface, ifMatch string) (string, error) {
+	return c.do(ctx, http.MethodGet, configPath("reset"), url.Values{"iface": {iface}}, ifMatch, nil)
+}
+
+// ResetAll removes every rule from the host (the "panic button") and
+// returns the interfaces that were reset.
+func (c *Client) ResetAll(ctx context.Context) ([]string, error) {
+	var resp struct {
+		Ifaces []string `json:"ifaces"`
+	}
+	_, err := c.do(ctx, http.MethodPost, configPath("reset-all"), nil, "", &resp)
+	return resp.Ifaces, err
+}
+
+// Rule returns the desired rule of iface (its outgoing rule when it has
+// both, nil if none) and its ETag.
+func (c *Client) Rule(ctx context.Context, iface string) (*Rule, string, error) {
+	var resp struct {
+		Rule *Rule `json:"rule"`
+	}
+	etag, err := c.do(ctx, http.MethodGet, configPath("query"), url.Values{"iface": {iface}}, "", &resp)
+	return resp.Rule, etag, err
+}
+
+// DeleteRule removes the rule with the ID (the rule of the other direction
+// of its interface stays) and returns the ETag.
+func (c *Client) DeleteRule(ctx context.Context, id, ifMatch string) (string, error) {
+	return c.do(ctx, http.MethodDelete, fmt.Sprintf("/tc/api/%s/rules/%s", APIVersion, url.PathEscape(id)), nil, ifMatch, nil)
+}
+
+// Rules returns every desired rule and the global ETag.
+func (c *Client) Rules(ctx context.Context) ([]*Rule, string, error) {
+	var resp struct {
+		Rules []*Rule `json:"rules"`
+	}
+	etag, err := c.do(ctx, http.MethodGet, configPath("query"), nil, "", &resp)
+	return resp.Rules, etag, err
+}
+
+// Stats returns the counters of every rule (or of iface, if not "") since
+// the rule was applied.
+func (c *Client) Stats(ctx context.Context, iface string) ([]*RuleStats, error) {
+	var resp struct {
+		Stats []*RuleStats `json:"stats"`
+	}
+	var q url.Values
+	if iface != "" {
+		q = url.Values{"iface": {iface}}
+	}
+	_, err := c.do(ctx, http.MethodGet, configPath("stats"), q, "", &resp)
+	return resp.Stats, err
+}
@@ -0,0 +1,459 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// --- OpenAPI Spec ---
+
+// spec is api/openapi.yaml.
+type spec struct {
+	root map[string]any
+}
+
+func loadSpec(t *testing.T) *spec {
+	t.Helper()
+	data, err := os.ReadFile("../api/openapi.yaml")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var root map[string]any
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		t.Fatalf("api/openapi.yaml: %v", err)
+	}
+	return &spec{root: root}
+}
+
+// resolve follows the $ref of node, if it has one.
+func (s *spec) resolve(node map[string]any) map[string]any {
+	for {
+		ref, ok := node["$ref"].(string)
+		if !ok {
+			return node
+		}
+		var cur any = s.root
+		for _, name := range strings.Split(strings.TrimPrefix(ref, "#/"), "/") {
+			cur, _ = cur.(map[string]any)[name]
+		}
+		next, ok := cur.(map[string]any)
+		if !ok {
+			return map[string]any{}
+		}
+		node = next
+	}
+}
+
+// schema returns a schema of components/schemas.
+func (s *spec) schema(name string) map[string]any {
+	return s.resolve(map[string]any{"$ref": "#/components/schemas/" + name})
+}
+
+// operation returns the operation of method on path (matching the path
+// templates) and the parameters it declares, by name.
+func (s *spec) operation(method, path string) (map[string]any, map[string]map[string]any) {
+	paths, _ := s.root["paths"].(map[string]any)
+	for template, item := range paths {
+		if !pathMatches(template, path) {
+			continue
+		}
+		pathItem, _ := item.(map[string]any)
+		op, ok := pathItem[strings.ToLower(method)].(map[string]any)
+		if !ok {
+			return nil, nil
+		}
+		params := map[string]map[string]any{}
+		for _, list := range []any{pathItem["parameters"], op["parameters"]} {
+			items, _ := list.([]any)
+			for _, p := range items {
+				param := s.resolve(p.(map[string]any))
+				params[param["name"].(string)] = param
+			}
+		}
+		return op, params
+	}
+	return nil, nil
+}
+
+func pathMatches(template, path string) bool {
+	ts, ps := strings.Split(template, "/"), strings.Split(path, "/")
+	if len(ts) != len(ps) {
+		return false
+	}
+	for i := range ts {
+		if ts[i] != ps[i] && !strings.HasPrefix(ts[i], "{") {
+			return false
+		}
+	}
+	return true
+}
+
+// responseSchema returns the JSON schema of an operation's response.
+func (s *spec) responseSchema(op map[string]any, status int) map[string]any {
+	responses, _ := op["responses"].(map[string]any)
+	resp, ok := responses[strconv.Itoa(status)].(map[string]any)
+	if !ok {
+		return nil
+	}
+	resp = s.resolve(resp)
+	content, _ := resp["content"].(map[string]any)
+	media, _ := content["application/json"].(map[string]any)
+	schema, _ := media["schema"].(map[string]any)
+	return schema
+}
+
+// validate checks a decoded JSON value against a schema. Properties the
+// schema does not declare are errors, unless it is a free-form object.
+func (s *spec) validate(v any, schema map[string]any, at string) error {
+	schema = s.resolve(schema)
+	if v == nil {
+		if schema["nullable"] == true {
+			return nil
+		}
+		return fmt.Errorf("%s: null", at)
+	}
+	if all, ok := schema["allOf"].([]any); ok {
+		for _, sub := range all {
+			if err := s.validate(v, sub.(map[string]any), at); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if enum, ok := schema["enum"].([]any); ok && !slices.Contains(enum, v) {
+		return fmt.Errorf("%s: %v is not one of %v", at, v, enum)
+	}
+	switch schema["type"] {
+	case "object":
+		obj, ok := v.(map[string]any)
+		if !ok {
+			return fmt.Errorf("%s: %T, want an object", at, v)
+		}
+		props, _ := schema["properties"].(map[string]any)
+		extra, _ := schema["additionalProperties"].(map[string]any)
+		for key, value := range obj {
+			prop, ok := props[key].(map[string]any)
+			switch {
+			case ok:
+			case extra != nil:
+				prop = extra
+			case props == nil:
+				continue
+			default:
+				return fmt.Errorf("%s: undeclared property '%s'", at, key)
+			}
+			if err := s.validate(value, prop, at+"."+key); err != nil {
+				return err
+			}
+		}
+	case "array":
+		arr, ok := v.([]any)
+		if !ok {
+			return fmt.Errorf("%s: %T, want an array", at, v)
+		}
+		items, _ := schema["items"].(map[string]any)
+		for i, item := range arr {
+			if err := s.validate(item, items, fmt.Sprintf("%s[%d]", at, i)); err != nil {
+				return err
+			}
+		}
+	case "string":
+		str, ok := v.(string)
+		if !ok {
+			return fmt.Errorf("%s: %T, want a string", at, v)
+		}
+		if schema["format"] == "date-time" {
+			if _, err := time.Parse(time.RFC3339, str); err != nil {
+				return fmt.Errorf("%s: %v", at, err)
+			}
+		}
+	case "integer":
+		if f, ok := v.(float64); !ok || f != math.Trunc(f) {
+			return fmt.Errorf("%s: %v, want an integer", at, v)
+		}
+	case "number":
+		if _, ok := v.(float64); !ok {
+			return fmt.Errorf("%s: %T, want a number", at, v)
+		}
+	case "boolean":
+		if _, ok := v.(bool); !ok {
+			return fmt.Errorf("%s: %T, want a boolean", at, v)
+		}
+	}
+	return nil
+}
+
+// schemaTypes are the schema types a Go kind is encoded as.
+var schemaTypes = map[reflect.Kind]string{
+	reflect.String:  "string",
+	reflect.Bool:    "boolean",
+	reflect.Int:     "integer",
+	reflect.Int64:   "integer",
+	reflect.Uint64:  "integer",
+	reflect.Float64: "number",
+	reflect.Slice:   "array",
+	reflect.Map:     "object",
+	reflect.Struct:  "object",
+}
+
+// setupOnly are the Options that select what /config/setup applies to but
+// are not recorded in the rule (TestClientAgainstSpec checks that they are
+// setup parameters).
+var setupOnly = map[string]bool{"ifaceRegex": true, "excludeClient": true}
+
+// checkType fails t for a JSON field of typ that schema does not declare,
+// or declares with another type.
+func (s *spec) checkType(t *testing.T, typ reflect.Type, schema map[string]any, at string) {
+	t.Helper()
+	schema = s.resolve(schema)
+	for typ.Kind() == reflect.Pointer {
+		typ = typ.Elem()
+	}
+	want := schemaTypes[typ.Kind()]
+	if typ == reflect.TypeOf(time.Time{}) {
+		want = "string"
+	}
+	if schema["type"] != want {
+		t.Errorf("%s: %s is a %v in the spec, want %s", at, typ, schema["type"], want)
+		return
+	}
+	switch typ.Kind() {
+	case reflect.Slice:
+		items, _ := schema["items"].(map[string]any)
+		s.checkType(t, typ.Elem(), items, at+"[]")
+	case reflect.Map:
+		extra, _ := schema["additionalProperties"].(map[string]any)
+		s.checkType(t, typ.Elem(), extra, at+".*")
+	case reflect.Struct:
+		if typ == reflect.TypeOf(time.Time{}) {
+			return
+		}
+		props, _ := schema["properties"].(map[string]any)
+		for i := 0; i < typ.NumField(); i++ {
+			name, _, _ := strings.Cut(typ.Field(i).Tag.Get("json"), ",")
+			if name == "" || name == "-" || (typ == reflect.TypeOf(Options{}) && setupOnly[name]) {
+				continue
+			}
+			prop, ok := props[name].(map[string]any)
+			if !ok {
+				t.Errorf("%s: field '%s' is not in the spec", at, name)
+				continue
+			}
+			s.checkType(t, typ.Field(i).Type, prop, at+"."+name)
+		}
+	}
+}
+
+// --- Tests ---
+
+func TestTypesMatchSpec(t *testing.T) {
+	s := loadSpec(t)
+	for _, tc := range []struct {
+		value  any
+		schema string
+	}{
+		{Options{}, "Options"},
+		{Interface{}, "Interface"},
+		{Rule{}, "Rule"},
+		{AppliedConfig{}, "AppliedConfig"},
+		{Counters{}, "Counters"},
+		{RuleStats{}, "RuleStats"},
+		{DirectionStats{}, "DirectionStats"},
+		{TcCounters{}, "TcCounters"},
+		{Version{}, "Version"},
+		{System{}, "System"},
+		{Error{}, "Error"},
+	} {
+		s.checkType(t, reflect.TypeOf(tc.value), s.schema(tc.schema), tc.schema)
+	}
+}
+
+const (
+	testRuleID = "3f6c8a52-7d4e-4c1b-9a0e-2b5f1d7e8c90"
+	testRule   = `{"id":"` + testRuleID + `","options":{"iface":"eth0","direction":"outgoing","rate":"10mbit","delay":"100"},"appliedAt":"2026-10-17T09:30:00Z","revision":7}`
+	testStats  = `{"ruleId":"` + testRuleID + `","iface":"eth0","direction":"outgoing","seconds":12.5,
+		"sinceApply":{"rxBytes":1200,"txBytes":3400,"rxPackets":12,"txPackets":34,"rxDropped":0,"txDropped":2,"qdiscBytes":3400,"qdiscPackets":34,"qdiscDropped":2,"at":"2026-10-17T09:30:12Z"},
+		"current":{"rxBytes":5200,"txBytes":9400,"rxPackets":52,"txPackets":94,"rxDropped":0,"txDropped":2,"qdiscBytes":9400,"qdiscPackets":94,"qdiscDropped":2,"at":"2026-10-17T09:30:12Z"},
+		"directions":[{"direction":"outgoing","device":"eth0","mode":"ifb","shaped":true,
+			"qdiscs":[{"kind":"htb","handle":"1:","parent":"root","rate":"","bytes":9400,"packets":94,"dropped":2,"overlimits":3,"requeues":0,"backlogPackets":0}],
+			"classes":[{"kind":"htb","handle":"1:10","parent":"1:","rate":"10Mbit","bytes":9400,"packets":94,"dropped":0,"overlimits":3,"requeues":0,"backlogPackets":1}]}]}`
+)
+
+// everyOption returns Options with every field set.
+func everyOption() Options {
+	var opts Options
+	v := reflect.ValueOf(&opts).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		v.Field(i).SetString("1")
+	}
+	opts.Iface, opts.Direction = "eth0", "outgoing"
+	return opts
+}
+
+func TestClientAgainstSpec(t *testing.T) {
+	s := loadSpec(t)
+
+	// The response of the call under test
+	var status int
+	var body string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		op, params := s.operation(r.Method, r.URL.Path)
+		if op == nil {
+			t.Errorf("%s %s is not in the spec", r.Method, r.URL.Path)
+			http.NotFound(w, r)
+			return
+		}
+		if v := r.Header.Get("X-Netsim-API-Version"); v != APIVersion {
+			t.Errorf("%s %s: X-Netsim-API-Version %q, want %q", r.Method, r.URL.Path, v, APIVersion)
+		}
+		q := r.URL.Query()
+		for name := range q {
+			if p := params[name]; p == nil || p["in"] != "query" {
+				t.Errorf("%s %s: query parameter '%s' is not in the spec", r.Method, r.URL.Path, name)
+			}
+		}
+		for name, p := range params {
+			if p["in"] == "query" && p["required"] == true && !q.Has(name) {
+				t.Errorf("%s %s: required query parameter '%s' missing", r.Method, r.URL.Path, name)
+			}
+		}
+		if r.Header.Get("If-Match") != "" && params["If-Match"] == nil {
+			t.Errorf("%s %s: sends If-Match, which the spec does not declare", r.Method, r.URL.Path)
+		}
+
+		schema := s.responseSchema(op, status)
+		if schema == nil {
+			t.Errorf("%s %s: no %d response in the spec", r.Method, r.URL.Path, status)
+		}
+		var decoded any
+		if err := json.Unmarshal([]byte(body), &decoded); err != nil {
+			t.Fatalf("%s %s: invalid fixture: %v", r.Method, r.URL.Path, err)
+		}
+		if err := s.validate(decoded, schema, r.URL.Path); err != nil {
+			t.Errorf("%s %s: response does not match the spec: %v", r.Method, r.URL.Path, err)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Header().Set("X-Netsim-API-Version", APIVersion)
+		w.Header().Set("ETag", `"7"`)
+		w.WriteHeader(status)
+		fmt.Fprintln(w, body)
+	}))
+	defer srv.Close()
+	c := New(srv.URL)
+	ctx := context.Background()
+
+	for _, tc := range []struct {
+		name   string
+		status int
+		body   string
+		call   func() error
+	}{
+		{"Version", 200, `{"software_version":"2.4.0","api_version":"v2","supported_api_versions":["v2"]}`, func() error {
+			v, err := c.Version(ctx)
+			if err == nil && (v.API != "v2" || !slices.Equal(v.Supported, []string{"v2"})) {
+				err = fmt.Errorf("got %+v", v)
+			}
+			return err
+		}},
+		{"System", 200, `{"softwareVersion":"2.4.0","apiVersion":"v2","hostname":"lab1","os":"Debian GNU/Linux 12 (bookworm)","kernel":"6.1.0","arch":"amd64","goVersion":"go1.23.2","iproute2":"tc utility, iproute2-6.1.0","tcconfig":"","container":"docker",
+			"gatewayMode":{"enabled":true,"wanIface":"eth1","ipForward":true},"listen":":2023","startedAt":"2026-10-17T09:00:00Z","uptimeSeconds":1800.5,"features":{"ifb":true},"ingressMode":"ifb"}`, func() error {
+			sys, err := c.System(ctx)
+			if err == nil && (sys.Container != "docker" || !sys.Gateway.Enabled || !sys.Features["ifb"]) {
+				err = fmt.Errorf("got %+v", sys)
+			}
+			return err
+		}},
+		{"Interfaces", 200, `{"ifaces":[{"name":"eth0","ipv4":"10.0.0.2"},{"name":"eth1","ipv4":"192.168.1.2","ipv6":"fe80::1"}]}`, func() error {
+			ifaces, err := c.Interfaces(ctx)
+			if err == nil && (len(ifaces) != 2 || ifaces[1].IPv6 != "fe80::1") {
+				err = fmt.Errorf("got %+v", ifaces)
+			}
+			return err
+		}},
+		{"Apply", 200, `{"ifaces":["eth0"],"applied":[{"ruleId":"` + testRuleID + `","iface":"eth0","direction":"outgoing","device":"eth0","tree":"htb","revision":7,
+			"handles":{"root":"1:","shapedClass":"1:10","netem":"10:"},"rate":"10mbit","rateBits":10000000,"netem":"delay 100ms","netemSeed":"42",
+			"options":{"iface":"eth0","direction":"outgoing","rate":"10mbit","delay":"100"}}],"warnings":[]}`, func() error {
+			applied, etag, err := c.Apply(ctx, everyOption(), `"6"`)
+			if err == nil && (etag != `"7"` || len(applied) != 1 || applied[0].RuleID != testRuleID || applied[0].Handles["netem"] != "10:") {
+				err = fmt.Errorf("got %+v, %s", applied, etag)
+			}
+			return err
+		}},
+		{"Setup stale", 412, `{"code":412,"message":"conflict: 'eth0' was changed by someone else (revision 8, you have 7). Reload and retry"}`, func() error {
+			_, err := c.Setup(ctx, Options{Iface: "eth0", Direction: "outgoing", Delay: "50"}, `"7"`)
+			var apiErr *Error
+			if !errors.As(err, &apiErr) || apiErr.StatusCode != 412 || !strings.Contains(apiErr.Message, "revision 8") {
+				return fmt.Errorf("got %v, want a 412 *Error", err)
+			}
+			return nil
+		}},
+		{"Reset", 200, `{"ifaces":["eth0"]}`, func() error {
+			etag, err := c.Reset(ctx, "eth0", `"7"`)
+			if err == nil && etag != `"7"` {
+				err = fmt.Errorf("got ETag %s", etag)
+			}
+			return err
+		}},
+		{"ResetAll", 200, `{"ifaces":["eth0","eth1"]}`, func() error {
+			ifaces, err := c.ResetAll(ctx)
+			if err == nil && !slices.Equal(ifaces, []string{"eth0", "eth1"}) {
+				err = fmt.Errorf("got %v", ifaces)
+			}
+			return err
+		}},
+		{"Rule", 200, `{"iface":"eth0","revision":7,"rule":` + testRule + `}`, func() error {
+			rule, etag, err := c.Rule(ctx, "eth0")
+			if err == nil && (rule == nil || rule.ID != testRuleID || rule.Options.Rate != "10mbit" || etag != `"7"`) {
+				err = fmt.Errorf("got %+v, %s", rule, etag)
+			}
+			return err
+		}},
+		{"Rule none", 200, `{"iface":"eth1","revision":7,"rule":null}`, func() error {
+			rule, _, err := c.Rule(ctx, "eth1")
+			if err == nil && rule != nil {
+				err = fmt.Errorf("got %+v, want no rule", rule)
+			}
+			return err
+		}},
+		{"Rules", 200, `{"revision":7,"rules":[` + testRule + `]}`, func() error {
+			rules, _, err := c.Rules(ctx)
+			if err == nil && (len(rules) != 1 || !rules[0].AppliedAt.Equal(time.Date(2026, 10, 17, 9, 30, 0, 0, time.UTC))) {
+				err = fmt.Errorf("got %+v", rules)
+			}
+			return err
+		}},
+		{"DeleteRule", 200, `null`, func() error {
+			etag, err := c.DeleteRule(ctx, testRuleID, `"7"`)
+			if err == nil && etag != `"7"` {
+				err = fmt.Errorf("got ETag %s", etag)
+			}
+			return err
+		}},
+		{"Stats", 200, `{"stats":[` + testStats + `]}`, func() error {
+			stats, err := c.Stats(ctx, "eth0")
+			if err == nil && (len(stats) != 1 || stats[0].RuleID != testRuleID || stats[0].SinceApply.TxDropped != 2 || stats[0].Directions[0].Classes[0].BacklogPackets != 1) {
+				err = fmt.Errorf("got %+v", stats)
+			}
+			return err
+		}},
+	} {
+		status, body = tc.status, tc.body
+		if err := tc.call(); err != nil {
+			t.Errorf("%s: %v", tc.name, err)
+		}
+	}
+}
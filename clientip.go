@@ -0,0 +1,132 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// --- Client IP and Trusted Proxies ---
+
+// trustedProxies are the networks of TRUSTED_PROXIES (default: loopback).
+// Only requests from these peers may name the client in X-Forwarded-For or
+// X-Real-IP; anyone else could use the headers to pose as another client.
+var trustedProxies []*net.IPNet
+
+// configureTrustedProxies reads TRUSTED_PROXIES, a comma-separated list of
+// IPs or CIDRs ("none" trusts no proxy).
+func configureTrustedProxies() error {
+	list := os.Getenv("TRUSTED_PROXIES")
+	if list == "" {
+		list = "127.0.0.0/8,::1/128"
+	}
+	trustedProxies = nil
+	for _, entry := range strings.Split(list, ",") {
+		if entry = strings.TrimSpace(entry); entry == "" || entry == "none" {
+			continue
+		}
+		if !strings.Contains(entry, "/") {
+			ip := net.ParseIP(entry)
+			if ip == nil {
+				return fmt.Errorf("invalid TRUSTED_PROXIES entry '%s'", entry)
+			}
+			bits := 128
+			if ip.To4() != nil {
+				bits = 32
+			}
+			entry = fmt.Sprintf("%s/%d", entry, bits)
+		}
+		_, network, err := net.ParseCIDR(entry)
+		if err != nil {
+			return fmt.Errorf("invalid TRUSTED_PROXIES entry '%s': %w", entry, err)
+		}
+		trustedProxies = append(trustedProxies, network)
+	}
+	return nil
+}
+
+// isTrustedProxy reports whether ip is in TRUSTED_PROXIES.
+func isTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// remoteIP returns the IP of r.RemoteAddr ("ip:port", or a bare IP once
+// RealIPMiddleware replaced it), or nil.
+func remoteIP(r *http.Request) net.IP {
+	if host, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		return net.ParseIP(host)
+	}
+	return net.ParseIP(r.RemoteAddr)
+}
+
+// forwardedClientIP returns the client named by a trusted proxy: the last
+// X-Forwarded-For address that is not itself a trusted proxy (earlier ones
+// were written by the client and can be forged), else X-Real-IP.
+func forwardedClientIP(r *http.Request) net.IP {
+	if xff := r.Header.Values("X-Forwarded-For"); len(xff) > 0 {
+		hops := strings.Split(strings.Join(xff, ","), ",")
+		var ip net.IP
+		for i := len(hops) - 1; i >= 0; i-- {
+			if ip = net.ParseIP(strings.TrimSpace(hops[i])); ip == nil || !isTrustedProxy(ip) {
+				return ip
+			}
+		}
+		return ip // Every hop is a trusted proxy: the first one is the client
+	}
+	return net.ParseIP(strings.TrimSpace(r.Header.Get("X-Real-IP")))
+}
+
+// RealIPMiddleware sets RemoteAddr to the client's IP when the request came
+// through a trusted proxy, like chi's RealIP but without believing the
+// headers of untrusted peers.
+func RealIPMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if peer := remoteIP(r); peer != nil && isTrustedProxy(peer) {
+			if ip := forwardedClientIP(r); ip != nil {
+				r.RemoteAddr = ip.String()
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// --- Client Exclusion ---
+
+// excludeClient adds the client's IP to the excluded networks of opts
+// (both directions), so the rule does not impair the connections of the
+// machine it is configured from. It applies with excludeClient=true, or by
+// default with EXCLUDE_CLIENT=true unless the rule cannot use selectors. It
+// returns the excluded IP, or "".
+func excludeClient(r *http.Request, opts *V4NetworkOptions) string {
+	switch r.URL.Query().Get("excludeClient") {
+	case "true":
+	case "":
+		if setting("EXCLUDE_CLIENT") != "true" || opts.Tree == "netem" ||
+			opts.PreserveMQ == "true" || opts.Direction == "incoming" && opts.ingressMode() == "police" {
+			return ""
+		}
+	default:
+		return ""
+	}
+	ip := remoteIP(r)
+	if ip == nil || ip.IsLoopback() {
+		return "" // Local clients do not cross the shaped interfaces
+	}
+	client := ip.String()
+	for _, list := range []*string{&opts.ExcludeSrcNetwork, &opts.ExcludeDstNetwork} {
+		if *list != "" {
+			*list += ","
+		}
+		*list += client
+	}
+	log.Printf("[INFO] V4: Excluding the client %s from the rule of %s", client, opts.Iface)
+	return client
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// --- Coexistence Mode ---
+
+// validateParentClass checks (and normalizes to tc's "1:20" form) the class
+// of the host's tree that an 'outgoing' rule is attached below. The tree
+// then becomes the leaf qdisc of that class instead of replacing the root.
+func (v *V4NetworkOptions) validateParentClass() error {
+	if v.ParentClass == "" {
+		return nil
+	}
+	if v.Direction != "outgoing" {
+		return msg("rule.parentClassOutgoing")
+	}
+	if v.PreserveMQ == "true" {
+		return msg("rule.parentClassIncompatible")
+	}
+	major, minor, found := strings.Cut(v.ParentClass, ":")
+	maj, errMaj := strconv.ParseUint(strings.TrimPrefix(major, "0x"), 16, 16)
+	mnr, errMin := strconv.ParseUint(strings.TrimPrefix(minor, "0x"), 16, 16)
+	if !found || errMaj != nil || errMin != nil || maj == 0 || mnr == 0 {
+		return msg("rule.invalidParentClass", v.ParentClass)
+	}
+	class := fmt.Sprintf("%x:%x", maj, mnr)
+	if ownsHandle(class) {
+		return msg("rule.invalidParentClass", v.ParentClass)
+	}
+	v.ParentClass = class
+	return nil
+}
+
+// treeAttach returns where the tree of the rule is attached: "root", or
+// "parent" and the host's class in coexistence mode.
+func (v *V4NetworkOptions) treeAttach() []string {
+	if v.ParentClass != "" && v.Direction == "outgoing" {
+		return []string{"parent", v.ParentClass}
+	}
+	return []string{"root"}
+}
+
+// parentClassExists reports whether the host's tree on iface has the class.
+func parentClassExists(ctx context.Context, iface, class string) bool {
+	out, err := runTCOutput(ctx, "class", "show", "dev", iface, "classid", class)
+	return err == nil && strings.TrimSpace(out) != ""
+}
+
+// hostLeafQdisc returns the kind of the leaf qdisc the host attached to
+// class (e.g. "fq_codel"), or "" when the class has its default one or ours.
+func hostLeafQdisc(ctx context.Context, iface, class string) string {
+	out, err := runTCOutput(ctx, "qdisc", "show", "dev", iface)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 5 && fields[0] == "qdisc" && fields[3] == "parent" && fields[4] == class && !ownsHandle(fields[2]) {
+			return fields[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Latency Compensation ---
+
+// LatencyBaseline is the RTT the host path adds by itself (virtio, bridges,
+// ...), measured without any rule on the interface.
+type LatencyBaseline struct {
+	Iface    string  `json:"iface"`
+	Target   string  `json:"target"`
+	Sent     int     `json:"sent"`
+	Received int     `json:"received"`
+	RttMinMs float64 `json:"rttMinMs"`
+	RttAvgMs float64 `json:"rttAvgMs"`
+	JitterMs float64 `json:"jitterMs"` // standard deviation of the RTT
+	Measured TcTime  `json:"measured"`
+}
+
+// latencyBaselines holds the last baseline of each interface.
+var latencyBaselines = struct {
+	sync.Mutex
+	byIface map[string]*LatencyBaseline
+}{byIface: map[string]*LatencyBaseline{}}
+
+func latencyBaseline(iface string) *LatencyBaseline {
+	latencyBaselines.Lock()
+	defer latencyBaselines.Unlock()
+	return latencyBaselines.byIface[iface]
+}
+
+// compensatedDelay returns the netem delay and jitter to configure. With
+// Compensate "true" and a baseline measured, the host's own RTT is subtracted
+// from the delay (netem delays one direction, which adds the full delay to
+// the RTT) and its jitter from the jitter (variances add up).
+func (v *V4NetworkOptions) compensatedDelay() (delay, jitter string) {
+	delay, jitter = v.Delay, v.Jitter
+	b := latencyBaseline(v.Iface)
+	if v.Compensate != "true" || b == nil || delay == "" {
+		return delay, jitter
+	}
+	d := math.Max(parseFloatOrZero(delay)-b.RttAvgMs, 0)
+	delay = strconv.FormatFloat(roundTo(d, 3), 'f', -1, 64)
+	if jitter != "" {
+		j := parseFloatOrZero(jitter)
+		j = math.Sqrt(math.Max(j*j-b.JitterMs*b.JitterMs, 0))
+		jitter = strconv.FormatFloat(roundTo(j, 3), 'f', -1, 64)
+	}
+	return delay, jitter
+}
+
+// compensationWarnings explains the compensation of opts, if any.
+func compensationWarnings(opts *V4NetworkOptions) []string {
+	if opts.Compensate != "true" {
+		return nil
+	}
+	b := latencyBaseline(opts.Iface)
+	if b == nil {
+		return []string{fmt.Sprintf("no latency baseline for %s: the delay is not compensated (measure one with /calibrate/baseline)", opts.Iface)}
+	}
+	delay, _ := opts.compensatedDelay()
+	warnings := []string{fmt.Sprintf("delay compensated for the host's own %.3fms RTT: %sms requested, %sms configured (tolerance +/-%.3fms)",
+		b.RttAvgMs, opts.Delay, delay, b.JitterMs)}
+	if parseFloatOrZero(opts.Delay) < b.RttAvgMs {
+		warnings = append(warnings, fmt.Sprintf("the requested delay is below the host's own RTT (%.3fms) and cannot be met", b.RttAvgMs))
+	}
+	return warnings
+}
+
+// defaultGateway returns the default gateway via iface, if any.
+func defaultGateway(ctx context.Context, iface string) string {
+	for _, family := range []string{"-4", "-6"} {
+		out, err := command(ctx, "ip", family, "route", "show", "default", "dev", iface).Output()
+		if err != nil {
+			continue
+		}
+		fields := strings.Fields(string(out))
+		for i, f := range fields {
+			if f == "via" && i+1 < len(fields) {
+				return fields[i+1]
+			}
+		}
+	}
+	return ""
+}
+
+// replyTimeout is how long pingRTTs waits for the last replies.
+const replyTimeout = 2 * time.Second
+
+// pingRTTs sends count ICMP echo requests to target, from the address of
+// iface, and returns the RTTs (ms) of the replies.
+func pingRTTs(ctx context.Context, iface, target string, count int, interval time.Duration) ([]float64, error) {
+	dst, err := net.ResolveIPAddr("ip", target)
+	if err != nil {
+		return nil, fmt.Errorf("invalid target '%s': %w", target, err)
+	}
+	v4 := dst.IP.To4() != nil
+	network, echoType, replyType := "ip6:ipv6-icmp", byte(128), byte(129)
+	if v4 {
+		network, echoType, replyType = "ip4:icmp", 8, 0
+	}
+	conn, err := net.ListenPacket(network, interfaceAddr(iface, v4))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open ICMP socket (needs CAP_NET_RAW): %w", err)
+	}
+	defer conn.Close()
+
+	id := uint16(os.Getpid())
+	sent := map[uint16]time.Time{}
+	var rtts []float64
+	buf := make([]byte, 1500)
+	// collect reads replies until deadline, or until all probes are answered
+	collect := func(deadline time.Time) error {
+		for len(sent) > 0 {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			conn.SetReadDeadline(deadline)
+			n, _, err := conn.ReadFrom(buf)
+			if err != nil {
+				return nil
+			}
+			if n < 8 || buf[0] != replyType || binary.BigEndian.Uint16(buf[4:6]) != id {
+				continue
+			}
+			if t, ok := sent[binary.BigEndian.Uint16(buf[6:8])]; ok {
+				rtts = append(rtts, float64(time.Since(t))/float64(time.Millisecond))
+				delete(sent, binary.BigEndian.Uint16(buf[6:8]))
+			}
+		}
+		return nil
+	}
+
+	for seq := uint16(0); seq < uint16(count); seq++ {
+		msg := make([]byte, 16)
+		msg[0] = echoType
+		binary.BigEndian.PutUint16(msg[4:6], id)
+		binary.BigEndian.PutUint16(msg[6:8], seq)
+		if v4 { // the kernel computes the ICMPv6 checksum
+			binary.BigEndian.PutUint16(msg[2:4], icmpChecksum(msg))
+		}
+		sent[seq] = time.Now()
+		if _, err := conn.WriteTo(msg, dst); err != nil {
+			return nil, fmt.Errorf("failed to send to %s: %w", target, err)
+		}
+		next := time.Now().Add(interval)
+		if err := collect(next); err != nil {
+			return nil, err
+		}
+		time.Sleep(time.Until(next))
+	}
+	// Late replies (e.g. through a delay rule)
+	if err := collect(time.Now().Add(replyTimeout)); err != nil {
+		return nil, err
+	}
+	return rtts, nil
+}
+
+// interfaceAddr returns the first IPv4 (or global IPv6) address of iface, or
+// "" to let the kernel choose.
+func interfaceAddr(name string, v4 bool) string {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return ""
+	}
+	addrs, _ := iface.Addrs()
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || (ipnet.IP.To4() != nil) != v4 || ipnet.IP.IsLinkLocalUnicast() && !v4 {
+			continue
+		}
+		return ipnet.IP.String()
+	}
+	return ""
+}
+
+// icmpChecksum is the Internet checksum (RFC 1071).
+func icmpChecksum(b []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum > 0xffff {
+		sum = sum>>16 + sum&0xffff
+	}
+	return ^uint16(sum)
+}
+
+// measureLatencyBaseline pings target (default: the gateway of iface).
+func measureLatencyBaseline(ctx context.Context, iface, target string, count int) (*LatencyBaseline, error) {
+	if target == "" {
+		if target = defaultGateway(ctx, iface); target == "" {
+			return nil, fmt.Errorf("no default gateway via %s: set 'target'", iface)
+		}
+	}
+	rtts, err := pingRTTs(ctx, iface, target, count, 100*time.Millisecond)
+	if err != nil {
+		return nil, err
+	}
+	if len(rtts) < (count+1)/2 {
+		return nil, fmt.Errorf("only %d of %d probes to %s were answered", len(rtts), count, target)
+	}
+	sort.Float64s(rtts)
+	return &LatencyBaseline{
+		Iface:    iface,
+		Target:   target,
+		Sent:     count,
+		Received: len(rtts),
+		RttMinMs: roundTo(rtts[0], 3),
+		RttAvgMs: roundTo(mean(rtts), 3),
+		JitterMs: roundTo(stddev(rtts), 3),
+		Measured: TcTime(time.Now()),
+	}, nil
+}
+
+// --- Handlers: /calibrate/baseline ---
+
+// handleBaselineMeasure measures the latency baseline of 'iface' by pinging
+// 'target' (default: its gateway) 'count' times (default 20). The interface
+// must not have a rule, which would be part of the measurement.
+func handleBaselineMeasure(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	iface := q.Get("iface")
+	if iface == "" {
+		respondWithError(w, "calibrate: 'iface' is required", 400)
+		return
+	}
+	count := 20
+	if v := q.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 200 {
+			respondWithError(w, fmt.Sprintf("calibrate: invalid 'count' %q (1-200)", v), 400)
+			return
+		}
+		count = n
+	}
+	if store.Get(iface, "") != nil {
+		respondWithError(w, fmt.Sprintf("calibrate: %s has a rule: reset it before measuring the baseline", iface), 409)
+		return
+	}
+	b, err := measureLatencyBaseline(r.Context(), iface, q.Get("target"), count)
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("calibrate: %v", err), 502)
+		return
+	}
+	latencyBaselines.Lock()
+	latencyBaselines.byIface[iface] = b
+	latencyBaselines.Unlock()
+	log.Printf("[INFO] CALIBRATE: Baseline of %s: %.3fms +/- %.3fms to %s", iface, b.RttAvgMs, b.JitterMs, b.Target)
+	respondWithJSON(w, http.StatusOK, b)
+}
+
+// handleBaselineList returns the measured baselines.
+func handleBaselineList(w http.ResponseWriter, r *http.Request) {
+	latencyBaselines.Lock()
+	list := make([]*LatencyBaseline, 0, len(latencyBaselines.byIface))
+	for _, b := range latencyBaselines.byIface {
+		list = append(list, b)
+	}
+	latencyBaselines.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].Iface < list[j].Iface })
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleBaselineDelete forgets the baseline of 'iface'.
+func handleBaselineDelete(w http.ResponseWriter, r *http.Request) {
+	latencyBaselines.Lock()
+	delete(latencyBaselines.byIface, r.URL.Query().Get("iface"))
+	latencyBaselines.Unlock()
+	respondWithJSON(w, http.StatusOK, nil)
+}
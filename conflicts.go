@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"regexp"
+	"slices"
+	"strconv"
+)
+
+// --- Rule Conflict Detection ---
+
+// RuleConflict is something already on an interface that stands in the way
+// of a rule, found before the rule is applied. A blocking conflict would
+// make tc fail (with an RTNETLINK error) or leave the rule without effect.
+type RuleConflict struct {
+	Iface    string `json:"iface"`
+	Code     string `json:"code"` // catalog code, e.g. "conflict.foreignRoot"
+	Blocking bool   `json:"blocking"`
+	Message  string `json:"message"`
+	Hint     string `json:"hint,omitempty"`
+
+	message, hint *Message
+}
+
+// render sets Message and Hint in lang.
+func (c *RuleConflict) render(lang string) *RuleConflict {
+	c.Message = c.message.Render(lang)
+	if c.hint != nil {
+		c.Hint = c.hint.Render(lang)
+	}
+	return c
+}
+
+// redirectPattern finds the target device of a mirred redirect in 'tc
+// filter show' output.
+var redirectPattern = regexp.MustCompile(`Redirect to device (\S+?)\)`)
+
+// ingressPrefs are the ingress filter priorities a rule adds: the ifb
+// redirect, or the pass filters and the policer.
+func (v *V4NetworkOptions) ingressPrefs() []string {
+	if v.ingressMode() == "police" {
+		return []string{"2", "3", "4"}
+	}
+	return []string{"2"}
+}
+
+// detectConflicts analyzes the qdiscs and filters of the rule's interface
+// (and ifb0 for 'incoming' rules) for what the rule would collide with:
+// a root qdisc of the host, a foreign root on ifb0, an ingress already
+// redirected elsewhere, or host filters at the priorities the rule uses.
+func (v *V4NetworkOptions) detectConflicts(ctx context.Context) []*RuleConflict {
+	if isDarwin || v.Iface == "" {
+		return nil
+	}
+	var conflicts []*RuleConflict
+	add := func(blocking bool, message, hint *Message) {
+		conflicts = append(conflicts, &RuleConflict{Iface: v.Iface, Code: message.Code, Blocking: blocking, message: message, hint: hint})
+	}
+
+	if v.Direction == "outgoing" {
+		kind, handle := rootQdisc(ctx, v.Iface)
+		if v.ParentClass == "" && handle != "" && handle != "0:" && !ownsHandle(handle) && !isMultiQueueRoot(kind) {
+			add(false, msg("conflict.foreignRoot", kind, handle, v.Iface), msg("hint.foreignRoot", v.Iface))
+		}
+		return conflicts
+	}
+	if v.Direction != "incoming" {
+		return nil
+	}
+
+	if v.ingressMode() == "ifb" {
+		if kind, handle := rootQdisc(ctx, "ifb0"); handle != "" && handle != "0:" && !ownsHandle(handle) {
+			add(true, msg("conflict.foreignIfbRoot", kind, handle), msg("hint.foreignIfbRoot"))
+		}
+	}
+	if ingressQdisc(ctx, v.Iface) == "" {
+		return conflicts
+	}
+	out, err := runTCOutput(ctx, "filter", "show", "dev", v.Iface, "ingress")
+	if err != nil {
+		return conflicts
+	}
+	prefs := v.ingressPrefs()
+	first, _ := strconv.Atoi(prefs[0])
+	seen := map[string]bool{}
+	for _, f := range parseFilters(out) {
+		if f.own() || seen[f.pref] {
+			continue
+		}
+		seen[f.pref] = true
+		pref, _ := strconv.Atoi(f.pref)
+		switch m := redirectPattern.FindStringSubmatch(f.text); {
+		case slices.Contains(prefs, f.pref):
+			add(true, msg("conflict.filterPref", f.pref, v.Iface), msg("hint.filterPref", v.Iface, f.pref))
+		case m == nil || m[1] == "ifb0":
+		case pref < first:
+			// (filters run by priority: this one takes the traffic first)
+			add(true, msg("conflict.ingressRedirect", v.Iface, m[1], f.pref), msg("hint.ingressRedirect", v.Iface, f.pref, m[1]))
+		default:
+			add(false, msg("conflict.ingressRedirectOverridden", v.Iface, m[1], f.pref), nil)
+		}
+	}
+	return conflicts
+}
+
+// conflictsStop reports whether conflicts stop a setup: with onConflict
+// "" the blocking ones do, with "fail" any does, with "ignore" none.
+func conflictsStop(conflicts []*RuleConflict, onConflict string) bool {
+	for _, c := range conflicts {
+		if onConflict == "fail" || onConflict == "" && c.Blocking {
+			return true
+		}
+	}
+	return false
+}
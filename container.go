@@ -0,0 +1,76 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// --- Container Awareness ---
+
+// Bits of the capabilities netsim needs in the capability sets.
+const (
+	capNetAdmin = 12 // tc and ip changes
+	capNetRaw   = 13 // tcpdump
+)
+
+// hasCapability reports whether capability c is in the effective set of the
+// process (/proc/self/status).
+func hasCapability(c int) (bool, error) {
+	b, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false, err
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		if v, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(v), 16, 64)
+			if err != nil {
+				return false, fmt.Errorf("invalid CapEff %q", strings.TrimSpace(v))
+			}
+			return caps&(1<<c) != 0, nil
+		}
+	}
+	return false, fmt.Errorf("no CapEff in /proc/self/status")
+}
+
+// isolatedInterfaces returns the interfaces of a container network namespace
+// (veth ends whose peer lives elsewhere) when no host interface is visible,
+// i.e. the container was started without --net=host. With host networking
+// the NICs (and bridges like docker0) are visible and it returns nil.
+func isolatedInterfaces() []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var isolated []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback != 0 || strings.HasPrefix(iface.Name, "ifb") {
+			continue
+		}
+		sys := "/sys/class/net/" + iface.Name
+		if _, err := os.Stat(sys + "/device"); err == nil {
+			return nil // a NIC
+		}
+		if _, err := os.Stat(sys + "/bridge"); err == nil {
+			return nil // a bridge (docker0, br-...)
+		}
+		if link, err := os.ReadFile(sys + "/iflink"); err == nil {
+			if peer, _ := strconv.Atoi(strings.TrimSpace(string(link))); peer != 0 && peer != iface.Index {
+				isolated = append(isolated, iface.Name)
+			}
+		}
+	}
+	return isolated
+}
+
+// permissionHint adds a remediation hint to the error output of a tc or ip
+// command that failed for lack of privileges, which otherwise only says
+// "Operation not permitted".
+func permissionHint(errStr string) error {
+	if strings.Contains(errStr, "Operation not permitted") {
+		return msg("hint.netAdmin")
+	}
+	return nil
+}
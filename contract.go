@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+)
+
+// --- API Contract and Version Negotiation ---
+
+// apiVersionHeader names the API version a client speaks, and, in
+// responses, the version the server answered with.
+const apiVersionHeader = "X-Netsim-API-Version"
+
+// supportedAPIVersions are the API versions this server answers.
+var supportedAPIVersions = []string{apiVersion}
+
+// setupExtraParams are the /setup parameters that are not rule options.
+var setupExtraParams = []string{"ifaceRegex", "dryRun", "accuracy", "excludeClient", "onConflict", "profile", "shadow"}
+
+// planExtraParams are the /plan parameters on top of those of /setup.
+var planExtraParams = []string{"baseRtt", "mss"}
+
+// ruleOptionParams returns the query names of the rule options: the JSON
+// names of the V4NetworkOptions fields, which parseV4Options reads.
+func ruleOptionParams() []string {
+	var names []string
+	t := reflect.TypeOf(V4NetworkOptions{})
+	for i := 0; i < t.NumField(); i++ {
+		name, _, _ := strings.Cut(t.Field(i).Tag.Get("json"), ",")
+		if name != "" && name != "-" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// setupParams returns every parameter /setup accepts, sorted.
+func setupParams() []string {
+	names := append(ruleOptionParams(), setupExtraParams...)
+	sort.Strings(names)
+	return names
+}
+
+// unknownParams returns warnings for the query parameters of r that are
+// neither rule options nor in extra, sorted.
+func unknownParams(r *http.Request, extra ...string) []string {
+	known := map[string]bool{}
+	for _, name := range append(setupParams(), extra...) {
+		known[name] = true
+	}
+	lang := requestLanguage(r)
+	var warnings []string
+	for name := range r.URL.Query() {
+		if !known[name] {
+			warnings = append(warnings, msg("rule.unknownParam", name).Render(lang))
+		}
+	}
+	sort.Strings(warnings)
+	return warnings
+}
+
+// APIVersionMiddleware negotiates the API version: a request naming a
+// version (X-Netsim-API-Version) this server does not answer is refused
+// with 406, and every API response names the version it was served with.
+func APIVersionMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/tc/api/") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if v := r.Header.Get(apiVersionHeader); v != "" && !slices.Contains(supportedAPIVersions, v) {
+			respondWithError(w, fmt.Sprintf("API version '%s' is not supported (supported: %s)",
+				v, strings.Join(supportedAPIVersions, ", ")), http.StatusNotAcceptable)
+			return
+		}
+		w.Header().Set(apiVersionHeader, apiVersion)
+		next.ServeHTTP(w, r)
+	})
+}
+
+// --- Handlers: /contract ---
+
+// handleContract returns the query parameters the API accepts, so clients
+// can check the names they send.
+func handleContract(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"apiVersion":        apiVersion,
+		"supportedVersions": supportedAPIVersions,
+		"setupParams":       setupParams(),
+		"planParams":        planExtraParams,
+	})
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"regexp"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestContractParamsReachFields checks that each rule option parameter
+// reaches its own field of the rule: a parameter parseV4Options leaves out,
+// or reads into another field, would be silently dropped.
+func TestContractParamsReachFields(t *testing.T) {
+	typ := reflect.TypeOf(V4NetworkOptions{})
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if name == "" || name == "-" || field.Type.Kind() != reflect.String {
+			continue
+		}
+		value := "contract-" + name
+		opts := reflect.ValueOf(parseV4Options(url.Values{name: {value}})).Elem()
+		for j := 0; j < typ.NumField(); j++ {
+			got := opts.Field(j).String()
+			if j == i && got != value {
+				t.Errorf("'%s' does not reach %s", name, field.Name)
+			} else if j != i && got == value {
+				t.Errorf("'%s' is read into %s", name, typ.Field(j).Name)
+			}
+		}
+	}
+}
+
+// TestContractFrontendFields checks that the server accepts every form
+// field the UI sends to /setup.
+func TestContractFrontendFields(t *testing.T) {
+	js, err := os.ReadFile("frontend/app.js")
+	if err != nil {
+		t.Fatal(err)
+	}
+	list := regexp.MustCompile(`(?s)const setupFields = \[(.*?)\];`).FindSubmatch(js)
+	if list == nil {
+		t.Fatal("frontend/app.js: no setupFields")
+	}
+	fields := regexp.MustCompile(`'([A-Za-z0-9]+)'`).FindAllSubmatch(list[1], -1)
+	if len(fields) == 0 {
+		t.Fatal("frontend/app.js: setupFields is empty")
+	}
+	params := setupParams()
+	for _, f := range fields {
+		if !slices.Contains(params, string(f[1])) {
+			t.Errorf("the UI sends '%s', which /setup does not accept", f[1])
+		}
+	}
+}
+
+func TestContractUnknownParams(t *testing.T) {
+	r := httptest.NewRequest(http.MethodGet, "/tc/api/v2/config/plan?iface=eth0&delay=10&baseRtt=20&losscorrelation=5", nil)
+	warnings := unknownParams(r, planExtraParams...)
+	if len(warnings) != 1 || !strings.Contains(warnings[0], "'losscorrelation'") {
+		t.Errorf("unknownParams = %q, want one warning for 'losscorrelation'", warnings)
+	}
+}
+
+func TestContractAPIVersion(t *testing.T) {
+	h := APIVersionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	for _, tc := range []struct {
+		version string
+		code    int
+	}{
+		{"", http.StatusOK},
+		{apiVersion, http.StatusOK},
+		{"v1", http.StatusNotAcceptable},
+	} {
+		r := httptest.NewRequest(http.MethodGet, "/tc/api/v2/config/init", nil)
+		if tc.version != "" {
+			r.Header.Set(apiVersionHeader, tc.version)
+		}
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, r)
+		if w.Code != tc.code {
+			t.Errorf("version %q: %d, want %d", tc.version, w.Code, tc.code)
+		}
+		if tc.code == http.StatusOK && w.Header().Get(apiVersionHeader) != apiVersion {
+			t.Errorf("version %q: answered with %q, want %q", tc.version, w.Header().Get(apiVersionHeader), apiVersion)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Time-of-Day Curves ---
+
+// CurvePoint overrides rule parameters from Hour (0-23, host local time)
+// until the next point. Empty fields keep the curve's base value.
+type CurvePoint struct {
+	Hour   int    `json:"hour"`
+	Rate   string `json:"rate,omitempty"`
+	Delay  string `json:"delay,omitempty"`
+	Jitter string `json:"jitter,omitempty"`
+	Loss   string `json:"loss,omitempty"`
+}
+
+// DiurnalCurve is a 24-hour schedule of rate/latency/loss for one interface,
+// e.g. a congested evening on an otherwise fast link.
+type DiurnalCurve struct {
+	Options *V4NetworkOptions `json:"options"`
+	Points  []CurvePoint      `json:"points"`
+}
+
+// curves holds the active curve of each interface (guarded by sched).
+var curves = map[string]*DiurnalCurve{}
+
+// validate checks and sorts the curve points.
+func (c *DiurnalCurve) validate() error {
+	if c.Options == nil || c.Options.Iface == "" || c.Options.Direction == "" {
+		return fmt.Errorf("curve: 'options.iface' and 'options.direction' are required")
+	}
+	if len(c.Points) == 0 {
+		return fmt.Errorf("curve: at least one point is required")
+	}
+	seen := map[int]bool{}
+	for _, p := range c.Points {
+		if p.Hour < 0 || p.Hour > 23 {
+			return fmt.Errorf("curve: invalid hour %d (must be 0-23)", p.Hour)
+		}
+		if seen[p.Hour] {
+			return fmt.Errorf("curve: duplicate hour %d", p.Hour)
+		}
+		seen[p.Hour] = true
+	}
+	sort.Slice(c.Points, func(i, j int) bool { return c.Points[i].Hour < c.Points[j].Hour })
+	return nil
+}
+
+// pointAt returns the index of the point active at t: the last point at or
+// before t's hour, wrapping around to the previous day's last point.
+func (c *DiurnalCurve) pointAt(t time.Time) int {
+	active := len(c.Points) - 1
+	for i, p := range c.Points {
+		if p.Hour <= t.Hour() {
+			active = i
+		}
+	}
+	return active
+}
+
+// optionsAt returns the rule options of point i applied over the base.
+func (c *DiurnalCurve) optionsAt(i int) *V4NetworkOptions {
+	opts := *c.Options
+	p := c.Points[i]
+	if p.Rate != "" {
+		opts.Rate = p.Rate
+	}
+	if p.Delay != "" {
+		opts.Delay = p.Delay
+	}
+	if p.Jitter != "" {
+		opts.Jitter = p.Jitter
+	}
+	if p.Loss != "" {
+		opts.LossModel = "random"
+		opts.Loss = p.Loss
+	}
+	return &opts
+}
+
+// run applies the active point whenever the hour crosses a point boundary.
+func (c *DiurnalCurve) run(ctx context.Context) {
+	applied := -1
+	var prev *V4NetworkOptions
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		if i := c.pointAt(time.Now()); i != applied {
+			opts := c.optionsAt(i)
+			log.Printf("[INFO] CURVE: %s entering hour %02d:00 (rate=%q delay=%q loss=%q)",
+				opts.Iface, c.Points[i].Hour, opts.Rate, opts.Delay, opts.Loss)
+			applyMu.Lock()
+			if ctx.Err() != nil { // Stopped (e.g. reset) while waiting for the lock
+				applyMu.Unlock()
+				return
+			}
+			err := opts.Adjust(ctx, prev)
+			if err == nil {
+				store.Set(opts, Actor{Source: "curve"})
+				prev, applied = opts, i
+			}
+			applyMu.Unlock()
+			if err != nil {
+				log.Printf("[ERROR] CURVE: Failed to apply point on %s: %v", opts.Iface, err)
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// --- Handlers: /curves ---
+
+// handleCurveStart installs (or replaces) the curve of an interface.
+func handleCurveStart(w http.ResponseWriter, r *http.Request) {
+	curve := &DiurnalCurve{}
+	if err := json.NewDecoder(r.Body).Decode(curve); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid curve JSON: %v", err), 400)
+		return
+	}
+	if err := curve.validate(); err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+
+	iface := curve.Options.Iface
+	sched.StopIface(iface)
+	sched.mu.Lock()
+	curves[iface] = curve
+	sched.mu.Unlock()
+	sched.Start("curve:"+iface, "curve", iface, curve.run)
+	respondWithJSON(w, http.StatusOK, curve)
+}
+
+// handleCurveList returns the curves of all interfaces with a running job.
+func handleCurveList(w http.ResponseWriter, r *http.Request) {
+	active := map[string]*DiurnalCurve{}
+	sched.mu.Lock()
+	for iface, curve := range curves {
+		if _, ok := sched.jobs["curve:"+iface]; ok {
+			active[iface] = curve
+		}
+	}
+	sched.mu.Unlock()
+	respondWithJSON(w, http.StatusOK, active)
+}
+
+// handleCurveStop stops the curve of an interface, keeping its current rule.
+func handleCurveStop(w http.ResponseWriter, r *http.Request) {
+	iface := chi.URLParam(r, "iface")
+	if !sched.Stop("curve:" + iface) {
+		respondWithError(w, fmt.Sprintf("no curve running on '%s'", iface), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Diagnostics ---
+
+// diagnostic is a read-only command of /diag with the parser of its output.
+// Unlike /config/raw, clients only pick a diagnostic (and an interface):
+// the commands and their arguments are fixed here.
+type diagnostic struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Command     string `json:"command"`         // IFACE is the 'iface' parameter
+	Iface       string `json:"iface,omitempty"` // "required" or "optional"
+
+	run func(ctx context.Context, iface string) (interface{}, error)
+}
+
+// diagnostics are the commands /diag runs, in the order it lists them.
+var diagnostics = []*diagnostic{
+	{
+		Name: "addr", Description: "Interfaces and their addresses",
+		Command: "ip -j addr show [dev IFACE]", Iface: "optional",
+		run: func(ctx context.Context, iface string) (interface{}, error) {
+			return diagJSON(ctx, "ip", withDev([]string{"-j", "addr", "show"}, iface)...)
+		},
+	},
+	{
+		Name: "route", Description: "IPv4 and IPv6 routes",
+		Command: "ip -j [-6] route show [dev IFACE]", Iface: "optional",
+		run: func(ctx context.Context, iface string) (interface{}, error) {
+			routes := map[string]json.RawMessage{}
+			v4, err := diagJSON(ctx, "ip", withDev([]string{"-j", "route", "show"}, iface)...)
+			if err != nil {
+				return nil, err
+			}
+			routes["ipv4"] = v4
+			if hasIPv6 {
+				if routes["ipv6"], err = diagJSON(ctx, "ip", withDev([]string{"-j", "-6", "route", "show"}, iface)...); err != nil {
+					return nil, err
+				}
+			}
+			return routes, nil
+		},
+	},
+	{
+		Name: "qdisc", Description: "qdiscs with their counters",
+		Command: "tc -j -s qdisc show [dev IFACE]", Iface: "optional",
+		run: func(ctx context.Context, iface string) (interface{}, error) {
+			return diagJSON(ctx, "tc", withDev([]string{"-j", "-s", "qdisc", "show"}, iface)...)
+		},
+	},
+	{
+		Name: "conntrack", Description: "Tracked connections and the table size",
+		Command: "conntrack -C", Iface: "",
+		run: func(ctx context.Context, _ string) (interface{}, error) {
+			return conntrackCount(ctx)
+		},
+	},
+	{
+		Name: "offloads", Description: "Offload features of a NIC",
+		Command: "ethtool -k IFACE", Iface: "required",
+		run: func(ctx context.Context, iface string) (interface{}, error) {
+			out, err := diagOutput(ctx, "ethtool", "-k", iface)
+			if err != nil {
+				return nil, err
+			}
+			return parseEthtoolFeatures(out), nil
+		},
+	},
+}
+
+// withDev appends "dev iface" to args when iface is set.
+func withDev(args []string, iface string) []string {
+	if iface == "" {
+		return args
+	}
+	return append(args, "dev", iface)
+}
+
+// diagOutput runs a diagnostic command and returns its stdout. A failure
+// carries the command's stderr.
+func diagOutput(ctx context.Context, name string, args ...string) (string, error) {
+	done := traceCommand(ctx, name, args)
+	b, err := command(ctx, name, args...).Output()
+	done(err)
+	if err != nil {
+		var exitErr *exec.ExitError
+		if errors.As(err, &exitErr) && len(exitErr.Stderr) > 0 {
+			return "", fmt.Errorf("%s: %v: %s", name, err, strings.TrimSpace(string(exitErr.Stderr)))
+		}
+		return "", fmt.Errorf("%s: %w", name, err)
+	}
+	return string(b), nil
+}
+
+// diagJSON runs a diagnostic command that prints JSON (-j).
+func diagJSON(ctx context.Context, name string, args ...string) (json.RawMessage, error) {
+	out, err := diagOutput(ctx, name, args...)
+	if err != nil {
+		return nil, err
+	}
+	out = strings.TrimSpace(out)
+	if out == "" {
+		return json.RawMessage("[]"), nil
+	}
+	if !json.Valid([]byte(out)) {
+		return nil, fmt.Errorf("%s: output is not JSON", name)
+	}
+	return json.RawMessage(out), nil
+}
+
+// conntrackCount returns the number of tracked connections and the table
+// size, from conntrack or, without it, from /proc.
+func conntrackCount(ctx context.Context) (map[string]int, error) {
+	counts := map[string]int{}
+	if out, err := diagOutput(ctx, "conntrack", "-C"); err == nil {
+		if counts["count"], err = strconv.Atoi(strings.TrimSpace(out)); err != nil {
+			return nil, fmt.Errorf("conntrack: unexpected output %q", strings.TrimSpace(out))
+		}
+	} else if b, err := os.ReadFile("/proc/sys/net/netfilter/nf_conntrack_count"); err == nil {
+		counts["count"], _ = strconv.Atoi(strings.TrimSpace(string(b)))
+	} else {
+		return nil, fmt.Errorf("conntrack: no conntrack tool and no nf_conntrack table (is the module loaded?)")
+	}
+	if b, err := os.ReadFile("/proc/sys/net/netfilter/nf_conntrack_max"); err == nil {
+		counts["max"], _ = strconv.Atoi(strings.TrimSpace(string(b)))
+	}
+	return counts, nil
+}
+
+// EthtoolFeature is an offload feature of 'ethtool -k'.
+type EthtoolFeature struct {
+	On    bool `json:"on"`
+	Fixed bool `json:"fixed,omitempty"` // cannot be changed
+}
+
+// parseEthtoolFeatures parses the "name: on|off [fixed]" lines of
+// 'ethtool -k'.
+func parseEthtoolFeatures(out string) map[string]EthtoolFeature {
+	features := map[string]EthtoolFeature{}
+	for _, line := range strings.Split(out, "\n") {
+		name, value, ok := strings.Cut(strings.TrimSpace(line), ":")
+		fields := strings.Fields(value)
+		if !ok || len(fields) == 0 || (fields[0] != "on" && fields[0] != "off") {
+			continue
+		}
+		features[name] = EthtoolFeature{On: fields[0] == "on", Fixed: strings.Contains(value, "[fixed]")}
+	}
+	return features
+}
+
+// --- Handlers: /diag ---
+
+// handleDiagList returns the diagnostics /diag/{name} runs.
+func handleDiagList(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"diagnostics": diagnostics})
+}
+
+// handleDiagRun runs a diagnostic, on 'iface' when given, and returns its
+// parsed output.
+func handleDiagRun(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	var d *diagnostic
+	for _, candidate := range diagnostics {
+		if candidate.Name == name {
+			d = candidate
+		}
+	}
+	if d == nil {
+		respondWithError(w, fmt.Sprintf("unknown diagnostic '%s'", name), 404)
+		return
+	}
+	iface := r.URL.Query().Get("iface")
+	switch {
+	case iface == "" && d.Iface == "required":
+		respondWithError(w, fmt.Sprintf("diagnostic '%s' needs 'iface'", name), 400)
+		return
+	case iface != "" && d.Iface == "":
+		respondWithError(w, fmt.Sprintf("diagnostic '%s' takes no 'iface'", name), 400)
+		return
+	case iface != "":
+		if _, err := net.InterfaceByName(iface); err != nil {
+			respondWithError(w, fmt.Sprintf("interface '%s' not found", iface), 404)
+			return
+		}
+	}
+	if isDarwin {
+		respondWithError(w, "diagnostics are not available on this platform", 501)
+		return
+	}
+
+	ranAt := time.Now()
+	result, err := d.run(r.Context(), iface)
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("diag %s: %v", name, err), 500)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"name":   name,
+		"iface":  iface,
+		"ranAt":  TcTime(ranAt),
+		"result": result,
+	})
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// --- Disable-able Endpoint Groups ---
+
+// endpointGroups are the groups of endpoints DISABLE_ENDPOINTS can turn
+// off, with their paths below /tc/api/v2. "gateway" also turns off
+// DEFAULT_GATEWAY_MODE.
+var endpointGroups = map[string][]string{
+	"raw":       {"/config/raw"},
+	"capture":   {"/calibrate/capture", "/mirror", "/flowexport"}, // tcpdump
+	"gateway":   {"/nat"},
+	"upgrade":   {"/restarter"},
+	"fleet":     {"/fleet"},
+	"library":   {"/library"},
+	"l7":        {"/l7"},
+	"mangle":    {"/mangle", "/resets", "/ttl"},
+	"scenarios": {"/scenarios"},
+	"curves":    {"/curves", "/oscillations", "/ab", "/satellite", "/handover", "/storms"},
+	"system":    {"/system", "/preflight", "/timesync"},
+	"metrics":   {"/metrics"},
+	"speedtest": {"/speedtest", "/owd"},
+	"diag":      {"/diag", "/connections"},
+	"alerts":    {"/alerts"}, // webhooks
+	"settings":  {"/settings"},
+}
+
+// endpointGroupAliases are other names of the groups.
+var endpointGroupAliases = map[string]string{
+	"scan":    "capture",
+	"tcpdump": "capture",
+}
+
+// disabledGroups are the endpoint groups turned off, at startup or by the
+// DISABLE_ENDPOINTS setting.
+var disabledGroups = struct {
+	sync.RWMutex
+	names map[string]bool
+}{names: map[string]bool{}}
+
+// lockedEndpoints are groups disabled at build time, for locked-down builds:
+//
+//	go build -ldflags "-X main.lockedEndpoints=raw,capture,upgrade"
+var lockedEndpoints string
+
+// parseEndpointGroups returns the groups of a list like "raw,capture". An
+// unknown group is an error, so a typo does not leave a group enabled.
+func parseEndpointGroups(list string) (map[string]bool, error) {
+	groups := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if alias, ok := endpointGroupAliases[name]; ok {
+			name = alias
+		}
+		if name == "" {
+			continue
+		}
+		if _, ok := endpointGroups[name]; !ok {
+			return nil, fmt.Errorf("unknown endpoint group '%s' in DISABLE_ENDPOINTS", name)
+		}
+		groups[name] = true
+	}
+	return groups, nil
+}
+
+// configureEndpointGroups disables the groups of lockedEndpoints and
+// DISABLE_ENDPOINTS (e.g. "raw,capture"), replacing the previous ones.
+func configureEndpointGroups() error {
+	groups, err := parseEndpointGroups(lockedEndpoints + "," + setting("DISABLE_ENDPOINTS"))
+	if err != nil {
+		return err
+	}
+	disabledGroups.Lock()
+	disabledGroups.names = groups
+	disabledGroups.Unlock()
+	if len(groups) > 0 {
+		log.Printf("[INFO] DISABLE_ENDPOINTS: Disabled endpoint groups: %s", strings.Join(disabledGroupNames(), ", "))
+	}
+	return nil
+}
+
+// groupDisabled reports whether the endpoint group name is disabled.
+func groupDisabled(name string) bool {
+	disabledGroups.RLock()
+	defer disabledGroups.RUnlock()
+	return disabledGroups.names[name]
+}
+
+// disabledGroupNames lists the disabled endpoint groups, sorted.
+func disabledGroupNames() []string {
+	disabledGroups.RLock()
+	defer disabledGroups.RUnlock()
+	names := make([]string, 0, len(disabledGroups.names))
+	for name := range disabledGroups.names {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// endpointDisabled reports whether path belongs to a disabled group.
+func endpointDisabled(path string) bool {
+	path, ok := strings.CutPrefix(path, "/tc/api/"+apiVersion)
+	if !ok {
+		return false
+	}
+	disabledGroups.RLock()
+	defer disabledGroups.RUnlock()
+	for name := range disabledGroups.names {
+		for _, prefix := range endpointGroups[name] {
+			if path == prefix || strings.HasPrefix(path, prefix+"/") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// EndpointGroupsMiddleware answers 404 for the endpoints of disabled
+// groups, as if they did not exist.
+func EndpointGroupsMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if endpointDisabled(r.URL.Path) {
+			http.NotFound(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
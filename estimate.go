@@ -0,0 +1,215 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// --- Impairment Effect Estimator ---
+
+// ImpairmentEstimate is the theoretical effect of a rule on one TCP flow.
+type ImpairmentEstimate struct {
+	ImpairedFlowsPercent  float64  `json:"impairedFlowsPercent"`
+	BaseRttMs             float64  `json:"baseRttMs"`
+	AddedRttMs            float64  `json:"addedRttMs"`
+	EffectiveRttMs        float64  `json:"effectiveRttMs"`
+	LossPercent           float64  `json:"lossPercent"`           // drops (incl. corruption)
+	RetransmissionPercent float64  `json:"retransmissionPercent"` // of sent segments
+	RateLimitBps          float64  `json:"rateLimitBps,omitempty"`
+	MaxTcpThroughputBps   float64  `json:"maxTcpThroughputBps,omitempty"` // 0 = unbounded
+	LimitedBy             string   `json:"limitedBy"`                     // "rate", "loss" or "none"
+	BdpBytes              float64  `json:"bdpBytes,omitempty"`
+	Notes                 []string `json:"notes,omitempty"`
+}
+
+// mathisConstant is C = sqrt(3/2) of the Mathis et al. model
+// (throughput <= MSS/RTT * C/sqrt(p)), for Reno-style congestion control.
+var mathisConstant = math.Sqrt(1.5)
+
+// estimateImpairment computes the expected effect of opts for a flow with
+// the given base RTT (ms, without the rule) and MSS (bytes).
+func estimateImpairment(opts *V4NetworkOptions, baseRttMs float64, mss int) *ImpairmentEstimate {
+	est := &ImpairmentEstimate{ImpairedFlowsPercent: 100, BaseRttMs: baseRttMs, LimitedBy: "none"}
+	if p, err := strconv.ParseFloat(opts.FlowSamplePercent, 64); err == nil {
+		est.ImpairedFlowsPercent = p
+	}
+
+	// netem delays one direction, which adds the full delay to the RTT.
+	// Jitter is symmetric around the delay, so the mean is unchanged.
+	est.AddedRttMs = parseFloatOrZero(opts.Delay)
+	est.EffectiveRttMs = est.BaseRttMs + est.AddedRttMs
+	if jitter := parseFloatOrZero(opts.Jitter); jitter > 0 {
+		est.Notes = append(est.Notes, fmt.Sprintf("RTT varies by +/-%vms (jitter)", jitter))
+		if jitter > est.AddedRttMs {
+			est.Notes = append(est.Notes, "jitter > delay reorders packets, which triggers spurious fast retransmits")
+		}
+	}
+
+	// Drops: the loss model, plus corruption (discarded by checksums)
+	loss, approximate := expectedLoss(opts)
+	corrupt := parseFloatOrZero(opts.Corrupt) / 100
+	drop := 1 - (1-loss)*(1-corrupt)
+	est.LossPercent = drop * 100
+	est.RetransmissionPercent = est.LossPercent
+	if approximate {
+		est.Notes = append(est.Notes, "the loss of the 'state' model is approximated by its 2-state (good/burst) part")
+	}
+	if opts.Reorder != "" {
+		est.Notes = append(est.Notes, "reordering may add spurious retransmissions (not included)")
+	}
+	if opts.Duplicate != "" {
+		est.Notes = append(est.Notes, "duplicates cost bandwidth but are not retransmissions")
+	}
+
+	rttSec := est.EffectiveRttMs / 1000
+	if rate, err := parseTCRate(opts.Rate); err == nil && rate > 0 {
+		est.RateLimitBps = rate
+		est.MaxTcpThroughputBps = rate
+		est.LimitedBy = "rate"
+		est.BdpBytes = rate / 8 * rttSec
+		if opts.Ceil != "" && opts.Burst != "" {
+			est.Notes = append(est.Notes, fmt.Sprintf("after an idle period, the first %s are sent at up to %s (burst)", opts.Burst, opts.Ceil))
+		}
+		if opts.RateScope == "flow" {
+			est.Notes = append(est.Notes, "the rate caps each flow: parallel flows together get more")
+		}
+	}
+	if drop > 0 && rttSec > 0 {
+		mathis := float64(mss) * 8 / rttSec * mathisConstant / math.Sqrt(drop)
+		if est.MaxTcpThroughputBps == 0 || mathis < est.MaxTcpThroughputBps {
+			est.MaxTcpThroughputBps = mathis
+			est.LimitedBy = "loss"
+		}
+	} else if drop > 0 {
+		est.Notes = append(est.Notes, "set 'baseRtt' to estimate the loss-limited throughput")
+	}
+	return est
+}
+
+// expectedLoss returns the long-run loss probability (0-1) of the loss
+// model, and whether it is an approximation.
+func expectedLoss(opts *V4NetworkOptions) (loss float64, approximate bool) {
+	switch opts.LossModel {
+	case "random":
+		return parseFloatOrZero(opts.Loss) / 100, false
+	case "gemodel":
+		// Gilbert-Elliott: p (good->bad), r (bad->good), 1-h (loss in
+		// bad), 1-k (loss in good). netem defaults: r=1-p, 1-h=1, 1-k=0.
+		p := parseFloatOrZero(opts.LossGemodelP) / 100
+		if p == 0 {
+			return 0, false
+		}
+		r, lossBad, lossGood := 1-p, 1.0, 0.0
+		if opts.LossGemodelR != "" {
+			r = parseFloatOrZero(opts.LossGemodelR) / 100
+		}
+		if opts.LossGemodel1h != "" {
+			lossBad = parseFloatOrZero(opts.LossGemodel1h) / 100
+		}
+		if opts.LossGemodel1k != "" {
+			lossGood = parseFloatOrZero(opts.LossGemodel1k) / 100
+		}
+		bad := p / (p + r)
+		return bad*lossBad + (1-bad)*lossGood, false
+	case "state":
+		// 4-state Markov: approximated by the good (1) <-> burst-loss (3)
+		// states; netem defaults p31 to 1-p13.
+		p13 := parseFloatOrZero(opts.LossStateP13) / 100
+		if p13 == 0 {
+			return 0, false
+		}
+		p31 := 1 - p13
+		if opts.LossStateP31 != "" {
+			p31 = parseFloatOrZero(opts.LossStateP31) / 100
+		}
+		return p13 / (p13 + p31), opts.LossStateP32 != "" || opts.LossStateP14 != ""
+	}
+	return 0, false
+}
+
+// parseFloatOrZero parses a numeric parameter, returning 0 when unset.
+func parseFloatOrZero(s string) float64 {
+	v, err := strconv.ParseFloat(strings.TrimSpace(s), 64)
+	if err != nil || v < 0 {
+		return 0
+	}
+	return v
+}
+
+// tcRateUnits maps tc rate suffixes to bits per second. Note that tc's
+// "bps" means *bytes* per second.
+var tcRateUnits = []struct {
+	suffix string
+	factor float64
+}{
+	{"tibit", 1 << 40}, {"gibit", 1 << 30}, {"mibit", 1 << 20}, {"kibit", 1 << 10},
+	{"tbit", 1e12}, {"gbit", 1e9}, {"mbit", 1e6}, {"kbit", 1e3}, {"bit", 1},
+	{"tibps", 8 << 40}, {"gibps", 8 << 30}, {"mibps", 8 << 20}, {"kibps", 8 << 10},
+	{"tbps", 8e12}, {"gbps", 8e9}, {"mbps", 8e6}, {"kbps", 8e3}, {"bps", 8},
+}
+
+// parseTCRate converts a tc rate (e.g. "10mbit", "1gbit") to bits/s. A
+// bare number is bits/s, as in tc.
+func parseTCRate(s string) (float64, error) {
+	s = strings.ToLower(s)
+	if s == "" {
+		return 0, fmt.Errorf("empty rate")
+	}
+	factor := 1.0
+	for _, u := range tcRateUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s, factor = strings.TrimSuffix(s, u.suffix), u.factor
+			break
+		}
+	}
+	v, ok := parseTCNumber(s)
+	if !ok {
+		return 0, fmt.Errorf("invalid rate %q", s)
+	}
+	return v * factor, nil
+}
+
+// estimateParams reads 'baseRtt' (ms, default 1) and 'mss' (default 1460).
+func estimateParams(r *http.Request) (baseRttMs float64, mss int, err error) {
+	baseRttMs, mss = 1, 1460
+	q := r.URL.Query()
+	if v := q.Get("baseRtt"); v != "" {
+		if baseRttMs, err = strconv.ParseFloat(v, 64); err != nil || baseRttMs < 0 {
+			return 0, 0, fmt.Errorf("invalid 'baseRtt' %q (ms)", v)
+		}
+	}
+	if v := q.Get("mss"); v != "" {
+		if mss, err = strconv.Atoi(v); err != nil || mss < 1 {
+			return 0, 0, fmt.Errorf("invalid 'mss' %q (bytes)", v)
+		}
+	}
+	return baseRttMs, mss, nil
+}
+
+// --- Handler: /estimate ---
+
+// handleTcEstimate takes the /setup parameters (plus optional 'baseRtt' and
+// 'mss') and returns the theoretical effect of the rule. Nothing is applied.
+func handleTcEstimate(w http.ResponseWriter, r *http.Request) {
+	baseRttMs, mss, err := estimateParams(r)
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	q, err := withProfile(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	opts := parseV4Options(q)
+	if opts.Rate != "" {
+		if _, err := parseTCRate(opts.Rate); err != nil {
+			respondWithError(w, fmt.Sprintf("V4: %v", err), 400)
+			return
+		}
+	}
+	respondWithJSON(w, http.StatusOK, estimateImpairment(opts, baseRttMs, mss))
+}
@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Fleet Registration ---
+
+// FleetMember is what a box reports to the fleet controller.
+type FleetMember struct {
+	ID           string          `json:"id"`
+	Hostname     string          `json:"hostname"`
+	APIURL       string          `json:"apiUrl,omitempty"`
+	Version      string          `json:"version"`
+	APIVersion   string          `json:"apiVersion"`
+	Interfaces   []*TcInterface  `json:"interfaces"`
+	Capabilities map[string]bool `json:"capabilities"`
+	Rules        int             `json:"rules"`
+	LastSeen     TcTime          `json:"lastSeen"`
+	Stale        bool            `json:"stale"`
+}
+
+// fleetRegisterInterval is how often boxes re-register. The controller
+// marks members stale after three missed registrations.
+var fleetRegisterInterval = 60 * time.Second
+
+// fleet is the inventory kept by a controller (FLEET_CONTROLLER=true).
+var fleet = struct {
+	sync.Mutex
+	members map[string]*FleetMember
+}{members: map[string]*FleetMember{}}
+
+// localFleetMember describes this box.
+func localFleetMember() *FleetMember {
+	hostname, _ := os.Hostname()
+	ifaces, _ := queryIPNetInterfaces(nil)
+	id := os.Getenv("FLEET_ID")
+	if id == "" {
+		id = hostname
+	}
+	return &FleetMember{
+		ID:           id,
+		Hostname:     hostname,
+		APIURL:       os.Getenv("FLEET_ADVERTISE_URL"),
+		Version:      version,
+		APIVersion:   apiVersion,
+		Interfaces:   ifaces,
+		Capabilities: capabilities(),
+		Rules:        len(store.List()),
+		LastSeen:     TcTime(time.Now()),
+	}
+}
+
+// startFleetRegistration registers this box with FLEET_CONTROLLER_URL now
+// and then every FLEET_REGISTER_INTERVAL (default 60s).
+func startFleetRegistration(ctx context.Context, controllerURL string) {
+	fleetRegisterInterval = envDuration("FLEET_REGISTER_INTERVAL", fleetRegisterInterval)
+	endpoint := strings.TrimRight(controllerURL, "/") + fmt.Sprintf("/tc/api/%s/fleet/register", apiVersion)
+	client := &http.Client{Timeout: 10 * time.Second}
+	log.Printf("[INFO] FLEET: Registering with %s every %v", endpoint, fleetRegisterInterval)
+
+	go func() {
+		ticker := time.NewTicker(fleetRegisterInterval)
+		defer ticker.Stop()
+		failing := false
+		for {
+			err := registerWithController(ctx, client, endpoint)
+			if err != nil && !failing {
+				log.Printf("[WARN] FLEET: Registration failed (will retry): %v", err)
+			} else if err == nil && failing {
+				log.Printf("[INFO] FLEET: Registration succeeded again")
+			}
+			failing = err != nil
+
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+			}
+		}
+	}()
+}
+
+func registerWithController(ctx context.Context, client *http.Client, endpoint string) error {
+	body, err := json.Marshal(localFleetMember())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := secret("FLEET_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("controller returned %s", resp.Status)
+	}
+	return nil
+}
+
+// fleetControllerEnabled reports whether this box accepts registrations.
+func fleetControllerEnabled() bool {
+	return os.Getenv("FLEET_CONTROLLER") == "true"
+}
+
+// fleetAuthorized checks the FLEET_TOKEN bearer token (if configured).
+func fleetAuthorized(r *http.Request) bool {
+	token := secret("FLEET_TOKEN")
+	if token == "" {
+		return true
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// fleetPeer returns the registered member that peer names (its ID or API
+// URL). Box-to-box calls carry the FLEET_TOKEN, so they only go to members
+// of this box's fleet, never to a URL taken from a request.
+func fleetPeer(peer string) (*FleetMember, error) {
+	if !fleetControllerEnabled() {
+		return nil, fmt.Errorf("fleet: peer '%s' must be a member registered with this box, which is not a controller (FLEET_CONTROLLER=true)", peer)
+	}
+	want := strings.TrimRight(peer, "/")
+	fleet.Lock()
+	defer fleet.Unlock()
+	for _, m := range fleet.members {
+		if m.ID == peer || strings.TrimRight(m.APIURL, "/") == want {
+			member := *m
+			return &member, nil
+		}
+	}
+	return nil, fmt.Errorf("fleet: '%s' is not a registered member (GET /fleet lists them)", peer)
+}
+
+// --- Handlers: /fleet (controller) ---
+
+// handleFleetRegister records (or refreshes) a fleet member.
+func handleFleetRegister(w http.ResponseWriter, r *http.Request) {
+	if !fleetControllerEnabled() {
+		respondWithError(w, "fleet: this box is not a controller (FLEET_CONTROLLER=true)", 404)
+		return
+	}
+	if !fleetAuthorized(r) {
+		respondWithError(w, "fleet: invalid token", 401)
+		return
+	}
+	m := &FleetMember{}
+	if err := json.NewDecoder(r.Body).Decode(m); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid member JSON: %v", err), 400)
+		return
+	}
+	if m.ID == "" {
+		respondWithError(w, "fleet: 'id' is required", 400)
+		return
+	}
+	if m.APIURL == "" {
+		// Best guess: the registering address on the default API port
+		host, _, _ := net.SplitHostPort(r.RemoteAddr)
+		m.APIURL = "http://" + net.JoinHostPort(host, strings.Trim(os.Getenv("API_LISTEN"), ":"))
+	}
+	m.LastSeen = TcTime(time.Now())
+	fleet.Lock()
+	if _, known := fleet.members[m.ID]; !known {
+		log.Printf("[INFO] FLEET: New member %s (%s, v%s)", m.ID, m.APIURL, m.Version)
+	}
+	fleet.members[m.ID] = m
+	fleet.Unlock()
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// handleFleetList returns the inventory, marking members that missed three
+// registrations as stale.
+func handleFleetList(w http.ResponseWriter, r *http.Request) {
+	if !fleetControllerEnabled() {
+		respondWithError(w, "fleet: this box is not a controller (FLEET_CONTROLLER=true)", 404)
+		return
+	}
+	fleet.Lock()
+	list := make([]FleetMember, 0, len(fleet.members))
+	for _, m := range fleet.members {
+		member := *m
+		member.Stale = time.Since(time.Time(m.LastSeen)) > 3*fleetRegisterInterval
+		list = append(list, member)
+	}
+	fleet.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleFleetRemove forgets a member (e.g. a decommissioned box).
+func handleFleetRemove(w http.ResponseWriter, r *http.Request) {
+	if !fleetControllerEnabled() {
+		respondWithError(w, "fleet: this box is not a controller (FLEET_CONTROLLER=true)", 404)
+		return
+	}
+	if !fleetAuthorized(r) {
+		respondWithError(w, "fleet: invalid token", 401)
+		return
+	}
+	id := chi.URLParam(r, "id")
+	fleet.Lock()
+	defer fleet.Unlock()
+	if _, ok := fleet.members[id]; !ok {
+		respondWithError(w, fmt.Sprintf("fleet: unknown member '%s'", id), 404)
+		return
+	}
+	delete(fleet.members, id)
+	respondWithJSON(w, http.StatusOK, nil)
+}
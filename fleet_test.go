@@ -0,0 +1,30 @@
+package main
+
+import "testing"
+
+func TestFleetPeer(t *testing.T) {
+	fleet.Lock()
+	fleet.members = map[string]*FleetMember{"box-b": {ID: "box-b", APIURL: "http://10.0.0.5:2023"}}
+	fleet.Unlock()
+	defer func() {
+		fleet.Lock()
+		fleet.members = map[string]*FleetMember{}
+		fleet.Unlock()
+	}()
+
+	t.Setenv("FLEET_CONTROLLER", "false")
+	if _, err := fleetPeer("box-b"); err == nil {
+		t.Error("fleetPeer: a peer accepted on a box that is not a controller")
+	}
+	t.Setenv("FLEET_CONTROLLER", "true")
+	for _, peer := range []string{"box-b", "http://10.0.0.5:2023", "http://10.0.0.5:2023/"} {
+		if m, err := fleetPeer(peer); err != nil || m.APIURL != "http://10.0.0.5:2023" {
+			t.Errorf("fleetPeer(%q) = %v, %v", peer, m, err)
+		}
+	}
+	for _, peer := range []string{"http://attacker.example:2023", "http://10.0.0.5:2024", ""} {
+		if _, err := fleetPeer(peer); err == nil {
+			t.Errorf("fleetPeer(%q): unregistered peer accepted", peer)
+		}
+	}
+}
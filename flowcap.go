@@ -0,0 +1,41 @@
+package main
+
+// --- Per-Flow Rate Caps (rateScope=flow) ---
+
+// validateRateScope checks RateScope: "aggregate" (the default) shares Rate
+// between all impaired flows in the HTB class; "flow" gives each flow its
+// own cap of Rate, like ISPs and access points that limit per connection.
+func (v *V4NetworkOptions) validateRateScope(policing bool) error {
+	switch v.RateScope {
+	case "", "aggregate":
+		return nil
+	case "flow":
+	default:
+		return msg("rule.invalidRateScope", v.RateScope)
+	}
+	if v.Rate == "" {
+		return msg("rule.rateScopeNeedsRate")
+	}
+	switch {
+	case v.Ceil != "" || v.Burst != "" || v.Cburst != "":
+		return msg("rule.rateScopeIncompatible", "ceil/burst/cburst")
+	case policing:
+		return msg("rule.rateScopeIncompatible", "ingressMode=police")
+	case v.PreserveMQ == "true":
+		return msg("rule.rateScopeIncompatible", "preserveMq=true")
+	}
+	return nil
+}
+
+// flowCapArgs builds the tc command ("add" or "replace") of the fq qdisc
+// that paces each flow at Rate (maxrate), below netem when the rule has
+// one, else below the shaped class (left unlimited). fq tells flows apart
+// by socket, or by a hash of their addresses and ports for forwarded and
+// ifb traffic.
+func (v *V4NetworkOptions) flowCapArgs(dev string, belowNetem bool, verb string) []string {
+	parent := shapedClass
+	if belowNetem {
+		parent = netemHandle + "1"
+	}
+	return []string{"qdisc", verb, "dev", dev, "parent", parent, "handle", flowCapHandle, "fq", "maxrate", v.Rate}
+}
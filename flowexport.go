@@ -0,0 +1,297 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- sFlow Export ---
+
+// FlowExporter samples packets of one interface (1-in-N, from a tcpdump
+// pcap stream) and sends them as sFlow v5 flow samples to a collector.
+type FlowExporter struct {
+	Iface     string `json:"iface"`
+	Collector string `json:"collector"`
+	Sampling  int    `json:"sampling"`
+	Started   TcTime `json:"started"`
+
+	mu       sync.Mutex
+	Packets  uint64 `json:"packets"` // packets seen (sample pool)
+	Samples  uint64 `json:"samples"` // samples exported
+	cancel   context.CancelFunc
+	conn     net.Conn
+	ifIndex  uint32
+	agentIP  net.IP
+	seq      uint32
+	dgramSeq uint32
+	bootTime time.Time
+}
+
+// sflowHeaderBytes is how much of each sampled packet is exported.
+const sflowHeaderBytes = 128
+
+var (
+	exportersMu sync.Mutex
+	exporters   = map[string]*FlowExporter{}
+)
+
+// start connects to the collector and launches the capture loop.
+func (e *FlowExporter) start() error {
+	iface, err := net.InterfaceByName(e.Iface)
+	if err != nil {
+		return fmt.Errorf("flowexport: interface '%s' not found", e.Iface)
+	}
+	e.ifIndex = uint32(iface.Index)
+	e.agentIP = flowAgentIP()
+	e.bootTime = time.Now()
+
+	conn, err := net.Dial("udp", e.Collector)
+	if err != nil {
+		return fmt.Errorf("flowexport: invalid collector '%s': %w", e.Collector, err)
+	}
+	e.conn = conn
+
+	// Not bound to a request context: the exporter outlives the API call.
+	ctx, cancel := context.WithCancel(context.Background())
+	e.cancel = cancel
+	cmd := command(ctx, "tcpdump", "-i", e.Iface, "-U", "-n", "-s", strconv.Itoa(sflowHeaderBytes), "-w", "-")
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		cancel()
+		conn.Close()
+		return fmt.Errorf("flowexport: %w", err)
+	}
+	log.Printf("[INFO] FLOWEXPORT: Executing: %s", cmd.String())
+	if err := cmd.Start(); err != nil {
+		cancel()
+		conn.Close()
+		return fmt.Errorf("flowexport: failed to start tcpdump: %w", err)
+	}
+
+	go func() {
+		if err := e.readPcap(bufio.NewReader(stdout)); err != nil && ctx.Err() == nil {
+			log.Printf("[ERROR] FLOWEXPORT: Capture on %s failed: %v", e.Iface, err)
+		}
+		cmd.Wait()
+		conn.Close()
+		log.Printf("[INFO] FLOWEXPORT: Exporter on %s stopped", e.Iface)
+	}()
+	return nil
+}
+
+// stop terminates the capture.
+func (e *FlowExporter) stop() {
+	if e.cancel != nil {
+		e.cancel()
+	}
+}
+
+// readPcap parses the pcap stream and exports a random 1-in-N sample.
+func (e *FlowExporter) readPcap(r io.Reader) error {
+	pcap, err := newPcapReader(r)
+	if err != nil {
+		return err
+	}
+	if pcap.LinkType != linkTypeEthernet {
+		return fmt.Errorf("unsupported link type %d (only Ethernet is exported)", pcap.LinkType)
+	}
+
+	for {
+		pkt, err := pcap.Next()
+		if err != nil {
+			return err
+		}
+
+		e.mu.Lock()
+		e.Packets++
+		sample := rand.Intn(e.Sampling) == 0
+		e.mu.Unlock()
+		if sample {
+			e.export(pkt.Data, pkt.OrigLen)
+		}
+	}
+}
+
+// export sends one sampled packet header as an sFlow v5 datagram.
+func (e *FlowExporter) export(header []byte, frameLen uint32) {
+	e.mu.Lock()
+	e.seq++
+	e.dgramSeq++
+	e.Samples++
+	seq, dgramSeq, pool := e.seq, e.dgramSeq, uint32(e.Packets)
+	e.mu.Unlock()
+
+	// Raw packet header record (enterprise 0, format 1)
+	padded := (len(header) + 3) &^ 3
+	record := make([]byte, 16+padded)
+	binary.BigEndian.PutUint32(record[0:], 1) // header_protocol: ethernet
+	binary.BigEndian.PutUint32(record[4:], frameLen)
+	binary.BigEndian.PutUint32(record[8:], 0) // stripped
+	binary.BigEndian.PutUint32(record[12:], uint32(len(header)))
+	copy(record[16:], header)
+
+	// Flow sample (enterprise 0, format 1) with a single record
+	sample := make([]byte, 32, 32+8+len(record))
+	binary.BigEndian.PutUint32(sample[0:], seq)
+	binary.BigEndian.PutUint32(sample[4:], e.ifIndex) // source_id: ifIndex
+	binary.BigEndian.PutUint32(sample[8:], uint32(e.Sampling))
+	binary.BigEndian.PutUint32(sample[12:], pool)
+	binary.BigEndian.PutUint32(sample[16:], 0) // drops
+	binary.BigEndian.PutUint32(sample[20:], e.ifIndex)
+	binary.BigEndian.PutUint32(sample[24:], e.ifIndex)
+	binary.BigEndian.PutUint32(sample[28:], 1) // num records
+	sample = binary.BigEndian.AppendUint32(sample, 1)
+	sample = binary.BigEndian.AppendUint32(sample, uint32(len(record)))
+	sample = append(sample, record...)
+
+	// Datagram header
+	dgram := binary.BigEndian.AppendUint32(nil, 5) // version
+	if ip4 := e.agentIP.To4(); ip4 != nil {
+		dgram = binary.BigEndian.AppendUint32(dgram, 1)
+		dgram = append(dgram, ip4...)
+	} else {
+		dgram = binary.BigEndian.AppendUint32(dgram, 2)
+		dgram = append(dgram, e.agentIP.To16()...)
+	}
+	dgram = binary.BigEndian.AppendUint32(dgram, 0) // sub_agent_id
+	dgram = binary.BigEndian.AppendUint32(dgram, dgramSeq)
+	dgram = binary.BigEndian.AppendUint32(dgram, uint32(time.Since(e.bootTime).Milliseconds()))
+	dgram = binary.BigEndian.AppendUint32(dgram, 1) // num samples
+	dgram = binary.BigEndian.AppendUint32(dgram, 1) // flow_sample
+	dgram = binary.BigEndian.AppendUint32(dgram, uint32(len(sample)))
+	dgram = append(dgram, sample...)
+
+	if _, err := e.conn.Write(dgram); err != nil {
+		log.Printf("[WARN] FLOWEXPORT: Failed to send sample to %s: %v", e.Collector, err)
+	}
+}
+
+// flowAgentIP returns FLOW_EXPORT_AGENT_IP, or the first host IPv4 (the
+// first IPv6 on IPv6-only hosts).
+func flowAgentIP() net.IP {
+	if ip := net.ParseIP(os.Getenv("FLOW_EXPORT_AGENT_IP")); ip != nil {
+		return ip
+	}
+	ifaces, _ := queryIPNetInterfaces(nil)
+	for _, iface := range ifaces {
+		if iface.IPv4 != nil {
+			return net.IP(iface.IPv4)
+		}
+	}
+	for _, iface := range ifaces {
+		if iface.IPv6 != nil {
+			return net.IP(iface.IPv6)
+		}
+	}
+	return net.IPv4zero
+}
+
+// stopAllExporters stops every flow exporter (e.g. on shutdown).
+func stopAllExporters() {
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	for iface, e := range exporters {
+		e.stop()
+		delete(exporters, iface)
+	}
+}
+
+// --- Handlers: /flowexport ---
+
+// handleFlowExportSetup starts exporting sFlow samples of 'iface' to
+// 'collector' (default FLOW_EXPORT_COLLECTOR) at 1-in-'sampling' packets
+// (default FLOW_EXPORT_SAMPLING, or 400).
+func handleFlowExportSetup(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	e := &FlowExporter{
+		Iface:     q.Get("iface"),
+		Collector: q.Get("collector"),
+		Sampling:  400,
+		Started:   TcTime(time.Now()),
+	}
+	if e.Collector == "" {
+		e.Collector = os.Getenv("FLOW_EXPORT_COLLECTOR")
+	}
+	if e.Iface == "" || e.Collector == "" {
+		respondWithError(w, "flowexport: 'iface' and 'collector' (or FLOW_EXPORT_COLLECTOR) are required", 400)
+		return
+	}
+	sampling := q.Get("sampling")
+	if sampling == "" {
+		sampling = os.Getenv("FLOW_EXPORT_SAMPLING")
+	}
+	if sampling != "" {
+		n, err := strconv.Atoi(sampling)
+		if err != nil || n < 1 {
+			respondWithError(w, fmt.Sprintf("flowexport: invalid 'sampling' %q", sampling), 400)
+			return
+		}
+		e.Sampling = n
+	}
+	if isDarwin {
+		log.Println("[INFO] FLOWEXPORT: Darwin: Ignoring flow export setup")
+		respondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	if old, ok := exporters[e.Iface]; ok {
+		old.stop()
+	}
+	if err := e.start(); err != nil {
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	exporters[e.Iface] = e
+	log.Printf("[INFO] FLOWEXPORT: Exporting sFlow samples of %s to %s (1-in-%d)", e.Iface, e.Collector, e.Sampling)
+	respondWithJSON(w, http.StatusOK, e)
+}
+
+// handleFlowExportReset stops the exporter of 'iface'.
+func handleFlowExportReset(w http.ResponseWriter, r *http.Request) {
+	iface := r.URL.Query().Get("iface")
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	e, ok := exporters[iface]
+	if !ok {
+		respondWithError(w, fmt.Sprintf("flowexport: no exporter on '%s'", iface), 404)
+		return
+	}
+	e.stop()
+	delete(exporters, iface)
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// handleFlowExportList returns the active exporters and their counters.
+func handleFlowExportList(w http.ResponseWriter, r *http.Request) {
+	exportersMu.Lock()
+	defer exportersMu.Unlock()
+	list := make([]map[string]interface{}, 0, len(exporters))
+	for _, e := range exporters {
+		e.mu.Lock()
+		list = append(list, map[string]interface{}{
+			"iface":     e.Iface,
+			"collector": e.Collector,
+			"sampling":  e.Sampling,
+			"started":   e.Started,
+			"packets":   e.Packets,
+			"samples":   e.Samples,
+		})
+		e.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i]["iface"].(string) < list[j]["iface"].(string) })
+	respondWithJSON(w, http.StatusOK, list)
+}
@@ -14,6 +14,10 @@ document.addEventListener('DOMContentLoaded', () => {
     const configForm = document.getElementById('config-form');
     const presetSelect = document.getElementById('simulation-presets');
     const resetButton = document.getElementById('reset-button');
+    const previewButton = document.getElementById('preview-button');
+    const speedtestButton = document.getElementById('speedtest-button');
+    const diagButton = document.getElementById('diag-button');
+    const panicButton = document.getElementById('panic-button');
     const directionSelect = document.getElementById('direction');
     const ifbWarning = document.getElementById('ifb-warning');
 
@@ -58,6 +62,38 @@ document.addEventListener('DOMContentLoaded', () => {
     ];
 
     let selectedInterface = null; // Stores the selected interface
+    let selectedEtag = null; // Config revision (ETag) of the selected interface
+
+    // Session id of this UI (other sessions are warned about our changes).
+    // An optional user name can be stored in localStorage 'netsimUser'.
+    const sessionId = Math.random().toString(16).slice(2) + Date.now().toString(16);
+    const sessionUser = localStorage.getItem('netsimUser') || '';
+    const sessionHeaders = sessionUser
+        ? { 'X-Netsim-Session': sessionId, 'X-Netsim-User': sessionUser, 'X-Netsim-API-Version': API_VERSION }
+        : { 'X-Netsim-Session': sessionId, 'X-Netsim-API-Version': API_VERSION };
+
+    // Form fields sent to /setup (and /plan) under their own name. The
+    // server's contract (/contract) must accept every one of them.
+    const setupFields = [
+        // Latency
+        'delay', 'jitter', 'delayCorrelation', 'distribution',
+        // Loss Model (selector)
+        'lossModel',
+        // Loss Random
+        'loss', 'lossCorrelation',
+        // Loss State
+        'lossStateP13', 'lossStateP31', 'lossStateP32', 'lossStateP23', 'lossStateP14',
+        // Loss Gemodel
+        'lossGemodelP', 'lossGemodelR', 'lossGemodel1h', 'lossGemodel1k',
+        // Other Manipulations
+        'corrupt', 'corruptCorrelation',
+        'duplicate', 'duplicateCorrelation',
+        'reorder', 'reorderCorrelation', 'reorderGap',
+        // HTB Bursts
+        'ceil', 'burst', 'cburst',
+        // Flow Sampling
+        'flowSamplePercent',
+    ];
 
     const presets = {
         // --- 1. Mobile Networks ---
@@ -264,15 +300,26 @@ document.addEventListener('DOMContentLoaded', () => {
 
     /**
      * Helper for making API calls
+     * Sends the known config revision as If-Match, so concurrent edits
+     * from another UI or script are reported as conflicts.
      * @param {string} endpoint - The API endpoint
      * @param {string} successMessage - Message to log on success
      */
     async function apiRequest(endpoint, successMessage) {
         logMessage(`Calling API: ${endpoint}`, 'info');
         try {
-            const response = await fetch(endpoint);
+            const headers = selectedEtag ? { ...sessionHeaders, 'If-Match': selectedEtag } : { ...sessionHeaders };
+            const response = await fetch(endpoint, { headers });
             const responseText = await response.text(); // Read text first
 
+            if (response.status === 412) {
+                logMessage('Conflict: this interface was changed by someone else. Refreshing its revision; review and apply again.', 'error');
+                await fetchRevision(selectedInterface.name);
+            }
+            if (response.ok && response.headers.get('ETag')) {
+                selectedEtag = response.headers.get('ETag');
+            }
+
             if (!response.ok) {
                 // Try to parse error from V4 JSON, fallback to text
                 try {
@@ -284,6 +331,12 @@ document.addEventListener('DOMContentLoaded', () => {
             }
             
             logMessage(successMessage, 'success');
+            // Parameters the server ignored (e.g. a field it does not know)
+            try {
+                (JSON.parse(responseText).warnings || []).forEach(w => logMessage(`Warning: ${w}`, 'error'));
+            } catch (e) {
+                // Not JSON: no warnings
+            }
             return responseText;
 
         } catch (err) {
@@ -322,6 +375,23 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     }
 
+    /**
+     * Fetches the current config revision (ETag) of an interface
+     * @param {string} ifaceName - The interface name
+     */
+    async function fetchRevision(ifaceName) {
+        selectedEtag = null;
+        try {
+            const params = new URLSearchParams({ iface: ifaceName });
+            const response = await fetch(`/tc/api/${API_VERSION}/config/query?${params.toString()}`);
+            if (response.ok) {
+                selectedEtag = response.headers.get('ETag');
+            }
+        } catch (err) {
+            logMessage(`Could not fetch revision of ${ifaceName}: ${err.message}`, 'error');
+        }
+    }
+
     /**
      * Renders the interface cards
      * @param {Array} ifaces - Array of interface objects
@@ -361,6 +431,116 @@ document.addEventListener('DOMContentLoaded', () => {
 
         selectedIfaceNameEl.textContent = iface.name;
         configFormSection.style.display = 'block';
+        fetchRevision(iface.name);
+        reportViewing(iface.name);
+    }
+
+    /**
+     * Tells the server which interface this session is viewing, and warns
+     * if other sessions are viewing it too
+     * @param {string} ifaceName - The interface name
+     */
+    async function reportViewing(ifaceName) {
+        const params = new URLSearchParams({ session: sessionId, iface: ifaceName });
+        try {
+            const response = await fetch(`/tc/api/${API_VERSION}/sessions/view?${params.toString()}`);
+            if (!response.ok) {
+                return; // Event stream not connected (yet)
+            }
+            const body = await response.json();
+            if (body.otherViewers && body.otherViewers.length > 0) {
+                const who = body.otherViewers.map(v => v.user || v.remoteAddr).join(', ');
+                logMessage(`Note: ${ifaceName} is also open in other sessions (${who}).`, 'info');
+            }
+        } catch (err) {
+            // Non-fatal: session awareness is best-effort
+        }
+    }
+
+    /**
+     * Adapts the 'incoming' note to how the host applies incoming rules
+     * (ifb shaping, or policing when the ifb module is missing)
+     */
+    async function fetchCapabilities() {
+        try {
+            const response = await fetch(`/tc/api/${API_VERSION}/capabilities`);
+            if (!response.ok) {
+                return;
+            }
+            const body = await response.json();
+            if (body.readOnly) {
+                enterReadOnly();
+            }
+            if (body.ingressMode === 'police') {
+                ifbWarning.innerHTML = "<strong>Note:</strong> The 'ifb' module is not loaded: 'incoming' rules only police the rate (excess traffic is dropped). Delay, loss and other impairments need 'ifb'.";
+            }
+        } catch (err) {
+            // Non-fatal: keep the default note
+        }
+    }
+
+    /**
+     * Read-only view (VIEW_LISTEN): rules and stats can be watched, but the
+     * controls that change something are disabled
+     */
+    function enterReadOnly() {
+        configForm.querySelectorAll('input, select, button').forEach(el => { el.disabled = true; });
+        [applyButton, resetButton, previewButton, speedtestButton, diagButton, panicButton].forEach(el => {
+            el.disabled = true;
+            el.title = 'Read-only view';
+        });
+        logMessage('Read-only view: rules and stats can be watched, changes are disabled.', 'info');
+    }
+
+    /**
+     * Checks the API contract: the server speaks our API version and
+     * accepts every form field (a field it does not know would be dropped)
+     */
+    async function checkContract() {
+        try {
+            const response = await fetch(`/tc/api/${API_VERSION}/contract`, { headers: sessionHeaders });
+            if (response.status === 406) {
+                logMessage(`Warning: the server does not support API version ${API_VERSION}.`, 'error');
+                return;
+            }
+            if (!response.ok) {
+                return;
+            }
+            const body = await response.json();
+            const missing = ['iface', 'direction', 'rate', ...setupFields].filter(f => !body.setupParams.includes(f));
+            if (missing.length > 0) {
+                logMessage(`Warning: the server does not accept these fields: ${missing.join(', ')}.`, 'error');
+            }
+        } catch (err) {
+            // Non-fatal: older servers have no contract endpoint
+        }
+    }
+
+    /**
+     * Subscribes to rule changes made by other sessions
+     */
+    function connectSessionEvents() {
+        const params = new URLSearchParams({ session: sessionId, user: sessionUser });
+        const events = new EventSource(`/tc/api/${API_VERSION}/sessions/events?${params.toString()}`);
+        const describe = (ev) => {
+            const by = ev.by.user ? `${ev.by.user} (${ev.by.source})` : ev.by.source;
+            return `${by} ${ev.action === 'reset' ? 'reset' : 'changed'} ${ev.iface} (revision ${ev.revision})`;
+        };
+        events.addEventListener('hello', () => {
+            if (selectedInterface) {
+                reportViewing(selectedInterface.name);
+            }
+        });
+        events.addEventListener('warning', (e) => {
+            const ev = JSON.parse(e.data);
+            logMessage(`Warning: ${describe(ev)} while you are viewing it.`, 'error');
+            if (selectedInterface && selectedInterface.name === ev.iface) {
+                fetchRevision(ev.iface);
+            }
+        });
+        events.addEventListener('change', (e) => {
+            logMessage(describe(JSON.parse(e.data)), 'info');
+        });
     }
 
     /**
@@ -376,41 +556,17 @@ document.addEventListener('DOMContentLoaded', () => {
 
 
     /**
-     * Handles the form submission to apply rules
+     * Builds the /setup (and /plan) query parameters from the form
+     * @returns {URLSearchParams}
      */
-    configForm.addEventListener('submit', async (e) => {
-        e.preventDefault();
-        
-        if (!selectedInterface) {
-            logMessage('Error: No interface selected.', 'error');
-            return;
-        }
-
+    function buildSetupParams() {
         const formData = new FormData(configForm);
         const params = new URLSearchParams();
 
         // 1. Required Parameters
         params.append('iface', selectedInterface.name);
         params.append('direction', formData.get('direction'));
-        
-        // 2. Add all other fields *only if they have a value*
-        const fields = [
-            // Latency
-            'delay', 'jitter', 'delayCorrelation', 'distribution',
-            // Loss Model (selector)
-            'lossModel',
-            // Loss Random
-            'loss', 'lossCorrelation',
-            // Loss State
-            'lossStateP13', 'lossStateP31', 'lossStateP32', 'lossStateP23', 'lossStateP14',
-            // Loss Gemodel
-            'lossGemodelP', 'lossGemodelR', 'lossGemodel1h', 'lossGemodel1k',
-            // Other Manipulations
-            'corrupt', 'corruptCorrelation',
-            'duplicate', 'duplicateCorrelation',
-            'reorder', 'reorderCorrelation', 'reorderGap',
-        ];
-        
+    
         const rateVal = formData.get('rate-value');
         const rateUnit = formData.get('rate-unit');
         if (rateVal) {
@@ -418,13 +574,30 @@ document.addEventListener('DOMContentLoaded', () => {
             params.append('rate', rateVal + rateUnit);
         }
 
-        fields.forEach(field => {
+        // 2. Add all other fields *only if they have a value*
+        setupFields.forEach(field => {
             const value = formData.get(field);
             if (value) {
                 params.append(field, value);
             }
         });
+
+        return params;
+    }
+
+    /**
+     * Handles the form submission to apply rules
+     */
+    configForm.addEventListener('submit', async (e) => {
+        e.preventDefault();
         
+        if (!selectedInterface) {
+            logMessage('Error: No interface selected.', 'error');
+            return;
+        }
+
+        const params = buildSetupParams();
+
         // 4. Builds and calls the setup endpoint
         const endpoint = `/tc/api/${API_VERSION}/config/setup?${params.toString()}`;
         
@@ -438,6 +611,105 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     });
 
+    /**
+     * Shows what 'Apply' would do (commands, warnings, estimated effect)
+     */
+    previewButton.addEventListener('click', async () => {
+        if (!selectedInterface) {
+            logMessage('Error: No interface selected.', 'error');
+            return;
+        }
+        const endpoint = `/tc/api/${API_VERSION}/config/plan?${buildSetupParams().toString()}`;
+        try {
+            const response = await fetch(endpoint);
+            const body = await response.json();
+            if (!response.ok) {
+                throw new Error(`API Error: ${body.message || response.statusText}`);
+            }
+            body.plans.forEach(plan => {
+                logMessage(`Plan for ${plan.iface}:`, 'info');
+                plan.steps.forEach((step, i) => logMessage(`  ${i + 1}. ${step.description}: ${step.command}`, 'info'));
+                (plan.warnings || []).forEach(warning => logMessage(`  Warning: ${warning}`, 'error'));
+                if (plan.error) {
+                    logMessage(`  Would fail: ${plan.error}`, 'error');
+                }
+                logMessage(`  Estimated effect: ${JSON.stringify(plan.estimatedEffect)}`, 'success');
+            });
+        } catch (err) {
+            logMessage(err.message, 'error');
+        }
+    });
+
+    /**
+     * Measures the throughput through the selected interface's shaped path
+     */
+    speedtestButton.addEventListener('click', async () => {
+        if (!selectedInterface) {
+            logMessage('Error: No interface selected.', 'error');
+            return;
+        }
+        speedtestButton.disabled = true;
+        logMessage(`Running speedtest through ${selectedInterface.name}...`, 'info');
+        try {
+            const response = await fetch(`/tc/api/${API_VERSION}/speedtest/run?iface=${encodeURIComponent(selectedInterface.name)}`, { method: 'POST' });
+            const body = await response.json();
+            if (!response.ok) {
+                throw new Error(`API Error: ${body.message || response.statusText}`);
+            }
+            logMessage(`Speedtest #${body.id} (${body.method}, ${body.target}): ${body.downloadMbps} Mbit/s down, ${body.uploadMbps} Mbit/s up${body.rttMs ? `, RTT ${body.rttMs} ms` : ''}`, 'success');
+            (body.errors || []).forEach(error => logMessage(`  ${error}`, 'error'));
+        } catch (err) {
+            logMessage(err.message, 'error');
+        } finally {
+            speedtestButton.disabled = false;
+        }
+    });
+
+    /**
+     * Runs the read-only diagnostics of the selected interface (qdiscs,
+     * offloads, conntrack) and shows a summary in the log
+     */
+    diagButton.addEventListener('click', async () => {
+        if (!selectedInterface) {
+            logMessage('Error: No interface selected.', 'error');
+            return;
+        }
+        const iface = encodeURIComponent(selectedInterface.name);
+        const runDiag = async (name, query) => {
+            const response = await fetch(`/tc/api/${API_VERSION}/diag/${name}${query}`, { headers: sessionHeaders });
+            const body = await response.json();
+            if (!response.ok) {
+                throw new Error(`Diagnostic '${name}': ${body.message || response.statusText}`);
+            }
+            return body.result;
+        };
+        diagButton.disabled = true;
+        logMessage(`Diagnostics of ${selectedInterface.name}:`, 'info');
+        try {
+            (await runDiag('qdisc', `?iface=${iface}`)).forEach(q => {
+                logMessage(`  qdisc ${q.kind} ${q.handle}: ${q.packets ?? 0} packets, ${q.drops ?? 0} dropped, ${q.overlimits ?? 0} overlimits`, 'info');
+            });
+        } catch (err) {
+            logMessage(`  ${err.message}`, 'error');
+        }
+        try {
+            const features = await runDiag('offloads', `?iface=${iface}`);
+            const on = ['tcp-segmentation-offload', 'generic-segmentation-offload', 'generic-receive-offload', 'large-receive-offload', 'hw-tc-offload']
+                .filter(f => features[f] && features[f].on);
+            logMessage(`  offloads on: ${on.length > 0 ? on.join(', ') : 'none'}`, 'info');
+        } catch (err) {
+            logMessage(`  ${err.message}`, 'error');
+        }
+        try {
+            const conntrack = await runDiag('conntrack', '');
+            logMessage(`  conntrack: ${conntrack.count} connections${conntrack.max ? ` of ${conntrack.max}` : ''}`, 'info');
+        } catch (err) {
+            logMessage(`  ${err.message}`, 'error');
+        } finally {
+            diagButton.disabled = false;
+        }
+    });
+
     /**
      * Handles resetting all rules
      */
@@ -465,6 +737,31 @@ document.addEventListener('DOMContentLoaded', () => {
         }
     });
 
+    /**
+     * Handles the "panic button": resets every interface on the host
+     */
+    panicButton.addEventListener('click', async () => {
+        if (!confirm('Reset ALL rules on ALL interfaces and remove ifb devices?')) {
+            return;
+        }
+        try {
+            await apiRequest(
+                `/tc/api/${API_VERSION}/config/reset-all`,
+                'Successfully reset every interface on the host.'
+            );
+            configForm.reset();
+            ifbWarning.style.display = 'none';
+            updateInputDependencies();
+            updateLossModelUI();
+            updateApplyButtonState();
+            if (selectedInterface) {
+                fetchRevision(selectedInterface.name);
+            }
+        } catch (err) {
+            logMessage(`Failed to reset all rules.`, 'error');
+        }
+    });
+
     delayInput.addEventListener('input', updateInputDependencies);
     jitterInput.addEventListener('input', updateInputDependencies);
     lossInput.addEventListener('input', updateInputDependencies);
@@ -481,6 +778,9 @@ document.addEventListener('DOMContentLoaded', () => {
 
     // Initialize the application
     fetchInterfaces();
+    fetchCapabilities();
+    checkContract();
+    connectSessionEvents();
     updateInputDependencies(); // Call on load to set initial state
     updateLossModelUI();    
     updateApplyButtonState();
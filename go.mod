@@ -2,4 +2,7 @@ module netsim
 
 go 1.23
 
-require github.com/go-chi/chi/v5 v5.2.3
+require (
+	github.com/go-chi/chi/v5 v5.2.3
+	gopkg.in/yaml.v3 v3.0.1
+)
@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Impairment Groups ---
+
+// ImpairmentGroup is a named set of rules, at most one per interface, that
+// is enabled and disabled as one: either every rule is applied or, when one
+// fails, the interfaces are put back as they were.
+type ImpairmentGroup struct {
+	Name  string              `json:"name"`
+	Rules []*V4NetworkOptions `json:"rules"`
+
+	State string `json:"state"` // "enabled", "disabled" or "partial" (some rules were replaced since)
+}
+
+// groups holds the defined groups by name.
+var groups = struct {
+	sync.Mutex
+	defs map[string]*ImpairmentGroup
+}{defs: map[string]*ImpairmentGroup{}}
+
+// groupNamePattern restricts group names to what fits a URL path segment.
+var groupNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// actor is the actor of the rules the group applies.
+func (g *ImpairmentGroup) actor() Actor {
+	return Actor{Source: "group", User: g.Name}
+}
+
+// validate checks the group and its rules.
+func (g *ImpairmentGroup) validate() error {
+	if !groupNamePattern.MatchString(g.Name) {
+		return fmt.Errorf("group: invalid 'name' %q (letters, digits, '_', '.' and '-')", g.Name)
+	}
+	if len(g.Rules) == 0 {
+		return fmt.Errorf("group: at least one rule is required")
+	}
+	seen := map[string]bool{}
+	for _, opts := range g.Rules {
+		if opts == nil || opts.Iface == "" || opts.Direction == "" {
+			return fmt.Errorf("group: every rule needs 'iface' and 'direction'")
+		}
+		if seen[opts.Iface] {
+			return fmt.Errorf("group: more than one rule on '%s' (one rule per interface)", opts.Iface)
+		}
+		seen[opts.Iface] = true
+		if !ifaceAllowed(opts.Iface) {
+			return msg("rule.ifaceExcluded", opts.Iface)
+		}
+		if err := opts.validateNetem(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// appliedIfaces returns the interfaces where the group's rule is in place.
+func (g *ImpairmentGroup) appliedIfaces() []string {
+	var ifaces []string
+	for _, opts := range g.Rules {
+		if rule := store.Get(opts.Iface, opts.Direction); rule != nil && rule.AppliedBy == g.actor() && optionsKey(rule.Options) == optionsKey(opts) {
+			ifaces = append(ifaces, opts.Iface)
+		}
+	}
+	return ifaces
+}
+
+// state tells whether the rules of the group are the ones in place.
+func (g *ImpairmentGroup) state() string {
+	switch len(g.appliedIfaces()) {
+	case len(g.Rules):
+		return "enabled"
+	case 0:
+		return "disabled"
+	}
+	return "partial"
+}
+
+// snapshot copies the group with its current state.
+func (g *ImpairmentGroup) snapshot() *ImpairmentGroup {
+	s := *g
+	s.State = g.state()
+	return &s
+}
+
+// applyAll puts each interface of targets in its desired state (a rule, or
+// none when nil), in the order of ifaces. When one fails, the interfaces
+// changed so far are restored to their previous rules. Must be called with
+// applyMu held.
+func applyAll(ctx context.Context, ifaces []string, targets map[string]*V4NetworkOptions, by Actor) error {
+	prev := map[string][]*AppliedRule{}
+	for _, iface := range ifaces {
+		prev[iface] = store.OfIface(iface)
+	}
+	for i, iface := range ifaces {
+		sched.StopIface(iface)
+		var err error
+		if opts := targets[iface]; opts != nil {
+			recordTCPBefore(ctx, iface)
+			rule := *opts
+			if err = rule.Execute(ctx); err == nil {
+				store.Set(&rule, by)
+			}
+		} else if err = cleanupSingleInterface(ctx, iface); err == nil {
+			store.Delete(iface, by)
+		}
+		if err == nil {
+			continue
+		}
+		// Roll back, the failed interface included
+		log.Printf("[ERROR] GROUP: Failed on %s, restoring %d interface(s): %v", iface, i+1, err)
+		for _, done := range ifaces[:i+1] {
+			restoreRules(ctx, done, prev[done], by)
+		}
+		return fmt.Errorf("%s: %w", iface, err)
+	}
+	return nil
+}
+
+// restoreRules puts the rules of iface back to prev, direction by
+// direction: a direction without a previous rule is reset.
+func restoreRules(ctx context.Context, iface string, prev []*AppliedRule, by Actor) {
+	for _, direction := range []string{"outgoing", "incoming"} {
+		i := slices.IndexFunc(prev, func(p *AppliedRule) bool { return p.Options.Direction == direction })
+		if i >= 0 {
+			if err := prev[i].Options.Execute(ctx); err != nil {
+				log.Printf("[ERROR] GROUP: Failed to restore the %s rule of %s: %v", direction, iface, err)
+				continue
+			}
+			store.Set(prev[i].Options, prev[i].AppliedBy)
+		} else if rule := store.Get(iface, direction); rule != nil {
+			if err := cleanupDirection(ctx, iface, direction); err != nil {
+				log.Printf("[ERROR] GROUP: Failed to reset %s: %v", iface, err)
+				continue
+			}
+			store.DeleteByID(rule.ID, by)
+		}
+	}
+}
+
+// enable applies the rules of g. Other groups enabled on any of its
+// interfaces are disabled with it (where their rules are still in place),
+// so enabling a group switches to it. Must be called with applyMu and
+// groups held.
+func (g *ImpairmentGroup) enable(ctx context.Context) ([]string, error) {
+	targets := map[string]*V4NetworkOptions{}
+	var ifaces, displaced []string
+	for _, opts := range g.Rules {
+		targets[opts.Iface] = opts
+		ifaces = append(ifaces, opts.Iface)
+	}
+	names := make([]string, 0, len(groups.defs))
+	for name := range groups.defs {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		other := groups.defs[name]
+		applied := other.appliedIfaces()
+		if other == g || !slices.ContainsFunc(applied, func(iface string) bool { return targets[iface] != nil }) {
+			continue
+		}
+		displaced = append(displaced, name)
+		for _, iface := range applied {
+			if _, ok := targets[iface]; !ok {
+				targets[iface] = nil
+				ifaces = append(ifaces, iface)
+			}
+		}
+	}
+	if err := applyAll(ctx, ifaces, targets, g.actor()); err != nil {
+		return nil, err
+	}
+	log.Printf("[INFO] GROUP: Enabled %q on %v (disabled: %v)", g.Name, ifaces, displaced)
+	return displaced, nil
+}
+
+// disable resets the interfaces where the rules of g are in place (those
+// replaced since are left alone). Must be called with applyMu and groups
+// held.
+func (g *ImpairmentGroup) disable(ctx context.Context) error {
+	ifaces := g.appliedIfaces()
+	if err := applyAll(ctx, ifaces, map[string]*V4NetworkOptions{}, g.actor()); err != nil {
+		return err
+	}
+	log.Printf("[INFO] GROUP: Disabled %q on %v", g.Name, ifaces)
+	return nil
+}
+
+// define records g, replacing a disabled group of the same name.
+func (g *ImpairmentGroup) define() error {
+	groups.Lock()
+	defer groups.Unlock()
+	if old, ok := groups.defs[g.Name]; ok && old.state() != "disabled" {
+		return fmt.Errorf("group '%s' is enabled: disable it before redefining it", g.Name)
+	}
+	groups.defs[g.Name] = g
+	return nil
+}
+
+// --- Handlers: /groups ---
+
+// handleGroupList returns the defined groups with their state, by name.
+func handleGroupList(w http.ResponseWriter, r *http.Request) {
+	list := map[string]*ImpairmentGroup{}
+	groups.Lock()
+	for name, g := range groups.defs {
+		list[name] = g.snapshot()
+	}
+	groups.Unlock()
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleGroupDefine defines (or redefines) a group, without applying it. An
+// enabled group cannot be redefined.
+func handleGroupDefine(w http.ResponseWriter, r *http.Request) {
+	g := &ImpairmentGroup{}
+	if err := json.NewDecoder(r.Body).Decode(g); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid group JSON: %v", err), 400)
+		return
+	}
+	if err := g.validate(); err != nil {
+		respondWithLocalizedError(w, r, 400, err)
+		return
+	}
+	if err := g.define(); err != nil {
+		respondWithError(w, err.Error(), 409)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, g.snapshot())
+}
+
+// handleGroupDelete disables a group (when enabled) and forgets it.
+func handleGroupDelete(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	groups.Lock()
+	defer groups.Unlock()
+	g, ok := groups.defs[name]
+	if !ok {
+		respondWithError(w, fmt.Sprintf("no group '%s'", name), 404)
+		return
+	}
+	if g.state() != "disabled" {
+		if err := g.disable(r.Context()); err != nil {
+			respondWithLocalizedError(w, r, 500, err)
+			return
+		}
+	}
+	delete(groups.defs, name)
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// handleGroupSwitch returns the handler of /groups/{name}/{action}: enable,
+// disable, or toggle (disable when enabled, else enable).
+func handleGroupSwitch(action string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		name := chi.URLParam(r, "name")
+		applyMu.Lock()
+		defer applyMu.Unlock()
+		groups.Lock()
+		defer groups.Unlock()
+		g, ok := groups.defs[name]
+		if !ok {
+			respondWithError(w, fmt.Sprintf("no group '%s'", name), 404)
+			return
+		}
+		if action == "toggle" {
+			action = "enable"
+			if g.state() == "enabled" {
+				action = "disable"
+			}
+		}
+		response := map[string]interface{}{}
+		var err error
+		if action == "enable" {
+			var displaced []string
+			if displaced, err = g.enable(r.Context()); len(displaced) > 0 {
+				response["disabled"] = displaced
+			}
+		} else {
+			err = g.disable(r.Context())
+		}
+		if err != nil {
+			respondWithLocalizedError(w, r, 500, err)
+			return
+		}
+		response["group"] = g.snapshot()
+		setETag(w, store.Revision(""))
+		respondWithJSON(w, http.StatusOK, response)
+	}
+}
@@ -1,15 +1,27 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
+	"math"
 	"net"
 	"net/http"
+	"net/url"
 	"os"
 	"os/exec"
+	"path"
+	"regexp"
+	"slices"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -22,6 +34,14 @@ func (v TcTime) MarshalJSON() ([]byte, error) {
 func (v TcTime) String() string {
 	return time.Time(v).Format("2006-01-02T15:04:05.000Z07:00")
 }
+func (v *TcTime) UnmarshalJSON(b []byte) error {
+	t, err := time.Parse(`"`+time.RFC3339Nano+`"`, string(b))
+	if err != nil {
+		return err
+	}
+	*v = TcTime(t)
+	return nil
+}
 
 type TcIP net.IP
 
@@ -43,12 +63,55 @@ func (v *TcInterface) String() string {
 }
 
 // --- Command Helpers ---
+
+// commandRecorder collects the mutating commands that would run, instead of
+// running them (see /plan). Read-only commands (runTCOutput) still run.
+type commandRecorder struct {
+	commands [][]string
+}
+
+type commandRecorderKey struct{}
+
+// withCommandRecorder returns a context in which runCommand only records.
+func withCommandRecorder(ctx context.Context) (context.Context, *commandRecorder) {
+	rec := &commandRecorder{}
+	return context.WithValue(ctx, commandRecorderKey{}, rec), rec
+}
+
 // runCommand is a generic helper to execute commands
 func runCommand(ctx context.Context, name string, args ...string) error {
-	cmd := exec.CommandContext(ctx, name, args...)
+	if rec, ok := ctx.Value(commandRecorderKey{}).(*commandRecorder); ok {
+		rec.commands = append(rec.commands, append([]string{name}, args...))
+		return nil
+	}
+	batch := tcBatchFrom(ctx)
+	if batch != nil {
+		if batch.err != nil {
+			return batch.err
+		}
+		if name == "tc" && batch.queue(args) {
+			log.Printf("[INFO] V4: Queued: tc %s", strings.Join(args, " "))
+			return nil
+		}
+	}
+	cmd := command(ctx, name, args...)
+	if batch != nil && batch.err != nil {
+		return batch.err
+	}
 	log.Printf("[INFO] V4: Executing: %s", cmd.String())
 
-	if b, err := cmd.CombinedOutput(); err != nil {
+	done := traceCommand(ctx, name, args)
+	b, err := cmd.CombinedOutput()
+	done(err)
+	err = commandError(cmd.String(), name, args, b, err)
+	trackCommand(ctx, name, args, err)
+	return err
+}
+
+// commandError turns the failure of a command (typed as line) into its
+// error, or nil when it is benign.
+func commandError(line, name string, args []string, b []byte, err error) error {
+	if err != nil {
 		errStr := string(b)
 		if errStr == "" {
 			errStr = err.Error()
@@ -63,7 +126,10 @@ func runCommand(ctx context.Context, name string, args ...string) error {
 			return nil
 		}
 
-		log.Printf("[ERROR] V4: Command %s failed: %s", cmd.String(), errStr)
+		log.Printf("[ERROR] V4: Command %s failed: %s", line, errStr)
+		if hint := permissionHint(errStr); hint != nil {
+			return fmt.Errorf("%s %v: %s: %w", name, args, strings.TrimSpace(errStr), hint)
+		}
 		return fmt.Errorf("%s %v: %s", name, args, errStr)
 	}
 	return nil
@@ -74,6 +140,17 @@ func runTC(ctx context.Context, args ...string) error {
 	return runCommand(ctx, "tc", args...)
 }
 
+// runTCOutput runs a read-only 'tc' command and returns its stdout.
+func runTCOutput(ctx context.Context, args ...string) (string, error) {
+	done := traceCommand(ctx, "tc", args)
+	b, err := command(ctx, "tc", args...).Output()
+	done(err)
+	if err != nil {
+		return "", fmt.Errorf("tc %v: %w", args, err)
+	}
+	return string(b), nil
+}
+
 // runIP is a specific helper for 'ip'
 func runIP(ctx context.Context, args ...string) error {
 	return runCommand(ctx, "ip", args...)
@@ -104,10 +181,18 @@ func handleTcInit(w http.ResponseWriter, r *http.Request) {
 // --- Handler: /reset (V4) ---
 // (Replaces tcdel)
 func handleTcResetV4(w http.ResponseWriter, r *http.Request) {
+	if !resolveRuleID(w, r) {
+		return
+	}
 	ctx := r.Context()
-	iface := r.URL.Query().Get("iface")
-	if iface == "" {
-		respondWithError(w, "V4: 'iface' is required", 400)
+	q := r.URL.Query()
+	targets, err := resolveTargetInterfaces(q.Get("iface"), q.Get("ifaceRegex"))
+	if err != nil {
+		respondWithLocalizedError(w, r, 400, err)
+		return
+	}
+	if q.Get("dryRun") == "true" {
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"dryRun": true, "ifaces": targets})
 		return
 	}
 	if isDarwin {
@@ -116,11 +201,55 @@ func handleTcResetV4(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	log.Printf("[INFO] V4: Resetting native rules on %v", iface)
-	if err := cleanupSingleInterface(ctx, iface); err != nil {
-		respondWithError(w, err.Error(), 500)
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if code, err := checkIfMatch(r, targets); err != nil {
+		respondWithError(w, err.Error(), code)
 		return
 	}
+
+	if id := q.Get("id"); id != "" {
+		resetRule(w, r, id)
+		return
+	}
+
+	var failures []string
+	for _, iface := range targets {
+		sched.StopIface(iface)
+		removeMirror(ctx, iface)
+		log.Printf("[INFO] V4: Resetting native rules on %v", iface)
+		if err := cleanupSingleInterface(ctx, iface); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", iface, err))
+			continue
+		}
+		setETag(w, store.Delete(iface, actorFromRequest(r)))
+	}
+	if len(failures) > 0 {
+		respondWithError(w, strings.Join(failures, "; "), 500)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, targetsResponse(q, targets))
+}
+
+// resetRule removes the rule with the ID; the rule of the other direction
+// of its interface, and its mirror, stay in place. Must be called with
+// applyMu held.
+func resetRule(w http.ResponseWriter, r *http.Request, id string) {
+	ctx := r.Context()
+	rule := store.ByID(id)
+	if rule == nil {
+		respondWithError(w, fmt.Sprintf("no rule with id '%s'", id), 404)
+		return
+	}
+	opts := rule.Options
+	sched.StopIface(opts.Iface)
+	log.Printf("[INFO] V4: Resetting the %s rule %s on %s", opts.Direction, id, opts.Iface)
+	if err := cleanupDirection(ctx, opts.Iface, opts.Direction); err != nil {
+		respondWithError(w, fmt.Sprintf("%s: %v", opts.Iface, err), 500)
+		return
+	}
+	opts.reattachMirror(ctx)
+	setETag(w, store.DeleteByID(id, actorFromRequest(r)))
 	respondWithJSON(w, http.StatusOK, nil)
 }
 
@@ -128,52 +257,100 @@ func handleTcResetV4(w http.ResponseWriter, r *http.Request) {
 // (Replaces tcset)
 
 type V4NetworkOptions struct {
-	Iface     string
-	Direction string
-	ApiPort   string
+	Iface     string `json:"iface,omitempty"`
+	Direction string `json:"direction,omitempty"`
 	// V4 Parameters
-	Rate             string // kbit
-	Delay            string // ms
-	Jitter           string // ms
-	DelayCorrelation string // %
-	Distribution     string // normal, pareto, etc.
-
-	LossModel string // "none", "random", "state", "gemodel"
+	Rate             string `json:"rate,omitempty"`             // kbit
+	Ceil             string `json:"ceil,omitempty"`             // tc rate, >= rate
+	Burst            string `json:"burst,omitempty"`            // tc size, e.g. "1mb"
+	Cburst           string `json:"cburst,omitempty"`           // tc size
+	RateScope        string `json:"rateScope,omitempty"`        // "aggregate" (default) or "flow": Rate caps each flow
+	Delay            string `json:"delay,omitempty"`            // ms
+	Jitter           string `json:"jitter,omitempty"`           // ms
+	DelayCorrelation string `json:"delayCorrelation,omitempty"` // %
+	Distribution     string `json:"distribution,omitempty"`     // normal, pareto, etc.
+
+	LossModel string `json:"lossModel,omitempty"` // "none", "random", "state", "gemodel"
 
 	// Loss Random
-	Loss            string // %
-	LossCorrelation string // %
+	Loss            string `json:"loss,omitempty"`            // %
+	LossCorrelation string `json:"lossCorrelation,omitempty"` // %
 
 	// Loss State (4-state Markov chain)
-	LossStateP13 string // %
-	LossStateP31 string // %
-	LossStateP32 string // %
-	LossStateP23 string // %
-	LossStateP14 string // %
+	LossStateP13 string `json:"lossStateP13,omitempty"` // %
+	LossStateP31 string `json:"lossStateP31,omitempty"` // %
+	LossStateP32 string `json:"lossStateP32,omitempty"` // %
+	LossStateP23 string `json:"lossStateP23,omitempty"` // %
+	LossStateP14 string `json:"lossStateP14,omitempty"` // %
 
 	// Loss Gemodel (Gilbert-Elliot (burst loss))
-	LossGemodelP  string // %
-	LossGemodelR  string // %
-	LossGemodel1h string // %
-	LossGemodel1k string // %
-
-	Corrupt              string // %
-	CorruptCorrelation   string // %
-	Duplicate            string // %
-	DuplicateCorrelation string // %
-	Reorder              string // %
-	ReorderCorrelation   string // %
-	ReorderGap           string
+	LossGemodelP  string `json:"lossGemodelP,omitempty"`  // %
+	LossGemodelR  string `json:"lossGemodelR,omitempty"`  // %
+	LossGemodel1h string `json:"lossGemodel1h,omitempty"` // %
+	LossGemodel1k string `json:"lossGemodel1k,omitempty"` // %
+
+	Corrupt              string `json:"corrupt,omitempty"`              // %
+	CorruptCorrelation   string `json:"corruptCorrelation,omitempty"`   // %
+	Duplicate            string `json:"duplicate,omitempty"`            // %
+	DuplicateCorrelation string `json:"duplicateCorrelation,omitempty"` // %
+	Reorder              string `json:"reorder,omitempty"`              // %
+	ReorderCorrelation   string `json:"reorderCorrelation,omitempty"`   // %
+	ReorderGap           string `json:"reorderGap,omitempty"`
+	Seed                 string `json:"seed,omitempty"` // netem PRNG seed, for reproducible randomness
+
+	// Flow sampling: only impair this % of flows (empty = all flows)
+	FlowSamplePercent string `json:"flowSamplePercent,omitempty"`
+
+	// Selectors (tcset --src-network & co): only impair matching traffic.
+	// Exclusions are comma-separated lists and are never impaired.
+	SrcNetwork        string `json:"srcNetwork,omitempty"`        // IP or CIDR
+	DstNetwork        string `json:"dstNetwork,omitempty"`        // IP or CIDR
+	SrcPort           string `json:"srcPort,omitempty"`           // 1-65535
+	DstPort           string `json:"dstPort,omitempty"`           // 1-65535
+	ExcludeSrcNetwork string `json:"excludeSrcNetwork,omitempty"` // IPs or CIDRs
+	ExcludeDstNetwork string `json:"excludeDstNetwork,omitempty"` // IPs or CIDRs
+	ExcludeSrcPort    string `json:"excludeSrcPort,omitempty"`    // ports
+	ExcludeDstPort    string `json:"excludeDstPort,omitempty"`    // ports
+
+	// ICMP: comma-separated kinds (echo, unreachable, frag-needed,
+	// time-exceeded) to drop, or to rate-limit to IcmpRate
+	IcmpDrop  string `json:"icmpDrop,omitempty"`
+	IcmpLimit string `json:"icmpLimit,omitempty"`
+	IcmpRate  string `json:"icmpRate,omitempty"` // e.g. "8kbit"
+
+	// "true": subtract the interface's measured latency baseline from Delay
+	Compensate string `json:"compensate,omitempty"`
+
+	// 'incoming' rules: "ifb" or "police" (empty = INGRESS_MODE, or auto)
+	IngressMode string `json:"ingressMode,omitempty"`
+
+	// qdisc tree: "htb", "prio" or "netem" (empty = prio without rate limiting)
+	Tree string `json:"tree,omitempty"`
+
+	// "true": keep an mq/mqprio root and impair each transmit queue
+	PreserveMQ string `json:"preserveMq,omitempty"`
+
+	// Coexistence: a class of the host's root (e.g. "1:20") to attach the
+	// tree below, instead of replacing the root ('outgoing' only)
+	ParentClass string `json:"parentClass,omitempty"`
+
+	// Ingress filters: "auto", "none", "skip_hw" or "skip_sw" (hw-tc-offload NICs)
+	FilterOffload string `json:"filterOffload,omitempty"`
+
+	// "true": allow a rule on a loopback interface ('lo')
+	ConfirmLoopback string `json:"confirmLoopback,omitempty"`
 }
 
-func handleTcSetupV4(w http.ResponseWriter, r *http.Request) {
-	ctx := r.Context()
-	q := r.URL.Query()
+// parseV4Options builds the V4 options from the /setup query string.
+func parseV4Options(q url.Values) *V4NetworkOptions {
 	opts := &V4NetworkOptions{
 		Iface:                q.Get("iface"),
 		Direction:            q.Get("direction"),
-		ApiPort:              strings.Trim(os.Getenv("API_LISTEN"), ":"),
 		Rate:                 q.Get("rate"),
+		Ceil:                 q.Get("ceil"),
+		Burst:                q.Get("burst"),
+		Cburst:               q.Get("cburst"),
+		RateScope:            q.Get("rateScope"),
 		Delay:                q.Get("delay"),
 		Jitter:               q.Get("jitter"),
 		DelayCorrelation:     q.Get("delayCorrelation"),
@@ -197,96 +374,803 @@ func handleTcSetupV4(w http.ResponseWriter, r *http.Request) {
 		Reorder:              q.Get("reorder"),
 		ReorderCorrelation:   q.Get("reorderCorrelation"),
 		ReorderGap:           q.Get("reorderGap"),
+		Seed:                 q.Get("seed"),
+		FlowSamplePercent:    q.Get("flowSamplePercent"),
+		SrcNetwork:           q.Get("srcNetwork"),
+		DstNetwork:           q.Get("dstNetwork"),
+		SrcPort:              q.Get("srcPort"),
+		DstPort:              q.Get("dstPort"),
+		ExcludeSrcNetwork:    q.Get("excludeSrcNetwork"),
+		ExcludeDstNetwork:    q.Get("excludeDstNetwork"),
+		ExcludeSrcPort:       q.Get("excludeSrcPort"),
+		ExcludeDstPort:       q.Get("excludeDstPort"),
+		IcmpDrop:             q.Get("icmpDrop"),
+		IcmpLimit:            q.Get("icmpLimit"),
+		IcmpRate:             q.Get("icmpRate"),
+		Compensate:           q.Get("compensate"),
+		IngressMode:          q.Get("ingressMode"),
+		Tree:                 q.Get("tree"),
+		PreserveMQ:           q.Get("preserveMq"),
+		ParentClass:          q.Get("parentClass"),
+		FilterOffload:        q.Get("filterOffload"),
+		ConfirmLoopback:      q.Get("confirmLoopback"),
+	}
+	// V2 clients send 'loss' (and 'lossCorrelation') without a model, which
+	// netem would otherwise never see
+	if opts.LossModel == "" && opts.Loss != "" {
+		opts.LossModel = "random"
 	}
+	return opts
+}
 
-	if err := opts.Execute(ctx); err != nil {
-		respondWithError(w, err.Error(), 500)
+func handleTcSetupV4(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	q, err := withProfile(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	targets, err := resolveTargetInterfaces(q.Get("iface"), q.Get("ifaceRegex"))
+	if err != nil {
+		respondWithLocalizedError(w, r, 400, err)
+		return
+	}
+	if q.Get("dryRun") == "true" {
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{"dryRun": true, "ifaces": targets})
+		return
+	}
+	// All 'incoming' rules share ifb0, so they can only target one interface.
+	if q.Get("direction") == "incoming" && len(targets) > 1 {
+		respondWithLocalizedError(w, r, 400, msg("rule.incomingSingleIface", len(targets)))
+		return
+	}
+	onConflict := q.Get("onConflict")
+	if onConflict != "" && onConflict != "fail" && onConflict != "ignore" {
+		respondWithLocalizedError(w, r, 400, msg("rule.invalidOnConflict", onConflict))
 		return
 	}
 
-	log.Printf("[INFO] V4: Native rules applied successfully to %v", opts.Iface)
-	respondWithJSON(w, http.StatusOK, nil)
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if code, err := checkIfMatch(r, targets); err != nil {
+		respondWithError(w, err.Error(), code)
+		return
+	}
+
+	// What is already on the targets, before anything changes
+	lang := requestLanguage(r)
+	conflicts := []*RuleConflict{}
+	for _, iface := range targets {
+		opts := parseV4Options(q)
+		opts.Iface = iface
+		for _, c := range opts.detectConflicts(ctx) {
+			conflicts = append(conflicts, c.render(lang))
+		}
+	}
+	if conflictsStop(conflicts, onConflict) {
+		texts := make([]string, len(conflicts))
+		for i, c := range conflicts {
+			texts[i] = c.Message
+		}
+		message := msg("rule.conflicts", strings.Join(texts, "; "))
+		log.Printf("[ERROR] API Error: %s", message.Error())
+		w.Header().Set("Content-Language", lang)
+		respondWithJSON(w, http.StatusConflict, map[string]interface{}{
+			"code": http.StatusConflict, "message": message.Render(lang), "messageCode": message.Code, "conflicts": conflicts,
+		})
+		return
+	}
+
+	// The kernel judges the commands in a scratch namespace first
+	var shadow []*ShadowResult
+	if shadowRequested(q.Get("shadow")) && !isDarwin {
+		if err := privilegedFeatureAvailable("shadow"); err != nil {
+			respondWithError(w, "shadow: "+err.Error(), 501)
+			return
+		}
+		rules := make([]*V4NetworkOptions, 0, len(targets))
+		for _, iface := range targets {
+			opts := parseV4Options(q)
+			opts.Iface = iface
+			excludeClient(r, opts)
+			rules = append(rules, opts)
+		}
+		results, ok, err := shadowApply(ctx, lang, rules)
+		if err != nil {
+			respondWithError(w, err.Error(), 500)
+			return
+		}
+		if !ok {
+			var refused []error
+			for _, result := range results {
+				if !result.OK {
+					refused = append(refused, msg("rule.shadowRefused", result.Iface, result.Error))
+				}
+			}
+			body := localizedErrorBody(w, r, 400, refused...)
+			body["shadow"] = results
+			respondWithJSON(w, 400, body)
+			return
+		}
+		shadow = results
+	}
+
+	var failures []error
+	var partials []*SetupError
+	var applied []*AppliedConfig
+	for _, iface := range targets {
+		sched.StopIface(iface)
+		opts := parseV4Options(q)
+		opts.Iface = iface
+		excludeClient(r, opts)
+		recordTCPBefore(ctx, iface)
+		if err := opts.Execute(ctx); err != nil {
+			failures = append(failures, err)
+			var partial *SetupError
+			if errors.As(err, &partial) {
+				restorePrevious(ctx, partial)
+				partials = append(partials, partial)
+			}
+			continue
+		}
+		rev := store.Set(opts, actorFromRequest(r))
+		setETag(w, rev)
+		applied = append(applied, appliedConfig(ctx, opts, rev))
+		log.Printf("[INFO] V4: Native rules applied successfully to %v", opts.Iface)
+	}
+	if len(failures) > 0 {
+		body := localizedErrorBody(w, r, 500, failures...)
+		if len(partials) > 0 {
+			body["failures"] = partials
+		}
+		respondWithJSON(w, 500, body)
+		return
+	}
+	// The canonical applied configuration of each target
+	response := map[string]interface{}{"ifaces": targets, "applied": applied}
+	if len(conflicts) > 0 {
+		response["conflicts"] = conflicts
+	}
+	if shadow != nil {
+		response["shadow"] = shadow
+	}
+	// Parameters the server does not know are ignored, but reported
+	if warnings := unknownParams(r); len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+	// Optional self-measurement of the rule (same for all targets)
+	if q.Get("accuracy") == "true" && !isDarwin {
+		response["accuracy"] = measureAccuracy(ctx, applied[0].Options)
+	}
+	respondWithJSON(w, http.StatusOK, response)
 }
 
-// Execute is the new native 'tc' command builder
+// Execute is the new native 'tc' command builder. When a step fails after
+// the interface was changed, the partial tree is rolled back and the error
+// is a *SetupError naming the step.
 func (v *V4NetworkOptions) Execute(ctx context.Context) error {
+	// (a plan records the commands one by one)
+	if _, planning := ctx.Value(commandRecorderKey{}).(*commandRecorder); tcBatchEnabled() && !planning {
+		t := &setupTracker{}
+		batchCtx, batch := withTCBatch(context.WithValue(ctx, setupTrackerKey{}, t))
+		err := v.execute(batchCtx)
+		if err == nil {
+			err = batch.flush(batchCtx)
+		}
+		if batch.err == nil {
+			return v.settle(ctx, t, err)
+		}
+		log.Printf("[WARN] V4: Batched setup of %s failed, redoing it command by command", v.Iface)
+	}
+	t := &setupTracker{}
+	return v.settle(ctx, t, v.execute(context.WithValue(ctx, setupTrackerKey{}, t)))
+}
+
+// settle returns the result of a setup, rolling back what a failed one
+// changed.
+func (v *V4NetworkOptions) settle(ctx context.Context, t *setupTracker, err error) error {
+	if err == nil || len(t.completed) == 0 && t.failed == "" {
+		return err
+	}
+	return v.rollback(ctx, t, err)
+}
+
+// execute builds the rule's tree, step by step.
+func (v *V4NetworkOptions) execute(ctx context.Context) error {
 	if v.Iface == "" {
-		return fmt.Errorf("V4: 'iface' is required")
+		return msg("rule.ifaceRequired")
 	}
 	if v.Direction == "" {
-		return fmt.Errorf("V4: 'direction' is required")
+		return msg("rule.directionRequired")
+	}
+	if v.Direction != "incoming" && v.Direction != "outgoing" {
+		return msg("rule.invalidDirection", v.Direction)
+	}
+	if !ifaceAllowed(v.Iface) {
+		return msg("rule.ifaceExcluded", v.Iface)
+	}
+	if err := v.validateLoopback(); err != nil {
+		return err
+	}
+	if err := v.validateNetem(); err != nil {
+		return err
+	}
+	// (before the class parameters, which leave the rate out per flow)
+	if err := v.validateRateScope(v.Direction == "incoming" && v.ingressMode() == "police"); err != nil {
+		return err
+	}
+	sampleBuckets, err := v.flowSampleBuckets()
+	if err != nil {
+		return err
+	}
+	classParams, err := v.htbClassParams()
+	if err != nil {
+		return err
+	}
+	shape, err := v.treeShape()
+	if err != nil {
+		return err
+	}
+	if v.IngressMode != "" && v.IngressMode != "ifb" && v.IngressMode != "police" {
+		return msg("rule.invalidIngressMode", v.IngressMode)
+	}
+	policing := v.Direction == "incoming" && v.ingressMode() == "police"
+	if policing {
+		if err := v.validatePolicing(); err != nil {
+			return err
+		}
+	}
+	filterFlags, err := v.filterFlags(ctx)
+	if err != nil {
+		return err
+	}
+	preserveMQ := v.PreserveMQ == "true"
+	if preserveMQ {
+		if err := v.validatePreserveMQ(); err != nil {
+			return err
+		}
+	}
+	if err := v.validateParentClass(); err != nil {
+		return err
+	}
+	if err := v.validateSelectors(shape, policing); err != nil {
+		return err
+	}
+	if err := v.validateICMP(shape, policing); err != nil {
+		return err
 	}
 	if isDarwin {
 		log.Println("[INFO] V4: Darwin: Ignoring network setup")
 		return nil
 	}
 
-	// 1. Atomic Operation: Clean old rules FIRST
-	if err := cleanupSingleInterface(ctx, v.Iface); err != nil {
+	// 1. Atomic Operation: Clean the old rule of the direction FIRST (the
+	// rule of the other direction stays)
+	liveKind, liveHandle := rootQdisc(ctx, v.Iface)
+	if err := cleanupDirection(ctx, v.Iface, v.Direction); err != nil {
 		return fmt.Errorf("V4: cleanup failed before setup: %w", err)
 	}
 
-	// 2. Determine Effective Interface (ifb logic)
+	// 1b. Coexistence: the host's root stays, the tree goes below its class
+	if v.ParentClass != "" {
+		if !parentClassExists(ctx, v.Iface, v.ParentClass) {
+			return msg("rule.parentClassMissing", v.ParentClass, v.Iface)
+		}
+		if kind := hostLeafQdisc(ctx, v.Iface, v.ParentClass); kind != "" {
+			return msg("rule.parentClassTaken", v.ParentClass, v.Iface, kind)
+		}
+		log.Printf("[INFO] V4: Attaching the tree below class %s of the %s root of %s (coexistence)", v.ParentClass, liveKind, v.Iface)
+	} else if isMultiQueueRoot(liveKind) && v.Direction == "outgoing" {
+		// 1c. Multi-queue NIC: impair each tx queue, or replace the mq root
+		if preserveMQ {
+			return v.executePerQueue(ctx, liveKind, liveHandle)
+		}
+		log.Printf("[WARN] V4: Replacing the %s root of %s: its hardware queue mapping is lost until reset (use preserveMq=true to keep it)", liveKind, v.Iface)
+		if err := runTC(ctx, "qdisc", "del", "dev", v.Iface, "root"); err != nil {
+			return fmt.Errorf("V4: failed to remove the %s root of '%s': %w", liveKind, v.Iface, err)
+		}
+	} else if v.Direction == "outgoing" && liveHandle != "" && liveHandle != "0:" && !ownsHandle(liveHandle) {
+		// 1d. A root of the host (the cleanup left it alone)
+		log.Printf("[WARN] V4: Replacing the %s %s root of %s, which was not created by netsim: it is not restored on reset", liveKind, liveHandle, v.Iface)
+		if err := runTC(ctx, "qdisc", "del", "dev", v.Iface, "root"); err != nil {
+			return fmt.Errorf("V4: failed to remove the %s root of '%s': %w", liveKind, v.Iface, err)
+		}
+	}
+
+	// 2a. Without ifb: police the ingress instead of shaping it
+	if policing {
+		if err := v.executePolicing(ctx, filterFlags); err != nil {
+			return err
+		}
+		v.reattachMirror(ctx)
+		return nil
+	}
+
+	// 2b. Determine Effective Interface (ifb logic)
 	effectiveIface := v.Iface
 	apiFilterPortCmd := "sport" // Outgoing traffic (from API)
 	if v.Direction == "incoming" {
 		if !hasIFB {
-			return fmt.Errorf("V4: 'ifb' module not loaded on host. 'incoming' rules cannot be applied")
+			return msg("rule.ifbMissing")
 		}
 
-		// 1. Bring up ifb0 interface
-		if err := runIP(ctx, "link", "set", "dev", "ifb0", "up"); err != nil {
-			return fmt.Errorf("V4: failed to bring up 'ifb0': %w", err)
-		}
-		// 2. Add ingress qdisc to real interface
-		if err := runTC(ctx, "qdisc", "add", "dev", v.Iface, "ingress"); err != nil {
-			return fmt.Errorf("V4: failed to add ingress qdisc on '%s': %w", v.Iface, err)
+		// 1. Bring up ifb0 interface (recreating it if a reset-all removed it)
+		if err := ensureIFB(ctx, "ifb0"); err != nil {
+			return err
 		}
-		// 3. Add filter to mirror all inbound traffic to ifb0's output
-		if err := runTC(ctx, "filter", "add", "dev", v.Iface, "parent", "ffff:",
-			"protocol", "all", "u32", "match", "u32", "0", "0",
-			"action", "mirred", "egress", "redirect", "dev", "ifb0"); err != nil {
-			return fmt.Errorf("V4: failed to add mirred filter on '%s': %w", v.Iface, err)
+		// 2-3. Redirect all inbound traffic to ifb0's output
+		if err := redirectIngressToIFB(ctx, v.Iface, filterFlags); err != nil {
+			return err
 		}
 
 		effectiveIface = "ifb0"    // Rules are now applied to the egress of ifb0
 		apiFilterPortCmd = "dport" // Incoming traffic (to the API)
 	}
 
+	// 3. Without rate limiting, netem alone is enough
+	if shape != "htb" {
+		if err := v.executeNetemTree(ctx, shape, effectiveIface, apiFilterPortCmd); err != nil {
+			return err
+		}
+		v.reattachMirror(ctx)
+		return nil
+	}
+
 	// 3. Build the Fixed HTB Tree
 
-	// 3a. Root Qdisc: htb, default 11 (slow traffic)
-	if err := runTC(ctx, "qdisc", "add", "dev", effectiveIface, "root", "handle", "1:", "htb", "default", "11"); err != nil {
+	// 3a. Root Qdisc (or the leaf of the host's class): htb, default 11 (slow traffic)
+	htbArgs := append(append([]string{"qdisc", "add", "dev", effectiveIface}, v.treeAttach()...), "handle", rootHandle, "htb", "default", "11")
+	if err := runTC(ctx, htbArgs...); err != nil {
 		return fmt.Errorf("V4: failed to add root htb qdisc: %w", err)
 	}
 
-	// 3b. "Fast" Class (API): 1:10, unlimited bandwidth
-	if err := runTC(ctx, "class", "add", "dev", effectiveIface, "parent", "1:", "classid", "1:10", "htb", "rate", "10gbit"); err != nil {
+	// 3b. "Fast" Class (API): unlimited bandwidth
+	fastRate := unlimitedRate(v.Iface)
+	if err := runTC(ctx, "class", "add", "dev", effectiveIface, "parent", rootHandle, "classid", unlimitedClass, "htb", "rate", fastRate, "quantum", htbQuantum(v.Iface, fastRate)); err != nil {
 		return fmt.Errorf("V4: failed to add 'fast' htb class: %w", err)
 	}
 
-	// 3c. "Slow" Class (Simulation): 1:11, with user's 'rate'
-	rateLimit := "10gbit" // Unlimited default if not provided
+	// 3c. "Slow" Class (Simulation): with user's 'rate' (and ceil/burst)
+	classArgs := append([]string{"class", "add", "dev", effectiveIface, "parent", rootHandle, "classid", shapedClass, "htb"}, classParams...)
+	if err := runTC(ctx, classArgs...); err != nil {
+		return fmt.Errorf("V4: failed to add 'slow' htb class: %w", err)
+	}
+
+	// 4. Build and Attach 'netem' to the "Slow" Class
+	netemArgs := []string{"qdisc", "add", "dev", effectiveIface, "parent", shapedClass, "handle", netemHandle, "netem"}
+	netemParams, hasNetemRules := v.netemParams()
+	netemArgs = append(netemArgs, netemParams...)
+
+	// Only attach 'netem' if there are rules for it
+	if hasNetemRules {
+		if err := runTC(ctx, netemArgs...); err != nil {
+			return fmt.Errorf("V4: failed to add netem qdisc: %w", err)
+		}
+	}
+
+	// 4b. (Conditional) rateScope=flow: fq below netem (or the class) caps
+	// each flow instead
+	if v.RateScope == "flow" {
+		if err := runTC(ctx, v.flowCapArgs(effectiveIface, hasNetemRules, "add")...); err != nil {
+			return fmt.Errorf("V4: failed to add the per-flow fq qdisc: %w", err)
+		}
+	}
+
+	// 5. Apply u32 Filters
+
+	// 5a. API Filters (Prio 1) -> "Fast" Class, IPv4 and IPv6, for every
+	// protected port (We use --dport or --sport depending on direction)
+	if err := addProtectedPortFilters(ctx, effectiveIface, apiFilterPortCmd, unlimitedClass); err != nil {
+		return fmt.Errorf("V4: failed to add 'fast' API filter: %w", err)
+	}
+	if err := v.addICMPFilters(ctx, effectiveIface); err != nil {
+		return err
+	}
+
+	// 5b. (Conditional) Selectors (Prio 2-7): only the targeted,
+	// non-excluded traffic goes to the "Slow" class (its sampled flows with
+	// flow sampling)
+	if v.hasSelectors() {
+		if err := v.addSelectorFilters(ctx, effectiveIface, shapedClass, unlimitedClass, sampleBuckets); err != nil {
+			return err
+		}
+	} else if sampleBuckets != 0 {
+		// 5c. (Conditional) Flow Sampling (Prio 2) -> "Slow" Class, the
+		// rest (Prio 3) -> "Fast" Class
+		if err := v.addSampleFilters(ctx, effectiveIface, sampleBuckets, shapedClass, unlimitedClass); err != nil {
+			return err
+		}
+	} else {
+		// 5d. "All Else" Filter (Prio 2) -> "Slow" Class
+		if err := runTC(ctx, "filter", "add", "dev", effectiveIface, "protocol", "all", "parent", rootHandle, "prio", "2",
+			"u32", "match", "u32", "0", "0",
+			"flowid", shapedClass); err != nil {
+			return fmt.Errorf("V4: failed to add default 'slow' filter: %w", err)
+		}
+	}
+
+	// 6. Re-attach the traffic mirror (the cleanup above removed it)
+	v.reattachMirror(ctx)
+
+	return nil
+}
+
+// clsactUnsupported is set once the kernel refused a clsact qdisc, so later
+// rules go straight to the legacy ingress qdisc.
+var clsactUnsupported atomic.Bool
+
+// redirectIngressToIFB sends the inbound traffic of iface to ifb0. It uses
+// the clsact qdisc when the kernel supports it (its ingress hook also takes
+// eBPF programs next to ours), and falls back to the legacy ingress qdisc.
+// The interface must be clean. flags are the offload flags of the filter.
+func redirectIngressToIFB(ctx context.Context, iface string, flags []string) error {
+	if !clsactUnsupported.Load() {
+		// The host's own filters may have kept a clsact qdisc in place
+		existing := ingressQdisc(ctx, iface) == "clsact"
+		var err error
+		if !existing {
+			err = runTC(ctx, "qdisc", "add", "dev", iface, "clsact")
+		}
+		if err == nil {
+			err = runTC(ctx, withFilterFlags(withCookie("filter", "add", "dev", iface, "ingress", "prio", "2",
+				"protocol", "all", "u32", "match", "u32", "0", "0",
+				"action", "mirred", "egress", "redirect", "dev", "ifb0"), flags)...)
+			if err == nil || existing {
+				return err
+			}
+			runTC(ctx, "qdisc", "del", "dev", iface, "clsact")
+		}
+		clsactUnsupported.Store(true)
+		log.Printf("[WARN] V4: clsact ingress unavailable (%v). Falling back to the legacy ingress qdisc.", err)
+	}
+
+	// Legacy path: ingress qdisc + mirred filter
+	if err := runTC(ctx, "qdisc", "add", "dev", iface, "ingress"); err != nil {
+		return fmt.Errorf("V4: failed to add ingress qdisc on '%s': %w", iface, err)
+	}
+	if err := runTC(ctx, withFilterFlags(withCookie("filter", "add", "dev", iface, "parent", "ffff:",
+		"protocol", "all", "u32", "match", "u32", "0", "0",
+		"action", "mirred", "egress", "redirect", "dev", "ifb0"), flags)...); err != nil {
+		return fmt.Errorf("V4: failed to add mirred filter on '%s': %w", iface, err)
+	}
+	return nil
+}
+
+// flowSampleBuckets translates FlowSamplePercent into the number of the
+// flowHashBuckets buckets whose flows are impaired (see flowHashMatch), 0
+// without sampling: round(percent*256/100), at least one. At 100% every
+// bucket is selected, and the rule keeps its sampling filters so that it can
+// be lowered in place.
+func (v *V4NetworkOptions) flowSampleBuckets() (int, error) {
+	if v.FlowSamplePercent == "" {
+		return 0, nil
+	}
+	percent, ok := parseTCNumber(v.FlowSamplePercent)
+	if !ok || percent <= 0 || percent > 100 {
+		return 0, msg("rule.invalidFlowSample", v.FlowSamplePercent)
+	}
+	selected := int(math.Round(percent * flowHashBuckets / 100))
+	if selected == 0 {
+		selected = 1 // Smallest possible sample (~0.4% of flows)
+	}
+	return selected, nil
+}
+
+// Adjust changes a live rule in place: the "slow" class rate and the netem
+// qdisc are changed without tearing down the tree, so established flows are
+// not disturbed; so are the flow sampling filters when only the percentage
+// changes. It falls back to a full Execute when there is no previous rule or
+// the tree shape (interface, direction, selectors, flow sampling on or off)
+// differs.
+func (v *V4NetworkOptions) Adjust(ctx context.Context, prev *V4NetworkOptions) error {
+	if err := v.validateNetem(); err != nil {
+		return err
+	}
+	if err := v.validateRateScope(v.Direction == "incoming" && v.ingressMode() == "police"); err != nil {
+		return err
+	}
+	if isDarwin {
+		return nil
+	}
+	// (a policer or per-queue netem has no tree to adjust: it is re-applied)
+	if prev == nil || v.PreserveMQ == "true" || prev.PreserveMQ == "true" || prev.Iface != v.Iface || prev.Direction != v.Direction ||
+		prev.ParentClass != v.ParentClass || prev.RateScope != v.RateScope ||
+		(prev.FlowSamplePercent == "") != (v.FlowSamplePercent == "") || prev.selectorKey() != v.selectorKey() || prev.icmpKey() != v.icmpKey() ||
+		v.Direction == "incoming" && (prev.ingressMode() != "ifb" || v.ingressMode() != "ifb") ||
+		!ruleIsLive(ctx, prev) {
+		return v.Execute(ctx)
+	}
+
+	shape, err := v.treeShape()
+	if err != nil {
+		return err
+	}
+	if prevShape, _ := prev.treeShape(); prevShape != shape {
+		return v.Execute(ctx)
+	}
+	dev := v.effectiveIface()
+	switch shape {
+	case "prio":
+		args := append([]string{"qdisc", "replace", "dev", dev, "parent", impairedBand, "handle", netemHandle, "netem"}, v.netemArgs()...)
+		if err := runTC(ctx, args...); err != nil {
+			return fmt.Errorf("V4: failed to change netem qdisc: %w", err)
+		}
+		return nil
+	case "netem":
+		args := append(append(append([]string{"qdisc", "replace", "dev", dev}, v.treeAttach()...), "handle", netemHandle, "netem"), v.netemArgs()...)
+		if err := runTC(ctx, args...); err != nil {
+			return fmt.Errorf("V4: failed to change netem qdisc: %w", err)
+		}
+		return nil
+	}
+
+	classParams, err := v.htbClassParams()
+	if err != nil {
+		return err
+	}
+	classArgs := append([]string{"class", "change", "dev", dev, "parent", rootHandle, "classid", shapedClass, "htb"}, classParams...)
+	if err := runTC(ctx, classArgs...); err != nil {
+		return fmt.Errorf("V4: failed to change 'slow' htb class: %w", err)
+	}
+
+	netemParams, hasNetemRules := v.netemParams()
+	if v.RateScope == "flow" {
+		// The fq sits below netem when there is one: moving it needs the
+		// whole tree
+		if _, prevNetem := prev.netemParams(); prevNetem != hasNetemRules {
+			return v.Execute(ctx)
+		}
+	}
+	if hasNetemRules {
+		args := append([]string{"qdisc", "replace", "dev", dev, "parent", shapedClass, "handle", netemHandle, "netem"}, netemParams...)
+		if err := runTC(ctx, args...); err != nil {
+			return fmt.Errorf("V4: failed to change netem qdisc: %w", err)
+		}
+	} else if v.RateScope != "flow" {
+		if err := runTC(ctx, "qdisc", "del", "dev", dev, "parent", shapedClass, "handle", netemHandle); err != nil {
+			return fmt.Errorf("V4: failed to remove netem qdisc: %w", err)
+		}
+	}
+	if v.RateScope == "flow" {
+		if err := runTC(ctx, v.flowCapArgs(dev, hasNetemRules, "replace")...); err != nil {
+			return fmt.Errorf("V4: failed to change the per-flow fq qdisc: %w", err)
+		}
+	}
+	if prev.FlowSamplePercent != v.FlowSamplePercent {
+		return v.resample(ctx, dev)
+	}
+	return nil
+}
+
+// tcSizePattern matches tc sizes such as "1500", "15k", "1mb" or "64kbit".
+var tcSizePattern = regexp.MustCompile(`(?i)^[0-9]+(\.[0-9]+)?(b|k|kb|m|mb|g|gb|bit|kbit|mbit|gbit)?$`)
+
+// tcNumberPattern matches the plain decimals netsim passes to tc.
+// strconv.ParseFloat alone also accepts "NaN", "Inf", "0x1p3" and "1e3",
+// which slip past range checks or are read differently by tc.
+var tcNumberPattern = regexp.MustCompile(`^([0-9]+(\.[0-9]*)?|\.[0-9]+)$`)
+
+// parseTCNumber parses a plain non-negative decimal (see tcNumberPattern).
+func parseTCNumber(s string) (float64, bool) {
+	if !tcNumberPattern.MatchString(s) {
+		return 0, false
+	}
+	f, err := strconv.ParseFloat(s, 64)
+	return f, err == nil
+}
+
+// tcDistributionPattern matches netem distribution names: tc reads the
+// table from <name>.dist in its library directory, so a path is refused.
+var tcDistributionPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// htbClassParams builds the parameters of the shaped class (everything after
+// the 'htb' keyword): rate, quantum, and the optional ceil, burst and
+// cburst. With ceil above rate, a class that was idle sends 'burst' bytes at
+// up to the ceil rate before settling at the sustained rate (like a cable
+// ISP's "PowerBoost").
+func (v *V4NetworkOptions) htbClassParams() ([]string, error) {
+	rateLimit := unlimitedRate(v.Iface) // Unlimited default if not provided
 	if v.Rate != "" {
-		rateLimit = v.Rate
+		if _, err := parseTCRate(v.Rate); err != nil {
+			return nil, msg("rule.invalidRate", v.Rate)
+		}
+		if v.RateScope != "flow" { // (per flow, the fq below caps it)
+			rateLimit = v.Rate
+		}
 	}
-	if err := runTC(ctx, "class", "add", "dev", effectiveIface, "parent", "1:", "classid", "1:11", "htb", "rate", rateLimit); err != nil {
-		return fmt.Errorf("V4: failed to add 'slow' htb class: %w", err)
+	params := []string{"rate", rateLimit}
+	if v.Ceil != "" {
+		ceil, err := parseTCRate(v.Ceil)
+		if err != nil {
+			return nil, msg("rule.invalidCeil", v.Ceil)
+		}
+		if rate, err := parseTCRate(rateLimit); err == nil && ceil < rate {
+			return nil, msg("rule.ceilBelowRate", v.Ceil, rateLimit)
+		}
+		params = append(params, "ceil", v.Ceil)
+	}
+	for _, size := range []struct{ name, value string }{{"burst", v.Burst}, {"cburst", v.Cburst}} {
+		if size.value == "" {
+			continue
+		}
+		if !tcSizePattern.MatchString(size.value) {
+			return nil, msg("rule.invalidSize", size.name, size.value)
+		}
+		params = append(params, size.name, size.value)
+	}
+	params = append(params, "quantum", htbQuantum(v.Iface, rateLimit))
+	return params, nil
+}
+
+// htbQuantum is the quantum (bytes a class sends per round) of an HTB class
+// of rate on iface. HTB derives it as rate/r2q (r2q 10): below one packet
+// under ~120kbit ("quantum of class is small", unfair rounds) and over its
+// 200000 cap above 16mbit ("quantum of class is big" in dmesg). Setting it
+// explicitly to rate/10, clamped to [MTU + Ethernet header, 200000], keeps
+// the scheduling smooth and the kernel log quiet.
+func htbQuantum(iface, rate string) string {
+	minQuantum := linkMTU(iface) + 14
+	bits, err := parseTCRate(rate)
+	if err != nil {
+		return strconv.Itoa(minQuantum)
+	}
+	quantum := int(math.Min(bits/8/10, 200000))
+	return strconv.Itoa(max(quantum, minQuantum))
+}
+
+// linkMTU returns the MTU of iface (from sysfs), or 1500 when unknown.
+func linkMTU(iface string) int {
+	b, err := os.ReadFile("/sys/class/net/" + iface + "/mtu")
+	if err != nil {
+		return 1500
+	}
+	mtu, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || mtu <= 0 {
+		return 1500
 	}
+	return mtu
+}
+
+// unlimitedRate is the rate of the classes that should not limit anything:
+// the link speed of iface (from sysfs) when it is above 10gbit, so 25/40/100G
+// NICs are not capped, else 10gbit (also for virtual devices without speed).
+func unlimitedRate(iface string) string {
+	if mbit := linkSpeedMbit(iface); mbit > 10000 {
+		return fmt.Sprintf("%dmbit", mbit)
+	}
+	return "10gbit"
+}
 
-	// 4. Build and Attach 'netem' to the "Slow" Class (1:11)
-	netemArgs := []string{"qdisc", "add", "dev", effectiveIface, "parent", "1:11", "handle", "10:", "netem"}
-	hasNetemRules := false
+// linkSpeedMbit returns the negotiated speed of iface in Mbit/s, or 0 when
+// unknown.
+func linkSpeedMbit(iface string) int {
+	b, err := os.ReadFile("/sys/class/net/" + iface + "/speed")
+	if err != nil {
+		return 0
+	}
+	mbit, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil || mbit < 0 {
+		return 0
+	}
+	return mbit
+}
 
+// treeShape picks the qdisc tree of the rule:
+//   - "htb": the fixed HTB tree, needed to limit the rate (and to sample flows)
+//   - "prio": a 2-band prio root with netem on band 2, the API port on band 1
+//   - "netem": netem as the root qdisc (lowest overhead, the API is impaired too)
+//
+// Without Tree, rules with netem parameters and no rate limiting use "prio",
+// so fast NICs are not capped by the HTB classes.
+func (v *V4NetworkOptions) treeShape() (string, error) {
+	_, hasNetemRules := v.netemParams()
+	rateLimited := v.Rate != "" || v.Ceil != "" || v.Burst != "" || v.Cburst != "" || v.FlowSamplePercent != ""
+	switch v.Tree {
+	case "":
+		if hasNetemRules && !rateLimited {
+			return "prio", nil
+		}
+		return "htb", nil
+	case "htb":
+		return "htb", nil
+	case "prio", "netem":
+		if rateLimited {
+			return "", msg("rule.treeCannotLimit", v.Tree)
+		}
+		if !hasNetemRules {
+			return "", msg("rule.treeNeedsNetem", v.Tree)
+		}
+		return v.Tree, nil
+	}
+	return "", msg("rule.invalidTree", v.Tree)
+}
+
+// netemArgs returns the netem parameters of the rule.
+func (v *V4NetworkOptions) netemArgs() []string {
+	args, _ := v.netemParams()
+	return args
+}
+
+// addPortFilters adds the u32 filters at prio that send the IPv4 and (if the
+// host has IPv6) IPv6 packets whose port (portCmd: "sport" or "dport")
+// matches value/mask to flowid. The kernel allows a single protocol per
+// priority, so both are 'protocol all' filters that match the IP version.
+// An IPv6 failure only fails the rule on IPv6-only hosts, where it would
+// leave the API unprotected.
+func addPortFilters(ctx context.Context, dev, prio, portCmd, value, mask, flowid string) error {
+	if err := runTC(ctx, "filter", "add", "dev", dev, "protocol", "all", "parent", rootHandle, "prio", prio,
+		"u32", "match", "u8", "0x40", "0xf0", "at", "0", "match", "ip", portCmd, value, mask,
+		"flowid", flowid); err != nil {
+		return err
+	}
+	if !hasIPv6 {
+		return nil
+	}
+	if err := runTC(ctx, "filter", "add", "dev", dev, "protocol", "all", "parent", rootHandle, "prio", prio,
+		"u32", "match", "u8", "0x60", "0xf0", "at", "0", "match", "ip6", portCmd, value, mask,
+		"flowid", flowid); err != nil {
+		if ipv6Only() {
+			return err
+		}
+		log.Printf("[WARN] V4: Failed to add the IPv6 filter at prio %s. This is non-fatal. Error: %v", prio, err)
+	}
+	return nil
+}
+
+// executeNetemTree builds a netem-only tree ("prio" or "netem" shape) on dev.
+func (v *V4NetworkOptions) executeNetemTree(ctx context.Context, shape, dev, apiFilterPortCmd string) error {
+	if shape == "netem" {
+		args := append(append(append([]string{"qdisc", "add", "dev", dev}, v.treeAttach()...), "handle", netemHandle, "netem"), v.netemArgs()...)
+		if err := runTC(ctx, args...); err != nil {
+			return fmt.Errorf("V4: failed to add root netem qdisc: %w", err)
+		}
+		return nil
+	}
+
+	// Every priority maps to band 2 (impairedBand); only the API filter picks band 1
+	priomap := strings.Fields(strings.Repeat("1 ", 16))
+	prioArgs := append(append([]string{"qdisc", "add", "dev", dev}, v.treeAttach()...), "handle", rootHandle, "prio", "bands", "2", "priomap")
+	if err := runTC(ctx, append(prioArgs, priomap...)...); err != nil {
+		return fmt.Errorf("V4: failed to add root prio qdisc: %w", err)
+	}
+	args := append([]string{"qdisc", "add", "dev", dev, "parent", impairedBand, "handle", netemHandle, "netem"}, v.netemArgs()...)
+	if err := runTC(ctx, args...); err != nil {
+		return fmt.Errorf("V4: failed to add netem qdisc: %w", err)
+	}
+	if err := addProtectedPortFilters(ctx, dev, apiFilterPortCmd, unimpairedBand); err != nil {
+		return fmt.Errorf("V4: failed to add 'fast' API filter: %w", err)
+	}
+	if err := v.addICMPFilters(ctx, dev); err != nil {
+		return err
+	}
+	if v.hasSelectors() {
+		return v.addSelectorFilters(ctx, dev, impairedBand, unimpairedBand, 0)
+	}
+	return nil
+}
+
+// effectiveIface returns the device that carries the HTB tree: the
+// interface itself for 'outgoing' rules, or its ifb mirror for 'incoming'.
+func (v *V4NetworkOptions) effectiveIface() string {
+	if v.Direction == "incoming" {
+		return "ifb0"
+	}
+	return v.Iface
+}
+
+// netemParams builds the netem parameter list (everything after the 'netem'
+// keyword). hasNetemRules is false when no netem feature was requested.
+func (v *V4NetworkOptions) netemParams() (netemArgs []string, hasNetemRules bool) {
 	// Delay, Jitter, Correlation, Distribution
 	// We trust the UI to send valid, dependent combinations (e.g., no jitter-only).
-	if v.Delay != "" {
+	delay, jitter := v.compensatedDelay()
+	if delay != "" {
 		hasNetemRules = true
-		netemArgs = append(netemArgs, "delay", fmt.Sprintf("%vms", v.Delay))
+		netemArgs = append(netemArgs, "delay", fmt.Sprintf("%vms", delay))
 
 		// Jitter is positional, requires Delay
-		if v.Jitter != "" {
-			jitterVal := v.Jitter
+		if jitter != "" {
+			jitterVal := jitter
 			// Fix: 'distribution' requires a non-zero jitter.
 			if (jitterVal == "0") && v.Distribution != "" {
 				jitterVal = "0.1" // Force 0.1ms
@@ -311,10 +1195,10 @@ func (v *V4NetworkOptions) Execute(ctx context.Context) error {
 			netemArgs = append(netemArgs, "reorder", fmt.Sprintf("%v%%", v.Reorder))
 			if v.ReorderCorrelation != "" {
 				netemArgs = append(netemArgs, fmt.Sprintf("%v%%", v.ReorderCorrelation))
-				// Gap is positional and must come AFTER correlation
-				if v.ReorderGap != "" {
-					netemArgs = append(netemArgs, "gap", v.ReorderGap)
-				}
+			}
+			// Gap is a keyword and must come AFTER correlation
+			if v.ReorderGap != "" {
+				netemArgs = append(netemArgs, "gap", v.ReorderGap)
 			}
 		}
 
@@ -382,50 +1266,169 @@ func (v *V4NetworkOptions) Execute(ctx context.Context) error {
 			netemArgs = append(netemArgs, fmt.Sprintf("%v%%", v.DuplicateCorrelation))
 		}
 	}
+	// Seed of the PRNG behind the loss, jitter, corruption, ... above
+	if seed := v.netemSeed(); hasNetemRules && seed != "" {
+		netemArgs = append(netemArgs, "seed", seed)
+	}
+	return netemArgs, hasNetemRules
+}
 
-	// Only attach 'netem' if there are rules for it
-	if hasNetemRules {
-		if err := runTC(ctx, netemArgs...); err != nil {
-			return fmt.Errorf("V4: failed to add netem qdisc: %w", err)
+// validateNetem checks the netem parameters: percentages are in [0, 100],
+// delays are non-negative, and each parameter that netem reads positionally
+// (a correlation, jitter, ...) or only applies with delay (reorder) has the
+// parameter it depends on, instead of being silently dropped.
+func (v *V4NetworkOptions) validateNetem() error {
+	for _, p := range []struct{ name, value string }{
+		{"delay", v.Delay}, {"jitter", v.Jitter},
+	} {
+		if f, ok := parseTCNumber(p.value); p.value != "" && (!ok || f < 0) {
+			return msg("rule.invalidDelay", p.name, p.value)
+		}
+	}
+	for _, p := range []struct{ name, value string }{
+		{"delayCorrelation", v.DelayCorrelation},
+		{"loss", v.Loss}, {"lossCorrelation", v.LossCorrelation},
+		{"lossStateP13", v.LossStateP13}, {"lossStateP31", v.LossStateP31}, {"lossStateP32", v.LossStateP32},
+		{"lossStateP23", v.LossStateP23}, {"lossStateP14", v.LossStateP14},
+		{"lossGemodelP", v.LossGemodelP}, {"lossGemodelR", v.LossGemodelR},
+		{"lossGemodel1h", v.LossGemodel1h}, {"lossGemodel1k", v.LossGemodel1k},
+		{"corrupt", v.Corrupt}, {"corruptCorrelation", v.CorruptCorrelation},
+		{"duplicate", v.Duplicate}, {"duplicateCorrelation", v.DuplicateCorrelation},
+		{"reorder", v.Reorder}, {"reorderCorrelation", v.ReorderCorrelation},
+	} {
+		if f, ok := parseTCNumber(p.value); p.value != "" && (!ok || f > 100) {
+			return msg("rule.invalidPercent", p.name, p.value)
 		}
 	}
+	if gap, err := strconv.Atoi(v.ReorderGap); v.ReorderGap != "" && (err != nil || gap < 1 || !tcNumberPattern.MatchString(v.ReorderGap)) {
+		return msg("rule.invalidReorderGap", v.ReorderGap)
+	}
+	if v.Distribution != "" && !tcDistributionPattern.MatchString(v.Distribution) {
+		return msg("rule.invalidDistribution", v.Distribution)
+	}
+	switch v.LossModel {
+	case "", "none", "random", "state", "gemodel":
+	default:
+		return msg("rule.invalidLossModel", v.LossModel)
+	}
+	for _, dep := range []struct{ name, value, needs, needsValue string }{
+		{"jitter", v.Jitter, "delay", v.Delay},
+		{"delayCorrelation", v.DelayCorrelation, "jitter", v.Jitter},
+		{"distribution", v.Distribution, "delay", v.Delay},
+		{"reorder", v.Reorder, "delay", v.Delay}, // netem only reorders delayed packets
+		{"reorderCorrelation", v.ReorderCorrelation, "reorder", v.Reorder},
+		{"reorderGap", v.ReorderGap, "reorder", v.Reorder},
+		{"lossCorrelation", v.LossCorrelation, "loss", v.Loss},
+		{"lossStateP31", v.LossStateP31, "lossStateP13", v.LossStateP13},
+		{"lossStateP32", v.LossStateP32, "lossStateP31", v.LossStateP31},
+		{"lossStateP23", v.LossStateP23, "lossStateP32", v.LossStateP32},
+		{"lossStateP14", v.LossStateP14, "lossStateP23", v.LossStateP23},
+		{"lossGemodelR", v.LossGemodelR, "lossGemodelP", v.LossGemodelP},
+		{"lossGemodel1h", v.LossGemodel1h, "lossGemodelR", v.LossGemodelR},
+		{"lossGemodel1k", v.LossGemodel1k, "lossGemodel1h", v.LossGemodel1h},
+		{"corruptCorrelation", v.CorruptCorrelation, "corrupt", v.Corrupt},
+		{"duplicateCorrelation", v.DuplicateCorrelation, "duplicate", v.Duplicate},
+	} {
+		if dep.value != "" && dep.needsValue == "" {
+			return msg("rule.requires", dep.name, dep.needs)
+		}
+	}
+	return v.validateSeed()
+}
 
-	// 5. Apply u32 Filters
+// --- Handler: /query ---
 
-	// 5a. API Filter (Prio 1) -> "Fast" Class (1:10)
-	// (We use --dport or --sport depending on direction)
-	if err := runTC(ctx, "filter", "add", "dev", effectiveIface, "protocol", "ip", "parent", "1:", "prio", "1",
-		"u32", "match", "ip", apiFilterPortCmd, v.ApiPort, "0xffff",
-		"flowid", "1:10"); err != nil {
-		return fmt.Errorf("V4: failed to add 'fast' API filter: %w", err)
+// handleTcQuery returns the desired rules of 'iface' (or all rules) with
+// their revision, which is also sent as the ETag for use in If-Match. 'rule'
+// is the rule 'id', or the one of 'direction' (the outgoing one first).
+func handleTcQuery(w http.ResponseWriter, r *http.Request) {
+	if !resolveRuleID(w, r) {
+		return
+	}
+	iface := r.URL.Query().Get("iface")
+	if iface == "" {
+		setETag(w, store.Revision(""))
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"revision": store.Revision(""),
+			"rules":    store.List(),
+		})
+		return
 	}
 
-	// 5b. (Conditional) API Filter (Prio 1) -> "Fast" Class (1:10) [IPv6]
-	if hasIPv6 {
-		log.Printf("[INFO] V4: Host has IPv6. Adding parallel 'fast' API filter for IPv6...")
-		if err := runTC(ctx, "filter", "add", "dev", effectiveIface, "protocol", "ipv6", "parent", "1:", "prio", "1",
-			"u32", "match", "ip6", apiFilterPortCmd, v.ApiPort, "0xffff",
-			"flowid", "1:10"); err != nil {
-			log.Printf("[WARN] V4: Failed to add 'fast' API filter (IPv6). Host kernel may lack 'u32' IPv6 support. This is non-fatal. Error: %v", err)
-		}
-	} else {
-		log.Printf("[INFO] V4: Host does not have IPv6. Skipping IPv6 filter rule.")
+	q := r.URL.Query()
+	rev := store.Revision(iface)
+	setETag(w, rev)
+	rule := store.Get(iface, q.Get("direction"))
+	if id := q.Get("id"); id != "" {
+		rule = store.ByID(id)
+	}
+	resp := map[string]interface{}{
+		"iface":    iface,
+		"revision": rev,
+		"rule":     rule,
+		"rules":    store.OfIface(iface),
 	}
+	if rule != nil {
+		resp["stats"] = ruleStats(r.Context(), rule)
+	} else if _, err := net.InterfaceByName(iface); err == nil {
+		resp["directions"] = readDirectionStats(r.Context(), iface, nil)
+	}
+	respondWithJSON(w, http.StatusOK, resp)
+}
+
+// --- Optimistic Concurrency (ETag / If-Match) ---
 
-	// 5c. "All Else" Filter (Prio 2) -> "Slow" Class (1:11)
-	if err := runTC(ctx, "filter", "add", "dev", effectiveIface, "protocol", "all", "parent", "1:", "prio", "2",
-		"u32", "match", "u32", "0", "0",
-		"flowid", "1:11"); err != nil {
-		return fmt.Errorf("V4: failed to add default 'slow' filter: %w", err)
+// setETag exposes a config revision as a strong ETag.
+func setETag(w http.ResponseWriter, rev uint64) {
+	w.Header().Set("ETag", fmt.Sprintf("\"%d\"", rev))
+}
+
+// checkIfMatch verifies that the If-Match revision (if any) is still the
+// current revision of every targeted interface. When REQUIRE_IF_MATCH=true
+// mutating calls without If-Match are rejected. Must be called with applyMu
+// held so the check and the change are atomic.
+func checkIfMatch(r *http.Request, ifaces []string) (int, error) {
+	header := strings.TrimSpace(r.Header.Get("If-Match"))
+	if header == "" {
+		if setting("REQUIRE_IF_MATCH") == "true" {
+			return http.StatusPreconditionRequired, fmt.Errorf("If-Match header is required (use the ETag returned by /config/query)")
+		}
+		return 0, nil
+	}
+	if header == "*" {
+		return 0, nil
 	}
 
-	return nil
+	want, err := strconv.ParseUint(strings.Trim(strings.TrimPrefix(header, "W/"), "\""), 10, 64)
+	if err != nil {
+		return http.StatusBadRequest, fmt.Errorf("invalid If-Match header: %q", header)
+	}
+	for _, iface := range ifaces {
+		if rev := store.Revision(iface); rev != want {
+			return http.StatusPreconditionFailed, fmt.Errorf("conflict: '%s' was changed by someone else (revision %d, you have %d). Reload and retry", iface, rev, want)
+		}
+	}
+	return 0, nil
 }
 
+// rawTimeout bounds a buffered raw command, as the request timeout bounds
+// the other routes.
+const rawTimeout = 60 * time.Second
+
 // --- Handler: /raw (V4) ---
 // (Ported, but now allows 'tc' and 'ip')
+//
+// 'json=true' runs the command with -j and returns its parsed output as
+// 'json'; 'stream=true' streams stdout and stderr as plain text while the
+// command runs (for long outputs such as 'tc -s -d qdisc show'), with the
+// exit code in the X-Exit-Code trailer. Otherwise the response holds
+// stdout, stderr and the exit code, also when the command fails. The route
+// is mounted without the request timeout: a buffered command is stopped
+// after rawTimeout, a streamed one runs until it exits or the client
+// disconnects.
 func handleTcRaw(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	q := r.URL.Query()
 	cmd := ""
 
 	if r.Method == "POST" {
@@ -438,7 +1441,7 @@ func handleTcRaw(w http.ResponseWriter, r *http.Request) {
 		}
 	}
 	if cmd == "" {
-		cmd = r.URL.Query().Get("cmd")
+		cmd = q.Get("cmd")
 	}
 	if cmd == "" {
 		respondWithError(w, "no command provided in body or 'cmd' query param", 400)
@@ -446,7 +1449,7 @@ func handleTcRaw(w http.ResponseWriter, r *http.Request) {
 	}
 
 	log.Printf("[INFO] RAW: Executing raw cmd: %v", cmd)
-	args := strings.Split(cmd, " ")
+	args := strings.Fields(cmd)
 	if len(args) == 0 {
 		respondWithError(w, "empty command", 400)
 		return
@@ -471,47 +1474,173 @@ func handleTcRaw(w http.ResponseWriter, r *http.Request) {
 		respondWithError(w, fmt.Sprintf("invalid command: %v. Only 'tc' and 'ip' are allowed", arg0), 403)
 		return
 	}
+	cmdArgs := args[1:]
+	jsonMode := q.Get("json") == "true"
+	if jsonMode && !slices.Contains(cmdArgs, "-j") && !slices.Contains(cmdArgs, "-json") {
+		cmdArgs = append([]string{"-j"}, cmdArgs...)
+	}
+
+	// No batch files, 'ip netns exec' or 'tc exec': only tc/ip themselves
+	if err := rawArgsAllowed(safeCmd, cmdArgs); err != nil {
+		respondWithError(w, err.Error(), 403)
+		return
+	}
 
 	// 3. Use the "clean" 'safeCmd' variable in the exec.
 	// The scanner will now see the command is a hard-coded value,
-	// and 'args[1:]' are safely treated as arguments, not commands.
-	if b, err := exec.CommandContext(ctx, safeCmd, args[1:]...).Output(); err != nil {
-		respondWithError(w, fmt.Sprintf("exec %v: %v", cmd, err), 500)
+	// and 'cmdArgs' are safely treated as arguments, not commands.
+	if q.Get("stream") == "true" {
+		streamRaw(w, r, safeCmd, cmdArgs)
+		return
+	}
+	ctx, cancel := context.WithTimeout(ctx, rawTimeout)
+	defer cancel()
+	var stdout, stderr bytes.Buffer
+	c := command(ctx, safeCmd, cmdArgs...)
+	c.Stdout, c.Stderr = &stdout, &stderr
+	done := traceCommand(ctx, safeCmd, cmdArgs)
+	err := c.Run()
+	done(err)
+
+	response := map[string]interface{}{"status": "ok", "output": stdout.String(), "exitCode": exitCode(err)}
+	if stderr.Len() > 0 {
+		response["stderr"] = stderr.String()
+	}
+	if jsonMode && json.Valid(stdout.Bytes()) {
+		response["json"] = json.RawMessage(bytes.TrimSpace(stdout.Bytes()))
+	}
+	if err != nil {
+		message := fmt.Sprintf("exec %v: %v", cmd, err)
+		if s := strings.TrimSpace(stderr.String()); s != "" {
+			message += ": " + s
+		}
+		log.Printf("[ERROR] API Error: %s", message)
+		response["status"], response["code"], response["message"] = "error", 500, message
+		respondWithJSON(w, http.StatusInternalServerError, response)
 		return
-	} else if len(b) == 0 {
-		log.Printf("[INFO] RAW: exec %v ok (no output)", cmd)
-		respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok", "output": ""})
-	} else {
-		log.Printf("[INFO] RAW: exec %v ok (with output)", cmd)
-		respondWithJSON(w, http.StatusOK, map[string]string{"status": "ok", "output": string(b)})
 	}
+	log.Printf("[INFO] RAW: exec %v ok (%d bytes of output)", cmd, stdout.Len())
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// streamRaw runs a raw command and streams its stdout and stderr (in the
+// order they are written) as chunked plain text, then reports the exit
+// code in the X-Exit-Code trailer and, when it failed, a last line.
+func streamRaw(w http.ResponseWriter, r *http.Request, name string, args []string) {
+	ctx := r.Context()
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, "streaming not supported", 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("Trailer", "X-Exit-Code")
+	w.WriteHeader(http.StatusOK)
+
+	out := &flushWriter{w: w, flusher: flusher}
+	c := command(ctx, name, args...)
+	c.Stdout, c.Stderr = out, out // (the same writer: one pipe, in order)
+	done := traceCommand(ctx, name, args)
+	err := c.Run()
+	done(err)
+	if err != nil {
+		fmt.Fprintf(out, "\n[%s: %v]\n", name, err)
+	}
+	w.Header().Set("X-Exit-Code", strconv.Itoa(exitCode(err)))
+}
+
+// flushWriter flushes every write to the client.
+type flushWriter struct {
+	w       io.Writer
+	flusher http.Flusher
+}
+
+func (f *flushWriter) Write(p []byte) (int, error) {
+	n, err := f.w.Write(p)
+	f.flusher.Flush()
+	return n, err
+}
+
+// exitCode returns the exit code of a command that returned err: 0 on
+// success, -1 when it did not run (or was killed).
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		return exitErr.ExitCode()
+	}
+	return -1
 }
 
 // --- Cleanup Logic (V4) ---
 
-// cleanupSingleInterface cleans a single interface (and ifb0 if incoming)
+// cleanupSingleInterface cleans both directions of a single interface (and
+// ifb0).
 func cleanupSingleInterface(ctx context.Context, iface string) error {
-	// Clean main interface (root and ingress)
-	if err := runTC(ctx, "qdisc", "del", "dev", iface, "root"); err != nil {
-		log.Printf("[DEBUG] V4 Cleanup: Failed to clean root of %s (likely already clean): %v", iface, err)
+	if err := cleanupDirection(ctx, iface, "outgoing"); err != nil {
+		return err
+	}
+	return cleanupDirection(ctx, iface, "incoming")
+}
+
+// cleanupDirection removes the tree of one direction of iface: its root
+// (outgoing), or its ingress hook and the tree of ifb0 (incoming). The rule
+// of the other direction stays in place.
+func cleanupDirection(ctx context.Context, iface, direction string) error {
+	// Only what carries the ownership markers is removed: a root of the
+	// host (or an mq/mqprio root, of which only the per-queue children are
+	// ours) and the host's ingress filters stay in place.
+	if direction == "outgoing" {
+		if kind, handle := rootQdisc(ctx, iface); isMultiQueueRoot(kind) {
+			cleanupMQChildren(ctx, iface, handle)
+		} else {
+			removeOwnAttachments(ctx, iface)
+		}
+		return nil
 	}
-	if err := runTC(ctx, "qdisc", "del", "dev", iface, "ingress"); err != nil {
-		log.Printf("[DEBUG] V4 Cleanup: Failed to clean ingress of %s (likely already clean): %v", iface, err)
+	if err := cleanupOwnIngress(ctx, iface); err != nil {
+		log.Printf("[INFO] V4 Cleanup: Failed to clean ingress of %s (likely already clean): %v", iface, err)
 	}
 
 	// If ifb was used, clean it too
 	if hasIFB {
-		if err := runTC(ctx, "qdisc", "del", "dev", "ifb0", "root"); err != nil {
-			log.Printf("[DEBUG] V4 Cleanup: Failed to clean root of ifb0 (likely already clean): %v", err)
+		if _, handle := rootQdisc(ctx, "ifb0"); ownsHandle(handle) {
+			if err := runTC(ctx, "qdisc", "del", "dev", "ifb0", "root"); err != nil {
+				log.Printf("[INFO] V4 Cleanup: Failed to clean root of ifb0 (likely already clean): %v", err)
+			}
+		}
+	}
+	return nil
+}
+
+// cleanupWorkers and cleanupTimeout bound the shutdown cleanup: interfaces
+// are cleaned in parallel by up to CLEANUP_WORKERS workers (default 8), each
+// for at most CLEANUP_TIMEOUT (default 10s).
+var (
+	cleanupWorkers = 8
+	cleanupTimeout = 10 * time.Second
+)
+
+// configureCleanup reads CLEANUP_WORKERS and CLEANUP_TIMEOUT at startup.
+func configureCleanup() error {
+	if v := os.Getenv("CLEANUP_WORKERS"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			return fmt.Errorf("CLEANUP_WORKERS: %q is not a positive number", v)
 		}
+		cleanupWorkers = n
 	}
+	cleanupTimeout = envDuration("CLEANUP_TIMEOUT", cleanupTimeout)
 	return nil
 }
 
-// cleanupAllInterfaces (V4) is called on graceful shutdown
-func cleanupAllInterfaces(ctx context.Context) {
+// cleanupAllInterfaces (V4) is called on graceful shutdown. It returns the
+// interfaces that could not be cleaned, with the reason.
+func cleanupAllInterfaces(ctx context.Context) (failures []string) {
 	if isDarwin {
-		return // No TC on Darwin
+		return nil // No TC on Darwin
 	}
 
 	log.Println("[INFO] Cleaning up all TC rules from all interfaces...")
@@ -519,13 +1648,239 @@ func cleanupAllInterfaces(ctx context.Context) {
 	ifaces, err := queryIPNetInterfaces(nil)
 	if err != nil {
 		log.Printf("[ERROR] Cleanup failed: Could not query interfaces: %v", err)
+		return []string{fmt.Sprintf("query interfaces: %v", err)}
+	}
+	var names []string
+	for _, iface := range ifaces {
+		names = append(names, iface.Name)
+	}
+	names = append(names, loopbackRuleIfaces(ctx)...)
+	if len(names) == 0 {
+		return nil
+	}
+
+	var (
+		mu   sync.Mutex
+		wg   sync.WaitGroup
+		jobs = make(chan string)
+	)
+	for i := 0; i < min(cleanupWorkers, len(names)); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for iface := range jobs {
+				if err := cleanupInterfaceWithTimeout(ctx, iface); err != nil {
+					mu.Lock()
+					failures = append(failures, fmt.Sprintf("%s: %v", iface, err))
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	for _, name := range names {
+		jobs <- name
+	}
+	close(jobs)
+	wg.Wait()
+
+	sort.Strings(failures)
+	if len(failures) > 0 {
+		log.Printf("[ERROR] Cleanup finished with errors on %d of %d interface(s): %s", len(failures), len(names), strings.Join(failures, "; "))
+	}
+	return failures
+}
+
+// cleanupInterfaceWithTimeout cleans iface within cleanupTimeout, unless it
+// has no qdiscs installed, and checks that none are left.
+func cleanupInterfaceWithTimeout(ctx context.Context, iface string) error {
+	ctx, cancel := context.WithTimeout(ctx, cleanupTimeout)
+	defer cancel()
+	if !hasOwnQdiscs(ctx, iface) {
+		log.Printf("[INFO] Skipping interface without qdiscs: %s", iface)
+		return nil
+	}
+	log.Printf("[INFO] Cleaning up interface: %s", iface)
+	if err := cleanupSingleInterface(ctx, iface); err != nil {
+		return err
+	}
+	if ctx.Err() != nil {
+		return fmt.Errorf("timed out after %v", cleanupTimeout)
+	}
+	if kind, _ := rootQdisc(ctx, iface); !isMultiQueueRoot(kind) && hasOwnQdiscs(ctx, iface) {
+		return fmt.Errorf("qdiscs are still installed")
+	}
+	return nil
+}
+
+// --- Handler: /reset-all ---
+
+// handleTcResetAll is the "panic button": it stops scheduled jobs, resets
+// every interface, forgets all desired state and removes the ifb devices
+// and virtual interfaces, ignoring If-Match.
+func handleTcResetAll(w http.ResponseWriter, r *http.Request) {
+	if isDarwin {
+		log.Println("[INFO] V4: Darwin: Ignoring reset-all")
+		respondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	log.Println("[WARN] V4: RESET-ALL requested. Removing every rule from the host...")
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	ifaces, failures := resetAllInterfaces(r.Context())
+	if len(failures) > 0 {
+		respondWithError(w, fmt.Sprintf("reset-all finished with errors: %s", strings.Join(failures, "; ")), 500)
 		return
 	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"ifaces": ifaces})
+}
+
+// resetAllInterfaces stops all scheduled jobs, mirrors, mangles, reset
+// injections and L7 faults, removes the TTL rules and NAT behavior, resets
+// every non-loopback interface (with or without IPs), clears the desired
+// state and deletes the ifb devices (see ownsIFB) and the virtual interfaces
+// (alias vifAlias) the tool owns; the host's own devices are left alone.
+// It returns the interfaces that were reset and any failures. Must be
+// called with applyMu held.
+func resetAllInterfaces(ctx context.Context) (reset []string, failures []string) {
+	sched.StopAll()
+	removeAllMirrors(ctx)
+	removeAllMangles()
+	removeAllResets()
+	removeAllTTLRules(ctx)
+	resetNATBehavior(ctx)
+	clearL7Upstreams()
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, []string{fmt.Sprintf("query interfaces: %v", err)}
+	}
+
+	// (before the interfaces and the desired state are cleared: they tell
+	// which ifb devices are ours)
+	var ifbs []string
+	for _, iface := range ifaces {
+		if strings.HasPrefix(iface.Name, "ifb") && ownsIFB(ctx, iface.Name) {
+			ifbs = append(ifbs, iface.Name)
+		}
+	}
+	loopbacks := loopbackRuleIfaces(ctx)
+	for _, iface := range ifaces {
+		if (iface.Flags&net.FlagLoopback) != 0 && !slices.Contains(loopbacks, iface.Name) {
+			continue
+		}
+		if strings.HasPrefix(iface.Name, "ifb") {
+			continue
+		}
+		if !ifaceAllowed(iface.Name) {
+			continue
+		}
+		if err := cleanupSingleInterface(ctx, iface.Name); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", iface.Name, err))
+			continue
+		}
+		reset = append(reset, iface.Name)
+	}
+
+	for _, rule := range store.List() {
+		store.Delete(rule.Options.Iface, Actor{Source: "reset-all"})
+	}
+
+	for _, ifb := range ifbs {
+		if err := runIP(ctx, "link", "del", ifb); err != nil {
+			failures = append(failures, fmt.Sprintf("%s: %v", ifb, err))
+		}
+	}
+	if vifs, err := listVirtualInterfaces(ctx); err == nil {
+		for _, v := range vifs {
+			if err := runIP(ctx, "link", "del", v.Name); err != nil {
+				failures = append(failures, fmt.Sprintf("%s: %v", v.Name, err))
+			}
+		}
+	}
+	return reset, failures
+}
+
+// --- Interface Targeting ---
+
+// resolveTargetInterfaces expands the 'iface' (exact name or glob such as
+// "veth*") and 'ifaceRegex' parameters into a list of host interfaces.
+// An exact name is returned as-is so existing clients behave as before.
+func resolveTargetInterfaces(pattern, regex string) ([]string, error) {
+	if regex == "" && !strings.ContainsAny(pattern, "*?[") {
+		if pattern == "" {
+			return nil, msg("rule.ifaceRequired")
+		}
+		if !ifaceAllowed(pattern) {
+			return nil, msg("rule.ifaceExcluded", pattern)
+		}
+		return []string{pattern}, nil
+	}
 
+	var match func(name string) bool
+	if regex != "" {
+		re, err := regexp.Compile(regex)
+		if err != nil {
+			return nil, fmt.Errorf("V4: invalid 'ifaceRegex': %w", err)
+		}
+		match = re.MatchString
+	} else {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("V4: invalid 'iface' pattern: %w", err)
+		}
+		match = func(name string) bool {
+			ok, _ := path.Match(pattern, name)
+			return ok
+		}
+	}
+
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, fmt.Errorf("query interfaces: %w", err)
+	}
+	var targets []string
 	for _, iface := range ifaces {
-		log.Printf("[INFO] Cleaning up interface: %s", iface.Name)
-		cleanupSingleInterface(ctx, iface.Name)
+		// Never blanket-apply to loopback or to our own ifb plumbing.
+		if (iface.Flags&net.FlagLoopback) != 0 || strings.HasPrefix(iface.Name, "ifb") {
+			continue
+		}
+		if match(iface.Name) && ifaceAllowed(iface.Name) {
+			targets = append(targets, iface.Name)
+		}
+	}
+	if len(targets) == 0 {
+		return nil, msg("rule.noIfaceMatched")
 	}
+	return targets, nil
+}
+
+// targetsResponse reports the matched interfaces when a pattern was used.
+// Plain single-interface calls keep the original null response.
+func targetsResponse(q url.Values, targets []string) interface{} {
+	if q.Get("ifaceRegex") == "" && !strings.ContainsAny(q.Get("iface"), "*?[") {
+		return nil
+	}
+	return map[string]interface{}{"ifaces": targets}
+}
+
+// ipv6Only reports whether the host has IPv6 but no IPv4 address besides
+// loopback and link-local (169.254.0.0/16) ones.
+func ipv6Only() bool {
+	if !hasIPv6 {
+		return false
+	}
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return false
+	}
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil &&
+			!ipnet.IP.IsLoopback() && !ipnet.IP.IsLinkLocalUnicast() {
+			return false
+		}
+	}
+	return true
 }
 
 // queryIPNetInterfaces (Helper, ported)
@@ -547,6 +1902,9 @@ func queryIPNetInterfaces(filter func(iface *net.Interface, addr net.Addr) bool)
 		if (iface.Flags & net.FlagLoopback) != 0 {
 			continue
 		}
+		if !ifaceAllowed(iface.Name) {
+			continue
+		}
 		addrs, err := iface.Addrs()
 		if err != nil {
 			return nil, fmt.Errorf("query addrs of %v: %w", iface.Name, err)
@@ -563,8 +1921,8 @@ func queryIPNetInterfaces(filter func(iface *net.Interface, addr net.Addr) bool)
 			if r0, ok := addr.(*net.IPNet); ok {
 				if ip := r0.IP.To4(); ip != nil {
 					ti.IPv4 = TcIP(ip)
-				} else if ip := r0.IP.To16(); ip != nil {
-					ti.IPv6 = TcIP(ip)
+				} else if ip := r0.IP.To16(); ip != nil && (ti.IPv6 == nil || net.IP(ti.IPv6).IsLinkLocalUnicast()) {
+					ti.IPv6 = TcIP(ip) // A global address wins over the link-local one
 				}
 			}
 		}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"math"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// tcArgPattern is what an argument built from validated options may look
+// like: one word tc cannot take for an option or split.
+var tcArgPattern = regexp.MustCompile(`^[A-Za-z0-9_.%][A-Za-z0-9_.%-]*$`)
+
+// checkTCArgs fails t for an argument tc could misread.
+func checkTCArgs(t *testing.T, what string, args []string) {
+	t.Helper()
+	for _, arg := range args {
+		if !tcArgPattern.MatchString(arg) {
+			t.Fatalf("%s: unsafe tc argument %q in %q", what, arg, args)
+		}
+	}
+}
+
+// checkNetemValues fails t for a netem value (ms, %) that is not a finite
+// number in its range.
+func checkNetemValues(t *testing.T, args []string) {
+	t.Helper()
+	for _, arg := range args {
+		var v string
+		var limit float64
+		switch {
+		case strings.HasSuffix(arg, "ms"):
+			v, limit = strings.TrimSuffix(arg, "ms"), math.MaxFloat64
+		case strings.HasSuffix(arg, "%"):
+			v, limit = strings.TrimSuffix(arg, "%"), 100
+		default:
+			continue
+		}
+		f, err := strconv.ParseFloat(v, 64)
+		if err != nil || math.IsNaN(f) || math.IsInf(f, 0) || f < 0 || f > limit {
+			t.Fatalf("netem value %q out of range in %q", arg, args)
+		}
+	}
+}
+
+func FuzzParseV4Options(f *testing.F) {
+	for _, seed := range []string{
+		"direction=outgoing&delay=100&jitter=10&delayCorrelation=25&distribution=normal",
+		"direction=outgoing&lossModel=random&loss=5&lossCorrelation=25",
+		"direction=outgoing&lossModel=state&lossStateP13=1&lossStateP31=2&lossStateP32=3&lossStateP23=4&lossStateP14=5",
+		"direction=outgoing&lossModel=gemodel&lossGemodelP=1&lossGemodelR=50&lossGemodel1h=100&lossGemodel1k=0",
+		"direction=incoming&delay=10&reorder=25&reorderCorrelation=50&reorderGap=5",
+		"direction=outgoing&corrupt=0.1&corruptCorrelation=1&duplicate=1&duplicateCorrelation=2",
+		"direction=outgoing&rate=10mbit&ceil=20mbit&burst=15k&cburst=1mb",
+		"direction=outgoing&delay=NaN&loss=Inf&rate=0x10",
+		"direction=outgoing&delay=1e3&distribution=../../etc/passwd",
+		"direction=outgoing&delay=%2010&rate=%201mbit",
+		"direction=outgoing&rate=10mbit&flowSamplePercent=25&tree=htb",
+		"direction=outgoing&delay=5&tree=netem",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, query string) {
+		q, err := url.ParseQuery(query)
+		if err != nil {
+			return
+		}
+		opts := parseV4Options(q)
+		opts.Iface = "eth0"
+		opts.treeShape()
+		if opts.validateNetem() == nil {
+			args, _ := opts.netemParams()
+			checkTCArgs(t, "netem", args)
+			checkNetemValues(t, args)
+		}
+		if params, err := opts.htbClassParams(); err == nil {
+			checkTCArgs(t, "htb", params)
+		}
+		if _, err := opts.flowSampleBuckets(); err == nil && opts.FlowSamplePercent != "" {
+			if f, ok := parseTCNumber(opts.FlowSamplePercent); !ok || f <= 0 || f > 100 {
+				t.Fatalf("flowSamplePercent %q accepted", opts.FlowSamplePercent)
+			}
+		}
+	})
+}
+
+func FuzzHTBClassParams(f *testing.F) {
+	f.Add("10mbit", "", "", "")
+	f.Add("1gbit", "2gbit", "15k", "1mb")
+	f.Add("1.5mbit", "1mbit", "64kbit", "")
+	f.Add("8000", "", "1500", "1500b")
+	f.Add(" 1mbit", "NaN", "-1", "1e3")
+	f.Fuzz(func(t *testing.T, rate, ceil, burst, cburst string) {
+		opts := &V4NetworkOptions{Iface: "eth0", Rate: rate, Ceil: ceil, Burst: burst, Cburst: cburst}
+		params, err := opts.htbClassParams()
+		if err != nil {
+			return
+		}
+		checkTCArgs(t, "htb", params)
+		if rate != "" {
+			if bits, err := parseTCRate(rate); err != nil || math.IsNaN(bits) || math.IsInf(bits, 0) {
+				t.Fatalf("rate %q accepted as %v", rate, bits)
+			}
+		}
+	})
+}
+
+func FuzzParseTCRate(f *testing.F) {
+	for _, seed := range []string{"10mbit", "1Gbit", "100kbps", "8000", "1.5mbit", ".5kbit", "NaN", "Inf", "1e9", "0x10", " 1mbit", "-1mbit"} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		bits, err := parseTCRate(s)
+		if err != nil {
+			return
+		}
+		if math.IsNaN(bits) || math.IsInf(bits, 0) || bits < 0 {
+			t.Fatalf("parseTCRate(%q) = %v", s, bits)
+		}
+		if strings.TrimSpace(s) != s {
+			t.Fatalf("parseTCRate(%q): surrounding spaces accepted", s)
+		}
+	})
+}
+
+func TestLossCorrelationWithoutModel(t *testing.T) {
+	// A V2 query: no lossModel
+	opts := parseV4Options(url.Values{"direction": {"outgoing"}, "loss": {"5"}, "lossCorrelation": {"25"}})
+	if err := opts.validateNetem(); err != nil {
+		t.Fatalf("validateNetem: %v", err)
+	}
+	args, _ := opts.netemParams()
+	if !strings.Contains(strings.Join(args, " "), "loss random 5% 25%") {
+		t.Errorf("netem %q, want loss random 5%% 25%%", args)
+	}
+}
+
+func TestV2LossWithoutModel(t *testing.T) {
+	// What V2 clients send: 'loss', and no 'lossModel'
+	q, _ := url.ParseQuery("iface=eth0&direction=outgoing&delay=100&loss=1")
+	opts := parseV4Options(q)
+	if opts.LossModel != "random" {
+		t.Errorf("lossModel = %q, want random", opts.LossModel)
+	}
+	if err := opts.validateNetem(); err != nil {
+		t.Fatalf("validateNetem: %v", err)
+	}
+	args, _ := opts.netemParams()
+	if !strings.Contains(strings.Join(args, " "), "loss random 1%") {
+		t.Errorf("netem %q, want loss random 1%%", args)
+	}
+}
+
+func TestFlowSampleBuckets(t *testing.T) {
+	for percent, want := range map[string]int{"": 0, "0.1": 1, "25": 64, "100": flowHashBuckets} {
+		v := &V4NetworkOptions{FlowSamplePercent: percent}
+		if got, err := v.flowSampleBuckets(); err != nil || got != want {
+			t.Errorf("flowSamplePercent %q: %d buckets (%v), want %d", percent, got, err, want)
+		}
+	}
+	// Without selectors the sample is impaired, with them the rest is not
+	v := &V4NetworkOptions{FlowSamplePercent: "25"}
+	if got := strings.Join(v.sampleFilter("add", "eth0", 64), " "); !strings.Contains(got, "prio 2 handle 1 basic match meta(rxhash mask 0xff lt 64) flowid "+shapedClass) {
+		t.Errorf("sampleFilter = %q", got)
+	}
+	v.DstPort = "443"
+	if got := strings.Join(v.sampleFilter("replace", "eth0", 64), " "); !strings.Contains(got, "prio 4 handle 1 basic match not meta(rxhash mask 0xff lt 64) flowid "+unlimitedClass) {
+		t.Errorf("sampleFilter with selectors = %q", got)
+	}
+}
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Mobile Handovers ---
+
+// HandoverCell is one of the networks a handover test moves between (e.g.
+// "4g" and "5g"). Without options the interface runs unimpaired on it.
+type HandoverCell struct {
+	Name    string            `json:"name"`
+	Options *V4NetworkOptions `json:"options,omitempty"`
+}
+
+// MobileHandover moves an interface between cells A and B every Every,
+// with an Outage (100% loss) at each switch, as a phone does between cells
+// or between 4G and 5G. Cycles limits the A->B->A round trips (0 = until
+// stopped).
+type MobileHandover struct {
+	Iface     string        `json:"iface"`
+	Direction string        `json:"direction"`
+	A         *HandoverCell `json:"a"`
+	B         *HandoverCell `json:"b"`
+	Every     string        `json:"every"`            // Go duration, time on each cell
+	Outage    string        `json:"outage,omitempty"` // Go duration (default 300ms)
+	Cycles    int           `json:"cycles,omitempty"`
+
+	Cell      string `json:"cell"` // the current cell, or "" during an outage
+	Handovers int    `json:"handovers"`
+
+	every, outage time.Duration
+}
+
+// mobileHandovers holds the handover test of each interface (guarded by
+// sched).
+var mobileHandovers = map[string]*MobileHandover{}
+
+// validate checks the test and parses the durations.
+func (h *MobileHandover) validate() error {
+	if h.Iface == "" || h.Direction == "" {
+		return fmt.Errorf("handover: 'iface' and 'direction' are required")
+	}
+	if h.Cycles < 0 {
+		return fmt.Errorf("handover: 'cycles' must be >= 0")
+	}
+	for _, c := range []struct {
+		side string
+		cell *HandoverCell
+	}{{"a", h.A}, {"b", h.B}} {
+		if c.cell == nil || c.cell.Name == "" {
+			return fmt.Errorf("handover: '%s.name' is required", c.side)
+		}
+		if opts := c.cell.Options; opts != nil {
+			opts.Iface, opts.Direction = h.Iface, h.Direction
+			if err := opts.validateNetem(); err != nil {
+				return err
+			}
+		}
+	}
+	if h.A.Name == h.B.Name {
+		return fmt.Errorf("handover: the cells need different names")
+	}
+	if h.Outage == "" {
+		h.Outage = "300ms"
+	}
+	var err error
+	if h.outage, err = time.ParseDuration(h.Outage); err != nil || h.outage <= 0 {
+		return fmt.Errorf("handover: invalid 'outage' %q", h.Outage)
+	}
+	if h.every, err = time.ParseDuration(h.Every); err != nil || h.every < time.Second || h.every <= h.outage {
+		return fmt.Errorf("handover: invalid 'every' %q (at least 1s, and above 'outage')", h.Every)
+	}
+	return nil
+}
+
+// outageOptions returns the rule of the outage before moving to cell: its
+// rule (or none) with 100% loss.
+func (h *MobileHandover) outageOptions(cell *HandoverCell) *V4NetworkOptions {
+	opts := V4NetworkOptions{Iface: h.Iface, Direction: h.Direction}
+	if cell.Options != nil {
+		opts = *cell.Options
+	}
+	opts.LossModel, opts.Loss = "random", "100"
+	return &opts
+}
+
+// applyStep puts opts (nil: no rule) in place on iface in direction for a
+// job that steps through rules, and returns the rule now in place. The rule
+// of the other direction is left alone.
+func applyStep(ctx context.Context, iface, direction string, opts *V4NetworkOptions, by Actor, prev *V4NetworkOptions) (*V4NetworkOptions, error) {
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if ctx.Err() != nil { // Stopped (e.g. reset) while waiting for the lock
+		return prev, ctx.Err()
+	}
+	if opts == nil {
+		if err := cleanupDirection(ctx, iface, direction); err != nil {
+			return prev, err
+		}
+		if rule := store.Get(iface, direction); rule != nil {
+			store.DeleteByID(rule.ID, by)
+		}
+		return nil, nil
+	}
+	o := *opts
+	if err := o.Adjust(ctx, prev); err != nil {
+		return prev, err
+	}
+	store.Set(&o, by)
+	return &o, nil
+}
+
+// wait sleeps for d, and reports false when the test was stopped.
+func wait(ctx context.Context, d time.Duration) bool {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return false
+	case <-timer.C:
+		return true
+	}
+}
+
+// run starts on cell A, then hands over to the other cell every Every,
+// through an outage.
+func (h *MobileHandover) run(ctx context.Context) {
+	var prev *V4NetworkOptions
+	var err error
+	log.Printf("[INFO] HANDOVER: %s: starting on %q, handover every %v (%v outage)", h.Iface, h.A.Name, h.every, h.outage)
+	if prev, err = applyStep(ctx, h.Iface, h.Direction, h.A.Options, Actor{Source: "handover", User: h.A.Name}, prev); err != nil && ctx.Err() == nil {
+		log.Printf("[ERROR] HANDOVER: %s: failed to apply cell %q: %v", h.Iface, h.A.Name, err)
+	}
+	sched.mu.Lock()
+	h.Cell = h.A.Name
+	sched.mu.Unlock()
+
+	cells := []*HandoverCell{h.B, h.A}
+	for i := 0; h.Cycles == 0 || i < 2*h.Cycles; i++ {
+		if !wait(ctx, h.every-h.outage) {
+			return
+		}
+		to := cells[i%2]
+		if prev, err = applyStep(ctx, h.Iface, h.Direction, h.outageOptions(to), Actor{Source: "handover", User: "outage"}, prev); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("[ERROR] HANDOVER: %s: failed to start the outage: %v", h.Iface, err)
+		}
+		sched.mu.Lock()
+		h.Cell = ""
+		h.Handovers++
+		sched.mu.Unlock()
+		if !wait(ctx, h.outage) {
+			return
+		}
+		if prev, err = applyStep(ctx, h.Iface, h.Direction, to.Options, Actor{Source: "handover", User: to.Name}, prev); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("[ERROR] HANDOVER: %s: failed to apply cell %q: %v", h.Iface, to.Name, err)
+		}
+		sched.mu.Lock()
+		h.Cell = to.Name
+		sched.mu.Unlock()
+	}
+	log.Printf("[INFO] HANDOVER: %s: finished %d cycle(s)", h.Iface, h.Cycles)
+}
+
+// --- Handlers: /handover ---
+
+// handleHandoverStart starts (or replaces) the handover test of an
+// interface.
+func handleHandoverStart(w http.ResponseWriter, r *http.Request) {
+	h := &MobileHandover{}
+	if err := json.NewDecoder(r.Body).Decode(h); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid handover JSON: %v", err), 400)
+		return
+	}
+	if err := h.validate(); err != nil {
+		respondWithLocalizedError(w, r, 400, err)
+		return
+	}
+	sched.StopIface(h.Iface)
+	sched.mu.Lock()
+	mobileHandovers[h.Iface] = h
+	snapshot := *h
+	sched.mu.Unlock()
+	sched.Start("handover:"+h.Iface, "handover", h.Iface, h.run)
+	respondWithJSON(w, http.StatusOK, &snapshot)
+}
+
+// handleHandoverList returns the handover tests (running or finished) by
+// interface.
+func handleHandoverList(w http.ResponseWriter, r *http.Request) {
+	type handoverStatus struct {
+		MobileHandover
+		Running bool `json:"running"`
+	}
+	list := map[string]handoverStatus{}
+	sched.mu.Lock()
+	for iface, h := range mobileHandovers {
+		_, running := sched.jobs["handover:"+iface]
+		list[iface] = handoverStatus{MobileHandover: *h, Running: running}
+	}
+	sched.mu.Unlock()
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleHandoverStop stops the handover test of an interface. Stopped
+// during an outage, it moves on to the next cell rather than keep the
+// outage.
+func handleHandoverStop(w http.ResponseWriter, r *http.Request) {
+	iface := chi.URLParam(r, "iface")
+	if !sched.Stop("handover:" + iface) {
+		respondWithError(w, fmt.Sprintf("no handover test running on '%s'", iface), 404)
+		return
+	}
+	sched.mu.Lock()
+	h := mobileHandovers[iface]
+	inOutage := h.Cell == ""
+	to := h.B
+	if h.Handovers%2 == 0 {
+		to = h.A
+	}
+	if inOutage {
+		h.Cell = to.Name
+	}
+	sched.mu.Unlock()
+	if inOutage {
+		var prev *V4NetworkOptions
+		if rule := store.Get(iface, h.Direction); rule != nil {
+			prev = rule.Options
+		}
+		if _, err := applyStep(r.Context(), iface, h.Direction, to.Options, Actor{Source: "handover", User: to.Name}, prev); err != nil {
+			respondWithError(w, fmt.Sprintf("handover: failed to end the outage on %s: %v", iface, err), 500)
+			return
+		}
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- HTTP/3 (QUIC) Speedtest ---
+
+// QUIC recovers from loss on its own (per stream, without head-of-line
+// blocking, with its own congestion control in user space), so a rule can
+// hurt an HTTP/3 transfer quite differently from a TCP one. The http3
+// method downloads the same URL over HTTP/3 and over HTTPS on TCP, with
+// curl (the Go standard library has no QUIC), and reports both.
+
+// ProtocolRun is the download of the URL over one protocol.
+type ProtocolRun struct {
+	Protocol      string  `json:"protocol"`              // "h3", or "tcp" (HTTP/2 or HTTP/1.1 over TLS)
+	HTTPVersion   string  `json:"httpVersion,omitempty"` // as negotiated
+	HandshakeMs   float64 `json:"handshakeMs"`           // QUIC, or TCP and TLS, until the connection was usable
+	DownloadMbps  float64 `json:"downloadMbps"`
+	DownloadBytes int64   `json:"downloadBytes"`
+	Error         string  `json:"error,omitempty"`
+}
+
+// curlBinary is the curl the http3 method runs: SPEEDTEST_CURL, else the
+// one in PATH.
+func curlBinary() string {
+	if path := os.Getenv("SPEEDTEST_CURL"); path != "" {
+		return path
+	}
+	return "curl"
+}
+
+// curlHTTP3Once caches curlHTTP3.
+var curlHTTP3Once = sync.OnceValue(func() bool {
+	// (the "Features:" line lists HTTP3 when curl was built with QUIC)
+	out, err := command(context.Background(), curlBinary(), "--version").Output()
+	return err == nil && strings.Contains(string(out), " HTTP3")
+})
+
+// curlHTTP3 reports whether curl can speak HTTP/3.
+func curlHTTP3() bool {
+	return !isDarwin && curlHTTP3Once()
+}
+
+// curlWriteOut is the -w format the download reports with.
+const curlWriteOut = "%{http_version} %{time_connect} %{time_appconnect} %{time_starttransfer} %{time_total} %{size_download}"
+
+// curlDownload downloads url over protocol for at most d and measures the
+// handshake and the throughput from the first byte on.
+func curlDownload(ctx context.Context, iface, url, protocol string, d time.Duration) *ProtocolRun {
+	run := &ProtocolRun{Protocol: protocol}
+	args := []string{"-s", "-o", "/dev/null", "--connect-timeout", "10",
+		"--max-time", strconv.FormatFloat(d.Seconds(), 'f', 0, 64), "-w", curlWriteOut}
+	if protocol == "h3" {
+		args = append(args, "--http3-only")
+	} else {
+		args = append(args, "--http2")
+	}
+	if addr := speedtestSourceAddr(iface, url); addr != "" {
+		args = append(args, "--interface", addr)
+	}
+	args = append(args, url)
+	done := traceCommand(ctx, "curl", args)
+	out, err := command(ctx, curlBinary(), args...).Output()
+	done(err)
+
+	fields := strings.Fields(string(out))
+	if len(fields) != 6 {
+		run.Error = fmt.Sprintf("curl %s: %v", protocol, err)
+		return run
+	}
+	times := make([]float64, 4)
+	for i := range times {
+		times[i], _ = strconv.ParseFloat(fields[i+1], 64)
+	}
+	connect, appConnect, firstByte, total := times[0], times[1], times[2], times[3]
+	run.DownloadBytes, _ = strconv.ParseInt(fields[5], 10, 64)
+	// curl exits with 28 when --max-time ends a download that was still going
+	if code := exitCode(err); code != 0 && (code != 28 || run.DownloadBytes == 0) {
+		run.Error = fmt.Sprintf("curl %s: exit code %d", protocol, code)
+		return run
+	}
+	run.HTTPVersion = fields[0]
+	if appConnect == 0 {
+		appConnect = connect
+	}
+	run.HandshakeMs = roundTo(appConnect*1000, 3)
+	run.DownloadMbps = mbps(run.DownloadBytes, time.Duration((total-firstByte)*float64(time.Second)))
+	return run
+}
+
+// runHTTP3Speedtest downloads url over HTTP/3, then over TCP. The result's
+// download figures are those of HTTP/3.
+func runHTTP3Speedtest(ctx context.Context, t *SpeedTest, url string, d time.Duration) {
+	for _, protocol := range []string{"h3", "tcp"} {
+		run := curlDownload(ctx, t.Iface, url, protocol, d)
+		if run.Error != "" {
+			t.Errors = append(t.Errors, run.Error)
+		}
+		t.Protocols = append(t.Protocols, run)
+	}
+	h3 := t.Protocols[0]
+	t.DownloadBytes, t.DownloadMbps = h3.DownloadBytes, h3.DownloadMbps
+}
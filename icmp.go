@@ -0,0 +1,182 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// --- ICMP Manipulation ---
+
+// icmpKind is a class of ICMP messages that a rule can drop or rate-limit,
+// independent of the rest of the traffic: its ICMPv4 type (and code, or -1
+// for all codes) and its ICMPv6 types.
+type icmpKind struct {
+	types4 []int
+	code4  int
+	types6 []int
+}
+
+// icmpKinds are the values of IcmpDrop and IcmpLimit. "frag-needed" (and
+// ICMPv6 "packet too big") is what Path MTU Discovery depends on.
+var icmpKinds = map[string]icmpKind{
+	"echo":          {types4: []int{8, 0}, code4: -1, types6: []int{128, 129}},
+	"unreachable":   {types4: []int{3}, code4: -1, types6: []int{1}},
+	"frag-needed":   {types4: []int{3}, code4: 4, types6: []int{2}},
+	"time-exceeded": {types4: []int{11}, code4: -1, types6: []int{3}},
+}
+
+// icmpFilterPrio is the priority of the ICMP filters: next to the protected
+// port filters, before the selectors and the catch-all filter.
+const icmpFilterPrio = "1"
+
+// parseICMPKinds parses a comma-separated list of ICMP kinds.
+func parseICMPKinds(param, value string) ([]string, error) {
+	var kinds []string
+	for _, kind := range strings.Split(value, ",") {
+		if kind = strings.TrimSpace(kind); kind == "" {
+			continue
+		}
+		if _, ok := icmpKinds[kind]; !ok {
+			return nil, msg("rule.invalidICMPKind", kind, param)
+		}
+		kinds = append(kinds, kind)
+	}
+	return kinds, nil
+}
+
+// hasICMP reports whether the rule drops or rate-limits ICMP.
+func (v *V4NetworkOptions) hasICMP() bool {
+	return v.IcmpDrop != "" || v.IcmpLimit != ""
+}
+
+// icmpKey identifies the ICMP options, to tell whether they changed.
+func (v *V4NetworkOptions) icmpKey() string {
+	return strings.Join([]string{v.IcmpDrop, v.IcmpLimit, v.IcmpRate}, "|")
+}
+
+// validateICMP checks the ICMP options, and rejects them on trees without
+// filters.
+func (v *V4NetworkOptions) validateICMP(shape string, policing bool) error {
+	if v.IcmpRate != "" && v.IcmpLimit == "" {
+		return msg("rule.icmpRateWithoutLimit")
+	}
+	if !v.hasICMP() {
+		return nil
+	}
+	drop, err := parseICMPKinds("icmpDrop", v.IcmpDrop)
+	if err != nil {
+		return err
+	}
+	limit, err := parseICMPKinds("icmpLimit", v.IcmpLimit)
+	if err != nil {
+		return err
+	}
+	for _, kind := range limit {
+		if slices.Contains(drop, kind) {
+			return msg("rule.icmpDropAndLimit", kind)
+		}
+	}
+	if len(limit) > 0 {
+		if v.IcmpRate == "" {
+			return msg("rule.icmpLimitNeedsRate")
+		}
+		if _, err := parseTCRate(v.IcmpRate); err != nil {
+			return msg("rule.invalidICMPRate", v.IcmpRate)
+		}
+	}
+	if len(drop) == 0 && len(limit) == 0 {
+		return nil
+	}
+	switch {
+	case policing:
+		return msg("rule.icmpIncompatible", "ingressMode=police")
+	case v.PreserveMQ == "true":
+		return msg("rule.icmpIncompatible", "preserveMq=true")
+	case shape == "netem":
+		return msg("rule.icmpIncompatible", "tree=netem")
+	}
+	return nil
+}
+
+// icmpPoliceBurst is the bucket of an ICMP rate limit: 100ms of traffic,
+// and at least one full-size packet.
+func (v *V4NetworkOptions) icmpPoliceBurst() string {
+	rate, _ := parseTCRate(v.IcmpRate)
+	return strconv.Itoa(max(int(rate/8*0.1), 1600))
+}
+
+// addICMPFilters adds the filters that drop the IcmpDrop kinds and police
+// the IcmpLimit kinds (one bucket per ICMP type) on the root qdisc of dev.
+// Conforming messages continue to the next filters, so they are shaped like
+// the rest of the traffic. The u32 matches assume an IPv4 header without
+// options (ICMP senders do not use them) and no IPv6 extension headers.
+func (v *V4NetworkOptions) addICMPFilters(ctx context.Context, dev string) error {
+	drop, _ := parseICMPKinds("icmpDrop", v.IcmpDrop)
+	limit, _ := parseICMPKinds("icmpLimit", v.IcmpLimit)
+	for _, group := range []struct {
+		kinds  []string
+		action []string
+	}{
+		{drop, []string{"action", "drop"}},
+		{limit, []string{"action", "police", "rate", v.IcmpRate, "burst", v.icmpPoliceBurst(), "conform-exceed", "drop/continue"}},
+	} {
+		for _, name := range group.kinds {
+			kind := icmpKinds[name]
+			for _, typ := range kind.types4 {
+				match := []string{"match", "u8", "0x40", "0xf0", "at", "0", "match", "ip", "protocol", "1", "0xff",
+					"match", "u8", strconv.Itoa(typ), "0xff", "at", "20"}
+				if kind.code4 >= 0 {
+					match = append(match, "match", "u8", strconv.Itoa(kind.code4), "0xff", "at", "21")
+				}
+				if err := addICMPFilter(ctx, dev, match, group.action); err != nil {
+					return fmt.Errorf("V4: failed to add the ICMP %s filter: %w", name, err)
+				}
+			}
+			if !hasIPv6 {
+				continue
+			}
+			for _, typ := range kind.types6 {
+				match := []string{"match", "u8", "0x60", "0xf0", "at", "0", "match", "ip6", "protocol", "58", "0xff",
+					"match", "u8", strconv.Itoa(typ), "0xff", "at", "40"}
+				if err := addICMPFilter(ctx, dev, match, group.action); err != nil {
+					if ipv6Only() {
+						return fmt.Errorf("V4: failed to add the ICMPv6 %s filter: %w", name, err)
+					}
+					log.Printf("[WARN] V4: Failed to add the ICMPv6 %s filter. This is non-fatal. Error: %v", name, err)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// addICMPFilter adds one ICMP filter ('protocol all', like the protected
+// port filters at the same priority).
+func addICMPFilter(ctx context.Context, dev string, match, action []string) error {
+	args := append([]string{"filter", "add", "dev", dev, "protocol", "all", "parent", rootHandle, "prio", icmpFilterPrio, "u32"}, match...)
+	return runTC(ctx, append(args, action...)...)
+}
+
+// icmpFilterName describes the ICMP message an ICMP filter matches, e.g.
+// "ICMP type 3 code 4" or "ICMPv6 type 2".
+func icmpFilterName(cmd []string) string {
+	name, typ, code := "ICMP", "", ""
+	for i := 0; i+4 < len(cmd); i++ {
+		switch {
+		case cmd[i] == "ip6" && cmd[i+1] == "protocol":
+			name = "ICMPv6"
+		case cmd[i] == "u8" && cmd[i+3] == "at" && (cmd[i+4] == "20" || cmd[i+4] == "40"):
+			typ = cmd[i+1]
+		case cmd[i] == "u8" && cmd[i+3] == "at" && cmd[i+4] == "21":
+			code = cmd[i+1]
+		}
+	}
+	if code != "" {
+		return name + " type " + typ + " code " + code
+	}
+	return name + " type " + typ
+}
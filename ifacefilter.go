@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// --- Interface Include/Exclude Lists ---
+
+// ifaceFilter holds the globs of IFACE_INCLUDE and IFACE_EXCLUDE (or of the
+// last /config/ifacefilter update). Excluded interfaces (e.g. docker0,
+// virbr0, cni*, the management NIC) are never listed, shaped or reset.
+var ifaceFilter struct {
+	sync.RWMutex
+	include []string // empty = all interfaces
+	exclude []string
+}
+
+// IfaceFilter is the JSON form of the include/exclude lists.
+type IfaceFilter struct {
+	Include []string `json:"include"`
+	Exclude []string `json:"exclude"`
+}
+
+// splitGlobs parses a comma-separated list of globs, validating each.
+func splitGlobs(name, list string) ([]string, error) {
+	globs := []string{}
+	for _, glob := range strings.Split(list, ",") {
+		if glob = strings.TrimSpace(glob); glob == "" {
+			continue
+		}
+		if _, err := path.Match(glob, ""); err != nil {
+			return nil, fmt.Errorf("invalid %s pattern '%s': %w", name, glob, err)
+		}
+		globs = append(globs, glob)
+	}
+	return globs, nil
+}
+
+// configureIfaceFilter reads IFACE_INCLUDE and IFACE_EXCLUDE (e.g.
+// "docker0,virbr0,cni*"). An invalid glob is an error, so a typo does not
+// expose the management interface.
+func configureIfaceFilter() error {
+	include, err := splitGlobs("IFACE_INCLUDE", os.Getenv("IFACE_INCLUDE"))
+	if err != nil {
+		return err
+	}
+	exclude, err := splitGlobs("IFACE_EXCLUDE", os.Getenv("IFACE_EXCLUDE"))
+	if err != nil {
+		return err
+	}
+	setIfaceFilter(include, exclude)
+	return nil
+}
+
+// setIfaceFilter replaces the lists.
+func setIfaceFilter(include, exclude []string) {
+	ifaceFilter.Lock()
+	defer ifaceFilter.Unlock()
+	ifaceFilter.include, ifaceFilter.exclude = include, exclude
+	if len(include) > 0 || len(exclude) > 0 {
+		log.Printf("[INFO] IFACE_FILTER: include=%v exclude=%v", include, exclude)
+	}
+}
+
+// currentIfaceFilter returns a copy of the lists.
+func currentIfaceFilter() IfaceFilter {
+	ifaceFilter.RLock()
+	defer ifaceFilter.RUnlock()
+	return IfaceFilter{
+		Include: append([]string{}, ifaceFilter.include...),
+		Exclude: append([]string{}, ifaceFilter.exclude...),
+	}
+}
+
+// ifaceAllowed reports whether netsim may list and touch iface: it matches
+// no exclude glob and, when there are include globs, one of them.
+func ifaceAllowed(iface string) bool {
+	ifaceFilter.RLock()
+	defer ifaceFilter.RUnlock()
+	for _, glob := range ifaceFilter.exclude {
+		if ok, _ := path.Match(glob, iface); ok {
+			return false
+		}
+	}
+	if len(ifaceFilter.include) == 0 {
+		return true
+	}
+	for _, glob := range ifaceFilter.include {
+		if ok, _ := path.Match(glob, iface); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// --- Handler: /config/ifacefilter ---
+
+// handleIfaceFilter returns the lists (GET) or replaces them until the next
+// restart (POST, an IfaceFilter body).
+func handleIfaceFilter(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPost {
+		var body IfaceFilter
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			respondWithError(w, fmt.Sprintf("invalid body: %v", err), 400)
+			return
+		}
+		include, err := splitGlobs("include", strings.Join(body.Include, ","))
+		if err != nil {
+			respondWithError(w, err.Error(), 400)
+			return
+		}
+		exclude, err := splitGlobs("exclude", strings.Join(body.Exclude, ","))
+		if err != nil {
+			respondWithError(w, err.Error(), 400)
+			return
+		}
+		setIfaceFilter(include, exclude)
+	}
+	respondWithJSON(w, http.StatusOK, currentIfaceFilter())
+}
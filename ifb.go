@@ -0,0 +1,236 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- ifb Devices ---
+
+// IFBDevice is an ifb device and the interfaces whose inbound traffic is
+// redirected to it.
+type IFBDevice struct {
+	Name    string   `json:"name"`
+	Up      bool     `json:"up"`
+	Managed bool     `json:"managed"`         // used by 'incoming' rules (ifb0)
+	Qdisc   string   `json:"qdisc,omitempty"` // kind of the root qdisc
+	Mirrors []string `json:"mirrors"`         // interfaces redirected to it
+}
+
+// ifbNamePattern restricts the devices managed here to the "ifb" names that
+// reset-all and the blanket rules recognize.
+var ifbNamePattern = regexp.MustCompile(`^ifb[A-Za-z0-9_.-]{1,12}$`)
+
+// ifbRedirectPattern finds the target of a mirred redirect in 'tc filter show'.
+var ifbRedirectPattern = regexp.MustCompile(`Redirect to device (\S+?)\)`)
+
+// ifbAlias marks the ifb devices the tool creates, as vifAlias does its
+// virtual interfaces.
+const ifbAlias = "netsim-in-a-box-ifb"
+
+// ensureIFB creates the ifb device name if needed and brings it up.
+func ensureIFB(ctx context.Context, name string) error {
+	if _, err := net.InterfaceByName(name); err != nil {
+		if err := runIP(ctx, "link", "add", name, "type", "ifb"); err != nil {
+			return fmt.Errorf("V4: failed to create '%s': %w", name, err)
+		}
+		if err := runIP(ctx, "link", "set", "dev", name, "alias", ifbAlias); err != nil {
+			return fmt.Errorf("V4: failed to mark '%s': %w", name, err)
+		}
+	}
+	if err := runIP(ctx, "link", "set", "dev", name, "up"); err != nil {
+		return fmt.Errorf("V4: failed to bring up '%s': %w", name, err)
+	}
+	return nil
+}
+
+// ownsIFB reports whether the ifb device name is the tool's, which
+// reset-all deletes: it was created by the tool (ifbAlias), carries one of
+// its qdiscs, or takes the traffic of a rule of the desired state. Any other
+// ifb device belongs to the host.
+func ownsIFB(ctx context.Context, name string) bool {
+	if alias, err := os.ReadFile(filepath.Join("/sys/class/net", name, "ifalias")); err == nil && strings.TrimSpace(string(alias)) == ifbAlias {
+		return true
+	}
+	for _, rule := range store.List() {
+		if rule.Options.effectiveIface() == name {
+			return true
+		}
+	}
+	out, err := runTCOutput(ctx, "qdisc", "show", "dev", name)
+	return err == nil && showsOwnQdisc(out)
+}
+
+// listIFBDevices returns the ifb devices of the host, with the interfaces
+// whose ingress filters redirect to each of them.
+func listIFBDevices(ctx context.Context) ([]*IFBDevice, error) {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil, err
+	}
+	devices := map[string]*IFBDevice{}
+	for _, iface := range ifaces {
+		if strings.HasPrefix(iface.Name, "ifb") {
+			devices[iface.Name] = &IFBDevice{Name: iface.Name, Up: iface.Flags&net.FlagUp != 0, Managed: iface.Name == "ifb0", Mirrors: []string{}}
+		}
+	}
+	for _, iface := range ifaces {
+		if len(devices) == 0 || strings.HasPrefix(iface.Name, "ifb") || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		out, err := runTCOutput(ctx, "filter", "show", "dev", iface.Name, "ingress")
+		if err != nil {
+			continue // No ingress hook on this interface
+		}
+		seen := map[string]bool{}
+		for _, m := range ifbRedirectPattern.FindAllStringSubmatch(out, -1) {
+			if d, ok := devices[m[1]]; ok && !seen[m[1]] {
+				d.Mirrors = append(d.Mirrors, iface.Name)
+				seen[m[1]] = true
+			}
+		}
+	}
+	list := make([]*IFBDevice, 0, len(devices))
+	for _, d := range devices {
+		if out, err := runTCOutput(ctx, "qdisc", "show", "dev", d.Name, "root"); err == nil {
+			if fields := strings.Fields(out); len(fields) > 1 && fields[0] == "qdisc" && fields[1] != "noqueue" {
+				d.Qdisc = fields[1]
+			}
+		}
+		list = append(list, d)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// findIFBDevice returns the ifb device name, or nil.
+func findIFBDevice(ctx context.Context, name string) (*IFBDevice, error) {
+	list, err := listIFBDevices(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, d := range list {
+		if d.Name == name {
+			return d, nil
+		}
+	}
+	return nil, nil
+}
+
+// --- Handlers: /ifb ---
+
+// handleIFBList returns the ifb devices and the interfaces they mirror.
+func handleIFBList(w http.ResponseWriter, r *http.Request) {
+	if isDarwin {
+		respondWithJSON(w, http.StatusOK, []*IFBDevice{})
+		return
+	}
+	list, err := listIFBDevices(r.Context())
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("ifb: failed to list devices: %v", err), 500)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleIFBGet returns one ifb device.
+func handleIFBGet(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	d, err := findIFBDevice(r.Context(), name)
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("ifb: failed to list devices: %v", err), 500)
+		return
+	}
+	if d == nil {
+		respondWithError(w, fmt.Sprintf("ifb: no device '%s'", name), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, d)
+}
+
+// handleIFBCreate creates (or brings up) an ifb device, e.g. to prepare
+// ifb0 before the first 'incoming' rule.
+func handleIFBCreate(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	if !ifbNamePattern.MatchString(name) {
+		respondWithError(w, fmt.Sprintf("ifb: invalid device name '%s' (ifb followed by up to 12 letters, digits, '_', '.' or '-')", name), 400)
+		return
+	}
+	if isDarwin {
+		log.Println("[INFO] IFB: Darwin: Ignoring ifb create")
+		respondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+	if !hasIFB {
+		respondWithLocalizedError(w, r, 501, msg("rule.ifbMissing"))
+		return
+	}
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if err := ensureIFB(r.Context(), name); err != nil {
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	log.Printf("[INFO] IFB: Device %s is up", name)
+	d, _ := findIFBDevice(r.Context(), name)
+	respondWithJSON(w, http.StatusOK, d)
+}
+
+// handleIFBDelete removes an ifb device. A device that interfaces still
+// redirect to is refused (409) unless force=true, which first resets the
+// incoming rules of those interfaces.
+func handleIFBDelete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := chi.URLParam(r, "name")
+	if isDarwin {
+		log.Println("[INFO] IFB: Darwin: Ignoring ifb delete")
+		respondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	d, err := findIFBDevice(ctx, name)
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("ifb: failed to list devices: %v", err), 500)
+		return
+	}
+	if d == nil {
+		respondWithError(w, fmt.Sprintf("ifb: no device '%s'", name), 404)
+		return
+	}
+	if len(d.Mirrors) > 0 {
+		if r.URL.Query().Get("force") != "true" {
+			respondWithError(w, fmt.Sprintf("ifb: '%s' still receives the traffic of %s (reset them first, or force=true)",
+				name, strings.Join(d.Mirrors, ", ")), 409)
+			return
+		}
+		for _, iface := range d.Mirrors {
+			if err := cleanupDirection(ctx, iface, "incoming"); err != nil {
+				respondWithError(w, fmt.Sprintf("ifb: failed to reset '%s': %v", iface, err), 500)
+				return
+			}
+			reattachMirror(ctx, iface)
+			if rule := store.Get(iface, "incoming"); rule != nil {
+				store.DeleteByID(rule.ID, actorFromRequest(r))
+			}
+		}
+	}
+	if err := runIP(ctx, "link", "del", name); err != nil {
+		respondWithError(w, fmt.Sprintf("ifb: failed to delete '%s': %v", name, err), 500)
+		return
+	}
+	log.Printf("[INFO] IFB: Deleted %s (reset: %s)", name, strings.Join(d.Mirrors, ", "))
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"reset": d.Mirrors})
+}
@@ -0,0 +1,352 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- L7 Fault Proxy ---
+
+// FaultProfile describes HTTP-level faults injected for an upstream.
+type FaultProfile struct {
+	Name        string  `json:"name"`
+	ErrorRate   float64 `json:"errorRate"`             // % of requests failed
+	ErrorStatus int     `json:"errorStatus,omitempty"` // default 503
+	DelayMs     int     `json:"delayMs"`               // added latency
+	JitterMs    int     `json:"jitterMs"`              // +/- uniform jitter
+}
+
+// builtinFaultProfiles are always available and cannot be deleted.
+var builtinFaultProfiles = map[string]*FaultProfile{
+	"flaky-cdn":  {Name: "flaky-cdn", ErrorRate: 1, ErrorStatus: 503, DelayMs: 150, JitterMs: 50},
+	"slow-api":   {Name: "slow-api", DelayMs: 800, JitterMs: 400},
+	"overloaded": {Name: "overloaded", ErrorRate: 20, ErrorStatus: 429, DelayMs: 300, JitterMs: 200},
+	"down":       {Name: "down", ErrorRate: 100, ErrorStatus: 503},
+}
+
+// l7Faults holds the custom profiles and the upstream -> profile mapping.
+var l7Faults = struct {
+	sync.Mutex
+	profiles  map[string]*FaultProfile
+	upstreams map[string]string // host glob -> profile name
+}{profiles: map[string]*FaultProfile{}, upstreams: map[string]string{}}
+
+// validate checks the profile values.
+func (p *FaultProfile) validate() error {
+	if p.Name == "" {
+		return fmt.Errorf("l7: profile 'name' is required")
+	}
+	if p.ErrorRate < 0 || p.ErrorRate > 100 {
+		return fmt.Errorf("l7: 'errorRate' must be in [0, 100]")
+	}
+	if p.ErrorStatus == 0 {
+		p.ErrorStatus = http.StatusServiceUnavailable
+	} else if p.ErrorStatus < 400 || p.ErrorStatus > 599 {
+		return fmt.Errorf("l7: 'errorStatus' must be a 4xx/5xx code")
+	}
+	if p.DelayMs < 0 || p.JitterMs < 0 || p.JitterMs > p.DelayMs {
+		return fmt.Errorf("l7: 'delayMs' and 'jitterMs' must be >= 0 and jitter <= delay")
+	}
+	return nil
+}
+
+// lookupFaultProfile returns a profile by name (custom first, then built-in).
+// Must be called with l7Faults held.
+func lookupFaultProfile(name string) *FaultProfile {
+	if p, ok := l7Faults.profiles[name]; ok {
+		return p
+	}
+	return builtinFaultProfiles[name]
+}
+
+// faultProfileFor returns the profile mapped to host (port stripped) and
+// request path, or nil. Mappings are "host" or "host/path-prefix", where
+// host may be a glob such as "*.example.com". Path mappings only apply to
+// requests the proxy can see (plain HTTP, or intercepted HTTPS) and win over
+// host mappings; exact hosts win over globs, and longer prefixes win.
+func faultProfileFor(host, reqPath string) *FaultProfile {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	l7Faults.Lock()
+	defer l7Faults.Unlock()
+
+	best, bestScore := "", -1
+	for key := range l7Faults.upstreams {
+		hostPattern, prefix, hasPath := strings.Cut(key, "/")
+		if hasPath {
+			prefix = "/" + prefix
+			if reqPath == "" || !strings.HasPrefix(reqPath, prefix) {
+				continue
+			}
+		}
+		score := 0
+		if hostPattern == host {
+			score = 1
+		} else if ok, _ := path.Match(hostPattern, host); !ok {
+			continue
+		}
+		if hasPath {
+			score += 2 + 2*len(prefix)
+		}
+		if score > bestScore || (score == bestScore && key < best) {
+			best, bestScore = key, score
+		}
+	}
+	if bestScore < 0 {
+		return nil
+	}
+	return lookupFaultProfile(l7Faults.upstreams[best])
+}
+
+// inject applies the profile latency and returns true when the request
+// should fail with the profile error status.
+func (p *FaultProfile) inject() bool {
+	if p == nil {
+		return false
+	}
+	if p.DelayMs > 0 {
+		delay := p.DelayMs
+		if p.JitterMs > 0 {
+			delay += chaosIntn(2*p.JitterMs+1) - p.JitterMs
+		}
+		time.Sleep(time.Duration(delay) * time.Millisecond)
+	}
+	return p.ErrorRate > 0 && chaosFloat64()*100 < p.ErrorRate
+}
+
+// l7Proxy is a forward HTTP proxy that injects faults per upstream host.
+// Plain HTTP requests get latency and error responses; HTTPS (CONNECT)
+// tunnels get latency and refused tunnels.
+type l7Proxy struct {
+	transport http.RoundTripper
+}
+
+func (p *l7Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodConnect {
+		p.serveConnect(w, r)
+		return
+	}
+	if !r.URL.IsAbs() {
+		http.Error(w, "This is a forward proxy: send absolute-URI requests", http.StatusBadRequest)
+		return
+	}
+
+	resp := p.forward(r)
+	defer resp.Body.Close()
+	for k, vv := range resp.Header {
+		for _, v := range vv {
+			w.Header().Add(k, v)
+		}
+	}
+	w.WriteHeader(resp.StatusCode)
+	io.Copy(w, resp.Body)
+}
+
+// forward applies the fault profile of the request and sends it upstream.
+// It always returns a response: injected and upstream errors included.
+func (p *l7Proxy) forward(r *http.Request) *http.Response {
+	if profile := faultProfileFor(r.URL.Host, r.URL.Path); profile.inject() {
+		log.Printf("[INFO] L7: Injected %d (%s) for %s %s", profile.ErrorStatus, profile.Name, r.Method, r.URL)
+		return textResponse(r, profile.ErrorStatus, fmt.Sprintf("netsim fault injection (%s)", profile.Name))
+	}
+
+	out := r.Clone(r.Context())
+	out.RequestURI = ""
+	out.Header.Del("Proxy-Connection")
+	out.Header.Del("Proxy-Authorization")
+	resp, err := p.transport.RoundTrip(out)
+	if err != nil {
+		return textResponse(r, http.StatusBadGateway, fmt.Sprintf("upstream error: %v", err))
+	}
+	return resp
+}
+
+// textResponse builds a plain-text response generated by the proxy.
+func textResponse(r *http.Request, code int, body string) *http.Response {
+	body += "\n"
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", code, http.StatusText(code)),
+		StatusCode:    code,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        http.Header{"Content-Type": {"text/plain; charset=utf-8"}},
+		Body:          io.NopCloser(strings.NewReader(body)),
+		ContentLength: int64(len(body)),
+		Request:       r,
+	}
+}
+
+// serveConnect tunnels HTTPS, applying the profile at connection setup.
+// Hosts listed in L7_TLS_INTERCEPT are terminated instead (see intercept).
+func (p *l7Proxy) serveConnect(w http.ResponseWriter, r *http.Request) {
+	if tlsInterceptor.matches(r.Host) {
+		p.intercept(w, r)
+		return
+	}
+	if profile := faultProfileFor(r.Host, ""); profile.inject() {
+		log.Printf("[INFO] L7: Refused tunnel (%s) to %s", profile.Name, r.Host)
+		http.Error(w, fmt.Sprintf("netsim fault injection (%s)", profile.Name), profile.ErrorStatus)
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", r.Host, 10*time.Second)
+	if err != nil {
+		http.Error(w, fmt.Sprintf("upstream error: %v", err), http.StatusBadGateway)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		upstream.Close()
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		upstream.Close()
+		return
+	}
+	client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	go func() {
+		io.Copy(upstream, client)
+		upstream.Close()
+	}()
+	io.Copy(client, upstream)
+	client.Close()
+}
+
+// startL7Proxy serves the fault proxy on addr in the background.
+func startL7Proxy(addr string) *http.Server {
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	srv := &http.Server{Addr: addr, Handler: &l7Proxy{transport: http.DefaultTransport}}
+	go func() {
+		log.Printf("[INFO] L7: Fault proxy starting at %v", addr)
+		if err := srv.ListenAndServe(); err != http.ErrServerClosed {
+			log.Printf("[CRITICAL] L7: Fault proxy ListenAndServe error: %v", err)
+		}
+	}()
+	return srv
+}
+
+// l7ProxyEnabled reports whether L7_PROXY_LISTEN is configured.
+func l7ProxyEnabled() bool {
+	return os.Getenv("L7_PROXY_LISTEN") != ""
+}
+
+// --- Handlers: /l7 ---
+
+// handleL7State returns the profiles and upstream mapping.
+func handleL7State(w http.ResponseWriter, r *http.Request) {
+	l7Faults.Lock()
+	defer l7Faults.Unlock()
+	profiles := map[string]*FaultProfile{}
+	for name, p := range builtinFaultProfiles {
+		profiles[name] = p
+	}
+	for name, p := range l7Faults.profiles {
+		profiles[name] = p
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"enabled":   l7ProxyEnabled(),
+		"listen":    os.Getenv("L7_PROXY_LISTEN"),
+		"profiles":  profiles,
+		"upstreams": l7Faults.upstreams,
+		"intercept": tlsInterceptor.hosts,
+	})
+}
+
+// handleL7ProfileSave creates or replaces a custom fault profile.
+func handleL7ProfileSave(w http.ResponseWriter, r *http.Request) {
+	profile := &FaultProfile{}
+	if err := json.NewDecoder(r.Body).Decode(profile); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid profile JSON: %v", err), 400)
+		return
+	}
+	if err := profile.validate(); err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	if _, ok := builtinFaultProfiles[profile.Name]; ok {
+		respondWithError(w, fmt.Sprintf("l7: '%s' is a built-in profile", profile.Name), 409)
+		return
+	}
+	l7Faults.Lock()
+	l7Faults.profiles[profile.Name] = profile
+	l7Faults.Unlock()
+	respondWithJSON(w, http.StatusOK, profile)
+}
+
+// handleL7ProfileDelete removes a custom profile and its upstream mappings.
+func handleL7ProfileDelete(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	l7Faults.Lock()
+	defer l7Faults.Unlock()
+	if _, ok := l7Faults.profiles[name]; !ok {
+		respondWithError(w, fmt.Sprintf("l7: no custom profile '%s'", name), 404)
+		return
+	}
+	delete(l7Faults.profiles, name)
+	for host, p := range l7Faults.upstreams {
+		if p == name {
+			delete(l7Faults.upstreams, host)
+		}
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// handleL7Upstream maps 'host' (exact or glob, with an optional
+// "/path-prefix") to 'profile'. An empty profile removes the mapping.
+func handleL7Upstream(w http.ResponseWriter, r *http.Request) {
+	host, profile := r.URL.Query().Get("host"), r.URL.Query().Get("profile")
+	if host == "" {
+		respondWithError(w, "l7: 'host' is required", 400)
+		return
+	}
+	hostPattern, _, _ := strings.Cut(host, "/")
+	if _, err := path.Match(hostPattern, ""); err != nil {
+		respondWithError(w, fmt.Sprintf("l7: invalid 'host' pattern: %v", err), 400)
+		return
+	}
+	if err := setL7Upstream(host, profile); err != nil {
+		respondWithError(w, err.Error(), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// setL7Upstream maps host to profile ("" removes the mapping).
+func setL7Upstream(host, profile string) error {
+	l7Faults.Lock()
+	defer l7Faults.Unlock()
+	if profile == "" {
+		delete(l7Faults.upstreams, host)
+		log.Printf("[INFO] L7: Removed fault profile of %s", host)
+		return nil
+	}
+	if lookupFaultProfile(profile) == nil {
+		return fmt.Errorf("l7: unknown profile '%s'", profile)
+	}
+	l7Faults.upstreams[host] = profile
+	log.Printf("[INFO] L7: Upstream %s now uses fault profile '%s'", host, profile)
+	return nil
+}
+
+// clearL7Upstreams removes every upstream mapping (custom profiles are kept).
+func clearL7Upstreams() {
+	l7Faults.Lock()
+	defer l7Faults.Unlock()
+	l7Faults.upstreams = map[string]string{}
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- L7 TLS Interception ---
+
+// tlsIntercept terminates TLS for selected hosts with leaf certificates
+// signed by a user-provided CA, so HTTPS requests can get per-endpoint
+// faults. It is opt-in: without L7_TLS_INTERCEPT nothing is intercepted.
+type tlsIntercept struct {
+	hosts  []string // host globs to intercept
+	caCert *x509.Certificate
+	caKey  interface{}
+	key    *ecdsa.PrivateKey // shared leaf key
+
+	mu    sync.Mutex
+	certs map[string]*tls.Certificate
+	audit *os.File
+}
+
+var tlsInterceptor = &tlsIntercept{certs: map[string]*tls.Certificate{}}
+
+// configureTLSIntercept loads L7_TLS_INTERCEPT (comma-separated host globs),
+// L7_TLS_CA_CERT / L7_TLS_CA_KEY (PEM files) and L7_AUDIT_LOG (optional
+// JSON-lines file).
+func configureTLSIntercept() error {
+	hosts := os.Getenv("L7_TLS_INTERCEPT")
+	if hosts == "" {
+		return nil
+	}
+	for _, h := range strings.Split(hosts, ",") {
+		if h = strings.TrimSpace(h); h == "" {
+			continue
+		}
+		if _, err := path.Match(h, ""); err != nil {
+			return fmt.Errorf("invalid L7_TLS_INTERCEPT pattern %q: %w", h, err)
+		}
+		tlsInterceptor.hosts = append(tlsInterceptor.hosts, h)
+	}
+
+	ca, err := tls.LoadX509KeyPair(os.Getenv("L7_TLS_CA_CERT"), os.Getenv("L7_TLS_CA_KEY"))
+	if err != nil {
+		return fmt.Errorf("L7_TLS_INTERCEPT requires a CA (L7_TLS_CA_CERT, L7_TLS_CA_KEY): %w", err)
+	}
+	caCert, err := x509.ParseCertificate(ca.Certificate[0])
+	if err != nil {
+		return fmt.Errorf("invalid L7_TLS_CA_CERT: %w", err)
+	}
+	if !caCert.IsCA {
+		return fmt.Errorf("L7_TLS_CA_CERT is not a CA certificate")
+	}
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return fmt.Errorf("generate leaf key: %w", err)
+	}
+	tlsInterceptor.caCert, tlsInterceptor.caKey, tlsInterceptor.key = caCert, ca.PrivateKey, key
+
+	if auditPath := os.Getenv("L7_AUDIT_LOG"); auditPath != "" {
+		f, err := os.OpenFile(auditPath, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			return fmt.Errorf("open L7_AUDIT_LOG: %w", err)
+		}
+		tlsInterceptor.audit = f
+	}
+	log.Printf("[WARN] L7: TLS interception ENABLED for %v (CA %q)", tlsInterceptor.hosts, caCert.Subject.CommonName)
+	return nil
+}
+
+// matches reports whether host (port stripped) must be intercepted.
+func (t *tlsIntercept) matches(host string) bool {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, pattern := range t.hosts {
+		if ok, _ := path.Match(pattern, host); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// certificate returns (and caches) a leaf certificate for host.
+func (t *tlsIntercept) certificate(host string) (*tls.Certificate, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if cert, ok := t.certs[host]; ok && time.Now().Before(cert.Leaf.NotAfter.Add(-time.Hour)) {
+		return cert, nil
+	}
+
+	serial, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if err != nil {
+		return nil, err
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: host, Organization: []string{"netsim-in-a-box interception"}},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(7 * 24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		tmpl.IPAddresses = []net.IP{ip}
+	} else {
+		tmpl.DNSNames = []string{host}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, t.caCert, &t.key.PublicKey, t.caKey)
+	if err != nil {
+		return nil, fmt.Errorf("sign certificate for %s: %w", host, err)
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+	cert := &tls.Certificate{Certificate: [][]byte{der, t.caCert.Raw}, PrivateKey: t.key, Leaf: leaf}
+	t.certs[host] = cert
+	return cert, nil
+}
+
+// auditf records an interception event in the log and, if configured, in
+// the L7_AUDIT_LOG file.
+func (t *tlsIntercept) auditf(fields map[string]interface{}) {
+	fields["time"] = time.Now().UTC().Format(time.RFC3339Nano)
+	line, _ := json.Marshal(fields)
+	log.Printf("[AUDIT] L7: %s", line)
+	if t.audit != nil {
+		t.mu.Lock()
+		t.audit.Write(append(line, '\n'))
+		t.mu.Unlock()
+	}
+}
+
+// intercept terminates the CONNECT tunnel with a minted certificate and
+// proxies the decrypted requests through forward, so path mappings and
+// fault profiles apply to them.
+func (p *l7Proxy) intercept(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	client, _, err := hijacker.Hijack()
+	if err != nil {
+		return
+	}
+	defer client.Close()
+	client.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+
+	host := r.Host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	conn := tls.Server(client, &tls.Config{
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			if hello.ServerName != "" {
+				return tlsInterceptor.certificate(hello.ServerName)
+			}
+			return tlsInterceptor.certificate(host)
+		},
+		NextProtos: []string{"http/1.1"},
+	})
+	if err := conn.HandshakeContext(r.Context()); err != nil {
+		tlsInterceptor.auditf(map[string]interface{}{"event": "handshake-failed", "client": r.RemoteAddr, "host": r.Host, "error": err.Error()})
+		return
+	}
+	tlsInterceptor.auditf(map[string]interface{}{"event": "intercept", "client": r.RemoteAddr, "host": r.Host})
+
+	br := bufio.NewReader(conn)
+	for {
+		req, err := http.ReadRequest(br)
+		if err != nil {
+			return
+		}
+		req.URL.Scheme, req.URL.Host = "https", r.Host
+		req.RemoteAddr = r.RemoteAddr
+		resp := p.forward(req)
+		tlsInterceptor.auditf(map[string]interface{}{
+			"event": "request", "client": r.RemoteAddr, "host": r.Host,
+			"method": req.Method, "path": req.URL.Path, "status": resp.StatusCode,
+		})
+		err = resp.Write(conn)
+		resp.Body.Close()
+		if err != nil || req.Close || resp.Close {
+			return
+		}
+	}
+}
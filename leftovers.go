@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Leftovers of Crashed Runs ---
+
+// gatewayRuleComment tags the iptables rules of gateway mode, so a later
+// run can recognize them.
+const gatewayRuleComment = "netsim-in-a-box"
+
+// leftoverPolicy is STARTUP_LEFTOVERS: what to do with the trees and
+// firewall rules a previous (crashed) instance left behind. "clean"
+// (default) removes them, "adopt" records the trees that can be read back as
+// rules and keeps the firewall rules, "keep" leaves everything untouched.
+func leftoverPolicy() (string, error) {
+	switch policy := os.Getenv("STARTUP_LEFTOVERS"); policy {
+	case "":
+		return "clean", nil
+	case "clean", "adopt", "keep":
+		return policy, nil
+	default:
+		return "", fmt.Errorf("invalid STARTUP_LEFTOVERS '%s' (clean, adopt or keep)", policy)
+	}
+}
+
+// ownRootTree returns the shape of the tree Execute builds ("htb", "prio",
+// "netem", or "mq" for per-queue netem) when it is the root of dev (or the
+// leaf of a class of the host's tree), or "". They are recognized by their
+// reserved handles: htb 4e53: defaulting to 4e53:11, prio 4e53: with netem
+// 4e54: on band 4e53:2, netem 4e54:, and netem 4e55:... below mq.
+func ownRootTree(ctx context.Context, dev string) string {
+	out, err := runTCOutput(ctx, "qdisc", "show", "dev", dev)
+	if err != nil {
+		return ""
+	}
+	attach := " root"
+	if parents := ownAttachments(ctx, dev); len(parents) == 1 && parents[0] != "root" {
+		attach = " parent " + parents[0]
+	}
+	switch {
+	case strings.Contains(out, "qdisc htb "+rootHandle+attach) && strings.Contains(out, "default 0x11"):
+		return "htb"
+	case strings.Contains(out, "qdisc prio "+rootHandle+attach) && strings.Contains(out, "qdisc netem "+netemHandle+" parent "+impairedBand):
+		return "prio"
+	case strings.Contains(out, "qdisc netem "+netemHandle+attach):
+		return "netem"
+	}
+	if kind, _ := rootQdisc(ctx, dev); isMultiQueueRoot(kind) && strings.Contains(out, "qdisc netem "+mqChildHandle(1)) {
+		return "mq"
+	}
+	return ""
+}
+
+// ownIngress returns how the ingress of iface is wired by an 'incoming'
+// rule: "ifb" (redirect to ifb0), "police" (policer), or "". Only the
+// filters carrying the owner cookie are considered.
+func ownIngress(ctx context.Context, iface string) string {
+	own, _ := ownIngressFilters(ctx, iface)
+	for _, f := range own["ingress"] {
+		switch {
+		case strings.Contains(f.text, "Redirect to device ifb0"):
+			return "ifb"
+		case strings.Contains(f.text, " police "):
+			return "police"
+		}
+	}
+	return ""
+}
+
+// migrateLeftovers handles the trees of interfaces without desired state
+// at startup (after it was restored), following policy. Trees of
+// interfaces with desired state were rebuilt by the restore.
+func migrateLeftovers(ctx context.Context, policy string) {
+	if isDarwin || policy == "keep" {
+		return
+	}
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		log.Printf("[ERROR] LEFTOVERS: Could not query interfaces: %v", err)
+		return
+	}
+	for _, iface := range ifaces {
+		name := iface.Name
+		if iface.Flags&net.FlagLoopback != 0 || strings.HasPrefix(name, "ifb") || !ifaceAllowed(name) || store.Get(name, "") != nil {
+			continue
+		}
+		outgoing, incoming := ownRootTree(ctx, name), ownIngress(ctx, name)
+		if outgoing == "" && incoming == "" {
+			continue
+		}
+		if policy == "adopt" {
+			opts, err := readBackRule(ctx, name, outgoing, incoming)
+			if err == nil {
+				store.Set(opts, Actor{Source: "adopted"})
+				log.Printf("[INFO] LEFTOVERS: Adopted the %s rule left on %s by a previous run", opts.Direction, name)
+				continue
+			}
+			log.Printf("[WARN] LEFTOVERS: Cannot adopt the rule left on %s (%v): removing it", name, err)
+		}
+		cleanupLeftover(ctx, name, outgoing, incoming != "")
+	}
+
+	// ifb0 carries the tree of the 'incoming' rule, if any is left
+	for _, rule := range store.List() {
+		if rule.Options.Direction == "incoming" && rule.Options.ingressMode() == "ifb" {
+			return
+		}
+	}
+	if _, err := net.InterfaceByName("ifb0"); err == nil && ownRootTree(ctx, "ifb0") != "" {
+		log.Println("[INFO] LEFTOVERS: Removing the tree left on ifb0 by a previous run")
+		runTC(ctx, "qdisc", "del", "dev", "ifb0", "root")
+	}
+}
+
+// cleanupLeftover removes the tree (outgoing) and the ingress hook of iface,
+// but not the tree of ifb0, which may carry a restored rule.
+func cleanupLeftover(ctx context.Context, iface, outgoing string, ingress bool) {
+	log.Printf("[INFO] LEFTOVERS: Removing the rules left on %s by a previous run", iface)
+	switch outgoing {
+	case "":
+	case "mq":
+		_, handle := rootQdisc(ctx, iface)
+		cleanupMQChildren(ctx, iface, handle)
+	default:
+		removeOwnAttachments(ctx, iface)
+	}
+	if ingress {
+		cleanupOwnIngress(ctx, iface)
+	}
+}
+
+// readBackRule rebuilds the options of a leftover rule from the live tree:
+// the rate and ceil of the shaped class (or the policer, or the per-flow
+// cap) and the netem parameters. Rules whose filters or parameters cannot be read back
+// (selectors, flow sampling, ICMP filters, non-random loss models,
+// per-queue trees) are refused.
+func readBackRule(ctx context.Context, iface, outgoing, incoming string) (*V4NetworkOptions, error) {
+	opts := &V4NetworkOptions{Iface: iface, Direction: "outgoing"}
+	dev := iface
+	switch {
+	case outgoing != "" && incoming != "":
+		return nil, fmt.Errorf("rules in both directions")
+	case incoming == "police":
+		opts.Direction, opts.IngressMode = "incoming", "police"
+		own, _ := ownIngressFilters(ctx, iface)
+		for _, f := range own["ingress"] {
+			fields := strings.Fields(f.text)
+			for i := 0; i+1 < len(fields); i++ {
+				if fields[i] == "rate" {
+					opts.Rate = strings.ToLower(fields[i+1])
+					return opts, nil
+				}
+			}
+		}
+		return nil, fmt.Errorf("no policer rate")
+	case incoming == "ifb":
+		opts.Direction, opts.IngressMode = "incoming", "ifb"
+		dev = "ifb0"
+		if outgoing = ownRootTree(ctx, dev); outgoing == "" {
+			return nil, fmt.Errorf("no tree on ifb0")
+		}
+	}
+	if outgoing == "mq" {
+		return nil, fmt.Errorf("per-queue trees are not read back")
+	}
+	if outgoing == "netem" {
+		opts.Tree = "netem"
+	}
+	if parents := ownAttachments(ctx, dev); opts.Direction == "outgoing" && len(parents) == 1 && parents[0] != "root" {
+		opts.ParentClass = parents[0]
+	}
+
+	out, err := runTCOutput(ctx, "filter", "show", "dev", dev)
+	if err != nil {
+		return nil, err
+	}
+	if !onlyOwnFilters(out) {
+		return nil, fmt.Errorf("selectors, flow sampling or ICMP filters cannot be read back")
+	}
+	if outgoing == "htb" {
+		out, err := runTCOutput(ctx, "class", "show", "dev", dev, "classid", shapedClass)
+		if err != nil {
+			return nil, err
+		}
+		fields := strings.Fields(out)
+		for i := 0; i+1 < len(fields); i++ {
+			switch fields[i] {
+			case "rate":
+				opts.Rate = strings.ToLower(fields[i+1])
+			case "ceil":
+				opts.Ceil = strings.ToLower(fields[i+1])
+			}
+		}
+		if opts.Rate == "" {
+			return nil, fmt.Errorf("no rate on class %s", shapedClass)
+		}
+		if opts.Ceil == opts.Rate {
+			opts.Ceil = ""
+		}
+	}
+	out, err = runTCOutput(ctx, "qdisc", "show", "dev", dev)
+	if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "qdisc netem "+netemHandle+" ") {
+			if err := opts.readBackNetem(strings.Fields(line)); err != nil {
+				return nil, err
+			}
+		}
+		if fields := strings.Fields(line); strings.HasPrefix(line, "qdisc fq "+flowCapHandle+" ") {
+			for i := 0; i+1 < len(fields); i++ {
+				if fields[i] == "maxrate" {
+					opts.Rate, opts.RateScope = strings.ToLower(fields[i+1]), "flow"
+				}
+			}
+		}
+	}
+	return opts, nil
+}
+
+// onlyOwnFilters reports whether the filters of a tree are the API filters
+// (pref 1) and the catch-all filter of the impaired class: anything else
+// was added by selectors or flow sampling (basic filters), and filters with
+// actions by the ICMP options.
+func onlyOwnFilters(out string) bool {
+	pref := ""
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "filter" && slices.Contains(fields, "basic") {
+			return false
+		}
+		for i := 0; i+1 < len(fields) && fields[0] == "filter"; i++ {
+			if fields[i] == "pref" {
+				pref = fields[i+1]
+			}
+		}
+		if len(fields) > 0 && fields[0] == "action" {
+			return false
+		}
+		if len(fields) > 0 && fields[0] == "match" && pref != "1" && strings.Join(fields, " ") != "match 00000000/00000000 at 0" {
+			return false
+		}
+	}
+	return true
+}
+
+// readBackNetem parses the parameters of a 'tc qdisc show' netem line.
+func (v *V4NetworkOptions) readBackNetem(fields []string) error {
+	percent := func(s string) (string, bool) {
+		if !strings.HasSuffix(s, "%") {
+			return "", false
+		}
+		return strings.TrimSuffix(s, "%"), true
+	}
+	// value [correlation%] pairs after a keyword
+	pair := func(i int, value, correlation *string) int {
+		if i+1 < len(fields) {
+			if p, ok := percent(fields[i+1]); ok {
+				*value = p
+				i++
+				if i+1 < len(fields) {
+					if c, ok := percent(fields[i+1]); ok {
+						*correlation = c
+						i++
+					}
+				}
+			}
+		}
+		return i
+	}
+	millis := func(s string) (string, bool) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return "", false
+		}
+		return strconv.FormatFloat(float64(d)/float64(time.Millisecond), 'f', -1, 64), true
+	}
+
+	for i := 3; i < len(fields); i++ {
+		switch fields[i] {
+		case "root":
+		case "parent", "refcnt", "limit", "seed":
+			i++ // Not a rule parameter
+		case "delay":
+			if i+1 >= len(fields) {
+				return fmt.Errorf("netem: no delay value")
+			}
+			delay, ok := millis(fields[i+1])
+			if !ok {
+				return fmt.Errorf("netem: cannot read the delay '%s'", fields[i+1])
+			}
+			v.Delay = delay
+			i++
+			if i+1 < len(fields) {
+				if jitter, ok := millis(fields[i+1]); ok {
+					v.Jitter = jitter
+					i++
+					if i+1 < len(fields) {
+						if c, ok := percent(fields[i+1]); ok {
+							v.DelayCorrelation = c
+							i++
+						}
+					}
+				}
+			}
+		case "loss":
+			if i+1 < len(fields) && (fields[i+1] == "state" || fields[i+1] == "gemodel") {
+				return fmt.Errorf("netem: the %s loss model is not read back", fields[i+1])
+			}
+			i = pair(i, &v.Loss, &v.LossCorrelation)
+		case "duplicate":
+			i = pair(i, &v.Duplicate, &v.DuplicateCorrelation)
+		case "corrupt":
+			i = pair(i, &v.Corrupt, &v.CorruptCorrelation)
+		case "reorder":
+			i = pair(i, &v.Reorder, &v.ReorderCorrelation)
+		case "gap":
+			if i+1 < len(fields) {
+				v.ReorderGap = fields[i+1]
+				i++
+			}
+		default:
+			return fmt.Errorf("netem: cannot read back '%s'", fields[i])
+		}
+	}
+	return nil
+}
+
+// cleanupLeftoverFirewall deletes the iptables rules left by a previous run
+// (gateway mode, packet mangling, NAT behaviors and reset injections, tagged
+// with ownRuleComments), so they are not added twice, and the nftables table
+// of the TTL rules.
+func cleanupLeftoverFirewall(ctx context.Context) {
+	if isDarwin {
+		return
+	}
+	for _, iptables := range []string{"iptables", "ip6tables"} {
+		out, err := command(ctx, iptables+"-save").Output()
+		if err != nil {
+			continue // Not installed, or no permission
+		}
+		table := ""
+		for _, line := range strings.Split(string(out), "\n") {
+			if strings.HasPrefix(line, "*") {
+				table = strings.TrimPrefix(line, "*")
+				continue
+			}
+			if !strings.HasPrefix(line, "-A ") || !ownFirewallRule(line) {
+				continue
+			}
+			args := append([]string{"-t", table, "-D"}, strings.Fields(line)[1:]...)
+			if err := command(ctx, iptables, args...).Run(); err != nil {
+				log.Printf("[WARN] LEFTOVERS: Failed to remove the %s rule '%s': %v", iptables, line, err)
+				continue
+			}
+			log.Printf("[INFO] LEFTOVERS: Removed the %s rule left by a previous run: %s", iptables, line)
+		}
+	}
+	cleanupLeftoverTTLTable(ctx)
+}
+
+// ownRuleComments are the comments our iptables rules are tagged with.
+var ownRuleComments = map[string]bool{
+	gatewayRuleComment: true,
+	mangleRuleComment:  true,
+	natRuleComment:     true,
+	resetRuleComment:   true,
+}
+
+// ownFirewallRule reports whether an iptables-save line is one of our rules.
+func ownFirewallRule(line string) bool {
+	fields := strings.Fields(line)
+	for i := 0; i+1 < len(fields); i++ {
+		if fields[i] == "--comment" && ownRuleComments[fields[i+1]] {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"net"
+)
+
+// --- Loopback Rules ---
+
+// Two local processes talk over 'lo', which the interface lists, patterns,
+// reset-all and the shutdown cleanup leave out. A rule on it must be asked
+// for explicitly (confirmLoopback=true): the API's own clients are often
+// local too, so the protected ports are kept unimpaired both ways, and only
+// trees that can do so (htb, prio) are allowed. Every local packet crosses
+// 'lo' once, on its way out: 'outgoing' impairs both directions of local
+// connections, and 'incoming' (which would impair them twice) is refused.
+
+// isLoopback reports whether iface is a loopback interface.
+func isLoopback(iface string) bool {
+	i, err := net.InterfaceByName(iface)
+	return err == nil && i.Flags&net.FlagLoopback != 0
+}
+
+// validateLoopback checks a rule on a loopback interface.
+func (v *V4NetworkOptions) validateLoopback() error {
+	if !isLoopback(v.Iface) {
+		return nil
+	}
+	switch {
+	case v.ConfirmLoopback != "true":
+		return msg("rule.loopbackUnconfirmed", v.Iface)
+	case v.Direction != "outgoing":
+		return msg("rule.loopbackOutgoing", v.Iface)
+	case v.Tree == "netem":
+		return msg("rule.loopbackNetemTree", v.Iface)
+	}
+	return nil
+}
+
+// loopbackRuleIfaces returns the loopback interfaces that carry a rule (or
+// a leftover tree), for reset-all and the shutdown cleanup.
+func loopbackRuleIfaces(ctx context.Context) []string {
+	ifaces, err := net.Interfaces()
+	if err != nil {
+		return nil
+	}
+	var list []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagLoopback == 0 || !ifaceAllowed(iface.Name) {
+			continue
+		}
+		if store.Get(iface.Name, "") != nil || hasOwnQdiscs(ctx, iface.Name) {
+			list = append(list, iface.Name)
+		}
+	}
+	return list
+}
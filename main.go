@@ -5,14 +5,17 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
 	"os/exec"
 	"os/signal"
 	"path/filepath"
 	"runtime"
+	"strconv"
 	"strings"
 	"syscall"
 	"time"
@@ -27,8 +30,24 @@ type PreflightCheck struct {
 	Required bool   `json:"required"`
 	Status   bool   `json:"status"`
 	Message  string `json:"message"`
+	Hint     string `json:"hint,omitempty"` // how to fix a failed check
+
+	message, hint *Message // catalog messages, rendered per request by /preflight
+}
+
+// report sets the message of the check, in the server's language.
+func (c *PreflightCheck) report(m *Message) {
+	c.message, c.Message = m, m.Render(serverLanguage())
+}
+
+// remedy sets the remediation hint of a failed check.
+func (c *PreflightCheck) remedy(m *Message) {
+	c.hint, c.Hint = m, m.Render(serverLanguage())
 }
 
+// preflightChecks are the results of the startup checks.
+var preflightChecks []*PreflightCheck
+
 var isDarwin bool
 var hasIFB bool
 var hasIPv6 bool
@@ -46,9 +65,31 @@ func init() {
 }
 
 func main() {
+	tuiMode := flag.Bool("tui", false, "show a console UI for the netsim running on this box, instead of starting one")
+	checkMode := flag.Bool("check", false, "check the configuration (environment, LIBRARY_FILE, and the rules of STATE_FILE or of the file given) on this box, print the plan and exit")
+	flag.Parse()
+	if *tuiMode {
+		if err := runTUI(); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			os.Exit(1)
+		}
+		return
+	}
+	if *checkMode {
+		if path := flag.Arg(0); path != "" {
+			os.Setenv("STATE_FILE", path)
+		}
+		if runCheck(context.Background(), os.Stdout) > 0 {
+			os.Exit(1)
+		}
+		return
+	}
+
 	// Setup graceful shutdown
 	ctx, cancel := context.WithCancel(context.Background())
 	setupGracefulShutdown(cancel)
+	restarter.cancel = cancel
+	loadRestartHistory()
 
 	if err := doMain(ctx); err != nil {
 		log.Printf("[CRITICAL] CRITICAL FAILURE: %v", err)
@@ -58,6 +99,12 @@ func main() {
 		fmt.Println("-------------------------------------------------")
 		os.Exit(1)
 	}
+	if restartRequested() {
+		if err := execRestart(); err != nil {
+			log.Printf("[ERROR] RESTARTER: Re-exec failed, exiting for the supervisor to restart: %v", err)
+			os.Exit(1)
+		}
+	}
 }
 
 func doMain(ctx context.Context) error {
@@ -68,6 +115,16 @@ func doMain(ctx context.Context) error {
 		os.Setenv("API_LISTEN", "2023")
 	}
 
+	// Ship audit and error logs to syslog if requested
+	if err := configureSyslog(); err != nil {
+		return err
+	}
+
+	// Settings changed through the API override the environment
+	if err := loadSettings(); err != nil {
+		return err
+	}
+
 	// Run system preflight checks.
 	log.Println("[INFO] Running Preflight Checks...")
 	checks, allOk := runPreflightChecks(ctx)
@@ -84,15 +141,64 @@ func doMain(ctx context.Context) error {
 			criticalFailures = append(criticalFailures, fmt.Sprintf("%s: %s", check.Name, check.Message))
 		}
 		logFunc("  - Check: %-20s Status: %-7s Message: %s", check.Name, statusMsg, check.Message)
+		if check.Hint != "" {
+			logFunc("    %-27s Hint: %s", "", check.Hint)
+		}
 	}
+	preflightChecks = checks
 
 	if !allOk {
 		return fmt.Errorf("preflight checks failed: %s", strings.Join(criticalFailures, "; "))
 	}
 	log.Println("[INFO] Preflight checks passed successfully.")
 
+	// Seed the chaos PRNG (CHAOS_SEED) and detect netem seed support
+	if err := configureRandomness(ctx); err != nil {
+		return err
+	}
+
+	// Auth tokens (ADMIN_TOKEN, FLEET_TOKEN or their *_FILE)
+	if err := loadSecrets(); err != nil {
+		return err
+	}
+
+	// Endpoint groups turned off for locked-down deployments
+	if err := configureEndpointGroups(); err != nil {
+		return err
+	}
+	if err := configureIfaceFilter(); err != nil {
+		return err
+	}
+	if err := configureTrustedProxies(); err != nil {
+		return err
+	}
+	if err := configureAPITLS(); err != nil {
+		return err
+	}
+	if err := configureProtectedPorts(); err != nil {
+		return err
+	}
+	if err := configurePrivilegedFeatures(); err != nil {
+		return err
+	}
+	if err := configureCleanup(); err != nil {
+		return err
+	}
+
+	// Rules left by a crashed run are cleaned (or adopted) before new ones
+	// are added
+	leftovers, err := leftoverPolicy()
+	if err != nil {
+		return err
+	}
+	if leftovers == "clean" {
+		cleanupLeftoverFirewall(ctx)
+	}
+
 	// Enable Gateway Mode if requested
-	if os.Getenv("DEFAULT_GATEWAY_MODE") == "true" {
+	if setting("DEFAULT_GATEWAY_MODE") == "true" && groupDisabled("gateway") {
+		log.Println("[WARN] DEFAULT_GATEWAY_MODE=true ignored: the 'gateway' group is disabled (DISABLE_ENDPOINTS).")
+	} else if setting("DEFAULT_GATEWAY_MODE") == "true" {
 		if err := enableGatewayMode(ctx); err != nil {
 			return fmt.Errorf("failed to enable Default Gateway Mode: %w", err)
 		}
@@ -100,11 +206,104 @@ func doMain(ctx context.Context) error {
 		log.Println("[INFO] DEFAULT_GATEWAY_MODE=false. Skipping gateway setup.")
 	}
 
+	// Keep only the capabilities tc, ip and tcpdump need from here on, and
+	// sandbox the children
+	if !isDarwin {
+		if err := confinePrivileges(os.Getenv("DROP_PRIVILEGES") != "false"); err != nil {
+			log.Printf("[WARN] Could not drop privileges (continuing with the current ones): %v", err)
+		}
+		if os.Getenv("NO_NEW_PRIVS") != "false" || os.Getenv("SECCOMP") == "true" {
+			if err := hardenProcess(os.Getenv("SECCOMP") == "true"); err != nil {
+				log.Printf("[WARN] Could not sandbox child processes: %v", err)
+			}
+		}
+		if err := checkPrivilegedFeatures(ctx); err != nil {
+			return err
+		}
+	}
+
+	// Scheduled jobs (curves, etc.) stop on shutdown
+	sched.SetContext(ctx)
+
+	// Load the persisted desired state (optional) and re-apply it.
+	if stateFile := os.Getenv("STATE_FILE"); stateFile != "" {
+		if err := store.Open(stateFile); err != nil {
+			return fmt.Errorf("failed to load state: %w", err)
+		}
+		restoreDesiredState(ctx)
+	} else if err := loadHandoff(ctx); err != nil {
+		log.Printf("[ERROR] RESTARTER: Failed to load the handed-over state: %v", err)
+	}
+	migrateLeftovers(ctx, leftovers)
+
+	// Start the drift reconciler if requested
+	if interval := envDuration("RECONCILE_INTERVAL", 0); interval > 0 {
+		startReconciler(ctx, interval)
+	}
+
+	// Start the safe-mode watchdog if requested
+	if configureWatchdog() {
+		startWatchdog(ctx)
+	}
+
+	// Check the alert rules (defined through the API)
+	startAlerts(ctx)
+
+	// Start the scheduled auto-reset if requested
+	if ok, err := configureAutoReset(); err != nil {
+		return err
+	} else if ok {
+		startAutoReset(ctx)
+	}
+
+	// Start the L7 fault proxy if requested
+	var l7Server *http.Server
+	if addr := os.Getenv("L7_PROXY_LISTEN"); addr != "" {
+		if err := configureTLSIntercept(); err != nil {
+			return fmt.Errorf("failed to configure TLS interception: %w", err)
+		}
+		l7Server = startL7Proxy(addr)
+	}
+
+	// Export traces (HTTP request -> commands) if requested
+	if configureTracing() {
+		startTracing(ctx)
+	}
+
+	// Start the SNMP agent if requested
+	if ok, err := configureSNMP(); err != nil {
+		return err
+	} else if ok {
+		if err := startSNMPAgent(ctx, os.Getenv("SNMP_LISTEN")); err != nil {
+			return err
+		}
+	}
+
+	// Register with the fleet controller if requested
+	if controller := os.Getenv("FLEET_CONTROLLER_URL"); controller != "" {
+		startFleetRegistration(ctx, controller)
+	}
+
+	// Sync the library with object storage if requested
+	if configureBackup() {
+		startBackupSync(ctx, envDuration("S3_SYNC_INTERVAL", 0))
+	}
+
+	// Import the local profile library if requested
+	if _, err := loadLibraryFile(); err != nil {
+		return err
+	}
+
+	// Reload the configuration on SIGHUP
+	setupReloadSignal(ctx)
+
 	addr := os.Getenv("API_LISTEN")
 	if !strings.Contains(addr, ":") {
 		addr = fmt.Sprintf(":%v", addr)
 	}
 
+	listenAddr = addr
+
 	// --- Startup Log ---
 	apiPort := strings.TrimPrefix(addr, ":")
 	// Query interfaces *before* logging startup, so we can show IPs
@@ -117,31 +316,280 @@ func doMain(ctx context.Context) error {
 	logStartupInfo(apiPort, ifacesForLog)
 
 	// --- Chi Router Setup ---
-	r := chi.NewRouter()
-	r.Use(middleware.RequestID)
-	r.Use(middleware.RealIP)
+	mux := chi.NewRouter()
+	mux.Use(middleware.RequestID)
+	mux.Use(RealIPMiddleware)
+	mux.Use(TelemetryMiddleware)
 	// Use a custom logger middleware to match our log format
-	r.Use(LoggerMiddleware)
-	r.Use(middleware.Recoverer)
-	r.Use(middleware.Timeout(60 * time.Second))
+	mux.Use(LoggerMiddleware)
+	mux.Use(middleware.Recoverer)
+	// gzip JSON and text responses (stats and histories get large); event
+	// streams and pcaps are left alone
+	mux.Use(middleware.Compress(5))
+	mux.Use(EndpointGroupsMiddleware)
+	mux.Use(APIVersionMiddleware)
+	mux.Use(AutoResetMiddleware)
+
+	// Streams (server-sent events, streamed command output) outlive the
+	// request timeout, so they are mounted without it
+	mux.Group(func(r chi.Router) {
+		r.Get(fmt.Sprintf("/tc/api/%s/sessions/events", apiVersion), handleSessionEvents)
+		r.Get(fmt.Sprintf("/tc/api/%s/alerts/events", apiVersion), handleAlertEvents)
+		// (bounds its own buffered runs, see rawTimeout)
+		r.Get(fmt.Sprintf("/tc/api/%s/config/raw", apiVersion), handleTcRaw)
+		r.Post(fmt.Sprintf("/tc/api/%s/config/raw", apiVersion), handleTcRaw)
+	})
+
+	// Every other request is cut off after 60s
+	r := mux.With(middleware.Timeout(60 * time.Second))
 
 	// --- API Routes ---
 	r.Get("/tc/api/version", func(w http.ResponseWriter, r *http.Request) {
-		respondWithJSON(w, http.StatusOK, map[string]string{
-			"software_version": version,
-			"api_version":      apiVersion,
+		respondWithJSON(w, http.StatusOK, map[string]interface{}{
+			"software_version":       version,
+			"api_version":            apiVersion,
+			"supported_api_versions": supportedAPIVersions,
 		})
 	})
 
+	r.Get(fmt.Sprintf("/tc/api/%s/capabilities", apiVersion), handleCapabilities)
+	r.Get(fmt.Sprintf("/tc/api/%s/system", apiVersion), handleSystem)
+	r.Get(fmt.Sprintf("/tc/api/%s/preflight", apiVersion), handlePreflight)
+	r.Get(fmt.Sprintf("/tc/api/%s/contract", apiVersion), handleContract)
+
+	r.Get(fmt.Sprintf("/tc/api/%s/connections", apiVersion), handleConnections)
+	r.Route(fmt.Sprintf("/tc/api/%s/diag", apiVersion), func(r chi.Router) {
+		r.Get("/", handleDiagList)
+		r.Get("/{name}", handleDiagRun)
+	})
+	r.Get(fmt.Sprintf("/tc/api/%s/metrics", apiVersion), handleMetrics)
+
 	// Our V4 routes (keeping /v2/ path for compatibility)
 	r.Route(fmt.Sprintf("/tc/api/%s/config", apiVersion), func(r chi.Router) {
 		r.Get("/init", handleTcInit)
 		r.Get("/setup", handleTcSetupV4) // Mapped to the new V4 handler
 		r.Get("/reset", handleTcResetV4) // Mapped to the new V4 handler
-		r.MethodFunc("GET", "/raw", handleTcRaw)
-		r.MethodFunc("POST", "/raw", handleTcRaw)
+		r.Get("/query", handleTcQuery)
+		r.Get("/stats", handleTcStats)
+		r.Get("/plan", handleTcPlan)
+		r.Get("/estimate", handleTcEstimate)
+		r.MethodFunc("GET", "/reset-all", handleTcResetAll)
+		r.MethodFunc("POST", "/reset-all", handleTcResetAll)
+		r.MethodFunc("GET", "/ifacefilter", handleIfaceFilter)
+		r.MethodFunc("POST", "/ifacefilter", handleIfaceFilter)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/rules", apiVersion), func(r chi.Router) {
+		r.Get("/", handleRuleList)
+		r.Get("/{id}", withRuleID(handleTcQuery))
+		r.Get("/{id}/stats", withRuleID(handleTcStats))
+		r.Patch("/{id}", handleRuleAdjust)
+		r.Delete("/{id}", withRuleID(handleTcResetV4))
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/calibrate", apiVersion), func(r chi.Router) {
+		r.Post("/", handleCalibrateUpload)
+		r.Get("/capture", handleCalibrateCapture)
+		r.Get("/baseline", handleBaselineMeasure)
+		r.Delete("/baseline", handleBaselineDelete)
+		r.Get("/baselines", handleBaselineList)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/watchdog", apiVersion), func(r chi.Router) {
+		r.Get("/", handleWatchdogStatus)
+		r.MethodFunc("GET", "/keepalive", handleWatchdogKeepalive)
+		r.MethodFunc("POST", "/keepalive", handleWatchdogKeepalive)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/autoreset", apiVersion), func(r chi.Router) {
+		r.Get("/", handleAutoResetStatus)
+		r.Post("/skip", handleAutoResetSkip)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/ifb", apiVersion), func(r chi.Router) {
+		r.Get("/", handleIFBList)
+		r.Get("/{name}", handleIFBGet)
+		r.Post("/{name}", handleIFBCreate)
+		r.Delete("/{name}", handleIFBDelete)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/vifs", apiVersion), func(r chi.Router) {
+		r.Get("/", handleVifList)
+		r.Get("/{name}", handleVifGet)
+		r.Post("/{name}", handleVifCreate)
+		r.Delete("/{name}", handleVifDelete)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/mirror", apiVersion), func(r chi.Router) {
+		r.Get("/", handleMirrorList)
+		r.Get("/setup", handleMirrorSetup)
+		r.Get("/reset", handleMirrorReset)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/mangle", apiVersion), func(r chi.Router) {
+		r.Get("/", handleMangleList)
+		r.Get("/setup", handleMangleSetup)
+		r.Get("/reset", handleMangleReset)
 	})
 
+	r.Route(fmt.Sprintf("/tc/api/%s/resets", apiVersion), func(r chi.Router) {
+		r.Get("/", handleResetsList)
+		r.Get("/setup", handleResetsSetup)
+		r.Get("/reset", handleResetsReset)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/settings", apiVersion), func(r chi.Router) {
+		r.Get("/", handleSettingList)
+		r.Get("/{name}", handleSettingGet)
+		r.Post("/{name}", handleSettingSet)
+		r.Delete("/{name}", handleSettingDelete)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/nat", apiVersion), func(r chi.Router) {
+		r.Get("/", handleNATList)
+		r.Get("/setup", handleNATSetup)
+		r.Get("/reset", handleNATReset)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/ttl", apiVersion), func(r chi.Router) {
+		r.Get("/", handleTTLList)
+		r.Get("/setup", handleTTLSetup)
+		r.Get("/reset", handleTTLReset)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/flowexport", apiVersion), func(r chi.Router) {
+		r.Get("/", handleFlowExportList)
+		r.Get("/setup", handleFlowExportSetup)
+		r.Get("/reset", handleFlowExportReset)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/speedtest", apiVersion), func(r chi.Router) {
+		r.Get("/", handleSpeedtestList)
+		r.MethodFunc("GET", "/run", handleSpeedtestRun)
+		r.MethodFunc("POST", "/run", handleSpeedtestRun)
+		r.Delete("/", handleSpeedtestClear)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/curves", apiVersion), func(r chi.Router) {
+		r.Get("/", handleCurveList)
+		r.Post("/", handleCurveStart)
+		r.Delete("/{iface}", handleCurveStop)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/oscillations", apiVersion), func(r chi.Router) {
+		r.Get("/", handleOscillationList)
+		r.Post("/", handleOscillationStart)
+		r.Delete("/{iface}", handleOscillationStop)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/satellite", apiVersion), func(r chi.Router) {
+		r.Get("/", handleSatelliteList)
+		r.Post("/", handleSatelliteStart)
+		r.Delete("/{iface}", handleSatelliteStop)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/handover", apiVersion), func(r chi.Router) {
+		r.Get("/", handleHandoverList)
+		r.Post("/", handleHandoverStart)
+		r.Delete("/{iface}", handleHandoverStop)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/timesync", apiVersion), func(r chi.Router) {
+		r.Get("/", handleTimeSyncStatus)
+		r.Post("/asymmetry", handleTimeSyncAsymmetry)
+		r.Post("/skew", handleClockSkewStart)
+		r.Delete("/skew", handleClockSkewStop)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/owd", apiVersion), func(r chi.Router) {
+		r.Post("/run", handleOWDRun)
+		r.Post("/receivers", handleOWDReceiverStart)
+		r.Get("/receivers/{id}", handleOWDReceiverGet)
+		r.Delete("/receivers/{id}", handleOWDReceiverStop)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/storms", apiVersion), func(r chi.Router) {
+		r.Get("/", handleStormList)
+		r.Post("/", handleStormStart)
+		r.Delete("/{iface}", handleStormStop)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/ab", apiVersion), func(r chi.Router) {
+		r.Get("/", handleABList)
+		r.Post("/", handleABStart)
+		r.Get("/{iface}", handleABGet)
+		r.Delete("/{iface}", handleABStop)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/groups", apiVersion), func(r chi.Router) {
+		r.Get("/", handleGroupList)
+		r.Post("/", handleGroupDefine)
+		r.Delete("/{name}", handleGroupDelete)
+		r.Post("/{name}/enable", handleGroupSwitch("enable"))
+		r.Post("/{name}/disable", handleGroupSwitch("disable"))
+		r.Post("/{name}/toggle", handleGroupSwitch("toggle"))
+	})
+	r.Post(fmt.Sprintf("/tc/api/%s/budget", apiVersion), handleBudgetSplit)
+
+	r.Route(fmt.Sprintf("/tc/api/%s/alerts", apiVersion), func(r chi.Router) {
+		r.Get("/", handleAlertList)
+		r.Post("/", handleAlertDefine)
+		r.Delete("/{name}", handleAlertDelete)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/sessions", apiVersion), func(r chi.Router) {
+		r.Get("/", handleSessionList)
+		r.Get("/view", handleSessionView)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/scenarios", apiVersion), func(r chi.Router) {
+		r.Get("/", handleScenarioList)
+		r.Post("/", handleScenarioStart)
+		r.Get("/clock", handleScenarioClock)
+		r.Get("/suites", handleSuiteList)
+		r.Get("/suites/{name}", handleSuiteGet)
+		r.Get("/suites/{name}/report", handleSuiteReport)
+		r.Post("/suites/{name}/run", handleSuiteRun)
+		r.Delete("/{name}", handleScenarioStop)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/fleet", apiVersion), func(r chi.Router) {
+		r.Get("/", handleFleetList)
+		r.Post("/register", handleFleetRegister)
+		r.Delete("/{id}", handleFleetRemove)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/profiles", apiVersion), func(r chi.Router) {
+		r.Get("/", handleProfileList)
+		r.Post("/", handleProfileSave)
+		r.Get("/{name}", handleProfileGet)
+		r.Delete("/{name}", handleProfileDelete)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/library", apiVersion), func(r chi.Router) {
+		r.Get("/", handleLibraryExport)
+		r.Post("/", handleLibraryImport)
+		r.Post("/backup", handleBackup)
+		r.Post("/restore", handleRestore)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/restarter", apiVersion), func(r chi.Router) {
+		r.Get("/", handleRestarterStatus)
+		r.Post("/restart", handleRestart)
+		r.Post("/reload", handleReload)
+		r.Post("/upgrade", handleUpgrade)
+	})
+
+	r.Route(fmt.Sprintf("/tc/api/%s/l7", apiVersion), func(r chi.Router) {
+		r.Get("/", handleL7State)
+		r.Post("/profiles", handleL7ProfileSave)
+		r.Delete("/profiles/{name}", handleL7ProfileDelete)
+		r.Get("/upstream", handleL7Upstream)
+	})
+
+	// Text status page for headless consoles (curl, lynx)
+	r.Get("/status", handleStatus)
+
 	// --- Static File Server ---
 	uiStaticDir := "./frontend"
 	log.Printf("[INFO] Serving V4 static UI from %s at /", uiStaticDir)
@@ -208,14 +656,45 @@ func doMain(ctx context.Context) error {
 	// --- End Static Server ---
 
 	// --- Start Server ---
-	httpServer := &http.Server{Addr: addr, Handler: r}
+	httpServer := &http.Server{Addr: addr, Handler: mux, TLSConfig: apiTLS}
 	go func() {
-		log.Printf("[INFO] HTTP server starting at %v", addr)
-		if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
+		var err error
+		if apiTLS != nil {
+			log.Printf("[INFO] HTTPS server (HTTP/2) starting at %v", addr)
+			err = httpServer.ListenAndServeTLS("", "")
+		} else {
+			log.Printf("[INFO] HTTP server starting at %v", addr)
+			err = httpServer.ListenAndServe()
+		}
+		if err != http.ErrServerClosed {
 			log.Printf("[CRITICAL] HTTP server ListenAndServe error: %v", err)
 		}
 	}()
 
+	// The read-only view for stakeholders, on its own port, if requested
+	var viewServer *http.Server
+	if viewAddr := os.Getenv("VIEW_LISTEN"); viewAddr != "" {
+		if !strings.Contains(viewAddr, ":") {
+			viewAddr = ":" + viewAddr
+		}
+		if viewAddr == addr {
+			return fmt.Errorf("VIEW_LISTEN must differ from API_LISTEN (%s)", addr)
+		}
+		viewServer = &http.Server{Addr: viewAddr, Handler: ReadOnlyView(mux), TLSConfig: apiTLS}
+		go func() {
+			var err error
+			log.Printf("[INFO] Read-only view starting at %v (token required: %v)", viewAddr, secret("VIEW_TOKEN") != "")
+			if apiTLS != nil {
+				err = viewServer.ListenAndServeTLS("", "")
+			} else {
+				err = viewServer.ListenAndServe()
+			}
+			if err != http.ErrServerClosed {
+				log.Printf("[CRITICAL] View server ListenAndServe error: %v", err)
+			}
+		}()
+	}
+
 	// Wait for context cancellation (from graceful shutdown)
 	<-ctx.Done()
 
@@ -226,10 +705,33 @@ func doMain(ctx context.Context) error {
 	if err := httpServer.Shutdown(shutdownCtx); err != nil {
 		log.Printf("[ERROR] HTTP server graceful shutdown failed: %v", err)
 	}
+	if viewServer != nil {
+		viewServer.Shutdown(shutdownCtx)
+	}
+	if l7Server != nil {
+		l7Server.Shutdown(shutdownCtx)
+	}
+
+	// On a restart (upgrade), the rules stay active for the new process
+	if restartRequested() {
+		stopAllExporters()
+		prepareRestart()
+		log.Println("[INFO] Keeping TC rules for the restart. Exiting.")
+		return nil
+	}
 
 	// Finally, run the cleanup
 	log.Println("[INFO] Running graceful cleanup of all TC rules...")
-	cleanupAllInterfaces(context.Background()) // Use a new background context
+	removeAllMirrors(context.Background())
+	removeAllMangles()
+	removeAllResets()
+	removeAllTTLRules(context.Background())
+	resetNATBehavior(context.Background())
+	stopAllExporters()
+	if failures := cleanupAllInterfaces(context.Background()); len(failures) > 0 { // Use a new background context
+		log.Printf("[WARN] Cleanup incomplete (%d interface(s) may still have rules). Exiting.", len(failures))
+		return nil
+	}
 	log.Println("[INFO] Cleanup complete. Exiting.")
 
 	return nil
@@ -253,6 +755,24 @@ func LoggerMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// envDuration reads a duration from the environment. Plain numbers are
+// treated as seconds (e.g. "30"), otherwise Go syntax is used (e.g. "5m").
+func envDuration(name string, def time.Duration) time.Duration {
+	v := os.Getenv(name)
+	if v == "" {
+		return def
+	}
+	if secs, err := strconv.Atoi(v); err == nil {
+		return time.Duration(secs) * time.Second
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		log.Printf("[WARN] Invalid %s=%q, using default %v", name, v, def)
+		return def
+	}
+	return d
+}
+
 // --- HTTP Response Helpers ---
 
 func respondWithError(w http.ResponseWriter, message string, code int) {
@@ -265,6 +785,27 @@ func respondWithError(w http.ResponseWriter, message string, code int) {
 	})
 }
 
+// pageBounds returns the slice [start:end) of a history of total entries
+// selected by the 'offset' and 'limit' query parameters (no limit = all).
+func pageBounds(r *http.Request, total int) (start, end int, err error) {
+	q := r.URL.Query()
+	end = total
+	if v := q.Get("offset"); v != "" {
+		if start, err = strconv.Atoi(v); err != nil || start < 0 {
+			return 0, 0, fmt.Errorf("invalid 'offset' %q", v)
+		}
+		start = min(start, total)
+	}
+	if v := q.Get("limit"); v != "" {
+		limit, err := strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("invalid 'limit' %q", v)
+		}
+		end = min(start+limit, total)
+	}
+	return start, end, nil
+}
+
 func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(code)
@@ -280,7 +821,7 @@ func respondWithJSON(w http.ResponseWriter, code int, payload interface{}) {
 // runPreflightChecks (V4: Removed tcconfig checks)
 func runPreflightChecks(ctx context.Context) (checks []*PreflightCheck, ok bool) {
 	checkBinary := func(name string, args ...string) (string, error) {
-		cmd := exec.CommandContext(ctx, name, args...)
+		cmd := command(ctx, name, args...)
 		out, err := cmd.CombinedOutput()
 		if err != nil {
 			return "", err
@@ -292,19 +833,19 @@ func runPreflightChecks(ctx context.Context) (checks []*PreflightCheck, ok bool)
 		return "OK", nil
 	}
 
-	// === Check 1: Root Permission ===
+	// === Check 1: User (root is not required: see CAP_NET_ADMIN) ===
 	{
-		check := &PreflightCheck{Name: "Root Permission", Required: true}
-		cmd := exec.CommandContext(ctx, "id", "-u")
+		check := &PreflightCheck{Name: "User", Required: false}
+		cmd := command(ctx, "id", "-u")
 		if out, err := cmd.Output(); err != nil {
 			check.Status = false
-			check.Message = fmt.Sprintf("Failed to check UID: %v", err)
+			check.report(msg("preflight.uidFailed", err))
 		} else if uid := strings.TrimSpace(string(out)); uid != "0" {
-			check.Status = false
-			check.Message = fmt.Sprintf("Must run as root (uid=0), but was (uid=%s)", uid)
+			check.Status = true
+			check.report(msg("preflight.notRoot", uid))
 		} else {
 			check.Status = true
-			check.Message = "OK (uid=0)"
+			check.report(msg("preflight.root"))
 		}
 		checks = append(checks, check)
 	}
@@ -313,10 +854,10 @@ func runPreflightChecks(ctx context.Context) (checks []*PreflightCheck, ok bool)
 		check := &PreflightCheck{Name: "tc (iproute2)", Required: true}
 		if version, err := checkBinary("tc", "-V"); err != nil {
 			check.Status = false
-			check.Message = "Binary 'tc' not found. (Install with 'apt-get install iproute2')"
+			check.report(msg("preflight.binaryMissing", "tc"))
 		} else {
 			check.Status = true
-			check.Message = fmt.Sprintf("OK (%s)", version)
+			check.report(msg("preflight.version", version))
 		}
 		checks = append(checks, check)
 	}
@@ -325,23 +866,23 @@ func runPreflightChecks(ctx context.Context) (checks []*PreflightCheck, ok bool)
 		check := &PreflightCheck{Name: "ip (iproute2)", Required: true}
 		if version, err := checkBinary("ip", "-V"); err != nil {
 			check.Status = false
-			check.Message = "Binary 'ip' not found. (Install with 'apt-get install iproute2')"
+			check.report(msg("preflight.binaryMissing", "ip"))
 		} else {
 			check.Status = true
-			check.Message = fmt.Sprintf("OK (%s)", version)
+			check.report(msg("preflight.version", version))
 		}
 		checks = append(checks, check)
 	}
 	// === Check 4: Kernel Module 'ifb' ===
 	{
 		check := &PreflightCheck{Name: "Kernel Module 'ifb'", Required: false}
-		cmd := exec.CommandContext(ctx, "grep", "^ifb", "/proc/modules")
+		cmd := command(ctx, "grep", "^ifb", "/proc/modules")
 		if err := cmd.Run(); err != nil {
 			check.Status = false
-			check.Message = "Module 'ifb' not loaded. Ingress (incoming) traffic shaping will be disabled."
+			check.report(msg("preflight.ifbMissing"))
 		} else {
 			check.Status = true
-			check.Message = "OK (Module 'ifb' is loaded)"
+			check.report(msg("preflight.moduleLoaded", "ifb"))
 			hasIFB = true
 		}
 		checks = append(checks, check)
@@ -349,26 +890,26 @@ func runPreflightChecks(ctx context.Context) (checks []*PreflightCheck, ok bool)
 	// === Check 5: Kernel Module 'sch_htb' ===
 	{
 		check := &PreflightCheck{Name: "Kernel Module 'sch_htb'", Required: true}
-		cmd := exec.CommandContext(ctx, "grep", "^sch_htb", "/proc/modules")
+		cmd := command(ctx, "grep", "^sch_htb", "/proc/modules")
 		if err := cmd.Run(); err != nil {
 			check.Status = false
-			check.Message = "Module 'sch_htb' not loaded. This is *required*."
+			check.report(msg("preflight.moduleRequired", "sch_htb"))
 		} else {
 			check.Status = true
-			check.Message = "OK (Module 'sch_htb' is loaded)"
+			check.report(msg("preflight.moduleLoaded", "sch_htb"))
 		}
 		checks = append(checks, check)
 	}
 	// === Check 6: Kernel Module 'sch_netem' ===
 	{
 		check := &PreflightCheck{Name: "Kernel Module 'sch_netem'", Required: true}
-		cmd := exec.CommandContext(ctx, "grep", "^sch_netem", "/proc/modules")
+		cmd := command(ctx, "grep", "^sch_netem", "/proc/modules")
 		if err := cmd.Run(); err != nil {
 			check.Status = false
-			check.Message = "Module 'sch_netem' not loaded. This is *required*."
+			check.report(msg("preflight.moduleRequired", "sch_netem"))
 		} else {
 			check.Status = true
-			check.Message = "OK (Module 'sch_netem' is loaded)"
+			check.report(msg("preflight.moduleLoaded", "sch_netem"))
 		}
 		checks = append(checks, check)
 	}
@@ -379,14 +920,76 @@ func runPreflightChecks(ctx context.Context) (checks []*PreflightCheck, ok bool)
 		// If it exists, the stack is enabled.
 		if _, err := os.Stat("/proc/net/if_inet6"); err != nil {
 			check.Status = false
-			check.Message = "Host IPv6 stack not detected. IPv6 filter rules will be skipped."
+			check.report(msg("preflight.ipv6Missing"))
 		} else {
 			check.Status = true
-			check.Message = "OK (IPv6 stack detected)"
+			check.report(msg("preflight.ipv6"))
 			hasIPv6 = true
 		}
 		checks = append(checks, check)
 	}
+	// === Check 8: CAP_NET_ADMIN ===
+	{
+		check := &PreflightCheck{Name: "CAP_NET_ADMIN", Required: true}
+		if capable, err := hasCapability(capNetAdmin); err != nil {
+			check.Status = true // Not Linux, or /proc is hidden: tc will tell
+			check.report(msg("preflight.capUnknown", err))
+		} else if !capable {
+			check.Status = false
+			check.report(msg("preflight.noNetAdmin"))
+			check.remedy(msg("hint.netAdmin"))
+		} else {
+			check.Status = true
+			check.report(msg("preflight.netAdmin"))
+		}
+		checks = append(checks, check)
+	}
+	// === Check 9: CAP_NET_RAW (captures) ===
+	{
+		check := &PreflightCheck{Name: "CAP_NET_RAW", Required: false}
+		if capable, err := hasCapability(capNetRaw); err == nil && !capable {
+			check.Status = false
+			check.report(msg("preflight.noNetRaw"))
+			check.remedy(msg("hint.netRaw"))
+		} else {
+			check.Status = true
+			check.report(msg("preflight.netRaw"))
+		}
+		checks = append(checks, check)
+	}
+	// === Check 10: Host Networking (containers) ===
+	{
+		check := &PreflightCheck{Name: "Host Networking", Required: false}
+		if container := containerRuntime(); container == "" {
+			check.Status = true
+			check.report(msg("preflight.onHost"))
+		} else if ifaces := isolatedInterfaces(); len(ifaces) > 0 {
+			check.Status = false
+			check.report(msg("preflight.noHostNetwork", container, strings.Join(ifaces, ", ")))
+			check.remedy(msg("hint.hostNetwork"))
+		} else {
+			check.Status = true
+			check.report(msg("preflight.hostNetwork", container))
+		}
+		checks = append(checks, check)
+	}
+	// === Check 11: Time Synchronization (NTP) ===
+	{
+		check := &PreflightCheck{Name: "Time Synchronization", Required: false}
+		switch synced, known, estError := clockSync(); {
+		case !known:
+			check.Status = false
+			check.report(msg("preflight.clockUnknown"))
+		case !synced:
+			check.Status = false
+			check.report(msg("preflight.clockUnsynced"))
+			check.remedy(msg("hint.clockSync"))
+		default:
+			check.Status = true
+			check.report(msg("preflight.clockSynced", estError.String()))
+		}
+		checks = append(checks, check)
+	}
 
 	ok = true
 	for _, check := range checks {
@@ -399,7 +1002,7 @@ func runPreflightChecks(ctx context.Context) (checks []*PreflightCheck, ok bool)
 
 // runGatewayCommand (Helper function, no changes)
 func runGatewayCommand(ctx context.Context, name string, args ...string) error {
-	cmd := exec.CommandContext(ctx, name, args...)
+	cmd := command(ctx, name, args...)
 	log.Printf("[INFO] GATEWAY_MODE: Running command: %s", cmd.String())
 
 	if output, err := cmd.CombinedOutput(); err != nil {
@@ -415,50 +1018,39 @@ func runGatewayCommand(ctx context.Context, name string, args ...string) error {
 func enableGatewayMode(ctx context.Context) error {
 	log.Println("[INFO] GATEWAY_MODE: Enabling Default Gateway Mode...")
 
-	if err := runGatewayCommand(ctx, "sysctl", "-w", "net.ipv4.ip_forward=1"); err != nil {
-		return fmt.Errorf("failed to set net.ipv4.ip_forward: %w", err)
-	}
-
-	cmd := exec.CommandContext(ctx, "ip", "route", "show", "default")
-	output, err := cmd.Output()
+	wanIface, err := defaultRouteIface(ctx, "-4")
 	if err != nil {
 		return fmt.Errorf("failed to get default route. Cannot determine WAN interface: %w", err)
 	}
-
-	wanIface := ""
-	scanner := bufio.NewScanner(bytes.NewReader(output))
-	for scanner.Scan() {
-		line := scanner.Text()
-		if strings.HasPrefix(line, "default") {
-			parts := strings.Fields(line)
-			for i, part := range parts {
-				if part == "dev" && i+1 < len(parts) {
-					wanIface = parts[i+1]
-					break
-				}
-			}
-		}
-		if wanIface != "" {
-			break
+	wanIface6 := ""
+	if hasIPv6 {
+		if wanIface6, err = defaultRouteIface(ctx, "-6"); err != nil {
+			log.Printf("[WARN] GATEWAY_MODE: Failed to get the IPv6 default route: %v", err)
 		}
 	}
-
-	if wanIface == "" {
-		return fmt.Errorf("could not parse default route to find 'dev' interface from: %s", string(output))
+	if wanIface == "" && wanIface6 == "" {
+		return fmt.Errorf("could not find a default route (IPv4 or IPv6) to determine the WAN interface")
 	}
-	log.Printf("[INFO] GATEWAY_MODE: Detected WAN interface: %s", wanIface)
 
-	if err := runGatewayCommand(ctx, "iptables", "-t", "nat", "-A", "POSTROUTING", "-o", wanIface, "-j", "MASQUERADE"); err != nil {
-		return fmt.Errorf("failed to apply NAT/MASQUERADE rule: %w", err)
-	}
-	if err := runGatewayCommand(ctx, "iptables", "-A", "FORWARD", "-o", wanIface, "-j", "ACCEPT"); err != nil {
-		return fmt.Errorf("failed to apply FORWARD (out) rule: %w", err)
+	if wanIface != "" {
+		log.Printf("[INFO] GATEWAY_MODE: Detected WAN interface: %s", wanIface)
+		if err := enableForwarding(ctx, "iptables", "net.ipv4.ip_forward=1", wanIface); err != nil {
+			return err
+		}
 	}
-	if err := runGatewayCommand(ctx, "iptables", "-A", "FORWARD", "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"); err != nil {
-		return fmt.Errorf("failed to apply FORWARD (state) rule: %w", err)
+	// IPv6-only hosts forward (and masquerade) IPv6 alone; on dual-stack
+	// hosts IPv6 is best effort.
+	if wanIface6 != "" {
+		log.Printf("[INFO] GATEWAY_MODE: Detected IPv6 WAN interface: %s", wanIface6)
+		if err := enableForwarding(ctx, "ip6tables", "net.ipv6.conf.all.forwarding=1", wanIface6); err != nil {
+			if wanIface == "" {
+				return err
+			}
+			log.Printf("[WARN] GATEWAY_MODE: IPv6 is not forwarded (IPv4 is): %v", err)
+		}
 	}
 
-	if os.Getenv("RECONFIGURE_FIREWALL") == "true" {
+	if setting("RECONFIGURE_FIREWALL") == "true" {
 		log.Println("[INFO] GATEWAY_MODE: RECONFIGURE_FIREWALL=true detected.")
 		if _, err := exec.LookPath("ufw"); err == nil {
 			log.Println("[INFO] GATEWAY_MODE: ufw found, attempting to disable it...")
@@ -474,10 +1066,67 @@ func enableGatewayMode(ctx context.Context) error {
 		log.Println("[WARN] GATEWAY_MODE: WARNING: If ufw is active, it may block forwarded traffic. Set RECONFIGURE_FIREWALL=true or configure ufw manually.")
 	}
 
+	gateway.wanIface4 = wanIface
+	if wanIface == "" {
+		wanIface = wanIface6
+	}
+	gateway.enabled, gateway.wanIface = true, wanIface
 	log.Println("[INFO] GATEWAY_MODE: Successfully enabled. Host is now a gateway.")
 	return nil
 }
 
+// defaultRouteIface returns the device of the default route of family
+// ("-4" or "-6"), or "" when there is none.
+func defaultRouteIface(ctx context.Context, family string) (string, error) {
+	output, err := command(ctx, "ip", family, "route", "show", "default").Output()
+	if err != nil {
+		return "", err
+	}
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "default") {
+			continue
+		}
+		parts := strings.Fields(line)
+		for i, part := range parts {
+			if part == "dev" && i+1 < len(parts) {
+				return parts[i+1], nil
+			}
+		}
+	}
+	return "", nil
+}
+
+// enableForwarding turns on forwarding (the sysctl setting) and masquerades
+// the traffic forwarded out of wanIface, with iptables or ip6tables.
+func enableForwarding(ctx context.Context, iptables, sysctl, wanIface string) error {
+	if err := runGatewayCommand(ctx, "sysctl", "-w", sysctl); err != nil {
+		return fmt.Errorf("failed to set %s: %w", sysctl, err)
+	}
+	if err := addGatewayRule(ctx, iptables, "nat", "POSTROUTING", "-o", wanIface, "-j", "MASQUERADE"); err != nil {
+		return fmt.Errorf("failed to apply NAT/MASQUERADE rule: %w", err)
+	}
+	if err := addGatewayRule(ctx, iptables, "filter", "FORWARD", "-o", wanIface, "-j", "ACCEPT"); err != nil {
+		return fmt.Errorf("failed to apply FORWARD (out) rule: %w", err)
+	}
+	if err := addGatewayRule(ctx, iptables, "filter", "FORWARD", "-m", "state", "--state", "RELATED,ESTABLISHED", "-j", "ACCEPT"); err != nil {
+		return fmt.Errorf("failed to apply FORWARD (state) rule: %w", err)
+	}
+	return nil
+}
+
+// addGatewayRule appends a rule to chain, tagged with gatewayRuleComment,
+// unless an identical rule (e.g. kept from a previous run) is there.
+func addGatewayRule(ctx context.Context, iptables, table, chain string, spec ...string) error {
+	rule := append([]string{chain, "-m", "comment", "--comment", gatewayRuleComment}, spec...)
+	if command(ctx, iptables, append([]string{"-t", table, "-C"}, rule...)...).Run() == nil {
+		log.Printf("[INFO] GATEWAY_MODE: Keeping the existing %s rule: %s", iptables, strings.Join(rule, " "))
+		return nil
+	}
+	return runGatewayCommand(ctx, iptables, append([]string{"-t", table, "-A"}, rule...)...)
+}
+
 // logStartupInfo prints the welcome message with access ports and IPs.
 func logStartupInfo(apiPort string, ifaces []*TcInterface) {
 	squidPort := "3128" // This is static from our Dockerfile
@@ -497,7 +1146,10 @@ func logStartupInfo(apiPort string, ifaces []*TcInterface) {
 		for _, iface := range ifaces {
 			if iface.IPv4 != nil {
 				// Log other IPs, making it clear they use the same ports
-				log.Printf("[INFO]   - http://%s:%s (Interface: %s)", iface.IPv4.String(), apiPort, iface.Name)
+				log.Printf("[INFO]   - %s://%s:%s (Interface: %s)", apiScheme(), iface.IPv4.String(), apiPort, iface.Name)
+			}
+			if iface.IPv6 != nil && !net.IP(iface.IPv6).IsLinkLocalUnicast() {
+				log.Printf("[INFO]   - %s://[%s]:%s (Interface: %s)", apiScheme(), iface.IPv6.String(), apiPort, iface.Name)
 			}
 		}
 	} else {
@@ -0,0 +1,496 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Packet Mangling (truncation and bit flips) ---
+
+// PacketMangle truncates packets of one interface and direction, and/or
+// flips bits at fixed positions of their headers, for fuzz-like robustness
+// testing of parsers and drivers. An iptables NFQUEUE rule hands a random
+// 'rate' % of the packets to us; we rewrite them and give them back.
+type PacketMangle struct {
+	Iface     string    `json:"iface"`
+	Direction string    `json:"direction"`
+	Rate      float64   `json:"rate"`               // % of packets
+	Truncate  string    `json:"truncate,omitempty"` // bytes kept (IP header included), or "random"
+	Flips     []BitFlip `json:"flips,omitempty"`
+	Checksums string    `json:"checksums"` // "fix" (lengths and checksums recomputed) or "keep"
+	Queue     uint16    `json:"queue"`     // NFQUEUE queue number
+	Started   TcTime    `json:"started"`
+
+	mu       sync.Mutex
+	Mangled  uint64 `json:"mangled"` // packets changed
+	Skipped  uint64 `json:"skipped"` // packets of protected ports, or not IP
+	truncate int    // parsed Truncate; 0 is random
+	cancel   context.CancelFunc
+	done     chan struct{}
+}
+
+// BitFlip flips the bits of Mask in the byte at Offset of a layer: "ip"
+// (from the IP header), "l4" (from the TCP/UDP header) or "payload" (after
+// it). Bytes past the end of the packet are left alone.
+type BitFlip struct {
+	Layer  string `json:"layer"`
+	Offset int    `json:"offset"`
+	Mask   uint8  `json:"mask"`
+}
+
+const (
+	// mangleRuleComment tags the NFQUEUE rules, so a later run can recognize
+	// them (see cleanupLeftoverFirewall).
+	mangleRuleComment = gatewayRuleComment + "-mangle"
+	// mangleQueueBase is the first NFQUEUE queue number we use ("NS").
+	mangleQueueBase = 0x4e53
+)
+
+var (
+	manglesMu sync.Mutex
+	mangles   = map[string]*PacketMangle{} // by iface/direction
+)
+
+// parsePacketMangle reads a mangle from the query: iface, direction, rate,
+// truncate, flip (layer:offset:mask, repeated or comma-separated) and
+// checksums.
+func parsePacketMangle(q url.Values) (*PacketMangle, error) {
+	m := &PacketMangle{
+		Iface:     q.Get("iface"),
+		Direction: q.Get("direction"),
+		Truncate:  q.Get("truncate"),
+		Checksums: q.Get("checksums"),
+		Started:   TcTime(time.Now()),
+	}
+	if m.Iface == "" {
+		return nil, fmt.Errorf("mangle: 'iface' is required")
+	}
+	if m.Direction != "outgoing" && m.Direction != "incoming" {
+		return nil, fmt.Errorf("mangle: 'direction' must be 'outgoing' or 'incoming'")
+	}
+	rate, ok := parseTCNumber(q.Get("rate"))
+	if !ok || rate <= 0 || rate > 100 {
+		return nil, fmt.Errorf("mangle: 'rate' must be a percentage above 0 and up to 100")
+	}
+	m.Rate = rate
+	if m.Truncate != "" && m.Truncate != "random" {
+		n, err := strconv.Atoi(m.Truncate)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("mangle: 'truncate' must be a number of bytes or 'random', got %q", m.Truncate)
+		}
+		m.truncate = n
+	}
+	for _, value := range q["flip"] {
+		for _, spec := range strings.Split(value, ",") {
+			if spec = strings.TrimSpace(spec); spec == "" {
+				continue
+			}
+			flip, err := parseBitFlip(spec)
+			if err != nil {
+				return nil, err
+			}
+			m.Flips = append(m.Flips, flip)
+		}
+	}
+	if m.Truncate == "" && len(m.Flips) == 0 {
+		return nil, fmt.Errorf("mangle: set 'truncate' and/or 'flip'")
+	}
+	switch m.Checksums {
+	case "":
+		m.Checksums = "fix"
+	case "fix", "keep":
+	default:
+		return nil, fmt.Errorf("mangle: 'checksums' must be 'fix' or 'keep'")
+	}
+	return m, nil
+}
+
+// parseBitFlip parses "layer:offset:mask", e.g. "l4:13:0x02" (TCP SYN).
+func parseBitFlip(spec string) (BitFlip, error) {
+	parts := strings.Split(spec, ":")
+	if len(parts) != 3 {
+		return BitFlip{}, fmt.Errorf("mangle: invalid 'flip' %q (layer:offset:mask)", spec)
+	}
+	switch parts[0] {
+	case "ip", "l4", "payload":
+	default:
+		return BitFlip{}, fmt.Errorf("mangle: invalid 'flip' layer %q (ip, l4, payload)", parts[0])
+	}
+	offset, err := strconv.Atoi(parts[1])
+	if err != nil || offset < 0 || offset > 65535 {
+		return BitFlip{}, fmt.Errorf("mangle: invalid 'flip' offset %q", parts[1])
+	}
+	mask, err := strconv.ParseUint(parts[2], 0, 8)
+	if err != nil || mask == 0 {
+		return BitFlip{}, fmt.Errorf("mangle: invalid 'flip' mask %q (1-255, e.g. 0x02)", parts[2])
+	}
+	return BitFlip{Layer: parts[0], Offset: offset, Mask: uint8(mask)}, nil
+}
+
+// key identifies the mangle in the registry.
+func (m *PacketMangle) key() string {
+	return m.Iface + "/" + m.Direction
+}
+
+// ruleSpec is the NFQUEUE rule of the mangle table: sampled in the kernel
+// (statistic match), so only the packets to change reach us. With
+// --queue-bypass, packets pass untouched when nothing listens on the queue
+// (e.g. after a crash).
+func (m *PacketMangle) ruleSpec() []string {
+	spec := []string{"POSTROUTING", "-o", m.Iface}
+	if m.Direction == "incoming" {
+		spec = []string{"PREROUTING", "-i", m.Iface}
+	}
+	if m.Rate < 100 {
+		spec = append(spec, "-m", "statistic", "--mode", "random", "--probability", strconv.FormatFloat(m.Rate/100, 'f', -1, 64))
+	}
+	return append(spec, "-m", "comment", "--comment", mangleRuleComment,
+		"-j", "NFQUEUE", "--queue-num", strconv.Itoa(int(m.Queue)), "--queue-bypass")
+}
+
+// firewallCommands are the iptables commands a rule is added with: both
+// families on IPv6 hosts.
+func firewallCommands() []string {
+	if hasIPv6 {
+		return []string{"iptables", "ip6tables"}
+	}
+	return []string{"iptables"}
+}
+
+// start binds the queue, then adds the rules that feed it.
+func (m *PacketMangle) start() error {
+	if _, err := net.InterfaceByName(m.Iface); err != nil {
+		return fmt.Errorf("mangle: interface '%s' not found", m.Iface)
+	}
+	queue, err := openNFQueue(m.Queue)
+	if err != nil {
+		return fmt.Errorf("mangle: %w", err)
+	}
+	// Not bound to a request context: the mangle outlives the API call.
+	ctx, cancel := context.WithCancel(context.Background())
+	m.cancel, m.done = cancel, make(chan struct{})
+	go m.serve(ctx, queue)
+
+	for _, iptables := range firewallCommands() {
+		if err := runFirewallCommand(ctx, "MANGLE", iptables, append([]string{"-t", "mangle", "-A"}, m.ruleSpec()...)...); err != nil {
+			m.stop()
+			return fmt.Errorf("mangle: failed to add the %s NFQUEUE rule: %w", iptables, err)
+		}
+	}
+	return nil
+}
+
+// stop deletes the rules and unbinds the queue.
+func (m *PacketMangle) stop() {
+	for _, iptables := range firewallCommands() {
+		args := append([]string{"-t", "mangle", "-D"}, m.ruleSpec()...)
+		if command(context.Background(), iptables, append([]string{"-t", "mangle", "-C"}, m.ruleSpec()...)...).Run() == nil {
+			runFirewallCommand(context.Background(), "MANGLE", iptables, args...)
+		}
+	}
+	if m.cancel != nil {
+		m.cancel()
+		<-m.done
+	}
+}
+
+// serve rewrites the queued packets until ctx is cancelled.
+func (m *PacketMangle) serve(ctx context.Context, queue *nfQueue) {
+	defer close(m.done)
+	defer queue.close()
+	for ctx.Err() == nil {
+		packets, err := queue.read()
+		if err != nil {
+			log.Printf("[ERROR] MANGLE: %s %s: %v (packets now pass untouched)", m.Iface, m.Direction, err)
+			return
+		}
+		for _, p := range packets {
+			payload, changed := m.mangleSafely(p.payload)
+			m.mu.Lock()
+			if changed {
+				m.Mangled++
+			} else {
+				m.Skipped++
+			}
+			m.mu.Unlock()
+			if err := queue.verdict(p.id, payload); err != nil {
+				log.Printf("[WARN] MANGLE: %s %s: verdict failed: %v", m.Iface, m.Direction, err)
+			}
+		}
+	}
+}
+
+// mangleSafely mangles pkt, and lets it pass untouched (nil: the kernel
+// keeps its copy) if mangling it panics, instead of taking the process
+// down with the queue.
+func (m *PacketMangle) mangleSafely(pkt []byte) (payload []byte, changed bool) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Printf("[ERROR] MANGLE: %s %s: packet of %d bytes passed untouched: %v", m.Iface, m.Direction, len(pkt), err)
+			payload, changed = nil, false
+		}
+	}()
+	return m.mangle(pkt)
+}
+
+// mangle truncates pkt (an IPv4 or IPv6 packet) and flips its bits, then
+// fixes its lengths and checksums unless Checksums is "keep". Packets of
+// protected ports, and packets that are not IP, are returned unchanged.
+func (m *PacketMangle) mangle(pkt []byte) ([]byte, bool) {
+	ipLen, proto := ipHeaderLen(pkt)
+	if ipLen == 0 || protectedPacket(pkt[ipLen:], proto) {
+		return pkt, false
+	}
+	version := pkt[0] >> 4 // (before a flip changes it)
+	if m.Truncate != "" {
+		n := m.truncate
+		if n == 0 && len(pkt) > ipLen {
+			n = ipLen + chaosIntn(len(pkt)-ipLen)
+		}
+		// The IP header stays whole, so the packet is still routed
+		if n = max(n, ipLen); n < len(pkt) {
+			pkt = pkt[:n]
+		}
+	}
+	l4Len := transportHeaderLen(pkt[ipLen:], proto)
+	for _, f := range m.Flips {
+		i := f.Offset
+		switch f.Layer {
+		case "l4":
+			i += ipLen
+		case "payload":
+			i += ipLen + l4Len
+		}
+		if i < len(pkt) {
+			pkt[i] ^= f.Mask
+		}
+	}
+	if m.Checksums == "fix" {
+		fixIPChecksums(pkt, version, ipLen, proto)
+	}
+	return pkt, true
+}
+
+// ipHeaderLen returns the length of the IP header of pkt and the protocol
+// of the transport header that follows (0 for a non-first IPv4 fragment),
+// or 0 when pkt is not IP. IPv6 extension headers are not followed.
+func ipHeaderLen(pkt []byte) (int, byte) {
+	switch {
+	case len(pkt) >= 20 && pkt[0]>>4 == 4:
+		ihl := int(pkt[0]&0x0f) * 4
+		if ihl < 20 || ihl > len(pkt) {
+			return 0, 0
+		}
+		if binary.BigEndian.Uint16(pkt[6:8])&0x1fff != 0 {
+			return ihl, 0
+		}
+		return ihl, pkt[9]
+	case len(pkt) >= 40 && pkt[0]>>4 == 6:
+		return 40, pkt[6]
+	}
+	return 0, 0
+}
+
+// transportHeaderLen returns the length of the TCP or UDP header at the
+// start of l4, or 0.
+func transportHeaderLen(l4 []byte, proto byte) int {
+	switch {
+	case proto == 6 && len(l4) >= 20:
+		return min(int(l4[12]>>4)*4, len(l4))
+	case proto == 17 && len(l4) >= 8:
+		return 8
+	}
+	return 0
+}
+
+// protectedPacket reports whether a TCP segment belongs to a protected port
+// (the API, the L7 proxy, ...), which is never mangled.
+func protectedPacket(l4 []byte, proto byte) bool {
+	if proto != 6 || len(l4) < 4 {
+		return false
+	}
+	return protectedListener(strconv.Itoa(int(binary.BigEndian.Uint16(l4[0:2])))) != "" ||
+		protectedListener(strconv.Itoa(int(binary.BigEndian.Uint16(l4[2:4])))) != ""
+}
+
+// fixIPChecksums sets the lengths of the IP (and UDP) header to the size of
+// pkt and recomputes the IPv4 header and TCP/UDP checksums, so a truncated
+// or flipped packet reaches the parsers instead of being dropped by the
+// receiver's stack. version, ipLen and proto are those of the packet before
+// it was mangled. A transport header cut short is left as is.
+func fixIPChecksums(pkt []byte, version byte, ipLen int, proto byte) {
+	if version == 4 && (ipLen < 20 || len(pkt) < ipLen) || version == 6 && len(pkt) < 40 || version != 4 && version != 6 {
+		return
+	}
+	l4 := pkt[ipLen:]
+	var pseudo []byte
+	if version == 4 {
+		binary.BigEndian.PutUint16(pkt[2:4], uint16(len(pkt)))
+		binary.BigEndian.PutUint16(pkt[10:12], 0)
+		binary.BigEndian.PutUint16(pkt[10:12], icmpChecksum(pkt[:ipLen]))
+		pseudo = append(pseudo, pkt[12:20]...)
+		pseudo = append(pseudo, 0, proto)
+		pseudo = binary.BigEndian.AppendUint16(pseudo, uint16(len(l4)))
+	} else {
+		binary.BigEndian.PutUint16(pkt[4:6], uint16(len(l4)))
+		pseudo = append(pseudo, pkt[8:40]...)
+		pseudo = binary.BigEndian.AppendUint32(pseudo, uint32(len(l4)))
+		pseudo = append(pseudo, 0, 0, 0, proto)
+	}
+
+	csum := -1
+	switch {
+	case proto == 6 && len(l4) >= 20:
+		csum = 16
+	case proto == 17 && len(l4) >= 8:
+		binary.BigEndian.PutUint16(l4[4:6], uint16(len(l4)))
+		csum = 6
+	}
+	if csum < 0 {
+		return
+	}
+	binary.BigEndian.PutUint16(l4[csum:csum+2], 0)
+	sum := icmpChecksum(append(pseudo, l4...))
+	if sum == 0 && proto == 17 {
+		sum = 0xffff // 0 means "no checksum" in UDP
+	}
+	binary.BigEndian.PutUint16(l4[csum:csum+2], sum)
+}
+
+// runFirewallCommand runs an iptables command of a feature (the log tag,
+// e.g. "MANGLE"), logging it.
+func runFirewallCommand(ctx context.Context, feature, name string, args ...string) error {
+	cmd := command(ctx, name, args...)
+	log.Printf("[INFO] %s: Executing: %s", feature, cmd.String())
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if out := strings.TrimSpace(string(output)); out != "" {
+			return fmt.Errorf("%s: %w", out, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// nextMangleQueue returns the lowest free queue number. Must be called with
+// manglesMu held.
+func nextMangleQueue() uint16 {
+	used := map[uint16]bool{}
+	for _, m := range mangles {
+		used[m.Queue] = true
+	}
+	queue := uint16(mangleQueueBase)
+	for used[queue] {
+		queue++
+	}
+	return queue
+}
+
+// removeMangles stops the mangles of iface (direction "" for both) and
+// reports whether there were any.
+func removeMangles(iface, direction string) bool {
+	manglesMu.Lock()
+	defer manglesMu.Unlock()
+	found := false
+	for key, m := range mangles {
+		if m.Iface == iface && (direction == "" || m.Direction == direction) {
+			m.stop()
+			delete(mangles, key)
+			log.Printf("[INFO] MANGLE: Stopped mangling %s %s", m.Iface, m.Direction)
+			found = true
+		}
+	}
+	return found
+}
+
+// removeAllMangles stops every mangle (e.g. on reset-all and shutdown).
+func removeAllMangles() {
+	manglesMu.Lock()
+	defer manglesMu.Unlock()
+	for key, m := range mangles {
+		m.stop()
+		delete(mangles, key)
+	}
+}
+
+// packetMangling reports whether mangles can run on this host.
+func packetMangling() bool {
+	_, err := exec.LookPath("iptables")
+	return !isDarwin && err == nil
+}
+
+// --- Handlers: /mangle ---
+
+// handleMangleSetup starts (or replaces) the mangle of 'iface' in
+// 'direction'.
+func handleMangleSetup(w http.ResponseWriter, r *http.Request) {
+	m, err := parsePacketMangle(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	if isDarwin {
+		log.Println("[INFO] MANGLE: Darwin: Ignoring mangle setup")
+		respondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	removeMangles(m.Iface, m.Direction)
+	manglesMu.Lock()
+	defer manglesMu.Unlock()
+	m.Queue = nextMangleQueue()
+	if err := m.start(); err != nil {
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	mangles[m.key()] = m
+	log.Printf("[INFO] MANGLE: Mangling %.4g%% of the %s packets of %s (queue %d)", m.Rate, m.Direction, m.Iface, m.Queue)
+	respondWithJSON(w, http.StatusOK, m)
+}
+
+// handleMangleReset stops mangling 'iface' ('direction', default both).
+func handleMangleReset(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !removeMangles(q.Get("iface"), q.Get("direction")) {
+		respondWithError(w, fmt.Sprintf("mangle: no mangle on '%s'", q.Get("iface")), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// handleMangleList returns the active mangles and their counters.
+func handleMangleList(w http.ResponseWriter, r *http.Request) {
+	manglesMu.Lock()
+	defer manglesMu.Unlock()
+	list := make([]map[string]interface{}, 0, len(mangles))
+	for _, m := range mangles {
+		m.mu.Lock()
+		list = append(list, map[string]interface{}{
+			"iface":     m.Iface,
+			"direction": m.Direction,
+			"rate":      m.Rate,
+			"truncate":  m.Truncate,
+			"flips":     m.Flips,
+			"checksums": m.Checksums,
+			"queue":     m.Queue,
+			"started":   m.Started,
+			"mangled":   m.Mangled,
+			"skipped":   m.Skipped,
+		})
+		m.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return fmt.Sprint(list[i]["iface"], list[i]["direction"]) < fmt.Sprint(list[j]["iface"], list[j]["direction"])
+	})
+	respondWithJSON(w, http.StatusOK, list)
+}
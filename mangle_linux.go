@@ -0,0 +1,219 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"syscall"
+)
+
+// --- NFQUEUE (netlink) ---
+
+// The nfnetlink_queue protocol (linux/netfilter/nfnetlink_queue.h), spoken
+// directly over a netlink socket: the kernel hands us the packets that the
+// NFQUEUE rule selected, and takes each one back with a verdict and,
+// optionally, new contents.
+const (
+	netlinkNetfilter = 12 // NETLINK_NETFILTER
+	nfnlSubsysQueue  = 3
+
+	nfqnlMsgPacket  = 0
+	nfqnlMsgVerdict = 1
+	nfqnlMsgConfig  = 2
+
+	nfqaPacketHdr  = 1
+	nfqaVerdictHdr = 2
+	nfqaPayload    = 10
+	nfqaCfgCmd     = 1
+	nfqaCfgParams  = 2
+
+	nfqnlCfgCmdBind   = 1
+	nfqnlCfgCmdUnbind = 2
+	nfqnlCopyPacket   = 2
+
+	nfDrop   = 0
+	nfAccept = 1
+
+	nlmsgError  = 2
+	nlmFRequest = 0x1
+	nlmFAck     = 0x4
+	nlaTypeMask = 0x3fff
+)
+
+// nfQueue is a bound NFQUEUE queue.
+type nfQueue struct {
+	fd  int
+	num uint16
+	seq uint32
+	buf []byte
+}
+
+// queuedPacket is a packet handed over by the kernel.
+type queuedPacket struct {
+	id      uint32
+	payload []byte
+}
+
+// openNFQueue binds queue num and asks for whole packets. Reads time out
+// every second, so the caller can notice it was stopped.
+func openNFQueue(num uint16) (*nfQueue, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, netlinkNetfilter)
+	if err != nil {
+		return nil, fmt.Errorf("nfqueue: failed to open a netlink socket: %w", err)
+	}
+	q := &nfQueue{fd: fd, num: num, buf: make([]byte, 256*1024)}
+	if err := syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK}); err != nil {
+		q.close()
+		return nil, fmt.Errorf("nfqueue: failed to bind the netlink socket: %w", err)
+	}
+	tv := syscall.Timeval{Sec: 1}
+	if err := syscall.SetsockoptTimeval(fd, syscall.SOL_SOCKET, syscall.SO_RCVTIMEO, &tv); err != nil {
+		q.close()
+		return nil, fmt.Errorf("nfqueue: failed to set the read timeout: %w", err)
+	}
+	// A larger buffer absorbs bursts; without it the kernel drops (or, with
+	// --queue-bypass, still queues and drops) packets we are too slow for.
+	syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVBUF, 4<<20)
+
+	bind := []byte{nfqnlCfgCmdBind, 0, 0, 0} // command, pad, pf (any)
+	if err := q.request(nfqnlMsgConfig, attr(nfqaCfgCmd, bind)); err != nil {
+		q.close()
+		return nil, fmt.Errorf("nfqueue: failed to bind queue %d (is it used by another program?): %w", num, err)
+	}
+	params := make([]byte, 5) // copy range, copy mode
+	binary.BigEndian.PutUint32(params, 0xffff)
+	params[4] = nfqnlCopyPacket
+	if err := q.request(nfqnlMsgConfig, attr(nfqaCfgParams, params)); err != nil {
+		q.close()
+		return nil, fmt.Errorf("nfqueue: failed to configure queue %d: %w", num, err)
+	}
+	return q, nil
+}
+
+// close unbinds the queue: the rule's --queue-bypass lets packets through
+// from then on.
+func (q *nfQueue) close() {
+	q.send(nfqnlMsgConfig, 0, attr(nfqaCfgCmd, []byte{nfqnlCfgCmdUnbind, 0, 0, 0}))
+	syscall.Close(q.fd)
+}
+
+// read returns the next packets, or none when the read timed out.
+func (q *nfQueue) read() ([]queuedPacket, error) {
+	n, _, err := syscall.Recvfrom(q.fd, q.buf, 0)
+	if err != nil {
+		if errors.Is(err, syscall.EAGAIN) || errors.Is(err, syscall.EINTR) {
+			return nil, nil
+		}
+		if errors.Is(err, syscall.ENOBUFS) {
+			return nil, nil // We fell behind: the kernel dropped packets
+		}
+		return nil, fmt.Errorf("nfqueue: read failed: %w", err)
+	}
+	msgs, err := syscall.ParseNetlinkMessage(q.buf[:n])
+	if err != nil {
+		return nil, fmt.Errorf("nfqueue: malformed netlink message: %w", err)
+	}
+	var packets []queuedPacket
+	for _, m := range msgs {
+		if m.Header.Type != nfnlSubsysQueue<<8|nfqnlMsgPacket || len(m.Data) < 4 {
+			continue
+		}
+		var p queuedPacket
+		hasID := false
+		for data := m.Data[4:]; len(data) >= 4; {
+			l := int(binary.NativeEndian.Uint16(data[0:2]))
+			if l < 4 || l > len(data) {
+				break
+			}
+			value := data[4:l]
+			switch binary.NativeEndian.Uint16(data[2:4]) & nlaTypeMask {
+			case nfqaPacketHdr:
+				if len(value) >= 4 {
+					p.id, hasID = binary.BigEndian.Uint32(value[0:4]), true
+				}
+			case nfqaPayload:
+				p.payload = append([]byte(nil), value...)
+			}
+			data = data[min(align4(l), len(data)):]
+		}
+		if hasID {
+			packets = append(packets, p)
+		}
+	}
+	return packets, nil
+}
+
+// verdict accepts packet id, with payload as its new contents (nil keeps
+// them).
+func (q *nfQueue) verdict(id uint32, payload []byte) error {
+	attrs := verdictHeader(id, nfAccept)
+	if payload != nil {
+		attrs = append(attrs, attr(nfqaPayload, payload)...)
+	}
+	return q.send(nfqnlMsgVerdict, 0, attrs)
+}
+
+// drop drops packet id.
+func (q *nfQueue) drop(id uint32) error {
+	return q.send(nfqnlMsgVerdict, 0, verdictHeader(id, nfDrop))
+}
+
+// verdictHeader encodes the verdict attribute of packet id.
+func verdictHeader(id, verdict uint32) []byte {
+	hdr := make([]byte, 8)
+	binary.BigEndian.PutUint32(hdr[0:4], verdict)
+	binary.BigEndian.PutUint32(hdr[4:8], id)
+	return attr(nfqaVerdictHdr, hdr)
+}
+
+// request sends a message and waits for the kernel's acknowledgment.
+func (q *nfQueue) request(msgType uint16, attrs []byte) error {
+	if err := q.send(msgType, nlmFAck, attrs); err != nil {
+		return err
+	}
+	for {
+		n, _, err := syscall.Recvfrom(q.fd, q.buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(q.buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Type == nlmsgError && m.Header.Seq == q.seq && len(m.Data) >= 4 {
+				if errno := int32(binary.NativeEndian.Uint32(m.Data[0:4])); errno != 0 {
+					return syscall.Errno(-errno)
+				}
+				return nil
+			}
+		}
+	}
+}
+
+// send writes one nfnetlink_queue message for the queue.
+func (q *nfQueue) send(msgType, flags uint16, attrs []byte) error {
+	q.seq++
+	msg := make([]byte, 16+4, 16+4+len(attrs))
+	binary.NativeEndian.PutUint32(msg[0:4], uint32(16+4+len(attrs)))
+	binary.NativeEndian.PutUint16(msg[4:6], nfnlSubsysQueue<<8|msgType)
+	binary.NativeEndian.PutUint16(msg[6:8], nlmFRequest|flags)
+	binary.NativeEndian.PutUint32(msg[8:12], q.seq)
+	msg[16] = syscall.AF_UNSPEC // nfgenmsg: family, version, queue number
+	binary.BigEndian.PutUint16(msg[18:20], q.num)
+	msg = append(msg, attrs...)
+	return syscall.Sendto(q.fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+}
+
+// attr encodes a netlink attribute, padded to 4 bytes.
+func attr(typ uint16, value []byte) []byte {
+	b := make([]byte, align4(4+len(value)))
+	binary.NativeEndian.PutUint16(b[0:2], uint16(4+len(value)))
+	binary.NativeEndian.PutUint16(b[2:4], typ)
+	copy(b[4:], value)
+	return b
+}
+
+func align4(n int) int {
+	return (n + 3) &^ 3
+}
@@ -0,0 +1,31 @@
+//go:build !linux
+
+package main
+
+import "fmt"
+
+// nfQueue is unavailable outside Linux (there is no netfilter).
+type nfQueue struct{}
+
+type queuedPacket struct {
+	id      uint32
+	payload []byte
+}
+
+func openNFQueue(num uint16) (*nfQueue, error) {
+	return nil, fmt.Errorf("nfqueue: packet mangling needs Linux")
+}
+
+func (q *nfQueue) close() {}
+
+func (q *nfQueue) read() ([]queuedPacket, error) {
+	return nil, nil
+}
+
+func (q *nfQueue) verdict(id uint32, payload []byte) error {
+	return nil
+}
+
+func (q *nfQueue) drop(id uint32) error {
+	return nil
+}
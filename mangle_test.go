@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bytes"
+	"testing"
+)
+
+// ipv4UDP is a 28-byte IPv4/UDP packet without payload.
+var ipv4UDP = []byte{
+	0x45, 0x00, 0x00, 0x1c, 0x00, 0x01, 0x00, 0x00, 0x40, 0x11, 0x00, 0x00,
+	10, 0, 0, 1, 10, 0, 0, 2,
+	0x13, 0x88, 0x13, 0x89, 0x00, 0x08, 0x00, 0x00,
+}
+
+func TestMangleVersionFlip(t *testing.T) {
+	// 4 -> 6: the packet is shorter than an IPv6 header
+	m := &PacketMangle{Flips: []BitFlip{{Layer: "ip", Offset: 0, Mask: 0x20}}, Checksums: "fix"}
+	pkt, changed := m.mangleSafely(bytes.Clone(ipv4UDP))
+	if !changed || pkt == nil {
+		t.Fatalf("mangle(%x) = %x, %v; want the flipped packet", ipv4UDP, pkt, changed)
+	}
+	if pkt[0]>>4 != 6 {
+		t.Errorf("version = %d, want 6", pkt[0]>>4)
+	}
+	// The IPv4 header checksum was recomputed for the flipped header
+	if icmpChecksum(pkt[:20]) != 0 {
+		t.Errorf("IPv4 header checksum not fixed: %x", pkt[:20])
+	}
+}
+
+func TestMangleTruncateFixesLengths(t *testing.T) {
+	m := &PacketMangle{Truncate: "22", truncate: 22, Checksums: "fix"}
+	pkt, changed := m.mangleSafely(bytes.Clone(ipv4UDP))
+	if !changed || len(pkt) != 22 {
+		t.Fatalf("mangle(%x) = %x, %v; want 22 bytes", ipv4UDP, pkt, changed)
+	}
+	if total := int(pkt[2])<<8 | int(pkt[3]); total != 22 {
+		t.Errorf("total length = %d, want 22", total)
+	}
+}
+
+func FuzzMangle(f *testing.F) {
+	f.Add(ipv4UDP, 0, uint8(0x20), 0)
+	f.Add(ipv4UDP, 0, uint8(0x0f), 21)
+	f.Add(ipv4UDP[:20], 9, uint8(0x17), 0)
+	f.Add(append(make([]byte, 40), 1, 2, 3), 6, uint8(0x0b), 41)
+	f.Fuzz(func(t *testing.T, pkt []byte, offset int, mask uint8, truncate int) {
+		m := &PacketMangle{Flips: []BitFlip{{Layer: "ip", Offset: offset & 0xff, Mask: mask}}, Checksums: "fix"}
+		if truncate > 0 {
+			m.Truncate, m.truncate = "n", truncate
+		}
+		// mangle, not mangleSafely: a panic is the bug
+		m.mangle(bytes.Clone(pkt))
+		m.Flips[0].Layer = "l4"
+		m.mangle(bytes.Clone(pkt))
+	})
+}
@@ -0,0 +1,671 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// --- Message Catalog (Localization) ---
+
+// Message is a user-facing message of the catalog. It is rendered in the
+// client's language (Accept-Language) when it reaches the API, and in
+// English as a plain error.
+type Message struct {
+	Code string
+	Args []interface{}
+}
+
+// msg returns the catalog message code with its format arguments.
+func msg(code string, args ...interface{}) *Message {
+	return &Message{Code: code, Args: args}
+}
+
+func (m *Message) Error() string {
+	return m.Render("en")
+}
+
+// Render formats the message in lang, falling back to English.
+func (m *Message) Render(lang string) string {
+	texts, ok := catalog[m.Code]
+	if !ok {
+		return m.Code
+	}
+	format, ok := texts[lang]
+	if !ok {
+		format = texts["en"]
+	}
+	return fmt.Sprintf(format, m.Args...)
+}
+
+// languages are the supported languages, English first (the default).
+var languages = []string{"en", "pt", "es"}
+
+// catalog maps message codes to their format string per language. Every
+// translation takes the same arguments, in the same order.
+var catalog = map[string]map[string]string{
+	// Preflight checks
+	"preflight.uidFailed": {
+		"en": "Failed to check UID: %v",
+		"pt": "Falha ao verificar o UID: %v",
+		"es": "No se pudo verificar el UID: %v",
+	},
+	"preflight.notRoot": {
+		"en": "OK (uid=%s, running with capabilities only; Default Gateway Mode needs root)",
+		"pt": "OK (uid=%s, executando apenas com capabilities; o Default Gateway Mode exige root)",
+		"es": "OK (uid=%s, ejecutándose solo con capabilities; el Default Gateway Mode requiere root)",
+	},
+	"preflight.root": {
+		"en": "OK (uid=0)",
+		"pt": "OK (uid=0)",
+		"es": "OK (uid=0)",
+	},
+	"preflight.binaryMissing": {
+		"en": "Binary '%s' not found. (Install with 'apt-get install iproute2')",
+		"pt": "Binário '%s' não encontrado. (Instale com 'apt-get install iproute2')",
+		"es": "No se encontró el binario '%s'. (Instálelo con 'apt-get install iproute2')",
+	},
+	"preflight.version": {
+		"en": "OK (%s)",
+		"pt": "OK (%s)",
+		"es": "OK (%s)",
+	},
+	"preflight.ifbMissing": {
+		"en": "Module 'ifb' not loaded. Ingress (incoming) rules will be limited to rate policing.",
+		"pt": "Módulo 'ifb' não carregado. Regras de entrada (incoming) ficarão limitadas ao policiamento de taxa.",
+		"es": "Módulo 'ifb' no cargado. Las reglas de entrada (incoming) se limitarán a la vigilancia de tasa (policing).",
+	},
+	"preflight.moduleLoaded": {
+		"en": "OK (Module '%s' is loaded)",
+		"pt": "OK (Módulo '%s' carregado)",
+		"es": "OK (Módulo '%s' cargado)",
+	},
+	"preflight.moduleRequired": {
+		"en": "Module '%s' not loaded. This is *required*.",
+		"pt": "Módulo '%s' não carregado. Ele é *obrigatório*.",
+		"es": "Módulo '%s' no cargado. Es *obligatorio*.",
+	},
+	"preflight.ipv6Missing": {
+		"en": "Host IPv6 stack not detected. IPv6 filter rules will be skipped.",
+		"pt": "Pilha IPv6 do host não detectada. As regras de filtro IPv6 serão ignoradas.",
+		"es": "No se detectó la pila IPv6 del host. Se omitirán las reglas de filtro IPv6.",
+	},
+	"preflight.ipv6": {
+		"en": "OK (IPv6 stack detected)",
+		"pt": "OK (pilha IPv6 detectada)",
+		"es": "OK (pila IPv6 detectada)",
+	},
+	"preflight.capUnknown": {
+		"en": "Could not read the capabilities (%v)",
+		"pt": "Não foi possível ler as capabilities (%v)",
+		"es": "No se pudieron leer las capabilities (%v)",
+	},
+	"preflight.noNetAdmin": {
+		"en": "The process lacks CAP_NET_ADMIN: every tc and ip change will fail with 'Operation not permitted'.",
+		"pt": "O processo não tem CAP_NET_ADMIN: toda alteração com tc e ip falhará com 'Operation not permitted'.",
+		"es": "El proceso no tiene CAP_NET_ADMIN: todo cambio con tc e ip fallará con 'Operation not permitted'.",
+	},
+	"preflight.netAdmin": {
+		"en": "OK (CAP_NET_ADMIN)",
+		"pt": "OK (CAP_NET_ADMIN)",
+		"es": "OK (CAP_NET_ADMIN)",
+	},
+	"preflight.noNetRaw": {
+		"en": "The process lacks CAP_NET_RAW: captures (calibration, mirror, sFlow export) will fail.",
+		"pt": "O processo não tem CAP_NET_RAW: as capturas (calibração, espelhamento, exportação sFlow) falharão.",
+		"es": "El proceso no tiene CAP_NET_RAW: las capturas (calibración, espejo, exportación sFlow) fallarán.",
+	},
+	"preflight.netRaw": {
+		"en": "OK (CAP_NET_RAW)",
+		"pt": "OK (CAP_NET_RAW)",
+		"es": "OK (CAP_NET_RAW)",
+	},
+	"preflight.onHost": {
+		"en": "OK (not in a container)",
+		"pt": "OK (fora de contêiner)",
+		"es": "OK (fuera de un contenedor)",
+	},
+	"preflight.noHostNetwork": {
+		"en": "Running in a %s container without host networking: only the container's own interfaces (%s) can be shaped, not the host's.",
+		"pt": "Executando em um contêiner %s sem rede do host: apenas as interfaces do próprio contêiner (%s) podem ser moldadas, não as do host.",
+		"es": "Ejecutándose en un contenedor %s sin red del host: solo se pueden modelar las interfaces del propio contenedor (%s), no las del host.",
+	},
+	"preflight.hostNetwork": {
+		"en": "OK (%s container with host networking)",
+		"pt": "OK (contêiner %s com rede do host)",
+		"es": "OK (contenedor %s con red del host)",
+	},
+	"preflight.clockSynced": {
+		"en": "OK (synchronized, estimated error %s)",
+		"pt": "OK (sincronizado, erro estimado %s)",
+		"es": "OK (sincronizado, error estimado %s)",
+	},
+	"preflight.clockUnsynced": {
+		"en": "The clock is not synchronized (NTP): wall-clock scenarios, curves and two-box scenarios drift, or jump when it is stepped",
+		"pt": "O relógio não está sincronizado (NTP): cenários no relógio de parede, curvas e cenários entre duas máquinas derivam, ou saltam quando ele é ajustado",
+		"es": "El reloj no está sincronizado (NTP): los escenarios con reloj de pared, las curvas y los escenarios entre dos equipos derivan, o saltan cuando se ajusta",
+	},
+	"preflight.clockUnknown": {
+		"en": "Cannot tell whether the clock is synchronized on this platform",
+		"pt": "Não é possível saber se o relógio está sincronizado nesta plataforma",
+		"es": "No se puede saber si el reloj está sincronizado en esta plataforma",
+	},
+	"hint.netAdmin": {
+		"en": "run the container with --cap-add=NET_ADMIN (cap_add: [NET_ADMIN] in docker-compose), or, outside containers, setcap cap_net_admin,cap_net_raw+ep on the binary",
+		"pt": "execute o contêiner com --cap-add=NET_ADMIN (cap_add: [NET_ADMIN] no docker-compose) ou, fora de contêineres, setcap cap_net_admin,cap_net_raw+ep no binário",
+		"es": "ejecute el contenedor con --cap-add=NET_ADMIN (cap_add: [NET_ADMIN] en docker-compose) o, fuera de contenedores, setcap cap_net_admin,cap_net_raw+ep en el binario",
+	},
+	"hint.netRaw": {
+		"en": "add --cap-add=NET_RAW (or, outside containers, setcap cap_net_admin,cap_net_raw+ep on the binary)",
+		"pt": "adicione --cap-add=NET_RAW (ou, fora de contêineres, setcap cap_net_admin,cap_net_raw+ep no binário)",
+		"es": "añada --cap-add=NET_RAW (o, fuera de contenedores, setcap cap_net_admin,cap_net_raw+ep en el binario)",
+	},
+	"hint.clockSync": {
+		"en": "enable NTP on the host (e.g. timedatectl set-ntp true, chrony or systemd-timesyncd; containers use the host's clock), or use clock=monotonic for scenarios on this box",
+		"pt": "ative o NTP no host (ex.: timedatectl set-ntp true, chrony ou systemd-timesyncd; contêineres usam o relógio do host), ou use clock=monotonic nos cenários desta máquina",
+		"es": "active NTP en el host (p. ej. timedatectl set-ntp true, chrony o systemd-timesyncd; los contenedores usan el reloj del host), o use clock=monotonic en los escenarios de este equipo",
+	},
+	"hint.hostNetwork": {
+		"en": "run the container with --net=host (network_mode: host in docker-compose)",
+		"pt": "execute o contêiner com --net=host (network_mode: host no docker-compose)",
+		"es": "ejecute el contenedor con --net=host (network_mode: host en docker-compose)",
+	},
+
+	// Rule validation
+	"rule.ifaceRequired": {
+		"en": "V4: 'iface' is required",
+		"pt": "V4: 'iface' é obrigatório",
+		"es": "V4: 'iface' es obligatorio",
+	},
+	"rule.directionRequired": {
+		"en": "V4: 'direction' is required",
+		"pt": "V4: 'direction' é obrigatório",
+		"es": "V4: 'direction' es obligatorio",
+	},
+	"rule.invalidDirection": {
+		"en": "V4: invalid 'direction' %q (outgoing or incoming)",
+		"pt": "V4: 'direction' inválido %q (outgoing ou incoming)",
+		"es": "V4: 'direction' no válido %q (outgoing o incoming)",
+	},
+	"rule.incomingSingleIface": {
+		"en": "V4: 'incoming' rules can only target a single interface, but %d matched",
+		"pt": "V4: regras 'incoming' só podem ter uma única interface como alvo, mas %d corresponderam",
+		"es": "V4: las reglas 'incoming' solo pueden aplicarse a una única interfaz, pero coincidieron %d",
+	},
+	"rule.invalidSeed": {
+		"en": "V4: invalid 'seed' %q (a decimal number up to 18446744073709551615)",
+		"pt": "V4: 'seed' inválido %q (um número decimal até 18446744073709551615)",
+		"es": "V4: 'seed' no válido %q (un número decimal hasta 18446744073709551615)",
+	},
+	"rule.seedUnsupported": {
+		"en": "V4: this host's tc cannot set netem's 'seed' (it needs a recent iproute2 and kernel)",
+		"pt": "V4: o tc deste host não consegue definir o 'seed' do netem (exige iproute2 e kernel recentes)",
+		"es": "V4: el tc de este host no puede fijar el 'seed' de netem (requiere iproute2 y kernel recientes)",
+	},
+	"rule.conflicts": {
+		"en": "V4: the rule conflicts with the configuration of the interface: %s (onConflict=ignore applies it anyway)",
+		"pt": "V4: a regra conflita com a configuração da interface: %s (onConflict=ignore a aplica mesmo assim)",
+		"es": "V4: la regla entra en conflicto con la configuración de la interfaz: %s (onConflict=ignore la aplica de todos modos)",
+	},
+	"rule.invalidOnConflict": {
+		"en": "V4: invalid 'onConflict' %q (fail or ignore)",
+		"pt": "V4: 'onConflict' inválido %q (fail ou ignore)",
+		"es": "V4: 'onConflict' no válido %q (fail o ignore)",
+	},
+	"conflict.foreignRoot": {
+		"en": "The %s root qdisc (handle %s) of '%s' was not created by netsim: the rule replaces it, and a reset does not restore it",
+		"pt": "A qdisc raiz %s (handle %s) de '%s' não foi criada pelo netsim: a regra a substitui, e um reset não a restaura",
+		"es": "La qdisc raíz %s (handle %s) de '%s' no fue creada por netsim: la regla la reemplaza, y un reset no la restaura",
+	},
+	"conflict.foreignIfbRoot": {
+		"en": "ifb0 carries a %s root qdisc (handle %s) that was not created by netsim: 'incoming' rules cannot be built on it",
+		"pt": "ifb0 tem uma qdisc raiz %s (handle %s) que não foi criada pelo netsim: regras 'incoming' não podem ser montadas nela",
+		"es": "ifb0 tiene una qdisc raíz %s (handle %s) que no fue creada por netsim: las reglas 'incoming' no pueden montarse en ella",
+	},
+	"conflict.ingressRedirect": {
+		"en": "The ingress of '%s' is already redirected to %s by a filter not created by netsim (pref %s): incoming traffic would bypass the rule",
+		"pt": "A entrada de '%s' já é redirecionada para %s por um filtro que não foi criado pelo netsim (pref %s): o tráfego de entrada escaparia da regra",
+		"es": "La entrada de '%s' ya se redirige a %s mediante un filtro que no fue creado por netsim (pref %s): el tráfico entrante eludiría la regla",
+	},
+	"conflict.ingressRedirectOverridden": {
+		"en": "The ingress of '%s' is redirected to %s by a filter not created by netsim (pref %s): the rule takes that traffic to ifb0 first",
+		"pt": "A entrada de '%s' é redirecionada para %s por um filtro que não foi criado pelo netsim (pref %s): a regra leva esse tráfego para o ifb0 antes",
+		"es": "La entrada de '%s' se redirige a %s mediante un filtro que no fue creado por netsim (pref %s): la regla lleva ese tráfico a ifb0 antes",
+	},
+	"conflict.filterPref": {
+		"en": "A filter not created by netsim already uses priority %s on the ingress of '%s', which the rule needs",
+		"pt": "Um filtro que não foi criado pelo netsim já usa a prioridade %s na entrada de '%s', de que a regra precisa",
+		"es": "Un filtro que no fue creado por netsim ya usa la prioridad %s en la entrada de '%s', que la regla necesita",
+	},
+	"hint.foreignRoot": {
+		"en": "save it first (tc qdisc show dev %s), or attach the rule below one of its classes with parentClass (coexistence mode)",
+		"pt": "salve-a antes (tc qdisc show dev %s), ou anexe a regra abaixo de uma das classes dela com parentClass (modo de coexistência)",
+		"es": "guárdela antes (tc qdisc show dev %s), o cuelgue la regla de una de sus clases con parentClass (modo de coexistencia)",
+	},
+	"hint.foreignIfbRoot": {
+		"en": "remove it (tc qdisc del dev ifb0 root) if nothing else uses ifb0, or use ingressMode=police",
+		"pt": "remova-a (tc qdisc del dev ifb0 root) se nada mais usa o ifb0, ou use ingressMode=police",
+		"es": "elimínela (tc qdisc del dev ifb0 root) si nada más usa ifb0, o use ingressMode=police",
+	},
+	"hint.ingressRedirect": {
+		"en": "remove that filter (tc filter del dev %s ingress pref %s), or impair the traffic on %s instead",
+		"pt": "remova esse filtro (tc filter del dev %s ingress pref %s), ou aplique a degradação em %s",
+		"es": "elimine ese filtro (tc filter del dev %s ingress pref %s), o degrade el tráfico en %s",
+	},
+	"hint.filterPref": {
+		"en": "move or remove that filter (tc filter del dev %s ingress pref %s)",
+		"pt": "mova ou remova esse filtro (tc filter del dev %s ingress pref %s)",
+		"es": "mueva o elimine ese filtro (tc filter del dev %s ingress pref %s)",
+	},
+	"rule.unknownParam": {
+		"en": "Unknown parameter '%s' was ignored",
+		"pt": "O parâmetro desconhecido '%s' foi ignorado",
+		"es": "Se ignoró el parámetro desconocido '%s'",
+	},
+	"rule.noIfaceMatched": {
+		"en": "V4: no interfaces matched the requested pattern",
+		"pt": "V4: nenhuma interface corresponde ao padrão solicitado",
+		"es": "V4: ninguna interfaz coincide con el patrón solicitado",
+	},
+	"rule.ifaceExcluded": {
+		"en": "V4: interface '%s' is excluded by IFACE_EXCLUDE/IFACE_INCLUDE",
+		"pt": "V4: a interface '%s' está excluída por IFACE_EXCLUDE/IFACE_INCLUDE",
+		"es": "V4: la interfaz '%s' está excluida por IFACE_EXCLUDE/IFACE_INCLUDE",
+	},
+	"rule.loopbackUnconfirmed": {
+		"en": "V4: '%s' is a loopback interface: confirm a rule on it with confirmLoopback=true",
+		"pt": "V4: '%s' é uma interface de loopback: confirme uma regra nela com confirmLoopback=true",
+		"es": "V4: '%s' es una interfaz de loopback: confirme una regla en ella con confirmLoopback=true",
+	},
+	"rule.loopbackOutgoing": {
+		"en": "V4: rules on '%s' must be 'outgoing' (every local packet leaves through it once, so 'outgoing' already impairs both directions)",
+		"pt": "V4: regras em '%s' devem ser 'outgoing' (cada pacote local sai por ela uma vez, então 'outgoing' já afeta as duas direções)",
+		"es": "V4: las reglas en '%s' deben ser 'outgoing' (cada paquete local sale por ella una vez, así que 'outgoing' ya afecta a ambas direcciones)",
+	},
+	"rule.shadowRefused": {
+		"en": "V4: the kernel refused the rule of '%s' in a scratch namespace, nothing was changed: %s",
+		"pt": "V4: o kernel recusou a regra de '%s' em um namespace de teste, nada foi alterado: %s",
+		"es": "V4: el kernel rechazó la regla de '%s' en un namespace de prueba, no se cambió nada: %s",
+	},
+	"rule.loopbackNetemTree": {
+		"en": "V4: tree=netem cannot keep the API unimpaired on '%s' (use htb or prio)",
+		"pt": "V4: tree=netem não consegue manter a API sem degradação em '%s' (use htb ou prio)",
+		"es": "V4: tree=netem no puede mantener la API sin degradación en '%s' (use htb o prio)",
+	},
+	"rule.ifbMissing": {
+		"en": "V4: 'ifb' module not loaded on host. 'incoming' rules can only be applied with ingressMode=police",
+		"pt": "V4: módulo 'ifb' não carregado no host. Regras 'incoming' só podem ser aplicadas com ingressMode=police",
+		"es": "V4: módulo 'ifb' no cargado en el host. Las reglas 'incoming' solo pueden aplicarse con ingressMode=police",
+	},
+	"rule.invalidIngressMode": {
+		"en": "V4: invalid 'ingressMode' %q (ifb or police)",
+		"pt": "V4: 'ingressMode' inválido %q (ifb ou police)",
+		"es": "V4: 'ingressMode' no válido %q (ifb o police)",
+	},
+	"rule.invalidFlowSample": {
+		"en": "V4: 'flowSamplePercent' must be a number in (0, 100], got %q",
+		"pt": "V4: 'flowSamplePercent' deve ser um número em (0, 100], recebido %q",
+		"es": "V4: 'flowSamplePercent' debe ser un número en (0, 100], se recibió %q",
+	},
+	"rule.invalidRate": {
+		"en": "V4: invalid 'rate' %q (e.g. 500kbit, 20mbit, 25gbit)",
+		"pt": "V4: 'rate' inválido %q (ex.: 500kbit, 20mbit, 25gbit)",
+		"es": "V4: 'rate' no válido %q (p. ej., 500kbit, 20mbit, 25gbit)",
+	},
+	"rule.invalidCeil": {
+		"en": "V4: invalid 'ceil' %q (e.g. 50mbit)",
+		"pt": "V4: 'ceil' inválido %q (ex.: 50mbit)",
+		"es": "V4: 'ceil' no válido %q (p. ej., 50mbit)",
+	},
+	"rule.ceilBelowRate": {
+		"en": "V4: 'ceil' (%s) must not be lower than 'rate' (%s)",
+		"pt": "V4: 'ceil' (%s) não pode ser menor que 'rate' (%s)",
+		"es": "V4: 'ceil' (%s) no puede ser menor que 'rate' (%s)",
+	},
+	"rule.invalidDelay": {
+		"en": "V4: '%s' must be a number of milliseconds >= 0, got %q",
+		"pt": "V4: '%s' deve ser um número de milissegundos >= 0, recebido %q",
+		"es": "V4: '%s' debe ser un número de milisegundos >= 0, se recibió %q",
+	},
+	"rule.invalidPercent": {
+		"en": "V4: '%s' must be a percentage in [0, 100], got %q",
+		"pt": "V4: '%s' deve ser uma porcentagem em [0, 100], recebido %q",
+		"es": "V4: '%s' debe ser un porcentaje en [0, 100], se recibió %q",
+	},
+	"rule.invalidReorderGap": {
+		"en": "V4: 'reorderGap' must be a whole number of packets >= 1, got %q",
+		"pt": "V4: 'reorderGap' deve ser um número inteiro de pacotes >= 1, recebido %q",
+		"es": "V4: 'reorderGap' debe ser un número entero de paquetes >= 1, se recibió %q",
+	},
+	"rule.requires": {
+		"en": "V4: '%s' requires '%s'",
+		"pt": "V4: '%s' exige '%s'",
+		"es": "V4: '%s' requiere '%s'",
+	},
+	"rule.invalidDistribution": {
+		"en": "V4: invalid 'distribution' %q (e.g. normal, pareto, paretonormal)",
+		"pt": "V4: 'distribution' inválido %q (ex.: normal, pareto, paretonormal)",
+		"es": "V4: 'distribution' no válido %q (p. ej., normal, pareto, paretonormal)",
+	},
+	"rule.invalidLossModel": {
+		"en": "V4: invalid 'lossModel' %q (none, random, state or gemodel)",
+		"pt": "V4: 'lossModel' inválido %q (none, random, state ou gemodel)",
+		"es": "V4: 'lossModel' no válido %q (none, random, state o gemodel)",
+	},
+	"rule.invalidSize": {
+		"en": "V4: invalid '%s' %q (e.g. 15k, 1mb)",
+		"pt": "V4: '%s' inválido %q (ex.: 15k, 1mb)",
+		"es": "V4: '%s' no válido %q (p. ej., 15k, 1mb)",
+	},
+	"rule.treeCannotLimit": {
+		"en": "V4: tree=%s cannot limit the rate: 'rate', 'ceil', 'burst', 'cburst' and 'flowSamplePercent' need tree=htb",
+		"pt": "V4: tree=%s não limita a taxa: 'rate', 'ceil', 'burst', 'cburst' e 'flowSamplePercent' exigem tree=htb",
+		"es": "V4: tree=%s no puede limitar la tasa: 'rate', 'ceil', 'burst', 'cburst' y 'flowSamplePercent' requieren tree=htb",
+	},
+	"rule.treeNeedsNetem": {
+		"en": "V4: tree=%s requires netem parameters (delay, loss, ...)",
+		"pt": "V4: tree=%s exige parâmetros do netem (delay, loss, ...)",
+		"es": "V4: tree=%s requiere parámetros de netem (delay, loss, ...)",
+	},
+	"rule.invalidTree": {
+		"en": "V4: invalid 'tree' %q (htb, prio or netem)",
+		"pt": "V4: 'tree' inválido %q (htb, prio ou netem)",
+		"es": "V4: 'tree' no válido %q (htb, prio o netem)",
+	},
+	"rule.policeNeedsRate": {
+		"en": "V4: 'incoming' rules in police mode require a 'rate'",
+		"pt": "V4: regras 'incoming' no modo police exigem um 'rate'",
+		"es": "V4: las reglas 'incoming' en modo police requieren un 'rate'",
+	},
+	"rule.policeNoNetem": {
+		"en": "V4: delay, loss and other netem options on 'incoming' rules need the 'ifb' module (police mode only limits the rate)",
+		"pt": "V4: atraso, perda e outras opções do netem em regras 'incoming' exigem o módulo 'ifb' (o modo police apenas limita a taxa)",
+		"es": "V4: el retardo, la pérdida y otras opciones de netem en reglas 'incoming' requieren el módulo 'ifb' (el modo police solo limita la tasa)",
+	},
+	"rule.policeNoClasses": {
+		"en": "V4: 'flowSamplePercent', 'ceil' and 'cburst' on 'incoming' rules need the 'ifb' module",
+		"pt": "V4: 'flowSamplePercent', 'ceil' e 'cburst' em regras 'incoming' exigem o módulo 'ifb'",
+		"es": "V4: 'flowSamplePercent', 'ceil' y 'cburst' en reglas 'incoming' requieren el módulo 'ifb'",
+	},
+	"rule.preserveMqOutgoing": {
+		"en": "V4: 'preserveMq' only applies to 'outgoing' rules",
+		"pt": "V4: 'preserveMq' só se aplica a regras 'outgoing'",
+		"es": "V4: 'preserveMq' solo se aplica a reglas 'outgoing'",
+	},
+	"rule.preserveMqIncompatible": {
+		"en": "V4: 'ceil', 'burst', 'cburst', 'flowSamplePercent' and 'tree' cannot be combined with 'preserveMq'",
+		"pt": "V4: 'ceil', 'burst', 'cburst', 'flowSamplePercent' e 'tree' não podem ser combinados com 'preserveMq'",
+		"es": "V4: 'ceil', 'burst', 'cburst', 'flowSamplePercent' y 'tree' no pueden combinarse con 'preserveMq'",
+	},
+	"rule.parentClassOutgoing": {
+		"en": "V4: 'parentClass' only applies to 'outgoing' rules",
+		"pt": "V4: 'parentClass' só se aplica a regras 'outgoing'",
+		"es": "V4: 'parentClass' solo se aplica a reglas 'outgoing'",
+	},
+	"rule.parentClassIncompatible": {
+		"en": "V4: 'parentClass' cannot be combined with 'preserveMq'",
+		"pt": "V4: 'parentClass' não pode ser combinado com 'preserveMq'",
+		"es": "V4: 'parentClass' no puede combinarse con 'preserveMq'",
+	},
+	"rule.invalidParentClass": {
+		"en": "V4: invalid 'parentClass' '%s' (a class id of the host's tree, e.g. 1:20)",
+		"pt": "V4: 'parentClass' inválido '%s' (um id de classe da árvore do host, ex.: 1:20)",
+		"es": "V4: 'parentClass' no válido '%s' (un id de clase del árbol del host, p. ej. 1:20)",
+	},
+	"rule.parentClassMissing": {
+		"en": "V4: class %s not found on '%s': coexistence needs a classful root qdisc with that class",
+		"pt": "V4: classe %s não encontrada em '%s': a coexistência exige uma qdisc raiz com classes que tenha essa classe",
+		"es": "V4: clase %s no encontrada en '%s': la coexistencia requiere una qdisc raíz con clases que tenga esa clase",
+	},
+	"rule.parentClassTaken": {
+		"en": "V4: class %s of '%s' already has a %s qdisc of the host: pick a class without a leaf qdisc of its own",
+		"pt": "V4: a classe %s de '%s' já tem uma qdisc %s do host: escolha uma classe sem qdisc folha própria",
+		"es": "V4: la clase %s de '%s' ya tiene una qdisc %s del host: elija una clase sin qdisc hoja propia",
+	},
+	"rule.preserveMqNeedsParams": {
+		"en": "V4: 'preserveMq' requires a rate or netem parameters",
+		"pt": "V4: 'preserveMq' exige uma taxa ou parâmetros do netem",
+		"es": "V4: 'preserveMq' requiere una tasa o parámetros de netem",
+	},
+	"rule.skipSwPoliceOnly": {
+		"en": "V4: 'filterOffload=skip_sw' only works with ingressMode=police: ifb and netem run in software",
+		"pt": "V4: 'filterOffload=skip_sw' só funciona com ingressMode=police: ifb e netem rodam em software",
+		"es": "V4: 'filterOffload=skip_sw' solo funciona con ingressMode=police: ifb y netem se ejecutan en software",
+	},
+	"rule.invalidFilterOffload": {
+		"en": "V4: invalid 'filterOffload' %q (auto, none, skip_hw or skip_sw)",
+		"pt": "V4: 'filterOffload' inválido %q (auto, none, skip_hw ou skip_sw)",
+		"es": "V4: 'filterOffload' no válido %q (auto, none, skip_hw o skip_sw)",
+	},
+	"rule.invalidNetwork": {
+		"en": "V4: '%s' must be an IP address or CIDR network, got %q",
+		"pt": "V4: '%s' deve ser um endereço IP ou uma rede CIDR, recebido %q",
+		"es": "V4: '%s' debe ser una dirección IP o una red CIDR, se recibió %q",
+	},
+	"rule.invalidPort": {
+		"en": "V4: '%s' must be a port in [1, 65535], got %q",
+		"pt": "V4: '%s' deve ser uma porta em [1, 65535], recebido %q",
+		"es": "V4: '%s' debe ser un puerto en [1, 65535], se recibió %q",
+	},
+	"rule.selectorFamilies": {
+		"en": "V4: 'srcNetwork' and 'dstNetwork' must be of the same IP version",
+		"pt": "V4: 'srcNetwork' e 'dstNetwork' devem ser da mesma versão de IP",
+		"es": "V4: 'srcNetwork' y 'dstNetwork' deben ser de la misma versión de IP",
+	},
+	"rule.selectorsIncompatible": {
+		"en": "V4: network and port selectors cannot be combined with %s",
+		"pt": "V4: seletores de rede e porta não podem ser combinados com %s",
+		"es": "V4: los selectores de red y puerto no se pueden combinar con %s",
+	},
+	"rule.invalidICMPKind": {
+		"en": "V4: unknown ICMP kind %q in '%s' (echo, unreachable, frag-needed, time-exceeded)",
+		"pt": "V4: tipo de ICMP desconhecido %q em '%s' (echo, unreachable, frag-needed, time-exceeded)",
+		"es": "V4: tipo de ICMP desconocido %q en '%s' (echo, unreachable, frag-needed, time-exceeded)",
+	},
+	"rule.icmpDropAndLimit": {
+		"en": "V4: ICMP %q cannot be both dropped ('icmpDrop') and rate-limited ('icmpLimit')",
+		"pt": "V4: ICMP %q não pode ser descartado ('icmpDrop') e limitado ('icmpLimit') ao mesmo tempo",
+		"es": "V4: ICMP %q no puede descartarse ('icmpDrop') y limitarse ('icmpLimit') a la vez",
+	},
+	"rule.icmpLimitNeedsRate": {
+		"en": "V4: 'icmpLimit' needs an 'icmpRate' (e.g. 8kbit)",
+		"pt": "V4: 'icmpLimit' precisa de um 'icmpRate' (ex.: 8kbit)",
+		"es": "V4: 'icmpLimit' necesita un 'icmpRate' (p. ej., 8kbit)",
+	},
+	"rule.icmpRateWithoutLimit": {
+		"en": "V4: 'icmpRate' needs 'icmpLimit' (the ICMP kinds to rate-limit)",
+		"pt": "V4: 'icmpRate' precisa de 'icmpLimit' (os tipos de ICMP a limitar)",
+		"es": "V4: 'icmpRate' necesita 'icmpLimit' (los tipos de ICMP a limitar)",
+	},
+	"rule.invalidICMPRate": {
+		"en": "V4: invalid 'icmpRate' %q (e.g. 8kbit, 1mbit)",
+		"pt": "V4: 'icmpRate' inválido %q (ex.: 8kbit, 1mbit)",
+		"es": "V4: 'icmpRate' no válido %q (p. ej., 8kbit, 1mbit)",
+	},
+	"rule.icmpIncompatible": {
+		"en": "V4: 'icmpDrop' and 'icmpLimit' cannot be combined with %s",
+		"pt": "V4: 'icmpDrop' e 'icmpLimit' não podem ser combinados com %s",
+		"es": "V4: 'icmpDrop' e 'icmpLimit' no se pueden combinar con %s",
+	},
+	"rule.invalidRateScope": {
+		"en": "V4: invalid 'rateScope' %q (aggregate or flow)",
+		"pt": "V4: 'rateScope' inválido %q (aggregate ou flow)",
+		"es": "V4: 'rateScope' no válido %q (aggregate o flow)",
+	},
+	"rule.rateScopeNeedsRate": {
+		"en": "V4: rateScope=flow needs a 'rate' (the cap of each flow)",
+		"pt": "V4: rateScope=flow precisa de um 'rate' (o limite de cada fluxo)",
+		"es": "V4: rateScope=flow necesita un 'rate' (el límite de cada flujo)",
+	},
+	"rule.rateScopeIncompatible": {
+		"en": "V4: rateScope=flow cannot be combined with %s",
+		"pt": "V4: rateScope=flow não pode ser combinado com %s",
+		"es": "V4: rateScope=flow no se puede combinar con %s",
+	},
+
+	// Plan warnings
+	"warn.replacesRule": {
+		"en": "replaces the current rule on %s (revision %d)",
+		"pt": "substitui a regra atual em %s (revisão %d)",
+		"es": "reemplaza la regla actual en %s (revisión %d)",
+	},
+	"warn.stopsJob": {
+		"en": "stops the running %s job %q",
+		"pt": "interrompe a tarefa %s em execução %q",
+		"es": "detiene la tarea %s en ejecución %q",
+	},
+	"warn.noEffect": {
+		"en": "no rate or netem parameter is set: the rule has no effect",
+		"pt": "nenhuma taxa ou parâmetro do netem foi definido: a regra não tem efeito",
+		"es": "no se definió ninguna tasa ni parámetro de netem: la regla no tiene efecto",
+	},
+	"warn.reorder": {
+		"en": "jitter is larger than delay: packets will be reordered",
+		"pt": "o jitter é maior que o atraso: os pacotes serão reordenados",
+		"es": "el jitter es mayor que el retardo: los paquetes se reordenarán",
+	},
+	"warn.lossStall": {
+		"en": "%v%% loss will stall most TCP connections",
+		"pt": "%v%% de perda vai travar a maioria das conexões TCP",
+		"es": "una pérdida del %v%% bloqueará la mayoría de las conexiones TCP",
+	},
+	"warn.rateAboveLink": {
+		"en": "the rate is above the link speed of %s (%dmbit): it does not limit anything",
+		"pt": "a taxa está acima da velocidade do link de %s (%dmbit): ela não limita nada",
+		"es": "la tasa supera la velocidad del enlace de %s (%dmbit): no limita nada",
+	},
+	"warn.incomingDrops": {
+		"en": "incoming traffic is shaped after it arrived: senders see drops, not back-pressure",
+		"pt": "o tráfego de entrada é moldado depois de chegar: os remetentes veem descartes, não contrapressão",
+		"es": "el tráfico entrante se modela después de llegar: los emisores ven descartes, no contrapresión",
+	},
+	"warn.policeMode": {
+		"en": "police mode (no ifb): inbound traffic above the rate is dropped, not queued, so TCP throughput falls below the rate",
+		"pt": "modo police (sem ifb): o tráfego de entrada acima da taxa é descartado, não enfileirado, então a vazão TCP fica abaixo da taxa",
+		"es": "modo police (sin ifb): el tráfico entrante por encima de la tasa se descarta, no se encola, así que el rendimiento TCP queda por debajo de la tasa",
+	},
+	"warn.mqPreserved": {
+		"en": "%s keeps its %s root: each tx queue gets its own netem and a share of the rate, and the API port is impaired too",
+		"pt": "%s mantém a raiz %s: cada fila de transmissão recebe seu próprio netem e uma parte da taxa, e a porta da API também é afetada",
+		"es": "%s conserva su raíz %s: cada cola de transmisión recibe su propio netem y una parte de la tasa, y el puerto de la API también se ve afectado",
+	},
+	"warn.mqReplaced": {
+		"en": "replaces the %s root of %s, losing its hardware queue mapping until reset (preserveMq=true keeps it)",
+		"pt": "substitui a raiz %s de %s, perdendo o mapeamento de filas de hardware até o reset (preserveMq=true o mantém)",
+		"es": "reemplaza la raíz %s de %s y pierde el mapeo de colas de hardware hasta el reset (preserveMq=true lo conserva)",
+	},
+	"warn.parentClass": {
+		"en": "the tree is attached below class %s of the %s root of %s: only the traffic the host's filters send to that class is impaired",
+		"pt": "a árvore é anexada abaixo da classe %s da raiz %s de %s: só o tráfego que os filtros do host enviam a essa classe é afetado",
+		"es": "el árbol se adjunta debajo de la clase %s de la raíz %s de %s: solo se ve afectado el tráfico que los filtros del host envían a esa clase",
+	},
+	"warn.loopbackBothWays": {
+		"en": "on loopback, requests and responses both cross '%s': the round trip of local connections grows by twice the delay (use srcPort/dstPort to impair one direction)",
+		"pt": "no loopback, requisições e respostas passam ambas por '%s': o tempo de ida e volta das conexões locais cresce em duas vezes o atraso (use srcPort/dstPort para afetar uma direção)",
+		"es": "en loopback, solicitudes y respuestas pasan ambas por '%s': el tiempo de ida y vuelta de las conexiones locales crece en el doble del retardo (use srcPort/dstPort para afectar una dirección)",
+	},
+	"warn.netemTreeApi": {
+		"en": "tree=netem impairs the API port too: the UI and API will be slow or unreachable through this interface",
+		"pt": "tree=netem também afeta a porta da API: a interface web e a API ficarão lentas ou inacessíveis por esta interface",
+		"es": "tree=netem también afecta al puerto de la API: la interfaz web y la API serán lentas o inaccesibles a través de esta interfaz",
+	},
+}
+
+// requestLanguage picks the supported language the client prefers most
+// (Accept-Language, e.g. "pt-BR,pt;q=0.9,en;q=0.8"), or English.
+func requestLanguage(r *http.Request) string {
+	type choice struct {
+		lang string
+		q    float64
+	}
+	var choices []choice
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		q := 1.0
+		if v, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			q, _ = strconv.ParseFloat(v, 64)
+		}
+		primary, _, _ := strings.Cut(strings.ToLower(tag), "-")
+		for _, lang := range languages {
+			if primary == lang && q > 0 {
+				choices = append(choices, choice{lang, q})
+			}
+		}
+	}
+	if len(choices) == 0 {
+		return "en"
+	}
+	sort.SliceStable(choices, func(i, j int) bool { return choices[i].q > choices[j].q })
+	return choices[0].lang
+}
+
+// serverLanguage is the language of server-side text such as the preflight
+// log: NETSIM_LANG, else LANG (e.g. "pt_BR.UTF-8"), else English.
+func serverLanguage() string {
+	for _, env := range []string{"NETSIM_LANG", "LANG"} {
+		primary := strings.ToLower(os.Getenv(env))
+		if i := strings.IndexAny(primary, "_-."); i >= 0 {
+			primary = primary[:i]
+		}
+		for _, lang := range languages {
+			if primary == lang {
+				return lang
+			}
+		}
+	}
+	return "en"
+}
+
+// localizeError renders the catalog message inside err (if any) in lang,
+// keeping the context it was wrapped in. code is the message code, or "".
+func localizeError(err error, lang string) (text, code string) {
+	var m *Message
+	if !errors.As(err, &m) {
+		return err.Error(), ""
+	}
+	return strings.Replace(err.Error(), m.Error(), m.Render(lang), 1), m.Code
+}
+
+// respondWithLocalizedError is respondWithError for errors that may carry
+// catalog messages: the message follows the client's language and the
+// response includes its code ("messageCode") for clients that match on it.
+func respondWithLocalizedError(w http.ResponseWriter, r *http.Request, status int, errs ...error) {
+	respondWithJSON(w, status, localizedErrorBody(w, r, status, errs...))
+}
+
+// localizedErrorBody returns the body of respondWithLocalizedError, for
+// handlers that add to it.
+func localizedErrorBody(w http.ResponseWriter, r *http.Request, status int, errs ...error) map[string]interface{} {
+	lang := requestLanguage(r)
+	texts := make([]string, 0, len(errs))
+	codes := []string{}
+	for _, err := range errs {
+		text, code := localizeError(err, lang)
+		texts = append(texts, text)
+		if code != "" {
+			codes = append(codes, code)
+		}
+	}
+	message := strings.Join(texts, "; ")
+	log.Printf("[ERROR] API Error: %s", errorsText(errs))
+	body := map[string]interface{}{"code": status, "message": message}
+	if len(codes) == 1 && len(errs) == 1 {
+		body["messageCode"] = codes[0]
+	}
+	w.Header().Set("Content-Language", lang)
+	return body
+}
+
+// errorsText joins the English text of errs for the server log.
+func errorsText(errs []error) string {
+	texts := make([]string, 0, len(errs))
+	for _, err := range errs {
+		texts = append(texts, err.Error())
+	}
+	return strings.Join(texts, "; ")
+}
@@ -0,0 +1,233 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Traffic Mirroring ---
+
+// TrafficMirror copies all traffic of a shaped interface to an analysis
+// port (tc mirred) or to a local pcap file (tcpdump).
+type TrafficMirror struct {
+	Iface    string   `json:"iface"`
+	Target   string   `json:"target"`             // interface name, or "pcap"
+	PcapFile string   `json:"pcapFile,omitempty"` // when Target is "pcap"
+	Started  TcTime   `json:"started"`
+	Warnings []string `json:"warnings,omitempty"`
+
+	cmd *exec.Cmd
+}
+
+// mirrorFilterPrio runs before the ifb redirect filter (auto prio 49152).
+const mirrorFilterPrio = "1"
+
+var (
+	mirrorsMu sync.Mutex
+	mirrors   = map[string]*TrafficMirror{}
+)
+
+// attach installs the mirror on the interface.
+func (m *TrafficMirror) attach(ctx context.Context) error {
+	if m.Target == "pcap" {
+		return m.startPcap()
+	}
+
+	out, err := runTCOutput(ctx, "qdisc", "show", "dev", m.Iface)
+	if err != nil {
+		return fmt.Errorf("mirror: failed to inspect qdiscs of '%s': %w", m.Iface, err)
+	}
+	m.Warnings = nil
+
+	// An 'incoming' rule on a kernel without clsact (or in police mode) owns
+	// the legacy ingress qdisc, which cannot coexist with clsact. We can still
+	// mirror inbound traffic through it.
+	if strings.Contains(out, "qdisc ingress ffff:") {
+		if err := runTC(ctx, withCookie("filter", "add", "dev", m.Iface, "parent", "ffff:", "prio", mirrorFilterPrio,
+			"matchall", "action", "mirred", "egress", "mirror", "dev", m.Target, "continue")...); err != nil {
+			return fmt.Errorf("mirror: failed to mirror ingress of '%s': %w", m.Iface, err)
+		}
+		m.Warnings = append(m.Warnings, "the interface uses the legacy ingress qdisc: only inbound traffic is mirrored")
+		return nil
+	}
+
+	if !strings.Contains(out, "qdisc clsact ffff:") {
+		if err := runTC(ctx, "qdisc", "add", "dev", m.Iface, "clsact"); err != nil {
+			return fmt.Errorf("mirror: failed to add clsact qdisc on '%s': %w", m.Iface, err)
+		}
+	}
+	// (continue: an 'incoming' rule's ifb redirect follows on the ingress hook)
+	for _, hook := range []string{"ingress", "egress"} {
+		if err := runTC(ctx, withCookie("filter", "add", "dev", m.Iface, hook, "prio", mirrorFilterPrio,
+			"matchall", "action", "mirred", "egress", "mirror", "dev", m.Target, "continue")...); err != nil {
+			return fmt.Errorf("mirror: failed to mirror %s of '%s': %w", hook, m.Iface, err)
+		}
+	}
+	return nil
+}
+
+// detach removes the mirror filters (or stops the capture).
+func (m *TrafficMirror) detach(ctx context.Context) {
+	if m.Target == "pcap" {
+		if m.cmd != nil && m.cmd.Process != nil {
+			m.cmd.Process.Signal(os.Interrupt)
+		}
+		return
+	}
+	out, _ := runTCOutput(ctx, "qdisc", "show", "dev", m.Iface)
+	if strings.Contains(out, "qdisc ingress ffff:") {
+		runTC(ctx, "filter", "del", "dev", m.Iface, "parent", "ffff:", "prio", mirrorFilterPrio)
+		return
+	}
+	runTC(ctx, "filter", "del", "dev", m.Iface, "ingress", "prio", mirrorFilterPrio)
+	runTC(ctx, "filter", "del", "dev", m.Iface, "egress", "prio", mirrorFilterPrio)
+}
+
+// startPcap runs tcpdump writing every packet of the interface to a file.
+func (m *TrafficMirror) startPcap() error {
+	if m.cmd != nil {
+		return nil // Capture survives rule changes on the interface
+	}
+	dir := os.Getenv("MIRROR_PCAP_DIR")
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	m.PcapFile = filepath.Join(dir, fmt.Sprintf("%s-%s.pcap", m.Iface, time.Now().UTC().Format("20060102T150405Z")))
+
+	// Not bound to a request context: the capture outlives the API call.
+	cmd := command(context.Background(), "tcpdump", "-i", m.Iface, "-U", "-n", "-s", "0", "-w", m.PcapFile)
+	log.Printf("[INFO] MIRROR: Executing: %s", cmd.String())
+	if err := cmd.Start(); err != nil {
+		return fmt.Errorf("mirror: failed to start tcpdump: %w", err)
+	}
+	m.cmd = cmd
+	go func() {
+		err := cmd.Wait()
+		log.Printf("[INFO] MIRROR: Capture of %s to %s ended: %v", m.Iface, m.PcapFile, err)
+	}()
+	return nil
+}
+
+// reattachMirror re-installs the mirror of iface after its qdiscs were
+// rebuilt (cleanup deletes clsact/ingress together with our filters).
+func reattachMirror(ctx context.Context, iface string) {
+	mirrorsMu.Lock()
+	defer mirrorsMu.Unlock()
+	if m, ok := mirrors[iface]; ok && m.Target != "pcap" {
+		if err := m.attach(ctx); err != nil {
+			log.Printf("[ERROR] MIRROR: Failed to re-attach mirror on %s: %v", iface, err)
+		}
+	}
+}
+
+// reattachMirror re-installs the mirror of the rule's interface after the
+// cleanup of an 'incoming' rule, which deleted the ingress hook with the
+// mirror's filters. An 'outgoing' cleanup leaves them in place.
+func (v *V4NetworkOptions) reattachMirror(ctx context.Context) {
+	if v.Direction == "incoming" {
+		reattachMirror(ctx, v.Iface)
+	}
+}
+
+// removeMirror detaches and forgets the mirror of iface, if any.
+func removeMirror(ctx context.Context, iface string) bool {
+	mirrorsMu.Lock()
+	defer mirrorsMu.Unlock()
+	m, ok := mirrors[iface]
+	if !ok {
+		return false
+	}
+	m.detach(ctx)
+	delete(mirrors, iface)
+	log.Printf("[INFO] MIRROR: Removed mirror of %s", iface)
+	return true
+}
+
+// removeAllMirrors detaches every mirror and stops all captures.
+func removeAllMirrors(ctx context.Context) {
+	mirrorsMu.Lock()
+	ifaces := make([]string, 0, len(mirrors))
+	for iface := range mirrors {
+		ifaces = append(ifaces, iface)
+	}
+	mirrorsMu.Unlock()
+	for _, iface := range ifaces {
+		removeMirror(ctx, iface)
+	}
+}
+
+// --- Handlers: /mirror ---
+
+// handleMirrorSetup mirrors 'iface' to 'target' (an interface or "pcap").
+func handleMirrorSetup(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	iface, target := r.URL.Query().Get("iface"), r.URL.Query().Get("target")
+	if iface == "" || target == "" {
+		respondWithError(w, "mirror: 'iface' and 'target' are required", 400)
+		return
+	}
+	if target == iface {
+		respondWithError(w, "mirror: 'target' must differ from 'iface'", 400)
+		return
+	}
+	if target != "pcap" {
+		if _, err := net.InterfaceByName(target); err != nil {
+			respondWithError(w, fmt.Sprintf("mirror: target interface '%s' not found", target), 400)
+			return
+		}
+	}
+	if isDarwin {
+		log.Println("[INFO] MIRROR: Darwin: Ignoring mirror setup")
+		respondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	removeMirror(ctx, iface)
+	m := &TrafficMirror{Iface: iface, Target: target, Started: TcTime(time.Now())}
+	if err := m.attach(ctx); err != nil {
+		m.detach(ctx)
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	mirrorsMu.Lock()
+	mirrors[iface] = m
+	mirrorsMu.Unlock()
+	log.Printf("[INFO] MIRROR: Mirroring %s to %s", iface, target)
+	respondWithJSON(w, http.StatusOK, m)
+}
+
+// handleMirrorReset stops mirroring 'iface'.
+func handleMirrorReset(w http.ResponseWriter, r *http.Request) {
+	iface := r.URL.Query().Get("iface")
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if !removeMirror(r.Context(), iface) {
+		respondWithError(w, fmt.Sprintf("mirror: no mirror on '%s'", iface), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// handleMirrorList returns all active mirrors.
+func handleMirrorList(w http.ResponseWriter, r *http.Request) {
+	mirrorsMu.Lock()
+	defer mirrorsMu.Unlock()
+	list := make([]*TrafficMirror, 0, len(mirrors))
+	for _, m := range mirrors {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Iface < list[j].Iface })
+	respondWithJSON(w, http.StatusOK, list)
+}
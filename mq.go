@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+)
+
+// --- Multi-Queue NICs (mq / mqprio) ---
+
+// rootQdisc returns the kind ("mq", "htb", ...) and handle ("8001:") of the
+// root qdisc of iface.
+func rootQdisc(ctx context.Context, iface string) (kind, handle string) {
+	out, err := runTCOutput(ctx, "qdisc", "show", "dev", iface, "root")
+	if err != nil {
+		return "", ""
+	}
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 4 && fields[0] == "qdisc" && fields[3] == "root" {
+			return fields[1], fields[2]
+		}
+	}
+	return "", ""
+}
+
+// isMultiQueueRoot reports whether kind is a root that maps the hardware
+// transmit queues of a NIC.
+func isMultiQueueRoot(kind string) bool {
+	return kind == "mq" || kind == "mqprio"
+}
+
+// txQueues returns the number of transmit queues of iface.
+func txQueues(iface string) int {
+	queues, _ := filepath.Glob(filepath.Join("/sys/class/net", iface, "queues", "tx-*"))
+	return len(queues)
+}
+
+// mqChildHandle is the handle of the netem qdisc on transmit queue q (1-based).
+func mqChildHandle(q int) string {
+	return fmt.Sprintf("%x:", ownHandleFirst+1+q)
+}
+
+// cleanupMQChildren restores the default qdisc of every transmit queue under
+// the mq/mqprio root with the given handle that carries a netem of the tool,
+// keeping the root (and with it the hardware queue mapping).
+func cleanupMQChildren(ctx context.Context, iface, handle string) {
+	out, err := runTCOutput(ctx, "qdisc", "show", "dev", iface)
+	if err != nil {
+		return
+	}
+	children := map[string]string{} // parent -> handle
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) >= 5 && fields[0] == "qdisc" && fields[3] == "parent" {
+			children[fields[4]] = fields[2]
+		}
+	}
+	for q := 1; q <= txQueues(iface); q++ {
+		parent := fmt.Sprintf("%s%x", handle, q)
+		if !ownsHandle(children[parent]) {
+			continue // The host's own qdisc (or the default one)
+		}
+		if err := runTC(ctx, "qdisc", "del", "dev", iface, "parent", parent); err != nil {
+			log.Printf("[DEBUG] V4 Cleanup: Failed to clean tx queue %d of %s (likely already clean): %v", q, iface, err)
+		}
+	}
+}
+
+// perQueueParams returns the netem parameters of each of the queues of a
+// per-queue tree: the rule's, with its rate shared evenly between them.
+func (v *V4NetworkOptions) perQueueParams(queues int) []string {
+	params := v.netemArgs()
+	if v.Rate != "" && queues > 0 {
+		rate, _ := parseTCRate(v.Rate)
+		params = append(params, "rate", fmt.Sprintf("%.0fbit", rate/float64(queues)))
+	}
+	return params
+}
+
+// validatePreserveMQ checks that the rule can be applied per transmit queue:
+// each queue gets its own netem, so there is no shared class to apply ceil,
+// bursts or flow sampling to.
+func (v *V4NetworkOptions) validatePreserveMQ() error {
+	if v.Direction != "outgoing" {
+		return msg("rule.preserveMqOutgoing")
+	}
+	if v.Ceil != "" || v.Burst != "" || v.Cburst != "" || v.FlowSamplePercent != "" || v.Tree != "" {
+		return msg("rule.preserveMqIncompatible")
+	}
+	if _, hasNetemRules := v.netemParams(); !hasNetemRules && v.Rate == "" {
+		return msg("rule.preserveMqNeedsParams")
+	}
+	if v.Rate != "" {
+		if _, err := parseTCRate(v.Rate); err != nil {
+			return msg("rule.invalidRate", v.Rate)
+		}
+	}
+	return nil
+}
+
+// executePerQueue attaches a netem qdisc to every transmit queue of the
+// mq/mqprio root of v.Iface. The rate is split evenly between the
+// queues (netem's own rate limiter): flows are hashed to queues, so a single
+// flow only gets its queue's share.
+func (v *V4NetworkOptions) executePerQueue(ctx context.Context, kind, handle string) error {
+	queues := txQueues(v.Iface)
+	if queues == 0 {
+		return fmt.Errorf("V4: no transmit queues found for '%s'", v.Iface)
+	}
+	// The kernel's default mq has no handle to refer to its queues by
+	if kind == "mq" && handle == "0:" {
+		handle = rootHandle
+		if err := runTC(ctx, "qdisc", "replace", "dev", v.Iface, "root", "handle", handle, "mq"); err != nil {
+			return fmt.Errorf("V4: failed to take over the mq root of '%s': %w", v.Iface, err)
+		}
+	}
+	params := v.perQueueParams(queues)
+	log.Printf("[INFO] V4: Preserving the %s root of %s: netem on each of %d tx queues", kind, v.Iface, queues)
+	for q := 1; q <= queues; q++ {
+		args := append([]string{"qdisc", "add", "dev", v.Iface, "parent", fmt.Sprintf("%s%x", handle, q), "handle", mqChildHandle(q), "netem"}, params...)
+		if err := runTC(ctx, args...); err != nil {
+			return fmt.Errorf("V4: failed to add netem on tx queue %d: %w", q, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,271 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- NAT Behaviors (Gateway Mode) ---
+
+// NATBehavior changes how the gateway's NAT maps and forgets flows, for
+// testing NAT traversal (STUN/ICE) and keepalive logic: shorter conntrack
+// timeouts, a narrow port range (CGNAT port exhaustion) and endpoint-
+// dependent mapping (a "symmetric" NAT).
+type NATBehavior struct {
+	UDPTimeout int    `json:"udpTimeout,omitempty"` // seconds
+	TCPTimeout int    `json:"tcpTimeout,omitempty"` // seconds, established connections
+	Ports      string `json:"ports,omitempty"`      // "min-max"
+	Mapping    string `json:"mapping"`              // endpoint-independent or endpoint-dependent
+	Started    TcTime `json:"started"`
+}
+
+// natRuleComment tags the MASQUERADE rules of NAT behaviors, which go
+// before the gateway's own.
+const natRuleComment = gatewayRuleComment + "-nat"
+
+// natTimeoutSysctls are the conntrack timeouts each timeout sets.
+var natTimeoutSysctls = map[string][]string{
+	"udp": {"net.netfilter.nf_conntrack_udp_timeout", "net.netfilter.nf_conntrack_udp_timeout_stream"},
+	"tcp": {"net.netfilter.nf_conntrack_tcp_timeout_established"},
+}
+
+var (
+	natMu    sync.Mutex
+	natState *NATBehavior
+	// natSaved are the values of the sysctls before they were changed, to
+	// restore on reset.
+	natSaved = map[string]string{}
+)
+
+// parseNATBehavior reads a behavior from the query: udpTimeout, tcpTimeout
+// (seconds, or a duration such as "2m"), ports and mapping.
+func parseNATBehavior(q url.Values) (*NATBehavior, error) {
+	n := &NATBehavior{Ports: q.Get("ports"), Mapping: q.Get("mapping"), Started: TcTime(time.Now())}
+	var err error
+	if n.UDPTimeout, err = parseNATTimeout("udpTimeout", q.Get("udpTimeout")); err != nil {
+		return nil, err
+	}
+	if n.TCPTimeout, err = parseNATTimeout("tcpTimeout", q.Get("tcpTimeout")); err != nil {
+		return nil, err
+	}
+	if n.Ports != "" {
+		from, to, ok := strings.Cut(n.Ports, "-")
+		lo, err1 := strconv.Atoi(from)
+		hi, err2 := strconv.Atoi(to)
+		if !ok || err1 != nil || err2 != nil || lo < 1 || hi > 65535 || lo > hi {
+			return nil, fmt.Errorf("nat: 'ports' must be a range such as '40000-40099', got %q", n.Ports)
+		}
+	}
+	switch n.Mapping {
+	case "":
+		n.Mapping = "endpoint-independent"
+	case "endpoint-independent", "endpoint-dependent":
+	default:
+		return nil, fmt.Errorf("nat: 'mapping' must be 'endpoint-independent' or 'endpoint-dependent'")
+	}
+	if n.UDPTimeout == 0 && n.TCPTimeout == 0 && n.Ports == "" && n.Mapping == "endpoint-independent" {
+		return nil, fmt.Errorf("nat: set 'udpTimeout', 'tcpTimeout', 'ports' and/or 'mapping=endpoint-dependent'")
+	}
+	return n, nil
+}
+
+// parseNATTimeout parses a timeout in seconds or as a duration ("" is 0).
+func parseNATTimeout(param, value string) (int, error) {
+	if value == "" {
+		return 0, nil
+	}
+	secs, err := strconv.Atoi(value)
+	if err != nil {
+		d, derr := time.ParseDuration(value)
+		if derr != nil {
+			return 0, fmt.Errorf("nat: invalid '%s' %q (seconds, or a duration such as '2m')", param, value)
+		}
+		secs = int(d / time.Second)
+	}
+	if secs < 1 {
+		return 0, fmt.Errorf("nat: '%s' must be at least 1 second", param)
+	}
+	return secs, nil
+}
+
+// ruleSpecs are the MASQUERADE rules of the behavior, one per protocol with
+// ports: without --random-fully, Linux keeps a flow's source port when it
+// is free and maps every destination to it (endpoint-independent); with it,
+// each new flow gets a random port (endpoint-dependent). ICMP keeps the
+// gateway's rule.
+func (n *NATBehavior) ruleSpecs(wanIface string) [][]string {
+	if n.Ports == "" && n.Mapping == "endpoint-independent" {
+		return nil
+	}
+	var specs [][]string
+	for _, proto := range []string{"tcp", "udp"} {
+		spec := []string{"POSTROUTING", "-o", wanIface, "-p", proto, "-m", "comment", "--comment", natRuleComment, "-j", "MASQUERADE"}
+		if n.Ports != "" {
+			spec = append(spec, "--to-ports", n.Ports)
+		}
+		if n.Mapping == "endpoint-dependent" {
+			spec = append(spec, "--random-fully")
+		}
+		specs = append(specs, spec)
+	}
+	return specs
+}
+
+// sysctls are the conntrack settings of the behavior.
+func (n *NATBehavior) sysctls() map[string]int {
+	values := map[string]int{}
+	for proto, timeout := range map[string]int{"udp": n.UDPTimeout, "tcp": n.TCPTimeout} {
+		if timeout == 0 {
+			continue
+		}
+		for _, name := range natTimeoutSysctls[proto] {
+			values[name] = timeout
+		}
+	}
+	return values
+}
+
+// apply sets the sysctls (saving their previous values) and inserts the
+// rules. Must be called with natMu held, after the previous behavior was
+// removed and the sysctls restored.
+func (n *NATBehavior) apply(ctx context.Context) error {
+	for name, value := range n.sysctls() {
+		prev, err := os.ReadFile("/proc/sys/" + strings.ReplaceAll(name, ".", "/"))
+		if err != nil {
+			return fmt.Errorf("nat: cannot read %s (is the nf_conntrack module loaded?): %w", name, err)
+		}
+		if _, saved := natSaved[name]; !saved {
+			natSaved[name] = strings.TrimSpace(string(prev))
+		}
+		if err := runGatewayCommand(ctx, "sysctl", "-w", fmt.Sprintf("%s=%d", name, value)); err != nil {
+			return fmt.Errorf("nat: failed to set %s: %w", name, err)
+		}
+	}
+	for _, spec := range n.ruleSpecs(gateway.wanIface4) {
+		if err := runGatewayCommand(ctx, "iptables", append([]string{"-t", "nat", "-I", spec[0], "1"}, spec[1:]...)...); err != nil {
+			return fmt.Errorf("nat: failed to add the MASQUERADE rule: %w", err)
+		}
+	}
+	return nil
+}
+
+// remove deletes the rules of the behavior. Must be called with natMu held.
+func (n *NATBehavior) remove(ctx context.Context) {
+	for _, spec := range n.ruleSpecs(gateway.wanIface4) {
+		if command(ctx, "iptables", append([]string{"-t", "nat", "-C"}, spec...)...).Run() == nil {
+			runGatewayCommand(ctx, "iptables", append([]string{"-t", "nat", "-D"}, spec...)...)
+		}
+	}
+}
+
+// restoreNATSysctls puts the saved conntrack timeouts back. Must be called
+// with natMu held.
+func restoreNATSysctls(ctx context.Context) {
+	for name, value := range natSaved {
+		if err := runGatewayCommand(ctx, "sysctl", "-w", name+"="+value); err != nil {
+			log.Printf("[WARN] NAT: Failed to restore %s=%s: %v", name, value, err)
+			continue
+		}
+		delete(natSaved, name)
+	}
+}
+
+// resetNATBehavior removes the behavior and restores the timeouts (e.g. on
+// reset-all and shutdown), and reports whether there was one.
+func resetNATBehavior(ctx context.Context) bool {
+	natMu.Lock()
+	defer natMu.Unlock()
+	if natState == nil {
+		return false
+	}
+	natState.remove(ctx)
+	natState = nil
+	restoreNATSysctls(ctx)
+	log.Println("[INFO] NAT: Restored the default NAT behavior")
+	return true
+}
+
+// --- Handlers: /nat ---
+
+// handleNATSetup replaces the NAT behavior of the gateway.
+func handleNATSetup(w http.ResponseWriter, r *http.Request) {
+	n, err := parseNATBehavior(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	if isDarwin {
+		log.Println("[INFO] NAT: Darwin: Ignoring NAT setup")
+		respondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+	if !gateway.enabled {
+		respondWithError(w, "nat: Default Gateway Mode is not enabled (DEFAULT_GATEWAY_MODE=true)", 409)
+		return
+	}
+	if gateway.wanIface4 == "" && n.ruleSpecs("") != nil {
+		respondWithError(w, "nat: 'ports' and 'mapping' apply to IPv4 NAT, and this gateway has no IPv4 WAN interface", 409)
+		return
+	}
+
+	natMu.Lock()
+	defer natMu.Unlock()
+	if natState != nil {
+		natState.remove(r.Context())
+		natState = nil
+	}
+	// Timeouts the new behavior leaves alone go back to their defaults
+	restoreNATSysctls(r.Context())
+	if err := n.apply(r.Context()); err != nil {
+		n.remove(r.Context())
+		restoreNATSysctls(r.Context())
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	natState = n
+	log.Printf("[INFO] NAT: udpTimeout=%ds tcpTimeout=%ds ports=%q mapping=%s", n.UDPTimeout, n.TCPTimeout, n.Ports, n.Mapping)
+	respondWithJSON(w, http.StatusOK, n)
+}
+
+// handleNATReset restores the default NAT behavior.
+func handleNATReset(w http.ResponseWriter, r *http.Request) {
+	if !resetNATBehavior(r.Context()) {
+		respondWithError(w, "nat: no NAT behavior is set", 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// handleNATList returns the NAT behavior and the current conntrack timeouts.
+func handleNATList(w http.ResponseWriter, r *http.Request) {
+	natMu.Lock()
+	defer natMu.Unlock()
+	timeouts := map[string]string{}
+	for _, names := range natTimeoutSysctls {
+		for _, name := range names {
+			if b, err := os.ReadFile("/proc/sys/" + strings.ReplaceAll(name, ".", "/")); err == nil {
+				timeouts[name] = strings.TrimSpace(string(b))
+			}
+		}
+	}
+	saved := make([]string, 0, len(natSaved))
+	for name := range natSaved {
+		saved = append(saved, name)
+	}
+	sort.Strings(saved)
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"gateway":  gateway.enabled,
+		"behavior": natState,
+		"timeouts": timeouts,
+		"changed":  saved,
+	})
+}
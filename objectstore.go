@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// --- Object Storage Backup (S3-compatible) ---
+
+// s3Client is a minimal S3 client (path-style, SigV4) for PUT/GET of small
+// objects, enough to sync the library without an SDK.
+type s3Client struct {
+	endpoint  string // e.g. "https://s3.eu-west-1.amazonaws.com" or "http://minio:9000"
+	bucket    string
+	region    string
+	accessKey string
+	secretKey string
+	prefix    string // key prefix of this box, e.g. "netsim/"
+	http      *http.Client
+}
+
+// backupStore is nil unless S3_ENDPOINT and S3_BUCKET are set.
+var backupStore *s3Client
+
+// configureBackup reads S3_ENDPOINT, S3_BUCKET, S3_REGION (default
+// us-east-1), S3_ACCESS_KEY, S3_SECRET_KEY and S3_PREFIX (default "netsim/").
+func configureBackup() bool {
+	endpoint, bucket := os.Getenv("S3_ENDPOINT"), os.Getenv("S3_BUCKET")
+	if endpoint == "" || bucket == "" {
+		return false
+	}
+	c := &s3Client{
+		endpoint:  strings.TrimRight(endpoint, "/"),
+		bucket:    bucket,
+		region:    os.Getenv("S3_REGION"),
+		accessKey: os.Getenv("S3_ACCESS_KEY"),
+		secretKey: os.Getenv("S3_SECRET_KEY"),
+		prefix:    os.Getenv("S3_PREFIX"),
+		http:      &http.Client{Timeout: 30 * time.Second},
+	}
+	if c.region == "" {
+		c.region = "us-east-1"
+	}
+	if c.prefix == "" {
+		c.prefix = "netsim/"
+	}
+	if !strings.HasSuffix(c.prefix, "/") {
+		c.prefix += "/"
+	}
+	backupStore = c
+	log.Printf("[INFO] BACKUP: Object storage enabled: %s/%s/%s", c.endpoint, c.bucket, c.prefix)
+	return true
+}
+
+// put uploads body as key (relative to the prefix).
+func (c *s3Client) put(ctx context.Context, key string, body []byte) error {
+	_, err := c.do(ctx, http.MethodPut, key, body)
+	return err
+}
+
+// get downloads key (relative to the prefix). A missing object returns
+// (nil, nil).
+func (c *s3Client) get(ctx context.Context, key string) ([]byte, error) {
+	return c.do(ctx, http.MethodGet, key, nil)
+}
+
+func (c *s3Client) do(ctx context.Context, method, key string, body []byte) ([]byte, error) {
+	objectPath := "/" + c.bucket + "/" + c.prefix + key
+	req, err := http.NewRequestWithContext(ctx, method, c.endpoint+s3Escape(objectPath), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	c.sign(req, body, time.Now().UTC())
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("s3 %s %s: %w", method, key, err)
+	}
+	defer resp.Body.Close()
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if method == http.MethodGet && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode/100 != 2 {
+		return nil, fmt.Errorf("s3 %s %s: %s: %s", method, key, resp.Status, strings.TrimSpace(string(data)))
+	}
+	return data, nil
+}
+
+// sign adds AWS Signature Version 4 headers to req.
+func (c *s3Client) sign(req *http.Request, body []byte, now time.Time) {
+	amzDate, day := now.Format("20060102T150405Z"), now.Format("20060102")
+	payloadHash := sha256Hex(body)
+	req.Header.Set("X-Amz-Date", amzDate)
+	req.Header.Set("X-Amz-Content-Sha256", payloadHash)
+	if c.accessKey == "" {
+		return // Anonymous (e.g. a public or pre-authorized bucket)
+	}
+
+	signedHeaders := "host;x-amz-content-sha256;x-amz-date"
+	canonicalRequest := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		"",
+		"host:" + req.URL.Host + "\nx-amz-content-sha256:" + payloadHash + "\nx-amz-date:" + amzDate + "\n",
+		signedHeaders,
+		payloadHash,
+	}, "\n")
+	scope := day + "/" + c.region + "/s3/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + sha256Hex([]byte(canonicalRequest))
+
+	key := hmacSHA256([]byte("AWS4"+c.secretKey), day)
+	for _, part := range []string{c.region, "s3", "aws4_request"} {
+		key = hmacSHA256(key, part)
+	}
+	signature := hex.EncodeToString(hmacSHA256(key, stringToSign))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, signedHeaders, signature))
+}
+
+func sha256Hex(b []byte) string {
+	sum := sha256.Sum256(b)
+	return hex.EncodeToString(sum[:])
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// s3Escape URI-encodes a path as SigV4 expects: everything but unreserved
+// characters and "/".
+func s3Escape(p string) string {
+	var b strings.Builder
+	for i := 0; i < len(p); i++ {
+		c := p[i]
+		if 'A' <= c && c <= 'Z' || 'a' <= c && c <= 'z' || '0' <= c && c <= '9' || strings.IndexByte("-_.~/", c) >= 0 {
+			b.WriteByte(c)
+		} else {
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+// --- Library (fault profiles, network profiles and scenarios) ---
+
+// libraryKey is shared by every box using the same bucket and prefix.
+const libraryKey = "library.json"
+
+// Library is the shareable part of the configuration.
+type Library struct {
+	FaultProfiles []*FaultProfile   `json:"faultProfiles"`
+	Profiles      []*NetworkProfile `json:"profiles,omitempty"`
+	Scenarios     []*Scenario       `json:"scenarios"`
+	ExportedAt    TcTime            `json:"exportedAt"`
+	ExportedBy    string            `json:"exportedBy"`
+}
+
+// exportLibrary returns the custom fault and network profiles and the
+// defined scenarios.
+func exportLibrary() *Library {
+	lib := &Library{FaultProfiles: []*FaultProfile{}, Scenarios: []*Scenario{}, ExportedAt: TcTime(time.Now())}
+	lib.ExportedBy, _ = os.Hostname()
+	l7Faults.Lock()
+	for _, p := range l7Faults.profiles {
+		lib.FaultProfiles = append(lib.FaultProfiles, p)
+	}
+	l7Faults.Unlock()
+	networkProfiles.Lock()
+	for _, p := range networkProfiles.custom {
+		lib.Profiles = append(lib.Profiles, p)
+	}
+	networkProfiles.Unlock()
+	sched.mu.Lock()
+	for _, s := range scenarios {
+		lib.Scenarios = append(lib.Scenarios, s)
+	}
+	sched.mu.Unlock()
+	sort.Slice(lib.FaultProfiles, func(i, j int) bool { return lib.FaultProfiles[i].Name < lib.FaultProfiles[j].Name })
+	sort.Slice(lib.Profiles, func(i, j int) bool { return lib.Profiles[i].Name < lib.Profiles[j].Name })
+	sort.Slice(lib.Scenarios, func(i, j int) bool { return lib.Scenarios[i].Name < lib.Scenarios[j].Name })
+	return lib
+}
+
+// importLibrary merges lib (by name) into the local profiles and scenarios.
+// Imported scenarios are defined but not started. profiles counts the fault
+// profiles.
+func importLibrary(lib *Library) (profiles, scenarioCount int, err error) {
+	for _, p := range lib.FaultProfiles {
+		if err := p.validate(); err != nil {
+			return 0, 0, err
+		}
+	}
+	if _, err := importProfiles(lib.Profiles); err != nil {
+		return 0, 0, err
+	}
+	l7Faults.Lock()
+	for _, p := range lib.FaultProfiles {
+		if _, builtin := builtinFaultProfiles[p.Name]; !builtin {
+			l7Faults.profiles[p.Name] = p
+			profiles++
+		}
+	}
+	l7Faults.Unlock()
+
+	// Scenarios reference profiles, so they are validated after the import.
+	for _, s := range lib.Scenarios {
+		if err := s.validate(); err != nil {
+			return profiles, 0, err
+		}
+	}
+	sched.mu.Lock()
+	for _, s := range lib.Scenarios {
+		scenarios[s.Name] = s
+	}
+	sched.mu.Unlock()
+	return profiles, len(lib.Scenarios), nil
+}
+
+// backupToObjectStore uploads the library and (if set) the L7 audit log.
+func backupToObjectStore(ctx context.Context) ([]string, error) {
+	data, err := json.MarshalIndent(exportLibrary(), "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	if err := backupStore.put(ctx, libraryKey, data); err != nil {
+		return nil, err
+	}
+	uploaded := []string{libraryKey}
+
+	if auditPath := os.Getenv("L7_AUDIT_LOG"); auditPath != "" {
+		audit, err := os.ReadFile(auditPath)
+		if err != nil && !os.IsNotExist(err) {
+			return uploaded, fmt.Errorf("read L7_AUDIT_LOG: %w", err)
+		}
+		if len(audit) > 0 {
+			host, _ := os.Hostname()
+			key := fmt.Sprintf("audit/%s/l7-audit.jsonl", host)
+			if err := backupStore.put(ctx, key, audit); err != nil {
+				return uploaded, err
+			}
+			uploaded = append(uploaded, key)
+		}
+	}
+	return uploaded, nil
+}
+
+// restoreFromObjectStore downloads and imports the shared library.
+func restoreFromObjectStore(ctx context.Context) (profiles, scenarioCount int, err error) {
+	data, err := backupStore.get(ctx, libraryKey)
+	if err != nil || data == nil {
+		return 0, 0, err
+	}
+	lib := &Library{}
+	if err := json.Unmarshal(data, lib); err != nil {
+		return 0, 0, fmt.Errorf("invalid %s: %w", libraryKey, err)
+	}
+	return importLibrary(lib)
+}
+
+// startBackupSync restores the library at startup (so a reimaged box gets
+// it back) and, if interval > 0, uploads it periodically.
+func startBackupSync(ctx context.Context, interval time.Duration) {
+	if profiles, n, err := restoreFromObjectStore(ctx); err != nil {
+		log.Printf("[ERROR] BACKUP: Failed to restore the library: %v", err)
+	} else {
+		log.Printf("[INFO] BACKUP: Restored %d fault profile(s) and %d scenario(s)", profiles, n)
+	}
+	if interval <= 0 {
+		return
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if _, err := backupToObjectStore(ctx); err != nil {
+					log.Printf("[ERROR] BACKUP: Periodic backup failed: %v", err)
+				}
+			}
+		}
+	}()
+}
+
+// --- Handlers: /backup ---
+
+// handleBackup uploads the library (and audit log) to object storage.
+func handleBackup(w http.ResponseWriter, r *http.Request) {
+	if backupStore == nil {
+		respondWithError(w, "backup: object storage is not configured (S3_ENDPOINT, S3_BUCKET)", 501)
+		return
+	}
+	uploaded, err := backupToObjectStore(r.Context())
+	if err != nil {
+		respondWithError(w, err.Error(), 502)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"uploaded": uploaded})
+}
+
+// handleRestore imports the library from object storage.
+func handleRestore(w http.ResponseWriter, r *http.Request) {
+	if backupStore == nil {
+		respondWithError(w, "backup: object storage is not configured (S3_ENDPOINT, S3_BUCKET)", 501)
+		return
+	}
+	profiles, n, err := restoreFromObjectStore(r.Context())
+	if err != nil {
+		respondWithError(w, err.Error(), 502)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"faultProfiles": profiles, "scenarios": n})
+}
+
+// handleLibraryExport returns the library as JSON (no object storage needed).
+func handleLibraryExport(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, exportLibrary())
+}
+
+// handleLibraryImport merges a library JSON document.
+func handleLibraryImport(w http.ResponseWriter, r *http.Request) {
+	lib := &Library{}
+	if err := json.NewDecoder(r.Body).Decode(lib); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid library JSON: %v", err), 400)
+		return
+	}
+	profiles, n, err := importLibrary(lib)
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"faultProfiles": profiles, "scenarios": n})
+}
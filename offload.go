@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// --- Hardware Offload (hw-tc-offload) ---
+
+// hwTCOffload reports whether iface offloads tc filters to the NIC (ethtool
+// feature hw-tc-offload). known is false when ethtool is missing or the
+// driver does not report the feature.
+func hwTCOffload(ctx context.Context, iface string) (on, known bool) {
+	out, err := command(ctx, "ethtool", "-k", iface).Output()
+	if err != nil {
+		return false, false
+	}
+	for _, line := range strings.Split(string(out), "\n") {
+		if value, ok := strings.CutPrefix(strings.TrimSpace(line), "hw-tc-offload:"); ok {
+			return strings.HasPrefix(strings.TrimSpace(value), "on"), true
+		}
+	}
+	return false, false
+}
+
+// filterFlags returns the offload flags of the ingress filters of an
+// 'incoming' rule (the only ones a NIC can offload). netem and ifb only exist
+// in software: on an offloading NIC, a filter handled in hardware would never
+// reach them, so by default ("auto") the filters are kept in software.
+// skip_sw is only useful for policers, which many NICs run in hardware.
+func (v *V4NetworkOptions) filterFlags(ctx context.Context) ([]string, error) {
+	switch v.FilterOffload {
+	case "", "auto":
+		if on, _ := hwTCOffload(ctx, v.Iface); on {
+			return []string{"skip_hw"}, nil
+		}
+		return nil, nil
+	case "none":
+		return nil, nil
+	case "skip_hw":
+		return []string{"skip_hw"}, nil
+	case "skip_sw":
+		if v.Direction != "incoming" || v.ingressMode() != "police" {
+			return nil, msg("rule.skipSwPoliceOnly")
+		}
+		return []string{"skip_sw"}, nil
+	}
+	return nil, msg("rule.invalidFilterOffload", v.FilterOffload)
+}
+
+// withFilterFlags inserts the offload flags after the classifier keyword of
+// a 'tc filter' command.
+func withFilterFlags(args []string, flags []string) []string {
+	i := slices.Index(args, "u32")
+	if i < 0 || len(flags) == 0 {
+		return args
+	}
+	return slices.Concat(args[:i+1], flags, args[i+1:])
+}
+
+// offloadWarnings explains how an offloading NIC affects the rule.
+func offloadWarnings(ctx context.Context, opts *V4NetworkOptions) []string {
+	on, _ := hwTCOffload(ctx, opts.Iface)
+	if !on {
+		return nil
+	}
+	switch {
+	case opts.Direction != "incoming":
+		return []string{fmt.Sprintf("hw-tc-offload is on for %s: the egress tree is not offloaded, but other offloaded tc rules on the NIC may bypass it", opts.Iface)}
+	case opts.FilterOffload == "none":
+		return []string{fmt.Sprintf("hw-tc-offload is on for %s and filterOffload=none: packets matched in hardware bypass ifb and netem (the rule may have no effect)", opts.Iface)}
+	case opts.FilterOffload == "skip_sw":
+		return []string{fmt.Sprintf("the policer on %s runs in the NIC only (skip_sw)", opts.Iface)}
+	}
+	return []string{fmt.Sprintf("hw-tc-offload is on for %s: the ingress filters are kept in software (skip_hw) so the impairments are not bypassed", opts.Iface)}
+}
@@ -0,0 +1,290 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Oscillations (Generators) ---
+
+// oscillatingParam is a numeric rule parameter a generator can drive.
+type oscillatingParam struct {
+	field   func(*V4NetworkOptions) *string
+	rate    bool // a tc rate (e.g. "10mbit"), generated in bits/s
+	percent bool // capped at 100
+}
+
+// oscillatingParams are the parameters generators can drive, by query name.
+var oscillatingParams = map[string]oscillatingParam{
+	"rate":             {field: func(o *V4NetworkOptions) *string { return &o.Rate }, rate: true},
+	"ceil":             {field: func(o *V4NetworkOptions) *string { return &o.Ceil }, rate: true},
+	"delay":            {field: func(o *V4NetworkOptions) *string { return &o.Delay }},
+	"jitter":           {field: func(o *V4NetworkOptions) *string { return &o.Jitter }},
+	"delayCorrelation": {field: func(o *V4NetworkOptions) *string { return &o.DelayCorrelation }, percent: true},
+	"loss":             {field: func(o *V4NetworkOptions) *string { return &o.Loss }, percent: true},
+	"lossCorrelation":  {field: func(o *V4NetworkOptions) *string { return &o.LossCorrelation }, percent: true},
+	"corrupt":          {field: func(o *V4NetworkOptions) *string { return &o.Corrupt }, percent: true},
+	"duplicate":        {field: func(o *V4NetworkOptions) *string { return &o.Duplicate }, percent: true},
+	"reorder":          {field: func(o *V4NetworkOptions) *string { return &o.Reorder }, percent: true},
+}
+
+// Generator drives one parameter around Center, Amplitude away at most,
+// repeating every Period: "sine", "sawtooth" (ramps up, then drops),
+// "square" (high for the first half) or "randomwalk" (random steps, about
+// the whole range per period). Center and Amplitude use the parameter's
+// units (a tc rate for 'rate' and 'ceil'); Center defaults to the base
+// options' value.
+type Generator struct {
+	Param     string `json:"param"`
+	Shape     string `json:"shape"`
+	Center    string `json:"center,omitempty"`
+	Amplitude string `json:"amplitude"`
+	Period    string `json:"period"` // Go duration
+
+	Value string `json:"value"` // the value last applied
+
+	center, amplitude, walk float64
+	period                  time.Duration
+}
+
+// Oscillation runs generators over the base options of one interface,
+// adjusting the rule every Step (default 1s).
+type Oscillation struct {
+	Options    *V4NetworkOptions `json:"options"`
+	Generators []*Generator      `json:"generators"`
+	Step       string            `json:"step,omitempty"` // Go duration, at least 200ms
+
+	Steps int `json:"steps"`
+
+	step time.Duration
+}
+
+// oscillations holds the oscillation of each interface (guarded by sched).
+var oscillations = map[string]*Oscillation{}
+
+// parseParamValue parses a value of param: bits/s for rates.
+func parseParamValue(p oscillatingParam, s string) (float64, error) {
+	if p.rate {
+		return parseTCRate(s)
+	}
+	v, ok := parseTCNumber(s)
+	if !ok {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return v, nil
+}
+
+// formatParamValue formats v as a value of param, within its range.
+func formatParamValue(p oscillatingParam, v float64) string {
+	if p.rate {
+		return strconv.FormatFloat(math.Max(math.Round(v), 8), 'f', 0, 64) + "bit"
+	}
+	v = math.Max(v, 0)
+	if p.percent {
+		v = math.Min(v, 100)
+	}
+	return strconv.FormatFloat(roundTo(v, 2), 'f', -1, 64)
+}
+
+// validate checks the generators and parses their settings.
+func (o *Oscillation) validate() error {
+	if o.Options == nil || o.Options.Iface == "" || o.Options.Direction == "" {
+		return fmt.Errorf("oscillation: 'options.iface' and 'options.direction' are required")
+	}
+	if len(o.Generators) == 0 {
+		return fmt.Errorf("oscillation: at least one generator is required")
+	}
+	if o.Step == "" {
+		o.Step = "1s"
+	}
+	var err error
+	if o.step, err = time.ParseDuration(o.Step); err != nil || o.step < 200*time.Millisecond {
+		return fmt.Errorf("oscillation: invalid 'step' %q (at least 200ms)", o.Step)
+	}
+	seen := map[string]bool{}
+	for _, g := range o.Generators {
+		p, ok := oscillatingParams[g.Param]
+		if !ok {
+			return fmt.Errorf("oscillation: parameter '%s' cannot oscillate", g.Param)
+		}
+		if seen[g.Param] {
+			return fmt.Errorf("oscillation: duplicate generator for '%s'", g.Param)
+		}
+		seen[g.Param] = true
+		switch g.Shape {
+		case "sine", "sawtooth", "square", "randomwalk":
+		default:
+			return fmt.Errorf("oscillation: invalid 'shape' %q (sine, sawtooth, square or randomwalk)", g.Shape)
+		}
+		if g.Center == "" {
+			g.Center = *p.field(o.Options)
+		}
+		if g.Center == "" {
+			return fmt.Errorf("oscillation: '%s' needs a 'center' (or a value in 'options')", g.Param)
+		}
+		if g.center, err = parseParamValue(p, g.Center); err != nil {
+			return fmt.Errorf("oscillation: invalid 'center' of '%s': %v", g.Param, err)
+		}
+		if g.amplitude, err = parseParamValue(p, g.Amplitude); err != nil || g.amplitude <= 0 {
+			return fmt.Errorf("oscillation: invalid 'amplitude' of '%s' %q", g.Param, g.Amplitude)
+		}
+		if p.rate && g.amplitude >= g.center {
+			return fmt.Errorf("oscillation: the 'amplitude' of '%s' must be below its 'center'", g.Param)
+		}
+		if g.period, err = time.ParseDuration(g.Period); err != nil || g.period < 2*o.step {
+			return fmt.Errorf("oscillation: invalid 'period' of '%s' %q (at least two steps)", g.Param, g.Period)
+		}
+		g.walk = g.center
+	}
+	// The extremes must make valid rules
+	for _, sign := range []float64{-1, 1} {
+		opts := o.optionsWith(func(g *Generator) float64 { return g.center + sign*g.amplitude })
+		if err := opts.validateNetem(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// valueAt returns the generated value elapsed into the oscillation.
+func (g *Generator) valueAt(elapsed, step time.Duration) float64 {
+	x := math.Mod(float64(elapsed)/float64(g.period), 1) // position in the period, [0, 1)
+	switch g.Shape {
+	case "sine":
+		return g.center + g.amplitude*math.Sin(2*math.Pi*x)
+	case "sawtooth":
+		return g.center + g.amplitude*(2*x-1)
+	case "square":
+		if x < 0.5 {
+			return g.center + g.amplitude
+		}
+		return g.center - g.amplitude
+	default: // randomwalk
+		g.walk += (2*chaosFloat64() - 1) * 4 * g.amplitude * float64(step) / float64(g.period)
+		g.walk = math.Max(g.center-g.amplitude, math.Min(g.center+g.amplitude, g.walk))
+		return g.walk
+	}
+}
+
+// optionsWith returns the base options with the value of each generator.
+func (o *Oscillation) optionsWith(value func(g *Generator) float64) *V4NetworkOptions {
+	opts := *o.Options
+	for _, g := range o.Generators {
+		p := oscillatingParams[g.Param]
+		*p.field(&opts) = formatParamValue(p, value(g))
+		if g.Param == "loss" && opts.LossModel == "" {
+			opts.LossModel = "random"
+		}
+	}
+	return &opts
+}
+
+// run adjusts the rule to the generated values every step.
+func (o *Oscillation) run(ctx context.Context) {
+	var prev *V4NetworkOptions
+	start := time.Now()
+	ticker := time.NewTicker(o.step)
+	defer ticker.Stop()
+	log.Printf("[INFO] OSCILLATION: %s: %d generator(s), step %v", o.Options.Iface, len(o.Generators), o.step)
+	for {
+		elapsed := time.Since(start)
+		opts := o.optionsWith(func(g *Generator) float64 { return g.valueAt(elapsed, o.step) })
+		applyMu.Lock()
+		if ctx.Err() != nil { // Stopped (e.g. reset) while waiting for the lock
+			applyMu.Unlock()
+			return
+		}
+		err := opts.Adjust(ctx, prev)
+		if err == nil {
+			store.Set(opts, Actor{Source: "oscillation"})
+			prev = opts
+		}
+		applyMu.Unlock()
+		if err != nil {
+			log.Printf("[ERROR] OSCILLATION: Failed to adjust %s: %v", opts.Iface, err)
+		} else {
+			sched.mu.Lock()
+			for _, g := range o.Generators {
+				g.Value = *oscillatingParams[g.Param].field(opts)
+			}
+			o.Steps++
+			sched.mu.Unlock()
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// snapshot copies the oscillation and its generators (under sched.mu).
+func (o *Oscillation) snapshot() *Oscillation {
+	s := *o
+	s.Generators = make([]*Generator, len(o.Generators))
+	for i, g := range o.Generators {
+		c := *g
+		s.Generators[i] = &c
+	}
+	return &s
+}
+
+// --- Handlers: /oscillations ---
+
+// handleOscillationStart starts (or replaces) the oscillation of an
+// interface.
+func handleOscillationStart(w http.ResponseWriter, r *http.Request) {
+	o := &Oscillation{}
+	if err := json.NewDecoder(r.Body).Decode(o); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid oscillation JSON: %v", err), 400)
+		return
+	}
+	if err := o.validate(); err != nil {
+		respondWithLocalizedError(w, r, 400, err)
+		return
+	}
+	sort.Slice(o.Generators, func(i, j int) bool { return o.Generators[i].Param < o.Generators[j].Param })
+
+	iface := o.Options.Iface
+	sched.StopIface(iface)
+	sched.mu.Lock()
+	oscillations[iface] = o
+	snapshot := o.snapshot()
+	sched.mu.Unlock()
+	sched.Start("oscillation:"+iface, "oscillation", iface, o.run)
+	respondWithJSON(w, http.StatusOK, snapshot)
+}
+
+// handleOscillationList returns the oscillations with a running job, with
+// the values last applied.
+func handleOscillationList(w http.ResponseWriter, r *http.Request) {
+	active := map[string]*Oscillation{}
+	sched.mu.Lock()
+	for iface, o := range oscillations {
+		if _, ok := sched.jobs["oscillation:"+iface]; ok {
+			active[iface] = o.snapshot()
+		}
+	}
+	sched.mu.Unlock()
+	respondWithJSON(w, http.StatusOK, active)
+}
+
+// handleOscillationStop stops the oscillation of an interface, keeping the
+// rule of its last step.
+func handleOscillationStop(w http.ResponseWriter, r *http.Request) {
+	iface := chi.URLParam(r, "iface")
+	if !sched.Stop("oscillation:" + iface) {
+		respondWithError(w, fmt.Sprintf("no oscillation running on '%s'", iface), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
@@ -0,0 +1,552 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- One-Way Delay Probes ---
+
+// Validating a sub-millisecond impairment (a 200µs delay, 50µs of jitter)
+// needs better than the RTT of ping: /owd/run sends paced UDP probes to a
+// receiver on the peer box and timestamps each one where it leaves and
+// where it arrives, in the kernel (SO_TIMESTAMPING) or in the NIC
+// (hardware=true, on interfaces that can), not in user space. The delay
+// variation and the jitter only compare timestamps of the same clock, so
+// they are accurate whatever the offset between the boxes; the absolute
+// one-way delay also needs that offset: measured over the API (accurate to
+// half a round trip, reported), or zero with clock=synced when both boxes
+// follow the same PTP grandmaster.
+
+// Probe limits.
+const (
+	owdDefaultCount    = 1000
+	owdMaxCount        = 100000
+	owdDefaultInterval = 10 * time.Millisecond
+	owdMinInterval     = 100 * time.Microsecond
+	owdDefaultSize     = 64
+	owdHeaderSize      = 12 // session key, sequence number
+	owdMaxSize         = 1472
+	owdMaxReceivers    = 16
+	owdDefaultDuration = 2 * time.Minute
+	owdMaxDuration     = 30 * time.Minute
+	owdStragglers      = 500 * time.Millisecond // wait for the last probes
+)
+
+// owdSocket is a UDP socket whose packets are timestamped.
+type owdSocket struct {
+	conn   *net.UDPConn
+	source string // "hardware", "kernel" or "user"
+	notes  []string
+	sent   uint32 // packets sent, the key of their transmit timestamps
+}
+
+// owdStamp is when a probe left or arrived, in nanoseconds: the kernel's
+// time (of the system clock), and the NIC's (of its own clock) when there
+// is one.
+type owdStamp struct {
+	SW   int64 `json:"sw"`
+	HW   int64 `json:"hw,omitempty"`
+	User bool  `json:"user,omitempty"` // SW was taken in user space
+}
+
+// OWDReceived is the arrival of a probe.
+type OWDReceived struct {
+	Seq uint32 `json:"seq"`
+	owdStamp
+}
+
+// owdReceiver collects the probes of one session.
+type owdReceiver struct {
+	ID         string
+	key        uint64
+	sock       *owdSocket
+	timer      *time.Timer
+	mu         sync.Mutex
+	stamps     map[uint32]owdStamp
+	duplicates int
+}
+
+// owdReceivers are the open receivers, by ID.
+var owdReceivers = struct {
+	sync.Mutex
+	m map[string]*owdReceiver
+}{m: map[string]*owdReceiver{}}
+
+// owdRunning serializes the runs, whose probes would otherwise share the
+// link.
+var owdRunning sync.Mutex
+
+// OWDReceiverInfo is an open receiver.
+type OWDReceiverInfo struct {
+	ID         string         `json:"id"`
+	Port       int            `json:"port"`
+	Timestamps string         `json:"timestamps"` // "hardware", "kernel" or "user"
+	Notes      []string       `json:"notes,omitempty"`
+	Duplicates int            `json:"duplicates,omitempty"`
+	Received   []*OWDReceived `json:"received,omitempty"`
+}
+
+// startOWDReceiver opens a receiver on iface (any when empty) that closes
+// itself after duration.
+func startOWDReceiver(iface string, hardware bool, duration time.Duration) (*owdReceiver, error) {
+	owdReceivers.Lock()
+	defer owdReceivers.Unlock()
+	if len(owdReceivers.m) >= owdMaxReceivers {
+		return nil, fmt.Errorf("owd: too many open receivers (%d)", owdMaxReceivers)
+	}
+	sock, err := openOWDSocket(&net.UDPAddr{}, iface, hardware)
+	if err != nil {
+		return nil, err
+	}
+	var b [8]byte
+	rand.Read(b[:])
+	rx := &owdReceiver{key: binary.BigEndian.Uint64(b[:]), sock: sock, stamps: map[uint32]owdStamp{}}
+	rx.ID = fmt.Sprintf("%016x", rx.key)
+	rx.timer = time.AfterFunc(duration, func() { stopOWDReceiver(rx.ID) })
+	owdReceivers.m[rx.ID] = rx
+	go rx.receive()
+	log.Printf("[INFO] OWD: Receiver %s listening on port %d (%s timestamps)", rx.ID, rx.port(), sock.source)
+	return rx, nil
+}
+
+// stopOWDReceiver closes a receiver, and returns it (nil if unknown).
+func stopOWDReceiver(id string) *owdReceiver {
+	owdReceivers.Lock()
+	rx := owdReceivers.m[id]
+	delete(owdReceivers.m, id)
+	owdReceivers.Unlock()
+	if rx != nil {
+		rx.timer.Stop()
+		rx.sock.conn.Close()
+	}
+	return rx
+}
+
+func (rx *owdReceiver) port() int {
+	return rx.sock.conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// receive records the first arrival of every probe of the session until
+// the socket is closed.
+func (rx *owdReceiver) receive() {
+	b := make([]byte, owdMaxSize)
+	for {
+		n, stamp, err := rx.sock.receiveProbe(b)
+		if err != nil {
+			return
+		}
+		if n < owdHeaderSize || binary.BigEndian.Uint64(b) != rx.key {
+			continue
+		}
+		seq := binary.BigEndian.Uint32(b[8:])
+		rx.mu.Lock()
+		if _, dup := rx.stamps[seq]; dup {
+			rx.duplicates++
+		} else if len(rx.stamps) < owdMaxCount {
+			rx.stamps[seq] = stamp
+		}
+		rx.mu.Unlock()
+	}
+}
+
+// info returns the receiver, with its arrivals if withReceived.
+func (rx *owdReceiver) info(withReceived bool) *OWDReceiverInfo {
+	rx.mu.Lock()
+	defer rx.mu.Unlock()
+	info := &OWDReceiverInfo{ID: rx.ID, Port: rx.port(), Timestamps: rx.sock.source, Notes: rx.sock.notes, Duplicates: rx.duplicates}
+	if withReceived {
+		info.Received = make([]*OWDReceived, 0, len(rx.stamps))
+		for seq, stamp := range rx.stamps {
+			info.Received = append(info.Received, &OWDReceived{Seq: seq, owdStamp: stamp})
+		}
+		sort.Slice(info.Received, func(i, j int) bool { return info.Received[i].Seq < info.Received[j].Seq })
+	}
+	return info
+}
+
+// OWDStats summarizes delays, in microseconds.
+type OWDStats struct {
+	Min    float64 `json:"min"`
+	Mean   float64 `json:"mean"`
+	P50    float64 `json:"p50"`
+	P99    float64 `json:"p99"`
+	Max    float64 `json:"max"`
+	Stddev float64 `json:"stddev"`
+}
+
+// OWDReport is the result of a run.
+type OWDReport struct {
+	Peer               string    `json:"peer,omitempty"`
+	Target             string    `json:"target"`
+	Count              int       `json:"count"`
+	IntervalUs         float64   `json:"intervalUs"`
+	Size               int       `json:"size"`
+	Received           int       `json:"received"`
+	LossPercent        float64   `json:"lossPercent"`
+	Reordered          int       `json:"reordered"`
+	Duplicates         int       `json:"duplicates,omitempty"`
+	Timestamps         string    `json:"timestamps"` // the worst of both ends: "hardware", "kernel" or "user"
+	OneWayDelayUs      *OWDStats `json:"oneWayDelayUs,omitempty"`
+	DelayVariationUs   *OWDStats `json:"delayVariationUs,omitempty"` // delay - the smallest delay
+	JitterUs           float64   `json:"jitterUs"`                   // RFC 3550 interarrival jitter
+	ClockOffsetUs      float64   `json:"clockOffsetUs"`              // peer clock - our clock
+	ClockUncertaintyUs float64   `json:"clockUncertaintyUs"`
+	Notes              []string  `json:"notes,omitempty"`
+	Started            TcTime    `json:"started"`
+}
+
+// owdRun is a run's request.
+type owdRun struct {
+	peer, target, iface, peerIface string
+	count, size                    int
+	interval                       time.Duration
+	hardware, synced               bool
+}
+
+// parseOWDRun reads the query of /owd/run.
+func parseOWDRun(r *http.Request) (*owdRun, error) {
+	q := r.URL.Query()
+	run := &owdRun{
+		peer: q.Get("peer"), target: q.Get("target"), iface: q.Get("iface"), peerIface: q.Get("peerIface"),
+		count: owdDefaultCount, size: owdDefaultSize, interval: owdDefaultInterval,
+		hardware: q.Get("hardware") == "true",
+	}
+	if v := q.Get("count"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 2 || n > owdMaxCount {
+			return nil, fmt.Errorf("owd: 'count' must be between 2 and %d", owdMaxCount)
+		}
+		run.count = n
+	}
+	if v := q.Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < owdHeaderSize || n > owdMaxSize {
+			return nil, fmt.Errorf("owd: 'size' must be between %d and %d bytes", owdHeaderSize, owdMaxSize)
+		}
+		run.size = n
+	}
+	if v := q.Get("interval"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < owdMinInterval {
+			return nil, fmt.Errorf("owd: 'interval' must be a duration of at least %v", owdMinInterval)
+		}
+		run.interval = d
+	}
+	switch q.Get("clock") {
+	case "", "measure":
+	case "synced":
+		run.synced = true
+	default:
+		return nil, fmt.Errorf("owd: invalid 'clock' %q (measure, synced)", q.Get("clock"))
+	}
+	if run.peer != "" {
+		// The receiver is opened with the FLEET_TOKEN: fleet members only
+		member, err := fleetPeer(run.peer)
+		if err != nil {
+			return nil, fmt.Errorf("owd: %w", err)
+		}
+		u, err := url.Parse(member.APIURL)
+		if err != nil || u.Hostname() == "" {
+			return nil, fmt.Errorf("owd: invalid API URL %q of peer '%s'", member.APIURL, member.ID)
+		}
+		if run.target == "" {
+			run.target = u.Hostname()
+		}
+	} else if run.target == "" {
+		run.target = "127.0.0.1"
+	}
+	return run, nil
+}
+
+// sendProbes sends the probes of a session to addr, paced on an absolute
+// schedule, and returns their transmit timestamps (zero when the send
+// failed).
+func sendProbes(ctx context.Context, sock *owdSocket, addr *net.UDPAddr, key uint64, run *owdRun) ([]owdStamp, int) {
+	b := make([]byte, run.size)
+	binary.BigEndian.PutUint64(b, key)
+	sent := make([]owdStamp, run.count)
+	failed := 0
+	start := time.Now()
+	for i := 0; i < run.count; i++ {
+		if ctx.Err() != nil {
+			return sent[:i], failed
+		}
+		if wait := time.Until(start.Add(time.Duration(i) * run.interval)); wait > 0 {
+			time.Sleep(wait)
+		}
+		binary.BigEndian.PutUint32(b[8:], uint32(i))
+		stamp, err := sock.sendProbe(b, addr)
+		if err != nil {
+			failed++
+			continue
+		}
+		sent[i] = stamp
+	}
+	return sent, failed
+}
+
+// runOWD runs a session and reports it.
+func runOWD(ctx context.Context, run *owdRun) (*OWDReport, error) {
+	report := &OWDReport{Peer: run.peer, Target: run.target, Count: run.count, IntervalUs: float64(run.interval) / 1e3, Size: run.size, Started: TcTime(time.Now())}
+	duration := time.Duration(run.count)*run.interval + time.Minute
+
+	// The receiver: on the peer, or here
+	var info OWDReceiverInfo
+	var local *owdReceiver
+	if run.peer != "" {
+		path := fmt.Sprintf("/owd/receivers?iface=%s&hardware=%t&duration=%s", url.QueryEscape(run.peerIface), run.hardware, duration)
+		if err := peerRequest(ctx, http.MethodPost, run.peer, path, nil, &info); err != nil {
+			return nil, fmt.Errorf("owd: failed to open a receiver on the peer: %w", err)
+		}
+		defer peerRequest(context.WithoutCancel(ctx), http.MethodDelete, run.peer, "/owd/receivers/"+info.ID, nil, nil)
+	} else {
+		var err error
+		if local, err = startOWDReceiver(run.peerIface, run.hardware, duration); err != nil {
+			return nil, err
+		}
+		defer stopOWDReceiver(local.ID)
+		info = *local.info(false)
+	}
+	key, err := strconv.ParseUint(info.ID, 16, 64)
+	if err != nil {
+		return nil, fmt.Errorf("owd: unexpected receiver id %q", info.ID)
+	}
+	report.Notes = append(report.Notes, info.Notes...)
+
+	ip, err := net.ResolveIPAddr("ip", run.target)
+	if err != nil {
+		return nil, fmt.Errorf("owd: invalid 'target' %q: %w", run.target, err)
+	}
+	addr := &net.UDPAddr{IP: ip.IP, Port: info.Port}
+	sock, err := openOWDSocket(nil, run.iface, run.hardware)
+	if err != nil {
+		return nil, err
+	}
+	defer sock.conn.Close()
+	for _, note := range sock.notes {
+		if !slices.Contains(report.Notes, note) {
+			report.Notes = append(report.Notes, note)
+		}
+	}
+
+	sent, failed := sendProbes(ctx, sock, addr, key, run)
+	if failed > 0 {
+		report.Notes = append(report.Notes, fmt.Sprintf("%d probe(s) could not be sent", failed))
+	}
+	select {
+	case <-time.After(owdStragglers):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	// The arrivals, and the clock they were stamped with
+	var received OWDReceiverInfo
+	var offset time.Duration
+	if run.peer != "" {
+		if err := peerRequest(ctx, http.MethodGet, run.peer, "/owd/receivers/"+info.ID, nil, &received); err != nil {
+			return nil, fmt.Errorf("owd: failed to fetch the arrivals from the peer: %w", err)
+		}
+		if run.synced {
+			report.Notes = append(report.Notes, "clock=synced: the clocks of both boxes are taken as equal")
+		} else {
+			var uncertainty time.Duration
+			if offset, uncertainty, err = measurePeerClock(ctx, run.peer); err != nil {
+				return nil, fmt.Errorf("owd: failed to measure the peer's clock: %w", err)
+			}
+			report.ClockOffsetUs = roundTo(float64(offset)/1e3, 1)
+			report.ClockUncertaintyUs = roundTo(float64(uncertainty)/1e3, 1)
+			report.Notes = append(report.Notes, fmt.Sprintf("the one-way delay is accurate to ±%vµs (the clock offset, measured over the API); with PTP on both boxes use clock=synced", report.ClockUncertaintyUs))
+		}
+	} else {
+		received = *local.info(true)
+	}
+	report.Duplicates = received.Duplicates
+	owdAnalyze(report, sent, received.Received, offset, run.peer == "" || run.synced)
+	return report, nil
+}
+
+// owdAnalyze fills report from the transmit stamps (by sequence number) and
+// the arrivals. offset is the receiver's clock minus the sender's;
+// sameClock tells whether the NICs' clocks of both ends agree (one box, or
+// PTP).
+func owdAnalyze(report *OWDReport, sent []owdStamp, received []*OWDReceived, offset time.Duration, sameClock bool) {
+	type pair struct {
+		seq    int
+		tx, rx owdStamp
+	}
+	var pairs []pair
+	hardware, user := true, false
+	for _, r := range received {
+		if int(r.Seq) >= len(sent) || sent[r.Seq].SW == 0 && sent[r.Seq].HW == 0 {
+			continue
+		}
+		p := pair{int(r.Seq), sent[r.Seq], r.owdStamp}
+		hardware = hardware && p.tx.HW != 0 && p.rx.HW != 0
+		user = user || p.tx.User || p.rx.User
+		pairs = append(pairs, p)
+	}
+	report.Received = len(pairs)
+	report.LossPercent = roundTo(float64(len(sent)-len(pairs))/float64(max(len(sent), 1))*100, 2)
+	switch {
+	case len(pairs) > 0 && hardware:
+		report.Timestamps = "hardware"
+	case user:
+		report.Timestamps = "user"
+	default:
+		report.Timestamps = "kernel"
+	}
+	if len(pairs) == 0 {
+		return
+	}
+
+	// The transit time of every probe, in arrival order. Hardware stamps
+	// are of the NICs' clocks, the others of the system clocks
+	type transit struct {
+		seq      int
+		arrival  int64
+		duration float64 // ns
+	}
+	transits := make([]transit, len(pairs))
+	for i, p := range pairs {
+		tx, rx := p.tx.SW, p.rx.SW
+		if hardware {
+			tx, rx = p.tx.HW, p.rx.HW
+		}
+		transits[i] = transit{seq: p.seq, arrival: rx, duration: float64(rx - tx - int64(offset))}
+	}
+	sort.SliceStable(transits, func(i, j int) bool { return transits[i].arrival < transits[j].arrival })
+
+	delays := make([]float64, len(transits))
+	highest := -1
+	for i, t := range transits {
+		delays[i] = t.duration / 1e3
+		if t.seq < highest {
+			report.Reordered++
+		}
+		highest = max(highest, t.seq)
+		if i > 0 {
+			d := math.Abs(t.duration - transits[i-1].duration)
+			report.JitterUs += (d/1e3 - report.JitterUs) / 16
+		}
+	}
+	report.JitterUs = roundTo(report.JitterUs, 2)
+
+	sort.Float64s(delays)
+	variation := make([]float64, len(delays))
+	for i, d := range delays {
+		variation[i] = d - delays[0]
+	}
+	report.DelayVariationUs = owdStats(variation)
+	if hardware && !sameClock {
+		report.Notes = append(report.Notes, "hardware timestamps are of the NICs' clocks: the one-way delay needs them synchronized with PTP (clock=synced); the delay variation and the jitter do not")
+		return
+	}
+	report.OneWayDelayUs = owdStats(delays)
+}
+
+// owdStats summarizes sorted values.
+func owdStats(sorted []float64) *OWDStats {
+	return &OWDStats{
+		Min:    roundTo(sorted[0], 2),
+		Mean:   roundTo(mean(sorted), 2),
+		P50:    roundTo(percentile(sorted, 50), 2),
+		P99:    roundTo(percentile(sorted, 99), 2),
+		Max:    roundTo(sorted[len(sorted)-1], 2),
+		Stddev: roundTo(stddev(sorted), 2),
+	}
+}
+
+// --- Handlers: /owd ---
+
+// handleOWDRun measures the one-way delay to a receiver on 'peer' (or on
+// this box).
+func handleOWDRun(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	run, err := parseOWDRun(r)
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	if !owdRunning.TryLock() {
+		respondWithError(w, "owd: a run is in progress", 409)
+		return
+	}
+	defer owdRunning.Unlock()
+	report, err := runOWD(r.Context(), run)
+	if err != nil {
+		respondWithError(w, err.Error(), 502)
+		return
+	}
+	log.Printf("[INFO] OWD: %d probe(s) to %s, %d received, jitter %vµs (%s timestamps)", report.Count, report.Target, report.Received, report.JitterUs, report.Timestamps)
+	respondWithJSON(w, http.StatusOK, report)
+}
+
+// handleOWDReceiverStart opens a receiver for a peer's run.
+func handleOWDReceiverStart(w http.ResponseWriter, r *http.Request) {
+	if !fleetAuthorized(r) {
+		respondWithError(w, "owd: invalid token", 401)
+		return
+	}
+	q := r.URL.Query()
+	duration := owdDefaultDuration
+	if v := q.Get("duration"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 || d > owdMaxDuration {
+			respondWithError(w, fmt.Sprintf("owd: 'duration' must be a duration of at most %v", owdMaxDuration), 400)
+			return
+		}
+		duration = d
+	}
+	rx, err := startOWDReceiver(q.Get("iface"), q.Get("hardware") == "true", duration)
+	if err != nil {
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, rx.info(false))
+}
+
+// handleOWDReceiverGet returns a receiver with the probes it received.
+func handleOWDReceiverGet(w http.ResponseWriter, r *http.Request) {
+	if !fleetAuthorized(r) {
+		respondWithError(w, "owd: invalid token", 401)
+		return
+	}
+	owdReceivers.Lock()
+	rx := owdReceivers.m[chi.URLParam(r, "id")]
+	owdReceivers.Unlock()
+	if rx == nil {
+		respondWithError(w, "owd: unknown receiver", 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, rx.info(true))
+}
+
+// handleOWDReceiverStop closes a receiver.
+func handleOWDReceiverStop(w http.ResponseWriter, r *http.Request) {
+	if !fleetAuthorized(r) {
+		respondWithError(w, "owd: invalid token", 401)
+		return
+	}
+	if stopOWDReceiver(chi.URLParam(r, "id")) == nil {
+		respondWithError(w, "owd: unknown receiver", 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
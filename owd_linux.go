@@ -0,0 +1,199 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"runtime"
+	"syscall"
+	"time"
+	"unsafe"
+)
+
+// --- One-Way Delay Probes (Linux) ---
+
+// SO_TIMESTAMPING flags (linux/net_tstamp.h)
+const (
+	sofTimestampingTxHardware  = 1 << 0
+	sofTimestampingTxSoftware  = 1 << 1
+	sofTimestampingRxHardware  = 1 << 2
+	sofTimestampingRxSoftware  = 1 << 3
+	sofTimestampingSoftware    = 1 << 4
+	sofTimestampingRawHardware = 1 << 6
+	sofTimestampingOptID       = 1 << 7
+	sofTimestampingOptTSOnly   = 1 << 11
+)
+
+// NIC hardware timestamping (linux/sockios.h, linux/net_tstamp.h)
+const (
+	siocSHWTSTAMP     = 0x89b0
+	hwtstampTxOn      = 1
+	hwtstampFilterAll = 1
+)
+
+// hwtstampConfig is struct hwtstamp_config.
+type hwtstampConfig struct {
+	flags    int32
+	txType   int32
+	rxFilter int32
+}
+
+// ifreqData is struct ifreq with the ifr_data member.
+type ifreqData struct {
+	name [syscall.IFNAMSIZ]byte
+	data uintptr
+	_    [24 - unsafe.Sizeof(uintptr(0))]byte
+}
+
+// enableHardwareTimestamps asks the NIC of iface to timestamp every packet
+// it sends and receives. The setting stays after the probe.
+func enableHardwareTimestamps(fd int, iface string) error {
+	cfg := hwtstampConfig{txType: hwtstampTxOn, rxFilter: hwtstampFilterAll}
+	var ifr ifreqData
+	copy(ifr.name[:], iface)
+	ifr.data = uintptr(unsafe.Pointer(&cfg))
+	_, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), siocSHWTSTAMP, uintptr(unsafe.Pointer(&ifr)))
+	runtime.KeepAlive(&cfg)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// openOWDSocket opens a UDP socket on laddr (bound to iface when set) with
+// kernel timestamps, and with the NIC's when hardware is set and the NIC
+// can do it.
+func openOWDSocket(laddr *net.UDPAddr, iface string, hardware bool) (*owdSocket, error) {
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &owdSocket{conn: conn, source: "kernel"}
+	flags := sofTimestampingTxSoftware | sofTimestampingRxSoftware | sofTimestampingSoftware |
+		sofTimestampingOptID | sofTimestampingOptTSOnly
+	rc, err := conn.SyscallConn()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	var sockErr error
+	rc.Control(func(fd uintptr) {
+		if iface != "" {
+			if sockErr = syscall.BindToDevice(int(fd), iface); sockErr != nil {
+				return
+			}
+		}
+		if hardware {
+			if iface == "" {
+				s.notes = append(s.notes, "hardware timestamps need 'iface': kernel timestamps are used")
+			} else if err := enableHardwareTimestamps(int(fd), iface); err != nil {
+				s.notes = append(s.notes, fmt.Sprintf("%s cannot timestamp packets in hardware (%v): kernel timestamps are used", iface, err))
+			} else {
+				flags |= sofTimestampingTxHardware | sofTimestampingRxHardware | sofTimestampingRawHardware
+				s.source = "hardware"
+			}
+		}
+		if sockErr == nil {
+			sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_TIMESTAMPING, flags)
+		}
+	})
+	if sockErr != nil {
+		conn.Close()
+		return nil, fmt.Errorf("owd: failed to enable kernel timestamps: %w", sockErr)
+	}
+	return s, nil
+}
+
+// parseTimestamps reads the SCM_TIMESTAMPING message of oob: the
+// software time, and the raw hardware time (0 when missing).
+func parseTimestamps(oob []byte) (stamp owdStamp, ok bool) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return stamp, false
+	}
+	size := int(unsafe.Sizeof(syscall.Timespec{}))
+	for _, m := range msgs {
+		if m.Header.Level != syscall.SOL_SOCKET || m.Header.Type != syscall.SO_TIMESTAMPING || len(m.Data) < 3*size {
+			continue
+		}
+		ts := (*[3]syscall.Timespec)(unsafe.Pointer(&m.Data[0]))
+		stamp.SW, stamp.HW = ts[0].Nano(), ts[2].Nano()
+		return stamp, stamp.SW != 0 || stamp.HW != 0
+	}
+	return stamp, false
+}
+
+// sendProbe sends b to addr and returns when it left: its transmit
+// timestamps, read from the socket's error queue (the kernel's and the
+// NIC's come separately), or the time of the call when the kernel gives
+// none.
+func (s *owdSocket) sendProbe(b []byte, addr *net.UDPAddr) (owdStamp, error) {
+	before := time.Now()
+	if _, err := s.conn.WriteToUDP(b, addr); err != nil {
+		return owdStamp{}, err
+	}
+	key := s.sent
+	s.sent++
+	rc, err := s.conn.SyscallConn()
+	if err != nil {
+		return owdStamp{}, err
+	}
+	s.conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	defer s.conn.SetReadDeadline(time.Time{})
+	var stamp owdStamp
+	oob := make([]byte, 512)
+	for stamp.SW == 0 || s.source == "hardware" && stamp.HW == 0 {
+		var recvErr error
+		err := rc.Read(func(fd uintptr) bool {
+			var oobn int
+			_, oobn, _, _, recvErr = syscall.Recvmsg(int(fd), nil, oob, syscall.MSG_ERRQUEUE)
+			if recvErr == syscall.EAGAIN {
+				return false
+			}
+			if recvErr == nil && errQueueKey(oob[:oobn]) == key {
+				if got, ok := parseTimestamps(oob[:oobn]); ok {
+					stamp.SW, stamp.HW = max(stamp.SW, got.SW), max(stamp.HW, got.HW)
+				}
+			}
+			return true
+		})
+		if err != nil || recvErr != nil {
+			break
+		}
+	}
+	if stamp.SW == 0 && stamp.HW == 0 {
+		return owdStamp{SW: before.UnixNano(), User: true}, nil
+	}
+	return stamp, nil
+}
+
+// errQueueKey returns the counter (SOF_TIMESTAMPING_OPT_ID) of the packet a
+// timestamp of the error queue belongs to: ee_data of its
+// sock_extended_err.
+func errQueueKey(oob []byte) uint32 {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return ^uint32(0)
+	}
+	for _, m := range msgs {
+		if (m.Header.Level == syscall.IPPROTO_IP && m.Header.Type == syscall.IP_RECVERR ||
+			m.Header.Level == syscall.IPPROTO_IPV6 && m.Header.Type == syscall.IPV6_RECVERR) && len(m.Data) >= 16 {
+			return binary.NativeEndian.Uint32(m.Data[12:16])
+		}
+	}
+	return ^uint32(0)
+}
+
+// receiveProbe reads a packet into b and returns when it arrived: its
+// receive timestamp, or the time it was read when the kernel gives none.
+func (s *owdSocket) receiveProbe(b []byte) (int, owdStamp, error) {
+	oob := make([]byte, 512)
+	n, oobn, _, _, err := s.conn.ReadMsgUDP(b, oob)
+	if err != nil {
+		return 0, owdStamp{}, err
+	}
+	if stamp, ok := parseTimestamps(oob[:oobn]); ok {
+		return n, stamp, nil
+	}
+	return n, owdStamp{SW: time.Now().UnixNano(), User: true}, nil
+}
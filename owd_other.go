@@ -0,0 +1,36 @@
+//go:build !linux
+
+package main
+
+import (
+	"net"
+	"time"
+)
+
+// openOWDSocket opens a UDP socket on laddr. Outside Linux the probes are
+// timestamped in user space.
+func openOWDSocket(laddr *net.UDPAddr, iface string, hardware bool) (*owdSocket, error) {
+	conn, err := net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	s := &owdSocket{conn: conn, source: "user"}
+	if hardware {
+		s.notes = append(s.notes, "hardware timestamps need Linux: user-space timestamps are used")
+	}
+	return s, nil
+}
+
+// sendProbe sends b to addr and returns the time of the call.
+func (s *owdSocket) sendProbe(b []byte, addr *net.UDPAddr) (owdStamp, error) {
+	at := time.Now()
+	_, err := s.conn.WriteToUDP(b, addr)
+	s.sent++
+	return owdStamp{SW: at.UnixNano(), User: true}, err
+}
+
+// receiveProbe reads a packet into b and returns the time it was read.
+func (s *owdSocket) receiveProbe(b []byte) (int, owdStamp, error) {
+	n, _, err := s.conn.ReadFromUDP(b)
+	return n, owdStamp{SW: time.Now().UnixNano(), User: true}, err
+}
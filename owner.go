@@ -0,0 +1,223 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+)
+
+// --- Ownership Markers ---
+
+// The qdiscs and classes the tool creates take their handles from a
+// reserved range (majors 4e53: to 4fff:), and the actions of its ingress
+// and mirror filters carry ownerCookie. Cleanup, drift detection and
+// adoption only touch what carries these markers, so the host's own QoS
+// (and e.g. eBPF programs on the ingress hook) is left alone.
+const (
+	ownHandleFirst = 0x4e53
+	ownHandleLast  = 0x4fff
+
+	rootHandle     = "4e53:"   // htb or prio root (and a taken-over mq root)
+	unlimitedClass = "4e53:10" // htb: API and unimpaired traffic
+	shapedClass    = "4e53:11" // htb: impaired traffic (the default class)
+	unimpairedBand = "4e53:1"  // prio: API and unimpaired traffic
+	impairedBand   = "4e53:2"  // prio: impaired traffic
+	netemHandle    = "4e54:"   // netem below the shaped class or band, or as root
+	flowCapHandle  = "4fff:"   // fq below netem or the shaped class (rateScope=flow)
+
+	ownerCookie = "6e657473696d" // "netsim" in hex
+)
+
+// ownsHandle reports whether a qdisc handle ("4e53:") or class id
+// ("4e53:11") is in the reserved range.
+func ownsHandle(handle string) bool {
+	major, _, found := strings.Cut(handle, ":")
+	if !found {
+		return false
+	}
+	n, err := strconv.ParseUint(major, 16, 16)
+	return err == nil && n >= ownHandleFirst && n <= ownHandleLast
+}
+
+// withCookie marks the action of a filter (the last arguments) as ours.
+func withCookie(args ...string) []string {
+	return append(args, "cookie", ownerCookie)
+}
+
+// tcFilter is one filter of 'tc filter show', with the lines of its actions.
+type tcFilter struct {
+	pref string
+	text string
+}
+
+// own reports whether the filter was added by the tool.
+func (f tcFilter) own() bool {
+	return strings.Contains(f.text, "cookie "+ownerCookie)
+}
+
+// parseFilters splits 'tc filter show' output into filters. The header
+// lines of each classifier and u32 hash table are skipped.
+func parseFilters(out string) []tcFilter {
+	var filters []tcFilter
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) > 0 && fields[0] == "filter" {
+			f := tcFilter{text: line}
+			for i := 0; i+1 < len(fields); i++ {
+				if fields[i] == "pref" {
+					f.pref = fields[i+1]
+				}
+			}
+			if !strings.Contains(line, " handle ") && (!strings.Contains(line, "::") || strings.Contains(line, "ht divisor")) {
+				f.pref = "" // The classifier itself, or a u32 hash table
+			}
+			filters = append(filters, f)
+			continue
+		}
+		if len(filters) > 0 {
+			filters[len(filters)-1].text += "\n" + line
+		}
+	}
+	var result []tcFilter
+	for _, f := range filters {
+		if f.pref != "" {
+			result = append(result, f)
+		}
+	}
+	return result
+}
+
+// ingressQdisc returns the kind of the ingress qdisc of iface ("clsact" or
+// "ingress"), or "".
+func ingressQdisc(ctx context.Context, iface string) string {
+	out, _ := runTCOutput(ctx, "qdisc", "show", "dev", iface)
+	switch {
+	case strings.Contains(out, "qdisc clsact ffff:"):
+		return "clsact"
+	case strings.Contains(out, "qdisc ingress ffff:"):
+		return "ingress"
+	}
+	return ""
+}
+
+// ownIngressFilters returns the filters the tool added to the ingress hook
+// of iface (and the egress hook of clsact), and whether other filters are
+// there too.
+func ownIngressFilters(ctx context.Context, iface string) (own map[string][]tcFilter, foreign bool) {
+	own = map[string][]tcFilter{}
+	hooks := []string{"ingress"}
+	if ingressQdisc(ctx, iface) == "clsact" {
+		hooks = append(hooks, "egress")
+	}
+	for _, hook := range hooks {
+		out, err := runTCOutput(ctx, "filter", "show", "dev", iface, hook)
+		if err != nil {
+			continue
+		}
+		for _, f := range parseFilters(out) {
+			if f.own() {
+				own[hook] = append(own[hook], f)
+			} else {
+				foreign = true
+			}
+		}
+	}
+	return own, foreign
+}
+
+// cleanupOwnIngress removes the filters the tool added to the ingress (and
+// clsact egress) hooks of iface, and the ingress/clsact qdisc unless other
+// filters are still attached to it.
+func cleanupOwnIngress(ctx context.Context, iface string) error {
+	kind := ingressQdisc(ctx, iface)
+	if kind == "" {
+		return nil
+	}
+	own, foreign := ownIngressFilters(ctx, iface)
+	if !foreign {
+		return runTC(ctx, "qdisc", "del", "dev", iface, kind)
+	}
+	var failures []string
+	for hook, filters := range own {
+		deleted := map[string]bool{}
+		for _, f := range filters {
+			if deleted[f.pref] {
+				continue
+			}
+			deleted[f.pref] = true
+			if err := runTC(ctx, "filter", "del", "dev", iface, hook, "pref", f.pref); err != nil {
+				failures = append(failures, fmt.Sprintf("%s pref %s: %v", hook, f.pref, err))
+			}
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("failed to remove filters of '%s': %s", iface, strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// ownAttachments returns where the tool's qdiscs hang in the tree of iface:
+// "root", or the class of the host's tree they are the leaf of (coexistence
+// mode, or a transmit queue of mq/mqprio).
+func ownAttachments(ctx context.Context, iface string) []string {
+	out, err := runTCOutput(ctx, "qdisc", "show", "dev", iface)
+	if err != nil {
+		return nil
+	}
+	var parents []string
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "qdisc" || !ownsHandle(fields[2]) {
+			continue
+		}
+		switch {
+		case fields[3] == "root":
+			parents = append(parents, "root")
+		case fields[3] == "parent" && len(fields) > 4 && !ownsHandle(fields[4]):
+			parents = append(parents, fields[4])
+		}
+	}
+	return parents
+}
+
+// removeOwnAttachments removes the tool's qdiscs from the tree of iface
+// (see ownAttachments); in coexistence mode the host's class stays, with
+// its default qdisc.
+func removeOwnAttachments(ctx context.Context, iface string) {
+	for _, parent := range ownAttachments(ctx, iface) {
+		args := []string{"qdisc", "del", "dev", iface, "root"}
+		if parent != "root" {
+			args = []string{"qdisc", "del", "dev", iface, "parent", parent}
+		}
+		if err := runTC(ctx, args...); err != nil {
+			log.Printf("[DEBUG] V4 Cleanup: Failed to clean %s of %s (likely already clean): %v", parent, iface, err)
+		}
+	}
+}
+
+// hasOwnQdiscs reports whether iface carries qdiscs or ingress filters the
+// tool created.
+func hasOwnQdiscs(ctx context.Context, iface string) bool {
+	out, err := runTCOutput(ctx, "qdisc", "show", "dev", iface)
+	if err != nil {
+		return true // let the cleanup try
+	}
+	if showsOwnQdisc(out) {
+		return true
+	}
+	own, _ := ownIngressFilters(ctx, iface)
+	return len(own) > 0
+}
+
+// showsOwnQdisc reports whether 'tc qdisc show' output lists a qdisc with a
+// handle in the reserved range.
+func showsOwnQdisc(out string) bool {
+	for _, line := range strings.Split(out, "\n") {
+		if fields := strings.Fields(line); len(fields) >= 3 && fields[0] == "qdisc" && ownsHandle(fields[2]) {
+			return true
+		}
+	}
+	return false
+}
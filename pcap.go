@@ -0,0 +1,113 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"time"
+)
+
+// --- pcap Reader ---
+
+// pcap link types handled by the readers.
+const (
+	linkTypeEthernet = 1
+	linkTypeRaw      = 101 // raw IPv4/IPv6
+	linkTypeLinuxSLL = 113 // tcpdump -i any
+)
+
+// pcapPacket is one captured packet. Data is only valid until the next call
+// to Next.
+type pcapPacket struct {
+	Time    time.Time
+	Data    []byte
+	OrigLen uint32
+}
+
+// pcapReader reads a classic pcap stream (e.g. tcpdump -w -).
+type pcapReader struct {
+	r        io.Reader
+	order    binary.ByteOrder
+	nano     bool
+	LinkType uint32
+	buf      []byte
+}
+
+// newPcapReader reads the global header of a pcap stream.
+func newPcapReader(r io.Reader) (*pcapReader, error) {
+	var global [24]byte
+	if _, err := io.ReadFull(r, global[:]); err != nil {
+		return nil, fmt.Errorf("read pcap header: %w", err)
+	}
+	p := &pcapReader{r: r, buf: make([]byte, 65536)}
+	switch binary.LittleEndian.Uint32(global[0:4]) {
+	case 0xa1b2c3d4:
+		p.order = binary.LittleEndian
+	case 0xa1b23c4d:
+		p.order, p.nano = binary.LittleEndian, true
+	case 0xd4c3b2a1:
+		p.order = binary.BigEndian
+	case 0x4d3cb2a1:
+		p.order, p.nano = binary.BigEndian, true
+	default:
+		return nil, fmt.Errorf("not a pcap stream (pcapng is not supported)")
+	}
+	p.LinkType = p.order.Uint32(global[20:24])
+	return p, nil
+}
+
+// Next returns the next packet, or io.EOF at the end of the stream.
+func (p *pcapReader) Next() (pcapPacket, error) {
+	var rec [16]byte
+	if _, err := io.ReadFull(p.r, rec[:]); err != nil {
+		return pcapPacket{}, err
+	}
+	capLen, origLen := p.order.Uint32(rec[8:12]), p.order.Uint32(rec[12:16])
+	if capLen > uint32(len(p.buf)) {
+		return pcapPacket{}, fmt.Errorf("invalid pcap record length %d", capLen)
+	}
+	if _, err := io.ReadFull(p.r, p.buf[:capLen]); err != nil {
+		return pcapPacket{}, err
+	}
+	frac := time.Duration(p.order.Uint32(rec[4:8]))
+	if !p.nano {
+		frac *= time.Microsecond
+	}
+	ts := time.Unix(int64(p.order.Uint32(rec[0:4])), int64(frac))
+	return pcapPacket{Time: ts, Data: p.buf[:capLen], OrigLen: origLen}, nil
+}
+
+// networkLayer returns the IP packet of a captured frame and its IP version
+// (4 or 6), or 0 for other protocols.
+func (p *pcapReader) networkLayer(frame []byte) ([]byte, int) {
+	var etherType uint16
+	switch p.LinkType {
+	case linkTypeEthernet:
+		if len(frame) < 14 {
+			return nil, 0
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame[12:14]), frame[14:]
+		if etherType == 0x8100 && len(frame) >= 4 { // 802.1Q
+			etherType, frame = binary.BigEndian.Uint16(frame[2:4]), frame[4:]
+		}
+	case linkTypeLinuxSLL:
+		if len(frame) < 16 {
+			return nil, 0
+		}
+		etherType, frame = binary.BigEndian.Uint16(frame[14:16]), frame[16:]
+	case linkTypeRaw:
+		if len(frame) == 0 {
+			return nil, 0
+		}
+		return frame, int(frame[0] >> 4)
+	default:
+		return nil, 0
+	}
+	switch etherType {
+	case 0x0800:
+		return frame, 4
+	case 0x86dd:
+		return frame, 6
+	}
+	return nil, 0
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// --- Handler: /plan ---
+
+// PlanStep is one command of a plan with a human-readable description.
+type PlanStep struct {
+	Description string `json:"description"`
+	Command     string `json:"command"`
+}
+
+// Plan is what /setup would do on one interface, without doing it.
+type Plan struct {
+	Iface           string              `json:"iface"`
+	Steps           []PlanStep          `json:"steps"`
+	Warnings        []string            `json:"warnings,omitempty"`
+	Conflicts       []*RuleConflict     `json:"conflicts,omitempty"`
+	Error           string              `json:"error,omitempty"`
+	EstimatedEffect *ImpairmentEstimate `json:"estimatedEffect"`
+	Shadow          *ShadowResult       `json:"shadow,omitempty"` // with shadow=true
+}
+
+// handleTcPlan takes the same parameters as /setup (plus the /estimate
+// 'baseRtt' and 'mss') and returns, per target interface, the commands that
+// would run, warnings and the expected effect. Nothing is changed.
+func handleTcPlan(w http.ResponseWriter, r *http.Request) {
+	baseRttMs, mss, err := estimateParams(r)
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	q, err := withProfile(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	targets, err := resolveTargetInterfaces(q.Get("iface"), q.Get("ifaceRegex"))
+	if err != nil {
+		respondWithLocalizedError(w, r, 400, err)
+		return
+	}
+	if q.Get("direction") == "incoming" && len(targets) > 1 {
+		respondWithLocalizedError(w, r, 400, msg("rule.incomingSingleIface", len(targets)))
+		return
+	}
+
+	plans := make([]*Plan, 0, len(targets))
+	rules := make([]*V4NetworkOptions, 0, len(targets))
+	for _, iface := range targets {
+		opts := parseV4Options(q)
+		opts.Iface = iface
+		excludeClient(r, opts)
+		plan := buildPlan(r, opts)
+		plan.EstimatedEffect = estimateImpairment(opts, baseRttMs, mss)
+		plans = append(plans, plan)
+		rules = append(rules, opts)
+	}
+	// What the kernel says of the commands, in a scratch namespace
+	if q.Get("shadow") == "true" && !isDarwin {
+		if err := privilegedFeatureAvailable("shadow"); err != nil {
+			respondWithError(w, "shadow: "+err.Error(), 501)
+			return
+		}
+		results, _, err := shadowApply(r.Context(), requestLanguage(r), rules)
+		if err != nil {
+			respondWithError(w, err.Error(), 500)
+			return
+		}
+		for i, result := range results {
+			plans[i].Shadow = result
+		}
+	}
+	response := map[string]interface{}{"plans": plans}
+	if warnings := unknownParams(r, planExtraParams...); len(warnings) > 0 {
+		response["warnings"] = warnings
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// buildPlan runs Execute with a command recorder and describes the result
+// in the client's language.
+func buildPlan(r *http.Request, opts *V4NetworkOptions) *Plan {
+	return planIn(r.Context(), requestLanguage(r), opts)
+}
+
+// planIn is buildPlan in lang.
+func planIn(ctx context.Context, lang string, opts *V4NetworkOptions) *Plan {
+	plan := &Plan{Iface: opts.Iface, Steps: []PlanStep{}}
+	recCtx, rec := withCommandRecorder(ctx)
+	if err := opts.Execute(recCtx); err != nil {
+		plan.Error, _ = localizeError(err, lang)
+	}
+	for _, cmd := range rec.commands {
+		plan.Steps = append(plan.Steps, PlanStep{Description: describeCommand(cmd), Command: strings.Join(cmd, " ")})
+	}
+	plan.Warnings = planWarnings(opts, lang)
+	for _, c := range opts.detectConflicts(ctx) {
+		plan.Conflicts = append(plan.Conflicts, c.render(lang))
+	}
+	return plan
+}
+
+// describeCommand explains a tc/ip command produced by Execute.
+func describeCommand(cmd []string) string {
+	line := strings.Join(cmd, " ")
+	switch {
+	case strings.Contains(line, " qdisc del "):
+		return "Remove the existing rules"
+	case cmd[0] == "ip" && strings.Contains(line, " link add "):
+		return "Create the ifb0 device"
+	case cmd[0] == "ip":
+		return "Bring up ifb0"
+	case strings.Contains(line, " protocol 1 0xff ") || strings.Contains(line, " protocol 58 0xff "):
+		if i := slices.Index(cmd, "police"); i >= 0 {
+			return "Rate-limit " + icmpFilterName(cmd) + " messages to " + cmd[i+2] + " (the excess is dropped)"
+		}
+		return "Drop " + icmpFilterName(cmd) + " messages"
+	case strings.Contains(line, " police "):
+		return "Police inbound traffic to " + cmd[slices.Index(cmd, "rate")+1] + " (the excess is dropped)"
+	case strings.Contains(line, " action pass"):
+		return "Let " + protectedPortName(cmd) + " traffic through the policer"
+	case strings.Contains(line, "redirect dev ifb0"):
+		return "Redirect inbound traffic to ifb0, where it is shaped"
+	case strings.Contains(line, " mirred ") && strings.Contains(line, " mirror "):
+		return "Re-attach the traffic mirror"
+	case strings.Contains(line, " clsact"):
+		return "Attach a clsact qdisc (ingress and egress filter hooks)"
+	case strings.Contains(line, " ingress"):
+		return "Attach an ingress qdisc to capture inbound traffic"
+	case strings.Contains(line, "root handle "+rootHandle+" htb"):
+		return "Create the HTB root qdisc (unmatched traffic goes to the shaped class)"
+	case strings.Contains(line, "handle "+rootHandle+" htb"):
+		return "Create the HTB qdisc below " + cmd[slices.Index(cmd, "parent")+1] + " of the host's tree (unmatched traffic goes to the shaped class)"
+	case strings.Contains(line, "classid "+unlimitedClass):
+		return "Create the unlimited class for API traffic (" + cmd[len(cmd)-1] + ")"
+	case strings.Contains(line, "classid "+shapedClass):
+		return "Create the shaped class (" + strings.Join(cmd[slices.Index(cmd, "rate"):], " ") + ")"
+	case strings.Contains(line, "root handle "+rootHandle+" prio"):
+		return "Create a prio root qdisc (unmatched traffic goes to the impaired band 2)"
+	case strings.Contains(line, "handle "+rootHandle+" prio"):
+		return "Create a prio qdisc below " + cmd[slices.Index(cmd, "parent")+1] + " of the host's tree (unmatched traffic goes to the impaired band 2)"
+	case strings.Contains(line, "root handle "+netemHandle+" netem"):
+		return "Attach netem as the root qdisc (all traffic, API included): " + line[strings.Index(line, " netem")+len(" netem "):]
+	case strings.Contains(line, "handle "+netemHandle+" netem") && !strings.Contains(line, "parent "+impairedBand) && !strings.Contains(line, "parent "+shapedClass):
+		return "Attach netem below " + cmd[slices.Index(cmd, "parent")+1] + " of the host's tree (all of its traffic, API included): " + line[strings.Index(line, " netem")+len(" netem "):]
+	case strings.Contains(line, "parent "+impairedBand+" handle "+netemHandle+" netem"):
+		return "Attach netem to the impaired band: " + line[strings.Index(line, " netem")+len(" netem "):]
+	case strings.Contains(line, "handle "+flowCapHandle+" fq"):
+		return "Cap each flow at " + cmd[len(cmd)-1] + " (fq maxrate)"
+	case strings.Contains(line, "root handle "+rootHandle+" mq"):
+		return "Give the mq root a handle (the hardware queues are kept)"
+	case strings.Contains(line, " netem") && !strings.Contains(line, "handle "+netemHandle):
+		return "Attach netem to a transmit queue: " + line[strings.Index(line, " netem")+len(" netem "):]
+	case strings.Contains(line, " netem"):
+		return "Attach netem to the shaped class: " + line[strings.Index(line, " netem")+len(" netem "):]
+	case strings.Contains(line, "prio 1 "):
+		return "Keep " + protectedPortName(cmd) + " traffic unimpaired"
+	case (strings.Contains(line, "prio 2 ") || strings.Contains(line, "prio 3 ")) && !strings.Contains(line, "match u32 0 0") &&
+		(strings.HasSuffix(line, "flowid "+unlimitedClass) || strings.HasSuffix(line, "flowid "+unimpairedBand)):
+		return "Keep excluded traffic unimpaired"
+	case strings.Contains(line, "prio 4 "):
+		return "Send the unsampled flows to the unlimited class"
+	case strings.Contains(line, "prio 5 ") || strings.Contains(line, "prio 6 "):
+		return "Send the targeted traffic to the impaired class"
+	case strings.Contains(line, "prio 7 ") && (strings.HasSuffix(line, "flowid "+unlimitedClass) || strings.HasSuffix(line, "flowid "+unimpairedBand)):
+		return "Send the remaining (untargeted) traffic to the unimpaired class"
+	case strings.Contains(line, "prio 7 "):
+		return "Send all other traffic to the impaired class"
+	case strings.Contains(line, "prio 2 ") && strings.Contains(line, "flowid "+shapedClass) && !strings.Contains(line, "match u32 0 0"):
+		return "Send the sampled flows to the shaped class"
+	case strings.Contains(line, "flowid "+unlimitedClass):
+		return "Send the remaining (unsampled) flows to the unlimited class"
+	case strings.Contains(line, "flowid "+shapedClass):
+		return "Send all other traffic to the shaped class"
+	}
+	return "Run command"
+}
+
+// protectedPortName names the protected port a filter command matches, e.g.
+// "API port 2023".
+func protectedPortName(cmd []string) string {
+	for i := 0; i+1 < len(cmd); i++ {
+		if cmd[i] == "sport" || cmd[i] == "dport" {
+			switch listener := protectedListener(cmd[i+1]); listener {
+			case "api":
+				return "API port " + cmd[i+1]
+			case "l7proxy":
+				return "L7 proxy port " + cmd[i+1]
+			default:
+				return "protected port " + cmd[i+1]
+			}
+		}
+	}
+	return "protected port"
+}
+
+// planWarnings flags settings that are valid but likely surprising, in lang.
+func planWarnings(opts *V4NetworkOptions, lang string) []string {
+	var warnings []string
+	if applied := store.Get(opts.Iface, opts.Direction); applied != nil {
+		warnings = append(warnings, msg("warn.replacesRule", opts.Iface, applied.Revision).Render(lang))
+	}
+	for _, job := range sched.List() {
+		if job.Iface == opts.Iface {
+			warnings = append(warnings, msg("warn.stopsJob", job.Kind, job.Name).Render(lang))
+		}
+	}
+	if _, hasNetem := opts.netemParams(); !hasNetem && opts.Rate == "" && !opts.hasICMP() {
+		warnings = append(warnings, msg("warn.noEffect").Render(lang))
+	}
+	delay, _ := strconv.ParseFloat(opts.Delay, 64)
+	jitter, _ := strconv.ParseFloat(opts.Jitter, 64)
+	if jitter > delay && delay > 0 {
+		warnings = append(warnings, msg("warn.reorder").Render(lang))
+	}
+	if loss, _ := strconv.ParseFloat(opts.Loss, 64); opts.LossModel == "random" && loss >= 20 {
+		warnings = append(warnings, msg("warn.lossStall", opts.Loss).Render(lang))
+	}
+	if rate, err := parseTCRate(opts.Rate); err == nil && opts.Rate != "" {
+		if mbit := linkSpeedMbit(opts.Iface); mbit > 0 && rate > float64(mbit)*1e6 {
+			warnings = append(warnings, msg("warn.rateAboveLink", opts.Iface, mbit).Render(lang))
+		}
+	}
+	warnings = append(warnings, compensationWarnings(opts)...)
+	if kind, _ := rootQdisc(context.Background(), opts.Iface); opts.ParentClass != "" && opts.Direction == "outgoing" {
+		warnings = append(warnings, msg("warn.parentClass", opts.ParentClass, kind, opts.Iface).Render(lang))
+	} else if isMultiQueueRoot(kind) && opts.Direction == "outgoing" {
+		if opts.PreserveMQ == "true" {
+			warnings = append(warnings, msg("warn.mqPreserved", opts.Iface, kind).Render(lang))
+		} else {
+			warnings = append(warnings, msg("warn.mqReplaced", kind, opts.Iface).Render(lang))
+		}
+	}
+	warnings = append(warnings, offloadWarnings(context.Background(), opts)...)
+	if isLoopback(opts.Iface) && opts.Delay != "" && !opts.hasSelectors() {
+		warnings = append(warnings, msg("warn.loopbackBothWays", opts.Iface).Render(lang))
+	}
+	if shape, _ := opts.treeShape(); shape == "netem" {
+		warnings = append(warnings, msg("warn.netemTreeApi").Render(lang))
+	}
+	if opts.Direction == "incoming" && opts.Rate != "" {
+		warnings = append(warnings, msg("warn.incomingDrops").Render(lang))
+	}
+	if opts.Direction == "incoming" && opts.ingressMode() == "police" {
+		warnings = append(warnings, msg("warn.policeMode").Render(lang))
+	}
+	return warnings
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+)
+
+// --- Ingress Policing (no ifb) ---
+
+// ingressMode returns how 'incoming' rules are applied: "ifb" (the inbound
+// traffic is redirected to ifb0 and shaped there) or "police" (a policer on
+// the ingress qdisc drops what exceeds the rate). The rule's IngressMode
+// wins, then INGRESS_MODE, then "ifb" when the module is loaded.
+func (v *V4NetworkOptions) ingressMode() string {
+	if v.IngressMode != "" {
+		return v.IngressMode
+	}
+	return defaultIngressMode()
+}
+
+// defaultIngressMode is the mode of rules that do not choose one.
+func defaultIngressMode() string {
+	if mode := setting("INGRESS_MODE"); mode == "ifb" || mode == "police" {
+		return mode
+	}
+	if hasIFB {
+		return "ifb"
+	}
+	return "police"
+}
+
+// validatePolicing checks that an 'incoming' rule can be applied by a
+// policer: it only limits the rate, so everything netem does needs ifb.
+func (v *V4NetworkOptions) validatePolicing() error {
+	if v.Rate == "" {
+		return msg("rule.policeNeedsRate")
+	}
+	if _, err := parseTCRate(v.Rate); err != nil {
+		return msg("rule.invalidRate", v.Rate)
+	}
+	if _, hasNetemRules := v.netemParams(); hasNetemRules {
+		return msg("rule.policeNoNetem")
+	}
+	if v.FlowSamplePercent != "" || v.Ceil != "" || v.Cburst != "" {
+		return msg("rule.policeNoClasses")
+	}
+	if v.Burst != "" && !tcSizePattern.MatchString(v.Burst) {
+		return msg("rule.invalidSize", "burst", v.Burst)
+	}
+	return nil
+}
+
+// policeBurst returns the bucket size of the policer: 'burst', or 100ms
+// worth of traffic (at least 15k), so TCP is not starved by a tiny bucket.
+func (v *V4NetworkOptions) policeBurst() string {
+	if v.Burst != "" {
+		return v.Burst
+	}
+	rate, _ := parseTCRate(v.Rate)
+	return fmt.Sprintf("%dk", int(math.Max(rate/8*0.1/1024, 15)))
+}
+
+// executePolicing attaches the policer to the ingress qdisc of v.Iface.
+// The protected ports are let through first (prio 2-3, after the traffic mirror);
+// everything else is policed (prio 4). The interface must be clean of our
+// filters; an ingress or clsact qdisc kept for the host's filters is
+// reused. flags are the offload flags of the filters.
+func (v *V4NetworkOptions) executePolicing(ctx context.Context, flags []string) error {
+	log.Printf("[INFO] V4: Policing inbound traffic of %s to %s (no ifb)", v.Iface, v.Rate)
+	if ingressQdisc(ctx, v.Iface) == "" {
+		if err := runTC(ctx, "qdisc", "add", "dev", v.Iface, "ingress"); err != nil {
+			return fmt.Errorf("V4: failed to add ingress qdisc on '%s': %w", v.Iface, err)
+		}
+	}
+	for _, p := range protectedPortList() {
+		if err := runTC(ctx, withFilterFlags(withCookie("filter", "add", "dev", v.Iface, "parent", "ffff:", "protocol", "ip", "prio", "2",
+			"u32", "match", "ip", "dport", p.Port, "0xffff",
+			"action", "pass"), flags)...); err != nil {
+			return fmt.Errorf("V4: failed to add the pass filter of port %s (%s): %w", p.Port, p.Listener, err)
+		}
+		if hasIPv6 {
+			if err := runTC(ctx, withFilterFlags(withCookie("filter", "add", "dev", v.Iface, "parent", "ffff:", "protocol", "ipv6", "prio", "3",
+				"u32", "match", "ip6", "dport", p.Port, "0xffff",
+				"action", "pass"), flags)...); err != nil {
+				log.Printf("[WARN] V4: Failed to add the pass filter of port %s (IPv6). This is non-fatal. Error: %v", p.Port, err)
+			}
+		}
+	}
+	if err := runTC(ctx, withFilterFlags(withCookie("filter", "add", "dev", v.Iface, "parent", "ffff:", "protocol", "all", "prio", "4",
+		"u32", "match", "u32", "0", "0", "flowid", ":1",
+		"action", "police", "rate", v.Rate, "burst", v.policeBurst(), "drop"), flags)...); err != nil {
+		return fmt.Errorf("V4: failed to add ingress policer: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// --- Privileged Features ---
+
+// A few features need a capability beyond NET_ADMIN, NET_RAW and
+// NET_BIND_SERVICE, which the process drops after startup (see
+// confinePrivileges), or a syscall SECCOMP denies. PRIVILEGED_FEATURES
+// lists the ones to keep them for (SHADOW_APPLY=true implies 'shadow'); a
+// listed feature the process cannot use stops the startup, and an unlisted
+// one answers with what it needs instead of a bare tc/ip failure.
+
+// Capabilities of the privileged features.
+const (
+	capSysAdmin = 21 // network namespaces (ip netns add)
+	capSysTime  = 25 // the clock's frequency (adjtimex)
+)
+
+// netnsProbe is the namespace created and removed at startup to check the
+// namespace features.
+const netnsProbe = "netsim-probe"
+
+// privilegedFeature is a feature that needs a dropped capability.
+type privilegedFeature struct {
+	description string
+	capability  int
+	capName     string
+	syscalls    []string                        // denied by SECCOMP unless the feature is enabled
+	probe       func(ctx context.Context) error // nil: the capability is enough
+}
+
+// netnsSyscalls are the syscalls 'ip netns add/del' need (the namespace is
+// bind-mounted below /var/run/netns).
+var netnsSyscalls = []string{"mount", "umount2"}
+
+// privilegedFeatures are the features PRIVILEGED_FEATURES can list.
+var privilegedFeatures = map[string]*privilegedFeature{
+	"accuracy":  {description: "the accuracy lab (setup accuracy=true)", capability: capSysAdmin, capName: "SYS_ADMIN", syscalls: netnsSyscalls, probe: probeNetns},
+	"shadow":    {description: "shadow apply (shadow=true, SHADOW_APPLY)", capability: capSysAdmin, capName: "SYS_ADMIN", syscalls: netnsSyscalls, probe: probeNetns},
+	"clockskew": {description: "the clock skew (/timesync/skew)", capability: capSysTime, capName: "SYS_TIME"},
+}
+
+// privileged holds the features enabled at startup, and whether the
+// seccomp filter is installed.
+var privileged = struct {
+	sync.RWMutex
+	enabled map[string]bool
+	seccomp bool
+}{enabled: map[string]bool{}}
+
+// parsePrivilegedFeatures parses a PRIVILEGED_FEATURES list ("all" for
+// every feature).
+func parsePrivilegedFeatures(list string) (map[string]bool, error) {
+	features := map[string]bool{}
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		switch {
+		case name == "":
+		case name == "all":
+			for name := range privilegedFeatures {
+				features[name] = true
+			}
+		case privilegedFeatures[name] != nil:
+			features[name] = true
+		default:
+			return nil, fmt.Errorf("PRIVILEGED_FEATURES: unknown feature '%s' (%s, all)", name, strings.Join(privilegedFeatureNames(), ", "))
+		}
+	}
+	return features, nil
+}
+
+// privilegedFeatureNames returns the feature names, sorted.
+func privilegedFeatureNames() []string {
+	names := make([]string, 0, len(privilegedFeatures))
+	for name := range privilegedFeatures {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// configurePrivilegedFeatures reads PRIVILEGED_FEATURES, before the
+// capabilities are dropped.
+func configurePrivilegedFeatures() error {
+	features, err := parsePrivilegedFeatures(os.Getenv("PRIVILEGED_FEATURES"))
+	if err != nil {
+		return err
+	}
+	if setting("SHADOW_APPLY") == "true" {
+		features["shadow"] = true
+	}
+	privileged.Lock()
+	privileged.enabled = features
+	privileged.Unlock()
+	return nil
+}
+
+// privilegedFeatureEnabled reports whether a feature is in
+// PRIVILEGED_FEATURES.
+func privilegedFeatureEnabled(name string) bool {
+	privileged.RLock()
+	defer privileged.RUnlock()
+	return privileged.enabled[name]
+}
+
+// privilegedCapabilities returns the capabilities of the enabled features.
+func privilegedCapabilities() []int {
+	privileged.RLock()
+	defer privileged.RUnlock()
+	var caps []int
+	seen := map[int]bool{}
+	for name := range privileged.enabled {
+		if c := privilegedFeatures[name].capability; !seen[c] {
+			seen[c] = true
+			caps = append(caps, c)
+		}
+	}
+	sort.Ints(caps)
+	return caps
+}
+
+// privilegedFeatureAvailable returns why this process cannot use a
+// feature, or nil.
+func privilegedFeatureAvailable(name string) error {
+	f := privilegedFeatures[name]
+	if isDarwin {
+		return nil
+	}
+	if capable, err := hasCapability(f.capability); err == nil && !capable {
+		return fmt.Errorf("%s needs CAP_%s, which this process does not have: add '%s' to PRIVILEGED_FEATURES (or set DROP_PRIVILEGES=false) and give the container --cap-add %s", f.description, f.capName, name, f.capName)
+	}
+	privileged.RLock()
+	denied := privileged.seccomp && !privileged.enabled[name] && len(f.syscalls) > 0
+	privileged.RUnlock()
+	if denied {
+		return fmt.Errorf("%s needs %s, which SECCOMP=true denies: add '%s' to PRIVILEGED_FEATURES", f.description, strings.Join(f.syscalls, " and "), name)
+	}
+	return nil
+}
+
+// checkPrivilegedFeatures checks, once the capabilities are dropped, that
+// every enabled feature works.
+func checkPrivilegedFeatures(ctx context.Context) error {
+	for _, name := range privilegedFeatureNames() {
+		if !privilegedFeatureEnabled(name) {
+			continue
+		}
+		if err := privilegedFeatureAvailable(name); err != nil {
+			return err
+		}
+		if probe := privilegedFeatures[name].probe; probe != nil && !isDarwin {
+			if err := probe(ctx); err != nil {
+				return fmt.Errorf("%s is enabled (PRIVILEGED_FEATURES) but does not work here: %w", privilegedFeatures[name].description, err)
+			}
+		}
+	}
+	return nil
+}
+
+// probeNetns creates and removes a network namespace.
+func probeNetns(ctx context.Context) error {
+	if _, err := os.Stat("/var/run/netns/" + netnsProbe); err == nil {
+		runIP(ctx, "netns", "del", netnsProbe) // (left by a crash)
+	}
+	if err := runIP(ctx, "netns", "add", netnsProbe); err != nil {
+		return fmt.Errorf("failed to create a network namespace: %w", err)
+	}
+	return runIP(ctx, "netns", "del", netnsProbe)
+}
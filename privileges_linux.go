@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// --- Privileges (Linux capabilities) ---
+
+const (
+	capSetgid          = 6
+	capSetuid          = 7
+	capNetBindService  = 10
+	linuxCapVersion3   = 0x20080522
+	prCapbsetDrop      = 24
+	prCapAmbient       = 47
+	prCapAmbientRaise  = 2
+	prCapAmbientClrAll = 4
+)
+
+type capHeader struct {
+	version uint32
+	pid     int32
+}
+
+type capData struct {
+	effective, permitted, inheritable uint32
+}
+
+// keptCapabilities are the capabilities the process keeps after startup:
+// tc/ip (NET_ADMIN), captures (NET_RAW), ports below 1024 for the API
+// (NET_BIND_SERVICE) and those of the enabled privileged features. As
+// root, tcpdump switches to its own user after opening the capture, so
+// root also keeps SETUID/SETGID.
+func keptCapabilities() []int {
+	keep := append([]int{capNetAdmin, capNetRaw, capNetBindService}, privilegedCapabilities()...)
+	if os.Geteuid() == 0 {
+		keep = append(keep, capSetuid, capSetgid)
+	}
+	return keep
+}
+
+// lastCapability is the highest capability the kernel knows.
+func lastCapability() int {
+	b, err := os.ReadFile("/proc/sys/kernel/cap_last_cap")
+	if err != nil {
+		return 40
+	}
+	last, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 40
+	}
+	return last
+}
+
+// allThreads runs a per-thread syscall (capset, prctl) on every thread of
+// the process, so children started from any thread get the same sets.
+func allThreads(trap, a1, a2, a3 uintptr) error {
+	_, _, errno := syscall.AllThreadsSyscall(trap, a1, a2, a3)
+	if errno == syscall.ENOTSUP {
+		return fmt.Errorf("not supported by cgo builds (build with CGO_ENABLED=0, as the Dockerfile does)")
+	}
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
+
+// confinePrivileges reduces the process to keptCapabilities (unless drop is
+// false) and raises them as ambient capabilities, so that tc, ip and tcpdump
+// inherit them even when netsim runs as a non-root user with file
+// capabilities (setcap cap_net_admin,cap_net_raw+ep).
+func confinePrivileges(drop bool) error {
+	hdr := capHeader{version: linuxCapVersion3}
+	var data [2]capData
+	if _, _, errno := syscall.Syscall(syscall.SYS_CAPGET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); errno != 0 {
+		return fmt.Errorf("capget: %w", errno)
+	}
+	var keep [2]uint32
+	for _, c := range keptCapabilities() {
+		keep[c/32] |= 1 << (c % 32)
+	}
+
+	if drop {
+		// The bounding set limits what any later exec (restart, children) can regain
+		for c := 0; c <= lastCapability(); c++ {
+			if keep[c/32]&(1<<(c%32)) != 0 {
+				continue
+			}
+			if err := allThreads(syscall.SYS_PRCTL, prCapbsetDrop, uintptr(c), 0); err != nil && err != syscall.EINVAL {
+				return fmt.Errorf("dropping capability %d from the bounding set: %w", c, err)
+			}
+		}
+		if err := allThreads(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientClrAll, 0); err != nil && err != syscall.EINVAL {
+			return fmt.Errorf("clearing the ambient capabilities: %w", err)
+		}
+	}
+	for i := range data {
+		if drop {
+			data[i].permitted &= keep[i]
+			data[i].effective &= keep[i]
+		}
+		data[i].inheritable = data[i].permitted & keep[i]
+	}
+	if err := allThreads(syscall.SYS_CAPSET, uintptr(unsafe.Pointer(&hdr)), uintptr(unsafe.Pointer(&data[0])), 0); err != nil {
+		return fmt.Errorf("capset: %w", err)
+	}
+	for _, c := range keptCapabilities() {
+		if data[c/32].inheritable&(1<<(c%32)) == 0 {
+			continue // not permitted (e.g. no file capability): children cannot get it
+		}
+		if err := allThreads(syscall.SYS_PRCTL, prCapAmbient, prCapAmbientRaise, uintptr(c)); err != nil {
+			return fmt.Errorf("raising ambient capability %d: %w", c, err)
+		}
+	}
+	return nil
+}
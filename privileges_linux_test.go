@@ -0,0 +1,92 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+// featureCapabilities is the capability every feature needs. A feature that
+// needs a new one must be listed here, and be a privileged feature unless
+// the capability is always kept.
+var featureCapabilities = []struct {
+	feature    string
+	capability int
+	privileged bool // dropped unless the feature is in PRIVILEGED_FEATURES
+}{
+	{"rules (tc, ip)", capNetAdmin, false},
+	{"captures (calibration, mirror, flow export)", capNetRaw, false},
+	{"API ports below 1024", capNetBindService, false},
+	{"accuracy", capSysAdmin, true},
+	{"shadow", capSysAdmin, true},
+	{"clockskew", capSysTime, true},
+}
+
+func TestFeatureCapabilities(t *testing.T) {
+	defer func() { privileged.enabled = map[string]bool{} }()
+	listed := 0
+	for _, fc := range featureCapabilities {
+		if !fc.privileged {
+			privileged.enabled = map[string]bool{}
+			if !slices.Contains(keptCapabilities(), fc.capability) {
+				t.Errorf("%s: capability %d is not always kept", fc.feature, fc.capability)
+			}
+			continue
+		}
+		listed++
+		f := privilegedFeatures[fc.feature]
+		if f == nil {
+			t.Errorf("%s: not a privileged feature", fc.feature)
+			continue
+		}
+		if f.capability != fc.capability {
+			t.Errorf("%s: needs capability %d, want %d", fc.feature, f.capability, fc.capability)
+		}
+		privileged.enabled = map[string]bool{}
+		if slices.Contains(keptCapabilities(), fc.capability) {
+			t.Errorf("%s: capability %d kept while the feature is disabled", fc.feature, fc.capability)
+		}
+		privileged.enabled = map[string]bool{fc.feature: true}
+		if !slices.Contains(keptCapabilities(), fc.capability) {
+			t.Errorf("%s: capability %d dropped while the feature is enabled", fc.feature, fc.capability)
+		}
+	}
+	if listed != len(privilegedFeatures) {
+		t.Errorf("%d privileged features, %d listed in featureCapabilities", len(privilegedFeatures), listed)
+	}
+}
+
+func TestParsePrivilegedFeatures(t *testing.T) {
+	features, err := parsePrivilegedFeatures(" Shadow, clockskew ,")
+	if err != nil || !features["shadow"] || !features["clockskew"] || features["accuracy"] {
+		t.Errorf("parsePrivilegedFeatures = %v, %v", features, err)
+	}
+	if features, err := parsePrivilegedFeatures("all"); err != nil || len(features) != len(privilegedFeatures) {
+		t.Errorf("parsePrivilegedFeatures(all) = %v, %v", features, err)
+	}
+	if _, err := parsePrivilegedFeatures("shadow,root"); err == nil {
+		t.Error("parsePrivilegedFeatures(root): no error")
+	}
+}
+
+func TestSeccompAllowsFeatureSyscalls(t *testing.T) {
+	defer func() { privileged.enabled = map[string]bool{} }()
+	for arch, numbers := range syscallNumbers {
+		for _, call := range deniedSyscalls {
+			if _, ok := numbers[call]; !ok {
+				t.Errorf("%s: no number for %s", arch, call)
+			}
+		}
+		for _, name := range privilegedFeatureNames() {
+			for _, call := range privilegedFeatures[name].syscalls {
+				privileged.enabled = map[string]bool{}
+				if !slices.Contains(seccompDenied(arch), numbers[call]) {
+					t.Errorf("%s: %s allowed while %s is disabled", arch, call, name)
+				}
+				privileged.enabled = map[string]bool{name: true}
+				if slices.Contains(seccompDenied(arch), numbers[call]) {
+					t.Errorf("%s: %s denied while %s is enabled", arch, call, name)
+				}
+			}
+		}
+	}
+}
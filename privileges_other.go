@@ -0,0 +1,13 @@
+//go:build !linux
+
+package main
+
+// confinePrivileges is a no-op outside Linux (there is no tc to run).
+func confinePrivileges(drop bool) error {
+	return nil
+}
+
+// hardenProcess is a no-op outside Linux.
+func hardenProcess(seccomp bool) error {
+	return nil
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Network Profiles ---
+
+// A profile is a named set of rule options, without an interface or a
+// direction. It can extend other profiles: their options are merged in the
+// order listed, and its own override them ("3g-roaming" = "3g-legacy" with
+// more delay). /setup, /plan and /estimate take 'profile=', with the
+// request's own parameters over the profile's (an empty one clears it).
+
+// NetworkProfile is a built-in or custom profile.
+type NetworkProfile struct {
+	Name        string            `json:"name"`
+	Description string            `json:"description,omitempty"`
+	Extends     []string          `json:"extends,omitempty"`
+	Options     *V4NetworkOptions `json:"options,omitempty"`
+}
+
+// profileNamePattern keeps names usable in URLs.
+var profileNamePattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// builtinProfiles are the presets of the UI; they cannot be changed.
+var builtinProfiles = map[string]*NetworkProfile{
+	"5g-ideal":           {Name: "5g-ideal", Description: "5G, ideal", Options: &V4NetworkOptions{Rate: "100mbit", Delay: "20", Jitter: "5"}},
+	"4g-good":            {Name: "4g-good", Description: "4G/LTE, good signal", Options: &V4NetworkOptions{Rate: "25mbit", Delay: "80", Jitter: "15", LossModel: "random", Loss: "0.1"}},
+	"4g-poor":            {Name: "4g-poor", Description: "4G/LTE, poor signal", Options: &V4NetworkOptions{Rate: "5mbit", Delay: "150", Jitter: "50", LossModel: "random", Loss: "1"}},
+	"3g-legacy":          {Name: "3g-legacy", Description: "Legacy (3G/Edge)", Options: &V4NetworkOptions{Rate: "1mbit", Delay: "400", Jitter: "100", LossModel: "random", Loss: "3"}},
+	"nationwide-network": {Name: "nationwide-network", Description: "Nationwide WAN", Options: &V4NetworkOptions{Rate: "50mbit", Delay: "40", Jitter: "10"}},
+	"oversea-network":    {Name: "oversea-network", Description: "Overseas WAN (unlimited rate)", Options: &V4NetworkOptions{Delay: "120", Jitter: "10"}},
+	"leo-satellite":      {Name: "leo-satellite", Description: "LEO satellite", Options: &V4NetworkOptions{Rate: "15mbit", Delay: "80", Jitter: "30", LossModel: "random", Loss: "0.5"}},
+	"geo-satellite":      {Name: "geo-satellite", Description: "GEO satellite", Options: &V4NetworkOptions{Rate: "3mbit", Delay: "600", Jitter: "200", LossModel: "random", Loss: "1"}},
+	"slow-stable-adsl":   {Name: "slow-stable-adsl", Description: "Slow but stable ADSL", Options: &V4NetworkOptions{Rate: "512kbit", Delay: "100", Jitter: "20", LossModel: "random", Loss: "0.1"}},
+	"unstable-wifi":      {Name: "unstable-wifi", Description: "Unstable Wi-Fi (unlimited rate)", Options: &V4NetworkOptions{Delay: "40", Jitter: "20", LossModel: "random", Loss: "2"}},
+	"unstable-voip":      {Name: "unstable-voip", Description: "Unstable VoIP path", Options: &V4NetworkOptions{Rate: "10mbit", Delay: "50", Jitter: "150", LossModel: "random", Loss: "1"}},
+	"bad-network":        {Name: "bad-network", Description: "Bad network", Options: &V4NetworkOptions{Rate: "5mbit", Delay: "100", Jitter: "50", LossModel: "random", Loss: "8"}},
+}
+
+// networkProfiles holds the custom profiles.
+var networkProfiles = struct {
+	sync.Mutex
+	custom map[string]*NetworkProfile
+}{custom: map[string]*NetworkProfile{}}
+
+// lookupProfile returns a profile by name (custom first, then built-in) in
+// custom. Must be called with networkProfiles held when custom is theirs.
+func lookupProfile(custom map[string]*NetworkProfile, name string) *NetworkProfile {
+	if p, ok := custom[name]; ok {
+		return p
+	}
+	return builtinProfiles[name]
+}
+
+// resolveProfile returns the merged options of the profile name, as query
+// values. path is the chain of profiles being resolved, to detect cycles.
+func resolveProfile(custom map[string]*NetworkProfile, name string, path []string) (map[string]string, error) {
+	for i, seen := range path {
+		if seen == name {
+			return nil, fmt.Errorf("profile: cycle %s", strings.Join(append(path[i:], name), " -> "))
+		}
+	}
+	p := lookupProfile(custom, name)
+	if p == nil {
+		if len(path) > 0 {
+			return nil, fmt.Errorf("profile: '%s' extends an unknown profile '%s'", path[len(path)-1], name)
+		}
+		return nil, fmt.Errorf("profile: unknown profile '%s'", name)
+	}
+	path = append(path, name)
+	merged := map[string]string{}
+	for _, parent := range p.Extends {
+		options, err := resolveProfile(custom, parent, path)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range options {
+			merged[k] = v
+		}
+	}
+	if p.Options != nil {
+		var own map[string]string
+		b, _ := json.Marshal(p.Options)
+		json.Unmarshal(b, &own)
+		for k, v := range own {
+			merged[k] = v
+		}
+	}
+	return merged, nil
+}
+
+// validate checks a custom profile against the profiles of custom (which it
+// is about to join) and returns its resolved options.
+func (p *NetworkProfile) validate(custom map[string]*NetworkProfile) (*V4NetworkOptions, error) {
+	if !profileNamePattern.MatchString(p.Name) {
+		return nil, fmt.Errorf("profile: invalid 'name' %q (up to 64 letters, digits, '_', '.' or '-')", p.Name)
+	}
+	if _, builtin := builtinProfiles[p.Name]; builtin {
+		return nil, fmt.Errorf("profile: '%s' is a built-in profile", p.Name)
+	}
+	if p.Options != nil && (p.Options.Iface != "" || p.Options.Direction != "") {
+		return nil, fmt.Errorf("profile: options cannot set 'iface' or 'direction'")
+	}
+	if p.Options == nil && len(p.Extends) == 0 {
+		return nil, fmt.Errorf("profile: 'options' or 'extends' is required")
+	}
+	options, err := resolveProfile(custom, p.Name, nil)
+	if err != nil {
+		return nil, err
+	}
+	q := url.Values{}
+	for k, v := range options {
+		q.Set(k, v)
+	}
+	opts := parseV4Options(q)
+	if err := opts.validateNetem(); err != nil {
+		return nil, err
+	}
+	return opts, nil
+}
+
+// withProfile returns q with the options of its 'profile' under the other
+// parameters, or q itself without one.
+func withProfile(q url.Values) (url.Values, error) {
+	name := q.Get("profile")
+	if name == "" {
+		return q, nil
+	}
+	networkProfiles.Lock()
+	options, err := resolveProfile(networkProfiles.custom, name, nil)
+	networkProfiles.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	merged := url.Values{}
+	for k, v := range options {
+		merged.Set(k, v)
+	}
+	for k := range q {
+		merged.Set(k, q.Get(k))
+	}
+	return merged, nil
+}
+
+// profileDependents returns the custom profiles that extend name.
+func profileDependents(custom map[string]*NetworkProfile, name string) []string {
+	var dependents []string
+	for _, p := range custom {
+		for _, parent := range p.Extends {
+			if parent == name {
+				dependents = append(dependents, p.Name)
+				break
+			}
+		}
+	}
+	sort.Strings(dependents)
+	return dependents
+}
+
+// importProfiles validates profiles together with the local ones and adds
+// them (by name). Built-in names are skipped.
+func importProfiles(profiles []*NetworkProfile) (int, error) {
+	networkProfiles.Lock()
+	defer networkProfiles.Unlock()
+	custom := map[string]*NetworkProfile{}
+	for name, p := range networkProfiles.custom {
+		custom[name] = p
+	}
+	var added []*NetworkProfile
+	for _, p := range profiles {
+		if _, builtin := builtinProfiles[p.Name]; !builtin {
+			custom[p.Name] = p
+			added = append(added, p)
+		}
+	}
+	for _, p := range added {
+		if _, err := p.validate(custom); err != nil {
+			return 0, err
+		}
+	}
+	networkProfiles.custom = custom
+	return len(added), nil
+}
+
+// --- Handlers: /profiles ---
+
+// profileView is a profile with its resolved options.
+type profileView struct {
+	*NetworkProfile
+	Builtin  bool              `json:"builtin"`
+	Resolved map[string]string `json:"resolved"`
+}
+
+// handleProfileList returns the built-in and custom profiles, resolved.
+func handleProfileList(w http.ResponseWriter, r *http.Request) {
+	networkProfiles.Lock()
+	defer networkProfiles.Unlock()
+	list := []*profileView{}
+	for _, profiles := range []map[string]*NetworkProfile{builtinProfiles, networkProfiles.custom} {
+		for _, p := range profiles {
+			resolved, _ := resolveProfile(networkProfiles.custom, p.Name, nil)
+			_, builtin := builtinProfiles[p.Name]
+			list = append(list, &profileView{NetworkProfile: p, Builtin: builtin, Resolved: resolved})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleProfileGet returns one profile, resolved.
+func handleProfileGet(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	networkProfiles.Lock()
+	defer networkProfiles.Unlock()
+	p := lookupProfile(networkProfiles.custom, name)
+	if p == nil {
+		respondWithError(w, fmt.Sprintf("profile: unknown profile '%s'", name), 404)
+		return
+	}
+	resolved, err := resolveProfile(networkProfiles.custom, name, nil)
+	if err != nil {
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	_, builtin := builtinProfiles[name]
+	respondWithJSON(w, http.StatusOK, &profileView{NetworkProfile: p, Builtin: builtin, Resolved: resolved})
+}
+
+// handleProfileSave creates or replaces a custom profile.
+func handleProfileSave(w http.ResponseWriter, r *http.Request) {
+	p := &NetworkProfile{}
+	if err := json.NewDecoder(r.Body).Decode(p); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid profile JSON: %v", err), 400)
+		return
+	}
+	networkProfiles.Lock()
+	defer networkProfiles.Unlock()
+	custom := map[string]*NetworkProfile{p.Name: p}
+	for name, other := range networkProfiles.custom {
+		if name != p.Name {
+			custom[name] = other
+		}
+	}
+	if _, err := p.validate(custom); err != nil {
+		respondWithLocalizedError(w, r, 400, err)
+		return
+	}
+	networkProfiles.custom = custom
+	resolved, _ := resolveProfile(custom, p.Name, nil)
+	respondWithJSON(w, http.StatusOK, &profileView{NetworkProfile: p, Resolved: resolved})
+}
+
+// handleProfileDelete removes a custom profile that no other extends.
+func handleProfileDelete(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	networkProfiles.Lock()
+	defer networkProfiles.Unlock()
+	if _, ok := networkProfiles.custom[name]; !ok {
+		respondWithError(w, fmt.Sprintf("profile: no custom profile '%s'", name), 404)
+		return
+	}
+	if dependents := profileDependents(networkProfiles.custom, name); len(dependents) > 0 {
+		respondWithError(w, fmt.Sprintf("profile: '%s' is extended by %s", name, strings.Join(dependents, ", ")), 409)
+		return
+	}
+	delete(networkProfiles.custom, name)
+	respondWithJSON(w, http.StatusOK, nil)
+}
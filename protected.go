@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// --- Protected Ports ---
+
+// protectedPorts is the registry of the TCP ports of netsim's own
+// listeners: the API (with the UI, its SSE streams and the metrics), the L7
+// proxy, and the extra ports of PROTECTED_PORTS. Every tree keeps them
+// unimpaired (the unlimited class of htb, the unimpaired band of prio, the
+// pass filters of the policer), so a listener is added here rather than
+// given filters of its own, and the user's rate limit cannot cut it off.
+var protectedPorts = struct {
+	sync.Mutex
+	ports map[string]string // port -> listener
+}{ports: map[string]string{}}
+
+// ProtectedPort is a registered port and the listener it belongs to.
+type ProtectedPort struct {
+	Port     string `json:"port"`
+	Listener string `json:"listener"`
+}
+
+// listenPort returns the port of a listen address ("2023", ":2023" or
+// "host:2023").
+func listenPort(listener, addr string) (string, error) {
+	port := strings.TrimPrefix(addr, ":")
+	if _, p, err := net.SplitHostPort(addr); err == nil {
+		port = p
+	}
+	if n, err := strconv.Atoi(port); err != nil || n < 1 || n > 65535 {
+		return "", fmt.Errorf("invalid port in the %s address '%s'", listener, addr)
+	}
+	return port, nil
+}
+
+// protectPort registers the port of a listen address for listener.
+func protectPort(listener, addr string) error {
+	port, err := listenPort(listener, addr)
+	if err != nil {
+		return err
+	}
+	protectedPorts.Lock()
+	defer protectedPorts.Unlock()
+	if _, known := protectedPorts.ports[port]; !known {
+		protectedPorts.ports[port] = listener
+	}
+	return nil
+}
+
+// configureProtectedPorts registers the ports of the listeners configured
+// at startup, before any rule is applied.
+func configureProtectedPorts() error {
+	if err := protectPort("api", os.Getenv("API_LISTEN")); err != nil {
+		return err
+	}
+	if addr := os.Getenv("L7_PROXY_LISTEN"); addr != "" {
+		if err := protectPort("l7proxy", addr); err != nil {
+			return err
+		}
+	}
+	return setExtraProtectedPorts(setting("PROTECTED_PORTS"))
+}
+
+// parseProtectedPorts returns the ports of a PROTECTED_PORTS list
+// (comma-separated).
+func parseProtectedPorts(list string) ([]string, error) {
+	var ports []string
+	for _, port := range strings.Split(list, ",") {
+		if port = strings.TrimSpace(port); port != "" {
+			p, err := listenPort("PROTECTED_PORTS", port)
+			if err != nil {
+				return nil, err
+			}
+			ports = append(ports, p)
+		}
+	}
+	return ports, nil
+}
+
+// setExtraProtectedPorts replaces the ports of PROTECTED_PORTS with those
+// of list. Rules applied before keep their filters until they are
+// re-applied.
+func setExtraProtectedPorts(list string) error {
+	ports, err := parseProtectedPorts(list)
+	if err != nil {
+		return err
+	}
+	protectedPorts.Lock()
+	defer protectedPorts.Unlock()
+	for port, listener := range protectedPorts.ports {
+		if listener == "PROTECTED_PORTS" {
+			delete(protectedPorts.ports, port)
+		}
+	}
+	for _, port := range ports {
+		if _, known := protectedPorts.ports[port]; !known {
+			protectedPorts.ports[port] = "PROTECTED_PORTS"
+		}
+	}
+	return nil
+}
+
+// protectedPortList returns the registered ports in numeric order.
+func protectedPortList() []ProtectedPort {
+	protectedPorts.Lock()
+	defer protectedPorts.Unlock()
+	list := make([]ProtectedPort, 0, len(protectedPorts.ports))
+	for port, listener := range protectedPorts.ports {
+		list = append(list, ProtectedPort{Port: port, Listener: listener})
+	}
+	sort.Slice(list, func(i, j int) bool {
+		a, _ := strconv.Atoi(list[i].Port)
+		b, _ := strconv.Atoi(list[j].Port)
+		return a < b
+	})
+	return list
+}
+
+// protectedListener returns the listener of a registered port, or "".
+func protectedListener(port string) string {
+	protectedPorts.Lock()
+	defer protectedPorts.Unlock()
+	return protectedPorts.ports[port]
+}
+
+// addProtectedPortFilters adds the prio 1 filters that send the traffic of
+// every protected port (portCmd: "sport" or "dport") to flowid. On loopback
+// the requests of local clients leave through dev too, so both ports are
+// matched.
+func addProtectedPortFilters(ctx context.Context, dev, portCmd, flowid string) error {
+	portCmds := []string{portCmd}
+	if isLoopback(dev) {
+		portCmds = []string{"sport", "dport"}
+	}
+	for _, p := range protectedPortList() {
+		for _, cmd := range portCmds {
+			if err := addPortFilters(ctx, dev, "1", cmd, p.Port, "0xffff", flowid); err != nil {
+				return fmt.Errorf("port %s (%s): %w", p.Port, p.Listener, err)
+			}
+		}
+	}
+	return nil
+}
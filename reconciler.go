@@ -0,0 +1,222 @@
+package main
+
+import (
+	"context"
+	"log"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Reconciliation Loop ---
+
+// startReconciler compares the desired state with the live tc configuration
+// every interval and re-applies rules that drifted (e.g. removed by another
+// tool or an interface that was recreated).
+func startReconciler(ctx context.Context, interval time.Duration) {
+	log.Printf("[INFO] RECONCILE: Reconciler enabled (interval=%v)", interval)
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				reconcileOnce(ctx)
+			}
+		}
+	}()
+}
+
+// reconcileOnce runs a single compare-and-repair pass over all desired rules.
+func reconcileOnce(ctx context.Context) {
+	if isDarwin {
+		return
+	}
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	for _, rule := range store.List() {
+		opts := rule.Options
+		if ruleIsLive(ctx, opts) {
+			continue
+		}
+		log.Printf("[WARN] RECONCILE: Drift detected on %s (direction=%s). Re-applying desired rule...", opts.Iface, opts.Direction)
+		if err := opts.Execute(ctx); err != nil {
+			log.Printf("[ERROR] RECONCILE: Failed to repair %s: %v", opts.Iface, err)
+			continue
+		}
+		log.Printf("[INFO] RECONCILE: Repaired %s", opts.Iface)
+	}
+}
+
+// ruleIsLive checks that the qdiscs created by Execute are still installed,
+// with the parameters of the rule (a netem or class changed by hand has
+// drifted too).
+func ruleIsLive(ctx context.Context, opts *V4NetworkOptions) bool {
+	if opts.Direction == "incoming" && opts.ingressMode() == "police" {
+		out, err := runTCOutput(ctx, "filter", "show", "dev", opts.Iface, "ingress")
+		if err != nil || !strings.Contains(out, "police") {
+			return false
+		}
+		rate, _ := parseTCRate(opts.Rate)
+		return !paramsDrifted(tcParams(strings.Fields(out), "rate"), map[string]float64{"rate": rate})
+	}
+	if opts.PreserveMQ == "true" && opts.Direction == "outgoing" {
+		if kind, _ := rootQdisc(ctx, opts.Iface); isMultiQueueRoot(kind) {
+			out, err := runTCOutput(ctx, "qdisc", "show", "dev", opts.Iface)
+			return err == nil && strings.Contains(out, "qdisc netem "+mqChildHandle(1)) &&
+				!netemDrifted(out, mqChildHandle(1), opts.perQueueParams(txQueues(opts.Iface)))
+		}
+	}
+	out, err := runTCOutput(ctx, "qdisc", "show", "dev", opts.effectiveIface())
+	if err != nil {
+		return false
+	}
+	attach := " " + strings.Join(opts.treeAttach(), " ")
+	switch shape, _ := opts.treeShape(); shape {
+	case "prio":
+		if !strings.Contains(out, "qdisc prio "+rootHandle+attach) || !strings.Contains(out, "qdisc netem "+netemHandle+" parent "+impairedBand) {
+			return false
+		}
+	case "netem":
+		if !strings.Contains(out, "qdisc netem "+netemHandle+attach) {
+			return false
+		}
+	default:
+		if !strings.Contains(out, "qdisc htb "+rootHandle+attach) {
+			return false
+		}
+		if _, hasNetem := opts.netemParams(); hasNetem && !strings.Contains(out, "qdisc netem "+netemHandle+" parent "+shapedClass) {
+			return false
+		}
+		if opts.RateScope == "flow" && !strings.Contains(out, "qdisc fq "+flowCapHandle) {
+			return false
+		}
+		if opts.classDrifted(ctx) {
+			return false
+		}
+	}
+	if netemDrifted(out, netemHandle, opts.netemArgs()) {
+		return false
+	}
+	if opts.Direction == "incoming" {
+		out, err := runTCOutput(ctx, "filter", "show", "dev", opts.Iface, "ingress")
+		if err != nil || !strings.Contains(out, "ifb0") {
+			return false
+		}
+	}
+	return true
+}
+
+// netemParamKeys are the netem parameters compared by netemDrifted.
+var netemParamKeys = []string{"delay", "jitter", "loss", "duplicate", "corrupt", "reorder", "rate"}
+
+// netemDrifted reports whether the netem qdisc with the handle in qdiscs
+// ('tc qdisc show' output) has other parameters than args. Without that
+// qdisc there is nothing to compare.
+func netemDrifted(qdiscs, handle string, args []string) bool {
+	for _, line := range strings.Split(qdiscs, "\n") {
+		if strings.HasPrefix(line, "qdisc netem "+handle+" ") {
+			return paramsDrifted(tcParams(strings.Fields(line), netemParamKeys...), tcParams(args, netemParamKeys...))
+		}
+	}
+	return false
+}
+
+// classDrifted reports whether the rate or ceil of the shaped class differs
+// from the rule's (tc shows a ceil equal to the rate when none was set).
+func (v *V4NetworkOptions) classDrifted(ctx context.Context) bool {
+	params, err := v.htbClassParams()
+	if err != nil {
+		return false
+	}
+	out, err := runTCOutput(ctx, "class", "show", "dev", v.effectiveIface(), "classid", shapedClass)
+	if err != nil {
+		return true
+	}
+	want := tcParams(params, "rate", "ceil")
+	if _, ok := want["ceil"]; !ok {
+		want["ceil"] = want["rate"]
+	}
+	return paramsDrifted(tcParams(strings.Fields(out), "rate", "ceil"), want)
+}
+
+// tcParams reads the values of keys in the fields of a tc command or of its
+// 'show' output: durations in ms, percentages, rates in bit/s. A value is
+// the first number in the few fields after its key (after the loss model
+// and its parameter names); the duration after a delay is its jitter. Zero
+// values are left out, as tc does not show them.
+func tcParams(fields []string, keys ...string) map[string]float64 {
+	value := func(s string) (float64, bool) {
+		if p, ok := strings.CutSuffix(s, "%"); ok {
+			f, err := strconv.ParseFloat(p, 64)
+			return f, err == nil
+		}
+		if d, err := time.ParseDuration(s); err == nil {
+			return float64(d) / float64(time.Millisecond), true
+		}
+		r, err := parseTCRate(s)
+		return r, err == nil
+	}
+	values := map[string]float64{}
+	for i, field := range fields {
+		if !slices.Contains(keys, field) {
+			continue
+		}
+		for j := i + 1; j < len(fields) && j <= i+3 && !slices.Contains(keys, fields[j]); j++ {
+			if f, ok := value(fields[j]); ok {
+				if f != 0 {
+					values[field] = f
+				}
+				if field == "delay" && j+1 < len(fields) && slices.Contains(keys, "jitter") {
+					if jitter, ok := value(fields[j+1]); ok && jitter != 0 && !strings.HasSuffix(fields[j+1], "%") {
+						values["jitter"] = jitter
+					}
+				}
+				break
+			}
+		}
+	}
+	return values
+}
+
+// paramsDrifted reports whether the live values differ from the wanted ones
+// by more than tc's rounding (1%).
+func paramsDrifted(live, want map[string]float64) bool {
+	if len(live) != len(want) {
+		return true
+	}
+	for key, w := range want {
+		l, ok := live[key]
+		if !ok || math.Abs(l-w) > 0.01*math.Abs(w)+0.001 {
+			return true
+		}
+	}
+	return false
+}
+
+// restoreDesiredState re-applies every persisted rule, e.g. after a restart.
+// A rule still live in the kernel (a restart keeps the rules) is adopted as
+// is: re-applying it would tear it down first.
+func restoreDesiredState(ctx context.Context) {
+	rules := store.List()
+	if len(rules) == 0 || isDarwin {
+		return
+	}
+	log.Printf("[INFO] STATE: Restoring %d persisted rule(s)...", len(rules))
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	for _, rule := range rules {
+		if ruleIsLive(ctx, rule.Options) {
+			log.Printf("[INFO] STATE: Rule on %s is still live, adopted", rule.Options.Iface)
+			continue
+		}
+		if err := rule.Options.Execute(ctx); err != nil {
+			log.Printf("[ERROR] STATE: Failed to restore rule on %s: %v", rule.Options.Iface, err)
+		}
+	}
+}
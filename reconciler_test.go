@@ -0,0 +1,44 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestNetemDrifted(t *testing.T) {
+	opts := &V4NetworkOptions{Iface: "eth0", Direction: "outgoing", Delay: "100", Jitter: "10", DelayCorrelation: "25", LossModel: "random", Loss: "0.5"}
+	args := opts.netemArgs()
+	for _, tc := range []struct {
+		show    string
+		drifted bool
+	}{
+		{"qdisc netem 4e54: parent 4e53:11 limit 1000 delay 100ms  10ms 25% loss 0.5%", false},
+		{"qdisc netem 4e54: parent 4e53:11 limit 1000 delay 100.0ms 10.0ms 25% loss 0.5% seed 42", false},
+		{"qdisc netem 4e54: parent 4e53:11 limit 1000 delay 200ms  10ms 25% loss 0.5%", true},
+		{"qdisc netem 4e54: parent 4e53:11 limit 1000 delay 100ms loss 0.5%", true},
+		{"qdisc netem 4e54: parent 4e53:11 limit 1000 delay 100ms  10ms 25% loss 0.5% duplicate 1%", true},
+		{"qdisc htb 4e53: root refcnt 2 r2q 10 default 0x11", false},
+	} {
+		if got := netemDrifted(tc.show, netemHandle, args); got != tc.drifted {
+			t.Errorf("netemDrifted(%q) = %v, want %v", tc.show, got, tc.drifted)
+		}
+	}
+
+	// A state loss model is compared by its first probability
+	opts = &V4NetworkOptions{LossModel: "state", LossStateP13: "1", LossStateP31: "2"}
+	if netemDrifted("qdisc netem 4e54: root refcnt 2 limit 1000 loss state p13 1% p31 2% p32 0% p23 0% p14 0%", netemHandle, opts.netemArgs()) {
+		t.Error("the state loss model drifted")
+	}
+}
+
+func TestClassParamsDrifted(t *testing.T) {
+	show := strings.Fields("class htb 4e53:11 parent 4e53: leaf 4e54: prio 0 rate 1500Kbit ceil 1500Kbit burst 1599b cburst 1599b")
+	want := map[string]float64{"rate": 1.5e6, "ceil": 1.5e6}
+	if paramsDrifted(tcParams(show, "rate", "ceil"), want) {
+		t.Errorf("1500Kbit drifted from 1.5mbit: %v", tcParams(show, "rate", "ceil"))
+	}
+	want["rate"] = 1e6
+	if !paramsDrifted(tcParams(show, "rate", "ceil"), want) {
+		t.Error("1500Kbit matches 1mbit")
+	}
+}
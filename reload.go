@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// --- Configuration Reload ---
+
+// reloadConfig re-reads the configuration without dropping the active rules
+// or the HTTP listener, and returns what was reloaded.
+func reloadConfig(ctx context.Context) ([]string, error) {
+	var reloaded []string
+	if err := loadSecrets(); err != nil {
+		return reloaded, err
+	}
+	reloaded = append(reloaded, "tokens")
+	if ok, err := loadLibraryFile(); err != nil {
+		return reloaded, err
+	} else if ok {
+		reloaded = append(reloaded, "library")
+	}
+	if ok, err := reloadDesiredState(ctx); err != nil {
+		return reloaded, err
+	} else if ok {
+		reloaded = append(reloaded, "state")
+	}
+	log.Printf("[INFO] RELOAD: Reloaded %v", reloaded)
+	return reloaded, nil
+}
+
+// reloadDesiredState re-reads STATE_FILE and applies the difference: rules
+// that changed are re-applied, removed ones are reset, and unchanged rules
+// are not touched. It reports whether there is a STATE_FILE.
+func reloadDesiredState(ctx context.Context) (bool, error) {
+	applyMu.Lock()
+	defer applyMu.Unlock()
+
+	type ruleOf struct{ iface, direction string }
+	before := map[ruleOf]string{}
+	for _, rule := range store.List() {
+		before[ruleOf{rule.Options.Iface, rule.Options.Direction}] = optionsKey(rule.Options)
+	}
+	ok, err := store.Reload()
+	if !ok || err != nil {
+		return ok, err
+	}
+	after := store.List()
+	for _, rule := range after {
+		of := ruleOf{rule.Options.Iface, rule.Options.Direction}
+		key, found := before[of]
+		delete(before, of)
+		if found && key == optionsKey(rule.Options) {
+			continue
+		}
+		log.Printf("[INFO] RELOAD: Applying the changed %s rule of %s", of.direction, of.iface)
+		sched.StopIface(of.iface)
+		if err := rule.Options.Execute(ctx); err != nil {
+			log.Printf("[ERROR] RELOAD: Failed to apply the %s rule of %s: %v", of.direction, of.iface, err)
+		}
+	}
+	for of := range before {
+		log.Printf("[INFO] RELOAD: Resetting the %s direction of %s (its rule was removed)", of.direction, of.iface)
+		sched.StopIface(of.iface)
+		if err := cleanupDirection(ctx, of.iface, of.direction); err != nil {
+			log.Printf("[ERROR] RELOAD: Failed to reset %s: %v", of.iface, err)
+		}
+	}
+	return true, nil
+}
+
+// optionsKey identifies the parameters of a rule, to tell whether it changed.
+func optionsKey(opts *V4NetworkOptions) string {
+	b, _ := json.Marshal(opts)
+	return string(b)
+}
+
+// --- Auth Tokens ---
+
+// secretNames are the tokens that can be rotated by a reload.
+var secretNames = []string{"ADMIN_TOKEN", "FLEET_TOKEN", "VIEW_TOKEN"}
+
+// secrets holds the current tokens, read from NAME_FILE (e.g. a mounted
+// Kubernetes/Docker secret) when set, else from the NAME variable.
+var secrets struct {
+	sync.RWMutex
+	values map[string]string
+}
+
+// loadSecrets (re-)reads every token. A token file that cannot be read is
+// an error and the previous tokens are kept.
+func loadSecrets() error {
+	values := map[string]string{}
+	for _, name := range secretNames {
+		path := os.Getenv(name + "_FILE")
+		if path == "" {
+			values[name] = os.Getenv(name)
+			continue
+		}
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read %s_FILE: %w", name, err)
+		}
+		values[name] = strings.TrimSpace(string(data))
+	}
+	secrets.Lock()
+	secrets.values = values
+	secrets.Unlock()
+	return nil
+}
+
+// secret returns the current value of the token name ("" = not set): set
+// through the settings API, else read by loadSecrets.
+func secret(name string) string {
+	if s := store.Setting(name); s != nil {
+		return s.Value
+	}
+	secrets.RLock()
+	defer secrets.RUnlock()
+	if secrets.values == nil {
+		return os.Getenv(name)
+	}
+	return secrets.values[name]
+}
+
+// --- Profile Library File ---
+
+// loadLibraryFile imports LIBRARY_FILE (an exported library: fault profiles
+// and scenarios), merging by name. It reports whether LIBRARY_FILE is set.
+func loadLibraryFile() (bool, error) {
+	path := os.Getenv("LIBRARY_FILE")
+	if path == "" {
+		return false, nil
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return true, fmt.Errorf("failed to read LIBRARY_FILE: %w", err)
+	}
+	lib := &Library{}
+	if err := json.Unmarshal(data, lib); err != nil {
+		return true, fmt.Errorf("invalid LIBRARY_FILE: %w", err)
+	}
+	profiles, n, err := importLibrary(lib)
+	if err != nil {
+		return true, fmt.Errorf("invalid LIBRARY_FILE: %w", err)
+	}
+	log.Printf("[INFO] LIBRARY: Loaded %d fault profile(s) and %d scenario(s) from %s", profiles, n, path)
+	return true, nil
+}
+
+// --- SIGHUP ---
+
+// setupReloadSignal reloads the configuration on SIGHUP until ctx is done.
+func setupReloadSignal(ctx context.Context) {
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGHUP)
+
+	go func() {
+		defer signal.Stop(sigChan)
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-sigChan:
+				log.Println("[INFO] RELOAD: Received SIGHUP")
+				if _, err := reloadConfig(ctx); err != nil {
+					log.Printf("[ERROR] RELOAD: %v", err)
+				}
+			}
+		}
+	}()
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math/bits"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Connection Reset Injection ---
+
+// ResetInjection kills a random 'rate' % of the TCP connections of one
+// interface and direction mid-stream: with RSTs, like a middlebox or a
+// flaky load balancer, or silently (Action "drop"), like a NAT or firewall
+// that forgot the connection, which exposes missing application timeouts.
+// A mangle rule marks the chosen connections when they open (CONNMARK);
+// once 'after' bytes went through one, filter rules answer its packets with
+// a RST (REJECT --reject-with tcp-reset) to the sender, or drop them in
+// both directions. A time limit (AfterSeconds) is kept by us: the marked
+// connections' packets are queued to us (NFQUEUE), and dropped once the
+// connection is that old.
+type ResetInjection struct {
+	Iface        string  `json:"iface"`
+	Direction    string  `json:"direction"`              // of the connections' first packet
+	Rate         float64 `json:"rate"`                   // % of connections
+	Port         int     `json:"port,omitempty"`         // destination port of the connections (default: all)
+	Action       string  `json:"action"`                 // "reset" or "drop"
+	After        int     `json:"after"`                  // bytes (both directions) before the reset
+	AfterSeconds int     `json:"afterSeconds,omitempty"` // age of the connection before the drop
+	Mark         uint32  `json:"mark"`                   // connection mark bit
+	Queue        uint16  `json:"queue,omitempty"`        // NFQUEUE queue number, with AfterSeconds
+	Started      TcTime  `json:"started"`
+
+	mu      sync.Mutex
+	Dropped uint64 `json:"dropped,omitempty"` // packets dropped, with AfterSeconds
+
+	added  []firewallRule // the rules start added, for stop
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+const (
+	// resetRuleComment tags the rules, so a later run can recognize them
+	// (see cleanupLeftoverFirewall).
+	resetRuleComment = gatewayRuleComment + "-reset"
+	// resetMarkShift is the first of the 8 connection mark bits we use, one
+	// per injection.
+	resetMarkShift = 16
+	resetMarkBits  = 8
+	// resetQueueBase is the NFQUEUE queue number of the first mark bit,
+	// clear of the mangles' queues.
+	resetQueueBase = mangleQueueBase + 0x100
+	// resetFlowIdle is how long a connection that sends nothing is
+	// remembered (and kept blackholed).
+	resetFlowIdle = 5 * time.Minute
+)
+
+var (
+	resetsMu sync.Mutex
+	resets   = map[string]*ResetInjection{} // by iface/direction
+)
+
+// firewallRule is an iptables rule: its table, then its chain and spec.
+type firewallRule struct {
+	table string
+	spec  []string
+}
+
+// parseResetInjection reads an injection from the query: iface, direction,
+// rate, port, action, after and afterSeconds.
+func parseResetInjection(q url.Values) (*ResetInjection, error) {
+	inj := &ResetInjection{Iface: q.Get("iface"), Direction: q.Get("direction"), Action: q.Get("action"), Started: TcTime(time.Now())}
+	if inj.Iface == "" {
+		return nil, fmt.Errorf("resets: 'iface' is required")
+	}
+	if inj.Direction == "" {
+		inj.Direction = "outgoing"
+	}
+	if inj.Direction != "outgoing" && inj.Direction != "incoming" {
+		return nil, fmt.Errorf("resets: 'direction' must be 'outgoing' or 'incoming'")
+	}
+	rate, ok := parseTCNumber(q.Get("rate"))
+	if !ok || rate <= 0 || rate > 100 {
+		return nil, fmt.Errorf("resets: 'rate' must be a percentage above 0 and up to 100")
+	}
+	inj.Rate = rate
+	if port := q.Get("port"); port != "" {
+		n, err := strconv.Atoi(port)
+		if err != nil || n < 1 || n > 65535 {
+			return nil, fmt.Errorf("resets: invalid 'port' %q", port)
+		}
+		if listener := protectedListener(port); listener != "" {
+			return nil, fmt.Errorf("resets: port %s is protected (%s)", port, listener)
+		}
+		inj.Port = n
+	}
+	if after := q.Get("after"); after != "" {
+		n, err := strconv.Atoi(after)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("resets: 'after' must be a number of bytes, got %q", after)
+		}
+		inj.After = n
+	}
+	switch inj.Action {
+	case "":
+		inj.Action = "reset"
+	case "reset", "drop":
+	default:
+		return nil, fmt.Errorf("resets: 'action' must be 'reset' or 'drop'")
+	}
+	if secs := q.Get("afterSeconds"); secs != "" {
+		n, err := strconv.Atoi(secs)
+		if err != nil || n < 1 {
+			return nil, fmt.Errorf("resets: 'afterSeconds' must be a number of seconds, got %q", secs)
+		}
+		if inj.Action != "drop" {
+			return nil, fmt.Errorf("resets: 'afterSeconds' needs action=drop")
+		}
+		if inj.After > 0 {
+			return nil, fmt.Errorf("resets: set either 'after' or 'afterSeconds'")
+		}
+		inj.AfterSeconds = n
+	}
+	return inj, nil
+}
+
+// key identifies the injection in the registry.
+func (inj *ResetInjection) key() string {
+	return inj.Iface + "/" + inj.Direction
+}
+
+// rules are the filter rules of local and forwarded traffic, then the
+// marking rule (sampled in the kernel, on the connection's first packet):
+// in that order, a connection is never marked without them. Resets answer
+// the packets sent in Direction; drops take both directions (the mark is
+// the connection's, so no interface is matched). Connections of protected
+// ports are never marked.
+func (inj *ResetInjection) rules() []firewallRule {
+	ifaceFlag, markChain, filterChains := "-o", "POSTROUTING", []string{"OUTPUT", "FORWARD"}
+	if inj.Direction == "incoming" {
+		ifaceFlag, markChain, filterChains = "-i", "PREROUTING", []string{"INPUT", "FORWARD"}
+	}
+	if inj.Action == "drop" {
+		filterChains = []string{"INPUT", "OUTPUT", "FORWARD"}
+	}
+	mark := fmt.Sprintf("0x%x/0x%x", inj.Mark, inj.Mark)
+
+	var rules []firewallRule
+	for _, chain := range filterChains {
+		spec := []string{chain}
+		if inj.Action == "reset" {
+			spec = append(spec, ifaceFlag, inj.Iface)
+		}
+		spec = append(spec, "-p", "tcp", "-m", "connmark", "--mark", mark, "-m", "conntrack", "--ctstate", "ESTABLISHED")
+		if inj.After > 0 {
+			spec = append(spec, "-m", "connbytes", "--connbytes", strconv.Itoa(inj.After)+":", "--connbytes-dir", "both", "--connbytes-mode", "bytes")
+		}
+		spec = append(spec, "-m", "comment", "--comment", resetRuleComment)
+		switch {
+		case inj.Action == "reset":
+			spec = append(spec, "-j", "REJECT", "--reject-with", "tcp-reset")
+		case inj.AfterSeconds > 0:
+			spec = append(spec, "-j", "NFQUEUE", "--queue-num", strconv.Itoa(int(inj.Queue)), "--queue-bypass")
+		default:
+			spec = append(spec, "-j", "DROP")
+		}
+		rules = append(rules, firewallRule{"filter", spec})
+	}
+
+	spec := []string{markChain, ifaceFlag, inj.Iface, "-p", "tcp"}
+	if inj.Port > 0 {
+		spec = append(spec, "--dport", strconv.Itoa(inj.Port))
+	}
+	spec = append(spec, "-m", "conntrack", "--ctstate", "NEW")
+	var ports []string
+	for _, p := range protectedPortList() {
+		ports = append(ports, p.Port)
+	}
+	for i := 0; i < len(ports); i += 15 { // multiport takes up to 15 ports
+		spec = append(spec, "-m", "multiport", "!", "--ports", strings.Join(ports[i:min(i+15, len(ports))], ","))
+	}
+	if inj.Rate < 100 {
+		spec = append(spec, "-m", "statistic", "--mode", "random", "--probability", strconv.FormatFloat(inj.Rate/100, 'f', -1, 64))
+	}
+	spec = append(spec, "-m", "comment", "--comment", resetRuleComment, "-j", "CONNMARK", "--set-xmark", mark)
+	return append(rules, firewallRule{"mangle", spec})
+}
+
+// start binds the queue of a time limit, then adds the rules.
+func (inj *ResetInjection) start(ctx context.Context) error {
+	if _, err := net.InterfaceByName(inj.Iface); err != nil {
+		return fmt.Errorf("resets: interface '%s' not found", inj.Iface)
+	}
+	if inj.AfterSeconds > 0 {
+		queue, err := openNFQueue(inj.Queue)
+		if err != nil {
+			return fmt.Errorf("resets: %w", err)
+		}
+		// Not bound to a request context: the injection outlives the API call.
+		serveCtx, cancel := context.WithCancel(context.Background())
+		inj.cancel, inj.done = cancel, make(chan struct{})
+		go inj.serve(serveCtx, queue)
+	}
+	inj.added = inj.rules()
+	for _, iptables := range firewallCommands() {
+		for _, rule := range inj.added {
+			if err := runFirewallCommand(ctx, "RESETS", iptables, append([]string{"-t", rule.table, "-A"}, rule.spec...)...); err != nil {
+				inj.stop()
+				return fmt.Errorf("resets: failed to add the %s %s rule: %w", iptables, rule.table, err)
+			}
+		}
+	}
+	return nil
+}
+
+// stop deletes the rules start added that are in place, and unbinds the
+// queue.
+func (inj *ResetInjection) stop() {
+	ctx := context.Background()
+	for _, iptables := range firewallCommands() {
+		for _, rule := range inj.added {
+			if command(ctx, iptables, append([]string{"-t", rule.table, "-C"}, rule.spec...)...).Run() == nil {
+				runFirewallCommand(ctx, "RESETS", iptables, append([]string{"-t", rule.table, "-D"}, rule.spec...)...)
+			}
+		}
+	}
+	if inj.cancel != nil {
+		inj.cancel()
+		<-inj.done
+	}
+}
+
+// serve accepts the queued packets of each connection until it is
+// AfterSeconds old, and drops them from then on, until ctx is cancelled.
+func (inj *ResetInjection) serve(ctx context.Context, queue *nfQueue) {
+	defer close(inj.done)
+	defer queue.close()
+	type flow struct{ first, last time.Time }
+	flows := map[string]*flow{}
+	limit := time.Duration(inj.AfterSeconds) * time.Second
+	lastSweep := time.Now()
+	for ctx.Err() == nil {
+		packets, err := queue.read()
+		if err != nil {
+			log.Printf("[ERROR] RESETS: %s %s: %v (packets now pass)", inj.Iface, inj.Direction, err)
+			return
+		}
+		now := time.Now()
+		for _, p := range packets {
+			key := connectionKey(p.payload)
+			f := flows[key]
+			if f == nil {
+				f = &flow{first: now}
+				if key != "" {
+					flows[key] = f
+				}
+			}
+			f.last = now
+			if now.Sub(f.first) < limit {
+				err = queue.verdict(p.id, nil)
+			} else {
+				err = queue.drop(p.id)
+				inj.mu.Lock()
+				inj.Dropped++
+				inj.mu.Unlock()
+			}
+			if err != nil {
+				log.Printf("[WARN] RESETS: %s %s: verdict failed: %v", inj.Iface, inj.Direction, err)
+			}
+		}
+		if now.Sub(lastSweep) > time.Minute {
+			for key, f := range flows {
+				if now.Sub(f.last) > resetFlowIdle {
+					delete(flows, key)
+				}
+			}
+			lastSweep = now
+		}
+	}
+}
+
+// connectionKey identifies the TCP connection of pkt, the same in both
+// directions, or "" when pkt is not TCP.
+func connectionKey(pkt []byte) string {
+	ipLen, proto := ipHeaderLen(pkt)
+	if ipLen == 0 || proto != 6 || len(pkt) < ipLen+4 {
+		return ""
+	}
+	src, dst := pkt[12:16], pkt[16:20]
+	if pkt[0]>>4 == 6 {
+		src, dst = pkt[8:24], pkt[24:40]
+	}
+	a := string(src) + string(pkt[ipLen:ipLen+2])
+	b := string(dst) + string(pkt[ipLen+2:ipLen+4])
+	if a > b {
+		a, b = b, a
+	}
+	return a + b
+}
+
+// nextResetMark returns a free connection mark bit, or 0. Must be called
+// with resetsMu held.
+func nextResetMark() uint32 {
+	used := map[uint32]bool{}
+	for _, inj := range resets {
+		used[inj.Mark] = true
+	}
+	for bit := 0; bit < resetMarkBits; bit++ {
+		if mark := uint32(1) << (resetMarkShift + bit); !used[mark] {
+			return mark
+		}
+	}
+	return 0
+}
+
+// removeResets stops the injections of iface (direction "" for both) and
+// reports whether there were any.
+func removeResets(iface, direction string) bool {
+	resetsMu.Lock()
+	defer resetsMu.Unlock()
+	found := false
+	for key, inj := range resets {
+		if inj.Iface == iface && (direction == "" || inj.Direction == direction) {
+			inj.stop()
+			delete(resets, key)
+			log.Printf("[INFO] RESETS: Stopped resetting %s %s connections", inj.Iface, inj.Direction)
+			found = true
+		}
+	}
+	return found
+}
+
+// removeAllResets stops every injection (e.g. on reset-all and shutdown).
+func removeAllResets() {
+	resetsMu.Lock()
+	defer resetsMu.Unlock()
+	for key, inj := range resets {
+		inj.stop()
+		delete(resets, key)
+	}
+}
+
+// resetInjection reports whether injections can run on this host.
+func resetInjection() bool {
+	_, err := exec.LookPath("iptables")
+	return !isDarwin && err == nil
+}
+
+// --- Handlers: /resets ---
+
+// handleResetsSetup starts (or replaces) the injection of 'iface' in
+// 'direction'.
+func handleResetsSetup(w http.ResponseWriter, r *http.Request) {
+	inj, err := parseResetInjection(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	if isDarwin {
+		log.Println("[INFO] RESETS: Darwin: Ignoring resets setup")
+		respondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	removeResets(inj.Iface, inj.Direction)
+	resetsMu.Lock()
+	defer resetsMu.Unlock()
+	if inj.Mark = nextResetMark(); inj.Mark == 0 {
+		respondWithError(w, fmt.Sprintf("resets: at most %d injections can run at once", resetMarkBits), 409)
+		return
+	}
+	if inj.AfterSeconds > 0 {
+		inj.Queue = resetQueueBase + uint16(bits.TrailingZeros32(inj.Mark)-resetMarkShift)
+	}
+	if err := inj.start(r.Context()); err != nil {
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	resets[inj.key()] = inj
+	after := fmt.Sprintf("%d bytes", inj.After)
+	if inj.AfterSeconds > 0 {
+		after = fmt.Sprintf("%ds", inj.AfterSeconds)
+	}
+	log.Printf("[INFO] RESETS: Killing (%s) %.4g%% of the %s connections of %s after %s", inj.Action, inj.Rate, inj.Direction, inj.Iface, after)
+	respondWithJSON(w, http.StatusOK, inj)
+}
+
+// handleResetsReset stops the injection of 'iface' ('direction', default
+// both).
+func handleResetsReset(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if !removeResets(q.Get("iface"), q.Get("direction")) {
+		respondWithError(w, fmt.Sprintf("resets: no injection on '%s'", q.Get("iface")), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// handleResetsList returns the active injections and their counters.
+func handleResetsList(w http.ResponseWriter, r *http.Request) {
+	resetsMu.Lock()
+	defer resetsMu.Unlock()
+	list := make([]map[string]interface{}, 0, len(resets))
+	for _, inj := range resets {
+		inj.mu.Lock()
+		list = append(list, map[string]interface{}{
+			"iface":        inj.Iface,
+			"direction":    inj.Direction,
+			"rate":         inj.Rate,
+			"port":         inj.Port,
+			"action":       inj.Action,
+			"after":        inj.After,
+			"afterSeconds": inj.AfterSeconds,
+			"mark":         inj.Mark,
+			"queue":        inj.Queue,
+			"started":      inj.Started,
+			"dropped":      inj.Dropped,
+		})
+		inj.mu.Unlock()
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return fmt.Sprint(list[i]["iface"], list[i]["direction"]) < fmt.Sprint(list[j]["iface"], list[j]["direction"])
+	})
+	respondWithJSON(w, http.StatusOK, list)
+}
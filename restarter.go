@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// --- Restarter (self-upgrade) ---
+
+// maxUpgradeSize bounds the downloaded binary.
+const maxUpgradeSize = 256 << 20
+
+// restarter restarts the process in place (exec of the current binary),
+// keeping the tc rules active and handing the desired state over to the new
+// process.
+var restarter = struct {
+	mu        sync.Mutex
+	cancel    context.CancelFunc // cancels the root context (set by main)
+	requested bool
+	reason    string
+}{}
+
+// handoffEnv passes the path of the handed-over state to the new process:
+// only a process started by a restart reads one.
+const handoffEnv = "NETSIM_HANDOFF"
+
+// handoffPath is where the state is handed over when STATE_FILE is unset:
+// read from handoffEnv on a restart, or set by prepareRestart in a private
+// directory (0700) of its own.
+var handoffPath string
+
+// requestRestart shuts the server down and re-executes the binary.
+func requestRestart(reason string) {
+	restarter.mu.Lock()
+	defer restarter.mu.Unlock()
+	if restarter.requested || restarter.cancel == nil {
+		return
+	}
+	log.Printf("[WARN] RESTARTER: Restarting (%s)...", reason)
+	restarter.requested, restarter.reason = true, reason
+	restarter.cancel()
+}
+
+// restartRequested reports whether the shutdown in progress is a restart.
+func restartRequested() bool {
+	restarter.mu.Lock()
+	defer restarter.mu.Unlock()
+	return restarter.requested
+}
+
+// prepareRestart runs instead of the shutdown cleanup when restarting: the
+// rules stay in the kernel and the desired state is handed over.
+func prepareRestart() {
+	if os.Getenv("STATE_FILE") != "" {
+		return // (the new process reads it)
+	}
+	dir, err := os.MkdirTemp("", "netsim-handoff-")
+	if err != nil {
+		log.Printf("[ERROR] RESTARTER: Failed to hand over state, rules will not be restored: %v", err)
+		return
+	}
+	handoffPath = filepath.Join(dir, "state.json")
+	if err := store.WriteHandoff(handoffPath); err != nil {
+		log.Printf("[ERROR] RESTARTER: Failed to hand over state, rules will not be restored: %v", err)
+	}
+}
+
+// lastRestart is the restart history, handed over to the new process in
+// NETSIM_RESTARTS, NETSIM_RESTART_REASON and NETSIM_RESTART_AT (with the
+// state's path in NETSIM_HANDOFF).
+var lastRestart struct {
+	count  int
+	reason string
+	at     time.Time
+}
+
+// loadRestartHistory reads (and clears) the history handed over by the
+// previous process, if this one was started by a restart.
+func loadRestartHistory() {
+	lastRestart.count, _ = strconv.Atoi(os.Getenv("NETSIM_RESTARTS"))
+	lastRestart.reason = os.Getenv("NETSIM_RESTART_REASON")
+	lastRestart.at, _ = time.Parse(time.RFC3339Nano, os.Getenv("NETSIM_RESTART_AT"))
+	handoffPath = os.Getenv(handoffEnv)
+	for _, name := range []string{"NETSIM_RESTARTS", "NETSIM_RESTART_REASON", "NETSIM_RESTART_AT", handoffEnv} {
+		os.Unsetenv(name)
+	}
+}
+
+// execRestart replaces the process with a fresh copy of the binary. It only
+// returns on error (the supervisor then restarts us).
+func execRestart() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	restarter.mu.Lock()
+	reason := restarter.reason
+	restarter.mu.Unlock()
+	env := append(os.Environ(),
+		"NETSIM_RESTARTS="+strconv.Itoa(lastRestart.count+1),
+		"NETSIM_RESTART_REASON="+reason,
+		"NETSIM_RESTART_AT="+time.Now().UTC().Format(time.RFC3339Nano))
+	if handoffPath != "" {
+		env = append(env, handoffEnv+"="+handoffPath)
+	}
+	log.Printf("[INFO] RESTARTER: Executing %s", exe)
+	return syscall.Exec(exe, os.Args, env)
+}
+
+// adminAuthorized checks the ADMIN_TOKEN bearer token. Without ADMIN_TOKEN
+// the admin endpoints (restart, reload, upgrade) are disabled.
+func adminAuthorized(r *http.Request) bool {
+	token := secret("ADMIN_TOKEN")
+	if token == "" {
+		return false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// requireAdmin answers 403 (no ADMIN_TOKEN) or 401 (wrong token) and
+// returns false unless the request carries the admin token.
+func requireAdmin(w http.ResponseWriter, r *http.Request) bool {
+	if secret("ADMIN_TOKEN") == "" {
+		respondWithError(w, "admin endpoints are disabled (set ADMIN_TOKEN)", 403)
+		return false
+	}
+	if !adminAuthorized(r) {
+		log.Printf("[AUDIT] RESTARTER: Rejected %s %s: bad admin token (by %s)", r.Method, r.URL.Path, actorFromRequest(r))
+		w.Header().Set("WWW-Authenticate", `Bearer realm="netsim-admin"`)
+		respondWithError(w, "invalid or missing admin token", 401)
+		return false
+	}
+	return true
+}
+
+// loadHandoff restores the state handed over by the previous process, and
+// removes its directory.
+func loadHandoff(ctx context.Context) error {
+	if handoffPath == "" {
+		return nil
+	}
+	if err := checkHandoff(handoffPath); err != nil {
+		return err
+	}
+	// (only ours: checkHandoff passed)
+	defer os.RemoveAll(filepath.Dir(handoffPath))
+	found, err := store.ReadHandoff(handoffPath)
+	if err != nil || !found {
+		return err
+	}
+	restoreDesiredState(ctx)
+	return nil
+}
+
+// checkHandoff refuses a handoff file (it holds the tokens changed through
+// the settings) that another user could have written: the file and its
+// directory must be ours, and closed to the others.
+func checkHandoff(path string) error {
+	for _, p := range []string{filepath.Dir(path), path} {
+		info, err := os.Lstat(p)
+		if os.IsNotExist(err) && p == path {
+			return nil // (nothing was handed over)
+		} else if err != nil {
+			return err
+		}
+		st, ok := info.Sys().(*syscall.Stat_t)
+		if !ok || int(st.Uid) != os.Geteuid() {
+			return fmt.Errorf("handoff %s is not owned by this user, ignored", p)
+		}
+		if info.Mode()&os.ModeSymlink != 0 || info.Mode().Perm()&0o077 != 0 {
+			return fmt.Errorf("handoff %s is open to other users (%v), ignored", p, info.Mode())
+		}
+	}
+	return nil
+}
+
+// upgradePublicKey returns the ed25519 key that release binaries must be
+// signed with (UPGRADE_PUBLIC_KEY, base64). Upgrades are disabled without it.
+func upgradePublicKey() (ed25519.PublicKey, error) {
+	v := os.Getenv("UPGRADE_PUBLIC_KEY")
+	if v == "" {
+		return nil, nil
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(v))
+	if err != nil || len(key) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("UPGRADE_PUBLIC_KEY must be a base64 ed25519 public key (%d bytes)", ed25519.PublicKeySize)
+	}
+	return ed25519.PublicKey(key), nil
+}
+
+// upgradeURL returns where the release binary is published (UPGRADE_URL),
+// with its signature at <url>.sig. Upgrades are disabled without it: the
+// endpoint never fetches a URL the caller supplies.
+func upgradeURL() string {
+	return strings.TrimSpace(os.Getenv("UPGRADE_URL"))
+}
+
+// parseRelease reads a signature file: the release's version on the first
+// line, then the signature (base64) of the version line followed by the
+// binary, so that an older release cannot be passed off as a newer one.
+func parseRelease(b []byte) (string, []byte, error) {
+	ver, sig, ok := strings.Cut(strings.TrimSpace(string(b)), "\n")
+	ver = strings.TrimSpace(ver)
+	if !ok || !validVersion(ver) {
+		return "", nil, fmt.Errorf("the signature file must start with the release's version")
+	}
+	raw, err := base64.StdEncoding.DecodeString(strings.TrimSpace(sig))
+	if err != nil || len(raw) != ed25519.SignatureSize {
+		return "", nil, fmt.Errorf("the signature is not a base64 ed25519 signature")
+	}
+	return ver, raw, nil
+}
+
+// releaseMessage is what a release's signature covers.
+func releaseMessage(ver string, bin []byte) []byte {
+	return append([]byte(ver+"\n"), bin...)
+}
+
+// validVersion reports whether v is a dotted version (4.5.0).
+func validVersion(v string) bool {
+	for _, part := range strings.Split(v, ".") {
+		if _, err := strconv.Atoi(part); err != nil || strings.Trim(part, "0123456789") != "" {
+			return false
+		}
+	}
+	return true
+}
+
+// compareVersions compares two valid versions like strings.Compare does
+// (4.10.0 is newer than 4.9.1; a missing part counts as 0).
+func compareVersions(a, b string) int {
+	as, bs := strings.Split(a, "."), strings.Split(b, ".")
+	for i := 0; i < len(as) || i < len(bs); i++ {
+		var x, y int
+		if i < len(as) {
+			x, _ = strconv.Atoi(as[i])
+		}
+		if i < len(bs) {
+			y, _ = strconv.Atoi(bs[i])
+		}
+		if x != y {
+			if x < y {
+				return -1
+			}
+			return 1
+		}
+	}
+	return 0
+}
+
+// download fetches url, up to limit bytes.
+func download(ctx context.Context, url string, limit int64) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	b, err := io.ReadAll(io.LimitReader(resp.Body, limit+1))
+	if err != nil {
+		return nil, fmt.Errorf("GET %s: %w", url, err)
+	}
+	if int64(len(b)) > limit {
+		return nil, fmt.Errorf("GET %s: larger than %d bytes", url, limit)
+	}
+	return b, nil
+}
+
+// installBinary atomically replaces the running executable with bin,
+// keeping the old one as <exe>.prev.
+func installBinary(bin []byte) (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	if exe, err = filepath.EvalSymlinks(exe); err != nil {
+		return "", err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(exe), ".upgrade-*")
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(bin); err != nil {
+		tmp.Close()
+		return "", err
+	}
+	if err := tmp.Close(); err != nil {
+		return "", err
+	}
+	if err := os.Chmod(tmp.Name(), 0755); err != nil {
+		return "", err
+	}
+	os.Remove(exe + ".prev")
+	if err := os.Link(exe, exe+".prev"); err != nil {
+		log.Printf("[WARN] RESTARTER: Could not keep the previous binary: %v", err)
+	}
+	if err := os.Rename(tmp.Name(), exe); err != nil {
+		return "", err
+	}
+	return exe, nil
+}
+
+// --- Handlers: /restarter ---
+
+// handleRestarterStatus reports the uptime and the last restart.
+func handleRestarterStatus(w http.ResponseWriter, r *http.Request) {
+	status := map[string]interface{}{
+		"version":        version,
+		"startedAt":      TcTime(startedAt),
+		"uptimeSeconds":  roundTo(time.Since(startedAt).Seconds(), 0),
+		"restarts":       lastRestart.count,
+		"adminEnabled":   secret("ADMIN_TOKEN") != "",
+		"upgradeEnabled": secret("ADMIN_TOKEN") != "" && os.Getenv("UPGRADE_PUBLIC_KEY") != "" && upgradeURL() != "",
+	}
+	if lastRestart.count > 0 {
+		status["lastRestart"] = map[string]interface{}{"reason": lastRestart.reason, "at": TcTime(lastRestart.at)}
+	}
+	respondWithJSON(w, http.StatusOK, status)
+}
+
+// handleRestart restarts the process in place (admin). The tc rules stay
+// active and the desired state is restored by the new process.
+func handleRestart(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	reason := r.URL.Query().Get("reason")
+	if reason == "" {
+		reason = "api"
+	}
+	log.Printf("[AUDIT] RESTARTER: Restart requested (%s) by %s", reason, actorFromRequest(r))
+	respondWithJSON(w, http.StatusAccepted, map[string]string{"status": "restarting", "reason": reason})
+
+	// Restart once the response is out
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		requestRestart(reason)
+	}()
+}
+
+// handleReload reloads the configuration without restarting (admin).
+func handleReload(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	log.Printf("[AUDIT] RESTARTER: Reload requested by %s", actorFromRequest(r))
+	reloaded, err := reloadConfig(r.Context())
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("reload: %v", err), 500)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"reloaded": reloaded})
+}
+
+// --- Handler: /restarter/upgrade ---
+
+// handleUpgrade downloads the release published at UPGRADE_URL (admin),
+// verifies its ed25519 signature (<url>.sig, see parseRelease), refuses a
+// release that is not newer than the running version, installs it and
+// restarts. The tc rules stay active across the restart.
+func handleUpgrade(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	key, err := upgradePublicKey()
+	if err != nil {
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	url := upgradeURL()
+	if key == nil || url == "" {
+		respondWithError(w, "upgrades are disabled (set UPGRADE_PUBLIC_KEY and UPGRADE_URL)", 501)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), 50*time.Second)
+	defer cancel()
+	sigFile, err := download(ctx, url+".sig", 1024)
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("upgrade: %v", err), 502)
+		return
+	}
+	release, sig, err := parseRelease(sigFile)
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("upgrade: %v", err), 502)
+		return
+	}
+	if compareVersions(release, version) <= 0 {
+		log.Printf("[AUDIT] RESTARTER: Refused %s: version %s is not newer than %s (by %s)", url, release, version, actorFromRequest(r))
+		respondWithError(w, fmt.Sprintf("upgrade: the release (%s) is not newer than the running version (%s)", release, version), 409)
+		return
+	}
+	bin, err := download(ctx, url, maxUpgradeSize)
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("upgrade: %v", err), 502)
+		return
+	}
+	if !ed25519.Verify(key, releaseMessage(release, bin), sig) {
+		log.Printf("[AUDIT] RESTARTER: Rejected %s (%s): bad signature (by %s)", url, release, actorFromRequest(r))
+		respondWithError(w, "upgrade: signature verification failed", 502)
+		return
+	}
+	if !bytes.HasPrefix(bin, []byte("\x7fELF")) {
+		respondWithError(w, "upgrade: the release is not an ELF binary", 502)
+		return
+	}
+
+	sum := sha256.Sum256(bin)
+	exe, err := installBinary(bin)
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("upgrade: failed to install: %v", err), 500)
+		return
+	}
+	log.Printf("[AUDIT] RESTARTER: Installed %s %s (sha256 %s) from %s (by %s)", exe, release, hex.EncodeToString(sum[:]), url, actorFromRequest(r))
+	respondWithJSON(w, http.StatusAccepted, map[string]string{
+		"installed":       exe,
+		"sha256":          hex.EncodeToString(sum[:]),
+		"version":         release,
+		"previousVersion": version,
+	})
+
+	// Restart once the response is out
+	go func() {
+		time.Sleep(500 * time.Millisecond)
+		requestRestart("upgrade")
+	}()
+}
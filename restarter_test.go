@@ -0,0 +1,46 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"testing"
+)
+
+func TestCompareVersions(t *testing.T) {
+	for _, tc := range []struct {
+		a, b string
+		want int
+	}{
+		{"4.5.0", "4.5.0", 0},
+		{"4.5", "4.5.0", 0},
+		{"4.10.0", "4.9.1", 1},
+		{"4.5.0", "4.5.1", -1},
+		{"5", "4.99.99", 1},
+	} {
+		if got := compareVersions(tc.a, tc.b); got != tc.want {
+			t.Errorf("compareVersions(%q, %q) = %d, want %d", tc.a, tc.b, got, tc.want)
+		}
+	}
+}
+
+func TestParseRelease(t *testing.T) {
+	pub, priv, _ := ed25519.GenerateKey(nil)
+	bin := []byte("\x7fELF release")
+	sig := ed25519.Sign(priv, releaseMessage("4.6.0", bin))
+	ver, got, err := parseRelease([]byte("4.6.0\n" + base64.StdEncoding.EncodeToString(sig) + "\n"))
+	if err != nil || ver != "4.6.0" {
+		t.Fatalf("parseRelease = %q, %v", ver, err)
+	}
+	if !ed25519.Verify(pub, releaseMessage(ver, bin), got) {
+		t.Error("the signature does not verify")
+	}
+	// The version is signed with the binary: another one does not verify
+	if ed25519.Verify(pub, releaseMessage("4.4.0", bin), got) {
+		t.Error("the signature verifies with another version")
+	}
+	for _, bad := range []string{base64.StdEncoding.EncodeToString(sig), "v4.6.0\n" + base64.StdEncoding.EncodeToString(sig), "4.6.0\nnot base64"} {
+		if _, _, err := parseRelease([]byte(bad)); err == nil {
+			t.Errorf("parseRelease(%q) accepted", bad)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Rule IDs ---
+
+// newRuleID returns a random (version 4) UUID.
+func newRuleID() string {
+	var b [16]byte
+	rand.Read(b[:])
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// resolveRuleID adds the 'iface' of the rule named by the 'id' parameter of
+// a request, so the iface-keyed handlers accept rule IDs; they keep to that
+// rule of the interface. It reports false (after responding 404) when no
+// rule has the ID.
+func resolveRuleID(w http.ResponseWriter, r *http.Request) bool {
+	q := r.URL.Query()
+	id := q.Get("id")
+	if id == "" {
+		return true
+	}
+	rule := store.ByID(id)
+	if rule == nil {
+		respondWithError(w, fmt.Sprintf("no rule with id '%s'", id), 404)
+		return false
+	}
+	q.Del("ifaceRegex")
+	q.Set("iface", rule.Options.Iface)
+	r.URL.RawQuery = q.Encode()
+	return true
+}
+
+// withRuleID serves a /rules/{id} request with an iface-keyed handler.
+func withRuleID(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		q.Set("id", chi.URLParam(r, "id"))
+		r.URL.RawQuery = q.Encode()
+		if resolveRuleID(w, r) {
+			next(w, r)
+		}
+	}
+}
+
+// --- Handlers: /rules ---
+
+// handleRuleList returns every rule with its ID.
+func handleRuleList(w http.ResponseWriter, r *http.Request) {
+	setETag(w, store.Revision(""))
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{
+		"revision": store.Revision(""),
+		"rules":    store.List(),
+	})
+}
+
+// handleRuleAdjust changes parameters of a rule in place, keeping its ID:
+// the query parameters (as for /config/setup; an empty value clears one)
+// replace the rule's own. The interface and direction cannot change.
+func handleRuleAdjust(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	id := chi.URLParam(r, "id")
+	q := r.URL.Query()
+	if q.Has("iface") || q.Has("direction") {
+		respondWithError(w, "rules: 'iface' and 'direction' cannot be adjusted (set up a new rule)", 400)
+		return
+	}
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	rule := store.ByID(id)
+	if rule == nil {
+		respondWithError(w, fmt.Sprintf("no rule with id '%s'", id), 404)
+		return
+	}
+	if code, err := checkIfMatch(r, []string{rule.Options.Iface}); err != nil {
+		respondWithError(w, err.Error(), code)
+		return
+	}
+
+	// The rule's options as a query, with the request's parameters over it
+	var current map[string]string
+	b, _ := json.Marshal(rule.Options)
+	json.Unmarshal(b, &current)
+	merged := url.Values{}
+	for k, v := range current {
+		merged.Set(k, v)
+	}
+	for k := range q {
+		merged.Set(k, q.Get(k))
+	}
+	opts := parseV4Options(merged)
+
+	sched.StopIface(opts.Iface)
+	recordTCPBefore(ctx, opts.Iface)
+	if err := opts.Adjust(ctx, rule.Options); err != nil {
+		var partial *SetupError
+		if !errors.As(err, &partial) {
+			respondWithLocalizedError(w, r, 500, err)
+			return
+		}
+		restorePrevious(ctx, partial)
+		body := localizedErrorBody(w, r, 500, err)
+		body["failures"] = []*SetupError{partial}
+		respondWithJSON(w, 500, body)
+		return
+	}
+	rev := store.Set(opts, actorFromRequest(r))
+	setETag(w, rev)
+	log.Printf("[INFO] V4: Rule %s on %s adjusted", id, opts.Iface)
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"ifaces": []string{opts.Iface}, "applied": []*AppliedConfig{appliedConfig(ctx, opts, rev)}})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"slices"
+	"strings"
+)
+
+// --- Child Process Sandbox ---
+
+// childPath is the only PATH children get.
+const childPath = "/usr/local/sbin:/usr/local/bin:/usr/sbin:/usr/bin:/sbin:/bin"
+
+// childEnv is the environment of tc, ip, tcpdump & co: none of netsim's
+// own variables (tokens, object storage keys, ...) and the C locale, whose
+// output the parsers expect.
+func childEnv() []string {
+	env := []string{"PATH=" + childPath, "HOME=/", "LANG=C", "LC_ALL=C"}
+	if tz, ok := os.LookupEnv("TZ"); ok {
+		env = append(env, "TZ="+tz)
+	}
+	return env
+}
+
+// command returns an exec.Cmd for a child process with the cleaned
+// environment. Use it for every command netsim runs. The process-wide
+// restrictions (no-new-privs, seccomp; see hardenProcess) are inherited.
+func command(ctx context.Context, name string, args ...string) *exec.Cmd {
+	flushTCBatch(ctx) // (the command may depend on the queued ones)
+	if ns := shadowNetns(ctx); ns != "" && (name == "tc" || name == "ip") {
+		args = append([]string{"-n", ns}, args...)
+	}
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Env = childEnv()
+	return cmd
+}
+
+// rawArgsAllowed rejects the arguments of a raw 'tc'/'ip' command that run
+// other programs or read arbitrary files: 'ip netns exec', 'tc exec' (bpf
+// import can run a command) and batch mode.
+func rawArgsAllowed(name string, args []string) error {
+	for i, arg := range args {
+		// iproute2 accepts "--opt" and any prefix of an option ("-ba")
+		opt := strings.TrimPrefix(arg, "-")
+		switch {
+		case strings.HasPrefix(arg, "-") && len(opt) > 0 && (strings.HasPrefix("-batch", opt) || strings.HasPrefix("batch", opt)):
+			return fmt.Errorf("batch mode ('%s') is not allowed in raw commands", arg)
+		case name == "ip" && arg == "exec" && slices.Contains(args[:i], "netns"):
+			return fmt.Errorf("'ip netns exec' is not allowed in raw commands")
+		case name == "tc" && arg == "exec":
+			return fmt.Errorf("'tc exec' is not allowed in raw commands")
+		}
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"syscall"
+	"unsafe"
+)
+
+const (
+	prSetNoNewPrivs       = 38
+	seccompSetModeFilter  = 1
+	seccompFilterFlagSync = 1 // SECCOMP_FILTER_FLAG_TSYNC
+	seccompRetAllow       = 0x7fff0000
+	seccompRetErrno       = 0x00050000
+	bpfLdWAbs             = 0x20 // BPF_LD | BPF_W | BPF_ABS
+	bpfJeqK               = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	bpfJgeK               = 0x35 // BPF_JMP | BPF_JGE | BPF_K
+	bpfRetK               = 0x06 // BPF_RET | BPF_K
+)
+
+// seccompArch is the audit architecture and seccomp(2) syscall number of
+// each supported GOARCH.
+var seccompArch = map[string]struct {
+	audit   uint32
+	seccomp uintptr
+}{
+	"amd64": {0xc000003e, 317},
+	"arm64": {0xc00000b7, 277},
+}
+
+// deniedSyscalls are the syscalls neither netsim nor tc, ip, tcpdump or
+// ethtool need, except mount and umount2, which 'ip netns add/del' need for
+// the namespace features (see privilegedFeatures): those are only denied
+// when no such feature is enabled.
+var deniedSyscalls = []string{
+	"mount", "umount2", "pivot_root", "ptrace", "process_vm_readv", "process_vm_writev",
+	"kexec_load", "kexec_file_load", "init_module", "finit_module", "delete_module",
+	"reboot", "swapon", "swapoff", "acct", "add_key", "request_key", "keyctl",
+	"open_by_handle_at", "perf_event_open", "userfaultfd",
+}
+
+// syscallNumbers are the numbers of deniedSyscalls, by GOARCH.
+var syscallNumbers = map[string]map[string]uint32{
+	"amd64": {
+		"mount": 165, "umount2": 166, "pivot_root": 155, "ptrace": 101, "process_vm_readv": 310, "process_vm_writev": 311,
+		"kexec_load": 246, "kexec_file_load": 320, "init_module": 175, "finit_module": 313, "delete_module": 176,
+		"reboot": 169, "swapon": 167, "swapoff": 168, "acct": 163, "add_key": 248, "request_key": 249, "keyctl": 250,
+		"open_by_handle_at": 304, "perf_event_open": 298, "userfaultfd": 323,
+	},
+	"arm64": {
+		"mount": 40, "umount2": 39, "pivot_root": 41, "ptrace": 117, "process_vm_readv": 270, "process_vm_writev": 271,
+		"kexec_load": 104, "kexec_file_load": 294, "init_module": 105, "finit_module": 273, "delete_module": 106,
+		"reboot": 142, "swapon": 224, "swapoff": 225, "acct": 89, "add_key": 217, "request_key": 218, "keyctl": 219,
+		"open_by_handle_at": 265, "perf_event_open": 241, "userfaultfd": 282,
+	},
+}
+
+// seccompDenied returns the numbers of the syscalls the filter denies on
+// arch: deniedSyscalls, but those of the enabled privileged features.
+func seccompDenied(arch string) []uint32 {
+	allowed := map[string]bool{}
+	for _, name := range privilegedFeatureNames() {
+		if privilegedFeatureEnabled(name) {
+			for _, call := range privilegedFeatures[name].syscalls {
+				allowed[call] = true
+			}
+		}
+	}
+	var denied []uint32
+	for _, call := range deniedSyscalls {
+		if !allowed[call] {
+			denied = append(denied, syscallNumbers[arch][call])
+		}
+	}
+	return denied
+}
+
+type sockFilter struct {
+	code uint16
+	jt   uint8
+	jf   uint8
+	k    uint32
+}
+
+type sockFprog struct {
+	len    uint16
+	filter *sockFilter
+}
+
+// seccompFilter builds the BPF program: other architectures (32-bit
+// compat calls) and x32 syscalls are denied, then each denied syscall
+// returns EPERM and everything else is allowed.
+func seccompFilter(audit uint32, denied []uint32) []sockFilter {
+	deny := sockFilter{code: bpfRetK, k: seccompRetErrno | uint32(syscall.EPERM)}
+	prog := []sockFilter{
+		{code: bpfLdWAbs, k: 4}, // seccomp_data.arch
+		{code: bpfJeqK, jt: 1, k: audit},
+		deny,
+		{code: bpfLdWAbs, k: 0}, // seccomp_data.nr
+		{code: bpfJgeK, jf: 1, k: 0x40000000},
+		deny,
+	}
+	for _, nr := range denied {
+		prog = append(prog, sockFilter{code: bpfJeqK, jf: 1, k: nr}, deny)
+	}
+	return append(prog, sockFilter{code: bpfRetK, k: seccompRetAllow})
+}
+
+// hardenProcess sets no-new-privs on the process (children cannot gain
+// privileges through setuid or file-capability binaries) and, with
+// seccomp, installs the deny-list filter on every thread. Both are inherited
+// by all children and cannot be undone.
+func hardenProcess(seccomp bool) error {
+	if !seccomp {
+		if err := allThreads(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); err != nil {
+			return fmt.Errorf("setting no-new-privs: %w", err)
+		}
+		return nil
+	}
+	arch, ok := seccompArch[runtime.GOARCH]
+	if !ok {
+		return fmt.Errorf("seccomp is not supported on %s", runtime.GOARCH)
+	}
+	// TSYNC applies the filter, and no-new-privs, to the other threads
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	if _, _, errno := syscall.RawSyscall(syscall.SYS_PRCTL, prSetNoNewPrivs, 1, 0); errno != 0 {
+		return fmt.Errorf("setting no-new-privs: %w", errno)
+	}
+	filter := seccompFilter(arch.audit, seccompDenied(runtime.GOARCH))
+	prog := sockFprog{len: uint16(len(filter)), filter: &filter[0]}
+	if r, _, errno := syscall.RawSyscall(arch.seccomp, seccompSetModeFilter, seccompFilterFlagSync, uintptr(unsafe.Pointer(&prog))); errno != 0 {
+		return fmt.Errorf("installing the seccomp filter: %w", errno)
+	} else if r != 0 {
+		return fmt.Errorf("installing the seccomp filter: thread %d cannot be synchronized", r)
+	}
+	privileged.Lock()
+	privileged.seccomp = true
+	privileged.Unlock()
+	return nil
+}
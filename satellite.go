@@ -0,0 +1,284 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Satellite Links ---
+
+// satelliteOrbits are the defaults of each orbit: the delay and jitter (on
+// the shaped direction, so with an 'outgoing' rule they make up the RTT)
+// and the handovers of LEO constellations, which re-plan their beams every
+// 15 seconds.
+var satelliteOrbits = map[string]SatelliteLink{
+	"geo": {Delay: "550", Jitter: "10"},
+	"meo": {Delay: "130", Jitter: "5"},
+	"leo": {Delay: "30", Jitter: "5", HandoverEvery: "15s", HandoverOutage: "200ms"},
+}
+
+// SatelliteLink is a composite impairment: the long delay and low jitter of
+// a satellite hop, short periodic outages (handovers, 100% loss) and
+// rain-fade-style dips of the rate at random intervals. Empty fields take
+// the defaults of Orbit.
+type SatelliteLink struct {
+	Orbit          string            `json:"orbit,omitempty"` // "geo" (default), "meo" or "leo"
+	Options        *V4NetworkOptions `json:"options,omitempty"`
+	Delay          string            `json:"delay,omitempty"`          // ms
+	Jitter         string            `json:"jitter,omitempty"`         // ms
+	HandoverEvery  string            `json:"handoverEvery,omitempty"`  // Go duration; "" or "0s": none
+	HandoverOutage string            `json:"handoverOutage,omitempty"` // Go duration
+	FadeEvery      string            `json:"fadeEvery,omitempty"`      // mean time between fades; "": none
+	FadeDuration   string            `json:"fadeDuration,omitempty"`   // Go duration (default 30s)
+	FadeDepth      int               `json:"fadeDepth,omitempty"`      // % of the rate lost in a fade (default 50)
+
+	State     string `json:"state"` // "clear", "handover" or "fade"
+	Handovers int    `json:"handovers"`
+	Fades     int    `json:"fades"`
+
+	handoverEvery, handoverOutage, fadeEvery, fadeDuration time.Duration
+	rate                                                   float64 // bits/s of the base rule
+}
+
+// satelliteLinks holds the satellite link of each interface (guarded by
+// sched).
+var satelliteLinks = map[string]*SatelliteLink{}
+
+// validate fills in the defaults of the orbit and parses the durations.
+func (s *SatelliteLink) validate() error {
+	if s.Options == nil || s.Options.Iface == "" || s.Options.Direction == "" {
+		return fmt.Errorf("satellite: 'options.iface' and 'options.direction' are required")
+	}
+	if s.Orbit == "" {
+		s.Orbit = "geo"
+	}
+	orbit, ok := satelliteOrbits[s.Orbit]
+	if !ok {
+		return fmt.Errorf("satellite: invalid 'orbit' %q (geo, meo or leo)", s.Orbit)
+	}
+	for _, f := range []struct{ value, def *string }{
+		{&s.Delay, &orbit.Delay}, {&s.Jitter, &orbit.Jitter},
+		{&s.HandoverEvery, &orbit.HandoverEvery}, {&s.HandoverOutage, &orbit.HandoverOutage},
+	} {
+		if *f.value == "" {
+			*f.value = *f.def
+		}
+	}
+	if s.FadeDuration == "" {
+		s.FadeDuration = "30s"
+	}
+	if s.FadeDepth == 0 {
+		s.FadeDepth = 50
+	}
+
+	for _, d := range []struct {
+		name  string
+		value string
+		out   *time.Duration
+	}{
+		{"handoverEvery", s.HandoverEvery, &s.handoverEvery},
+		{"handoverOutage", s.HandoverOutage, &s.handoverOutage},
+		{"fadeEvery", s.FadeEvery, &s.fadeEvery},
+		{"fadeDuration", s.FadeDuration, &s.fadeDuration},
+	} {
+		if d.value == "" {
+			continue
+		}
+		v, err := time.ParseDuration(d.value)
+		if err != nil || v < 0 {
+			return fmt.Errorf("satellite: invalid '%s' %q", d.name, d.value)
+		}
+		*d.out = v
+	}
+	if s.handoverEvery > 0 && (s.handoverOutage <= 0 || s.handoverOutage >= s.handoverEvery) {
+		return fmt.Errorf("satellite: 'handoverOutage' must be above 0 and below 'handoverEvery'")
+	}
+	if s.fadeEvery > 0 {
+		if s.Options.Rate == "" {
+			return fmt.Errorf("satellite: fades need a rate ('options.rate')")
+		}
+		rate, err := parseTCRate(s.Options.Rate)
+		if err != nil {
+			return fmt.Errorf("satellite: invalid 'options.rate': %v", err)
+		}
+		s.rate = rate
+		if s.FadeDepth < 1 || s.FadeDepth > 99 {
+			return fmt.Errorf("satellite: 'fadeDepth' must be 1-99")
+		}
+		if s.fadeDuration <= 0 {
+			return fmt.Errorf("satellite: 'fadeDuration' must be above 0")
+		}
+	}
+	return s.optionsFor("clear").validateNetem()
+}
+
+// optionsFor returns the rule of a state over the base options.
+func (s *SatelliteLink) optionsFor(state string) *V4NetworkOptions {
+	opts := *s.Options
+	opts.Delay, opts.Jitter = s.Delay, s.Jitter
+	switch state {
+	case "handover":
+		opts.LossModel, opts.Loss = "random", "100"
+	case "fade":
+		opts.Rate = strconv.FormatFloat(s.rate*float64(100-s.FadeDepth)/100, 'f', 0, 64) + "bit"
+	}
+	return &opts
+}
+
+// nextFade returns the time until the next fade: FadeEvery on average,
+// anywhere between half and one and a half of it.
+func (s *SatelliteLink) nextFade() time.Duration {
+	return s.fadeEvery/2 + time.Duration(chaosInt63n(int64(s.fadeEvery)+1))
+}
+
+// run applies the clear-sky rule, then switches to handover and fade states
+// as their timers fire. A handover during a fade wins; the fade resumes
+// after it.
+func (s *SatelliteLink) run(ctx context.Context) {
+	var prev *V4NetworkOptions
+	apply := func(state string) bool {
+		opts := s.optionsFor(state)
+		applyMu.Lock()
+		defer applyMu.Unlock()
+		if ctx.Err() != nil { // Stopped (e.g. reset) while waiting for the lock
+			return false
+		}
+		if err := opts.Adjust(ctx, prev); err != nil {
+			log.Printf("[ERROR] SATELLITE: Failed to enter %s on %s: %v", state, opts.Iface, err)
+			return true
+		}
+		store.Set(opts, Actor{Source: "satellite", User: state})
+		prev = opts
+		sched.mu.Lock()
+		s.State = state
+		switch state {
+		case "handover":
+			s.Handovers++
+		case "fade":
+			s.Fades++
+		}
+		sched.mu.Unlock()
+		return true
+	}
+
+	// nil channels never fire: a disabled timer
+	var handover, handoverEnd, fade, fadeEnd <-chan time.Time
+	if s.handoverEvery > 0 {
+		handover = time.After(s.handoverEvery)
+	}
+	if s.fadeEvery > 0 {
+		fade = time.After(s.nextFade())
+	}
+	log.Printf("[INFO] SATELLITE: %s: %s link (delay %sms, handover every %v, fade every %v)",
+		s.Options.Iface, s.Orbit, s.Delay, s.handoverEvery, s.fadeEvery)
+	if !apply("clear") {
+		return
+	}
+	fading := false
+	for {
+		state := ""
+		select {
+		case <-ctx.Done():
+			return
+		case <-handover:
+			handover, handoverEnd = time.After(s.handoverEvery), time.After(s.handoverOutage)
+			state = "handover"
+		case <-handoverEnd:
+			handoverEnd, state = nil, "clear"
+			if fading {
+				state = "fade"
+			}
+		case <-fade:
+			fade, fadeEnd, fading = nil, time.After(s.fadeDuration), true
+			if handoverEnd == nil {
+				state = "fade"
+			}
+		case <-fadeEnd:
+			fade, fadeEnd, fading = time.After(s.nextFade()), nil, false
+			if handoverEnd == nil {
+				state = "clear"
+			}
+		}
+		if state != "" && !apply(state) {
+			return
+		}
+	}
+}
+
+// --- Handlers: /satellite ---
+
+// handleSatelliteStart installs (or replaces) the satellite link of an
+// interface.
+func handleSatelliteStart(w http.ResponseWriter, r *http.Request) {
+	link := &SatelliteLink{}
+	if err := json.NewDecoder(r.Body).Decode(link); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid satellite JSON: %v", err), 400)
+		return
+	}
+	if err := link.validate(); err != nil {
+		respondWithLocalizedError(w, r, 400, err)
+		return
+	}
+
+	iface := link.Options.Iface
+	sched.StopIface(iface)
+	link.State = "clear"
+	sched.mu.Lock()
+	satelliteLinks[iface] = link
+	snapshot := *link
+	sched.mu.Unlock()
+	sched.Start("satellite:"+iface, "satellite", iface, link.run)
+	respondWithJSON(w, http.StatusOK, &snapshot)
+}
+
+// handleSatelliteList returns the satellite links with a running job, with
+// their current state and counters.
+func handleSatelliteList(w http.ResponseWriter, r *http.Request) {
+	active := map[string]SatelliteLink{}
+	sched.mu.Lock()
+	for iface, link := range satelliteLinks {
+		if _, ok := sched.jobs["satellite:"+iface]; ok {
+			active[iface] = *link
+		}
+	}
+	sched.mu.Unlock()
+	respondWithJSON(w, http.StatusOK, active)
+}
+
+// handleSatelliteStop stops the satellite link of an interface and leaves
+// its clear-sky rule in place, so a stop during a handover does not keep
+// the outage.
+func handleSatelliteStop(w http.ResponseWriter, r *http.Request) {
+	iface := chi.URLParam(r, "iface")
+	if !sched.Stop("satellite:" + iface) {
+		respondWithError(w, fmt.Sprintf("no satellite link running on '%s'", iface), 404)
+		return
+	}
+	sched.mu.Lock()
+	link := satelliteLinks[iface]
+	state := link.State
+	link.State = "clear"
+	sched.mu.Unlock()
+	if state != "clear" {
+		applyMu.Lock()
+		defer applyMu.Unlock()
+		opts := link.optionsFor("clear")
+		var prev *V4NetworkOptions
+		if rule := store.Get(iface, opts.Direction); rule != nil {
+			prev = rule.Options
+		}
+		if err := opts.Adjust(r.Context(), prev); err != nil {
+			respondWithError(w, fmt.Sprintf("satellite: failed to restore the clear-sky rule on %s: %v", iface, err), 500)
+			return
+		}
+		store.Set(opts, Actor{Source: "satellite", User: "clear"})
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
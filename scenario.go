@@ -0,0 +1,463 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Scenarios ---
+
+// ScenarioStep applies L3 rules and/or L7 fault profiles, then holds them
+// for Duration.
+type ScenarioStep struct {
+	Name       string              `json:"name,omitempty"`
+	Duration   string              `json:"duration"`             // Go duration, e.g. "30s"
+	Rules      []*V4NetworkOptions `json:"rules,omitempty"`      // L3 rules (setup)
+	Resets     []string            `json:"resets,omitempty"`     // interfaces to reset
+	L7         map[string]string   `json:"l7,omitempty"`         // upstream host -> fault profile ("" clears)
+	PeerRules  []*V4NetworkOptions `json:"peerRules,omitempty"`  // L3 rules for the peer box
+	PeerResets []string            `json:"peerResets,omitempty"` // interfaces to reset on the peer box
+	Branches   []*ScenarioBranch   `json:"branches,omitempty"`   // checked while the step holds
+	Next       string              `json:"next,omitempty"`       // step after this one (default: the following step)
+	duration   time.Duration
+}
+
+// scenarioCheckInterval is how often the branches of a step are checked.
+const scenarioCheckInterval = time.Second
+
+// ScenarioBranch jumps to the step named Goto as soon as Metric, measured
+// on Iface since the step started, compares to Value with Op.
+type ScenarioBranch struct {
+	Iface  string  `json:"iface"`
+	Metric string  `json:"metric"` // loss (%), dropped (packets), rxMbps, txMbps
+	Op     string  `json:"op"`     // >, >=, <, <=
+	Value  float64 `json:"value"`
+	Goto   string  `json:"goto"`
+}
+
+// measure returns the metric of b over the counters of the window.
+func (b *ScenarioBranch) measure(c *IfaceCounters, window time.Duration) float64 {
+	switch b.Metric {
+	case "loss":
+		if sent := c.QdiscPackets + c.QdiscDropped; sent > 0 {
+			return 100 * float64(c.QdiscDropped) / float64(sent)
+		}
+		return 0
+	case "dropped":
+		return float64(c.QdiscDropped)
+	case "rxMbps":
+		return float64(c.RxBytes) * 8 / window.Seconds() / 1e6
+	default: // txMbps
+		return float64(c.TxBytes) * 8 / window.Seconds() / 1e6
+	}
+}
+
+// holds reports whether the measured value satisfies the condition.
+func (b *ScenarioBranch) holds(value float64) bool {
+	switch b.Op {
+	case ">":
+		return value > b.Value
+	case ">=":
+		return value >= b.Value
+	case "<":
+		return value < b.Value
+	default: // <=
+		return value <= b.Value
+	}
+}
+
+// branchCounters reads the counters of iface, on the device shaped by its
+// applied rule (if any).
+func branchCounters(ctx context.Context, iface string) *IfaceCounters {
+	opts := &V4NetworkOptions{Iface: iface, Direction: "outgoing"}
+	if applied := store.Get(iface, ""); applied != nil {
+		opts = applied.Options
+	}
+	return readIfaceCounters(ctx, opts)
+}
+
+// Scenario is a named sequence of steps, optionally looped, that unifies
+// L3 (tc) and L7 (fault proxy) chaos under one timeline.
+type Scenario struct {
+	Name  string         `json:"name"`
+	Loop  bool           `json:"loop,omitempty"`
+	Steps []ScenarioStep `json:"steps"`
+
+	// Two-box scenarios: Peer is the API URL of the box at the other end of
+	// the path, which runs the peer rules in lockstep. StartAt (wall clock)
+	// is set by the coordinating box.
+	Peer          string        `json:"peer,omitempty"`
+	StartAt       *TcTime       `json:"startAt,omitempty"`
+	CoordinatedBy string        `json:"coordinatedBy,omitempty"`
+	Sync          *ScenarioSync `json:"sync,omitempty"`
+
+	// Clock is the clock the steps are scheduled on: "wall" follows the
+	// system clock, so steps move when the host steps it (and two boxes stay
+	// aligned to StartAt); "monotonic" ignores clock steps, so step
+	// durations stay exact. Default: wall with a StartAt or Peer, monotonic
+	// otherwise.
+	Clock string `json:"clock,omitempty"`
+}
+
+// scenarios holds the defined scenarios (guarded by sched).
+var scenarios = map[string]*Scenario{}
+
+// validate checks the scenario and parses the step durations.
+func (s *Scenario) validate() error {
+	if s.Name == "" {
+		return fmt.Errorf("scenario: 'name' is required")
+	}
+	if len(s.Steps) == 0 {
+		return fmt.Errorf("scenario: at least one step is required")
+	}
+	if s.Peer != "" {
+		if _, err := fleetPeer(s.Peer); err != nil {
+			return fmt.Errorf("scenario: %w", err)
+		}
+	}
+	switch s.Clock {
+	case "":
+		s.Clock = "monotonic"
+		if s.StartAt != nil || s.Peer != "" {
+			s.Clock = "wall"
+		}
+	case "wall", "monotonic":
+	default:
+		return fmt.Errorf("scenario: invalid 'clock' %q (wall, monotonic)", s.Clock)
+	}
+	steps := map[string]int{}
+	for i, step := range s.Steps {
+		if step.Name == "" {
+			continue
+		}
+		if _, dup := steps[step.Name]; dup {
+			return fmt.Errorf("scenario: duplicate step name '%s'", step.Name)
+		}
+		steps[step.Name] = i
+	}
+	for i := range s.Steps {
+		step := &s.Steps[i]
+		d, err := time.ParseDuration(step.Duration)
+		if err != nil || d <= 0 {
+			return fmt.Errorf("scenario: step %d: invalid 'duration' %q", i, step.Duration)
+		}
+		step.duration = d
+		for _, opts := range append(step.Rules, step.PeerRules...) {
+			if opts == nil || opts.Iface == "" || opts.Direction == "" {
+				return fmt.Errorf("scenario: step %d: rules need 'iface' and 'direction'", i)
+			}
+		}
+		if s.Peer == "" && (len(step.PeerRules) > 0 || len(step.PeerResets) > 0) {
+			return fmt.Errorf("scenario: step %d: 'peerRules' and 'peerResets' need a 'peer'", i)
+		}
+		if _, ok := steps[step.Next]; step.Next != "" && !ok {
+			return fmt.Errorf("scenario: step %d: 'next' names an unknown step '%s'", i, step.Next)
+		}
+		for _, b := range step.Branches {
+			if s.Peer != "" {
+				return fmt.Errorf("scenario: step %d: 'branches' are measured locally and cannot be used with a 'peer'", i)
+			}
+			if b == nil || b.Iface == "" {
+				return fmt.Errorf("scenario: step %d: branches need an 'iface'", i)
+			}
+			switch b.Metric {
+			case "loss", "dropped", "rxMbps", "txMbps":
+			default:
+				return fmt.Errorf("scenario: step %d: unknown branch 'metric' %q (loss, dropped, rxMbps, txMbps)", i, b.Metric)
+			}
+			switch b.Op {
+			case ">", ">=", "<", "<=":
+			default:
+				return fmt.Errorf("scenario: step %d: invalid branch 'op' %q (>, >=, <, <=)", i, b.Op)
+			}
+			if _, ok := steps[b.Goto]; !ok {
+				return fmt.Errorf("scenario: step %d: branch 'goto' names an unknown step '%s'", i, b.Goto)
+			}
+		}
+		if s.Peer != "" && step.Next != "" {
+			return fmt.Errorf("scenario: step %d: 'next' cannot be used with a 'peer'", i)
+		}
+		for host, profile := range step.L7 {
+			if profile == "" {
+				continue
+			}
+			l7Faults.Lock()
+			known := lookupFaultProfile(profile) != nil
+			l7Faults.Unlock()
+			if !known {
+				return fmt.Errorf("scenario: step %d: unknown L7 profile '%s' for %s", i, profile, host)
+			}
+		}
+	}
+	cycles := s.Loop
+	for _, step := range s.Steps {
+		cycles = cycles || step.Next != ""
+	}
+	if cycles {
+		var total time.Duration
+		for _, step := range s.Steps {
+			total += step.duration
+		}
+		if total < time.Second {
+			return fmt.Errorf("scenario: a looped scenario (or one with 'next') must last at least 1s")
+		}
+	}
+	return nil
+}
+
+// applyStep applies one step. L3 changes are serialized with other tc
+// mutations; L7 changes take effect on the next proxied request.
+func (s *Scenario) applyStep(ctx context.Context, i int) {
+	step := s.Steps[i]
+	log.Printf("[INFO] SCENARIO: %s: step %d %q (%v)", s.Name, i, step.Name, step.duration)
+
+	if len(step.Rules) > 0 || len(step.Resets) > 0 {
+		applyMu.Lock()
+		if ctx.Err() != nil {
+			applyMu.Unlock()
+			return
+		}
+		for _, iface := range step.Resets {
+			removeMirror(ctx, iface)
+			cleanupSingleInterface(ctx, iface)
+			store.Delete(iface, Actor{Source: "scenario", User: s.Name})
+		}
+		for _, rule := range step.Rules {
+			opts := *rule
+			var prev *V4NetworkOptions
+			if applied := store.Get(opts.Iface, opts.Direction); applied != nil {
+				prev = applied.Options
+			}
+			if err := opts.Adjust(ctx, prev); err != nil {
+				log.Printf("[ERROR] SCENARIO: %s: failed to apply rule on %s: %v", s.Name, opts.Iface, err)
+				continue
+			}
+			store.Set(&opts, Actor{Source: "scenario", User: s.Name})
+		}
+		applyMu.Unlock()
+	}
+
+	for host, profile := range step.L7 {
+		if err := setL7Upstream(host, profile); err != nil {
+			log.Printf("[ERROR] SCENARIO: %s: %v", s.Name, err)
+		}
+	}
+}
+
+// run walks the steps until cancelled: a step is followed by its 'next' step
+// or the following one, and wraps around when Loop is set. A branch whose
+// condition holds jumps to its step early. Steps are scheduled from StartAt
+// (default: now) on the scenario's clock; a late start skips the steps that
+// are already over.
+func (s *Scenario) run(ctx context.Context) {
+	at := time.Now()
+	if s.StartAt != nil {
+		at = time.Time(*s.StartAt)
+	}
+	if s.Clock == "wall" {
+		at = at.Round(0) // strips the monotonic reading: comparisons use the wall clock
+	} else {
+		at = time.Now().Add(time.Until(at))
+	}
+	steps := newClockStepDetector()
+	for i := 0; i < len(s.Steps); {
+		step := s.Steps[i]
+		next := at.Add(step.duration)
+		target := -1
+		if time.Now().Before(next) {
+			if !s.sleepUntil(ctx, at) {
+				return
+			}
+			s.applyStep(ctx, i)
+			if j, branchedAt := s.watchBranches(ctx, i, next); j >= 0 {
+				target, next = j, branchedAt
+				if s.Clock == "wall" {
+					next = next.Round(0)
+				}
+			}
+		}
+		if !s.sleepUntil(ctx, next) {
+			return
+		}
+		if jump := steps.check(); jump != 0 {
+			if s.Clock == "wall" {
+				log.Printf("[WARN] SCENARIO: %s: the system clock was stepped by %v: the steps follow it (clock=wall)", s.Name, jump)
+			} else {
+				log.Printf("[WARN] SCENARIO: %s: the system clock was stepped by %v: the steps keep their durations (clock=monotonic)", s.Name, jump)
+			}
+		}
+		at = next
+		switch {
+		case target >= 0:
+			i = target
+		case step.Next != "":
+			i = s.stepIndex(step.Next)
+		case i == len(s.Steps)-1 && s.Loop:
+			i = 0
+		default:
+			i++
+		}
+	}
+	log.Printf("[INFO] SCENARIO: %s finished", s.Name)
+}
+
+// watchBranches checks the branches of step i until the step ends and
+// returns the target of the first one that holds, with the time it did, or
+// -1 when none did.
+func (s *Scenario) watchBranches(ctx context.Context, i int, end time.Time) (int, time.Time) {
+	step := s.Steps[i]
+	if len(step.Branches) == 0 {
+		return -1, end
+	}
+	start := time.Now()
+	base := map[string]*IfaceCounters{}
+	for _, b := range step.Branches {
+		if base[b.Iface] == nil {
+			base[b.Iface] = branchCounters(ctx, b.Iface)
+		}
+	}
+	ticker := time.NewTicker(scenarioCheckInterval)
+	defer ticker.Stop()
+	for time.Now().Add(scenarioCheckInterval).Before(end) {
+		select {
+		case <-ctx.Done():
+			return -1, end
+		case <-ticker.C:
+		}
+		window := time.Since(start)
+		current := map[string]*IfaceCounters{}
+		for _, b := range step.Branches {
+			if current[b.Iface] == nil {
+				current[b.Iface] = branchCounters(ctx, b.Iface).since(base[b.Iface])
+			}
+			if value := b.measure(current[b.Iface], window); b.holds(value) {
+				log.Printf("[INFO] SCENARIO: %s: step %d %q: %s %s is %.2f (%s %v), going to %q",
+					s.Name, i, step.Name, b.Iface, b.Metric, value, b.Op, b.Value, b.Goto)
+				return s.stepIndex(b.Goto), time.Now()
+			}
+		}
+	}
+	return -1, end
+}
+
+// stepIndex returns the index of the step named name, or -1.
+func (s *Scenario) stepIndex(name string) int {
+	for i, step := range s.Steps {
+		if step.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// sleepUntil waits until t and reports whether ctx is still active. Timers
+// run on the monotonic clock, so on the wall clock it wakes up every
+// scenarioCheckInterval to follow clock steps.
+func (s *Scenario) sleepUntil(ctx context.Context, t time.Time) bool {
+	for {
+		d := time.Until(t)
+		if d <= 0 {
+			return ctx.Err() == nil
+		}
+		if s.Clock == "wall" {
+			d = min(d, scenarioCheckInterval)
+		}
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return false
+		case <-timer.C:
+		}
+	}
+}
+
+// clockStepDetector notices the system clock being stepped, as a change in
+// the difference between the wall and the monotonic clocks.
+type clockStepDetector struct {
+	start time.Time
+	skew  time.Duration
+}
+
+func newClockStepDetector() *clockStepDetector {
+	return &clockStepDetector{start: time.Now()}
+}
+
+// check returns how far the clock was stepped since the last check, or 0
+// when it moved by less than a second (slewed by NTP).
+func (d *clockStepDetector) check() time.Duration {
+	now := time.Now()
+	skew := now.Round(0).Sub(d.start.Round(0)) - now.Sub(d.start)
+	jump := skew - d.skew
+	if jump > -time.Second && jump < time.Second {
+		return 0
+	}
+	d.skew = skew
+	return jump.Round(time.Millisecond)
+}
+
+// --- Handlers: /scenarios ---
+
+// handleScenarioStart defines (or replaces) a scenario and starts it.
+func handleScenarioStart(w http.ResponseWriter, r *http.Request) {
+	s := &Scenario{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid scenario JSON: %v", err), 400)
+		return
+	}
+	if err := s.validate(); err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	if s.Peer != "" {
+		if err := s.startOnPeer(r.Context()); err != nil {
+			respondWithError(w, err.Error(), 502)
+			return
+		}
+	}
+	sched.mu.Lock()
+	scenarios[s.Name] = s
+	sched.mu.Unlock()
+	sched.Start("scenario:"+s.Name, "scenario", "", s.run)
+	respondWithJSON(w, http.StatusOK, s)
+}
+
+// handleScenarioList returns the defined scenarios and whether they run.
+func handleScenarioList(w http.ResponseWriter, r *http.Request) {
+	type scenarioStatus struct {
+		*Scenario
+		Running bool `json:"running"`
+	}
+	list := map[string]scenarioStatus{}
+	sched.mu.Lock()
+	for name, s := range scenarios {
+		_, running := sched.jobs["scenario:"+name]
+		list[name] = scenarioStatus{Scenario: s, Running: running}
+	}
+	sched.mu.Unlock()
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleScenarioStop stops a running scenario, keeping its current state.
+func handleScenarioStop(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	sched.mu.Lock()
+	s := scenarios[name]
+	sched.mu.Unlock()
+	if s != nil && s.Peer != "" {
+		if err := s.stopOnPeer(r.Context()); err != nil {
+			log.Printf("[WARN] SCENARIO: %s: failed to stop on peer %s: %v", name, s.Peer, err)
+		}
+	}
+	if !sched.Stop("scenario:" + name) {
+		respondWithError(w, fmt.Sprintf("no scenario '%s' running", name), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// --- Two-Box Scenarios ---
+
+// ScenarioSync describes how a two-box scenario was synchronized.
+type ScenarioSync struct {
+	PeerOffsetMs  float64  `json:"peerOffsetMs"`  // peer clock - our clock
+	UncertaintyMs float64  `json:"uncertaintyMs"` // half the best round trip
+	LeadMs        float64  `json:"leadMs"`        // delay before the first step
+	Notes         []string `json:"notes,omitempty"`
+}
+
+// clockSamples is how many round trips are used to estimate the offset.
+const clockSamples = 5
+
+// minScenarioLead leaves both boxes time to receive the scenario.
+const minScenarioLead = 2 * time.Second
+
+// peerClient is used for box-to-box calls.
+var peerClient = &http.Client{Timeout: 5 * time.Second}
+
+// peerRequest calls the API of peer, a registered fleet member, with the
+// FLEET_TOKEN bearer token (if configured), and decodes the JSON response
+// into out (if not nil).
+func peerRequest(ctx context.Context, method, peer, path string, body, out interface{}) error {
+	member, err := fleetPeer(peer)
+	if err != nil {
+		return err
+	}
+	var payload []byte
+	if body != nil {
+		if payload, err = json.Marshal(body); err != nil {
+			return err
+		}
+	}
+	endpoint := strings.TrimRight(member.APIURL, "/") + fmt.Sprintf("/tc/api/%s%s", apiVersion, path)
+	req, err := http.NewRequestWithContext(ctx, method, endpoint, bytes.NewReader(payload))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if token := secret("FLEET_TOKEN"); token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		apiErr := struct {
+			Message string `json:"message"`
+		}{}
+		json.NewDecoder(resp.Body).Decode(&apiErr)
+		return fmt.Errorf("%s %s: %s %s", method, endpoint, resp.Status, apiErr.Message)
+	}
+	if out != nil {
+		return json.NewDecoder(resp.Body).Decode(out)
+	}
+	return nil
+}
+
+// measurePeerClock estimates the offset of the peer's clock from ours, NTP
+// style: the sample with the shortest round trip wins, and the offset is
+// accurate to half of that round trip.
+func measurePeerClock(ctx context.Context, peer string) (offset, uncertainty time.Duration, err error) {
+	best := time.Duration(-1)
+	for i := 0; i < clockSamples; i++ {
+		var clock struct {
+			UnixNano int64 `json:"unixNano"`
+		}
+		t0 := time.Now()
+		if err := peerRequest(ctx, http.MethodGet, peer, "/scenarios/clock", nil, &clock); err != nil {
+			return 0, 0, err
+		}
+		rtt := time.Since(t0)
+		if best < 0 || rtt < best {
+			best = rtt
+			offset = time.Unix(0, clock.UnixNano).Sub(t0.Add(rtt / 2))
+		}
+	}
+	return offset, best / 2, nil
+}
+
+// peerScenario is the part of s that the peer runs.
+func (s *Scenario) peerScenario(startAt time.Time) *Scenario {
+	hostname, _ := os.Hostname()
+	at := TcTime(startAt)
+	peer := &Scenario{Name: s.Name, Loop: s.Loop, StartAt: &at, CoordinatedBy: hostname, Clock: s.Clock}
+	for _, step := range s.Steps {
+		peer.Steps = append(peer.Steps, ScenarioStep{
+			Name:     step.Name,
+			Duration: step.Duration,
+			Rules:    step.PeerRules,
+			Resets:   step.PeerResets,
+		})
+	}
+	return peer
+}
+
+// startOnPeer synchronizes with the peer's clock, picks a common start time
+// and starts the peer's part of the scenario. s.StartAt is set to the start
+// time on our clock.
+func (s *Scenario) startOnPeer(ctx context.Context) error {
+	offset, uncertainty, err := measurePeerClock(ctx, s.Peer)
+	if err != nil {
+		return fmt.Errorf("scenario: peer %s unreachable: %w", s.Peer, err)
+	}
+	lead := max(minScenarioLead, 8*uncertainty)
+	sync := &ScenarioSync{
+		PeerOffsetMs:  float64(offset) / float64(time.Millisecond),
+		UncertaintyMs: float64(uncertainty) / float64(time.Millisecond),
+		LeadMs:        float64(lead) / float64(time.Millisecond),
+	}
+	if offset > time.Second || offset < -time.Second {
+		sync.Notes = append(sync.Notes, "the clocks differ by more than 1s: compensated, but check NTP on both boxes")
+	}
+	if s.Clock == "wall" && !clockSynced() {
+		sync.Notes = append(sync.Notes, "this box's clock is not synchronized (NTP): a clock step moves its steps away from the peer's")
+	}
+	if uncertainty > 50*time.Millisecond {
+		sync.Notes = append(sync.Notes, fmt.Sprintf("steps may be up to %v apart on the two boxes (slow control path)", uncertainty.Round(time.Millisecond)))
+	}
+
+	start := time.Now().Add(lead)
+	if err := peerRequest(ctx, http.MethodPost, s.Peer, "/scenarios", s.peerScenario(start.Add(offset)), nil); err != nil {
+		return fmt.Errorf("scenario: failed to start on peer: %w", err)
+	}
+	at := TcTime(start)
+	s.StartAt, s.Sync = &at, sync
+	log.Printf("[INFO] SCENARIO: %s: started on peer %s (offset %.1fms +/- %.1fms), first step at %v",
+		s.Name, s.Peer, sync.PeerOffsetMs, sync.UncertaintyMs, at)
+	return nil
+}
+
+// stopOnPeer stops the peer's part of the scenario.
+func (s *Scenario) stopOnPeer(ctx context.Context) error {
+	return peerRequest(ctx, http.MethodDelete, s.Peer, "/scenarios/"+url.PathEscape(s.Name), nil, nil)
+}
+
+// --- Handler: /scenarios/clock ---
+
+// handleScenarioClock returns this box's wall clock, for peers estimating
+// the offset between the two boxes.
+func handleScenarioClock(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, map[string]int64{"unixNano": time.Now().UnixNano()})
+}
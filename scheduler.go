@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --- Scheduler ---
+
+// ScheduledJob describes a background job that drives rules over time
+// (e.g. a time-of-day curve).
+type ScheduledJob struct {
+	Name    string `json:"name"`
+	Kind    string `json:"kind"`
+	Iface   string `json:"iface"`
+	Started TcTime `json:"started"`
+
+	cancel context.CancelFunc
+}
+
+// scheduler runs named jobs, at most one per name. Starting a job with an
+// existing name replaces it.
+type scheduler struct {
+	mu   sync.Mutex
+	ctx  context.Context
+	jobs map[string]*ScheduledJob
+}
+
+// sched is the process-wide scheduler. Its context is set at startup.
+var sched = &scheduler{ctx: context.Background(), jobs: map[string]*ScheduledJob{}}
+
+// SetContext sets the parent context of all jobs (cancelled on shutdown).
+func (s *scheduler) SetContext(ctx context.Context) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.ctx = ctx
+}
+
+// Start runs fn in the background as job name, replacing any previous job
+// with the same name. fn must return when its context is cancelled.
+func (s *scheduler) Start(name, kind, iface string, fn func(ctx context.Context)) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if old, ok := s.jobs[name]; ok {
+		old.cancel()
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	job := &ScheduledJob{Name: name, Kind: kind, Iface: iface, Started: TcTime(time.Now()), cancel: cancel}
+	s.jobs[name] = job
+	log.Printf("[INFO] SCHEDULER: Started %s job %q on %s", kind, name, iface)
+
+	go func() {
+		fn(ctx)
+		s.mu.Lock()
+		if s.jobs[name] == job {
+			delete(s.jobs, name)
+		}
+		s.mu.Unlock()
+	}()
+}
+
+// Stop cancels job name and reports whether it was running.
+func (s *scheduler) Stop(name string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	job, ok := s.jobs[name]
+	if !ok {
+		return false
+	}
+	job.cancel()
+	delete(s.jobs, name)
+	log.Printf("[INFO] SCHEDULER: Stopped %s job %q", job.Kind, name)
+	return true
+}
+
+// StopIface cancels every job driving iface, so an explicit setup/reset
+// always wins over a running schedule.
+func (s *scheduler) StopIface(iface string) {
+	for _, job := range s.List() {
+		if job.Iface == iface {
+			s.Stop(job.Name)
+		}
+	}
+}
+
+// StopAll cancels every job.
+func (s *scheduler) StopAll() {
+	for _, job := range s.List() {
+		s.Stop(job.Name)
+	}
+}
+
+// List returns a snapshot of the running jobs, sorted by name.
+func (s *scheduler) List() []*ScheduledJob {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs := make([]*ScheduledJob, 0, len(s.jobs))
+	for _, job := range s.jobs {
+		j := *job
+		jobs = append(jobs, &j)
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].Name < jobs[j].Name })
+	return jobs
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"log"
+	"math/rand"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// --- Reproducible Randomness ---
+
+// netemSeedSupported reports whether tc can set the seed of netem's PRNG
+// (recent iproute2 and kernels). Detected at startup.
+var netemSeedSupported bool
+
+// chaosSeed seeds the randomness the server makes up itself: L7 fault
+// jitter and errors, packet truncation, satellite fades and random-walk
+// oscillations. CHAOS_SEED sets it (and then also seeds the netem rules
+// without their own 'seed'); otherwise it is random. Either way it is
+// reported by /capabilities, so a run can be repeated.
+var chaosSeed int64
+
+// chaosSeedSet reports whether CHAOS_SEED was set.
+var chaosSeedSet bool
+
+// chaosRand is the PRNG seeded with chaosSeed (rand.Rand is not safe for
+// concurrent use).
+var chaosRand struct {
+	sync.Mutex
+	r *rand.Rand
+}
+
+// netemSeedPattern finds the seed in the 'tc qdisc show' line of a netem.
+var netemSeedPattern = regexp.MustCompile(`\bseed (\d+)`)
+
+// configureRandomness seeds the chaos PRNG from CHAOS_SEED (or at random)
+// and detects netem seed support.
+func configureRandomness(ctx context.Context) error {
+	chaosSeed = rand.Int63()
+	if s := os.Getenv("CHAOS_SEED"); s != "" {
+		v, err := strconv.ParseInt(s, 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid CHAOS_SEED %q (a decimal integer)", s)
+		}
+		chaosSeed, chaosSeedSet = v, true
+	}
+	chaosRand.r = rand.New(rand.NewSource(chaosSeed))
+
+	if !isDarwin {
+		// (tc lists the netem options, then fails: the output is what matters)
+		out, _ := command(ctx, "tc", "qdisc", "add", "dev", "lo", "root", "netem", "help").CombinedOutput()
+		netemSeedSupported = bytes.Contains(out, []byte("seed"))
+	}
+	log.Printf("[INFO] Chaos seed: %d (netem seeds supported: %v)", chaosSeed, netemSeedSupported)
+	return nil
+}
+
+// chaosFloat64 returns a number in [0, 1) from the chaos PRNG.
+func chaosFloat64() float64 {
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+	return chaosRand.r.Float64()
+}
+
+// chaosInt63n returns a number in [0, n) from the chaos PRNG.
+func chaosInt63n(n int64) int64 {
+	chaosRand.Lock()
+	defer chaosRand.Unlock()
+	return chaosRand.r.Int63n(n)
+}
+
+// chaosIntn returns a number in [0, n) from the chaos PRNG.
+func chaosIntn(n int) int {
+	return int(chaosInt63n(int64(n)))
+}
+
+// netemSeed returns the netem PRNG seed of the rule: its own 'seed', else
+// CHAOS_SEED when set and supported, else none (netem picks one).
+func (v *V4NetworkOptions) netemSeed() string {
+	if v.Seed != "" {
+		return v.Seed
+	}
+	if chaosSeedSet && netemSeedSupported {
+		return strconv.FormatUint(uint64(chaosSeed), 10)
+	}
+	return ""
+}
+
+// validateSeed checks the 'seed' of the rule: a decimal 64-bit number, on a
+// rule with netem parameters, where tc supports it.
+func (v *V4NetworkOptions) validateSeed() error {
+	if v.Seed == "" {
+		return nil
+	}
+	if _, err := strconv.ParseUint(v.Seed, 10, 64); err != nil {
+		return msg("rule.invalidSeed", v.Seed)
+	}
+	if _, hasNetem := v.netemParams(); !hasNetem {
+		return msg("rule.requires", "seed", "delay, loss, corrupt, duplicate or reorder")
+	}
+	if !netemSeedSupported && !isDarwin {
+		return msg("rule.seedUnsupported")
+	}
+	return nil
+}
+
+// appliedNetemSeed returns the seed the kernel reports for the netem qdisc
+// of dev: the rule's, or the one netem picked. It is empty when the kernel
+// does not report seeds.
+func appliedNetemSeed(ctx context.Context, dev string) string {
+	out, err := runTCOutput(ctx, "qdisc", "show", "dev", dev)
+	if err != nil {
+		return ""
+	}
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.Contains(line, "netem "+netemHandle) {
+			continue
+		}
+		if m := netemSeedPattern.FindStringSubmatch(line); m != nil {
+			return m[1]
+		}
+	}
+	return ""
+}
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// --- Traffic Selectors ---
+// (Replaces tcset --src-network, --dst-port, --exclude-dst-network & co)
+
+// u32Match is the match arguments of a u32 filter for IPv4 and IPv6
+// packets. A family is skipped when its flag is false (e.g. for an IPv4
+// network).
+type u32Match struct {
+	ip, ip6       []string
+	hasIP, hasIP6 bool
+}
+
+// and combines two matches: packets must match both.
+func (m u32Match) and(o u32Match) u32Match {
+	return u32Match{
+		ip:     append(append([]string{}, m.ip...), o.ip...),
+		ip6:    append(append([]string{}, m.ip6...), o.ip6...),
+		hasIP:  m.hasIP && o.hasIP,
+		hasIP6: m.hasIP6 && o.hasIP6,
+	}
+}
+
+// anyPacket matches every packet of both families.
+var anyPacket = u32Match{hasIP: true, hasIP6: true}
+
+// networkMatch matches the src or dst address against an IP or CIDR.
+func networkMatch(param, field, value string) (u32Match, error) {
+	_, network, err := net.ParseCIDR(value)
+	if err != nil {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return u32Match{}, msg("rule.invalidNetwork", param, value)
+		}
+		bits := 128
+		if ip.To4() != nil {
+			ip, bits = ip.To4(), 32
+		}
+		network = &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)}
+	}
+	if network.IP.To4() != nil {
+		return u32Match{ip: []string{"match", "ip", field, network.String()}, hasIP: true}, nil
+	}
+	return u32Match{ip6: []string{"match", "ip6", field, network.String()}, hasIP6: true}, nil
+}
+
+// portMatch matches the src or dst port (TCP, UDP, SCTP).
+func portMatch(param, field, value string) (u32Match, error) {
+	port, err := strconv.Atoi(value)
+	if err != nil || port < 1 || port > 65535 {
+		return u32Match{}, msg("rule.invalidPort", param, value)
+	}
+	return u32Match{
+		ip:     []string{"match", "ip", field + "port", strconv.Itoa(port), "0xffff"},
+		ip6:    []string{"match", "ip6", field + "port", strconv.Itoa(port), "0xffff"},
+		hasIP:  true,
+		hasIP6: true,
+	}, nil
+}
+
+// targeted reports whether the rule only impairs the traffic matching
+// SrcNetwork, DstNetwork, SrcPort or DstPort.
+func (v *V4NetworkOptions) targeted() bool {
+	return v.SrcNetwork != "" || v.DstNetwork != "" || v.SrcPort != "" || v.DstPort != ""
+}
+
+// hasSelectors reports whether the rule has selectors or exclusions.
+func (v *V4NetworkOptions) hasSelectors() bool {
+	return v.targeted() || v.ExcludeSrcNetwork != "" || v.ExcludeDstNetwork != "" || v.ExcludeSrcPort != "" || v.ExcludeDstPort != ""
+}
+
+// selectorKey identifies the selectors, to tell whether they changed.
+func (v *V4NetworkOptions) selectorKey() string {
+	return strings.Join([]string{v.SrcNetwork, v.DstNetwork, v.SrcPort, v.DstPort,
+		v.ExcludeSrcNetwork, v.ExcludeDstNetwork, v.ExcludeSrcPort, v.ExcludeDstPort}, "|")
+}
+
+// selectorMatches parses the selectors into the match of the targeted
+// traffic (nil when the rule is not targeted) and one match per exclusion.
+func (v *V4NetworkOptions) selectorMatches() (target *u32Match, excludes []u32Match, err error) {
+	if v.targeted() {
+		m := anyPacket
+		for _, s := range []struct {
+			param, field, value string
+			parse               func(param, field, value string) (u32Match, error)
+		}{
+			{"srcNetwork", "src", v.SrcNetwork, networkMatch},
+			{"dstNetwork", "dst", v.DstNetwork, networkMatch},
+			{"srcPort", "s", v.SrcPort, portMatch},
+			{"dstPort", "d", v.DstPort, portMatch},
+		} {
+			if s.value == "" {
+				continue
+			}
+			sm, err := s.parse(s.param, s.field, s.value)
+			if err != nil {
+				return nil, nil, err
+			}
+			m = m.and(sm)
+		}
+		if !m.hasIP && !m.hasIP6 {
+			return nil, nil, msg("rule.selectorFamilies")
+		}
+		target = &m
+	}
+	for _, s := range []struct {
+		param, field, values string
+		parse                func(param, field, value string) (u32Match, error)
+	}{
+		{"excludeSrcNetwork", "src", v.ExcludeSrcNetwork, networkMatch},
+		{"excludeDstNetwork", "dst", v.ExcludeDstNetwork, networkMatch},
+		{"excludeSrcPort", "s", v.ExcludeSrcPort, portMatch},
+		{"excludeDstPort", "d", v.ExcludeDstPort, portMatch},
+	} {
+		for _, value := range strings.Split(s.values, ",") {
+			if value = strings.TrimSpace(value); value == "" {
+				continue
+			}
+			m, err := s.parse(s.param, s.field, value)
+			if err != nil {
+				return nil, nil, err
+			}
+			excludes = append(excludes, m)
+		}
+	}
+	return target, excludes, nil
+}
+
+// validateSelectors rejects selectors on trees that cannot tell flows apart.
+func (v *V4NetworkOptions) validateSelectors(shape string, policing bool) error {
+	if !v.hasSelectors() {
+		return nil
+	}
+	if _, _, err := v.selectorMatches(); err != nil {
+		return err
+	}
+	switch {
+	case policing:
+		return msg("rule.selectorsIncompatible", "ingressMode=police")
+	case v.PreserveMQ == "true":
+		return msg("rule.selectorsIncompatible", "preserveMq=true")
+	case shape == "netem":
+		return msg("rule.selectorsIncompatible", "tree=netem")
+	}
+	return nil
+}
+
+// addSelectorFilters adds the selector filters of the rule to the root
+// qdisc 1: of dev: exclusions (Prio 2, IPv6 3) to the unimpaired class, with
+// flow sampling the flows outside the sample's first buckets (Prio 4) as
+// well, the targeted traffic (Prio 5, IPv6 6) to the impaired class, and
+// everything else (Prio 7) to the unimpaired class, or to the impaired one
+// when the rule has no targets. The kernel allows one protocol per priority.
+func (v *V4NetworkOptions) addSelectorFilters(ctx context.Context, dev, impaired, unimpaired string, sample int) error {
+	target, excludes, err := v.selectorMatches()
+	if err != nil {
+		return err
+	}
+	for _, m := range excludes {
+		if err := addMatchFilter(ctx, dev, "2", "3", m, unimpaired); err != nil {
+			return fmt.Errorf("V4: failed to add exclusion filter: %w", err)
+		}
+	}
+	if sample != 0 {
+		if err := runTC(ctx, v.sampleFilter("add", dev, sample)...); err != nil {
+			return fmt.Errorf("V4: failed to add flow sampling filter: %w", err)
+		}
+	}
+	rest := impaired
+	if target != nil {
+		if err := addMatchFilter(ctx, dev, "5", "6", *target, impaired); err != nil {
+			return fmt.Errorf("V4: failed to add selector filter: %w", err)
+		}
+		rest = unimpaired
+	}
+	if err := runTC(ctx, "filter", "add", "dev", dev, "protocol", "all", "parent", rootHandle, "prio", "7",
+		"u32", "match", "u32", "0", "0",
+		"flowid", rest); err != nil {
+		return fmt.Errorf("V4: failed to add default filter: %w", err)
+	}
+	return nil
+}
+
+// addMatchFilter adds the u32 filter(s) of m to dev, at prio for IPv4 and
+// prio6 for IPv6 packets. The IPv6 filter is skipped on hosts without IPv6,
+// and its failure is non-fatal, unless m only matches IPv6 packets.
+func addMatchFilter(ctx context.Context, dev, prio, prio6 string, m u32Match, flowid string) error {
+	if m.hasIP {
+		args := append([]string{"filter", "add", "dev", dev, "protocol", "ip", "parent", rootHandle, "prio", prio, "u32"}, m.ip...)
+		if err := runTC(ctx, append(args, "flowid", flowid)...); err != nil {
+			return err
+		}
+	}
+	if m.hasIP6 && (hasIPv6 || !m.hasIP) {
+		args := append([]string{"filter", "add", "dev", dev, "protocol", "ipv6", "parent", rootHandle, "prio", prio6, "u32"}, m.ip6...)
+		if err := runTC(ctx, append(args, "flowid", flowid)...); err != nil {
+			if !m.hasIP {
+				return err
+			}
+			log.Printf("[WARN] V4: Failed to add selector filter (IPv6). This is non-fatal. Error: %v", err)
+		}
+	}
+	return nil
+}
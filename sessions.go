@@ -0,0 +1,193 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math/rand"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --- Multi-User Sessions ---
+
+// Actor identifies who changed a rule.
+type Actor struct {
+	Source  string `json:"source"`            // "api", "ui", "curve", "scenario", "reset-all"
+	User    string `json:"user,omitempty"`    // X-Netsim-User, or the client address
+	Session string `json:"session,omitempty"` // UI session id (X-Netsim-Session)
+}
+
+func (a Actor) String() string {
+	if a.User != "" {
+		return fmt.Sprintf("%s (%s)", a.User, a.Source)
+	}
+	return a.Source
+}
+
+// actorFromRequest returns the actor of an API call. The UI sends its
+// session id and (optional) user name as headers; other clients are
+// identified by their address.
+func actorFromRequest(r *http.Request) Actor {
+	a := Actor{Source: "api", User: r.Header.Get("X-Netsim-User"), Session: r.Header.Get("X-Netsim-Session")}
+	if a.Session != "" {
+		a.Source = "ui"
+	}
+	if a.User == "" {
+		a.User = r.RemoteAddr
+	}
+	return a
+}
+
+// RuleEvent is sent to the UI sessions when a rule changes.
+type RuleEvent struct {
+	Action   string `json:"action"` // "set" or "reset"
+	Iface    string `json:"iface"`
+	RuleID   string `json:"ruleId"`
+	Revision uint64 `json:"revision"`
+	By       Actor  `json:"by"`
+	At       TcTime `json:"at"`
+}
+
+// uiSession is a connected UI (one SSE stream).
+type uiSession struct {
+	ID         string `json:"id"`
+	User       string `json:"user,omitempty"`
+	Viewing    string `json:"viewing,omitempty"`
+	RemoteAddr string `json:"remoteAddr"`
+	Connected  TcTime `json:"connected"`
+
+	events chan RuleEvent
+}
+
+type sessionRegistry struct {
+	mu       sync.Mutex
+	sessions map[string]*uiSession
+}
+
+// sessions is the process-wide registry of connected UIs.
+var sessions = &sessionRegistry{sessions: map[string]*uiSession{}}
+
+// publish sends ev to every session except the one that caused it. Slow
+// sessions miss events rather than blocking rule changes.
+func (s *sessionRegistry) publish(ev RuleEvent) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for id, sess := range s.sessions {
+		if id == ev.By.Session {
+			continue
+		}
+		select {
+		case sess.events <- ev:
+		default:
+			log.Printf("[WARN] SESSIONS: Dropped event for slow session %s", id)
+		}
+	}
+}
+
+// viewers returns the sessions (other than self) viewing iface.
+func (s *sessionRegistry) viewers(iface, self string) []*uiSession {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var list []*uiSession
+	for id, sess := range s.sessions {
+		if id != self && sess.Viewing == iface {
+			list = append(list, sess)
+		}
+	}
+	return list
+}
+
+// --- Handlers: /sessions ---
+
+// handleSessionEvents registers a UI session and streams rule changes as
+// Server-Sent Events: "warning" for the interface the session is viewing,
+// "change" for the others. The stream ends with the request timeout; the
+// browser's EventSource reconnects with the same session id.
+func handleSessionEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		respondWithError(w, "streaming not supported", 500)
+		return
+	}
+	q := r.URL.Query()
+	sess := &uiSession{
+		ID:         q.Get("session"),
+		User:       q.Get("user"),
+		Viewing:    q.Get("iface"),
+		RemoteAddr: r.RemoteAddr,
+		Connected:  TcTime(time.Now()),
+		events:     make(chan RuleEvent, 16),
+	}
+	if sess.ID == "" {
+		sess.ID = fmt.Sprintf("%016x", rand.Uint64())
+	}
+
+	sessions.mu.Lock()
+	sessions.sessions[sess.ID] = sess
+	sessions.mu.Unlock()
+	defer func() {
+		sessions.mu.Lock()
+		if sessions.sessions[sess.ID] == sess {
+			delete(sessions.sessions, sess.ID)
+		}
+		sessions.mu.Unlock()
+	}()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprintf(w, "retry: 2000\nevent: hello\ndata: {\"session\":%q}\n\n", sess.ID)
+	flusher.Flush()
+
+	keepalive := time.NewTicker(20 * time.Second)
+	defer keepalive.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepalive.C:
+			fmt.Fprint(w, ": keepalive\n\n")
+		case ev := <-sess.events:
+			kind := "change"
+			sessions.mu.Lock()
+			if ev.Iface == sess.Viewing {
+				kind = "warning"
+			}
+			sessions.mu.Unlock()
+			data, _ := json.Marshal(ev)
+			fmt.Fprintf(w, "event: %s\ndata: %s\n\n", kind, data)
+		}
+		flusher.Flush()
+	}
+}
+
+// handleSessionView records which interface a session is viewing.
+func handleSessionView(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	sessions.mu.Lock()
+	sess, ok := sessions.sessions[q.Get("session")]
+	if ok {
+		sess.Viewing = q.Get("iface")
+	}
+	sessions.mu.Unlock()
+	if !ok {
+		respondWithError(w, fmt.Sprintf("unknown session '%s'", q.Get("session")), 404)
+		return
+	}
+	others := sessions.viewers(q.Get("iface"), sess.ID)
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"otherViewers": others})
+}
+
+// handleSessionList returns the connected UI sessions.
+func handleSessionList(w http.ResponseWriter, r *http.Request) {
+	sessions.mu.Lock()
+	list := make([]uiSession, 0, len(sessions.sessions))
+	for _, sess := range sessions.sessions {
+		list = append(list, *sess)
+	}
+	sessions.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	respondWithJSON(w, http.StatusOK, list)
+}
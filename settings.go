@@ -0,0 +1,324 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Settings ---
+
+// Some options of the environment can be changed at runtime through the
+// API: the extra protected ports, the endpoint groups, the gateway mode,
+// feature toggles and the auth tokens. A setting changed through the API
+// overrides its variable until it is removed, and is kept with the desired
+// state (STATE_FILE, or the handoff of a restart), so it survives
+// restarts. Changing one needs ADMIN_TOKEN; reads mask the tokens, and
+// every change is audited.
+
+// Setting is the value of a setting changed through the API.
+type Setting struct {
+	Value     string    `json:"value"`
+	ChangedAt time.Time `json:"changedAt"`
+	ChangedBy Actor     `json:"changedBy"`
+}
+
+// settingDef is a setting the API can change.
+type settingDef struct {
+	description string
+	secret      bool
+	values      []string                                      // the allowed values, when there is a fixed set
+	validate    func(value string) error                      // nil: any value
+	apply       func(ctx context.Context, value string) error // nil: read where it is used
+}
+
+var boolValues = []string{"true", "false"}
+
+// settingDefs are the settings the API can change, by variable name.
+var settingDefs = map[string]*settingDef{
+	"PROTECTED_PORTS": {
+		description: "Extra ports every rule keeps unimpaired (comma-separated); rules applied before keep their filters until re-applied",
+		validate:    func(value string) error { _, err := parseProtectedPorts(value); return err },
+		apply:       func(ctx context.Context, value string) error { return setExtraProtectedPorts(value) },
+	},
+	"DISABLE_ENDPOINTS": {
+		description: "Endpoint groups turned off (comma-separated); groups locked at build time stay off",
+		validate:    validateDisabledEndpoints,
+		apply:       func(ctx context.Context, value string) error { return configureEndpointGroups() },
+	},
+	"DEFAULT_GATEWAY_MODE": {
+		description: "Default Gateway Mode; enabled right away, turning it off takes a restart",
+		values:      boolValues,
+		apply:       applyGatewayMode,
+	},
+	"RECONFIGURE_FIREWALL": {
+		description: "Disable ufw when the Default Gateway Mode is enabled",
+		values:      boolValues,
+	},
+	"EXCLUDE_CLIENT": {
+		description: "Exclude the caller's IP from every rule that can use selectors",
+		values:      boolValues,
+	},
+	"REQUIRE_IF_MATCH": {
+		description: "Reject mutating calls without If-Match",
+		values:      boolValues,
+	},
+	"TC_BATCH": {
+		description: "Run the tc commands of a setup with one 'tc -batch'",
+		values:      boolValues,
+	},
+	"SHADOW_APPLY": {
+		description: "Apply every setup in a scratch namespace first (shadow=true)",
+		values:      boolValues,
+		validate:    validateShadowApply,
+	},
+	"INGRESS_MODE": {
+		description: "Default mode of incoming rules",
+		values:      []string{"ifb", "police"},
+	},
+	"ADMIN_TOKEN": {
+		description: "Bearer token of the admin endpoints (restarter, settings)",
+		secret:      true,
+		validate: func(value string) error {
+			if value == "" {
+				return fmt.Errorf("settings: ADMIN_TOKEN cannot be empty (it would lock the settings)")
+			}
+			return nil
+		},
+	},
+	"FLEET_TOKEN": {
+		description: "Bearer token between fleet agents and the controller",
+		secret:      true,
+	},
+	"VIEW_TOKEN": {
+		description: "Token of the read-only view (VIEW_LISTEN); empty leaves it open",
+		secret:      true,
+	},
+}
+
+// validateDisabledEndpoints checks a DISABLE_ENDPOINTS list. The settings
+// group cannot be disabled through itself.
+func validateDisabledEndpoints(value string) error {
+	groups, err := parseEndpointGroups(value)
+	if err != nil {
+		return err
+	}
+	if groups["settings"] {
+		return fmt.Errorf("settings: the 'settings' group cannot be disabled through the API (set DISABLE_ENDPOINTS)")
+	}
+	return nil
+}
+
+// validateShadowApply refuses SHADOW_APPLY=true when this process cannot
+// create the scratch namespaces (CAP_SYS_ADMIN dropped at startup).
+func validateShadowApply(value string) error {
+	if value != "true" || isDarwin {
+		return nil
+	}
+	if err := privilegedFeatureAvailable("shadow"); err != nil {
+		return fmt.Errorf("settings: %w", err)
+	}
+	return nil
+}
+
+// applyGatewayMode enables the Default Gateway Mode when it is turned on.
+func applyGatewayMode(ctx context.Context, value string) error {
+	if value != "true" || isDarwin {
+		return nil
+	}
+	if groupDisabled("gateway") {
+		return fmt.Errorf("settings: the 'gateway' group is disabled (DISABLE_ENDPOINTS)")
+	}
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if gateway.enabled {
+		return nil
+	}
+	return enableGatewayMode(ctx)
+}
+
+// setting returns the value of a setting: changed through the API, else
+// from the environment.
+func setting(name string) string {
+	if s := store.Setting(name); s != nil {
+		return s.Value
+	}
+	return os.Getenv(name)
+}
+
+// loadSettings reads the settings kept with the desired state, before the
+// startup configuration uses them: STATE_FILE, or the handoff of a
+// restart.
+func loadSettings() error {
+	path := os.Getenv("STATE_FILE")
+	if path == "" {
+		if path = handoffPath; path == "" {
+			return nil
+		}
+		if err := checkHandoff(path); err != nil {
+			return err
+		}
+	}
+	return store.LoadSettings(path)
+}
+
+// SettingView is a setting as the API shows it.
+type SettingView struct {
+	Name        string     `json:"name"`
+	Description string     `json:"description"`
+	Value       string     `json:"value"`  // masked for secrets
+	Source      string     `json:"source"` // "api", "env", "file" (NAME_FILE) or "unset"
+	Secret      bool       `json:"secret,omitempty"`
+	Values      []string   `json:"values,omitempty"`
+	ChangedAt   *time.Time `json:"changedAt,omitempty"`
+	ChangedBy   *Actor     `json:"changedBy,omitempty"`
+}
+
+// maskSecret hides a secret value, keeping whether it is set.
+func maskSecret(value string) string {
+	if value == "" {
+		return ""
+	}
+	return "********"
+}
+
+// settingView returns the current state of a setting.
+func settingView(name string) *SettingView {
+	def := settingDefs[name]
+	v := &SettingView{Name: name, Description: def.description, Secret: def.secret, Values: def.values, Source: "unset"}
+	if s := store.Setting(name); s != nil {
+		v.Value, v.Source = s.Value, "api"
+		v.ChangedAt, v.ChangedBy = &s.ChangedAt, &s.ChangedBy
+	} else if def.secret && os.Getenv(name+"_FILE") != "" {
+		v.Value, v.Source = secret(name), "file"
+	} else if value, ok := os.LookupEnv(name); ok {
+		v.Value, v.Source = value, "env"
+	}
+	if def.secret {
+		v.Value = maskSecret(v.Value)
+	}
+	return v
+}
+
+// settingTarget returns the setting of a request, or answers 404.
+func settingTarget(w http.ResponseWriter, r *http.Request) (string, *settingDef, bool) {
+	name := chi.URLParam(r, "name")
+	def := settingDefs[name]
+	if def == nil {
+		respondWithError(w, fmt.Sprintf("settings: unknown setting '%s'", name), 404)
+		return "", nil, false
+	}
+	return name, def, true
+}
+
+// changeSetting records a setting (nil removes it) and applies its new
+// value; when it cannot be applied, the previous one is restored.
+func changeSetting(ctx context.Context, name string, s *Setting) error {
+	def := settingDefs[name]
+	prev := store.Setting(name)
+	if err := store.SetSetting(name, s); err != nil {
+		return err
+	}
+	if def.apply == nil {
+		return nil
+	}
+	if err := def.apply(ctx, setting(name)); err != nil {
+		if err := store.SetSetting(name, prev); err != nil {
+			log.Printf("[ERROR] SETTINGS: Failed to restore %s: %v", name, err)
+		}
+		return err
+	}
+	return nil
+}
+
+// --- Handlers: /settings ---
+
+// handleSettingList returns every setting the API can change.
+func handleSettingList(w http.ResponseWriter, r *http.Request) {
+	list := make([]*SettingView, 0, len(settingDefs))
+	for name := range settingDefs {
+		list = append(list, settingView(name))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleSettingGet returns one setting.
+func handleSettingGet(w http.ResponseWriter, r *http.Request) {
+	name, _, ok := settingTarget(w, r)
+	if !ok {
+		return
+	}
+	respondWithJSON(w, http.StatusOK, settingView(name))
+}
+
+// handleSettingSet changes a setting (body: {"value": "..."}).
+func handleSettingSet(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	name, def, ok := settingTarget(w, r)
+	if !ok {
+		return
+	}
+	var body struct {
+		Value *string `json:"value"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil || body.Value == nil {
+		respondWithError(w, `settings: the body must be {"value": "..."}`, 400)
+		return
+	}
+	value := strings.TrimSpace(*body.Value)
+	if def.values != nil && !slices.Contains(def.values, value) {
+		respondWithError(w, fmt.Sprintf("settings: invalid %s '%s' (%s)", name, value, strings.Join(def.values, ", ")), 400)
+		return
+	}
+	if def.validate != nil {
+		if err := def.validate(value); err != nil {
+			respondWithError(w, err.Error(), 400)
+			return
+		}
+	}
+	actor := actorFromRequest(r)
+	if err := changeSetting(r.Context(), name, &Setting{Value: value, ChangedAt: time.Now().UTC(), ChangedBy: actor}); err != nil {
+		respondWithError(w, fmt.Sprintf("settings: failed to apply %s: %v", name, err), 500)
+		return
+	}
+	if def.secret {
+		log.Printf("[AUDIT] SETTINGS: %s changed (secret) (by %s)", name, actor)
+	} else {
+		log.Printf("[AUDIT] SETTINGS: %s set to '%s' (by %s)", name, value, actor)
+	}
+	respondWithJSON(w, http.StatusOK, settingView(name))
+}
+
+// handleSettingDelete removes a setting changed through the API: the
+// environment's value is used again.
+func handleSettingDelete(w http.ResponseWriter, r *http.Request) {
+	if !requireAdmin(w, r) {
+		return
+	}
+	name, _, ok := settingTarget(w, r)
+	if !ok {
+		return
+	}
+	if store.Setting(name) == nil {
+		respondWithError(w, fmt.Sprintf("settings: %s was not changed through the API", name), 404)
+		return
+	}
+	if err := changeSetting(r.Context(), name, nil); err != nil {
+		respondWithError(w, fmt.Sprintf("settings: failed to apply %s: %v", name, err), 500)
+		return
+	}
+	log.Printf("[AUDIT] SETTINGS: %s reverted to the environment (by %s)", name, actorFromRequest(r))
+	respondWithJSON(w, http.StatusOK, settingView(name))
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// --- Partial Setup Failures ---
+
+// setupTracker follows the commands of a setup: those that succeeded, and
+// the one that failed.
+type setupTracker struct {
+	completed []string
+	failed    string // as the command's error starts ("tc [qdisc add ...]")
+	command   string // as it would be typed
+}
+
+type setupTrackerKey struct{}
+
+// trackCommand records a command of the setup running in ctx, if any.
+func trackCommand(ctx context.Context, name string, args []string, err error) {
+	t, ok := ctx.Value(setupTrackerKey{}).(*setupTracker)
+	if !ok {
+		return
+	}
+	command := name + " " + strings.Join(args, " ")
+	if err != nil {
+		t.failed, t.command = fmt.Sprintf("%s %v", name, args), command
+		return
+	}
+	t.completed = append(t.completed, command)
+}
+
+// SetupError is a setup that failed after it had changed the interface: the
+// step and command that failed, the commands that had succeeded, and how the
+// partial tree was rolled back. Its text is that of the failure.
+type SetupError struct {
+	Iface         string   `json:"iface"`
+	Direction     string   `json:"direction"`
+	Step          string   `json:"step"`              // e.g. "V4: failed to add 'slow' htb class"
+	Command       string   `json:"command,omitempty"` // the command that failed
+	Completed     []string `json:"completed"`
+	RolledBack    bool     `json:"rolledBack"` // the partial tree was removed
+	RollbackError string   `json:"rollbackError,omitempty"`
+	Restored      bool     `json:"restored"` // the previous rule of the direction is back in place
+	RestoreError  string   `json:"restoreError,omitempty"`
+
+	err error
+}
+
+func (e *SetupError) Error() string {
+	return e.err.Error()
+}
+
+func (e *SetupError) Unwrap() error {
+	return e.err
+}
+
+// rollback removes what a failed setup left on the interface. It runs even
+// when the request that asked for the setup is gone.
+func (v *V4NetworkOptions) rollback(ctx context.Context, t *setupTracker, err error) *SetupError {
+	e := &SetupError{Iface: v.Iface, Direction: v.Direction, Step: err.Error(), Command: t.command, Completed: t.completed, err: err}
+	if t.failed != "" {
+		e.Step, _, _ = strings.Cut(e.Step, ": "+t.failed)
+	}
+	if e.Completed == nil {
+		e.Completed = []string{}
+	}
+	log.Printf("[WARN] V4: Setup of %s failed at %q after %d command(s), rolling back", v.Iface, e.Step, len(t.completed))
+	ctx = context.WithoutCancel(ctx)
+	if cerr := cleanupDirection(ctx, v.Iface, v.Direction); cerr != nil {
+		e.RollbackError = cerr.Error()
+	} else if _, handle := rootQdisc(ctx, v.effectiveIface()); ownsHandle(handle) {
+		e.RollbackError = fmt.Sprintf("the %s root of '%s' could not be removed", handle, v.effectiveIface())
+	} else {
+		e.RolledBack = true
+	}
+	v.reattachMirror(ctx)
+	return e
+}
+
+// restorePrevious puts the rule the store holds for the interface and
+// direction of a failed setup back in place (the setup had removed it), or
+// forgets it when that fails too.
+func restorePrevious(ctx context.Context, e *SetupError) {
+	prev := store.Get(e.Iface, e.Direction)
+	if prev == nil {
+		return
+	}
+	opts := *prev.Options
+	if err := opts.Execute(context.WithoutCancel(ctx)); err != nil {
+		log.Printf("[ERROR] V4: Failed to restore the previous rule of %s: %v", e.Iface, err)
+		e.RestoreError = err.Error()
+		store.DeleteByID(prev.ID, Actor{Source: "rollback"})
+		return
+	}
+	e.Restored = true
+	log.Printf("[INFO] V4: Previous rule of %s restored", e.Iface)
+}
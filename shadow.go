@@ -0,0 +1,135 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// --- Shadow Apply ---
+
+// tc's syntax and the qdiscs the kernel has differ between distributions
+// (an older iproute2, a missing sch_* module, ...), and a refused command
+// leaves a real interface half-configured until the rollback. With
+// shadow=true (or SHADOW_APPLY=true) a setup first applies its rules in a
+// scratch network namespace, to stand-in devices with the same names and
+// number of transmit queues (dummy devices, or veth pairs without the
+// dummy module): the commands are the very same, run with 'tc -n' and
+// 'ip -n'. Only when the kernel accepted all of them are the real
+// interfaces touched. The namespace is removed right after. Creating it
+// needs CAP_SYS_ADMIN, kept when 'shadow' is in PRIVILEGED_FEATURES (or
+// SHADOW_APPLY=true at startup).
+
+// shadowNetnsPrefix names the scratch namespaces.
+const shadowNetnsPrefix = "netsim-shadow-"
+
+// shadowSeq numbers the scratch namespaces (plans run concurrently).
+var shadowSeq atomic.Uint64
+
+type shadowNetnsKey struct{}
+
+// shadowNetns returns the scratch namespace the tc and ip commands of ctx
+// run in, or "".
+func shadowNetns(ctx context.Context) string {
+	ns, _ := ctx.Value(shadowNetnsKey{}).(string)
+	return ns
+}
+
+// ShadowResult is how the kernel took the rule of one interface in the
+// scratch namespace.
+type ShadowResult struct {
+	Iface   string `json:"iface"`
+	OK      bool   `json:"ok"`
+	Step    string `json:"step,omitempty"`    // the step that failed
+	Command string `json:"command,omitempty"` // the command that was refused
+	Error   string `json:"error,omitempty"`
+}
+
+// shadowRequested reports whether a setup is shadow-applied first:
+// 'shadow', else SHADOW_APPLY.
+func shadowRequested(shadow string) bool {
+	if shadow != "" {
+		return shadow == "true"
+	}
+	return setting("SHADOW_APPLY") == "true"
+}
+
+// setupShadowNetns creates the namespace ns with a stand-in for every
+// interface of rules (and ifb0 for 'incoming' rules, when the host has it:
+// the setup only creates it when it is missing).
+func setupShadowNetns(ctx context.Context, ns string, rules []*V4NetworkOptions) error {
+	if err := runIP(ctx, "netns", "add", ns); err != nil {
+		return err
+	}
+	devices := map[string]bool{}
+	for _, opts := range rules {
+		if devices[opts.Iface] {
+			continue
+		}
+		devices[opts.Iface] = true
+		if isLoopback(opts.Iface) {
+			if err := runIP(ctx, "-n", ns, "link", "set", "lo", "up"); err != nil {
+				return err
+			}
+			continue
+		}
+		queues := strconv.Itoa(max(txQueues(opts.Iface), 1))
+		if err := runIP(ctx, "-n", ns, "link", "add", opts.Iface, "numtxqueues", queues, "type", "dummy"); err != nil {
+			peer := fmt.Sprintf("shadow%d", len(devices))
+			if err := runIP(ctx, "-n", ns, "link", "add", opts.Iface, "numtxqueues", queues, "type", "veth", "peer", "name", peer); err != nil {
+				return err
+			}
+			if err := runIP(ctx, "-n", ns, "link", "set", peer, "up"); err != nil {
+				return err
+			}
+		}
+		if err := runIP(ctx, "-n", ns, "link", "set", opts.Iface, "up"); err != nil {
+			return err
+		}
+		if _, err := net.InterfaceByName("ifb0"); err == nil && opts.Direction == "incoming" && !devices["ifb0"] {
+			devices["ifb0"] = true
+			if err := runIP(ctx, "-n", ns, "link", "add", "ifb0", "type", "ifb"); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// shadowApply applies copies of rules in a scratch namespace and returns
+// the result of each, and whether all were accepted. An error means the
+// namespace itself could not be set up.
+func shadowApply(ctx context.Context, lang string, rules []*V4NetworkOptions) ([]*ShadowResult, bool, error) {
+	if err := privilegedFeatureAvailable("shadow"); err != nil {
+		return nil, false, fmt.Errorf("shadow: %w", err)
+	}
+	ns := fmt.Sprintf("%s%d", shadowNetnsPrefix, shadowSeq.Add(1))
+	defer runIP(context.WithoutCancel(ctx), "netns", "del", ns)
+	if err := setupShadowNetns(ctx, ns, rules); err != nil {
+		return nil, false, fmt.Errorf("shadow: failed to set up the scratch namespace: %w", err)
+	}
+	nsCtx := context.WithValue(ctx, shadowNetnsKey{}, ns)
+	results := make([]*ShadowResult, 0, len(rules))
+	ok := true
+	for _, opts := range rules {
+		shadow := *opts
+		result := &ShadowResult{Iface: opts.Iface, OK: true}
+		if err := shadow.Execute(nsCtx); err != nil {
+			ok, result.OK = false, false
+			text, _ := localizeError(err, lang)
+			result.Error = strings.TrimSpace(text)
+			var partial *SetupError
+			if errors.As(err, &partial) {
+				result.Step, result.Command = partial.Step, partial.Command
+			}
+			log.Printf("[WARN] SHADOW: The kernel refused the rule of %s: %v", opts.Iface, err)
+		}
+		results = append(results, result)
+	}
+	return results, ok, nil
+}
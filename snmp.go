@@ -0,0 +1,507 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- SNMP Agent ---
+
+// The SNMP agent answers read-only SNMPv1/v2c requests (get, getnext,
+// getbulk) for the NETSIM-MIB (api/NETSIM-MIB.txt): a few scalars and a
+// table of the active rules with their qdisc counters, for lab monitoring
+// that only speaks SNMP. It is enabled by SNMP_LISTEN.
+//
+// The MIB lives under netSnmpPlaypen (NET-SNMP-MIB), the subtree set aside
+// for local experiments; SNMP_BASE_OID moves it, e.g. under an enterprise
+// number of your own.
+const snmpDefaultBaseOID = "1.3.6.1.4.1.8072.9999.9999.2023"
+
+// snmpCacheTTL is how long a snapshot of the MIB is reused: a walk sends
+// one request per object, and each snapshot runs tc per rule.
+const snmpCacheTTL = 5 * time.Second
+
+// snmpMaxVarBinds caps the variable bindings of a getbulk response.
+const snmpMaxVarBinds = 200
+
+// BER tags of the values and PDUs.
+const (
+	berInteger     = 0x02
+	berOctetString = 0x04
+	berNull        = 0x05
+	berOID         = 0x06
+	berSequence    = 0x30
+	berCounter32   = 0x41
+	berGauge32     = 0x42
+	berTimeTicks   = 0x43
+	berCounter64   = 0x46
+	berNoSuchObj   = 0x80
+	berNoSuchInst  = 0x81
+	berEndOfMib    = 0x82
+
+	pduGet      = 0xa0
+	pduGetNext  = 0xa1
+	pduResponse = 0xa2
+	pduSet      = 0xa3
+	pduGetBulk  = 0xa5
+)
+
+// SNMP error-status values.
+const (
+	snmpNoSuchName  = 2  // v1
+	snmpNotWritable = 17 // v2c
+)
+
+// snmpVar is an object of the MIB: its OID and BER-encoded value.
+type snmpVar struct {
+	oid   []uint32
+	value []byte
+}
+
+// snmpAgent is the process-wide agent.
+var snmpAgent struct {
+	sync.Mutex
+	base      []uint32
+	community string
+	snapshot  []snmpVar // sorted by OID
+	taken     time.Time
+}
+
+// configureSNMP reads SNMP_COMMUNITY and SNMP_BASE_OID, and returns false
+// when SNMP_LISTEN is not set.
+func configureSNMP() (bool, error) {
+	if os.Getenv("SNMP_LISTEN") == "" {
+		return false, nil
+	}
+	base := os.Getenv("SNMP_BASE_OID")
+	if base == "" {
+		base = snmpDefaultBaseOID
+	}
+	oid, err := parseOID(base)
+	if err != nil {
+		return false, fmt.Errorf("invalid SNMP_BASE_OID %q", base)
+	}
+	snmpAgent.base = oid
+	snmpAgent.community = os.Getenv("SNMP_COMMUNITY")
+	if snmpAgent.community == "" {
+		snmpAgent.community = "public"
+	}
+	return true, nil
+}
+
+// parseOID parses a dotted OID such as "1.3.6.1".
+func parseOID(s string) ([]uint32, error) {
+	var oid []uint32
+	for _, part := range strings.Split(strings.Trim(s, "."), ".") {
+		n, err := strconv.ParseUint(part, 10, 32)
+		if err != nil {
+			return nil, err
+		}
+		oid = append(oid, uint32(n))
+	}
+	if len(oid) < 2 || oid[0] > 2 {
+		return nil, fmt.Errorf("too short")
+	}
+	return oid, nil
+}
+
+// startSNMPAgent listens on addr (UDP) and answers until ctx is cancelled.
+func startSNMPAgent(ctx context.Context, addr string) error {
+	if !strings.Contains(addr, ":") {
+		addr = ":" + addr
+	}
+	conn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return fmt.Errorf("snmp: %w", err)
+	}
+	log.Printf("[INFO] SNMP: Agent listening on udp %s (base OID %s)", addr, formatOID(snmpAgent.base))
+	go func() {
+		<-ctx.Done()
+		conn.Close()
+	}()
+	go func() {
+		buf := make([]byte, 65535)
+		for {
+			n, from, err := conn.ReadFrom(buf)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("[ERROR] SNMP: %v", err)
+				}
+				return
+			}
+			resp, err := handleSNMPPacket(ctx, buf[:n])
+			if err != nil {
+				continue // Malformed, or a wrong community: not answered
+			}
+			conn.WriteTo(resp, from)
+		}
+	}()
+	return nil
+}
+
+// handleSNMPPacket decodes a request and returns the encoded response.
+func handleSNMPPacket(ctx context.Context, packet []byte) ([]byte, error) {
+	tag, msg, _, err := berRead(packet)
+	if err != nil || tag != berSequence {
+		return nil, errors.New("not an SNMP message")
+	}
+	_, v, msg, err := berRead(msg)
+	if err != nil {
+		return nil, err
+	}
+	version := berInt(v)
+	if version != 0 && version != 1 {
+		return nil, fmt.Errorf("unsupported version %d", version)
+	}
+	_, community, msg, err := berRead(msg)
+	if err != nil || string(community) != snmpAgent.community {
+		return nil, errors.New("wrong community")
+	}
+	pdu, body, _, err := berRead(msg)
+	if err != nil {
+		return nil, err
+	}
+	var fields [3]int64
+	for i := range fields {
+		var f []byte
+		if _, f, body, err = berRead(body); err != nil {
+			return nil, err
+		}
+		fields[i] = berInt(f)
+	}
+	requestID, nonRepeaters, maxRepetitions := fields[0], int(fields[1]), int(fields[2])
+	_, list, _, err := berRead(body)
+	if err != nil {
+		return nil, err
+	}
+	var oids [][]uint32
+	for len(list) > 0 {
+		var vb, o []byte
+		if _, vb, list, err = berRead(list); err != nil {
+			return nil, err
+		}
+		if _, o, _, err = berRead(vb); err != nil {
+			return nil, err
+		}
+		oid, err := berDecodeOID(o)
+		if err != nil {
+			return nil, err
+		}
+		oids = append(oids, oid)
+	}
+
+	mib := snmpSnapshot(ctx, version == 0)
+	var errStatus, errIndex int
+	var vars []snmpVar
+	switch pdu {
+	case pduGet:
+		for i, oid := range oids {
+			value, found := snmpLookup(mib, oid)
+			if !found && version == 0 {
+				errStatus, errIndex = snmpNoSuchName, i+1
+			}
+			vars = append(vars, snmpVar{oid, value})
+		}
+	case pduGetNext:
+		for i, oid := range oids {
+			next := snmpNext(mib, oid)
+			if next.value[0] == berEndOfMib && version == 0 {
+				errStatus, errIndex = snmpNoSuchName, i+1
+			}
+			vars = append(vars, next)
+		}
+	case pduGetBulk:
+		if version == 0 {
+			return nil, errors.New("getbulk in SNMPv1")
+		}
+		nonRepeaters = min(max(nonRepeaters, 0), len(oids))
+		for _, oid := range oids[:nonRepeaters] {
+			vars = append(vars, snmpNext(mib, oid))
+		}
+		repeaters := slices.Clone(oids[nonRepeaters:])
+		for r := 0; r < maxRepetitions && len(repeaters) > 0 && len(vars) < snmpMaxVarBinds; r++ {
+			for i, oid := range repeaters {
+				next := snmpNext(mib, oid)
+				vars = append(vars, next)
+				repeaters[i] = next.oid
+			}
+		}
+	case pduSet:
+		errStatus, errIndex = snmpNotWritable, 1
+		if version == 0 {
+			errStatus = snmpNoSuchName
+		}
+		for _, oid := range oids {
+			vars = append(vars, snmpVar{oid, berTLV(berNull, nil)})
+		}
+	default:
+		return nil, fmt.Errorf("unsupported PDU 0x%x", pdu)
+	}
+	if errStatus != 0 && pdu != pduSet {
+		// v1: the request's bindings are returned as they were
+		vars = vars[:0]
+		for _, oid := range oids {
+			vars = append(vars, snmpVar{oid, berTLV(berNull, nil)})
+		}
+	}
+
+	var varBinds []byte
+	for _, v := range vars {
+		varBinds = append(varBinds, berTLV(berSequence, append(berTLV(berOID, berEncodeOID(v.oid)), v.value...))...)
+	}
+	resp := berTLV(berInteger, berIntBytes(requestID))
+	resp = append(resp, berTLV(berInteger, berIntBytes(int64(errStatus)))...)
+	resp = append(resp, berTLV(berInteger, berIntBytes(int64(errIndex)))...)
+	resp = append(resp, berTLV(berSequence, varBinds)...)
+	out := berTLV(berInteger, berIntBytes(version))
+	out = append(out, berTLV(berOctetString, community)...)
+	out = append(out, berTLV(pduResponse, resp)...)
+	return berTLV(berSequence, out), nil
+}
+
+// snmpLookup returns the value of oid, or the v2c noSuchObject exception.
+func snmpLookup(mib []snmpVar, oid []uint32) ([]byte, bool) {
+	i := sort.Search(len(mib), func(i int) bool { return slices.Compare(mib[i].oid, oid) >= 0 })
+	if i < len(mib) && slices.Equal(mib[i].oid, oid) {
+		return mib[i].value, true
+	}
+	return berTLV(berNoSuchObj, nil), false
+}
+
+// snmpNext returns the first object after oid, or endOfMibView.
+func snmpNext(mib []snmpVar, oid []uint32) snmpVar {
+	i := sort.Search(len(mib), func(i int) bool { return slices.Compare(mib[i].oid, oid) > 0 })
+	if i < len(mib) {
+		return mib[i]
+	}
+	return snmpVar{oid, berTLV(berEndOfMib, nil)}
+}
+
+// snmpSnapshot returns the objects of the MIB, sorted, taking a new
+// snapshot when the cached one is older than snmpCacheTTL. SNMPv1 has no
+// Counter64, so v1 requests do not see those objects.
+func snmpSnapshot(ctx context.Context, v1 bool) []snmpVar {
+	snmpAgent.Lock()
+	defer snmpAgent.Unlock()
+	if time.Since(snmpAgent.taken) > snmpCacheTTL {
+		snmpAgent.snapshot = snmpObjects(ctx, snmpAgent.base)
+		snmpAgent.taken = time.Now()
+	}
+	if !v1 {
+		return snmpAgent.snapshot
+	}
+	var mib []snmpVar
+	for _, v := range snmpAgent.snapshot {
+		if v.value[0] != berCounter64 {
+			mib = append(mib, v)
+		}
+	}
+	return mib
+}
+
+// snmpObjects builds the objects of the NETSIM-MIB below base:
+//
+//	base.1.1.0  netsimVersion     DisplayString
+//	base.1.2.0  netsimRuleCount   Gauge32
+//	base.1.3.0  netsimUptime      TimeTicks
+//	base.1.4.1.C.I netsimRuleTable, column C of the rule of ifIndex I:
+//	  2 iface, 3 direction, 4 rate, 5 delay (ms), 6 loss (%), 7 revision,
+//	  8 applied by, 9 age (TimeTicks), 10-12 qdisc bytes, packets and drops
+//	  (Counter64, since the rule was applied)
+func snmpObjects(ctx context.Context, base []uint32) []snmpVar {
+	oid := func(parts ...uint32) []uint32 {
+		return append(slices.Clone(base), parts...)
+	}
+	str := func(s string) []byte { return berTLV(berOctetString, []byte(s)) }
+	ticks := func(d time.Duration) []byte {
+		return berTLV(berTimeTicks, berUintBytes(uint64(d/(10*time.Millisecond))&0xffffffff))
+	}
+
+	rules := store.List()
+	mib := []snmpVar{
+		{oid(1, 1, 0), str(version)},
+		{oid(1, 2, 0), berTLV(berGauge32, berUintBytes(uint64(len(rules))))},
+		{oid(1, 3, 0), ticks(time.Since(startedAt))},
+	}
+	for _, rule := range rules {
+		iface, err := net.InterfaceByName(rule.Options.Iface)
+		if err != nil {
+			continue // No index to list it under
+		}
+		opts, idx := rule.Options, uint32(iface.Index)
+		stats := ruleStats(ctx, rule)
+		counters := stats.Current
+		if stats.SinceApply != nil {
+			counters = stats.SinceApply
+		}
+		for col, value := range map[uint32][]byte{
+			2:  str(opts.Iface),
+			3:  str(opts.Direction),
+			4:  str(opts.Rate),
+			5:  str(opts.Delay),
+			6:  str(opts.Loss),
+			7:  berTLV(berGauge32, berUintBytes(rule.Revision&0xffffffff)),
+			8:  str(rule.AppliedBy.String()),
+			9:  ticks(time.Since(rule.AppliedAt)),
+			10: berTLV(berCounter64, berUintBytes(counters.QdiscBytes)),
+			11: berTLV(berCounter64, berUintBytes(counters.QdiscPackets)),
+			12: berTLV(berCounter64, berUintBytes(counters.QdiscDropped)),
+		} {
+			mib = append(mib, snmpVar{oid(1, 4, 1, col, idx), value})
+		}
+	}
+	sort.Slice(mib, func(i, j int) bool { return slices.Compare(mib[i].oid, mib[j].oid) < 0 })
+	return mib
+}
+
+// snmpEnabled reports whether the agent is configured.
+func snmpEnabled() bool {
+	return os.Getenv("SNMP_LISTEN") != ""
+}
+
+// formatOID renders an OID in dotted form.
+func formatOID(oid []uint32) string {
+	parts := make([]string, len(oid))
+	for i, n := range oid {
+		parts[i] = strconv.FormatUint(uint64(n), 10)
+	}
+	return strings.Join(parts, ".")
+}
+
+// --- BER Encoding (the subset SNMP needs) ---
+
+// berRead splits the first TLV off b.
+func berRead(b []byte) (tag byte, content, rest []byte, err error) {
+	if len(b) < 2 {
+		return 0, nil, nil, errors.New("ber: truncated")
+	}
+	tag, length, n := b[0], int(b[1]), 2
+	if length&0x80 != 0 {
+		octets := length & 0x7f
+		if octets == 0 || octets > 3 || len(b) < 2+octets {
+			return 0, nil, nil, errors.New("ber: bad length")
+		}
+		length = 0
+		for _, c := range b[2 : 2+octets] {
+			length = length<<8 | int(c)
+		}
+		n += octets
+	}
+	if len(b) < n+length {
+		return 0, nil, nil, errors.New("ber: truncated")
+	}
+	return tag, b[n : n+length], b[n+length:], nil
+}
+
+// berTLV encodes a TLV.
+func berTLV(tag byte, content []byte) []byte {
+	out := []byte{tag}
+	switch l := len(content); {
+	case l < 0x80:
+		out = append(out, byte(l))
+	case l < 0x100:
+		out = append(out, 0x81, byte(l))
+	case l < 0x10000:
+		out = append(out, 0x82, byte(l>>8), byte(l))
+	default:
+		out = append(out, 0x83, byte(l>>16), byte(l>>8), byte(l))
+	}
+	return append(out, content...)
+}
+
+// berInt decodes a (two's complement) INTEGER.
+func berInt(b []byte) int64 {
+	var v int64
+	for i, c := range b {
+		if i == 0 && c&0x80 != 0 {
+			v = -1
+		}
+		v = v<<8 | int64(c)
+	}
+	return v
+}
+
+// berIntBytes encodes an INTEGER in the fewest octets.
+func berIntBytes(v int64) []byte {
+	out := []byte{byte(v)}
+	for v > 0x7f || v < -0x80 {
+		v >>= 8
+		out = append([]byte{byte(v)}, out...)
+	}
+	return out
+}
+
+// berUintBytes encodes an unsigned value (Counter, Gauge, TimeTicks) in
+// the fewest octets, with a leading zero when the high bit is set.
+func berUintBytes(v uint64) []byte {
+	var out []byte
+	for {
+		out = append([]byte{byte(v)}, out...)
+		if v >>= 8; v == 0 {
+			break
+		}
+	}
+	if out[0]&0x80 != 0 {
+		out = append([]byte{0}, out...)
+	}
+	return out
+}
+
+// berDecodeOID decodes an OBJECT IDENTIFIER.
+func berDecodeOID(b []byte) ([]uint32, error) {
+	if len(b) == 0 {
+		return nil, errors.New("ber: empty OID")
+	}
+	var oid []uint32
+	var n uint64
+	for i, c := range b {
+		n = n<<7 | uint64(c&0x7f)
+		if n > 0xffffffff {
+			return nil, errors.New("ber: OID arc too large")
+		}
+		if c&0x80 != 0 {
+			if i == len(b)-1 {
+				return nil, errors.New("ber: truncated OID")
+			}
+			continue
+		}
+		if len(oid) == 0 {
+			first := min(n/40, 2)
+			oid = append(oid, uint32(first), uint32(n-first*40))
+		} else {
+			oid = append(oid, uint32(n))
+		}
+		n = 0
+	}
+	return oid, nil
+}
+
+// berEncodeOID encodes an OBJECT IDENTIFIER.
+func berEncodeOID(oid []uint32) []byte {
+	if len(oid) < 2 {
+		return []byte{0}
+	}
+	arcs := []uint64{uint64(oid[0])*40 + uint64(oid[1])}
+	for _, n := range oid[2:] {
+		arcs = append(arcs, uint64(n))
+	}
+	var out []byte
+	for _, n := range arcs {
+		chunk := []byte{byte(n & 0x7f)}
+		for n >>= 7; n > 0; n >>= 7 {
+			chunk = append([]byte{byte(n&0x7f) | 0x80}, chunk...)
+		}
+		out = append(out, chunk...)
+	}
+	return out
+}
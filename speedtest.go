@@ -0,0 +1,408 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Speedtest ---
+
+// The speedtest measures the download and upload throughput through the
+// shaped path, against an HTTP server (Cloudflare's speed test by default)
+// or an iperf3 server, so the effect of a rule can be shown in one click.
+// The results are kept in a history with the rule in place at the time.
+
+// Default HTTP targets, overridden by SPEEDTEST_DOWNLOAD_URL and
+// SPEEDTEST_UPLOAD_URL.
+const (
+	speedtestDownloadURL = "https://speed.cloudflare.com/__down?bytes=1000000000"
+	speedtestUploadURL   = "https://speed.cloudflare.com/__up"
+)
+
+// speedtestHistoryLimit caps the kept results (oldest dropped first).
+const speedtestHistoryLimit = 200
+
+// SpeedTest is the result of a measurement.
+type SpeedTest struct {
+	ID            int               `json:"id"`
+	Iface         string            `json:"iface,omitempty"`
+	Method        string            `json:"method"` // "http", "http3" or "iperf"
+	Target        string            `json:"target"`
+	Seconds       int               `json:"seconds"` // per direction
+	DownloadMbps  float64           `json:"downloadMbps"`
+	UploadMbps    float64           `json:"uploadMbps"`
+	DownloadBytes int64             `json:"downloadBytes"`
+	UploadBytes   int64             `json:"uploadBytes"`
+	RttMs         float64           `json:"rttMs,omitempty"`     // TCP connect (http) or mean TCP RTT (iperf)
+	Protocols     []*ProtocolRun    `json:"protocols,omitempty"` // http3: the download over HTTP/3, then over TCP
+	Rule          *V4NetworkOptions `json:"rule,omitempty"`      // the rule of iface during the test
+	Errors        []string          `json:"errors,omitempty"`
+	Started       TcTime            `json:"started"`
+}
+
+// speedtests is the history of results; running serializes the tests,
+// which would otherwise share the link.
+var speedtests = struct {
+	sync.Mutex
+	running sync.Mutex
+	history []*SpeedTest
+	nextID  int
+}{nextID: 1}
+
+// mbps converts bytes transferred in d to Mbit/s.
+func mbps(bytes int64, d time.Duration) float64 {
+	if d <= 0 {
+		return 0
+	}
+	return roundTo(float64(bytes)*8/d.Seconds()/1e6, 2)
+}
+
+// speedtestSourceAddr returns the address of iface in the family of the
+// target URL's host ("" when iface is "" or has none).
+func speedtestSourceAddr(iface, target string) string {
+	if iface == "" {
+		return ""
+	}
+	v4 := true
+	if u, err := url.Parse(target); err == nil {
+		if ips, err := net.LookupIP(u.Hostname()); err == nil && len(ips) > 0 {
+			v4 = ips[0].To4() != nil
+		}
+	}
+	return interfaceAddr(iface, v4)
+}
+
+// speedtestClient returns an HTTP client whose connections leave from the
+// address of iface (any address when iface is "").
+func speedtestClient(iface, target string) *http.Client {
+	dialer := &net.Dialer{Timeout: 10 * time.Second}
+	if addr := speedtestSourceAddr(iface, target); addr != "" {
+		dialer.LocalAddr = &net.TCPAddr{IP: net.ParseIP(addr)}
+	}
+	return &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		DialContext:       dialer.DialContext,
+		DisableKeepAlives: true,
+	}}
+}
+
+// withConnectTrace records the TCP connect time of a request in rtt.
+func withConnectTrace(ctx context.Context, rtt *time.Duration) context.Context {
+	var start time.Time
+	return httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		ConnectStart: func(string, string) { start = time.Now() },
+		ConnectDone: func(_, _ string, err error) {
+			if err == nil && *rtt == 0 {
+				*rtt = time.Since(start)
+			}
+		},
+	})
+}
+
+// httpDownload reads url for d and returns the bytes received and the time
+// it took, from the response headers on.
+func httpDownload(ctx context.Context, client *http.Client, url string, d time.Duration, rtt *time.Duration) (int64, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, d+10*time.Second)
+	defer cancel()
+	req, err := http.NewRequestWithContext(withConnectTrace(ctx, rtt), http.MethodGet, url, nil)
+	if err != nil {
+		return 0, 0, err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return 0, 0, fmt.Errorf("download: %s answered %s", url, resp.Status)
+	}
+	start := time.Now()
+	deadline := start.Add(d)
+	buf := make([]byte, 64<<10)
+	var total int64
+	for time.Now().Before(deadline) {
+		n, err := resp.Body.Read(buf)
+		total += int64(n)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return total, time.Since(start), err
+		}
+	}
+	return total, time.Since(start), nil
+}
+
+// timedZeros is a request body of zeros that ends after a deadline.
+type timedZeros struct {
+	deadline time.Time
+	sent     int64
+}
+
+func (z *timedZeros) Read(p []byte) (int, error) {
+	if !time.Now().Before(z.deadline) {
+		return 0, io.EOF
+	}
+	clear(p)
+	z.sent += int64(len(p))
+	return len(p), nil
+}
+
+// httpUpload posts zeros to url for d and returns the bytes sent and the
+// time it took.
+func httpUpload(ctx context.Context, client *http.Client, url string, d time.Duration, rtt *time.Duration) (int64, time.Duration, error) {
+	ctx, cancel := context.WithTimeout(ctx, d+10*time.Second)
+	defer cancel()
+	body := &timedZeros{}
+	req, err := http.NewRequestWithContext(withConnectTrace(ctx, rtt), http.MethodPost, url, body)
+	if err != nil {
+		return 0, 0, err
+	}
+	req.Header.Set("Content-Type", "application/octet-stream")
+	start := time.Now()
+	body.deadline = start.Add(d)
+	resp, err := client.Do(req)
+	elapsed := time.Since(start)
+	if err != nil {
+		return body.sent, elapsed, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		return body.sent, elapsed, fmt.Errorf("upload: %s answered %s", url, resp.Status)
+	}
+	return body.sent, elapsed, nil
+}
+
+// runHTTPSpeedtest measures against the download and upload URLs (an empty
+// URL skips that direction).
+func runHTTPSpeedtest(ctx context.Context, t *SpeedTest, download, upload string, d time.Duration) {
+	var rtt time.Duration
+	if download != "" {
+		bytes, elapsed, err := httpDownload(ctx, speedtestClient(t.Iface, download), download, d, &rtt)
+		t.DownloadBytes, t.DownloadMbps = bytes, mbps(bytes, elapsed)
+		if err != nil {
+			t.Errors = append(t.Errors, err.Error())
+		}
+	}
+	if upload != "" {
+		bytes, elapsed, err := httpUpload(ctx, speedtestClient(t.Iface, upload), upload, d, &rtt)
+		t.UploadBytes, t.UploadMbps = bytes, mbps(bytes, elapsed)
+		if err != nil {
+			t.Errors = append(t.Errors, err.Error())
+		}
+	}
+	if rtt > 0 {
+		t.RttMs = roundTo(float64(rtt)/float64(time.Millisecond), 3)
+	}
+}
+
+// iperfResult is the part of 'iperf3 -J' the speedtest reads.
+type iperfResult struct {
+	End struct {
+		SumReceived struct {
+			Bytes         int64   `json:"bytes"`
+			BitsPerSecond float64 `json:"bits_per_second"`
+		} `json:"sum_received"`
+		Streams []struct {
+			Sender struct {
+				MeanRTT float64 `json:"mean_rtt"` // microseconds
+			} `json:"sender"`
+		} `json:"streams"`
+	} `json:"end"`
+	Error string `json:"error"`
+}
+
+// iperf3 runs one direction of an iperf3 test (reverse: the server sends).
+func iperf3(ctx context.Context, iface, server string, d time.Duration, reverse bool) (*iperfResult, error) {
+	host, port, err := net.SplitHostPort(server)
+	if err != nil {
+		host, port = server, "5201"
+	}
+	args := []string{"-c", host, "-p", port, "-t", strconv.Itoa(int(d.Seconds())), "-J"}
+	if reverse {
+		args = append(args, "-R")
+	}
+	if iface != "" {
+		if addr := interfaceAddr(iface, net.ParseIP(host) == nil || net.ParseIP(host).To4() != nil); addr != "" {
+			args = append(args, "-B", addr)
+		}
+	}
+	out, runErr := command(ctx, "iperf3", args...).Output()
+	res := &iperfResult{}
+	if err := json.Unmarshal(out, res); err != nil {
+		if runErr != nil {
+			return nil, fmt.Errorf("iperf3: %w", runErr)
+		}
+		return nil, fmt.Errorf("iperf3: unreadable output: %w", err)
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("iperf3: %s", res.Error)
+	}
+	return res, nil
+}
+
+// runIperfSpeedtest measures against an iperf3 server (host[:port]).
+func runIperfSpeedtest(ctx context.Context, t *SpeedTest, server string, d time.Duration) {
+	if res, err := iperf3(ctx, t.Iface, server, d, true); err != nil {
+		t.Errors = append(t.Errors, err.Error())
+	} else {
+		t.DownloadBytes = res.End.SumReceived.Bytes
+		t.DownloadMbps = roundTo(res.End.SumReceived.BitsPerSecond/1e6, 2)
+	}
+	if res, err := iperf3(ctx, t.Iface, server, d, false); err != nil {
+		t.Errors = append(t.Errors, err.Error())
+	} else {
+		t.UploadBytes = res.End.SumReceived.Bytes
+		t.UploadMbps = roundTo(res.End.SumReceived.BitsPerSecond/1e6, 2)
+		if len(res.End.Streams) > 0 {
+			t.RttMs = roundTo(res.End.Streams[0].Sender.MeanRTT/1000, 3)
+		}
+	}
+}
+
+// --- Handlers: /speedtest ---
+
+// handleSpeedtestRun measures the throughput and records it in the
+// history. Query: 'iface' (the source address, and the rule recorded with
+// the result), 'server' (an iperf3 host[:port]; default: HTTP), 'method'
+// ("iperf", or "http3" to download over HTTP/3 and TCP), 'download' and
+// 'upload' (HTTP URLs, "none" skips a direction) and 'seconds' per
+// direction (1-20, default 8).
+func handleSpeedtestRun(w http.ResponseWriter, r *http.Request) {
+	if isReadOnlyView(r) {
+		respondWithError(w, "this is a read-only view: changes are not allowed", 403)
+		return
+	}
+	q := r.URL.Query()
+	iface := q.Get("iface")
+	if iface != "" {
+		if _, err := net.InterfaceByName(iface); err != nil {
+			respondWithError(w, fmt.Sprintf("speedtest: interface '%s' not found", iface), 400)
+			return
+		}
+	}
+	seconds := 8
+	if v := q.Get("seconds"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 20 {
+			respondWithError(w, fmt.Sprintf("speedtest: invalid 'seconds' %q (1-20)", v), 400)
+			return
+		}
+		seconds = n
+	}
+	server := q.Get("server")
+	if server == "" && q.Get("method") == "iperf" {
+		server = os.Getenv("SPEEDTEST_IPERF_SERVER")
+	}
+	if server == "" && q.Get("method") == "iperf" {
+		respondWithError(w, "speedtest: 'server' is required for iperf (or set SPEEDTEST_IPERF_SERVER)", 400)
+		return
+	}
+	http3URL := ""
+	if q.Get("method") == "http3" {
+		if !curlHTTP3() {
+			respondWithError(w, "speedtest: http3 needs a curl with HTTP/3 support (curl --version lists HTTP3; see SPEEDTEST_CURL)", 501)
+			return
+		}
+		if http3URL = speedtestURL(q.Get("download"), "SPEEDTEST_DOWNLOAD_URL", speedtestDownloadURL); !strings.HasPrefix(http3URL, "https://") {
+			respondWithError(w, "speedtest: http3 needs an https:// 'download' URL", 400)
+			return
+		}
+	}
+	if !speedtests.running.TryLock() {
+		respondWithError(w, "speedtest: a test is already running", 409)
+		return
+	}
+	defer speedtests.running.Unlock()
+
+	t := &SpeedTest{Iface: iface, Seconds: seconds, Started: TcTime(time.Now())}
+	if rule := store.Get(iface, ""); iface != "" && rule != nil {
+		t.Rule = rule.Options
+	}
+	d := time.Duration(seconds) * time.Second
+	if server != "" {
+		t.Method, t.Target = "iperf", server
+		runIperfSpeedtest(r.Context(), t, server, d)
+	} else if http3URL != "" {
+		t.Method, t.Target = "http3", http3URL
+		runHTTP3Speedtest(r.Context(), t, http3URL, d)
+	} else {
+		download, upload := speedtestURL(q.Get("download"), "SPEEDTEST_DOWNLOAD_URL", speedtestDownloadURL), speedtestURL(q.Get("upload"), "SPEEDTEST_UPLOAD_URL", speedtestUploadURL)
+		if download == "" && upload == "" {
+			respondWithError(w, "speedtest: both directions are skipped", 400)
+			return
+		}
+		t.Method, t.Target = "http", download
+		if download == "" {
+			t.Target = upload
+		}
+		runHTTPSpeedtest(r.Context(), t, download, upload, d)
+	}
+
+	speedtests.Lock()
+	t.ID = speedtests.nextID
+	speedtests.nextID++
+	speedtests.history = append(speedtests.history, t)
+	if len(speedtests.history) > speedtestHistoryLimit {
+		speedtests.history = speedtests.history[len(speedtests.history)-speedtestHistoryLimit:]
+	}
+	speedtests.Unlock()
+	log.Printf("[INFO] SPEEDTEST: #%d via %s (%s): %.2f Mbit/s down, %.2f Mbit/s up", t.ID, t.Target, t.Method, t.DownloadMbps, t.UploadMbps)
+	respondWithJSON(w, http.StatusOK, t)
+}
+
+// speedtestURL returns the URL of a direction: the query's, else the
+// environment's, else the default ("none" skips the direction).
+func speedtestURL(query, env, def string) string {
+	target := query
+	if target == "" {
+		target = os.Getenv(env)
+	}
+	if target == "" {
+		target = def
+	}
+	if target == "none" {
+		return ""
+	}
+	return target
+}
+
+// handleSpeedtestList returns the history, oldest first (or the page of it
+// selected by 'offset' and 'limit'), optionally for one 'iface'.
+func handleSpeedtestList(w http.ResponseWriter, r *http.Request) {
+	iface := r.URL.Query().Get("iface")
+	speedtests.Lock()
+	list := []*SpeedTest{}
+	for _, t := range speedtests.history {
+		if iface == "" || t.Iface == iface {
+			list = append(list, t)
+		}
+	}
+	speedtests.Unlock()
+	start, end, err := pageBounds(r, len(list))
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("speedtest: %v", err), 400)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"total": len(list), "results": list[start:end]})
+}
+
+// handleSpeedtestClear forgets the history.
+func handleSpeedtestClear(w http.ResponseWriter, r *http.Request) {
+	speedtests.Lock()
+	speedtests.history = nil
+	speedtests.Unlock()
+	respondWithJSON(w, http.StatusOK, nil)
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// --- Desired State (Persistence Layer) ---
+
+// AppliedRule is the desired configuration recorded for one direction of
+// an interface.
+type AppliedRule struct {
+	ID        string            `json:"id"` // stable while the rule is adjusted (see Set)
+	Options   *V4NetworkOptions `json:"options"`
+	AppliedAt time.Time         `json:"appliedAt"`
+	AppliedBy Actor             `json:"appliedBy"`
+	Revision  uint64            `json:"revision"`
+	Baseline  *IfaceCounters    `json:"baseline,omitempty"` // counters when applied
+}
+
+// ruleKey names a rule of the store: its interface and its ID.
+type ruleKey struct {
+	iface, id string
+}
+
+// stateFile is the on-disk format of the rule store. Rules are keyed by
+// "iface/id" (files written before an interface held several rules are
+// keyed by the interface: only the values are read back).
+type stateFile struct {
+	Revision  uint64                  `json:"revision"`
+	Rules     map[string]*AppliedRule `json:"rules"`
+	Revisions map[string]uint64       `json:"revisions"`
+	Settings  map[string]*Setting     `json:"settings,omitempty"`
+}
+
+// ruleStore keeps the desired V4 rules, one per interface and direction,
+// keyed by interface and rule ID. When a path is set
+// (STATE_FILE), every change is written to disk so the state survives
+// restarts and can be used by the reconciler.
+//
+// Every change bumps a monotonically increasing revision. The revision of
+// an interface is kept after a reset, so clients holding a stale revision
+// still get a conflict instead of silently overwriting newer state.
+type ruleStore struct {
+	mu        sync.Mutex
+	path      string
+	revision  uint64
+	rules     map[ruleKey]*AppliedRule
+	revisions map[string]uint64
+	settings  map[string]*Setting // set through the API (see settings.go)
+}
+
+// store is the process-wide desired state.
+var store = &ruleStore{rules: map[ruleKey]*AppliedRule{}, revisions: map[string]uint64{}, settings: map[string]*Setting{}}
+
+// applyMu serializes every operation that mutates tc state (API handlers,
+// reconciler), so two writers never interleave commands on one interface.
+var applyMu sync.Mutex
+
+// Open binds the store to a JSON file and loads any existing state from it.
+func (s *ruleStore) Open(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.path = path
+	if err := s.load(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// load reads a state file into the store. Must be called with s.mu held.
+func (s *ruleStore) load(path string) error {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return err
+	} else if err != nil {
+		return fmt.Errorf("read state file %s: %w", path, err)
+	}
+
+	var state stateFile
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("parse state file %s: %w", path, err)
+	}
+	s.revision = state.Revision
+	if state.Rules != nil {
+		s.rules = map[ruleKey]*AppliedRule{}
+		for _, rule := range state.Rules {
+			if rule.Options == nil {
+				continue
+			}
+			if rule.ID == "" { // Written before rules had IDs
+				rule.ID = newRuleID()
+			}
+			s.rules[ruleKey{rule.Options.Iface, rule.ID}] = rule
+		}
+	}
+	if state.Revisions != nil {
+		s.revisions = state.Revisions
+	}
+	if state.Settings != nil {
+		s.settings = state.Settings
+	}
+	log.Printf("[INFO] STATE: Loaded %d rule(s) from %s", len(s.rules), path)
+	return nil
+}
+
+// Reload re-reads the state file, e.g. after it was edited by hand or by
+// configuration management. It reports whether the store has a file; on
+// error the state is unchanged. Revisions never go backwards.
+func (s *ruleStore) Reload() (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path == "" {
+		return false, nil
+	}
+	prev := s.revision
+	if err := s.load(s.path); err != nil {
+		return true, err
+	}
+	s.revision = max(s.revision, prev)
+	return true, nil
+}
+
+// WriteHandoff saves the state to path for the next process (e.g. across a
+// self-upgrade) when no STATE_FILE keeps it already.
+func (s *ruleStore) WriteHandoff(path string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.path != "" {
+		return nil
+	}
+	s.path = path
+	defer func() { s.path = "" }()
+	return s.saveErr()
+}
+
+// ReadHandoff loads (and removes) a handoff file written by the previous
+// process. It reports whether one was found.
+func (s *ruleStore) ReadHandoff(path string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	err := s.load(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	os.Remove(path)
+	return err == nil, err
+}
+
+// LoadSettings reads only the settings of a state file, for the startup
+// configuration that runs before the rules are loaded.
+func (s *ruleStore) LoadSettings(path string) error {
+	b, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return fmt.Errorf("read state file %s: %w", path, err)
+	}
+	var state stateFile
+	if err := json.Unmarshal(b, &state); err != nil {
+		return fmt.Errorf("parse state file %s: %w", path, err)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if state.Settings != nil {
+		s.settings = state.Settings
+	}
+	return nil
+}
+
+// Setting returns a setting changed through the API, or nil.
+func (s *ruleStore) Setting(name string) *Setting {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.settings[name]
+}
+
+// SetSetting records a setting (nil removes it) and writes the state file.
+func (s *ruleStore) SetSetting(name string, setting *Setting) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	prev, had := s.settings[name]
+	if setting == nil {
+		delete(s.settings, name)
+	} else {
+		s.settings[name] = setting
+	}
+	if err := s.saveErr(); err != nil {
+		if had {
+			s.settings[name] = prev
+		} else {
+			delete(s.settings, name)
+		}
+		return err
+	}
+	return nil
+}
+
+// Set records opts as the desired state of its interface and direction,
+// applied by, and returns the new revision. Connected UI sessions are
+// notified. A rule replacing one of the same direction keeps its ID (it was
+// adjusted); otherwise it gets a new one, next to the rule of the other
+// direction, if any.
+func (s *ruleStore) Set(opts *V4NetworkOptions, by Actor) uint64 {
+	baseline := readIfaceCounters(context.Background(), opts)
+	s.mu.Lock()
+	s.revision++
+	rev := s.revision
+	s.revisions[opts.Iface] = rev
+	id := newRuleID()
+	if prev := s.find(opts.Iface, opts.Direction); prev != nil {
+		id = prev.ID
+	}
+	s.rules[ruleKey{opts.Iface, id}] = &AppliedRule{ID: id, Options: opts, AppliedAt: time.Now(), AppliedBy: by, Revision: rev, Baseline: baseline}
+	s.save()
+	s.mu.Unlock()
+
+	sessions.publish(RuleEvent{Action: "set", Iface: opts.Iface, RuleID: id, Revision: rev, By: by, At: TcTime(time.Now())})
+	return rev
+}
+
+// Delete forgets the desired state of iface (its rules of both
+// directions) and returns the new revision. Connected UI sessions are
+// notified of each rule.
+func (s *ruleStore) Delete(iface string, by Actor) uint64 {
+	s.mu.Lock()
+	var ids []string
+	for key := range s.rules {
+		if key.iface == iface {
+			ids = append(ids, key.id)
+		}
+	}
+	if len(ids) == 0 {
+		defer s.mu.Unlock()
+		return s.revisions[iface]
+	}
+	s.revision++
+	rev := s.revision
+	s.revisions[iface] = rev
+	for _, id := range ids {
+		delete(s.rules, ruleKey{iface, id})
+	}
+	s.save()
+	s.mu.Unlock()
+
+	for _, id := range ids {
+		sessions.publish(RuleEvent{Action: "reset", Iface: iface, RuleID: id, Revision: rev, By: by, At: TcTime(time.Now())})
+	}
+	return rev
+}
+
+// DeleteByID forgets the rule with the ID (the other rule of its interface
+// stays) and returns the new revision of the interface, or 0 when no rule
+// has the ID. Connected UI sessions are notified.
+func (s *ruleStore) DeleteByID(id string, by Actor) uint64 {
+	s.mu.Lock()
+	var iface string
+	for key := range s.rules {
+		if key.id == id {
+			iface = key.iface
+		}
+	}
+	if iface == "" {
+		s.mu.Unlock()
+		return 0
+	}
+	s.revision++
+	rev := s.revision
+	s.revisions[iface] = rev
+	delete(s.rules, ruleKey{iface, id})
+	s.save()
+	s.mu.Unlock()
+
+	sessions.publish(RuleEvent{Action: "reset", Iface: iface, RuleID: id, Revision: rev, By: by, At: TcTime(time.Now())})
+	return rev
+}
+
+// Revision returns the revision of iface, or the global revision when
+// iface is empty. Interfaces never configured are at revision 0.
+func (s *ruleStore) Revision(iface string) uint64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if iface == "" {
+		return s.revision
+	}
+	return s.revisions[iface]
+}
+
+// Get returns a copy of the desired rule of iface in direction, or nil.
+// With an empty direction it returns either rule of iface, the outgoing one
+// first.
+func (s *ruleStore) Get(iface, direction string) *AppliedRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rule := s.find(iface, direction)
+	if rule == nil && direction == "" {
+		rule = s.find(iface, "incoming")
+	}
+	if rule == nil {
+		return nil
+	}
+	r := *rule
+	return &r
+}
+
+// find returns the rule of iface in direction ("" for outgoing). Must be
+// called with s.mu held.
+func (s *ruleStore) find(iface, direction string) *AppliedRule {
+	if direction == "" {
+		direction = "outgoing"
+	}
+	for key, rule := range s.rules {
+		if key.iface == iface && rule.Options.Direction == direction {
+			return rule
+		}
+	}
+	return nil
+}
+
+// ByID returns a copy of the desired rule with the ID, or nil.
+func (s *ruleStore) ByID(id string) *AppliedRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for key, rule := range s.rules {
+		if key.id == id {
+			r := *rule
+			return &r
+		}
+	}
+	return nil
+}
+
+// OfIface returns a copy of the desired rules of iface, the outgoing one
+// first.
+func (s *ruleStore) OfIface(iface string) []*AppliedRule {
+	rules := []*AppliedRule{}
+	for _, rule := range s.List() {
+		if rule.Options.Iface == iface {
+			rules = append(rules, rule)
+		}
+	}
+	return rules
+}
+
+// List returns a copy of all desired rules, sorted by interface name, the
+// outgoing rule of an interface first.
+func (s *ruleStore) List() []*AppliedRule {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	rules := make([]*AppliedRule, 0, len(s.rules))
+	for _, rule := range s.rules {
+		r := *rule
+		rules = append(rules, &r)
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		a, b := rules[i].Options, rules[j].Options
+		if a.Iface != b.Iface {
+			return a.Iface < b.Iface
+		}
+		return a.Direction > b.Direction // "outgoing" before "incoming"
+	})
+	return rules
+}
+
+// save writes the state file atomically. Must be called with s.mu held.
+func (s *ruleStore) save() {
+	if err := s.saveErr(); err != nil {
+		log.Printf("[ERROR] STATE: %v", err)
+	}
+}
+
+// saveErr is save, returning the error. Must be called with s.mu held.
+func (s *ruleStore) saveErr() error {
+	if s.path == "" {
+		return nil
+	}
+	rules := make(map[string]*AppliedRule, len(s.rules))
+	for key, rule := range s.rules {
+		rules[key.iface+"/"+key.id] = rule
+	}
+	b, err := json.MarshalIndent(&stateFile{Revision: s.revision, Rules: rules, Revisions: s.revisions, Settings: s.settings}, "", "  ")
+	if err != nil {
+		return fmt.Errorf("failed to encode state: %w", err)
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), ".state-*.json")
+	if err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	tmp.Close()
+	if err := os.Rename(tmp.Name(), s.path); err != nil {
+		return fmt.Errorf("failed to write %s: %w", s.path, err)
+	}
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestRuleStoreDirections(t *testing.T) {
+	s := &ruleStore{rules: map[ruleKey]*AppliedRule{}, revisions: map[string]uint64{}, settings: map[string]*Setting{}}
+	if err := s.Open(filepath.Join(t.TempDir(), "state.json")); err != nil {
+		t.Fatal(err)
+	}
+	by := Actor{Source: "test"}
+	s.Set(&V4NetworkOptions{Iface: "eth0", Direction: "outgoing", Delay: "10"}, by)
+	s.Set(&V4NetworkOptions{Iface: "eth0", Direction: "incoming", Delay: "20"}, by)
+	out, in := s.Get("eth0", "outgoing"), s.Get("eth0", "incoming")
+	if out == nil || in == nil || out.ID == in.ID || len(s.OfIface("eth0")) != 2 {
+		t.Fatalf("want an outgoing and an incoming rule, got %d", len(s.OfIface("eth0")))
+	}
+
+	// Adjusting a direction keeps its ID and leaves the other rule alone
+	s.Set(&V4NetworkOptions{Iface: "eth0", Direction: "outgoing", Delay: "30"}, by)
+	if got := s.Get("eth0", "outgoing"); got.ID != out.ID || got.Options.Delay != "30" {
+		t.Errorf("adjusted outgoing rule = %s %s, want %s 30", got.ID, got.Options.Delay, out.ID)
+	}
+	if got := s.Get("eth0", ""); got.ID != out.ID {
+		t.Errorf("Get without a direction = %s, want the outgoing rule", got.ID)
+	}
+
+	// The state file keeps both rules
+	if _, err := s.Reload(); err != nil || len(s.List()) != 2 {
+		t.Fatalf("reloaded %d rule(s) (%v), want 2", len(s.List()), err)
+	}
+
+	if rev := s.DeleteByID(in.ID, by); rev == 0 || s.ByID(in.ID) != nil {
+		t.Fatalf("DeleteByID(%s) = %d, the rule is still there", in.ID, rev)
+	}
+	if rules := s.OfIface("eth0"); len(rules) != 1 || rules[0].ID != out.ID {
+		t.Errorf("after DeleteByID: %d rule(s), want the outgoing one", len(rules))
+	}
+	if s.DeleteByID(in.ID, by) != 0 {
+		t.Error("DeleteByID of an unknown ID changed the revision")
+	}
+}
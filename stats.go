@@ -0,0 +1,248 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// --- Interface Statistics Since Apply ---
+
+// IfaceCounters are the interface counters (sysfs) and the counters of the
+// root qdisc of the shaped device (ifb0 for 'incoming' rules).
+type IfaceCounters struct {
+	RxBytes      uint64 `json:"rxBytes"`
+	TxBytes      uint64 `json:"txBytes"`
+	RxPackets    uint64 `json:"rxPackets"`
+	TxPackets    uint64 `json:"txPackets"`
+	RxDropped    uint64 `json:"rxDropped"`
+	TxDropped    uint64 `json:"txDropped"`
+	QdiscBytes   uint64 `json:"qdiscBytes"`
+	QdiscPackets uint64 `json:"qdiscPackets"`
+	QdiscDropped uint64 `json:"qdiscDropped"` // netem loss, queue overflows, ...
+	At           TcTime `json:"at"`
+}
+
+// RuleStats are the counters of a rule's interface since the rule was
+// applied.
+type RuleStats struct {
+	RuleID     string         `json:"ruleId"`
+	Iface      string         `json:"iface"`
+	Direction  string         `json:"direction"`
+	Seconds    float64        `json:"seconds"`
+	SinceApply *IfaceCounters `json:"sinceApply,omitempty"`
+	Current    *IfaceCounters `json:"current,omitempty"`
+	ABProfile  string         `json:"abProfile,omitempty"` // the active profile of a running A/B test
+	// The qdiscs and classes of each direction of the interface, so egress
+	// and ingress (ifb) numbers need no knowledge of the ifb mapping
+	Directions []*DirectionStats `json:"directions,omitempty"`
+}
+
+// DirectionStats are the qdisc and class counters of one direction of an
+// interface: "outgoing" on the interface itself, "incoming" on the ifb
+// device its inbound traffic is redirected to (or its ingress hook, when
+// policed).
+type DirectionStats struct {
+	Direction string        `json:"direction"`
+	Device    string        `json:"device"`
+	Mode      string        `json:"mode,omitempty"` // incoming: "ifb" or "police"; "" when nothing is redirected
+	Shaped    bool          `json:"shaped"`         // the rule impairs this direction
+	Qdiscs    []*TcCounters `json:"qdiscs"`
+	Classes   []*TcCounters `json:"classes"`
+}
+
+// TcCounters are the counters of a qdisc or class ('tc -s ... show').
+type TcCounters struct {
+	Kind           string `json:"kind"`
+	Handle         string `json:"handle"` // classid, for a class
+	Parent         string `json:"parent"` // "root", "ingress" or a class
+	Rate           string `json:"rate,omitempty"`
+	Bytes          uint64 `json:"bytes"`
+	Packets        uint64 `json:"packets"`
+	Dropped        uint64 `json:"dropped"`
+	Overlimits     uint64 `json:"overlimits"`
+	Requeues       uint64 `json:"requeues"`
+	BacklogPackets uint64 `json:"backlogPackets"`
+}
+
+// readIfaceCounters reads the counters of opts' interface and shaped device.
+func readIfaceCounters(ctx context.Context, opts *V4NetworkOptions) *IfaceCounters {
+	c := &IfaceCounters{At: TcTime(time.Now())}
+	for name, field := range map[string]*uint64{
+		"rx_bytes": &c.RxBytes, "tx_bytes": &c.TxBytes,
+		"rx_packets": &c.RxPackets, "tx_packets": &c.TxPackets,
+		"rx_dropped": &c.RxDropped, "tx_dropped": &c.TxDropped,
+	} {
+		b, err := os.ReadFile("/sys/class/net/" + opts.Iface + "/statistics/" + name)
+		if err == nil {
+			*field, _ = strconv.ParseUint(strings.TrimSpace(string(b)), 10, 64)
+		}
+	}
+	dev := opts.Iface
+	if opts.Direction == "incoming" && opts.ingressMode() == "ifb" {
+		dev = "ifb0"
+	}
+	if out, err := runTCOutput(ctx, append([]string{"-s", "qdisc", "show", "dev", dev}, opts.treeAttach()...)...); err == nil {
+		c.QdiscBytes, c.QdiscPackets, c.QdiscDropped = parseQdiscSent(out)
+	}
+	return c
+}
+
+// parseQdiscSent parses the first " Sent X bytes Y pkt (dropped Z, ..." line
+// of 'tc -s qdisc show'.
+func parseQdiscSent(out string) (bytes, packets, dropped uint64) {
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ", ",", " ").Replace(line))
+		if len(fields) < 7 || fields[0] != "Sent" {
+			continue
+		}
+		bytes, _ = strconv.ParseUint(fields[1], 10, 64)
+		packets, _ = strconv.ParseUint(fields[3], 10, 64)
+		dropped, _ = strconv.ParseUint(fields[6], 10, 64)
+		return bytes, packets, dropped
+	}
+	return 0, 0, 0
+}
+
+// parseTcCounters parses the qdiscs or classes of 'tc -s qdisc/class show'.
+func parseTcCounters(out string) []*TcCounters {
+	list := []*TcCounters{}
+	var cur *TcCounters
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(strings.NewReplacer("(", " ", ")", " ", ",", " ").Replace(line))
+		switch {
+		case len(fields) >= 3 && (fields[0] == "qdisc" || fields[0] == "class"):
+			cur = &TcCounters{Kind: fields[1], Handle: fields[2]}
+			for i, f := range fields[3:] {
+				switch {
+				case f == "root":
+					cur.Parent = f
+				case (f == "parent" || f == "rate") && i+4 < len(fields):
+					if f == "parent" {
+						cur.Parent = fields[i+4]
+					} else if cur.Rate == "" {
+						cur.Rate = fields[i+4]
+					}
+				}
+			}
+			list = append(list, cur)
+		case cur != nil && len(fields) >= 11 && fields[0] == "Sent":
+			cur.Bytes, _ = strconv.ParseUint(fields[1], 10, 64)
+			cur.Packets, _ = strconv.ParseUint(fields[3], 10, 64)
+			cur.Dropped, _ = strconv.ParseUint(fields[6], 10, 64)
+			cur.Overlimits, _ = strconv.ParseUint(fields[8], 10, 64)
+			cur.Requeues, _ = strconv.ParseUint(fields[10], 10, 64)
+		case cur != nil && len(fields) >= 3 && fields[0] == "backlog":
+			cur.BacklogPackets, _ = strconv.ParseUint(strings.TrimSuffix(fields[2], "p"), 10, 64)
+		}
+	}
+	return list
+}
+
+// ingressRedirect returns the ifb device the ingress filters of iface
+// redirect to, or "".
+func ingressRedirect(ctx context.Context, iface string) string {
+	out, err := runTCOutput(ctx, "filter", "show", "dev", iface, "ingress")
+	if err != nil {
+		return ""
+	}
+	if m := ifbRedirectPattern.FindStringSubmatch(out); m != nil {
+		return m[1]
+	}
+	return ""
+}
+
+// readDirectionStats reads the qdiscs and classes of both directions of
+// iface. rule (nil: none) tells which direction it shapes.
+func readDirectionStats(ctx context.Context, iface string, rule *V4NetworkOptions) []*DirectionStats {
+	read := func(d *DirectionStats, qdiscArgs ...string) *DirectionStats {
+		if out, err := runTCOutput(ctx, append([]string{"-s", "qdisc", "show", "dev", d.Device}, qdiscArgs...)...); err == nil {
+			d.Qdiscs = parseTcCounters(out)
+		}
+		if out, err := runTCOutput(ctx, "-s", "class", "show", "dev", d.Device); err == nil && len(qdiscArgs) == 0 {
+			d.Classes = parseTcCounters(out)
+		}
+		return d
+	}
+	out := &DirectionStats{Direction: "outgoing", Device: iface, Qdiscs: []*TcCounters{}, Classes: []*TcCounters{}}
+	out.Shaped = rule != nil && rule.Direction == "outgoing"
+	in := &DirectionStats{Direction: "incoming", Device: iface, Qdiscs: []*TcCounters{}, Classes: []*TcCounters{}}
+	in.Shaped = rule != nil && rule.Direction == "incoming"
+
+	read(out)
+	if dev := ingressRedirect(ctx, iface); dev != "" {
+		in.Device, in.Mode = dev, "ifb"
+		read(in)
+	} else {
+		if in.Shaped && rule.ingressMode() == "police" {
+			in.Mode = "police"
+		}
+		read(in, "ingress")
+	}
+	// The ingress hook is listed with the egress qdiscs too
+	kept := out.Qdiscs[:0]
+	for _, q := range out.Qdiscs {
+		if q.Kind != "ingress" && q.Kind != "clsact" {
+			kept = append(kept, q)
+		}
+	}
+	out.Qdiscs = kept
+	return []*DirectionStats{out, in}
+}
+
+// since returns c - base. A counter below its baseline was reset (reboot,
+// interface re-created), so it counts from zero.
+func (c *IfaceCounters) since(base *IfaceCounters) *IfaceCounters {
+	delta := func(now, then uint64) uint64 {
+		if now < then {
+			return now
+		}
+		return now - then
+	}
+	return &IfaceCounters{
+		RxBytes:      delta(c.RxBytes, base.RxBytes),
+		TxBytes:      delta(c.TxBytes, base.TxBytes),
+		RxPackets:    delta(c.RxPackets, base.RxPackets),
+		TxPackets:    delta(c.TxPackets, base.TxPackets),
+		RxDropped:    delta(c.RxDropped, base.RxDropped),
+		TxDropped:    delta(c.TxDropped, base.TxDropped),
+		QdiscBytes:   delta(c.QdiscBytes, base.QdiscBytes),
+		QdiscPackets: delta(c.QdiscPackets, base.QdiscPackets),
+		QdiscDropped: delta(c.QdiscDropped, base.QdiscDropped),
+		At:           c.At,
+	}
+}
+
+// ruleStats compares the current counters with the rule's baseline.
+func ruleStats(ctx context.Context, rule *AppliedRule) *RuleStats {
+	current := readIfaceCounters(ctx, rule.Options)
+	stats := &RuleStats{RuleID: rule.ID, Iface: rule.Options.Iface, Direction: rule.Options.Direction, Current: current, ABProfile: activeABProfile(rule.Options.Iface)}
+	stats.Directions = readDirectionStats(ctx, rule.Options.Iface, rule.Options)
+	if rule.Baseline != nil {
+		stats.SinceApply = current.since(rule.Baseline)
+		stats.Seconds = roundTo(time.Time(current.At).Sub(time.Time(rule.Baseline.At)).Seconds(), 3)
+	}
+	return stats
+}
+
+// --- Handler: /config/stats ---
+
+// handleTcStats returns the counters of each rule (or of the rules of
+// 'iface', or of the rule 'id') since the rule was applied.
+func handleTcStats(w http.ResponseWriter, r *http.Request) {
+	if !resolveRuleID(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	iface, id := q.Get("iface"), q.Get("id")
+	stats := []*RuleStats{}
+	for _, rule := range store.List() {
+		if (iface == "" || rule.Options.Iface == iface) && (id == "" || rule.ID == id) {
+			stats = append(stats, ruleStats(r.Context(), rule))
+		}
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"stats": stats})
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"net"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+// --- Handler: /status (text UI) ---
+
+// optionSummary lists the set parameters of a rule as "key=value" pairs
+// (without iface and direction).
+func optionSummary(opts *V4NetworkOptions) string {
+	raw, _ := json.Marshal(opts)
+	fields := map[string]string{}
+	json.Unmarshal(raw, &fields)
+	delete(fields, "iface")
+	delete(fields, "direction")
+	pairs := make([]string, 0, len(fields))
+	for k, v := range fields {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// renderStatus writes the current interfaces, rules, counters and jobs as
+// plain-text tables.
+func renderStatus(r *http.Request) string {
+	var buf bytes.Buffer
+	hostname, _ := os.Hostname()
+	fmt.Fprintf(&buf, "netsim-in-a-box %s (API %s) on %s, %s\n", version, apiVersion, hostname, time.Now().Format(time.RFC1123))
+
+	tw := tabwriter.NewWriter(&buf, 0, 4, 2, ' ', 0)
+	rules := store.List()
+	ruled := map[string]*AppliedRule{}
+	for _, rule := range rules {
+		ruled[rule.Options.Iface] = rule
+	}
+
+	fmt.Fprintln(tw, "\nINTERFACES")
+	fmt.Fprintln(tw, "NAME\tIPV4\tIPV6\tRULE")
+	ifaces, _ := net.Interfaces()
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 && ruled[iface.Name] == nil || !ifaceAllowed(iface.Name) {
+			continue
+		}
+		rule := "-"
+		if applied, ok := ruled[iface.Name]; ok {
+			rule = applied.Options.Direction
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", iface.Name, orDash(interfaceAddr(iface.Name, true)), orDash(interfaceAddr(iface.Name, false)), rule)
+	}
+
+	fmt.Fprintln(tw, "\nRULES")
+	if len(rules) == 0 {
+		fmt.Fprintln(tw, "(none)")
+	} else {
+		fmt.Fprintln(tw, "IFACE\tDIRECTION\tREV\tAPPLIED\tBY\tPARAMETERS")
+		for _, rule := range rules {
+			fmt.Fprintf(tw, "%s\t%s\t%d\t%s\t%s\t%s\n", rule.Options.Iface, rule.Options.Direction, rule.Revision,
+				rule.AppliedAt.Format("2006-01-02 15:04:05"), rule.AppliedBy, optionSummary(rule.Options))
+		}
+
+		fmt.Fprintln(tw, "\nSTATS (since apply)")
+		fmt.Fprintln(tw, "IFACE\tSECONDS\tTX BYTES\tRX BYTES\tTX PKTS\tRX PKTS\tSHAPED PKTS\tDROPPED")
+		for _, rule := range rules {
+			stats := ruleStats(r.Context(), rule)
+			if stats.SinceApply == nil {
+				continue
+			}
+			c := stats.SinceApply
+			fmt.Fprintf(tw, "%s\t%.0f\t%d\t%d\t%d\t%d\t%d\t%d\n", stats.Iface, stats.Seconds,
+				c.TxBytes, c.RxBytes, c.TxPackets, c.RxPackets, c.QdiscPackets, c.QdiscDropped)
+		}
+	}
+
+	if jobs := sched.List(); len(jobs) > 0 {
+		fmt.Fprintln(tw, "\nJOBS")
+		fmt.Fprintln(tw, "NAME\tKIND\tIFACE\tSTARTED")
+		for _, job := range jobs {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", job.Name, job.Kind, job.Iface, time.Time(job.Started).Format("2006-01-02 15:04:05"))
+		}
+	}
+	tw.Flush()
+	return buf.String()
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
+
+// handleStatus renders the state server-side for headless consoles: plain
+// text for curl, or a minimal auto-refreshing HTML page for text browsers
+// (Accept: text/html, or ?format=html).
+func handleStatus(w http.ResponseWriter, r *http.Request) {
+	text := renderStatus(r)
+	w.Header().Set("Cache-Control", "no-store")
+	if r.URL.Query().Get("format") == "html" || r.URL.Query().Get("format") == "" && strings.Contains(r.Header.Get("Accept"), "text/html") {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprintf(w, "<!DOCTYPE html>\n<html><head><meta charset=\"utf-8\"><meta http-equiv=\"refresh\" content=\"5\"><title>netsim status</title></head>\n<body><pre>%s</pre></body></html>\n", html.EscapeString(text))
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, text)
+}
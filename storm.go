@@ -0,0 +1,355 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Storms (Duplication Bursts and Multicast Noise) ---
+
+// Storm stresses what sits behind an interface, in one of two modes:
+//   - "duplicate": bursts of packet duplication (Duplicate %, for Window,
+//     every Every), over the interface's rule, as a switching loop or a
+//     flapping bond produces for a moment;
+//   - "multicast" or "broadcast": UDP noise sent from the interface to
+//     Destination at PPS packets per second, which discovery protocols
+//     (SSDP, mDNS) and the switches on the segment must shrug off.
+type Storm struct {
+	Iface string `json:"iface"`
+	Mode  string `json:"mode"`
+
+	// duplicate
+	Direction string `json:"direction,omitempty"` // the rule the bursts go into (default outgoing)
+	Duplicate string `json:"duplicate,omitempty"` // % during a burst (default 50)
+	Window    string `json:"window,omitempty"`    // Go duration, a burst (default 2s)
+	Every     string `json:"every,omitempty"`     // Go duration, from burst to burst (default 30s)
+	Count     int    `json:"count,omitempty"`     // bursts (0 = until stopped)
+
+	// multicast, broadcast
+	PPS         int    `json:"pps,omitempty"`
+	Destination string `json:"destination,omitempty"` // address:port (default SSDP, or 255.255.255.255:9)
+	Size        int    `json:"size,omitempty"`        // UDP payload bytes (default 64)
+	Duration    string `json:"duration,omitempty"`    // Go duration (default: until stopped)
+
+	Bursts  int    `json:"bursts,omitempty"` // bursts started
+	InBurst bool   `json:"inBurst,omitempty"`
+	Sent    int64  `json:"sent,omitempty"`   // noise packets sent
+	Failed  int64  `json:"failed,omitempty"` // noise packets the socket refused
+	Error   string `json:"error,omitempty"`
+
+	window, every, duration time.Duration
+	dest                    netip.AddrPort
+	base                    *V4NetworkOptions // the rule a burst interrupted (nil: none)
+}
+
+// storms holds the storms by interface and mode (guarded by sched).
+var storms = map[string]*Storm{}
+
+// stormKey names the storm of iface in mode, and its job ("storm:" key).
+func stormKey(iface, mode string) string {
+	return iface + ":" + mode
+}
+
+// stormMaxPPS caps the noise of a storm.
+const stormMaxPPS = 100000
+
+// validate checks the storm and parses its settings.
+func (s *Storm) validate() error {
+	if s.Iface == "" {
+		return fmt.Errorf("storm: 'iface' is required")
+	}
+	iface, err := net.InterfaceByName(s.Iface)
+	if err != nil {
+		return fmt.Errorf("storm: interface '%s' not found", s.Iface)
+	}
+	switch s.Mode {
+	case "duplicate":
+		return s.validateBursts()
+	case "multicast", "broadcast":
+		if s.Mode == "multicast" && iface.Flags&net.FlagMulticast == 0 {
+			return fmt.Errorf("storm: '%s' does not support multicast", s.Iface)
+		}
+		return s.validateNoise()
+	}
+	return fmt.Errorf("storm: invalid 'mode' %q (duplicate, multicast or broadcast)", s.Mode)
+}
+
+// validateBursts checks the settings of the duplicate mode.
+func (s *Storm) validateBursts() error {
+	if s.Direction == "" {
+		s.Direction = "outgoing"
+	}
+	if s.Duplicate == "" {
+		s.Duplicate = "50"
+	}
+	if s.Window == "" {
+		s.Window = "2s"
+	}
+	if s.Every == "" {
+		s.Every = "30s"
+	}
+	if s.Count < 0 {
+		return fmt.Errorf("storm: 'count' must be >= 0")
+	}
+	var err error
+	if s.window, err = time.ParseDuration(s.Window); err != nil || s.window < 100*time.Millisecond {
+		return fmt.Errorf("storm: invalid 'window' %q (at least 100ms)", s.Window)
+	}
+	if s.every, err = time.ParseDuration(s.Every); err != nil || s.every <= s.window {
+		return fmt.Errorf("storm: invalid 'every' %q (above 'window')", s.Every)
+	}
+	return s.burstOptions(nil).validateNetem()
+}
+
+// validateNoise checks the settings of the multicast and broadcast modes.
+func (s *Storm) validateNoise() error {
+	if s.PPS <= 0 || s.PPS > stormMaxPPS {
+		return fmt.Errorf("storm: 'pps' must be above 0 and up to %d", stormMaxPPS)
+	}
+	if s.Size == 0 {
+		s.Size = 64
+	}
+	if s.Size < 0 || s.Size > 1472 {
+		return fmt.Errorf("storm: 'size' must be up to 1472 bytes")
+	}
+	if s.Destination == "" {
+		s.Destination = "239.255.255.250:1900" // SSDP
+		if s.Mode == "broadcast" {
+			s.Destination = "255.255.255.255:9" // discard
+		}
+	}
+	var err error
+	if s.dest, err = netip.ParseAddrPort(s.Destination); err != nil {
+		return fmt.Errorf("storm: invalid 'destination' %q (address:port)", s.Destination)
+	}
+	if s.Mode == "multicast" && !s.dest.Addr().IsMulticast() {
+		return fmt.Errorf("storm: 'destination' %s is not a multicast address", s.dest.Addr())
+	}
+	if s.Mode == "broadcast" && (!s.dest.Addr().Is4() || s.dest.Addr().IsMulticast()) {
+		return fmt.Errorf("storm: 'destination' %s is not an IPv4 broadcast address", s.dest.Addr())
+	}
+	if s.Duration != "" {
+		if s.duration, err = time.ParseDuration(s.Duration); err != nil || s.duration <= 0 {
+			return fmt.Errorf("storm: invalid 'duration' %q", s.Duration)
+		}
+	}
+	return nil
+}
+
+// burstOptions returns the rule of a burst: base (nil: no rule) with the
+// storm's duplication.
+func (s *Storm) burstOptions(base *V4NetworkOptions) *V4NetworkOptions {
+	opts := V4NetworkOptions{Iface: s.Iface, Direction: s.Direction}
+	if base != nil {
+		opts = *base
+	}
+	opts.Duplicate = s.Duplicate
+	return &opts
+}
+
+// runBursts duplicates the interface's packets for a window every Every,
+// putting its rule back in between.
+func (s *Storm) runBursts(ctx context.Context) {
+	log.Printf("[INFO] STORM: %s: duplicating %s%% for %v every %v", s.Iface, s.Duplicate, s.window, s.every)
+	for i := 0; s.Count == 0 || i < s.Count; i++ {
+		if i > 0 && !wait(ctx, s.every-s.window) {
+			return
+		}
+		var base *V4NetworkOptions
+		if rule := store.Get(s.Iface, s.Direction); rule != nil {
+			o := *rule.Options
+			base = &o
+		}
+		prev, err := applyStep(ctx, s.Iface, s.Direction, s.burstOptions(base), Actor{Source: "storm", User: "duplicate"}, base)
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("[ERROR] STORM: %s: failed to start a burst: %v", s.Iface, err)
+			continue
+		}
+		sched.mu.Lock()
+		s.base, s.InBurst = base, true
+		s.Bursts++
+		sched.mu.Unlock()
+		if !wait(ctx, s.window) {
+			return
+		}
+		if _, err := applyStep(ctx, s.Iface, s.Direction, base, Actor{Source: "storm", User: "calm"}, prev); err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Printf("[ERROR] STORM: %s: failed to end a burst: %v", s.Iface, err)
+		}
+		sched.mu.Lock()
+		s.InBurst = false
+		sched.mu.Unlock()
+	}
+	log.Printf("[INFO] STORM: %s: finished %d burst(s)", s.Iface, s.Count)
+}
+
+// runNoise sends UDP packets from the interface to the destination at PPS
+// until stopped (or for Duration).
+func (s *Storm) runNoise(ctx context.Context) {
+	if s.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, s.duration)
+		defer cancel()
+	}
+	network := "udp4"
+	if s.dest.Addr().Is6() {
+		network = "udp6"
+	}
+	lc := net.ListenConfig{Control: stormControl(s.Iface)}
+	conn, err := lc.ListenPacket(ctx, network, ":0")
+	if err != nil {
+		log.Printf("[ERROR] STORM: %s: %v", s.Iface, err)
+		sched.mu.Lock()
+		s.Error = err.Error()
+		sched.mu.Unlock()
+		return
+	}
+	defer conn.Close()
+	dest := &net.UDPAddr{IP: s.dest.Addr().AsSlice(), Port: int(s.dest.Port())}
+	if s.dest.Addr().Is6() {
+		dest.Zone = s.Iface
+	}
+	payload := make([]byte, s.Size)
+	copy(payload, "netsim storm")
+
+	log.Printf("[INFO] STORM: %s: sending %s noise to %s at %d pps", s.Iface, s.Mode, s.Destination, s.PPS)
+	tick := time.Second / time.Duration(s.PPS)
+	if tick < time.Millisecond {
+		tick = time.Millisecond
+	}
+	ticker := time.NewTicker(tick)
+	defer ticker.Stop()
+	start := time.Now()
+	var due, sent, failed int64
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		// (after a stall, at most a second of packets is caught up)
+		now := int64(time.Since(start).Seconds() * float64(s.PPS))
+		if now-due > int64(s.PPS) {
+			due = now - int64(s.PPS)
+		}
+		for ; due < now; due++ {
+			if _, err := conn.WriteTo(payload, dest); err != nil {
+				failed++
+			} else {
+				sent++
+			}
+		}
+		sched.mu.Lock()
+		s.Sent, s.Failed = sent, failed
+		sched.mu.Unlock()
+	}
+}
+
+// run runs the storm's mode.
+func (s *Storm) run(ctx context.Context) {
+	if s.Mode == "duplicate" {
+		s.runBursts(ctx)
+		return
+	}
+	s.runNoise(ctx)
+}
+
+// --- Handlers: /storms ---
+
+// handleStormStart starts (or replaces) a storm. Duplication bursts change
+// the interface's rule, so they replace its other jobs (and a setup or
+// reset stops them); noise runs beside them.
+func handleStormStart(w http.ResponseWriter, r *http.Request) {
+	s := &Storm{}
+	if err := json.NewDecoder(r.Body).Decode(s); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid storm JSON: %v", err), 400)
+		return
+	}
+	if err := s.validate(); err != nil {
+		respondWithLocalizedError(w, r, 400, err)
+		return
+	}
+	key, jobIface := stormKey(s.Iface, s.Mode), ""
+	if s.Mode == "duplicate" {
+		sched.StopIface(s.Iface)
+		jobIface = s.Iface
+	}
+	sched.mu.Lock()
+	storms[key] = s
+	snapshot := *s
+	sched.mu.Unlock()
+	sched.Start("storm:"+key, "storm", jobIface, s.run)
+	respondWithJSON(w, http.StatusOK, &snapshot)
+}
+
+// handleStormList returns the storms (running or finished).
+func handleStormList(w http.ResponseWriter, r *http.Request) {
+	type stormStatus struct {
+		Storm
+		Running bool `json:"running"`
+	}
+	list := []stormStatus{}
+	sched.mu.Lock()
+	for key, s := range storms {
+		_, running := sched.jobs["storm:"+key]
+		list = append(list, stormStatus{Storm: *s, Running: running})
+	}
+	sched.mu.Unlock()
+	sort.Slice(list, func(i, j int) bool {
+		return stormKey(list[i].Iface, list[i].Mode) < stormKey(list[j].Iface, list[j].Mode)
+	})
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleStormStop stops the storms of an interface ('mode' for one of
+// them). Stopped during a burst, the interface gets its rule back.
+func handleStormStop(w http.ResponseWriter, r *http.Request) {
+	iface := chi.URLParam(r, "iface")
+	modes := []string{"duplicate", "multicast", "broadcast"}
+	if mode := r.URL.Query().Get("mode"); mode != "" {
+		modes = []string{mode}
+	}
+	stopped := []string{}
+	for _, mode := range modes {
+		key := stormKey(iface, mode)
+		if !sched.Stop("storm:" + key) {
+			continue
+		}
+		stopped = append(stopped, mode)
+		sched.mu.Lock()
+		s := storms[key]
+		inBurst, base := s.InBurst, s.base
+		s.InBurst = false
+		sched.mu.Unlock()
+		if !inBurst {
+			continue
+		}
+		var prev *V4NetworkOptions
+		if rule := store.Get(iface, s.Direction); rule != nil {
+			prev = rule.Options
+		}
+		if _, err := applyStep(r.Context(), iface, s.Direction, base, Actor{Source: "storm", User: "calm"}, prev); err != nil {
+			respondWithError(w, fmt.Sprintf("storm: failed to end the burst on %s: %v", iface, err), 500)
+			return
+		}
+	}
+	if len(stopped) == 0 {
+		respondWithError(w, fmt.Sprintf("no storm running on '%s'", iface), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"iface": iface, "stopped": stopped})
+}
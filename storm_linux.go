@@ -0,0 +1,26 @@
+package main
+
+import "syscall"
+
+// stormControl binds the noise socket to the interface, so multicast and
+// broadcast packets leave through it, and keeps the host's own multicast
+// from looping back to it.
+func stormControl(iface string) func(network, address string, c syscall.RawConn) error {
+	return func(network, address string, c syscall.RawConn) error {
+		var err error
+		cerr := c.Control(func(fd uintptr) {
+			if err = syscall.BindToDevice(int(fd), iface); err != nil {
+				return
+			}
+			if network == "udp6" {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IPV6, syscall.IPV6_MULTICAST_LOOP, 0)
+			} else {
+				err = syscall.SetsockoptInt(int(fd), syscall.IPPROTO_IP, syscall.IP_MULTICAST_LOOP, 0)
+			}
+		})
+		if cerr != nil {
+			return cerr
+		}
+		return err
+	}
+}
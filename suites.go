@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Scenario Suites ---
+
+// A suite is a built-in scenario for a protocol's regression tests: a
+// timeline of impairments that exercises its known weak spots, the probes
+// that tell how it coped, and a report template with a row per step and a
+// column per probe metric. The steps carry no interface: running a suite
+// on one defines it as a scenario of the same name, which the library
+// exports like any other.
+
+// SuiteProbe is a measurement to take while a suite runs.
+type SuiteProbe struct {
+	Name    string   `json:"name"`
+	Command string   `json:"command,omitempty"` // how to take it, when it is a command
+	Metrics []string `json:"metrics"`           // report columns
+}
+
+// suiteStep is a step of a suite: its impairment (nil resets the interface).
+type suiteStep struct {
+	name     string
+	duration string
+	rule     *V4NetworkOptions
+}
+
+// ScenarioSuite is a built-in suite.
+type ScenarioSuite struct {
+	Name        string       `json:"name"`
+	Title       string       `json:"title"`
+	Description string       `json:"description"`
+	Probes      []SuiteProbe `json:"probes"`
+	Duration    string       `json:"duration"` // of one run
+
+	steps []suiteStep
+}
+
+// scenarioSuites are the built-in suites.
+var scenarioSuites = map[string]*ScenarioSuite{
+	"webrtc-resilience": {
+		Name:  "webrtc-resilience",
+		Title: "WebRTC resilience",
+		Description: "A call through jitter, bursty loss, a bandwidth collapse and a short outage, " +
+			"then back to a clean path: the jitter buffer, FEC/NACK, congestion control and ICE restarts each get a turn.",
+		Probes: []SuiteProbe{
+			{Name: "getStats (chrome://webrtc-internals)", Metrics: []string{"jitter ms", "packets lost", "frames dropped", "available bitrate kbps", "quality limitation"}},
+			{Name: "user-perceived quality", Metrics: []string{"MOS 1-5", "freezes"}},
+		},
+		steps: []suiteStep{
+			{"baseline", "30s", nil},
+			{"jitter", "60s", &V4NetworkOptions{Delay: "40", Jitter: "30", Distribution: "normal"}},
+			{"burst-loss", "60s", &V4NetworkOptions{Delay: "40", LossModel: "gemodel", LossGemodelP: "2", LossGemodelR: "25"}},
+			{"bandwidth-collapse", "60s", &V4NetworkOptions{Rate: "500kbit", Delay: "60"}},
+			{"outage", "5s", &V4NetworkOptions{LossModel: "random", Loss: "100"}},
+			{"recovery", "60s", nil},
+		},
+	},
+	"abr-ladder-stress": {
+		Name:  "abr-ladder-stress",
+		Title: "HLS/DASH ABR ladder stress",
+		Description: "The throughput walks down the bitrate ladder and back up, with one sudden drop: " +
+			"the player should switch renditions in time, without stalls or oscillations.",
+		Probes: []SuiteProbe{
+			{Name: "player events (hls.js, dash.js, ExoPlayer, AVPlayer)", Metrics: []string{"rendition kbps", "switches", "stalls", "stall seconds"}},
+			{Name: "startup", Metrics: []string{"time to first frame s"}},
+		},
+		steps: []suiteStep{
+			{"high", "45s", &V4NetworkOptions{Rate: "20mbit", Delay: "40"}},
+			{"8mbit", "45s", &V4NetworkOptions{Rate: "8mbit", Delay: "40"}},
+			{"4mbit", "45s", &V4NetworkOptions{Rate: "4mbit", Delay: "40"}},
+			{"1.5mbit", "45s", &V4NetworkOptions{Rate: "1500kbit", Delay: "60"}},
+			{"800kbit", "45s", &V4NetworkOptions{Rate: "800kbit", Delay: "80"}},
+			{"climb", "45s", &V4NetworkOptions{Rate: "4mbit", Delay: "40"}},
+			{"sudden-drop", "30s", &V4NetworkOptions{Rate: "600kbit", Delay: "40"}},
+			{"restore", "45s", &V4NetworkOptions{Rate: "20mbit", Delay: "40"}},
+		},
+	},
+	"tcp-bbr-vs-cubic": {
+		Name:  "tcp-bbr-vs-cubic",
+		Title: "TCP BBR vs CUBIC comparison",
+		Description: "A long fat path, then random loss and a long RTT: loss-based CUBIC backs off where BBR keeps its pace. " +
+			"Run the probes once per congestion control (or both at once, to see how they share the path).",
+		Probes: []SuiteProbe{
+			{Name: "iperf3 with BBR", Command: "iperf3 -c <server> -t 55 -C bbr", Metrics: []string{"bbr Mbps", "bbr retransmits"}},
+			{Name: "iperf3 with CUBIC", Command: "iperf3 -c <server> -t 55 -C cubic", Metrics: []string{"cubic Mbps", "cubic retransmits"}},
+			{Name: "socket state", Command: "ss -tin dst <server>", Metrics: []string{"rtt ms"}},
+		},
+		steps: []suiteStep{
+			{"long-fat", "60s", &V4NetworkOptions{Rate: "50mbit", Delay: "50"}},
+			{"random-loss-1%", "60s", &V4NetworkOptions{Rate: "50mbit", Delay: "50", LossModel: "random", Loss: "1"}},
+			{"random-loss-3%", "60s", &V4NetworkOptions{Rate: "50mbit", Delay: "50", LossModel: "random", Loss: "3"}},
+			{"long-rtt", "60s", &V4NetworkOptions{Rate: "50mbit", Delay: "150"}},
+			{"shallow-rate", "60s", &V4NetworkOptions{Rate: "10mbit", Delay: "20"}},
+		},
+	},
+}
+
+func init() {
+	for _, s := range scenarioSuites {
+		var total time.Duration
+		for _, step := range s.steps {
+			d, _ := time.ParseDuration(step.duration)
+			total += d
+		}
+		s.Duration = total.String()
+	}
+}
+
+// scenario returns the suite as a scenario on iface (direction: default
+// outgoing).
+func (s *ScenarioSuite) scenario(iface, direction string) *Scenario {
+	sc := &Scenario{Name: s.Name}
+	for _, step := range s.steps {
+		st := ScenarioStep{Name: step.name, Duration: step.duration}
+		if step.rule == nil {
+			st.Resets = []string{iface}
+		} else {
+			rule := *step.rule
+			rule.Iface, rule.Direction = iface, direction
+			st.Rules = []*V4NetworkOptions{&rule}
+		}
+		sc.Steps = append(sc.Steps, st)
+	}
+	return sc
+}
+
+// report returns the suite's report template (Markdown) for a run on
+// iface: a table with a row per step and a column per probe metric.
+func (s *ScenarioSuite) report(iface, direction string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# %s: %s (%s)\n\n%s\n\n", s.Title, iface, direction, s.Description)
+	fmt.Fprintf(&b, "Date: ____ (netsim %s, suite %s, %s)  \nSystem under test: ____\n\n## Probes\n\n", version, s.Name, s.Duration)
+	var metrics []string
+	for _, p := range s.Probes {
+		fmt.Fprintf(&b, "* %s", p.Name)
+		if p.Command != "" {
+			fmt.Fprintf(&b, ": `%s`", p.Command)
+		}
+		b.WriteString("\n")
+		metrics = append(metrics, p.Metrics...)
+	}
+	b.WriteString("\n## Results\n\n| Step | Duration | Impairment | " + strings.Join(metrics, " | ") + " |\n")
+	b.WriteString("|---|---|---|" + strings.Repeat("---|", len(metrics)) + "\n")
+	for _, step := range s.steps {
+		impairment := "none (reset)"
+		if step.rule != nil {
+			impairment = optionSummary(step.rule)
+		}
+		fmt.Fprintf(&b, "| %s | %s | %s |%s\n", step.name, step.duration, impairment, strings.Repeat("  |", len(metrics)))
+	}
+	b.WriteString("\n## Verdict\n\nPass / fail: ____\n\nNotes:\n")
+	return b.String()
+}
+
+// suiteTarget reads the interface and direction of a suite request.
+func suiteTarget(w http.ResponseWriter, r *http.Request) (*ScenarioSuite, string, string, bool) {
+	name := chi.URLParam(r, "name")
+	s := scenarioSuites[name]
+	if s == nil {
+		respondWithError(w, fmt.Sprintf("scenario: no suite '%s'", name), 404)
+		return nil, "", "", false
+	}
+	iface, direction := r.URL.Query().Get("iface"), r.URL.Query().Get("direction")
+	if direction == "" {
+		direction = "outgoing"
+	}
+	if iface == "" {
+		respondWithLocalizedError(w, r, 400, msg("rule.ifaceRequired"))
+		return nil, "", "", false
+	}
+	if !ifaceAllowed(iface) {
+		respondWithLocalizedError(w, r, 400, msg("rule.ifaceExcluded", iface))
+		return nil, "", "", false
+	}
+	if direction != "incoming" && direction != "outgoing" {
+		respondWithLocalizedError(w, r, 400, msg("rule.invalidDirection", direction))
+		return nil, "", "", false
+	}
+	return s, iface, direction, true
+}
+
+// --- Handlers: /scenarios/suites ---
+
+// handleSuiteList returns the built-in suites.
+func handleSuiteList(w http.ResponseWriter, r *http.Request) {
+	list := make([]*ScenarioSuite, 0, len(scenarioSuites))
+	for _, s := range scenarioSuites {
+		list = append(list, s)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleSuiteGet returns a suite, with its scenario on ?iface= when given.
+func handleSuiteGet(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Query().Get("iface") == "" {
+		name := chi.URLParam(r, "name")
+		if s := scenarioSuites[name]; s != nil {
+			respondWithJSON(w, http.StatusOK, s)
+		} else {
+			respondWithError(w, fmt.Sprintf("scenario: no suite '%s'", name), 404)
+		}
+		return
+	}
+	s, iface, direction, ok := suiteTarget(w, r)
+	if !ok {
+		return
+	}
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"suite": s, "scenario": s.scenario(iface, direction)})
+}
+
+// handleSuiteReport returns the report template of a suite on ?iface=.
+func handleSuiteReport(w http.ResponseWriter, r *http.Request) {
+	s, iface, direction, ok := suiteTarget(w, r)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "text/markdown; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte(s.report(iface, direction)))
+}
+
+// handleSuiteRun defines the suite as a scenario on ?iface= and starts it
+// (replacing a scenario of the same name).
+func handleSuiteRun(w http.ResponseWriter, r *http.Request) {
+	s, iface, direction, ok := suiteTarget(w, r)
+	if !ok {
+		return
+	}
+	sc := s.scenario(iface, direction)
+	if err := sc.validate(); err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	for _, step := range sc.Steps {
+		for _, rule := range step.Rules {
+			if err := rule.validateNetem(); err != nil {
+				respondWithLocalizedError(w, r, 400, err)
+				return
+			}
+		}
+	}
+	sched.mu.Lock()
+	scenarios[sc.Name] = sc
+	sched.mu.Unlock()
+	sched.Start("scenario:"+sc.Name, "scenario", "", sc.run)
+	log.Printf("[INFO] SCENARIO: Suite %s started on %s (%s, %s)", s.Name, iface, direction, s.Duration)
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"scenario": sc, "probes": s.Probes, "duration": s.Duration})
+}
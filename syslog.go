@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// --- Syslog Shipping ---
+
+// The log shipper copies log lines to a remote syslog server (RFC 5424),
+// over UDP, TCP or TLS, so headless boxes feed central logging without a
+// sidecar. It is enabled by SYSLOG_ADDR; by default only the [AUDIT],
+// [ERROR] and [CRITICAL] lines are shipped (SYSLOG_LEVELS). The local log
+// is unchanged, and a slow or unreachable server never blocks it: lines
+// are queued and dropped when the queue is full.
+
+// syslogSeverity maps the log tags to RFC 5424 severities.
+var syslogSeverity = map[string]int{
+	"CRITICAL": 2,
+	"ERROR":    3,
+	"WARN":     4,
+	"AUDIT":    5, // notice
+	"INFO":     6,
+	"ACCESS":   6,
+	"DEBUG":    7,
+}
+
+// syslogFacilities are the facility names SYSLOG_FACILITY accepts.
+var syslogFacilities = map[string]int{
+	"user": 1, "daemon": 3, "auth": 4, "authpriv": 10,
+	"local0": 16, "local1": 17, "local2": 18, "local3": 19,
+	"local4": 20, "local5": 21, "local6": 22, "local7": 23,
+}
+
+// syslogQueueSize is how many lines wait for the server before new ones
+// are dropped.
+const syslogQueueSize = 1024
+
+// syslogShipper is an io.Writer for the log package that forwards the
+// selected lines to the server.
+type syslogShipper struct {
+	network  string // udp, tcp or tls
+	addr     string
+	tls      *tls.Config
+	facility int
+	levels   map[string]bool
+	hostname string
+
+	queue   chan []byte
+	dropped atomic.Uint64
+}
+
+// configureSyslog reads SYSLOG_ADDR (udp://, tcp:// or tls://host:port),
+// SYSLOG_LEVELS, SYSLOG_FACILITY and SYSLOG_TLS_CA, and tees the log to the
+// server. Without SYSLOG_ADDR nothing is shipped.
+func configureSyslog() error {
+	raw := os.Getenv("SYSLOG_ADDR")
+	if raw == "" {
+		return nil
+	}
+	u, err := url.Parse(raw)
+	if err != nil || u.Host == "" {
+		return fmt.Errorf("invalid SYSLOG_ADDR %q (expected udp://, tcp:// or tls://host:port)", raw)
+	}
+	s := &syslogShipper{network: u.Scheme, addr: u.Host, levels: map[string]bool{}, queue: make(chan []byte, syslogQueueSize)}
+	if u.Port() == "" {
+		port := "514"
+		if s.network == "tls" {
+			port = "6514"
+		}
+		s.addr = net.JoinHostPort(u.Hostname(), port)
+	}
+	switch s.network {
+	case "udp", "tcp":
+	case "tls":
+		s.tls = &tls.Config{ServerName: u.Hostname(), MinVersion: tls.VersionTLS12}
+		if caFile := os.Getenv("SYSLOG_TLS_CA"); caFile != "" {
+			pem, err := os.ReadFile(caFile)
+			if err != nil {
+				return fmt.Errorf("read SYSLOG_TLS_CA: %w", err)
+			}
+			s.tls.RootCAs = x509.NewCertPool()
+			if !s.tls.RootCAs.AppendCertsFromPEM(pem) {
+				return fmt.Errorf("no certificate in SYSLOG_TLS_CA")
+			}
+		}
+	default:
+		return fmt.Errorf("invalid SYSLOG_ADDR scheme %q (udp, tcp or tls)", u.Scheme)
+	}
+
+	levels := os.Getenv("SYSLOG_LEVELS")
+	if levels == "" {
+		levels = "AUDIT,ERROR,CRITICAL"
+	}
+	for _, level := range strings.Split(levels, ",") {
+		level = strings.ToUpper(strings.TrimSpace(level))
+		if _, ok := syslogSeverity[level]; !ok {
+			return fmt.Errorf("invalid SYSLOG_LEVELS entry %q", level)
+		}
+		s.levels[level] = true
+	}
+
+	facility := os.Getenv("SYSLOG_FACILITY")
+	if facility == "" {
+		facility = "local0"
+	}
+	var ok bool
+	if s.facility, ok = syslogFacilities[strings.ToLower(facility)]; !ok {
+		return fmt.Errorf("invalid SYSLOG_FACILITY %q", facility)
+	}
+
+	s.hostname, _ = os.Hostname()
+	if s.hostname == "" {
+		s.hostname = "-"
+	}
+	go s.run()
+	log.SetOutput(io.MultiWriter(os.Stderr, s))
+	log.Printf("[INFO] SYSLOG: Shipping %s lines to %s://%s", levels, s.network, s.addr)
+	return nil
+}
+
+// Write queues a log line (the log package writes one per call) when its
+// tag is selected.
+func (s *syslogShipper) Write(p []byte) (int, error) {
+	line := string(bytes.TrimRight(p, "\n"))
+	tag, msg := "INFO", line
+	// Skip the date and time the log package prefixes
+	if i := strings.Index(line, "["); i >= 0 {
+		if j := strings.Index(line[i:], "]"); j > 0 {
+			tag, msg = line[i+1:i+j], strings.TrimSpace(line[i+j+1:])
+		}
+	}
+	severity, known := syslogSeverity[tag]
+	if !known {
+		tag, severity, msg = "INFO", syslogSeverity["INFO"], line
+	}
+	if !s.levels[tag] {
+		return len(p), nil
+	}
+	// <PRI>VERSION TIMESTAMP HOSTNAME APP-NAME PROCID MSGID SD MSG
+	record := fmt.Sprintf("<%d>1 %s %s netsim %d %s - %s",
+		s.facility*8+severity, time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"), s.hostname, os.Getpid(), tag, msg)
+	select {
+	case s.queue <- []byte(record):
+	default:
+		s.dropped.Add(1)
+	}
+	return len(p), nil
+}
+
+// run sends the queued records, reconnecting after errors. A record that
+// fails to send is dropped.
+func (s *syslogShipper) run() {
+	var conn net.Conn
+	var lastErr time.Time
+	for record := range s.queue {
+		if conn == nil {
+			var err error
+			if conn, err = s.dial(); err != nil {
+				s.dropped.Add(1)
+				if time.Since(lastErr) > time.Minute {
+					// stderr only: logging would queue another record
+					fmt.Fprintf(os.Stderr, "%s [WARN] SYSLOG: Cannot reach %s: %v\n", time.Now().UTC().Format("2006/01/02 15:04:05"), s.addr, err)
+					lastErr = time.Now()
+				}
+				continue
+			}
+		}
+		if n := s.dropped.Swap(0); n > 0 {
+			s.send(conn, []byte(fmt.Sprintf("<%d>1 %s %s netsim %d WARN - [WARN] SYSLOG: %d lines dropped",
+				s.facility*8+syslogSeverity["WARN"], time.Now().UTC().Format("2006-01-02T15:04:05.000000Z"), s.hostname, os.Getpid(), n)))
+		}
+		if err := s.send(conn, record); err != nil {
+			conn.Close()
+			conn = nil
+			s.dropped.Add(1)
+		}
+	}
+}
+
+// dial connects to the server.
+func (s *syslogShipper) dial() (net.Conn, error) {
+	dialer := &net.Dialer{Timeout: 5 * time.Second}
+	if s.tls != nil {
+		return tls.DialWithDialer(dialer, "tcp", s.addr, s.tls)
+	}
+	return dialer.Dial(s.network, s.addr)
+}
+
+// send writes a record: one datagram over UDP, octet-counted (RFC 6587)
+// over TCP and TLS.
+func (s *syslogShipper) send(conn net.Conn, record []byte) error {
+	conn.SetWriteDeadline(time.Now().Add(5 * time.Second))
+	if s.network != "udp" {
+		record = append([]byte(strconv.Itoa(len(record))+" "), record...)
+	}
+	_, err := conn.Write(record)
+	return err
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"net/http"
+	"os"
+	"runtime"
+	"strings"
+	"time"
+)
+
+// --- Environment Summary (/system) ---
+
+// startedAt is when this process started.
+var startedAt = time.Now()
+
+// gateway is the state of the Default Gateway Mode, set by
+// enableGatewayMode.
+var gateway struct {
+	enabled   bool
+	wanIface  string
+	wanIface4 string // the masqueraded IPv4 WAN interface, "" on IPv6-only hosts
+}
+
+// listenAddr is the address the API listens on (e.g. ":2023").
+var listenAddr string
+
+// SystemInfo describes the environment netsim runs in, for support requests.
+type SystemInfo struct {
+	Version    string `json:"softwareVersion"`
+	ApiVersion string `json:"apiVersion"`
+	Hostname   string `json:"hostname"`
+	OS         string `json:"os"`     // PRETTY_NAME of /etc/os-release
+	Kernel     string `json:"kernel"` // uname -r
+	Arch       string `json:"arch"`
+	GoVersion  string `json:"goVersion"`
+	Iproute2   string `json:"iproute2"`
+	Tcconfig   string `json:"tcconfig,omitempty"` // only when tcconfig is installed
+	Container  string `json:"container"`          // docker, podman, kubernetes, lxc, or "" (host)
+	Gateway    struct {
+		Enabled   bool   `json:"enabled"`
+		WanIface  string `json:"wanIface,omitempty"`
+		IPForward bool   `json:"ipForward"`
+	} `json:"gatewayMode"`
+	Listen        string          `json:"listen"`
+	StartedAt     TcTime          `json:"startedAt"`
+	UptimeSeconds float64         `json:"uptimeSeconds"`
+	Features      map[string]bool `json:"features"`
+	IngressMode   string          `json:"ingressMode"`
+}
+
+// osRelease returns the PRETTY_NAME of /etc/os-release (or runtime.GOOS).
+func osRelease() string {
+	f, err := os.Open("/etc/os-release")
+	if err != nil {
+		return runtime.GOOS
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		if v, ok := strings.CutPrefix(s.Text(), "PRETTY_NAME="); ok {
+			return strings.Trim(v, `"`)
+		}
+	}
+	return runtime.GOOS
+}
+
+// containerRuntime detects the container netsim runs in, or "" on a host.
+func containerRuntime() string {
+	if os.Getenv("KUBERNETES_SERVICE_HOST") != "" {
+		return "kubernetes"
+	}
+	if _, err := os.Stat("/.dockerenv"); err == nil {
+		return "docker"
+	}
+	if _, err := os.Stat("/run/.containerenv"); err == nil {
+		return "podman"
+	}
+	if c := os.Getenv("container"); c != "" { // set by systemd-nspawn, lxc, podman
+		return c
+	}
+	if b, err := os.ReadFile("/proc/1/cgroup"); err == nil {
+		for _, name := range []string{"docker", "kubepods", "lxc", "containerd"} {
+			if strings.Contains(string(b), name) {
+				return name
+			}
+		}
+	}
+	return ""
+}
+
+// commandVersion returns the first line of the output of name args, or "".
+func commandVersion(ctx context.Context, name string, args ...string) string {
+	out, err := command(ctx, name, args...).CombinedOutput()
+	if err != nil {
+		return ""
+	}
+	line, _, _ := strings.Cut(strings.TrimSpace(string(out)), "\n")
+	return line
+}
+
+// systemInfo collects the environment summary.
+func systemInfo(ctx context.Context) *SystemInfo {
+	info := &SystemInfo{
+		Version:       version,
+		ApiVersion:    apiVersion,
+		OS:            osRelease(),
+		Arch:          runtime.GOARCH,
+		GoVersion:     runtime.Version(),
+		Iproute2:      commandVersion(ctx, "tc", "-V"),
+		Tcconfig:      commandVersion(ctx, "tcset", "--version"),
+		Container:     containerRuntime(),
+		Listen:        listenAddr,
+		StartedAt:     TcTime(startedAt),
+		UptimeSeconds: roundTo(time.Since(startedAt).Seconds(), 0),
+		Features:      capabilities(),
+		IngressMode:   defaultIngressMode(),
+	}
+	info.Hostname, _ = os.Hostname()
+	if b, err := os.ReadFile("/proc/sys/kernel/osrelease"); err == nil {
+		info.Kernel = strings.TrimSpace(string(b))
+	}
+	info.Gateway.Enabled = gateway.enabled
+	info.Gateway.WanIface = gateway.wanIface
+	if b, err := os.ReadFile("/proc/sys/net/ipv4/ip_forward"); err == nil {
+		info.Gateway.IPForward = strings.TrimSpace(string(b)) == "1"
+	}
+	return info
+}
+
+// handleSystem returns the environment summary as one JSON object to attach
+// to support requests.
+func handleSystem(w http.ResponseWriter, r *http.Request) {
+	respondWithJSON(w, http.StatusOK, systemInfo(r.Context()))
+}
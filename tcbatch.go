@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+)
+
+// --- tc Batches ---
+
+// A setup runs dozens of tc commands (hundreds with selectors, flow
+// sampling or per-queue trees), and each one is a process that opens its
+// own netlink socket. In a batch, the consecutive mutating commands are
+// queued and run by one 'tc -batch' when something else has to run (a
+// read, an 'ip' command) or the setup ends. A batch that fails is not
+// picked apart: the setup is redone command by command, which has the
+// precise errors and the tolerance of the optional steps (e.g. IPv6
+// filters). TC_BATCH=false turns batches off.
+
+// tcBatch is the queue of a setup's tc commands.
+type tcBatch struct {
+	lines [][]string
+	err   error // the first failure: the rest of the setup is skipped
+}
+
+type tcBatchKey struct{}
+
+// tcBatchEnabled reports whether setups batch their tc commands.
+func tcBatchEnabled() bool {
+	return setting("TC_BATCH") != "false"
+}
+
+// withTCBatch returns a context in which runCommand queues tc commands.
+func withTCBatch(ctx context.Context) (context.Context, *tcBatch) {
+	b := &tcBatch{}
+	return context.WithValue(ctx, tcBatchKey{}, b), b
+}
+
+// tcBatchFrom returns the batch of ctx, or nil.
+func tcBatchFrom(ctx context.Context) *tcBatch {
+	b, _ := ctx.Value(tcBatchKey{}).(*tcBatch)
+	return b
+}
+
+// queue adds a tc command to the batch, and reports false when it cannot
+// be written as a batch line (an empty argument, or one with spaces).
+func (b *tcBatch) queue(args []string) bool {
+	for _, arg := range args {
+		if arg == "" || strings.ContainsAny(arg, " \t\n\"'\\#") {
+			return false
+		}
+	}
+	b.lines = append(b.lines, args)
+	return true
+}
+
+// flush runs the queued commands with one 'tc -batch'.
+func (b *tcBatch) flush(ctx context.Context) error {
+	if b.err != nil || len(b.lines) == 0 {
+		return b.err
+	}
+	lines := b.lines
+	b.lines = nil
+	var in strings.Builder
+	for _, args := range lines {
+		in.WriteString(strings.Join(args, " ") + "\n")
+	}
+	log.Printf("[INFO] V4: Executing: tc -batch (%d commands)", len(lines))
+	cmd := command(ctx, "tc", "-batch", "-")
+	cmd.Stdin = strings.NewReader(in.String())
+	done := traceCommand(ctx, "tc", []string{"-batch", "-"})
+	out, err := cmd.CombinedOutput()
+	done(err)
+	if err != nil {
+		b.err = fmt.Errorf("tc -batch (%d commands): %s", len(lines), strings.TrimSpace(string(out)))
+		log.Printf("[WARN] V4: %v", b.err)
+		return b.err
+	}
+	for _, args := range lines {
+		trackCommand(ctx, "tc", args, nil)
+	}
+	return nil
+}
+
+// flushTCBatch runs the commands queued in ctx before another command.
+func flushTCBatch(ctx context.Context) {
+	if b := tcBatchFrom(ctx); b != nil {
+		b.flush(ctx)
+	}
+}
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- Impact on Live TCP Connections ---
+
+// TCPInfo is the state of a TCP connection as 'ss -ti' reports it.
+type TCPInfo struct {
+	RttMs        float64 `json:"rttMs"`
+	RttVarMs     float64 `json:"rttVarMs"`
+	Cwnd         int     `json:"cwnd"`
+	Ssthresh     int     `json:"ssthresh,omitempty"`
+	Retrans      int     `json:"retrans"` // segments retransmitted in total
+	Lost         int     `json:"lost"`    // segments currently considered lost
+	BytesSent    int64   `json:"bytesSent"`
+	BytesRetrans int64   `json:"bytesRetrans"`
+}
+
+// TCPConnImpact is a connection from an interface's address: its state
+// when the interface's rule was applied and now, and how it changed.
+type TCPConnImpact struct {
+	Local  string   `json:"local"`
+	Peer   string   `json:"peer"`
+	Before *TCPInfo `json:"before,omitempty"` // nil: opened since the rule was applied
+	Now    *TCPInfo `json:"now,omitempty"`    // nil: closed since
+
+	RttDeltaMs   float64 `json:"rttDeltaMs,omitempty"`
+	CwndDelta    int     `json:"cwndDelta,omitempty"`
+	RetransDelta int     `json:"retransDelta,omitempty"`
+}
+
+// tcpSnapshot is the state of the connections of an interface at a time.
+type tcpSnapshot struct {
+	at    time.Time
+	conns map[string]*TCPInfo // by "local peer"
+}
+
+// tcpBefore holds the snapshot of each interface taken before its rule was
+// last applied.
+var tcpBefore = struct {
+	sync.Mutex
+	snapshots map[string]*tcpSnapshot
+}{snapshots: map[string]*tcpSnapshot{}}
+
+// parseSSInfo parses the info line of 'ss -ti' (e.g. "cubic rtt:1.2/0.6
+// cwnd:10 retrans:0/3 ..."). Counters ss leaves out are zero.
+func parseSSInfo(line string) *TCPInfo {
+	info := &TCPInfo{}
+	for _, field := range strings.Fields(line) {
+		key, value, ok := strings.Cut(field, ":")
+		if !ok {
+			continue
+		}
+		switch key {
+		case "rtt":
+			rtt, rttVar, _ := strings.Cut(value, "/")
+			info.RttMs, _ = strconv.ParseFloat(rtt, 64)
+			info.RttVarMs, _ = strconv.ParseFloat(rttVar, 64)
+		case "cwnd":
+			info.Cwnd, _ = strconv.Atoi(value)
+		case "ssthresh":
+			info.Ssthresh, _ = strconv.Atoi(value)
+		case "retrans":
+			// (current/total)
+			_, total, _ := strings.Cut(value, "/")
+			info.Retrans, _ = strconv.Atoi(total)
+		case "lost":
+			info.Lost, _ = strconv.Atoi(value)
+		case "bytes_sent":
+			info.BytesSent, _ = strconv.ParseInt(value, 10, 64)
+		case "bytes_retrans":
+			info.BytesRetrans, _ = strconv.ParseInt(value, 10, 64)
+		}
+	}
+	return info
+}
+
+// parseSS parses 'ss -tinH state established': a line per socket (Recv-Q,
+// Send-Q, local and peer address), each followed by an indented info line.
+// Only the sockets whose local address is in local are kept.
+func parseSS(out string, local []net.IP) map[string]*TCPInfo {
+	conns := map[string]*TCPInfo{}
+	key := ""
+	for _, line := range strings.Split(out, "\n") {
+		if line == "" {
+			continue
+		}
+		if line[0] == ' ' || line[0] == '\t' {
+			if key != "" {
+				conns[key] = parseSSInfo(line)
+			}
+			key = ""
+			continue
+		}
+		key = ""
+		fields := strings.Fields(line)
+		if len(fields) < 4 {
+			continue
+		}
+		host, _, err := net.SplitHostPort(fields[2])
+		if err != nil {
+			continue
+		}
+		host, _, _ = strings.Cut(host, "%") // (zone of link-local addresses)
+		ip := net.ParseIP(host)
+		for _, addr := range local {
+			if ip != nil && ip.Equal(addr) {
+				key = fields[2] + " " + fields[3]
+			}
+		}
+	}
+	return conns
+}
+
+// ifaceIPs returns the addresses of an interface.
+func ifaceIPs(name string) ([]net.IP, error) {
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	var ips []net.IP
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			ips = append(ips, ipnet.IP)
+		}
+	}
+	return ips, nil
+}
+
+// snapshotTCP reads the established TCP connections from the addresses of
+// iface.
+func snapshotTCP(ctx context.Context, iface string) (*tcpSnapshot, error) {
+	ips, err := ifaceIPs(iface)
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-tinH", "state", "established"}
+	done := traceCommand(ctx, "ss", args)
+	out, err := command(ctx, "ss", args...).Output()
+	done(err)
+	if err != nil {
+		return nil, fmt.Errorf("ss: %w", err)
+	}
+	return &tcpSnapshot{at: time.Now(), conns: parseSS(string(out), ips)}, nil
+}
+
+// recordTCPBefore keeps the connections of iface before its rule changes,
+// to compare with later.
+func recordTCPBefore(ctx context.Context, iface string) {
+	if isDarwin {
+		return
+	}
+	snapshot, err := snapshotTCP(ctx, iface)
+	if err != nil {
+		log.Printf("[WARN] V4: Failed to read the TCP connections of %s: %v", iface, err)
+		return
+	}
+	tcpBefore.Lock()
+	tcpBefore.snapshots[iface] = snapshot
+	tcpBefore.Unlock()
+}
+
+// tcpImpact compares the connections before and now, sorted by the
+// retransmissions they suffered since (most first).
+func tcpImpact(before, now *tcpSnapshot) []*TCPConnImpact {
+	keys := map[string]bool{}
+	for key := range now.conns {
+		keys[key] = true
+	}
+	if before != nil {
+		for key := range before.conns {
+			keys[key] = true
+		}
+	}
+	impacts := []*TCPConnImpact{}
+	for key := range keys {
+		local, peer, _ := strings.Cut(key, " ")
+		c := &TCPConnImpact{Local: local, Peer: peer, Now: now.conns[key]}
+		if before != nil {
+			c.Before = before.conns[key]
+		}
+		if c.Before != nil && c.Now != nil {
+			c.RttDeltaMs = roundTo(c.Now.RttMs-c.Before.RttMs, 3)
+			c.CwndDelta = c.Now.Cwnd - c.Before.Cwnd
+			c.RetransDelta = c.Now.Retrans - c.Before.Retrans
+		}
+		impacts = append(impacts, c)
+	}
+	sort.Slice(impacts, func(i, j int) bool {
+		if impacts[i].RetransDelta != impacts[j].RetransDelta {
+			return impacts[i].RetransDelta > impacts[j].RetransDelta
+		}
+		return impacts[i].Local+impacts[i].Peer < impacts[j].Local+impacts[j].Peer
+	})
+	return impacts
+}
+
+// --- Handlers: /connections ---
+
+// handleConnections reports the established TCP connections from the
+// addresses of 'iface', with their state before the interface's rule was
+// last applied (or adjusted) and now.
+func handleConnections(w http.ResponseWriter, r *http.Request) {
+	iface := r.URL.Query().Get("iface")
+	if iface == "" {
+		respondWithError(w, "connections: 'iface' is required", 400)
+		return
+	}
+	if _, err := net.InterfaceByName(iface); err != nil {
+		respondWithError(w, fmt.Sprintf("interface '%s' not found", iface), 404)
+		return
+	}
+	if isDarwin {
+		respondWithError(w, "connections are not available on this platform", 501)
+		return
+	}
+	now, err := snapshotTCP(r.Context(), iface)
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("connections: %v", err), 500)
+		return
+	}
+	tcpBefore.Lock()
+	before := tcpBefore.snapshots[iface]
+	tcpBefore.Unlock()
+
+	response := map[string]interface{}{
+		"iface":       iface,
+		"at":          TcTime(now.at),
+		"connections": tcpImpact(before, now),
+	}
+	if before != nil {
+		response["before"] = TcTime(before.at)
+	}
+	if rule := store.Get(iface, ""); rule != nil {
+		response["rule"] = rule.Options
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-chi/chi/v5/middleware"
+)
+
+// --- Metrics and Tracing ---
+
+// durationBuckets are the upper bounds (seconds) of the duration
+// histograms: tc/ip calls take milliseconds, a slow one seconds.
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// histogram counts observations per bucket (not cumulative).
+type histogram struct {
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+// histogramVec is a set of histograms keyed by their label values.
+type histogramVec struct {
+	mu     sync.Mutex
+	name   string
+	help   string
+	labels []string
+	series map[string]*histogram // key: label values joined by "\x00"
+}
+
+func newHistogramVec(name, help string, labels ...string) *histogramVec {
+	return &histogramVec{name: name, help: help, labels: labels, series: map[string]*histogram{}}
+}
+
+// observe records d for the label values.
+func (h *histogramVec) observe(d time.Duration, values ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := strings.Join(values, "\x00")
+	s, ok := h.series[key]
+	if !ok {
+		s = &histogram{counts: make([]uint64, len(durationBuckets))}
+		h.series[key] = s
+	}
+	secs := d.Seconds()
+	for i, le := range durationBuckets {
+		if secs <= le {
+			s.counts[i]++
+			break
+		}
+	}
+	s.sum += secs
+	s.count++
+}
+
+// write renders the histograms in the Prometheus text format.
+func (h *histogramVec) write(buf *bytes.Buffer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(buf, "# HELP %s %s\n# TYPE %s histogram\n", h.name, h.help, h.name)
+	keys := make([]string, 0, len(h.series))
+	for key := range h.series {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		s := h.series[key]
+		var pairs []string
+		for i, value := range strings.Split(key, "\x00") {
+			pairs = append(pairs, fmt.Sprintf("%s=%q", h.labels[i], value))
+		}
+		labels := strings.Join(pairs, ",")
+		var cumulative uint64
+		for i, le := range durationBuckets {
+			cumulative += s.counts[i]
+			fmt.Fprintf(buf, "%s_bucket{%s,le=\"%g\"} %d\n", h.name, labels, le, cumulative)
+		}
+		fmt.Fprintf(buf, "%s_bucket{%s,le=\"+Inf\"} %d\n", h.name, labels, s.count)
+		fmt.Fprintf(buf, "%s_sum{%s} %g\n", h.name, labels, s.sum)
+		fmt.Fprintf(buf, "%s_count{%s} %d\n", h.name, labels, s.count)
+	}
+}
+
+var (
+	commandDurations = newHistogramVec("netsim_command_duration_seconds",
+		"Duration of the commands netsim runs (tc, ip).", "command", "status")
+	requestDurations = newHistogramVec("netsim_http_request_duration_seconds",
+		"Duration of the API requests, by route.", "method", "route", "code")
+)
+
+// commandLabel names a command by its program and first two words, e.g.
+// "tc qdisc add" for "tc -s qdisc add dev eth0 ...", so the label has few
+// values.
+func commandLabel(name string, args []string) string {
+	words := []string{name}
+	for _, arg := range args {
+		if len(words) == 3 {
+			break
+		}
+		if !strings.HasPrefix(arg, "-") {
+			words = append(words, arg)
+		}
+	}
+	return strings.Join(words, " ")
+}
+
+// traceCommand starts the measurement of a command. The returned function
+// ends it: it records the duration, logs slow commands (SLOW_COMMAND,
+// default 1s) and ends the command's span.
+func traceCommand(ctx context.Context, name string, args []string) func(error) {
+	label := commandLabel(name, args)
+	span := startSpan(ctx, label, spanKindClient)
+	return func(err error) {
+		d := time.Since(span.start)
+		status := "ok"
+		if err != nil {
+			status = "error"
+		}
+		commandDurations.observe(d, label, status)
+		if d >= slowCommand {
+			log.Printf("[WARN] Slow command (%s): %s %s", d.Round(time.Millisecond), name, strings.Join(args, " "))
+		}
+		span.attrs["command.line"] = name + " " + strings.Join(args, " ")
+		span.end(err)
+	}
+}
+
+// slowCommand is the duration above which commands are logged.
+var slowCommand = envDuration("SLOW_COMMAND", time.Second)
+
+// TelemetryMiddleware measures each request by route and opens its span,
+// the parent of the spans of the commands it runs.
+func TelemetryMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx := r.Context()
+		if parent, ok := parseTraceparent(r.Header.Get("traceparent")); ok {
+			ctx = context.WithValue(ctx, spanKey{}, parent)
+		}
+		span := startSpan(ctx, r.Method+" "+r.URL.Path, spanKindServer)
+		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
+
+		next.ServeHTTP(ww, r.WithContext(context.WithValue(ctx, spanKey{}, span)))
+
+		route := r.URL.Path
+		if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+			route = rctx.RoutePattern()
+		}
+		requestDurations.observe(time.Since(span.start), r.Method, route, fmt.Sprint(ww.Status()))
+		span.name = r.Method + " " + route
+		span.attrs["http.method"] = r.Method
+		span.attrs["http.route"] = route
+		span.attrs["http.status_code"] = fmt.Sprint(ww.Status())
+		var err error
+		if ww.Status() >= 500 {
+			err = fmt.Errorf("HTTP %d", ww.Status())
+		}
+		span.end(err)
+	})
+}
+
+// handleMetrics serves the histograms in the Prometheus text format.
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf bytes.Buffer
+	commandDurations.write(&buf)
+	requestDurations.write(&buf)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write(buf.Bytes())
+}
+
+// --- Tracing (OTLP/HTTP JSON) ---
+
+const (
+	spanKindServer = 2
+	spanKindClient = 3
+)
+
+// span is a finished or running operation of a trace.
+type span struct {
+	traceID [16]byte
+	spanID  [8]byte
+	parent  [8]byte
+	name    string
+	kind    int
+	start   time.Time
+	attrs   map[string]string
+}
+
+type spanKey struct{}
+
+// startSpan starts a span, a child of the span in ctx if any.
+func startSpan(ctx context.Context, name string, kind int) *span {
+	s := &span{name: name, kind: kind, start: time.Now(), attrs: map[string]string{}}
+	if parent, ok := ctx.Value(spanKey{}).(*span); ok {
+		s.traceID, s.parent = parent.traceID, parent.spanID
+	} else {
+		rand.Read(s.traceID[:])
+	}
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// parseTraceparent reads a W3C traceparent header
+// ("00-<trace id>-<parent id>-<flags>") as a remote parent span.
+func parseTraceparent(header string) (*span, bool) {
+	parts := strings.Split(header, "-")
+	if len(parts) != 4 || len(parts[1]) != 32 || len(parts[2]) != 16 {
+		return nil, false
+	}
+	s := &span{}
+	if _, err := hex.Decode(s.traceID[:], []byte(parts[1])); err != nil {
+		return nil, false
+	}
+	if _, err := hex.Decode(s.spanID[:], []byte(parts[2])); err != nil {
+		return nil, false
+	}
+	return s, true
+}
+
+// end finishes the span and queues it for export (if tracing is enabled).
+func (s *span) end(err error) {
+	if tracer.endpoint == "" {
+		return
+	}
+	out := otlpSpan{
+		TraceID:           hex.EncodeToString(s.traceID[:]),
+		SpanID:            hex.EncodeToString(s.spanID[:]),
+		Name:              s.name,
+		Kind:              s.kind,
+		StartTimeUnixNano: uint64(s.start.UnixNano()),
+		EndTimeUnixNano:   uint64(time.Now().UnixNano()),
+	}
+	if s.parent != [8]byte{} {
+		out.ParentSpanID = hex.EncodeToString(s.parent[:])
+	}
+	keys := make([]string, 0, len(s.attrs))
+	for k := range s.attrs {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		out.Attributes = append(out.Attributes, otlpAttribute{Key: k, Value: otlpValue{StringValue: s.attrs[k]}})
+	}
+	if err != nil {
+		out.Status = &otlpStatus{Code: 2, Message: err.Error()}
+	}
+	select {
+	case tracer.queue <- out:
+	default: // The exporter is behind: drop rather than block requests
+	}
+}
+
+type otlpValue struct {
+	StringValue string `json:"stringValue"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpStatus struct {
+	Code    int    `json:"code"` // 2 = error
+	Message string `json:"message,omitempty"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              int             `json:"kind"`
+	StartTimeUnixNano uint64          `json:"startTimeUnixNano,string"`
+	EndTimeUnixNano   uint64          `json:"endTimeUnixNano,string"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            *otlpStatus     `json:"status,omitempty"`
+}
+
+// tracer exports the finished spans in batches.
+var tracer = struct {
+	endpoint string // OTLP/HTTP traces URL; "" disables tracing
+	headers  map[string]string
+	service  string
+	queue    chan otlpSpan
+}{}
+
+// configureTracing reads the standard OpenTelemetry variables:
+// OTEL_EXPORTER_OTLP_TRACES_ENDPOINT (full URL) or
+// OTEL_EXPORTER_OTLP_ENDPOINT (base URL, /v1/traces is appended),
+// OTEL_EXPORTER_OTLP_HEADERS ("k=v,k2=v2") and OTEL_SERVICE_NAME.
+func configureTracing() bool {
+	tracer.endpoint = os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT")
+	if base := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); tracer.endpoint == "" && base != "" {
+		tracer.endpoint = strings.TrimRight(base, "/") + "/v1/traces"
+	}
+	if tracer.endpoint == "" {
+		return false
+	}
+	tracer.headers = map[string]string{}
+	for _, pair := range strings.Split(os.Getenv("OTEL_EXPORTER_OTLP_HEADERS"), ",") {
+		if k, v, ok := strings.Cut(pair, "="); ok {
+			tracer.headers[strings.TrimSpace(k)] = strings.TrimSpace(v)
+		}
+	}
+	tracer.service = os.Getenv("OTEL_SERVICE_NAME")
+	if tracer.service == "" {
+		tracer.service = "netsim"
+	}
+	tracer.queue = make(chan otlpSpan, 4096)
+	return true
+}
+
+// startTracing exports the queued spans every 5 seconds (or every 512
+// spans) until ctx is done, then flushes the rest.
+func startTracing(ctx context.Context) {
+	log.Printf("[INFO] TRACING: Exporting spans to %s (OTLP/HTTP JSON)", tracer.endpoint)
+	go func() {
+		ticker := time.NewTicker(5 * time.Second)
+		defer ticker.Stop()
+		var batch []otlpSpan
+		for {
+			select {
+			case s := <-tracer.queue:
+				if batch = append(batch, s); len(batch) >= 512 {
+					exportSpans(ctx, batch)
+					batch = nil
+				}
+			case <-ticker.C:
+				exportSpans(ctx, batch)
+				batch = nil
+			case <-ctx.Done():
+				for len(tracer.queue) > 0 {
+					batch = append(batch, <-tracer.queue)
+				}
+				flushCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				exportSpans(flushCtx, batch)
+				cancel()
+				return
+			}
+		}
+	}()
+}
+
+// exportSpans sends a batch to the collector.
+func exportSpans(ctx context.Context, spans []otlpSpan) {
+	if len(spans) == 0 {
+		return
+	}
+	body, _ := json.Marshal(map[string]interface{}{
+		"resourceSpans": []interface{}{map[string]interface{}{
+			"resource": map[string]interface{}{
+				"attributes": []otlpAttribute{
+					{Key: "service.name", Value: otlpValue{StringValue: tracer.service}},
+					{Key: "service.version", Value: otlpValue{StringValue: version}},
+				},
+			},
+			"scopeSpans": []interface{}{map[string]interface{}{
+				"scope": map[string]string{"name": "netsim"},
+				"spans": spans,
+			}},
+		}},
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, tracer.endpoint, bytes.NewReader(body))
+	if err != nil {
+		log.Printf("[WARN] TRACING: Invalid endpoint: %v", err)
+		return
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range tracer.headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := peerClient.Do(req)
+	if err != nil {
+		log.Printf("[WARN] TRACING: Failed to export %d spans: %v", len(spans), err)
+		return
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		log.Printf("[WARN] TRACING: Collector rejected %d spans: HTTP %d", len(spans), resp.StatusCode)
+	}
+}
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// --- Time Synchronization Testing ---
+
+// NTP and PTP assume the path to the time server is as long as the way
+// back: half of any asymmetry ends up in the clients' offset. An asymmetry
+// preset delays the time protocol's packets more one way than the other,
+// so the clients behind the box drift off by a chosen offset while their
+// daemons report a healthy sync.
+
+// TimeSyncPath is the interface and direction of one way of the path.
+type TimeSyncPath struct {
+	Iface     string `json:"iface"`
+	Direction string `json:"direction"`
+}
+
+// TimeSyncAsymmetry is the preset: Offset (ms, positive when the clients
+// should run ahead of the server) on top of a symmetric Delay (ms), with
+// optional Jitter (ms) and Loss (%) both ways.
+type TimeSyncAsymmetry struct {
+	Protocol string        `json:"protocol,omitempty"` // "ntp" (default) or "ptp"
+	ToServer *TimeSyncPath `json:"toServer"`
+	ToClient *TimeSyncPath `json:"toClient"`
+	Offset   string        `json:"offset"`
+	Delay    string        `json:"delay,omitempty"`
+	Jitter   string        `json:"jitter,omitempty"`
+	Loss     string        `json:"loss,omitempty"`
+	Group    string        `json:"group,omitempty"`
+
+	offset, delay float64
+}
+
+// validate checks the preset and parses its numbers.
+func (a *TimeSyncAsymmetry) validate() error {
+	if a.Protocol == "" {
+		a.Protocol = "ntp"
+	}
+	if a.Protocol != "ntp" && a.Protocol != "ptp" {
+		return fmt.Errorf("timesync: invalid 'protocol' %q (ntp or ptp)", a.Protocol)
+	}
+	if a.ToServer == nil || a.ToClient == nil || a.ToServer.Iface == "" || a.ToClient.Iface == "" ||
+		a.ToServer.Direction == "" || a.ToClient.Direction == "" {
+		return fmt.Errorf("timesync: 'toServer' and 'toClient' need 'iface' and 'direction'")
+	}
+	if a.ToServer.Iface == a.ToClient.Iface {
+		return fmt.Errorf("timesync: 'toServer' and 'toClient' need different interfaces (one rule per interface)")
+	}
+	offset := a.Offset
+	negative := len(offset) > 0 && offset[0] == '-'
+	if negative {
+		offset = offset[1:]
+	}
+	var ok bool
+	if a.offset, ok = parseTCNumber(offset); !ok {
+		return fmt.Errorf("timesync: invalid 'offset' %q (ms)", a.Offset)
+	}
+	if negative {
+		a.offset = -a.offset
+	}
+	if a.Delay != "" {
+		if a.delay, ok = parseTCNumber(a.Delay); !ok {
+			return fmt.Errorf("timesync: invalid 'delay' %q (ms)", a.Delay)
+		}
+	}
+	return nil
+}
+
+// rules returns the rule of each way: the way that should be slower gets
+// twice the offset on top of the delay. The selectors keep other traffic
+// unimpaired: NTP goes to and comes from port 123, PTP's event messages
+// (Sync, Delay_Req) go to port 319 both ways.
+func (a *TimeSyncAsymmetry) rules() []*V4NetworkOptions {
+	toServer, toClient := a.delay, a.delay
+	if a.offset > 0 {
+		toServer += 2 * a.offset
+	} else {
+		toClient -= 2 * a.offset
+	}
+	var rules []*V4NetworkOptions
+	for _, way := range []struct {
+		path  *TimeSyncPath
+		delay float64
+		port  func(o *V4NetworkOptions) *string
+	}{
+		{a.ToServer, toServer, func(o *V4NetworkOptions) *string { return &o.DstPort }},
+		{a.ToClient, toClient, func(o *V4NetworkOptions) *string { return &o.SrcPort }},
+	} {
+		opts := &V4NetworkOptions{Iface: way.path.Iface, Direction: way.path.Direction, Jitter: a.Jitter, Loss: a.Loss}
+		if way.delay > 0 {
+			opts.Delay = strconv.FormatFloat(roundTo(way.delay, 3), 'f', -1, 64)
+		}
+		if opts.Delay == "" && opts.Loss == "" {
+			continue // (nothing to impair this way)
+		}
+		if opts.Loss != "" {
+			opts.LossModel = "random"
+		}
+		if a.Protocol == "ptp" {
+			opts.DstPort = "319"
+		} else {
+			*way.port(opts) = "123"
+		}
+		rules = append(rules, opts)
+	}
+	return rules
+}
+
+// ClockSkew runs the box's own clock PPM fast (or slow, below zero), to
+// test how the clients that sync to it, or the monitoring that watches
+// it, cope. The frequency it replaced is put back when it ends.
+type ClockSkew struct {
+	PPM         float64 `json:"ppm"`
+	Duration    string  `json:"duration,omitempty"` // Go duration (default: until stopped)
+	Started     TcTime  `json:"started"`
+	PreviousPPM float64 `json:"previousPpm"`
+
+	duration time.Duration
+}
+
+// clockSkew is the running skew (guarded by sched.mu).
+var clockSkew *ClockSkew
+
+// run waits for the end of the skew and restores the frequency, unless
+// the skew was replaced or stopped by a request (which restores it).
+func (c *ClockSkew) run(ctx context.Context) {
+	if c.duration > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.duration)
+		defer cancel()
+	}
+	<-ctx.Done()
+	sched.mu.Lock()
+	current := clockSkew == c
+	if current {
+		clockSkew = nil
+	}
+	sched.mu.Unlock()
+	if !current {
+		return
+	}
+	if err := setClockFrequency(c.PreviousPPM); err != nil {
+		log.Printf("[ERROR] TIMESYNC: Failed to restore the clock frequency (%v ppm): %v", c.PreviousPPM, err)
+		return
+	}
+	log.Printf("[INFO] TIMESYNC: Clock skew ended, frequency restored to %v ppm", c.PreviousPPM)
+}
+
+// --- Handlers: /timesync ---
+
+// handleTimeSyncStatus reports the clock's synchronization, its frequency
+// offset and the running skew.
+func handleTimeSyncStatus(w http.ResponseWriter, r *http.Request) {
+	synced, known, estError := clockSync()
+	response := map[string]interface{}{"synced": synced, "known": known}
+	if known {
+		response["estErrorMs"] = roundTo(float64(estError)/float64(time.Millisecond), 3)
+	}
+	if ppm, err := clockFrequency(); err == nil {
+		response["frequencyPpm"] = roundTo(ppm, 3)
+	}
+	sched.mu.Lock()
+	if clockSkew != nil {
+		c := *clockSkew
+		response["skew"] = &c
+	}
+	sched.mu.Unlock()
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// handleTimeSyncAsymmetry returns the rules of an asymmetry preset,
+// defined as an impairment group with 'group'.
+func handleTimeSyncAsymmetry(w http.ResponseWriter, r *http.Request) {
+	a := &TimeSyncAsymmetry{}
+	if err := json.NewDecoder(r.Body).Decode(a); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid timesync JSON: %v", err), 400)
+		return
+	}
+	if err := a.validate(); err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	rules := a.rules()
+	if len(rules) == 0 {
+		respondWithError(w, "timesync: nothing to impair (set 'offset', 'delay' or 'loss')", 400)
+		return
+	}
+	for _, opts := range rules {
+		if err := opts.validateNetem(); err != nil {
+			respondWithLocalizedError(w, r, 400, err)
+			return
+		}
+	}
+	response := map[string]interface{}{"rules": rules, "expectedOffsetMs": a.offset}
+	if a.Group != "" {
+		g := &ImpairmentGroup{Name: a.Group, Rules: rules}
+		if err := g.validate(); err != nil {
+			respondWithLocalizedError(w, r, 400, err)
+			return
+		}
+		if err := g.define(); err != nil {
+			respondWithError(w, err.Error(), 409)
+			return
+		}
+		response["group"] = g.snapshot()
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// handleClockSkewStart skews the box's clock (replacing a running skew).
+func handleClockSkewStart(w http.ResponseWriter, r *http.Request) {
+	c := &ClockSkew{}
+	if err := json.NewDecoder(r.Body).Decode(c); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid skew JSON: %v", err), 400)
+		return
+	}
+	if math.IsNaN(c.PPM) || math.Abs(c.PPM) > 500 {
+		respondWithError(w, "timesync: 'ppm' must be between -500 and 500", 400)
+		return
+	}
+	if c.Duration != "" {
+		var err error
+		if c.duration, err = time.ParseDuration(c.Duration); err != nil || c.duration <= 0 {
+			respondWithError(w, fmt.Sprintf("timesync: invalid 'duration' %q", c.Duration), 400)
+			return
+		}
+	}
+	if err := privilegedFeatureAvailable("clockskew"); err != nil {
+		respondWithError(w, "timesync: "+err.Error(), 501)
+		return
+	}
+	previous, err := clockFrequency()
+	if err != nil {
+		respondWithError(w, err.Error(), 501)
+		return
+	}
+	sched.mu.Lock()
+	if clockSkew != nil {
+		previous = clockSkew.PreviousPPM // (not the replaced skew's)
+	}
+	sched.mu.Unlock()
+	if err := setClockFrequency(c.PPM); err != nil {
+		respondWithError(w, fmt.Sprintf("timesync: failed to skew the clock (needs CAP_SYS_TIME): %v", err), 500)
+		return
+	}
+	c.PreviousPPM, c.Started = previous, TcTime(time.Now())
+	sched.mu.Lock()
+	clockSkew = c
+	snapshot := *c
+	sched.mu.Unlock()
+	sched.Start("timesync:skew", "timesync", "", c.run)
+	log.Printf("[INFO] TIMESYNC: Clock skewed to %v ppm (was %v ppm)", c.PPM, previous)
+
+	response := map[string]interface{}{"skew": &snapshot}
+	if synced, _, _ := clockSync(); synced {
+		response["warning"] = "an NTP daemon disciplines this clock: it will steer the frequency back"
+	}
+	respondWithJSON(w, http.StatusOK, response)
+}
+
+// handleClockSkewStop ends the skew and restores the clock's frequency.
+func handleClockSkewStop(w http.ResponseWriter, r *http.Request) {
+	sched.mu.Lock()
+	c := clockSkew
+	clockSkew = nil
+	sched.mu.Unlock()
+	if c == nil {
+		respondWithError(w, "no clock skew running", 404)
+		return
+	}
+	sched.Stop("timesync:skew")
+	if err := setClockFrequency(c.PreviousPPM); err != nil {
+		respondWithError(w, fmt.Sprintf("timesync: failed to restore the clock frequency: %v", err), 500)
+		return
+	}
+	log.Printf("[INFO] TIMESYNC: Clock skew stopped, frequency restored to %v ppm", c.PreviousPPM)
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"frequencyPpm": c.PreviousPPM})
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"math"
+	"syscall"
+	"time"
+)
+
+// --- Time Synchronization (Linux) ---
+
+const (
+	timeError = 5      // adjtimex state: the clock is not synchronized
+	staUnsync = 0x0040 // adjtimex status: the clock is not synchronized
+)
+
+// clockSync reports whether the kernel considers the clock synchronized by
+// NTP (chrony, ntpd, systemd-timesyncd), with its estimated error. known is
+// false when the kernel could not be asked.
+func clockSync() (synced, known bool, estError time.Duration) {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return false, false, 0
+	}
+	return state != timeError && tx.Status&staUnsync == 0, true, time.Duration(tx.Esterror) * time.Microsecond
+}
+
+// adjFrequency is the adjtimex mode that sets the frequency offset.
+const adjFrequency = 0x0002
+
+// clockFrequency returns the frequency offset of the clock (ppm), as the
+// NTP daemon (or a skew) disciplined it.
+func clockFrequency() (float64, error) {
+	var tx syscall.Timex
+	if _, err := syscall.Adjtimex(&tx); err != nil {
+		return 0, err
+	}
+	return float64(tx.Freq) / 65536, nil
+}
+
+// setClockFrequency sets the frequency offset of the clock (ppm; the kernel
+// allows ±500). It needs CAP_SYS_TIME.
+func setClockFrequency(ppm float64) error {
+	tx := syscall.Timex{Modes: adjFrequency}
+	setScaled(&tx.Freq, ppm*65536) // (scaled ppm: 16 bits of fraction)
+	_, err := syscall.Adjtimex(&tx)
+	return err
+}
+
+// setScaled stores v in a field of Timex, a long in the kernel (32 or 64
+// bits depending on the architecture).
+func setScaled[T int32 | int64](field *T, v float64) {
+	*field = T(math.Round(v))
+}
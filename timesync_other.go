@@ -0,0 +1,23 @@
+//go:build !linux
+
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// clockSync cannot ask the kernel outside Linux.
+func clockSync() (synced, known bool, estError time.Duration) {
+	return false, false, 0
+}
+
+// clockFrequency cannot ask the kernel outside Linux.
+func clockFrequency() (float64, error) {
+	return 0, fmt.Errorf("timesync: the clock frequency can only be read on Linux")
+}
+
+// setClockFrequency cannot change the clock outside Linux.
+func setClockFrequency(ppm float64) error {
+	return fmt.Errorf("timesync: the clock can only be skewed on Linux")
+}
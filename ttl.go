@@ -0,0 +1,252 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"os/exec"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// --- TTL / Hop Limit Rewriting ---
+
+// TTLRule rewrites the TTL (IPv4) or hop limit (IPv6) of the packets this
+// box forwards to Network, to emulate a longer path (Decrement) or a
+// middlebox that resets it (Set). The packets are rewritten before routing,
+// so a packet whose TTL runs out expires here, and the sender gets the ICMP
+// "time exceeded" from this box.
+type TTLRule struct {
+	Network   string `json:"network"`             // CIDR, IPv4 or IPv6
+	Iface     string `json:"iface,omitempty"`     // inbound interface (default: any)
+	Decrement int    `json:"decrement,omitempty"` // hops added to the path
+	Set       int    `json:"set,omitempty"`       // TTL every packet leaves with
+	Started   TcTime `json:"started"`
+}
+
+// ttlTable is the nftables table that holds the rules. It belongs to
+// netsim: it is replaced as a whole on every change, and deleted when the
+// last rule is.
+const ttlTable = "netsim_ttl"
+
+var (
+	ttlMu    sync.Mutex
+	ttlRules = map[string]*TTLRule{} // by network
+)
+
+// parseTTLRule reads a rule from the query: network, iface, and decrement
+// or set.
+func parseTTLRule(q url.Values) (*TTLRule, error) {
+	t := &TTLRule{Iface: q.Get("iface"), Started: TcTime(time.Now())}
+	network := q.Get("network")
+	if network == "" {
+		return nil, fmt.Errorf("ttl: 'network' is required (an IP or CIDR)")
+	}
+	var ok bool
+	if t.Network, ok = ttlNetwork(network); !ok {
+		return nil, fmt.Errorf("ttl: invalid 'network' %q", network)
+	}
+	if t.Iface != "" {
+		if _, err := net.InterfaceByName(t.Iface); err != nil {
+			return nil, fmt.Errorf("ttl: interface '%s' not found", t.Iface)
+		}
+	}
+	decrement, set := q.Get("decrement"), q.Get("set")
+	switch {
+	case (decrement == "") == (set == ""):
+		return nil, fmt.Errorf("ttl: set either 'decrement' or 'set'")
+	case decrement != "":
+		n, err := strconv.Atoi(decrement)
+		if err != nil || n < 1 || n > 254 {
+			return nil, fmt.Errorf("ttl: 'decrement' must be in [1, 254], got %q", decrement)
+		}
+		t.Decrement = n
+	default:
+		n, err := strconv.Atoi(set)
+		if err != nil || n < 1 || n > 255 {
+			return nil, fmt.Errorf("ttl: 'set' must be in [1, 255], got %q", set)
+		}
+		t.Set = n
+	}
+	return t, nil
+}
+
+// ttlNetwork normalizes an IP or CIDR to the network key of the rules.
+func ttlNetwork(value string) (string, bool) {
+	if _, ipnet, err := net.ParseCIDR(value); err == nil {
+		return ipnet.String(), true
+	}
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return "", false
+	}
+	if ip.To4() != nil {
+		return ip.String() + "/32", true
+	}
+	return ip.String() + "/128", true
+}
+
+// nftRule renders the rule as an nftables rule. A decrement is a map from
+// each TTL to the lowered one (nftables has no subtraction), floored at 1:
+// routing then drops the packet as expired.
+func (t *TTLRule) nftRule() string {
+	family, field := "ip", "ip ttl"
+	if !strings.Contains(t.Network, ".") {
+		family, field = "ip6", "ip6 hoplimit"
+	}
+	var b strings.Builder
+	if t.Iface != "" {
+		fmt.Fprintf(&b, "iifname %q ", t.Iface)
+	}
+	fmt.Fprintf(&b, "%s daddr %s fib daddr type != local %s set ", family, t.Network, field)
+	if t.Set > 0 {
+		b.WriteString(strconv.Itoa(t.Set))
+		return b.String()
+	}
+	b.WriteString(field + " map { ")
+	for ttl := 1; ttl <= 255; ttl++ {
+		if ttl > 1 {
+			b.WriteString(", ")
+		}
+		fmt.Fprintf(&b, "%d : %d", ttl, max(ttl-t.Decrement, 1))
+	}
+	b.WriteString(" }")
+	return b.String()
+}
+
+// applyTTLRules replaces the netsim table with the current rules in one
+// nft transaction. Must be called with ttlMu held.
+func applyTTLRules(ctx context.Context) error {
+	// Creating the table first makes the deletion succeed when it is absent
+	script := fmt.Sprintf("table inet %s\ndelete table inet %s\n", ttlTable, ttlTable)
+	if len(ttlRules) > 0 {
+		networks := make([]string, 0, len(ttlRules))
+		for network := range ttlRules {
+			networks = append(networks, network)
+		}
+		sort.Strings(networks)
+		script += fmt.Sprintf("table inet %s {\n\tchain prerouting {\n\t\ttype filter hook prerouting priority mangle; policy accept;\n", ttlTable)
+		for _, network := range networks {
+			script += "\t\t" + ttlRules[network].nftRule() + "\n"
+		}
+		script += "\t}\n}\n"
+	}
+	cmd := command(ctx, "nft", "-f", "-")
+	cmd.Stdin = strings.NewReader(script)
+	log.Printf("[INFO] TTL: Replacing the nftables table inet %s (%d rule(s))", ttlTable, len(ttlRules))
+	if output, err := cmd.CombinedOutput(); err != nil {
+		if out := strings.TrimSpace(string(output)); out != "" {
+			return fmt.Errorf("ttl: nft failed: %s: %w", out, err)
+		}
+		return fmt.Errorf("ttl: nft failed: %w", err)
+	}
+	return nil
+}
+
+// removeAllTTLRules deletes every rule and the table (e.g. on reset-all).
+func removeAllTTLRules(ctx context.Context) {
+	ttlMu.Lock()
+	defer ttlMu.Unlock()
+	if len(ttlRules) == 0 {
+		return
+	}
+	ttlRules = map[string]*TTLRule{}
+	if err := applyTTLRules(ctx); err != nil {
+		log.Printf("[ERROR] TTL: %v", err)
+	}
+}
+
+// cleanupLeftoverTTLTable deletes the table left by a previous run.
+func cleanupLeftoverTTLTable(ctx context.Context) {
+	if command(ctx, "nft", "list", "table", "inet", ttlTable).Run() != nil {
+		return // No table (or no nft)
+	}
+	if err := command(ctx, "nft", "delete", "table", "inet", ttlTable).Run(); err != nil {
+		log.Printf("[WARN] LEFTOVERS: Failed to remove the nftables table inet %s: %v", ttlTable, err)
+		return
+	}
+	log.Printf("[INFO] LEFTOVERS: Removed the nftables table inet %s left by a previous run", ttlTable)
+}
+
+// ttlRewrite reports whether TTL rules can run on this host.
+func ttlRewrite() bool {
+	_, err := exec.LookPath("nft")
+	return !isDarwin && err == nil
+}
+
+// --- Handlers: /ttl ---
+
+// handleTTLSetup adds (or replaces) the rule of 'network'.
+func handleTTLSetup(w http.ResponseWriter, r *http.Request) {
+	t, err := parseTTLRule(r.URL.Query())
+	if err != nil {
+		respondWithError(w, err.Error(), 400)
+		return
+	}
+	if isDarwin {
+		log.Println("[INFO] TTL: Darwin: Ignoring TTL setup")
+		respondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	ttlMu.Lock()
+	defer ttlMu.Unlock()
+	prev := ttlRules[t.Network]
+	ttlRules[t.Network] = t
+	if err := applyTTLRules(r.Context()); err != nil {
+		if prev != nil {
+			ttlRules[t.Network] = prev
+		} else {
+			delete(ttlRules, t.Network)
+		}
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, t)
+}
+
+// handleTTLReset removes the rule of 'network' (all rules without one).
+func handleTTLReset(w http.ResponseWriter, r *http.Request) {
+	network := r.URL.Query().Get("network")
+	ttlMu.Lock()
+	defer ttlMu.Unlock()
+	removed := ttlRules
+	if network == "" {
+		ttlRules = map[string]*TTLRule{}
+	} else {
+		key, _ := ttlNetwork(network)
+		rule, ok := ttlRules[key]
+		if !ok {
+			respondWithError(w, fmt.Sprintf("ttl: no rule for '%s'", network), 404)
+			return
+		}
+		removed = map[string]*TTLRule{key: rule}
+		delete(ttlRules, key)
+	}
+	if err := applyTTLRules(r.Context()); err != nil {
+		for network, rule := range removed {
+			ttlRules[network] = rule
+		}
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, nil)
+}
+
+// handleTTLList returns the active rules.
+func handleTTLList(w http.ResponseWriter, r *http.Request) {
+	ttlMu.Lock()
+	defer ttlMu.Unlock()
+	list := make([]*TTLRule, 0, len(ttlRules))
+	for _, t := range ttlRules {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Network < list[j].Network })
+	respondWithJSON(w, http.StatusOK, list)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// --- Console TUI (-tui) ---
+
+// tuiRefresh is how often the TUI redraws the status.
+const tuiRefresh = 2 * time.Second
+
+// tuiClient calls the API of the running daemon, like any other client.
+type tuiClient struct {
+	base string
+	http *http.Client
+}
+
+// tuiBaseURL is TUI_API_URL, or the local API port of API_LISTEN.
+func tuiBaseURL() string {
+	if base := os.Getenv("TUI_API_URL"); base != "" {
+		return strings.TrimSuffix(base, "/")
+	}
+	port := strings.TrimPrefix(os.Getenv("API_LISTEN"), ":")
+	if _, p, err := net.SplitHostPort(os.Getenv("API_LISTEN")); err == nil {
+		port = p
+	}
+	if port == "" {
+		port = "2023"
+	}
+	return "http://" + net.JoinHostPort("127.0.0.1", port)
+}
+
+// call sends a request and returns the body, or the API's error message.
+func (c *tuiClient) call(method, path string, q url.Values) (string, error) {
+	u := c.base + path
+	if len(q) > 0 {
+		u += "?" + q.Encode()
+	}
+	req, err := http.NewRequest(method, u, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("X-Netsim-User", "console")
+	req.Header.Set("Accept", "text/plain")
+	if lang := os.Getenv("LANG"); len(lang) >= 2 {
+		req.Header.Set("Accept-Language", lang[:2])
+	}
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	if resp.StatusCode >= 300 {
+		var apiErr struct {
+			Message string `json:"message"`
+		}
+		if json.Unmarshal(body, &apiErr) == nil && apiErr.Message != "" {
+			return "", fmt.Errorf("%s", apiErr.Message)
+		}
+		return "", fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(body)))
+	}
+	return string(body), nil
+}
+
+// setTerm changes the mode of the controlling terminal with stty (an
+// error is ignored: the TUI then needs Enter after each key).
+func setTerm(args ...string) {
+	cmd := exec.Command("stty", args...)
+	cmd.Stdin = os.Stdin
+	cmd.Run()
+}
+
+// tui is the state of a TUI session.
+type tui struct {
+	client  *tuiClient
+	keys    chan byte
+	message string
+}
+
+// runTUI shows the interfaces, rules and live counters of the local daemon,
+// refreshed every tuiRefresh, with single-key commands to apply and reset
+// rules. It returns when the operator quits.
+func runTUI() error {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return fmt.Errorf("-tui needs a terminal")
+	}
+	t := &tui{
+		client: &tuiClient{base: tuiBaseURL(), http: &http.Client{Timeout: 30 * time.Second}},
+		keys:   make(chan byte, 64),
+	}
+	if _, err := t.client.call(http.MethodGet, "/status", nil); err != nil {
+		return fmt.Errorf("cannot reach the API at %s (is netsim running? set TUI_API_URL): %w", t.client.base, err)
+	}
+
+	setTerm("-icanon", "-echo", "min", "1")
+	defer setTerm("sane")
+	defer fmt.Print("\033[?25h\n")
+	go func() {
+		buf := make([]byte, 1)
+		for {
+			if n, err := os.Stdin.Read(buf); err != nil {
+				close(t.keys)
+				return
+			} else if n == 1 {
+				t.keys <- buf[0]
+			}
+		}
+	}()
+
+	// Ctrl-C restores the terminal too
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, syscall.SIGINT, syscall.SIGTERM)
+	defer signal.Stop(sigChan)
+
+	ticker := time.NewTicker(tuiRefresh)
+	defer ticker.Stop()
+	for {
+		t.draw()
+		select {
+		case <-sigChan:
+			return nil
+		case <-ticker.C:
+		case key, ok := <-t.keys:
+			if !ok {
+				return nil
+			}
+			switch key {
+			case 'q', 'Q':
+				return nil
+			case 'a':
+				t.apply()
+			case 'r':
+				t.reset()
+			case 'R':
+				t.resetAll()
+			}
+		}
+	}
+}
+
+// draw clears the screen and renders /status with the key help.
+func (t *tui) draw() {
+	status, err := t.client.call(http.MethodGet, "/status", nil)
+	if err != nil {
+		status = "Failed to read the status: " + err.Error() + "\n"
+	}
+	fmt.Print("\033[?25l\033[H\033[2J")
+	fmt.Print(strings.ReplaceAll(status, "\n", "\r\n"))
+	fmt.Printf("\r\n[a] apply  [r] reset  [R] reset all  [q] quit    (%s, every %s)\r\n", t.client.base, tuiRefresh)
+	if t.message != "" {
+		fmt.Printf("\r\n%s\r\n", t.message)
+	}
+}
+
+// prompt reads a line with echo on. ok is false when the input ended.
+func (t *tui) prompt(label string) (line string, ok bool) {
+	setTerm("icanon", "echo")
+	defer setTerm("-icanon", "-echo", "min", "1")
+	fmt.Print("\033[?25h\r\n" + label)
+	var b strings.Builder
+	for key := range t.keys {
+		if key == '\n' || key == '\r' {
+			return strings.TrimSpace(b.String()), true
+		}
+		b.WriteByte(key)
+	}
+	return "", false
+}
+
+// apply asks for an interface, a direction and the parameters, and calls
+// /config/setup.
+func (t *tui) apply() {
+	iface, ok := t.prompt("Interface (name or glob): ")
+	if !ok || iface == "" {
+		return
+	}
+	direction, ok := t.prompt("Direction [outgoing]: ")
+	if !ok {
+		return
+	}
+	if direction == "" {
+		direction = "outgoing"
+	}
+	params, ok := t.prompt("Parameters (e.g. rate=5mbit delay=50 loss=1): ")
+	if !ok {
+		return
+	}
+	q := url.Values{"iface": {iface}, "direction": {direction}}
+	for _, pair := range strings.FieldsFunc(params, func(r rune) bool { return r == ' ' || r == '&' }) {
+		k, v, found := strings.Cut(pair, "=")
+		if !found {
+			t.message = fmt.Sprintf("Not applied: '%s' is not a key=value parameter", pair)
+			return
+		}
+		q.Set(k, v)
+	}
+	if _, err := t.client.call(http.MethodGet, configPath("setup"), q); err != nil {
+		t.message = "Not applied: " + err.Error()
+		return
+	}
+	t.message = fmt.Sprintf("Applied to %s (%s): %s", iface, direction, params)
+}
+
+// reset asks for an interface and calls /config/reset.
+func (t *tui) reset() {
+	iface, ok := t.prompt("Reset interface (name or glob): ")
+	if !ok || iface == "" {
+		return
+	}
+	if _, err := t.client.call(http.MethodGet, configPath("reset"), url.Values{"iface": {iface}}); err != nil {
+		t.message = "Not reset: " + err.Error()
+		return
+	}
+	t.message = "Reset " + iface
+}
+
+// resetAll calls /config/reset-all after a confirmation.
+func (t *tui) resetAll() {
+	answer, ok := t.prompt("Reset EVERY interface on the host? [y/N]: ")
+	if !ok || !strings.EqualFold(answer, "y") {
+		return
+	}
+	if _, err := t.client.call(http.MethodPost, configPath("reset-all"), nil); err != nil {
+		t.message = "Not reset: " + err.Error()
+		return
+	}
+	t.message = "Reset every interface"
+}
+
+// configPath is the path of a /config endpoint of the current API version.
+func configPath(endpoint string) string {
+	return fmt.Sprintf("/tc/api/%s/config/%s", apiVersion, endpoint)
+}
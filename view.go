@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+)
+
+// --- Read-Only View ---
+
+// With VIEW_LISTEN, a second listener serves the UI and the API to
+// stakeholders who watch a demo or a test run: the current rules, stats and
+// scenario progress can be read, and every change is refused. VIEW_TOKEN
+// (or VIEW_TOKEN_FILE), when set, is required to look.
+
+// viewPaths are the API paths (below /tc/api/v2) the view serves, with the
+// paths below them. Only GET requests reach them, and none changes rules.
+var viewPaths = []string{
+	"/capabilities", "/contract",
+	"/config/init", "/config/query", "/config/stats",
+	"/rules", "/connections", "/metrics",
+	"/scenarios", "/curves", "/oscillations", "/ab", "/satellite", "/handover", "/storms",
+	"/groups", "/alerts", "/speedtest", "/vifs", "/profiles",
+	"/sessions/events", "/sessions/view",
+}
+
+// viewExcluded are the paths below viewPaths that act on a GET, which the
+// view refuses.
+var viewExcluded = []string{"/speedtest/run"}
+
+// viewCookie carries the view token of a browser that opened the view with
+// ?token=, so the UI's own requests are let in too.
+const viewCookie = "netsim_view"
+
+// viewKey marks the requests of the read-only view in their context.
+type viewKey struct{}
+
+// isReadOnlyView reports whether r came through the read-only view.
+func isReadOnlyView(r *http.Request) bool {
+	return r.Context().Value(viewKey{}) != nil
+}
+
+// viewAllowed reports whether the view serves path: the UI, the status
+// page and the read-only API paths.
+func viewAllowed(path string) bool {
+	if path == "/tc/api/version" {
+		return true
+	}
+	if !strings.HasPrefix(path, "/tc/api/") {
+		return true
+	}
+	rest, ok := strings.CutPrefix(path, "/tc/api/"+apiVersion)
+	if !ok {
+		return false
+	}
+	for _, p := range viewExcluded {
+		if rest == p || strings.HasPrefix(rest, p+"/") {
+			return false
+		}
+	}
+	for _, p := range viewPaths {
+		if rest == p || strings.HasPrefix(rest, p+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// viewAuthorized checks VIEW_TOKEN, from the bearer token, the 'token'
+// query parameter or the view cookie. Without VIEW_TOKEN the view is open.
+func viewAuthorized(r *http.Request) bool {
+	token := secret("VIEW_TOKEN")
+	if token == "" {
+		return true
+	}
+	candidates := []string{strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "), r.URL.Query().Get("token")}
+	if c, err := r.Cookie(viewCookie); err == nil {
+		candidates = append(candidates, c.Value)
+	}
+	for _, got := range candidates {
+		if got != "" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+// ReadOnlyView wraps the router for the view listener: it checks the view
+// token and refuses everything but reads of the paths the view serves.
+func ReadOnlyView(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !viewAuthorized(r) {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="netsim-view"`)
+			respondWithError(w, "invalid or missing view token", 401)
+			return
+		}
+		if (r.Method != http.MethodGet && r.Method != http.MethodHead) || !viewAllowed(r.URL.Path) {
+			respondWithError(w, "this is a read-only view: changes are not allowed", 403)
+			return
+		}
+		if token := r.URL.Query().Get("token"); token != "" {
+			http.SetCookie(w, &http.Cookie{Name: viewCookie, Value: token, Path: "/", HttpOnly: true, SameSite: http.SameSiteStrictMode})
+		}
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), viewKey{}, true)))
+	})
+}
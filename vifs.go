@@ -0,0 +1,344 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"regexp"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+)
+
+// --- Virtual Interfaces (macvlan / ipvlan / VLAN) ---
+
+// One rule per interface means one impairment per NIC. A virtual interface
+// on a shared NIC gives each tenant (or test) its own device, and so its own
+// rule. The devices the tool creates carry the alias vifAlias (with the
+// tenant after a '/'): they are the ones listed here, and they are removed
+// with their rules on delete and reset-all.
+const vifAlias = "netsim-in-a-box"
+
+// VirtualInterface is a virtual interface created by the tool.
+type VirtualInterface struct {
+	Name      string   `json:"name"`
+	Type      string   `json:"type"` // macvlan (default), ipvlan or vlan
+	Parent    string   `json:"parent"`
+	Mode      string   `json:"mode,omitempty"`    // macvlan: bridge (default), private, vepa, passthru; ipvlan: l2 (default), l3, l3s
+	VLAN      int      `json:"vlan,omitempty"`    // vlan: the 802.1Q id
+	MAC       string   `json:"mac,omitempty"`     // macvlan: fixed address (default: random)
+	Address   string   `json:"address,omitempty"` // create: IP/prefix to assign
+	Tenant    string   `json:"tenant,omitempty"`
+	Up        bool     `json:"up"`
+	Addresses []string `json:"addresses"`
+	Rule      string   `json:"rule,omitempty"` // id of the interface's rule
+}
+
+// vifNamePattern and vifTenantPattern keep names within IFNAMSIZ and the
+// alias parseable.
+var (
+	vifNamePattern   = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,15}$`)
+	vifTenantPattern = regexp.MustCompile(`^[A-Za-z0-9_.:-]{1,32}$`)
+)
+
+// vifModes are the modes of each type; the first is the default.
+var vifModes = map[string][]string{
+	"macvlan": {"bridge", "private", "vepa", "passthru"},
+	"ipvlan":  {"l2", "l3", "l3s"},
+	"vlan":    nil,
+}
+
+// validate checks a virtual interface to create and fills in the defaults.
+func (v *VirtualInterface) validate() error {
+	if !vifNamePattern.MatchString(v.Name) || strings.HasPrefix(v.Name, "ifb") {
+		return fmt.Errorf("vif: invalid name '%s' (up to 15 letters, digits, '_', '.' or '-', not ifb...)", v.Name)
+	}
+	if !ifaceAllowed(v.Name) {
+		return msg("rule.ifaceExcluded", v.Name)
+	}
+	if v.Type == "" {
+		v.Type = "macvlan"
+	}
+	modes, ok := vifModes[v.Type]
+	if !ok {
+		return fmt.Errorf("vif: invalid 'type' %q (macvlan, ipvlan or vlan)", v.Type)
+	}
+	parent, err := net.InterfaceByName(v.Parent)
+	if err != nil {
+		return fmt.Errorf("vif: no parent interface '%s'", v.Parent)
+	}
+	if parent.Flags&net.FlagLoopback != 0 || strings.HasPrefix(v.Parent, "ifb") {
+		return fmt.Errorf("vif: '%s' cannot be a parent", v.Parent)
+	}
+	switch {
+	case modes == nil && v.Mode != "":
+		return fmt.Errorf("vif: 'mode' does not apply to %s", v.Type)
+	case modes != nil && v.Mode == "":
+		v.Mode = modes[0]
+	case modes != nil && !slices.Contains(modes, v.Mode):
+		return fmt.Errorf("vif: invalid %s 'mode' %q (%s)", v.Type, v.Mode, strings.Join(modes, ", "))
+	}
+	if v.Type == "vlan" && (v.VLAN < 1 || v.VLAN > 4094) {
+		return fmt.Errorf("vif: 'vlan' must be between 1 and 4094")
+	}
+	if v.Type != "vlan" && v.VLAN != 0 {
+		return fmt.Errorf("vif: 'vlan' only applies to the vlan type")
+	}
+	if v.MAC != "" {
+		if v.Type == "ipvlan" {
+			return fmt.Errorf("vif: ipvlan devices share the MAC address of their parent")
+		}
+		if _, err := net.ParseMAC(v.MAC); err != nil {
+			return fmt.Errorf("vif: invalid 'mac' %q", v.MAC)
+		}
+	}
+	if v.Address != "" {
+		if _, _, err := net.ParseCIDR(v.Address); err != nil {
+			return fmt.Errorf("vif: invalid 'address' %q (IP/prefix)", v.Address)
+		}
+	}
+	if v.Tenant != "" && !vifTenantPattern.MatchString(v.Tenant) {
+		return fmt.Errorf("vif: invalid 'tenant' %q (up to 32 letters, digits, '_', '.', ':' or '-')", v.Tenant)
+	}
+	return nil
+}
+
+// create adds the device, tags it, assigns its address and brings it up. A
+// device that fails half-way is removed again.
+func (v *VirtualInterface) create(ctx context.Context) error {
+	args := []string{"link", "add", "link", v.Parent, "name", v.Name}
+	if v.MAC != "" {
+		args = append(args, "address", v.MAC)
+	}
+	args = append(args, "type", v.Type)
+	if v.Type == "vlan" {
+		args = append(args, "id", fmt.Sprint(v.VLAN))
+	} else {
+		args = append(args, "mode", v.Mode)
+	}
+	if err := runIP(ctx, args...); err != nil {
+		return fmt.Errorf("vif: failed to create '%s': %w", v.Name, err)
+	}
+	alias := vifAlias
+	if v.Tenant != "" {
+		alias += "/" + v.Tenant
+	}
+	steps := [][]string{{"link", "set", "dev", v.Name, "alias", alias}}
+	if v.Address != "" {
+		steps = append(steps, []string{"addr", "add", v.Address, "dev", v.Name})
+	}
+	steps = append(steps, []string{"link", "set", "dev", v.Name, "up"})
+	for _, step := range steps {
+		if err := runIP(ctx, step...); err != nil {
+			if derr := runIP(context.WithoutCancel(ctx), "link", "del", v.Name); derr != nil {
+				log.Printf("[ERROR] VIF: Failed to remove the half-created %s: %v", v.Name, derr)
+			}
+			return fmt.Errorf("vif: failed to set up '%s': %w", v.Name, err)
+		}
+	}
+	return nil
+}
+
+// ipLink is the part of 'ip -j -d link show' read here.
+type ipLink struct {
+	Name     string   `json:"ifname"`
+	Link     string   `json:"link"`
+	Address  string   `json:"address"`
+	Flags    []string `json:"flags"`
+	Alias    string   `json:"ifalias"`
+	LinkInfo struct {
+		Kind string `json:"info_kind"`
+		Data struct {
+			Mode string `json:"mode"`
+			ID   int    `json:"id"`
+		} `json:"info_data"`
+	} `json:"linkinfo"`
+}
+
+// listVirtualInterfaces returns the virtual interfaces created by the tool.
+func listVirtualInterfaces(ctx context.Context) ([]*VirtualInterface, error) {
+	out, err := command(ctx, "ip", "-j", "-d", "link", "show").Output()
+	if err != nil {
+		return nil, fmt.Errorf("ip link show: %w", err)
+	}
+	var links []ipLink
+	if err := json.Unmarshal(out, &links); err != nil {
+		return nil, fmt.Errorf("ip link show: %w", err)
+	}
+	list := []*VirtualInterface{}
+	for _, l := range links {
+		tenant, ok := strings.CutPrefix(l.Alias, vifAlias)
+		if !ok || (tenant != "" && tenant[0] != '/') {
+			continue
+		}
+		v := &VirtualInterface{Name: l.Name, Type: l.LinkInfo.Kind, Parent: l.Link, Mode: l.LinkInfo.Data.Mode,
+			Tenant: strings.TrimPrefix(tenant, "/"), Up: slices.Contains(l.Flags, "UP"), Addresses: []string{}}
+		switch v.Type {
+		case "vlan":
+			v.VLAN, v.Mode = l.LinkInfo.Data.ID, ""
+		case "macvlan":
+			v.MAC = l.Address
+		}
+		v.Mode = strings.ToLower(v.Mode)
+		if iface, err := net.InterfaceByName(l.Name); err == nil {
+			if addrs, err := iface.Addrs(); err == nil {
+				for _, a := range addrs {
+					v.Addresses = append(v.Addresses, a.String())
+				}
+			}
+		}
+		if rule := store.Get(l.Name, ""); rule != nil {
+			v.Rule = rule.ID
+		}
+		list = append(list, v)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name < list[j].Name })
+	return list, nil
+}
+
+// findVirtualInterface returns the virtual interface name, or nil.
+func findVirtualInterface(ctx context.Context, name string) (*VirtualInterface, error) {
+	list, err := listVirtualInterfaces(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range list {
+		if v.Name == name {
+			return v, nil
+		}
+	}
+	return nil, nil
+}
+
+// deleteVirtualInterface resets the rule of a virtual interface and
+// removes it. Must be called with applyMu held.
+func deleteVirtualInterface(ctx context.Context, name string, actor Actor) error {
+	sched.StopIface(name)
+	removeMirror(ctx, name)
+	if err := cleanupSingleInterface(ctx, name); err != nil {
+		return fmt.Errorf("vif: failed to reset '%s': %w", name, err)
+	}
+	store.Delete(name, actor)
+	if err := runIP(ctx, "link", "del", name); err != nil {
+		return fmt.Errorf("vif: failed to delete '%s': %w", name, err)
+	}
+	return nil
+}
+
+// --- Handlers: /vifs ---
+
+// handleVifList returns the virtual interfaces created by the tool, with
+// the id of their rules.
+func handleVifList(w http.ResponseWriter, r *http.Request) {
+	if isDarwin {
+		respondWithJSON(w, http.StatusOK, []*VirtualInterface{})
+		return
+	}
+	list, err := listVirtualInterfaces(r.Context())
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("vif: failed to list devices: %v", err), 500)
+		return
+	}
+	if tenant := r.URL.Query().Get("tenant"); tenant != "" {
+		filtered := []*VirtualInterface{}
+		for _, v := range list {
+			if v.Tenant == tenant {
+				filtered = append(filtered, v)
+			}
+		}
+		list = filtered
+	}
+	respondWithJSON(w, http.StatusOK, list)
+}
+
+// handleVifGet returns one virtual interface.
+func handleVifGet(w http.ResponseWriter, r *http.Request) {
+	name := chi.URLParam(r, "name")
+	v, err := findVirtualInterface(r.Context(), name)
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("vif: failed to list devices: %v", err), 500)
+		return
+	}
+	if v == nil {
+		respondWithError(w, fmt.Sprintf("vif: no virtual interface '%s'", name), 404)
+		return
+	}
+	respondWithJSON(w, http.StatusOK, v)
+}
+
+// handleVifCreate creates a virtual interface on a parent NIC, ready for
+// its own rule.
+func handleVifCreate(w http.ResponseWriter, r *http.Request) {
+	v := &VirtualInterface{}
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		respondWithError(w, fmt.Sprintf("invalid vif JSON: %v", err), 400)
+		return
+	}
+	v.Name = chi.URLParam(r, "name")
+	if isDarwin {
+		log.Println("[INFO] VIF: Darwin: Ignoring vif create")
+		respondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if err := v.validate(); err != nil {
+		respondWithLocalizedError(w, r, 400, err)
+		return
+	}
+	if _, err := net.InterfaceByName(v.Name); err == nil {
+		respondWithError(w, fmt.Sprintf("vif: '%s' already exists", v.Name), 409)
+		return
+	}
+	if err := v.create(r.Context()); err != nil {
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	log.Printf("[INFO] VIF: Created %s (%s on %s, tenant %q)", v.Name, v.Type, v.Parent, v.Tenant)
+	created, err := findVirtualInterface(r.Context(), v.Name)
+	if err != nil || created == nil {
+		respondWithJSON(w, http.StatusCreated, v)
+		return
+	}
+	respondWithJSON(w, http.StatusCreated, created)
+}
+
+// handleVifDelete resets the rule of a virtual interface and removes it.
+// Interfaces not created by the tool are refused.
+func handleVifDelete(w http.ResponseWriter, r *http.Request) {
+	ctx := r.Context()
+	name := chi.URLParam(r, "name")
+	if isDarwin {
+		log.Println("[INFO] VIF: Darwin: Ignoring vif delete")
+		respondWithJSON(w, http.StatusOK, nil)
+		return
+	}
+
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	v, err := findVirtualInterface(ctx, name)
+	if err != nil {
+		respondWithError(w, fmt.Sprintf("vif: failed to list devices: %v", err), 500)
+		return
+	}
+	if v == nil {
+		if _, err := net.InterfaceByName(name); err == nil {
+			respondWithError(w, fmt.Sprintf("vif: '%s' was not created by netsim", name), 409)
+			return
+		}
+		respondWithError(w, fmt.Sprintf("vif: no virtual interface '%s'", name), 404)
+		return
+	}
+	if err := deleteVirtualInterface(ctx, name, actorFromRequest(r)); err != nil {
+		respondWithError(w, err.Error(), 500)
+		return
+	}
+	log.Printf("[INFO] VIF: Deleted %s (rule: %q)", name, v.Rule)
+	respondWithJSON(w, http.StatusOK, map[string]interface{}{"deleted": name, "rule": v.Rule})
+}
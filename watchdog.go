@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// --- Safe-Mode Watchdog (Dead-Man Switch) ---
+
+// watchdog resets all impairments when the box looks unreachable: either a
+// configured control host stops answering, or no keepalive call arrives in
+// time. It protects remote boxes from being "bricked" by their own rules.
+type watchdog struct {
+	mu            sync.Mutex
+	controlHost   string        // host:port probed over TCP (optional)
+	maxFailures   int           // consecutive probe failures before tripping
+	keepalive     time.Duration // max time between keepalive calls (optional)
+	interval      time.Duration
+	lastKeepalive time.Time
+	failures      int
+	tripped       bool
+	lastTrip      time.Time
+	lastReason    string
+}
+
+// safeMode is the process-wide watchdog. It is disabled unless configured.
+var safeMode = &watchdog{}
+
+// configureWatchdog reads the WATCHDOG_* environment variables and returns
+// false when the watchdog is not enabled.
+func configureWatchdog() bool {
+	safeMode.controlHost = os.Getenv("WATCHDOG_CONTROL_HOST")
+	safeMode.keepalive = envDuration("WATCHDOG_KEEPALIVE_TIMEOUT", 0)
+	safeMode.interval = envDuration("WATCHDOG_INTERVAL", 10*time.Second)
+	safeMode.maxFailures = 3
+	if v, err := strconv.Atoi(os.Getenv("WATCHDOG_FAILURES")); err == nil && v > 0 {
+		safeMode.maxFailures = v
+	}
+	safeMode.lastKeepalive = time.Now()
+	return safeMode.controlHost != "" || safeMode.keepalive > 0
+}
+
+// startWatchdog runs the watchdog checks until ctx is cancelled.
+func startWatchdog(ctx context.Context) {
+	log.Printf("[INFO] WATCHDOG: Safe-mode enabled (controlHost=%q, keepaliveTimeout=%v, interval=%v, failures=%d)",
+		safeMode.controlHost, safeMode.keepalive, safeMode.interval, safeMode.maxFailures)
+	go func() {
+		ticker := time.NewTicker(safeMode.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				if reason := safeMode.check(); reason != "" {
+					safeMode.trip(ctx, reason)
+				}
+			}
+		}
+	}()
+}
+
+// check returns a non-empty reason when the watchdog should trip.
+func (wd *watchdog) check() string {
+	if wd.controlHost != "" {
+		conn, err := net.DialTimeout("tcp", wd.controlHost, 3*time.Second)
+		wd.mu.Lock()
+		if err != nil {
+			wd.failures++
+			log.Printf("[WARN] WATCHDOG: Control host %s unreachable (%d/%d): %v", wd.controlHost, wd.failures, wd.maxFailures, err)
+		} else {
+			conn.Close()
+			wd.failures = 0
+			if wd.keepalive == 0 || time.Since(wd.lastKeepalive) <= wd.keepalive {
+				wd.tripped = false
+			}
+		}
+		failures := wd.failures
+		wd.mu.Unlock()
+		if failures >= wd.maxFailures {
+			return fmt.Sprintf("control host %s unreachable %d times in a row", wd.controlHost, failures)
+		}
+	}
+
+	if wd.keepalive > 0 {
+		wd.mu.Lock()
+		since := time.Since(wd.lastKeepalive)
+		wd.mu.Unlock()
+		if since > wd.keepalive {
+			return fmt.Sprintf("no keepalive for %v (timeout %v)", since.Round(time.Second), wd.keepalive)
+		}
+	}
+	return ""
+}
+
+// trip resets every impairment once per incident.
+func (wd *watchdog) trip(ctx context.Context, reason string) {
+	wd.mu.Lock()
+	if wd.tripped {
+		wd.mu.Unlock()
+		return
+	}
+	wd.tripped = true
+	wd.lastTrip = time.Now()
+	wd.lastReason = reason
+	wd.mu.Unlock()
+
+	log.Printf("[WARN] WATCHDOG: Tripped (%s). Resetting all impairments...", reason)
+	if isDarwin {
+		return
+	}
+	applyMu.Lock()
+	defer applyMu.Unlock()
+	if _, failures := resetAllInterfaces(ctx); len(failures) > 0 {
+		log.Printf("[ERROR] WATCHDOG: Reset finished with errors: %v", failures)
+	}
+}
+
+// --- Handlers: /watchdog ---
+
+// handleWatchdogKeepalive feeds the dead-man switch and re-arms it.
+func handleWatchdogKeepalive(w http.ResponseWriter, r *http.Request) {
+	safeMode.mu.Lock()
+	safeMode.lastKeepalive = time.Now()
+	if safeMode.failures < safeMode.maxFailures {
+		safeMode.tripped = false
+	}
+	safeMode.mu.Unlock()
+	handleWatchdogStatus(w, r)
+}
+
+// handleWatchdogStatus reports the watchdog configuration and state.
+func handleWatchdogStatus(w http.ResponseWriter, r *http.Request) {
+	safeMode.mu.Lock()
+	defer safeMode.mu.Unlock()
+	status := map[string]interface{}{
+		"enabled":       safeMode.controlHost != "" || safeMode.keepalive > 0,
+		"controlHost":   safeMode.controlHost,
+		"failures":      safeMode.failures,
+		"maxFailures":   safeMode.maxFailures,
+		"tripped":       safeMode.tripped,
+		"lastKeepalive": TcTime(safeMode.lastKeepalive),
+	}
+	if safeMode.keepalive > 0 {
+		status["keepaliveTimeout"] = safeMode.keepalive.String()
+	}
+	if !safeMode.lastTrip.IsZero() {
+		status["lastTrip"] = TcTime(safeMode.lastTrip)
+		status["lastReason"] = safeMode.lastReason
+	}
+	respondWithJSON(w, http.StatusOK, status)
+}